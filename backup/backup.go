@@ -0,0 +1,305 @@
+/*
+Package backup uploads the applied lb configs to an S3 compatible bucket
+for disaster recovery and audit.
+
+Every backup is stored under <prefix>/<time>/, and holds the config file
+rendered by the provider along with a manifest of the certs of the
+applied configs. The manifest lists the cert names, hostnames, expiry
+and fingerprints, cert keys are never uploaded. Backups older than the
+retention are removed, the last ones being always kept.
+*/
+package backup
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+const (
+	manifestFile = "manifest.json"
+	timeFormat   = "20060102T150405Z"
+)
+
+var (
+	s3Bucket        = flags.String("BACKUP_S3_BUCKET", "", "Bucket the applied configs are backed up to, backups are disabled when not set")
+	s3Endpoint      = flags.String("BACKUP_S3_ENDPOINT", "https://s3.amazonaws.com", "Url of the S3 compatible object storage")
+	s3Region        = flags.String("BACKUP_S3_REGION", "us-east-1", "Region of the bucket")
+	s3AccessKey     = flags.String("BACKUP_S3_ACCESS_KEY", "", "Access key of the bucket, AWS_ACCESS_KEY_ID is used when not set")
+	s3SecretKey     = flags.Secret("BACKUP_S3_SECRET_KEY", "Secret key of the bucket, AWS_SECRET_ACCESS_KEY is used when not set")
+	backupPrefix    = flags.String("BACKUP_PREFIX", "lb-controller", "Key prefix of the backups in the bucket")
+	backupInterval  = flags.Duration("BACKUP_INTERVAL", time.Hour, "Interval of the backups, a backup is made only when a config was applied since the last one")
+	backupRetention = flags.Duration("BACKUP_RETENTION", 30*24*time.Hour, "Backups older than the retention are removed, 0 keeps them all")
+	backupKeepLast  = flags.Int("BACKUP_KEEP_LAST", 10, "Number of last backups kept regardless of the retention").Range(1, 100000)
+)
+
+// ObjectStore stores the backup files
+type ObjectStore interface {
+	Put(key string, data []byte) error
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// Manifest describes the applied configs of a backup
+type Manifest struct {
+	Time    time.Time         `json:"time"`
+	Configs []*ConfigManifest `json:"configs"`
+}
+
+// ConfigManifest lists the certs of an applied config
+type ConfigManifest struct {
+	Name  string          `json:"name"`
+	Certs []*CertManifest `json:"certs"`
+}
+
+// CertManifest describes a cert, without its key
+type CertManifest struct {
+	Name      string     `json:"name"`
+	Default   bool       `json:"default,omitempty"`
+	Bundle    string     `json:"bundle,omitempty"`
+	KeyType   string     `json:"key_type,omitempty"`
+	Hostnames []string   `json:"hostnames,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	DNSNames  []string   `json:"dns_names,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	// Fingerprint is the sha256 of the leaf cert, or of the cert
+	// content when it can't be parsed
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Uploader is an apply hook recording the applied configs, and
+// uploading them periodically along with the rendered config
+type Uploader struct {
+	Store     ObjectStore
+	Renderer  provider.RenderedConfigProvider
+	Prefix    string
+	Interval  time.Duration
+	Retention time.Duration
+	KeepLast  int
+
+	mu      sync.Mutex
+	configs map[string]*ConfigManifest
+	dirty   bool
+	now     func() time.Time
+}
+
+// NewUploaderFromEnv configures the uploader from the BACKUP_* env vars.
+// Nil is returned when no bucket is set
+func NewUploaderFromEnv(lbp provider.LBProvider) (*Uploader, error) {
+	if s3Bucket.Get() == "" {
+		return nil, nil
+	}
+	accessKey, secretKey := s3AccessKey.Get(), s3SecretKey.Get()
+	sessionToken := ""
+	if accessKey == "" {
+		accessKey, secretKey, sessionToken = flags.AWSAccessKeyID.Get(), flags.AWSSecretAccessKey.Get(), flags.AWSSessionToken.Get()
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("BACKUP_S3_ACCESS_KEY and BACKUP_S3_SECRET_KEY, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY should be set")
+	}
+	if backupInterval.Get() <= 0 {
+		return nil, fmt.Errorf("Invalid BACKUP_INTERVAL %v", backupInterval.Get())
+	}
+	u := NewUploader(newS3Store(s3Endpoint.Get(), s3Bucket.Get(), s3Region.Get(), accessKey, secretKey, sessionToken))
+	if renderer, ok := lbp.(provider.RenderedConfigProvider); ok {
+		u.Renderer = renderer
+	}
+	u.Prefix = strings.Trim(backupPrefix.Get(), "/")
+	u.Interval = backupInterval.Get()
+	u.Retention = backupRetention.Get()
+	u.KeepLast = backupKeepLast.Get()
+	return u, nil
+}
+
+func NewUploader(store ObjectStore) *Uploader {
+	return &Uploader{
+		Store:     store,
+		Prefix:    backupPrefix.Default.(string),
+		Interval:  backupInterval.Default.(time.Duration),
+		Retention: backupRetention.Default.(time.Duration),
+		KeepLast:  backupKeepLast.Default.(int),
+		configs:   map[string]*ConfigManifest{},
+		now:       time.Now,
+	}
+}
+
+func (u *Uploader) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply records the certs of the config once it's applied
+func (u *Uploader) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	manifest := newConfigManifest(lbConfig)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.configs[lbConfig.Name] = manifest
+	u.dirty = true
+	return nil
+}
+
+func (u *Uploader) PostCleanup(configName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.configs, configName)
+	u.dirty = true
+	return nil
+}
+
+// Run backs up the applied configs every interval until stopCh is closed
+func (u *Uploader) Run(stopCh chan struct{}) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := u.Backup(); err != nil {
+				logrus.Errorf("Failed to back up the lb configs: %v", err)
+			}
+		}
+	}
+}
+
+// Backup uploads the applied configs when they changed since the
+// last backup, and removes the backups past the retention
+func (u *Uploader) Backup() error {
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	now := u.now().UTC()
+	manifest := &Manifest{Time: now, Configs: []*ConfigManifest{}}
+	for _, c := range u.configs {
+		manifest.Configs = append(manifest.Configs, c)
+	}
+	u.dirty = false
+	u.mu.Unlock()
+	sort.Slice(manifest.Configs, func(i, j int) bool { return manifest.Configs[i].Name < manifest.Configs[j].Name })
+
+	if err := u.upload(now, manifest); err != nil {
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+		return err
+	}
+	return u.prune(now)
+}
+
+func (u *Uploader) upload(now time.Time, manifest *Manifest) error {
+	dir := path.Join(u.Prefix, now.Format(timeFormat))
+	if u.Renderer != nil {
+		name, data, err := u.Renderer.GetRenderedConfig()
+		if err != nil {
+			return fmt.Errorf("failed to read rendered config: %v", err)
+		}
+		if err := u.Store.Put(path.Join(dir, name), data); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the manifest is uploaded last, a backup without it is incomplete
+	if err := u.Store.Put(path.Join(dir, manifestFile), data); err != nil {
+		return err
+	}
+	logrus.Infof("Backed up %v lb configs to %s", len(manifest.Configs), dir)
+	return nil
+}
+
+// prune removes the backups older than the retention, except the last ones
+func (u *Uploader) prune(now time.Time) error {
+	if u.Retention <= 0 {
+		return nil
+	}
+	keys, err := u.Store.List(u.Prefix + "/")
+	if err != nil {
+		return err
+	}
+	backups := map[string][]string{}
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, u.Prefix+"/")
+		i := strings.Index(rel, "/")
+		if i < 0 {
+			continue
+		}
+		backups[rel[:i]] = append(backups[rel[:i]], key)
+	}
+	var times []string
+	for t := range backups {
+		times = append(times, t)
+	}
+	// newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(times)))
+	for i, t := range times {
+		if i < u.KeepLast {
+			continue
+		}
+		backupTime, err := time.Parse(timeFormat, t)
+		if err != nil || now.Sub(backupTime) <= u.Retention {
+			continue
+		}
+		for _, key := range backups[t] {
+			if err := u.Store.Delete(key); err != nil {
+				return err
+			}
+		}
+		logrus.Infof("Removed backup %s/%s past the retention", u.Prefix, t)
+	}
+	return nil
+}
+
+func newConfigManifest(lbConfig *config.LoadBalancerConfig) *ConfigManifest {
+	manifest := &ConfigManifest{Name: lbConfig.Name, Certs: []*CertManifest{}}
+	if lbConfig.DefaultCert != nil {
+		cert := newCertManifest(lbConfig.DefaultCert)
+		cert.Default = true
+		manifest.Certs = append(manifest.Certs, cert)
+	}
+	for _, cert := range lbConfig.Certs {
+		manifest.Certs = append(manifest.Certs, newCertManifest(cert))
+	}
+	return manifest
+}
+
+func newCertManifest(cert *config.Certificate) *CertManifest {
+	m := &CertManifest{
+		Name:      cert.Name,
+		Bundle:    cert.Bundle,
+		KeyType:   cert.KeyType,
+		Hostnames: cert.Hostnames,
+	}
+	if block, _ := pem.Decode([]byte(cert.Cert)); block != nil && block.Type == "CERTIFICATE" {
+		if leaf, err := x509.ParseCertificate(block.Bytes); err == nil {
+			sum := sha256.Sum256(leaf.Raw)
+			notAfter := leaf.NotAfter.UTC()
+			m.Subject = leaf.Subject.CommonName
+			m.DNSNames = leaf.DNSNames
+			m.NotAfter = &notAfter
+			m.Fingerprint = hex.EncodeToString(sum[:])
+			return m
+		}
+	}
+	sum := sha256.Sum256([]byte(cert.Cert))
+	m.Fingerprint = hex.EncodeToString(sum[:])
+	return m
+}
@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+type tStore struct {
+	objects map[string][]byte
+}
+
+func (s *tStore) Put(key string, data []byte) error {
+	s.objects[key] = data
+	return nil
+}
+
+func (s *tStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *tStore) Delete(key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+type tRenderer struct{}
+
+func (r tRenderer) GetRenderedConfig() (string, []byte, error) {
+	return "haproxy.cfg", []byte("frontend 80"), nil
+}
+
+func TestBackup(t *testing.T) {
+	store := &tStore{objects: map[string][]byte{}}
+	u := NewUploader(store)
+	u.Renderer = tRenderer{}
+	u.Retention = 24 * time.Hour
+	u.KeepLast = 2
+	now := time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+	u.now = func() time.Time { return now }
+
+	if err := u.Backup(); err != nil || len(store.objects) != 0 {
+		t.Fatalf("Nothing should be backed up before an apply %v %v", err, store.objects)
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Name:  "lb",
+		Certs: []*config.Certificate{{Name: "foo", Cert: "not a pem", Key: "secret key", Hostnames: []string{"foo.com"}}},
+	}
+	if err := u.PostApply(lbConfig, fmt.Errorf("apply failed")); err != nil || u.dirty {
+		t.Fatalf("Failed applies should not be backed up")
+	}
+	u.PostApply(lbConfig, nil)
+	if err := u.Backup(); err != nil {
+		t.Fatalf("Backup failed %v", err)
+	}
+	if string(store.objects["lb-controller/20171001T000000Z/haproxy.cfg"]) != "frontend 80" {
+		t.Fatalf("Rendered config is not backed up %v", store.objects)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(store.objects["lb-controller/20171001T000000Z/manifest.json"], manifest); err != nil {
+		t.Fatalf("Invalid manifest %v", err)
+	}
+	if len(manifest.Configs) != 1 || manifest.Configs[0].Name != "lb" || len(manifest.Configs[0].Certs) != 1 ||
+		!reflect.DeepEqual(manifest.Configs[0].Certs[0].Hostnames, []string{"foo.com"}) || manifest.Configs[0].Certs[0].Fingerprint == "" {
+		t.Fatalf("Invalid manifest %+v", manifest)
+	}
+
+	// the last two backups are kept, the older ones removed past the retention
+	u.PostApply(lbConfig, nil)
+	now = now.Add(time.Hour)
+	u.Backup()
+	u.PostApply(lbConfig, nil)
+	now = now.Add(48 * time.Hour)
+	u.Backup()
+	keys, _ := store.List("")
+	expected := []string{
+		"lb-controller/20171001T010000Z/haproxy.cfg",
+		"lb-controller/20171001T010000Z/manifest.json",
+		"lb-controller/20171003T010000Z/haproxy.cfg",
+		"lb-controller/20171003T010000Z/manifest.json",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Invalid backups after prune %v", keys)
+	}
+}
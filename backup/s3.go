@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/lb-controller/utils/sigv4"
+)
+
+// s3Store stores the objects in an S3 compatible bucket,
+// addressed in path style so any endpoint works
+type s3Store struct {
+	endpoint string
+	bucket   string
+	signer   *sigv4.Signer
+	client   *http.Client
+}
+
+type s3ListResponse struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newS3Store(endpoint, bucket, region, accessKey, secretKey, sessionToken string) *s3Store {
+	return &s3Store{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   bucket,
+		signer: &sigv4.Signer{
+			AccessKey:    accessKey,
+			SecretKey:    secretKey,
+			SessionToken: sessionToken,
+			Region:       region,
+			Service:      "s3",
+		},
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (s *s3Store) Put(key string, data []byte) error {
+	_, err := s.do("PUT", key, nil, data)
+	return err
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.do("DELETE", key, nil, nil)
+	return err
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	keys := []string{}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	for {
+		data, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp := &s3ListResponse{}
+		if err := xml.Unmarshal(data, resp); err != nil {
+			return nil, err
+		}
+		for _, c := range resp.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !resp.IsTruncated || resp.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", resp.NextContinuationToken)
+	}
+}
+
+func (s *s3Store) do(method string, key string, query url.Values, body []byte) ([]byte, error) {
+	u := fmt.Sprintf("%s/%s", s.endpoint, s.bucket)
+	if key != "" {
+		u += "/" + escapeKey(key)
+	}
+	if len(query) > 0 {
+		u += "?" + sigv4.CanonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.signer.Sign(req, body)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		s3Err := &s3Error{}
+		if err := xml.Unmarshal(data, s3Err); err == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("s3 error %s: %s", s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("s3 request failed with status %s", resp.Status)
+	}
+	return data, nil
+}
+
+// escapeKey escapes the path segments of the key
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,273 @@
+/*
+Package bgp announces the service ips of the lbs to the upstream routers
+from every healthy lb host, so the routers spread the traffic over the
+hosts with ecmp.
+
+The routes are announced by a gobgpd daemon run along the controller,
+the speaker configures its peering and adds and removes the routes of
+its rib through the gobgp cli. An instance withdraws its routes while
+its controller or provider is unhealthy, and the routers drop them
+when the daemon stops with the lb.
+*/
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	localAS        = flags.String("BGP_LOCAL_AS", "", "AS number the lb hosts announce the service ips from, the bgp speaker runs when set")
+	routerID       = flags.String("BGP_ROUTER_ID", "", "BGP router id, the first ipv4 of the host interfaces when not set")
+	neighbors      = flags.String("BGP_NEIGHBORS", "", "Comma separated list of the upstream routers as ip:as, [ip]:as for ipv6")
+	daemonConfig   = flags.String("BGP_CONFIG", "/etc/gobgp/gobgpd.conf", "Path of the gobgpd config")
+	daemonStartCmd = flags.String("BGP_START_CMD", "gobgpd_start /etc/gobgp/gobgpd.conf", "Command starting gobgpd, or reloading its config when running")
+	cliCmd         = flags.String("BGP_CLI", "gobgp", "gobgp cli the routes are added to the rib of gobgpd with")
+	healthInterval = flags.Duration("BGP_HEALTH_INTERVAL", 5*time.Second, "Interval the health of the instance is checked at, its routes are withdrawn while unhealthy")
+)
+
+// RIB holds the routes of the service ips the speaker announces
+type RIB interface {
+	Announce(ip string) error
+	Withdraw(ip string) error
+}
+
+/*
+Speaker announces the service ips of the applied configs while the
+instance is healthy. It is invoked as an apply hook of the lb provider,
+and checks the health every interval while it runs
+*/
+type Speaker struct {
+	RIB RIB
+	// Daemon is started with the speaker, when set
+	Daemon *Daemon
+	// Health tells whether the instance takes traffic
+	Health   func() bool
+	Interval time.Duration
+
+	mu sync.Mutex
+	// serviceIPs are the ips of the applied configs by name
+	serviceIPs map[string][]string
+	announced  map[string]bool
+	healthy    bool
+}
+
+// NewSpeakerFromEnv configures the speaker from the BGP_* env vars,
+// nil is returned when BGP_LOCAL_AS is not set
+func NewSpeakerFromEnv(health func() bool) (*Speaker, error) {
+	if localAS.Get() == "" {
+		return nil, nil
+	}
+	as, err := parseAS(localAS.Get())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid BGP_LOCAL_AS %s, should be a 32 bits as number", localAS.Get())
+	}
+	d := &Daemon{
+		Config:   daemonConfig.Get(),
+		StartCmd: daemonStartCmd.Get(),
+		LocalAS:  as,
+		RouterID: routerID.Get(),
+	}
+	if d.RouterID == "" {
+		var err error
+		if d.RouterID, err = firstIPv4(); err != nil {
+			return nil, err
+		}
+	} else if ip := net.ParseIP(d.RouterID); ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("Invalid BGP_ROUTER_ID %s, should be an ipv4", d.RouterID)
+	}
+	if d.Neighbors, err = parseNeighbors(neighbors.Get()); err != nil {
+		return nil, err
+	}
+	if len(d.Neighbors) == 0 {
+		return nil, fmt.Errorf("BGP_NEIGHBORS is not set")
+	}
+	return &Speaker{
+		RIB:      &gobgpCLI{Cmd: cliCmd.Get()},
+		Daemon:   d,
+		Health:   health,
+		Interval: healthInterval.Get(),
+	}, nil
+}
+
+// parseNeighbors parses the ip:as list of the neighbors
+func parseNeighbors(value string) ([]Neighbor, error) {
+	var result []Neighbor
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid BGP neighbor %s, should be ip:as", entry)
+		}
+		as, err := parseAS(port)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid BGP neighbor %s, invalid as %s", entry, port)
+		}
+		result = append(result, Neighbor{Address: host, AS: as})
+	}
+	return result, nil
+}
+
+// parseAS parses a non zero 32 bits as number
+func parseAS(value string) (uint32, error) {
+	as, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if as == 0 {
+		return 0, fmt.Errorf("as 0 is reserved")
+	}
+	return uint32(as), nil
+}
+
+// firstIPv4 returns the first ipv4 of the up interfaces, but the loopback
+func firstIPv4() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ipNet.IP.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No ipv4 found for the bgp router id, set BGP_ROUTER_ID")
+}
+
+// PreApply is a no-op, the routes are announced once the config is applied
+func (s *Speaker) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply announces the service ips of the applied config
+func (s *Speaker) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.serviceIPs == nil {
+		s.serviceIPs = map[string][]string{}
+	}
+	s.serviceIPs[lbConfig.Name] = lbConfig.ServiceIPs
+	return s.syncLocked()
+}
+
+// PostCleanup withdraws the service ips of the removed config
+func (s *Speaker) PostCleanup(configName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.serviceIPs, configName)
+	return s.syncLocked()
+}
+
+// Run starts the daemon, then checks the health every interval
+// until stopCh is closed
+func (s *Speaker) Run(stopCh <-chan struct{}) {
+	if s.Daemon != nil {
+		if err := s.Daemon.Start(); err != nil {
+			logrus.Errorf("Failed to start the bgp daemon: %v", err)
+			return
+		}
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := s.sync(); err != nil {
+				logrus.Errorf("Failed to sync the bgp routes: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Speaker) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncLocked()
+}
+
+// syncLocked announces the service ips while healthy, and withdraws
+// the others. The routes failing are retried on the next sync
+func (s *Speaker) syncLocked() error {
+	healthy := s.Health == nil || s.Health()
+	if healthy != s.healthy {
+		if healthy {
+			logrus.Infof("Instance is healthy, announcing the bgp routes")
+		} else {
+			logrus.Warnf("Instance is unhealthy, withdrawing the bgp routes")
+		}
+		s.healthy = healthy
+	}
+	desired := map[string]bool{}
+	if healthy {
+		for _, ips := range s.serviceIPs {
+			for _, ip := range ips {
+				desired[ip] = true
+			}
+		}
+	}
+	if s.announced == nil {
+		s.announced = map[string]bool{}
+	}
+	var errs []string
+	for _, ip := range sortedKeys(desired) {
+		if s.announced[ip] {
+			continue
+		}
+		if err := s.RIB.Announce(ip); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		logrus.Infof("Announced %s over bgp", ip)
+		s.announced[ip] = true
+	}
+	for _, ip := range sortedKeys(s.announced) {
+		if desired[ip] {
+			continue
+		}
+		if err := s.RIB.Withdraw(ip); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		logrus.Infof("Withdrew %s over bgp", ip)
+		delete(s.announced, ip)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
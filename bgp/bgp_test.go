@@ -0,0 +1,128 @@
+package bgp
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+type tRIB struct {
+	routes map[string]bool
+	calls  []string
+	fail   map[string]bool
+}
+
+func (r *tRIB) Announce(ip string) error {
+	r.calls = append(r.calls, "add "+ip)
+	if r.fail[ip] {
+		return fmt.Errorf("failed to add %s", ip)
+	}
+	r.routes[ip] = true
+	return nil
+}
+
+func (r *tRIB) Withdraw(ip string) error {
+	r.calls = append(r.calls, "del "+ip)
+	delete(r.routes, ip)
+	return nil
+}
+
+func TestSpeakerSync(t *testing.T) {
+	rib := &tRIB{routes: map[string]bool{}, fail: map[string]bool{}}
+	healthy := true
+	s := &Speaker{RIB: rib, Health: func() bool { return healthy }}
+
+	lbConfig := &config.LoadBalancerConfig{Name: "lb", ServiceIPs: []string{"203.0.113.11", "203.0.113.10"}}
+	if err := s.PostApply(lbConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostApply(&config.LoadBalancerConfig{Name: "other", ServiceIPs: []string{"203.0.113.10"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"add 203.0.113.10", "add 203.0.113.11"}
+	if !reflect.DeepEqual(rib.calls, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rib.calls)
+	}
+
+	// the routes are withdrawn while unhealthy
+	rib.calls = nil
+	healthy = false
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rib.routes) != 0 {
+		t.Fatalf("Expected the routes to be withdrawn, got %v", rib.routes)
+	}
+	healthy = true
+	rib.fail["203.0.113.11"] = true
+	if err := s.sync(); err == nil {
+		t.Fatalf("Expected the failed announce to be reported")
+	}
+	rib.fail = map[string]bool{}
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rib.routes, map[string]bool{"203.0.113.10": true, "203.0.113.11": true}) {
+		t.Fatalf("Expected the routes to be announced again, got %v", rib.routes)
+	}
+
+	// the ips still served by another config are kept
+	rib.calls = nil
+	if err := s.PostCleanup("lb"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"del 203.0.113.11"}
+	if !reflect.DeepEqual(rib.calls, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rib.calls)
+	}
+}
+
+func TestParseNeighbors(t *testing.T) {
+	result, err := parseNeighbors("10.0.0.254:65000, [fd00::1]:65001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Neighbor{{Address: "10.0.0.254", AS: 65000}, {Address: "fd00::1", AS: 65001}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v, got %v", expected, result)
+	}
+	for _, invalid := range []string{"10.0.0.254", "router:65000", "10.0.0.254:0", "10.0.0.254:4294967296"} {
+		if _, err := parseNeighbors(invalid); err == nil {
+			t.Fatalf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestParseAS(t *testing.T) {
+	if as, err := parseAS("4294967295"); err != nil || as != 4294967295 {
+		t.Fatalf("Expected the largest 32 bits as, got %v %v", as, err)
+	}
+	for _, invalid := range []string{"0", "-1", "4294967296", "as65000"} {
+		if _, err := parseAS(invalid); err == nil {
+			t.Fatalf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestGobgpConfig(t *testing.T) {
+	d := &Daemon{LocalAS: 65010, RouterID: "10.0.0.1", Neighbors: []Neighbor{{Address: "10.0.0.254", AS: 65000}}}
+	rendered, err := d.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"as = 65010", `router-id = "10.0.0.1"`, `neighbor-address = "10.0.0.254"`, "peer-as = 65000"} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in the gobgpd config:\n%s", expected, rendered)
+		}
+	}
+	cli := &gobgpCLI{Cmd: "gobgp"}
+	if cmd := cli.ribCmd("add", "203.0.113.10"); cmd != "gobgp global rib add -a ipv4 203.0.113.10/32" {
+		t.Fatalf("Unexpected command %s", cmd)
+	}
+	if cmd := cli.ribCmd("del", "2001:db8::1"); cmd != "gobgp global rib del -a ipv6 2001:db8::1/128" {
+		t.Fatalf("Unexpected command %s", cmd)
+	}
+}
@@ -0,0 +1,91 @@
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"text/template"
+)
+
+// Neighbor is an upstream router the daemon peers with
+type Neighbor struct {
+	Address string
+	AS      uint32
+}
+
+// Daemon is the gobgpd the routes are announced from
+type Daemon struct {
+	Config    string
+	StartCmd  string
+	LocalAS   uint32
+	RouterID  string
+	Neighbors []Neighbor
+}
+
+var daemonTemplate = template.Must(template.New("gobgpd").Parse(`[global.config]
+  as = {{.LocalAS}}
+  router-id = "{{.RouterID}}"
+{{range .Neighbors}}
+[[neighbors]]
+  [neighbors.config]
+    neighbor-address = "{{.Address}}"
+    peer-as = {{.AS}}
+{{end -}}
+`))
+
+func (d *Daemon) render() (string, error) {
+	var b bytes.Buffer
+	if err := daemonTemplate.Execute(&b, d); err != nil {
+		return "", fmt.Errorf("Failed to render the gobgpd config: %v", err)
+	}
+	return b.String(), nil
+}
+
+// Start writes the config of the daemon and starts it
+func (d *Daemon) Start() error {
+	rendered, err := d.render()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(d.Config), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(d.Config, []byte(rendered), 0644); err != nil {
+		return fmt.Errorf("Failed to write the gobgpd config: %v", err)
+	}
+	return runCmd(d.StartCmd)
+}
+
+// gobgpCLI updates the global rib of the daemon through the gobgp cli
+type gobgpCLI struct {
+	Cmd string
+}
+
+func (c *gobgpCLI) Announce(ip string) error {
+	return runCmd(c.ribCmd("add", ip))
+}
+
+func (c *gobgpCLI) Withdraw(ip string) error {
+	return runCmd(c.ribCmd("del", ip))
+}
+
+// ribCmd is the gobgp command adding or deleting the host route of the ip
+func (c *gobgpCLI) ribCmd(action string, ip string) string {
+	family, prefix := "ipv4", "32"
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		family, prefix = "ipv6", "128"
+	}
+	return fmt.Sprintf("%s global rib %s -a %s %s/%s", c.Cmd, action, family, ip, prefix)
+}
+
+func runCmd(cmd string) error {
+	output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v -- %v", cmd, err, string(output))
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"encoding/json"
 	"strings"
+	"time"
 )
 
 type BackendServices []*BackendService
@@ -33,6 +35,19 @@ type HealthCheck struct {
 	UnhealthyThreshold int    `json:"unhealthy_threshold"`
 	RequestLine        string `json:"request_line"`
 	Port               int    `json:"port"`
+	// Expect is matched against the responses of the http checks,
+	// in addition to the 2xx and 3xx statuses when nil
+	Expect *HealthCheckExpect `json:"expect,omitempty"`
+}
+
+// HealthCheckExpect is the response expected by the http checks. Match
+// is one of status, rstatus, string, rstring and header, Header being
+// the name of the header whose value is the Pattern. Header matches
+// require haproxy 2.2 or later
+type HealthCheckExpect struct {
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	Header  string `json:"header,omitempty"`
 }
 
 type StickinessPolicy struct {
@@ -46,52 +61,336 @@ type StickinessPolicy struct {
 }
 
 type BackendService struct {
-	UUID           string
-	Endpoints      Endpoints
-	Path           string
-	Host           string
-	RuleComparator string
-	Algorithm      string
-	Port           int
-	Protocol       string
-	Config         string
-	HealthCheck    *HealthCheck
-	Priority       int
-	SendProxy      bool
+	UUID           string       `json:"uuid"`
+	Endpoints      Endpoints    `json:"endpoints"`
+	Path           string       `json:"path"`
+	Host           string       `json:"host"`
+	RuleComparator string       `json:"rule_comparator"`
+	Algorithm      string       `json:"algorithm"`
+	Port           int          `json:"port"`
+	Protocol       string       `json:"protocol"`
+	Config         string       `json:"config"`
+	HealthCheck    *HealthCheck `json:"health_check"`
+	Priority       int          `json:"priority"`
+	SendProxy      bool         `json:"send_proxy"`
+	Redirect       *Redirect    `json:"redirect"`
+	KeepAlive      *KeepAlive   `json:"keep_alive"`
+	// CheckPort is the port the health checks hit instead of the
+	// health check port, so the checks and the traffic can use
+	// different ports of the endpoints
+	CheckPort int `json:"check_port"`
+	// Transparent connects to the endpoints from the client ip, so
+	// they see the real client source ip without the proxy protocol
+	Transparent bool `json:"transparent"`
+	// DebugCapture captures the requests of the backend for debugging
+	DebugCapture *DebugCapture `json:"debug_capture"`
+	// RequestLogging logs the requests of the backend for debugging
+	RequestLogging *RequestLogging `json:"request_logging"`
+	// Fault injects delays and errors in the requests of the backend
+	Fault *Fault `json:"fault"`
+	// InitState is the state of the checked endpoints added to the backend
+	InitState *InitState `json:"init_state"`
+	// AgentCheck polls an agent of the endpoints reporting their weight
+	AgentCheck *AgentCheck `json:"agent_check"`
+	// LuaHooks are run on the requests of the backend
+	LuaHooks []*LuaHook `json:"lua_hooks"`
+	// Environment is the uuid of the environment of the rule
+	Environment string `json:"environment"`
+	// MetricsTag labels the stats and the metrics of the backend
+	MetricsTag string `json:"metrics_tag"`
+	// H2 talks HTTP/2 cleartext to the servers of the http backend
+	H2 bool `json:"h2"`
+}
+
+// LuaHook runs the Action registered by the Script, a file of the
+// lua scripts dir of the provider, on the requests
+type LuaHook struct {
+	Script string `json:"script"`
+	Action string `json:"action"`
+}
+
+// AgentCheck is the haproxy agent-check of the endpoints, the agent
+// listening on Port answers with their weight or state every InterMs
+type AgentCheck struct {
+	Port    int `json:"port"`
+	InterMs int `json:"inter_ms"`
+}
+
+// InitState holds the state the checked endpoints start in, Down keeps
+// them out of the traffic until their first successful check (haproxy
+// 3.1 or later), and SlowStartMs ramps their weight up once they are
+// up, 0 being off
+type InitState struct {
+	Down        bool `json:"down"`
+	SlowStartMs int  `json:"slow_start_ms"`
+}
+
+// Fault delays DelayPercent of the requests by DelayMs, and answers
+// AbortPercent of them with AbortStatus, percents are from 0 to 100
+type Fault struct {
+	DelayMs      int `json:"delay_ms"`
+	DelayPercent int `json:"delay_percent"`
+	AbortStatus  int `json:"abort_status"`
+	AbortPercent int `json:"abort_percent"`
+	// Until is the end of the faults injected through the admin api,
+	// the faults of the labels last as long as their label
+	Until time.Time `json:"until,omitempty"`
+}
+
+// DebugCapture describes a time limited capture of the headers
+// and the truncated bodies of the requests of a backend
+type DebugCapture struct {
+	Until time.Time `json:"until"`
+}
+
+// RequestLogging describes a time limited logging of the requests
+// of a backend, one in SampleRate of them when it's above 1
+type RequestLogging struct {
+	Until      time.Time `json:"until"`
+	SampleRate int       `json:"sample_rate"`
+}
+
+// Redirect describes a rule answering with a redirect
+// instead of proxying the request to the endpoints
+type Redirect struct {
+	Code     int    `json:"code"`
+	Location string `json:"location"`
+	// Prefix keeps the original request path
+	Prefix bool `json:"prefix"`
+}
+
+// KeepAlive holds the connection reuse settings of the backend;
+// PoolPurgeDelay is a duration like 5s
+type KeepAlive struct {
+	HTTPReuse      string `json:"http_reuse"`
+	PoolPurgeDelay string `json:"pool_purge_delay"`
+	PoolMaxConn    int    `json:"pool_max_conn"`
 }
 
 type Endpoint struct {
-	Name    string
-	IP      string
-	Port    int
-	Config  string
-	IsCname bool
+	Name    string `json:"name"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	Config  string `json:"config"`
+	IsCname bool   `json:"is_cname"`
+	// HostUUID is the host the endpoint container runs on
+	HostUUID string `json:"host_uuid"`
+	// Weight is the relative share of the traffic,
+	// provider default is used when not set
+	Weight int `json:"weight"`
+	// Backup endpoints only receive traffic when all the
+	// other endpoints of the backend are down
+	Backup bool `json:"backup"`
+	// NoCheck leaves the endpoint out of the health checks
+	// of the backend, it is assumed up
+	NoCheck bool `json:"no_check"`
+	// Drain endpoints take no new traffic, only
+	// the sessions sticking to them
+	Drain bool `json:"drain"`
 }
 
 type FrontendService struct {
-	Name            string
-	Port            int
-	BackendServices BackendServices
-	Protocol        string
-	Config          string
-	AcceptProxy     bool
+	Name            string          `json:"name"`
+	Port            int             `json:"port"`
+	BackendServices BackendServices `json:"backend_services"`
+	Protocol        string          `json:"protocol"`
+	Config          string          `json:"config"`
+	AcceptProxy     bool            `json:"accept_proxy"`
+	// BindAddress is an ip or a network interface name
+	// the frontend binds to; all addresses when empty
+	BindAddress string `json:"bind_address"`
+	// Certs are the names of the certs the frontend presents, the first
+	// one is served to clients without SNI; all certs when empty
+	Certs []string `json:"certs"`
+	// H2C accepts HTTP/2 cleartext on the http frontend,
+	// next to HTTP/1.1
+	H2C bool `json:"h2c"`
+	// DetectTLS serves both TLS and plaintext clients on the port of the
+	// http or https frontend, TLS connections are terminated and routed
+	// as https, the others are routed as http
+	DetectTLS bool `json:"detect_tls"`
+	// LuaHooks are run on the requests of the frontend, before routing
+	LuaHooks []*LuaHook `json:"lua_hooks"`
+	// SPOEngines are the names of the spoe engines filtering the
+	// requests of the frontend
+	SPOEngines []string `json:"spoe_engines"`
 }
 
+// SchemaVersion is the version of the config model serialization,
+// it has to be bumped on every incompatible change of the model
+const SchemaVersion = "1"
+
 type LoadBalancerConfig struct {
-	DefaultCert      *Certificate
-	Certs            []*Certificate
-	Name             string
-	Annotations      map[string]string
-	FrontendServices FrontendServices
-	Config           string
-	StickinessPolicy *StickinessPolicy
+	Version          string            `json:"version"`
+	DefaultCert      *Certificate      `json:"default_cert"`
+	Certs            []*Certificate    `json:"certs"`
+	Name             string            `json:"name"`
+	Annotations      map[string]string `json:"annotations"`
+	FrontendServices FrontendServices  `json:"frontend_services"`
+	Config           string            `json:"config"`
+	StickinessPolicy *StickinessPolicy `json:"stickiness_policy"`
+	DebugHeaders     *DebugHeaders     `json:"debug_headers"`
+	Peers            []*Peer           `json:"peers"`
+	Resolvers        *Resolvers        `json:"resolvers"`
+	Hardening        *RequestHardening `json:"hardening"`
+	StripHeaders     *HeaderStripping  `json:"strip_headers"`
+	Tuning           *Tuning           `json:"tuning"`
+	SPOEngines       []*SPOEngine      `json:"spoe_engines"`
+	VRRP             *VRRP             `json:"vrrp"`
+	// ServiceIPs are announced over bgp by the healthy instances
+	ServiceIPs []string `json:"service_ips"`
+}
+
+// SPOEngine sends the messages to the external spoe agents on their
+// events, the agents set variables prefixed by the engine name the
+// custom config can act on, as txn.<name>.<var>
+type SPOEngine struct {
+	Name string `json:"name"`
+	// Agents are in host:port format
+	Agents   []string      `json:"agents"`
+	Messages []*SPOMessage `json:"messages"`
+	// TimeoutMs is how long the processing of the
+	// messages takes at most, provider default when 0
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+// SPOMessage is sent on the Event with the Args,
+// in name=sample format
+type SPOMessage struct {
+	Name  string   `json:"name"`
+	Event string   `json:"event"`
+	Args  []string `json:"args"`
+}
+
+// Resolvers configures runtime dns resolution of the cname endpoints,
+// provider defaults are used for the settings not set
+type Resolvers struct {
+	// Nameservers are in host:port format
+	Nameservers    []string `json:"nameservers"`
+	ResolvePrefer  string   `json:"resolve_prefer"`
+	ResolveRetries int      `json:"resolve_retries"`
+	TimeoutRetry   string   `json:"timeout_retry"`
+	HoldValid      string   `json:"hold_valid"`
+	HoldOther      string   `json:"hold_other"`
+	// ServerSlots is the number of servers kept for a cname resolving
+	// to multiple A records, the traffic is balanced over the records
+	ServerSlots int `json:"server_slots"`
+}
+
+// Peer is an lb instance stick-tables are replicated to
+type Peer struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// VRRP is the virtual router the lb instances float their virtual
+// ips over, the healthy instance of the highest priority holds them
+type VRRP struct {
+	RouterID   int      `json:"router_id"`
+	VirtualIPs []string `json:"virtual_ips"`
+	// SelfIP and Priority are the ones of the local instance
+	SelfIP   string      `json:"self_ip"`
+	Priority int         `json:"priority"`
+	Peers    []*VRRPPeer `json:"peers"`
+}
+
+// VRRPPeer is another lb instance of the virtual router
+type VRRPPeer struct {
+	IP       string `json:"ip"`
+	Priority int    `json:"priority"`
+}
+
+// RequestHardening holds the normalization and the protections
+// applied to the requests of the http frontends
+type RequestHardening struct {
+	// PercentDecode decodes the percent encoded unreserved
+	// characters of the path which aren't letters or digits
+	PercentDecode bool `json:"percent_decode"`
+	// MergeSlashes merges the consecutive slashes of the path
+	MergeSlashes bool `json:"merge_slashes"`
+	// RejectPathTraversal rejects the paths with .. segments,
+	// encoded or not
+	RejectPathTraversal bool `json:"reject_path_traversal"`
+	// RejectSmuggling rejects the requests with several
+	// Content-Length, or with both Transfer-Encoding and
+	// Content-Length, or with a Transfer-Encoding other than chunked
+	RejectSmuggling bool `json:"reject_smuggling"`
+	// MaxHeaderBytes rejects the requests whose headers are larger,
+	// 0 disables the check
+	MaxHeaderBytes int `json:"max_header_bytes"`
+}
+
+// HeaderStripping removes inbound headers from the requests of
+// the clients out of the trusted sources, before they are forwarded
+type HeaderStripping struct {
+	Headers []string `json:"headers"`
+	// TrustedSources are the CIDRs whose headers are kept,
+	// when empty the headers are removed from every request
+	TrustedSources []string `json:"trusted_sources"`
+}
+
+// Tuning holds the resource settings of the provider,
+// zero values are left to the provider defaults
+type Tuning struct {
+	MaxConn int `json:"maxconn"`
+	BufSize int `json:"bufsize"`
+	Threads int `json:"threads"`
+}
+
+// DebugHeaders enables response headers identifying the rule,
+// backend and endpoint that served the request
+type DebugHeaders struct {
+	// Sources limits the headers to the clients from these CIDRs,
+	// when empty the headers are added to every response
+	Sources []string `json:"sources"`
 }
 
+// supported certificate key types
+const (
+	RSAKeyType   = "rsa"
+	ECDSAKeyType = "ecdsa"
+)
+
 type Certificate struct {
-	Name  string
-	Cert  string
-	Key   string
-	Fetch bool
+	Name    string `json:"name"`
+	Cert    string `json:"cert"`
+	Key     string `json:"key"`
+	Fetch   bool   `json:"fetch"`
+	KeyType string `json:"key_type"`
+	// Bundle is set when the certificate is served together with
+	// a certificate of a different key type for the same hostnames
+	Bundle string `json:"bundle"`
+	// Hostnames the certificate is served for, overriding the hostnames
+	// the certificate is issued for; hostnames prefixed with ! are excluded
+	Hostnames []string `json:"hostnames"`
+}
+
+// EnvironmentSeparator separates the environment from the name of the
+// backends of the lbs shared by several environments
+const EnvironmentSeparator = "::"
+
+// EnvironmentName prefixes the name with the environment
+func EnvironmentName(environment string, name string) string {
+	return environment + EnvironmentSeparator + name
+}
+
+// SplitEnvironmentName returns the environment and the name of the
+// prefixed name, the environment is empty for the others
+func SplitEnvironmentName(name string) (string, string) {
+	parts := strings.SplitN(name, EnvironmentSeparator, 2)
+	if len(parts) != 2 {
+		return "", name
+	}
+	return parts[0], parts[1]
+}
+
+// MarshalJSON stamps the serialized config with the schema version
+func (c LoadBalancerConfig) MarshalJSON() ([]byte, error) {
+	type lbConfig LoadBalancerConfig
+	if c.Version == "" {
+		c.Version = SchemaVersion
+	}
+	return json.Marshal(lbConfig(c))
 }
 
 func (s FrontendServices) Len() int {
@@ -163,5 +462,8 @@ func (s Endpoints) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 func (s Endpoints) Less(i, j int) bool {
+	if s[i].IP == s[j].IP {
+		return s[i].Port > s[j].Port
+	}
 	return strings.Compare(s[i].IP, s[j].IP) > 0
 }
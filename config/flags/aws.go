@@ -0,0 +1,8 @@
+package flags
+
+// AWS credentials, shared by the route53 dns sync and the s3 backup
+var (
+	AWSAccessKeyID     = String("AWS_ACCESS_KEY_ID", "", "AWS access key id")
+	AWSSecretAccessKey = Secret("AWS_SECRET_ACCESS_KEY", "AWS secret access key")
+	AWSSessionToken    = Secret("AWS_SESSION_TOKEN", "AWS session token of temporary credentials")
+)
@@ -0,0 +1,17 @@
+package flags
+
+import "time"
+
+// Rancher API settings, shared by the rancher controller and provider
+var (
+	CattleURL       = String("CATTLE_URL", "", "Rancher API url")
+	CattleAccessKey = String("CATTLE_ACCESS_KEY", "", "Rancher API access key")
+	CattleSecretKey = Secret("CATTLE_SECRET_KEY", "Rancher API secret key")
+	CattleReadOnly  = Bool("CATTLE_READ_ONLY", false, "Run with agent scoped Rancher API keys, disabling the features needing environment admin keys")
+
+	CattleTimeout          = Duration("CATTLE_TIMEOUT", 10*time.Second, "Timeout of each of the Rancher API requests")
+	CattleRetries          = Int("CATTLE_RETRIES", 3, "Number of retries of the Rancher API calls failing with a 5xx or connection error").Range(0, 100)
+	CattleRetryBackoff     = Duration("CATTLE_RETRY_BACKOFF", time.Second, "Backoff before the first retry of a Rancher API call, doubled on every retry")
+	CattleBreakerThreshold = Int("CATTLE_BREAKER_THRESHOLD", 5, "Number of consecutive failed Rancher API calls opening the circuit, 0 disables the circuit breaker").Range(0, 10000)
+	CattleBreakerCooldown  = Duration("CATTLE_BREAKER_COOLDOWN", 30*time.Second, "Time the Rancher API calls fail fast once the circuit is open")
+)
@@ -0,0 +1,248 @@
+/*
+Package flags defines the typed settings of the lb controller, read
+either from env vars of the process or from labels of the lb service.
+
+Flags are declared once, with their type, default and usage, as package
+level vars of the code using them:
+
+	var pollInterval = flags.Int("CERTS_POLL_INTERVAL", 30, "Certificates poll interval in seconds")
+	var inferTargetPort = flags.LabelBool("io.rancher.lb_service.infer_target_port", false, "Infer missing target ports")
+
+Env flags are parsed on first use and cached, label flags are parsed
+from the labels passed in. All the declared flags can be validated
+at startup with Validate, and listed with Dump.
+*/
+package flags
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the type of the flag value
+type Kind string
+
+const (
+	KindString   Kind = "string"
+	KindBool     Kind = "bool"
+	KindInt      Kind = "int"
+	KindFloat    Kind = "float"
+	KindDuration Kind = "duration"
+)
+
+// Source is where the flag value is read from
+type Source string
+
+const (
+	SourceEnv   Source = "env"
+	SourceLabel Source = "label"
+)
+
+const secretMask = "******"
+
+// Flag is a typed setting read from an env var or an lb service label
+type Flag struct {
+	Name    string
+	Usage   string
+	Kind    Kind
+	Source  Source
+	Default interface{}
+	Secret  bool
+
+	validate func(value interface{}) error
+
+	once  sync.Once
+	value interface{}
+	raw   string
+	set   bool
+	err   error
+}
+
+var (
+	mu         sync.Mutex
+	registered = map[string]*Flag{}
+)
+
+func register(f *Flag) *Flag {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registered[f.Name]; ok {
+		panic(fmt.Sprintf("flag %s is declared twice", f.Name))
+	}
+	registered[f.Name] = f
+	return f
+}
+
+// flagsBySource returns the declared flags of the source sorted by name
+func flagsBySource(source Source) []*Flag {
+	mu.Lock()
+	defer mu.Unlock()
+	var flags []*Flag
+	for _, f := range registered {
+		if f.Source == source {
+			flags = append(flags, f)
+		}
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+func (f *Flag) parse(raw string) (interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	var value interface{}
+	var err error
+	switch f.Kind {
+	case KindString:
+		value = raw
+	case KindBool:
+		value, err = strconv.ParseBool(raw)
+	case KindInt:
+		value, err = strconv.Atoi(raw)
+	case KindFloat:
+		value, err = strconv.ParseFloat(raw, 64)
+	case KindDuration:
+		value, err = parseDuration(raw)
+	default:
+		err = fmt.Errorf("unsupported kind %s", f.Kind)
+	}
+	if err == nil && f.validate != nil {
+		err = f.validate(value)
+	}
+	if err != nil {
+		if f.Source == SourceLabel {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", f.Name, raw, err)
+		}
+		return nil, fmt.Errorf("Invalid %s %s: %v", f.Name, raw, err)
+	}
+	return value, nil
+}
+
+// parseDuration accepts go durations, and plain numbers as seconds
+func parseDuration(raw string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// lookup parses the flag value from the env var once
+func (f *Flag) lookup() interface{} {
+	f.once.Do(func() {
+		f.value = f.Default
+		raw, ok := os.LookupEnv(f.Name)
+		if !ok || raw == "" {
+			return
+		}
+		f.raw, f.set = raw, true
+		value, err := f.parse(raw)
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.value = value
+	})
+	return f.value
+}
+
+// lookupLabel parses the flag value from the labels
+func (f *Flag) lookupLabel(labels map[string]string) (interface{}, error) {
+	raw, ok := labels[f.Name]
+	if !ok || raw == "" {
+		return f.Default, nil
+	}
+	return f.parse(raw)
+}
+
+// IsSet tells if the env var of the flag is set
+func (f *Flag) IsSet() bool {
+	f.lookup()
+	return f.set
+}
+
+// Err returns the error parsing the env var of the flag,
+// the flag has its default value when it fails to parse
+func (f *Flag) Err() error {
+	f.lookup()
+	return f.err
+}
+
+// Validate parses all the env flags, and returns
+// the errors of the ones failing to parse
+func Validate() error {
+	var errs []string
+	for _, f := range flagsBySource(SourceEnv) {
+		if err := f.Err(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ValidateLabels parses all the label flags from the labels,
+// and returns the errors of the ones failing to parse
+func ValidateLabels(labels map[string]string) []error {
+	var errs []error
+	for _, f := range flagsBySource(SourceLabel) {
+		if _, err := f.lookupLabel(labels); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Info describes a declared flag and its current value
+type Info struct {
+	Name    string      `json:"name"`
+	Source  Source      `json:"source"`
+	Kind    Kind        `json:"kind"`
+	Usage   string      `json:"usage,omitempty"`
+	Default interface{} `json:"default"`
+	Value   interface{} `json:"value,omitempty"`
+	Set     bool        `json:"set"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Dump lists all the declared flags sorted by source and name,
+// with the values of the env flags. Secret values are masked
+func Dump() []Info {
+	infos := []Info{}
+	for _, source := range []Source{SourceEnv, SourceLabel} {
+		for _, f := range flagsBySource(source) {
+			info := Info{
+				Name:    f.Name,
+				Source:  f.Source,
+				Kind:    f.Kind,
+				Usage:   f.Usage,
+				Default: f.Default,
+			}
+			if f.Source == SourceEnv {
+				info.Value, info.Set = f.lookup(), f.set
+				if f.err != nil {
+					info.Error = f.err.Error()
+				}
+				if f.Secret && f.set {
+					info.Value = secretMask
+				}
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func intRange(min, max int) func(value interface{}) error {
+	return func(value interface{}) error {
+		if v := value.(int); v < min || v > max {
+			return fmt.Errorf("should be between %v and %v", min, max)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package flags
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnvFlags(t *testing.T) {
+	os.Setenv("TEST_FLAGS_INT", "42")
+	os.Setenv("TEST_FLAGS_DURATION", "30")
+	os.Setenv("TEST_FLAGS_SECRET", "s3cr3t")
+	os.Setenv("TEST_FLAGS_INVALID", "eleven")
+	defer func() {
+		os.Unsetenv("TEST_FLAGS_INT")
+		os.Unsetenv("TEST_FLAGS_DURATION")
+		os.Unsetenv("TEST_FLAGS_SECRET")
+		os.Unsetenv("TEST_FLAGS_INVALID")
+	}()
+	i := Int("TEST_FLAGS_INT", 1, "")
+	d := Duration("TEST_FLAGS_DURATION", time.Minute, "")
+	s := String("TEST_FLAGS_STRING", "default", "")
+	secret := Secret("TEST_FLAGS_SECRET", "")
+	invalid := Int("TEST_FLAGS_INVALID", 11, "").Range(1, 20)
+
+	if i.Get() != 42 || !i.IsSet() {
+		t.Fatalf("Invalid int flag %v", i.Get())
+	}
+	if d.Get() != 30*time.Second {
+		t.Fatalf("Invalid duration flag %v", d.Get())
+	}
+	if s.Get() != "default" || s.IsSet() {
+		t.Fatalf("Invalid string flag %v", s.Get())
+	}
+	if invalid.Get() != 11 || invalid.Err() == nil {
+		t.Fatalf("Invalid value should fall back to the default %v", invalid.Get())
+	}
+	if err := Validate(); err == nil {
+		t.Fatalf("Invalid flag should fail validation")
+	}
+	if secret.Get() != "s3cr3t" {
+		t.Fatalf("Invalid secret flag %v", secret.Get())
+	}
+	for _, info := range Dump() {
+		if info.Name == "TEST_FLAGS_SECRET" && info.Value != secretMask {
+			t.Fatalf("Secret flag is not masked %v", info.Value)
+		}
+	}
+}
+
+func TestLabelFlags(t *testing.T) {
+	b := LabelBool("test.flags.bool", false, "")
+	i := LabelInt("test.flags.int", 100, "").Range(1, 256)
+
+	labels := map[string]string{"test.flags.bool": "true"}
+	if v, err := b.Get(labels); err != nil || !v {
+		t.Fatalf("Invalid bool label flag %v %v", v, err)
+	}
+	if v, err := i.Get(labels); err != nil || v != 100 {
+		t.Fatalf("Invalid int label flag default %v %v", v, err)
+	}
+	labels["test.flags.int"] = "300"
+	if _, err := i.Get(labels); err == nil {
+		t.Fatalf("Out of range label value should fail")
+	}
+	if errs := ValidateLabels(labels); len(errs) != 1 {
+		t.Fatalf("Invalid label validation errors %v", errs)
+	}
+}
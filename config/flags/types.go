@@ -0,0 +1,125 @@
+package flags
+
+import "time"
+
+// StringFlag is a string env flag
+type StringFlag struct{ *Flag }
+
+// String declares a string env flag
+func String(name string, def string, usage string) StringFlag {
+	return StringFlag{register(&Flag{Name: name, Usage: usage, Kind: KindString, Source: SourceEnv, Default: def})}
+}
+
+// Secret declares a string env flag, whose value is masked in the dump
+func Secret(name string, usage string) StringFlag {
+	return StringFlag{register(&Flag{Name: name, Usage: usage, Kind: KindString, Source: SourceEnv, Default: "", Secret: true})}
+}
+
+func (f StringFlag) Get() string {
+	return f.lookup().(string)
+}
+
+// BoolFlag is a bool env flag
+type BoolFlag struct{ *Flag }
+
+// Bool declares a bool env flag
+func Bool(name string, def bool, usage string) BoolFlag {
+	return BoolFlag{register(&Flag{Name: name, Usage: usage, Kind: KindBool, Source: SourceEnv, Default: def})}
+}
+
+func (f BoolFlag) Get() bool {
+	return f.lookup().(bool)
+}
+
+// IntFlag is an int env flag
+type IntFlag struct{ *Flag }
+
+// Int declares an int env flag
+func Int(name string, def int, usage string) IntFlag {
+	return IntFlag{register(&Flag{Name: name, Usage: usage, Kind: KindInt, Source: SourceEnv, Default: def})}
+}
+
+// Range limits the values of the flag
+func (f IntFlag) Range(min, max int) IntFlag {
+	f.validate = intRange(min, max)
+	return f
+}
+
+func (f IntFlag) Get() int {
+	return f.lookup().(int)
+}
+
+// FloatFlag is a float env flag
+type FloatFlag struct{ *Flag }
+
+// Float declares a float env flag
+func Float(name string, def float64, usage string) FloatFlag {
+	return FloatFlag{register(&Flag{Name: name, Usage: usage, Kind: KindFloat, Source: SourceEnv, Default: def})}
+}
+
+func (f FloatFlag) Get() float64 {
+	return f.lookup().(float64)
+}
+
+// DurationFlag is a duration env flag, plain numbers are read as seconds
+type DurationFlag struct{ *Flag }
+
+// Duration declares a duration env flag
+func Duration(name string, def time.Duration, usage string) DurationFlag {
+	return DurationFlag{register(&Flag{Name: name, Usage: usage, Kind: KindDuration, Source: SourceEnv, Default: def})}
+}
+
+func (f DurationFlag) Get() time.Duration {
+	return f.lookup().(time.Duration)
+}
+
+// LabelStringFlag is a string lb service label flag
+type LabelStringFlag struct{ *Flag }
+
+// LabelString declares a string lb service label flag
+func LabelString(name string, def string, usage string) LabelStringFlag {
+	return LabelStringFlag{register(&Flag{Name: name, Usage: usage, Kind: KindString, Source: SourceLabel, Default: def})}
+}
+
+func (f LabelStringFlag) Get(labels map[string]string) string {
+	value, _ := f.lookupLabel(labels)
+	return value.(string)
+}
+
+// LabelBoolFlag is a bool lb service label flag
+type LabelBoolFlag struct{ *Flag }
+
+// LabelBool declares a bool lb service label flag
+func LabelBool(name string, def bool, usage string) LabelBoolFlag {
+	return LabelBoolFlag{register(&Flag{Name: name, Usage: usage, Kind: KindBool, Source: SourceLabel, Default: def})}
+}
+
+func (f LabelBoolFlag) Get(labels map[string]string) (bool, error) {
+	value, err := f.lookupLabel(labels)
+	if err != nil {
+		return f.Default.(bool), err
+	}
+	return value.(bool), nil
+}
+
+// LabelIntFlag is an int lb service label flag
+type LabelIntFlag struct{ *Flag }
+
+// LabelInt declares an int lb service label flag
+func LabelInt(name string, def int, usage string) LabelIntFlag {
+	return LabelIntFlag{register(&Flag{Name: name, Usage: usage, Kind: KindInt, Source: SourceLabel, Default: def})}
+}
+
+// Range limits the values of the flag
+func (f LabelIntFlag) Range(min, max int) LabelIntFlag {
+	f.validate = intRange(min, max)
+	return f
+}
+
+func (f LabelIntFlag) Get(labels map[string]string) (int, error) {
+	value, err := f.lookupLabel(labels)
+	if err != nil {
+		return f.Default.(int), err
+	}
+	return value.(int), nil
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-04/schema#"
+
+// JSONSchema returns json schema of the serialized LoadBalancerConfig
+func JSONSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(LoadBalancerConfig{}))
+	schema["$schema"] = jsonSchemaDraft
+	schema["title"] = "LoadBalancerConfig"
+	schema["version"] = SchemaVersion
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				// unexported
+				continue
+			}
+			name := field.Name
+			if tag := field.Tag.Get("json"); tag != "" {
+				name = strings.Split(tag, ",")[0]
+			}
+			if name == "-" {
+				continue
+			}
+			properties[name] = typeSchema(field.Type)
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+	}
+	return map[string]interface{}{}
+}
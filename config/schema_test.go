@@ -0,0 +1,36 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	schema := JSONSchema()
+	if schema["version"] != SchemaVersion {
+		t.Fatalf("Invalid schema version %v", schema["version"])
+	}
+	properties := schema["properties"].(map[string]interface{})
+	fes, ok := properties["frontend_services"].(map[string]interface{})
+	if !ok {
+		t.Fatal("frontend_services is missing in the schema")
+	}
+	if fes["type"] != "array" {
+		t.Fatalf("Invalid frontend_services type %v", fes["type"])
+	}
+	fe := fes["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	if _, ok := fe["backend_services"]; !ok {
+		t.Fatal("backend_services is missing in the frontend schema")
+	}
+}
+
+func TestMarshalVersion(t *testing.T) {
+	b, err := json.Marshal(&LoadBalancerConfig{Name: "lb"})
+	if err != nil {
+		t.Fatalf("Failed to marshal config %v", err)
+	}
+	if !strings.Contains(string(b), `"version":"1"`) {
+		t.Fatalf("Serialized config is missing the version %s", string(b))
+	}
+}
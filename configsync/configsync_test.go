@@ -0,0 +1,171 @@
+package configsync
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/provider"
+	utils "github.com/rancher/lb-controller/utils"
+)
+
+type tProvider struct {
+	applied  map[string]*config.LoadBalancerConfig
+	cleaned  []string
+	applyErr error
+}
+
+func (p *tProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	if p.applyErr != nil {
+		return p.applyErr
+	}
+	p.applied[lbConfig.Name] = lbConfig
+	return nil
+}
+
+func (p *tProvider) CleanupConfig(configName string) error {
+	delete(p.applied, configName)
+	p.cleaned = append(p.cleaned, configName)
+	return nil
+}
+
+func (p *tProvider) GetName() string                                                { return "test" }
+func (p *tProvider) GetPublicEndpoints(configName string) []provider.PublicEndpoint { return nil }
+func (p *tProvider) Run(syncEndpointsQueue *utils.TaskQueue)                        {}
+func (p *tProvider) Stop() error                                                    { return nil }
+func (p *tProvider) IsHealthy() bool                                                { return true }
+func (p *tProvider) ProcessCustomConfig(*config.LoadBalancerConfig, string) error   { return nil }
+
+func TestConfigSync(t *testing.T) {
+	publisher := NewPublisher("secret")
+	server := httptest.NewServer(publisher)
+	defer server.Close()
+
+	lbp := &tProvider{applied: map[string]*config.LoadBalancerConfig{}}
+	d := NewDataPlane()
+	d.SourceURL = server.URL
+	d.Token = "secret"
+	d.Client = &http.Client{Timeout: 5 * time.Second}
+	d.lbProvider = lbp
+
+	if err := d.sync(); err == nil || d.IsReady() {
+		t.Fatalf("Nothing should be synced before the builder published a config")
+	}
+
+	lb := &config.LoadBalancerConfig{
+		Name:  "lb",
+		Certs: []*config.Certificate{{Name: "foo", Cert: "cert", Key: "key"}},
+		FrontendServices: []*config.FrontendService{{
+			Name:            "80",
+			Port:            80,
+			BackendServices: []*config.BackendService{{UUID: "foo", Port: 80, Path: "/foo"}},
+		}},
+	}
+	publisher.PostApply(lb, fmt.Errorf("apply failed"))
+	publisher.PostApply(lb, nil)
+	publisher.PostApply(&config.LoadBalancerConfig{Name: "other"}, nil)
+	if err := d.sync(); err != nil || !d.IsReady() {
+		t.Fatalf("Failed to sync the published configs %v", err)
+	}
+	applied := lbp.applied["lb"]
+	if len(lbp.applied) != 2 || applied == nil || len(applied.Certs) != 1 || applied.Certs[0].Key != "key" ||
+		len(applied.FrontendServices) != 1 || applied.FrontendServices[0].BackendServices[0].Path != "/foo" {
+		t.Fatalf("The published configs should be applied, got %+v", lbp.applied)
+	}
+
+	// an unchanged config doesn't bump the version, the long-poll
+	// answers not modified once its wait is over
+	publisher.PostApply(lb, nil)
+	lbp.applied = map[string]*config.LoadBalancerConfig{}
+	d.Wait = 1
+	if snapshot, err := d.fetch(); err != nil || snapshot != nil {
+		t.Fatalf("The configs should not have changed %+v %v", snapshot, err)
+	}
+	d.Wait = maxWait
+
+	// the long-poll is woken by the next version
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		publisher.PostCleanup("other")
+	}()
+	if err := d.sync(); err != nil {
+		t.Fatalf("Failed to sync the published configs %v", err)
+	}
+	if len(lbp.cleaned) != 1 || lbp.cleaned[0] != "other" || lbp.applied["lb"] == nil {
+		t.Fatalf("The configs no longer published should be cleaned up, got %v %v", lbp.cleaned, lbp.applied)
+	}
+	cfgs, _ := d.GetLBConfigs()
+	names := []string{}
+	for _, cfg := range cfgs {
+		names = append(names, cfg.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != "lb" {
+		t.Fatalf("The applied configs should be reported, got %v", names)
+	}
+
+	// failed applies are retried with the same version
+	lbp.applyErr = fmt.Errorf("apply failed")
+	publisher.PostApply(&config.LoadBalancerConfig{Name: "new"}, nil)
+	if err := d.sync(); err == nil {
+		t.Fatalf("The failed apply should be reported")
+	}
+	lbp.applyErr = nil
+	if err := d.sync(); err != nil || lbp.applied["new"] == nil {
+		t.Fatalf("The failed apply should be retried %v", err)
+	}
+
+	d.Token = "wrong"
+	if err := d.sync(); err == nil {
+		t.Fatalf("The configs should not be served without the token")
+	}
+}
+
+func TestConfigSyncRestartedBuilder(t *testing.T) {
+	publisher := NewPublisher("secret")
+	publisher.PostApply(&config.LoadBalancerConfig{Name: "lb"}, nil)
+	server := httptest.NewServer(publisher)
+	defer server.Close()
+
+	lbp := &tProvider{applied: map[string]*config.LoadBalancerConfig{}}
+	d := NewDataPlane()
+	d.SourceURL = server.URL
+	d.Token = "secret"
+	d.Client = &http.Client{Timeout: 5 * time.Second}
+	d.Wait = 1
+	d.lbProvider = lbp
+	if err := d.sync(); err != nil {
+		t.Fatalf("Failed to sync the published configs %v", err)
+	}
+
+	// the restarted builder publishes other configs with the same version
+	restarted := NewPublisher("secret")
+	restarted.epoch = "restarted"
+	restarted.PostApply(&config.LoadBalancerConfig{Name: "other"}, nil)
+	server.Config.Handler = restarted
+	if err := d.sync(); err != nil {
+		t.Fatalf("Failed to sync the published configs %v", err)
+	}
+	if lbp.applied["other"] == nil || lbp.applied["lb"] != nil {
+		t.Fatalf("The configs of the restarted builder should be applied, got %v", lbp.applied)
+	}
+}
+
+func TestCheckSourceURL(t *testing.T) {
+	if err := checkSourceURL("https://builder/configs", false); err != nil {
+		t.Fatalf("Https url should be allowed %v", err)
+	}
+	if err := checkSourceURL("http://builder:10241/configs", false); err == nil {
+		t.Fatal("Http url should be refused")
+	}
+	if err := checkSourceURL("http://builder:10241/configs", true); err != nil {
+		t.Fatalf("Http url should be allowed when insecure %v", err)
+	}
+	if err := checkSourceURL("ftp://builder/configs", true); err == nil {
+		t.Fatal("Non http url should be refused")
+	}
+}
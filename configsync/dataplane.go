@@ -0,0 +1,228 @@
+package configsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/controller"
+	"github.com/rancher/lb-controller/provider"
+)
+
+// DataPlaneControllerName is the controller run by the data planes
+const DataPlaneControllerName = "dataplane"
+
+var (
+	sourceURL      = flags.String("CONFIG_SOURCE_URL", "", "Https url of the configs published by the builder, as https://builder/configs")
+	sourceInsecure = flags.Bool("CONFIG_SOURCE_INSECURE", false, "Allow a plain http CONFIG_SOURCE_URL, the configs and their cert keys are fetched in clear")
+	sourceRetry    = flags.Duration("CONFIG_SOURCE_RETRY_INTERVAL", 5*time.Second, "Interval the configs of the builder are fetched again at after a failure")
+	sourceTimeout  = flags.Duration("CONFIG_SOURCE_TIMEOUT", 10*time.Second, "Timeout of the config fetches, on top of the long-poll wait")
+)
+
+func init() {
+	controller.RegisterController(DataPlaneControllerName, NewDataPlane())
+}
+
+/*
+DataPlane is the controller of the data planes. It long-polls the configs
+published by the builder and applies them, the configs the builder no
+longer publishes are cleaned up. The configs stay applied while the
+builder is unreachable
+*/
+type DataPlane struct {
+	SourceURL     string
+	Token         string
+	RetryInterval time.Duration
+	// Wait is how long the builder holds the fetches of
+	// an unchanged version, in seconds
+	Wait   int
+	Client *http.Client
+
+	lbProvider provider.LBProvider
+	stopCh     chan struct{}
+	shutdown   bool
+
+	mu sync.Mutex
+	// version is the ETag of the configs applied
+	version string
+	configs []*config.LoadBalancerConfig
+}
+
+func NewDataPlane() *DataPlane {
+	return &DataPlane{
+		Wait:   maxWait,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Init configures the data plane from the CONFIG_SOURCE_* env vars,
+// the metadata is not used
+func (d *DataPlane) Init(metadataURL string) {
+	if sourceURL.Get() == "" {
+		logrus.Fatalf("CONFIG_SOURCE_URL is not set, fail to init the %s controller", d.GetName())
+	}
+	if err := checkSourceURL(sourceURL.Get(), sourceInsecure.Get()); err != nil {
+		logrus.Fatalf("%v, fail to init the %s controller", err, d.GetName())
+	}
+	d.SourceURL = sourceURL.Get()
+	d.Token = syncToken.Get()
+	d.RetryInterval = sourceRetry.Get()
+	d.Client = &http.Client{Timeout: sourceTimeout.Get() + maxWait*time.Second}
+}
+
+// checkSourceURL refuses the non https urls, plain http
+// is allowed when insecure is set
+func checkSourceURL(sourceURL string, insecure bool) error {
+	u, err := url.Parse(sourceURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Invalid CONFIG_SOURCE_URL %s", sourceURL)
+	}
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && insecure:
+		logrus.Warnf("Fetching the configs of the builder over plain http")
+		return nil
+	case u.Scheme == "http":
+		return fmt.Errorf("CONFIG_SOURCE_URL %s should be https, set CONFIG_SOURCE_INSECURE to allow http", sourceURL)
+	default:
+		return fmt.Errorf("Invalid CONFIG_SOURCE_URL scheme %s", u.Scheme)
+	}
+}
+
+func (d *DataPlane) GetName() string {
+	return DataPlaneControllerName
+}
+
+func (d *DataPlane) Run(lbProvider provider.LBProvider) {
+	logrus.Infof("starting %s controller, applying the configs of %s", d.GetName(), d.SourceURL)
+	d.lbProvider = lbProvider
+	go d.lbProvider.Run(nil)
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		default:
+		}
+		if err := d.sync(); err != nil {
+			logrus.Errorf("Failed to sync the configs of the builder: %v", err)
+			select {
+			case <-d.stopCh:
+				return
+			case <-time.After(d.RetryInterval):
+			}
+		}
+	}
+}
+
+// sync waits for the next version of the configs and applies it
+func (d *DataPlane) sync() error {
+	snapshot, err := d.fetch()
+	if err != nil || snapshot == nil {
+		return err
+	}
+	return d.apply(snapshot)
+}
+
+// fetch long-polls the configs, nil is returned when they didn't change
+func (d *DataPlane) fetch() (*Snapshot, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?wait=%d", d.SourceURL, d.Wait), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	d.mu.Lock()
+	if d.version != "" {
+		req.Header.Set("If-None-Match", d.version)
+	}
+	d.mu.Unlock()
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("builder answered %s", resp.Status)
+	}
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(resp.Body).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("Invalid configs: %v", err)
+	}
+	snapshot.etag = resp.Header.Get("ETag")
+	return snapshot, nil
+}
+
+// apply applies the configs of the snapshot and cleans up the removed
+// ones, the version is kept until all of them applied
+func (d *DataPlane) apply(snapshot *Snapshot) error {
+	d.mu.Lock()
+	previous := d.configs
+	d.mu.Unlock()
+	names := map[string]bool{}
+	var lastErr error
+	for _, cfg := range snapshot.Configs {
+		names[cfg.Name] = true
+		if err := d.lbProvider.ApplyConfig(cfg); err != nil {
+			logrus.Errorf("Failed to apply lb config on provider: %v", err)
+			lastErr = err
+		}
+	}
+	for _, cfg := range previous {
+		if names[cfg.Name] {
+			continue
+		}
+		if err := d.lbProvider.CleanupConfig(cfg.Name); err != nil {
+			logrus.Errorf("Failed to clean up lb config %s: %v", cfg.Name, err)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.version = snapshot.etag
+	d.configs = snapshot.Configs
+	logrus.Infof("Applied version %d of the configs of the builder", snapshot.Version)
+	return nil
+}
+
+func (d *DataPlane) Stop() error {
+	if !d.shutdown {
+		logrus.Infof("Shutting down %s controller", d.GetName())
+		if err := d.lbProvider.Stop(); err != nil {
+			return err
+		}
+		close(d.stopCh)
+		d.shutdown = true
+	}
+	return fmt.Errorf("shutdown already in progress")
+}
+
+// GetLBConfigs returns the configs last applied
+func (d *DataPlane) GetLBConfigs() ([]*config.LoadBalancerConfig, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.configs, nil
+}
+
+func (d *DataPlane) IsHealthy() bool {
+	return true
+}
+
+// IsReady returns true once the configs of the builder applied
+func (d *DataPlane) IsReady() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.version != ""
+}
@@ -0,0 +1,212 @@
+/*
+Package configsync splits the lb instances in a config builder and data
+planes. The builder syncs with the metadata and cattle as any controller
+and publishes the configs it applied, the data planes fetch them from the
+builder and apply them, without reading the metadata nor cattle.
+
+	LB_ROLE=builder   CONFIG_SYNC_TOKEN=secret
+	LB_ROLE=dataplane CONFIG_SYNC_TOKEN=secret CONFIG_SOURCE_URL=https://builder/configs
+
+The published configs hold the cert keys, the token is required to read them.
+The builder serves them on the plain http health check port, the data planes
+fetch them over https, through a tls lb port in front of the builder. Plain
+http is refused unless CONFIG_SOURCE_INSECURE is set.
+*/
+package configsync
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	// RoleAll builds and applies the configs, without publishing them
+	RoleAll = "all"
+	// RoleBuilder builds and applies the configs, and publishes them
+	RoleBuilder = "builder"
+	// RoleDataPlane applies the configs published by the builder
+	RoleDataPlane = "dataplane"
+
+	// maxWait caps the long-polls of the data planes, in seconds
+	maxWait = 60
+)
+
+var (
+	lbRole    = flags.String("LB_ROLE", RoleAll, "Role of the instance, all, builder to publish the applied configs to the data planes, or dataplane to apply the configs of CONFIG_SOURCE_URL")
+	syncToken = flags.Secret("CONFIG_SYNC_TOKEN", "Token the data planes read the configs of the builder with")
+)
+
+// RoleFromEnv returns the role set by LB_ROLE
+func RoleFromEnv() (string, error) {
+	switch role := lbRole.Get(); role {
+	case RoleAll, RoleBuilder, RoleDataPlane:
+		if role != RoleAll && syncToken.Get() == "" {
+			return "", fmt.Errorf("CONFIG_SYNC_TOKEN should be set with LB_ROLE %s", role)
+		}
+		return role, nil
+	default:
+		return "", fmt.Errorf("Invalid LB_ROLE %s, expected %s, %s or %s", role, RoleAll, RoleBuilder, RoleDataPlane)
+	}
+}
+
+// Snapshot is the set of configs published by the builder
+type Snapshot struct {
+	Version int64                        `json:"version"`
+	Configs []*config.LoadBalancerConfig `json:"configs"`
+
+	// etag is the ETag the snapshot was served with
+	etag string
+}
+
+/*
+Publisher is an apply hook recording the configs applied by the builder,
+and serving them to the data planes. The version of the snapshot is bumped
+when a config changes, the ETag of the answers is the version prefixed by
+the epoch of the publisher, so the versions of a restarted builder don't
+match the ones of the previous run: a data plane sending the ETag in
+If-None-Match waits for the next version, up to the wait query parameter
+in seconds
+*/
+type Publisher struct {
+	Token string
+
+	// epoch identifies the run of the publisher
+	epoch   string
+	mu      sync.Mutex
+	configs map[string][]byte
+	version int64
+	// changed is closed and replaced on every version bump
+	changed chan struct{}
+}
+
+// NewPublisherFromEnv configures the publisher from the CONFIG_SYNC_TOKEN
+// env var, nil is returned unless the role is builder
+func NewPublisherFromEnv() (*Publisher, error) {
+	role, err := RoleFromEnv()
+	if err != nil || role != RoleBuilder {
+		return nil, err
+	}
+	return NewPublisher(syncToken.Get()), nil
+}
+
+func NewPublisher(token string) *Publisher {
+	return &Publisher{
+		Token:   token,
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		configs: map[string][]byte{},
+		version: 1,
+		changed: make(chan struct{}),
+	}
+}
+
+func (p *Publisher) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply records the config once applied, the data
+// planes only get the configs that applied on the builder
+func (p *Publisher) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	b, err := json.Marshal(lbConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to publish the config: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if bytes.Equal(p.configs[lbConfig.Name], b) {
+		return nil
+	}
+	p.configs[lbConfig.Name] = b
+	p.bump()
+	return nil
+}
+
+func (p *Publisher) PostCleanup(configName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.configs[configName]; ok {
+		delete(p.configs, configName)
+		p.bump()
+	}
+	return nil
+}
+
+// bump increments the version and wakes the long-polls, p.mu is held
+func (p *Publisher) bump() {
+	p.version++
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// snapshot returns the published configs sorted by name
+func (p *Publisher) snapshot() ([]byte, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.configs))
+	for name := range p.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configs := make([]json.RawMessage, 0, len(names))
+	for _, name := range names {
+		configs = append(configs, p.configs[name])
+	}
+	b, _ := json.Marshal(struct {
+		Version int64             `json:"version"`
+		Configs []json.RawMessage `json:"configs"`
+	}{p.version, configs})
+	return b, p.version
+}
+
+func (p *Publisher) etag(version int64) string {
+	return p.epoch + "-" + strconv.FormatInt(version, 10)
+}
+
+func (p *Publisher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := []byte(req.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+p.Token)) != 1 {
+		http.Error(w, "Invalid config sync token", http.StatusUnauthorized)
+		return
+	}
+	p.mu.Lock()
+	version, changed := p.version, p.changed
+	p.mu.Unlock()
+	if version == 1 {
+		// the data planes keep their configs until the builder synced
+		http.Error(w, "No config is published yet", http.StatusServiceUnavailable)
+		return
+	}
+	if req.Header.Get("If-None-Match") == p.etag(version) {
+		wait, _ := strconv.Atoi(req.URL.Query().Get("wait"))
+		if wait > maxWait {
+			wait = maxWait
+		}
+		if wait > 0 {
+			select {
+			case <-changed:
+			case <-time.After(time.Duration(wait) * time.Second):
+			}
+		}
+	}
+	b, current := p.snapshot()
+	etag := p.etag(current)
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/rancher/lb-controller/config"
 	"github.com/rancher/lb-controller/provider"
+	"time"
 )
 
 type LBController interface {
@@ -15,6 +16,79 @@ type LBController interface {
 	IsHealthy() bool
 }
 
+// ValidationReporter is implemented by the controllers
+// validating lb rules before building the config
+type ValidationReporter interface {
+	// GetValidationReport returns the report of the last validation,
+	// nil when nothing was validated yet
+	GetValidationReport() interface{}
+}
+
+// RequestLogger is implemented by the controllers logging the
+// requests of single backends on demand from the admin api
+type RequestLogger interface {
+	// GetRequestLogging returns the running request loggings by backend name
+	GetRequestLogging() map[string]*config.RequestLogging
+	// SetRequestLogging logs the requests of the backend for the duration,
+	// one in sampleRate of them. A zero duration turns the logging off
+	SetRequestLogging(backendName string, duration time.Duration, sampleRate int) error
+}
+
+// ExpansionReporter is implemented by the controllers
+// expanding selector based lb rules
+type ExpansionReporter interface {
+	// GetRuleExpansions returns how the selector rules expanded on
+	// the last sync, nil when nothing was expanded yet
+	GetRuleExpansions() interface{}
+}
+
+// Resyncer is implemented by the controllers able to
+// rebuild and apply their config on demand
+type Resyncer interface {
+	// Resync rebuilds the config from fresh metadata and applies
+	// it, skipping the caches and the backoff of the retries
+	Resync()
+}
+
+// StateDumper is implemented by the controllers able to dump their
+// internal state, for the offline debugging of a stuck controller
+type StateDumper interface {
+	// DumpState returns the json encodable state of the controller
+	DumpState() interface{}
+}
+
+// ReadinessReporter is implemented by the controllers
+// telling when their initial sync is complete
+type ReadinessReporter interface {
+	// IsReady returns true once a config with the backends
+	// and the certificates of the lb was applied
+	IsReady() bool
+}
+
+// QueueReporter is implemented by the controllers syncing through a queue
+type QueueReporter interface {
+	// GetQueueDepth returns the number of syncs waiting in the queue
+	GetQueueDepth() int
+}
+
+// FaultInjector is implemented by the controllers accepting
+// the faults injected in the backends from the admin api
+type FaultInjector interface {
+	// GetFaults returns the faults by backend name
+	GetFaults() map[string]*config.Fault
+	// SetFault injects the fault in the requests of the backend
+	// for the duration, a nil fault removes it
+	SetFault(backendName string, fault *config.Fault, duration time.Duration) error
+}
+
+// MetadataSnapshotter is implemented by the controllers recording
+// the metadata the configs they apply are built from
+type MetadataSnapshotter interface {
+	// GetMetadataSnapshot returns the json encodable metadata the
+	// configs last applied were built from, nil before the first apply
+	GetMetadataSnapshot() interface{}
+}
+
 var (
 	controllers map[string]LBController
 )
@@ -14,6 +14,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/lb-controller/config"
+	envflags "github.com/rancher/lb-controller/config/flags"
 	"github.com/rancher/lb-controller/controller"
 	"github.com/rancher/lb-controller/provider"
 	utils "github.com/rancher/lb-controller/utils"
@@ -35,6 +36,7 @@ var (
 	flags        = pflag.NewFlagSet("", pflag.ExitOnError)
 	resyncPeriod = flags.Duration("sync-period", 30*time.Second,
 		`Relist and confirm cloud resources this often.`)
+	kubernetesURL = envflags.String("KUBERNETES_URL", "", "Url of the kubernetes api server, its token is read from the stdin")
 )
 
 const (
@@ -46,7 +48,7 @@ const (
 
 func init() {
 	if err := func() error {
-		server := os.Getenv("KUBERNETES_URL")
+		server := kubernetesURL.Get()
 		if server == "" {
 			return errors.New("KUBERNETES_URL is not set")
 		}
@@ -356,8 +358,7 @@ func (lbc *loadBalancerController) isStatusIPDefined(lbings []api.LoadBalancerIn
 }
 
 func (lbc *loadBalancerController) getPublicEndpoints(key string) []string {
-	providerEP := lbc.lbProvider.GetPublicEndpoints(key)
-	return providerEP
+	return provider.PublicEndpointIPs(lbc.lbProvider.GetPublicEndpoints(key))
 }
 
 // Starts a load balancer controller
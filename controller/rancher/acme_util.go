@@ -0,0 +1,94 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	acmeChallengeServiceLabel = "io.rancher.lb_service.acme_challenge_service"
+	acmeChallengePortLabel    = "io.rancher.lb_service.acme_challenge_port"
+	acmeChallengePathLabel    = "io.rancher.lb_service.acme_challenge_path"
+	acmeChallengeBackendName  = "acme_challenge"
+	defaultACMEChallengePath  = "/.well-known/acme-challenge/"
+	defaultACMEChallengePort  = 80
+)
+
+// ACMEChallenge is a service solving ACME HTTP-01 challenges
+// for all the http frontends of the lb
+type ACMEChallenge struct {
+	Service string
+	Port    int
+	Path    string
+}
+
+func getACMEChallenge(labels map[string]string) (*ACMEChallenge, error) {
+	svc := labels[acmeChallengeServiceLabel]
+	if svc == "" {
+		return nil, nil
+	}
+	if _, _, err := splitServiceName(svc); err != nil {
+		return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", acmeChallengeServiceLabel, svc, err)
+	}
+	challenge := &ACMEChallenge{
+		Service: svc,
+		Port:    defaultACMEChallengePort,
+		Path:    defaultACMEChallengePath,
+	}
+	if val, ok := labels[acmeChallengePortLabel]; ok {
+		port, err := strconv.Atoi(val)
+		if err != nil || port < 1 {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s", acmeChallengePortLabel, val)
+		}
+		challenge.Port = port
+	}
+	if val, ok := labels[acmeChallengePathLabel]; ok && val != "" {
+		if !strings.HasPrefix(val, "/") {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, path should start with /", acmeChallengePathLabel, val)
+		}
+		challenge.Path = val
+	}
+	return challenge, nil
+}
+
+func (lbc *LoadBalancerController) getACMEChallengeBackend(envUUID string, challenge *ACMEChallenge, network *net.IPNet) (*config.BackendService, error) {
+	stackName, svcName, err := splitServiceName(challenge.Service)
+	if err != nil {
+		return nil, err
+	}
+	service, err := lbc.MetaFetcher.GetService(envUUID, svcName, stackName)
+	if err != nil {
+		return nil, err
+	}
+	if service == nil || !IsActiveService(service) {
+		return nil, nil
+	}
+	eps, err := lbc.getServiceEndpoints(service, challenge.Port, "", "any", network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &config.BackendService{
+		UUID:           acmeChallengeBackendName,
+		Path:           challenge.Path,
+		Port:           challenge.Port,
+		Protocol:       config.HTTPProto,
+		RuleComparator: config.EqRuleComparator,
+		Endpoints:      eps,
+		Environment:    envUUID,
+	}, nil
+}
+
+// addACMEChallengeBackend puts the challenge backend in front of
+// all other rules of the http frontends, so host rules don't shadow it
+func addACMEChallengeBackend(frontends config.FrontendServices, backend *config.BackendService) {
+	for _, fe := range frontends {
+		if !strings.EqualFold(fe.Protocol, config.HTTPProto) {
+			continue
+		}
+		fe.BackendServices = append(config.BackendServices{backend}, fe.BackendServices...)
+	}
+}
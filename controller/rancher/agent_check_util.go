@@ -0,0 +1,91 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	agentCheckLabel       = "io.rancher.lb_service.agent_check"
+	agentCheckLabelPrefix = "io.rancher.lb_service.agent_check."
+	// agentCheckDefault keys the agent check applied to all the backends
+	agentCheckDefault = ""
+)
+
+/*
+getAgentChecks reads the agent checks of the backends from the lb service
+labels. The agent listening on the port of the endpoints reports their
+weight or state, letting the applications adjust their share of the
+traffic. The check applies to all the backends, or to the backend whose
+name is given in the label suffix:
+
+io.rancher.lb_service.agent_check=port=9999
+io.rancher.lb_service.agent_check.api=port=9999,inter=5s
+*/
+func getAgentChecks(labels map[string]string) (map[string]*config.AgentCheck, error) {
+	agentChecks := map[string]*config.AgentCheck{}
+	for k, v := range labels {
+		backendName := agentCheckDefault
+		if strings.HasPrefix(k, agentCheckLabelPrefix) {
+			backendName = strings.TrimPrefix(k, agentCheckLabelPrefix)
+			if backendName == "" {
+				continue
+			}
+		} else if k != agentCheckLabel {
+			continue
+		}
+		agentCheck, err := parseAgentCheck(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		agentChecks[backendName] = agentCheck
+	}
+	return agentChecks, nil
+}
+
+func parseAgentCheck(value string) (*config.AgentCheck, error) {
+	agentCheck := &config.AgentCheck{}
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("setting %s should be in key=value format", setting)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "port":
+			port, err := strconv.Atoi(val)
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port %s", val)
+			}
+			agentCheck.Port = port
+		case "inter":
+			inter, err := time.ParseDuration(val)
+			if err != nil || inter < time.Millisecond {
+				return nil, fmt.Errorf("invalid inter %s", val)
+			}
+			agentCheck.InterMs = int(inter / time.Millisecond)
+		default:
+			return nil, fmt.Errorf("unsupported setting %s", key)
+		}
+	}
+	if agentCheck.Port == 0 {
+		return nil, fmt.Errorf("port is required")
+	}
+	return agentCheck, nil
+}
+
+// getAgentCheck prefers the backend agent check over the one set for all backends
+func getAgentCheck(agentChecks map[string]*config.AgentCheck, backendName string) *config.AgentCheck {
+	if agentCheck, ok := agentChecks[backendName]; ok && backendName != agentCheckDefault {
+		return agentCheck
+	}
+	return agentChecks[agentCheckDefault]
+}
@@ -0,0 +1,73 @@
+package rancher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	// backendIdentityRule names the backends without backend name
+	// after the source port, hostname and path of their rule
+	backendIdentityRule = "rule"
+	// backendIdentityService names them after the source port
+	// and the service of their rule
+	backendIdentityService = "service"
+
+	backendIdentityLabel = "io.rancher.lb_service.backend_identity"
+)
+
+var (
+	backendIdentity = flags.LabelString(backendIdentityLabel, backendIdentityRule, "What the backends without backend name are named after, rule for their hostname and path or service to keep them, and their stick tables, across hostname and path edits")
+
+	nonAlphanumeric = regexp.MustCompile("[^A-Za-z0-9]+")
+)
+
+func getBackendIdentity(labels map[string]string) (string, error) {
+	identity := backendIdentity.Get(labels)
+	if identity != backendIdentityRule && identity != backendIdentityService {
+		return "", fmt.Errorf("Invalid value for label %s=%s: expected %s or %s", backendIdentityLabel, identity, backendIdentityRule, backendIdentityService)
+	}
+	return identity, nil
+}
+
+/*
+backendNames derives the names of the backends from the services of their
+rules, as with io.rancher.lb_service.backend_identity=service the name of
+the rule 80 -> default/web is 80_default_web. The derived names can be
+used as the backend name of the per backend labels. Rules of a same port
+and service with different hostnames or paths get a _2, _3... suffix in
+their order
+*/
+type backendNames struct {
+	identity string
+	used     map[string]int
+}
+
+func newBackendNames(identity string) *backendNames {
+	return &backendNames{
+		identity: identity,
+		used:     map[string]int{},
+	}
+}
+
+// derive returns the name of the service rule without backend name,
+// empty when the backends are named after their rule
+func (n *backendNames) derive(rule metadata.PortRule) string {
+	if n.identity != backendIdentityService || rule.BackendName != "" || rule.Service == "" {
+		return ""
+	}
+	return nonAlphanumeric.ReplaceAllString(fmt.Sprintf("%v_%s", rule.SourcePort, rule.Service), "_")
+}
+
+// unique suffixes the derived name taken by a previous backend
+func (n *backendNames) unique(name string) string {
+	n.used[name]++
+	if count := n.used[name]; count > 1 {
+		return name + "_" + strconv.Itoa(count)
+	}
+	return name
+}
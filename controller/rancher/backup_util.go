@@ -0,0 +1,80 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const backupServiceLabelPrefix = "io.rancher.lb_service.backup_service."
+
+/*
+getBackupServices reads the backup services of the backends from the lb
+service labels. The endpoints of the backup service only receive the
+traffic of the backend when all its endpoints are down, for warm standby
+setups:
+
+io.rancher.lb_service.backup_service.api=stack/api-standby
+*/
+func getBackupServices(labels map[string]string) (map[string]string, error) {
+	backups := map[string]string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, backupServiceLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, backupServiceLabelPrefix)
+		if backendName == "" {
+			continue
+		}
+		if _, _, err := splitServiceName(strings.TrimSpace(v)); err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		backups[backendName] = strings.TrimSpace(v)
+	}
+	return backups, nil
+}
+
+// getBackupEndpoints returns the endpoints of the backup service on the
+// target port, marked as backups. The backends are left without backup
+// when the service is missing, so a broken standby doesn't take down
+// the primary
+func (lbc *LoadBalancerController) getBackupEndpoints(envUUID, backupName string, targetPort int, eps config.Endpoints, scope *TargetScope, network *net.IPNet) config.Endpoints {
+	if backupName == "" {
+		return nil
+	}
+	stackName, svcName, _ := splitServiceName(backupName)
+	if err := scope.Allows(envUUID, stackName); err != nil {
+		logrus.Warnf("Skipping backup service %s: %v", backupName, err)
+		return nil
+	}
+	service, err := lbc.MetaFetcher.GetService(envUUID, svcName, stackName)
+	if err != nil {
+		logrus.Warnf("Skipping backup service %s: %v", backupName, err)
+		return nil
+	}
+	if service == nil || !IsActiveService(service) {
+		return nil
+	}
+	backupEps, err := lbc.getServiceEndpoints(service, targetPort, "", "any", network, nil)
+	if err != nil {
+		logrus.Warnf("Skipping backup service %s: %v", backupName, err)
+		return nil
+	}
+	ips := map[string]bool{}
+	for _, ep := range eps {
+		ips[ep.IP] = true
+	}
+	var backups config.Endpoints
+	for _, ep := range backupEps {
+		// endpoints shared with the primary stay primary
+		if ips[ep.IP] {
+			continue
+		}
+		ep.Backup = true
+		backups = append(backups, ep)
+	}
+	return backups
+}
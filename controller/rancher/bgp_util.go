@@ -0,0 +1,16 @@
+package rancher
+
+const serviceIPsLabel = "io.rancher.lb_service.bgp_service_ips"
+
+/*
+getServiceIPs reads the ips of the lb the instances announce over bgp
+to the upstream routers, so the traffic is spread over them with ecmp:
+
+io.rancher.lb_service.bgp_service_ips=203.0.113.10,203.0.113.11
+
+Every healthy instance announces them, the hosts should have them
+bound, on the loopback interface for instance
+*/
+func getServiceIPs(labels map[string]string) ([]string, error) {
+	return getIPsLabel(labels, serviceIPsLabel)
+}
@@ -0,0 +1,226 @@
+package rancher
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var pkcs12Password = flags.Secret("CERTS_PKCS12_PASSWORD", "Password of the PKCS#12 bundles in the cert dirs")
+
+/*
+readCertBundle reads the cert of the dir from a single file holding both
+the certificate chain and the key, when the dir has no separate cert and
+key files. Supported bundles are PKCS#12 files (.p12, .pfx), and PEM
+files (.pem, .crt) with the key embedded
+*/
+func (fetcher *RCertificateFetcher) readCertBundle(dir string, files []os.FileInfo, name string) *config.Certificate {
+	for _, file := range files {
+		if file.IsDir() || file.Name() == fetcher.CertName || file.Name() == fetcher.KeyName {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if ext != ".p12" && ext != ".pfx" && ext != ".pem" && ext != ".crt" {
+			continue
+		}
+		filePath := filepath.Join(dir, file.Name())
+		contentBytes, err := fetcher.evaluatueLinkAndReadFile(dir, file.Name())
+		if err != nil {
+			logrus.Errorf("Error while reading file [%v]. Error: %v", filePath, err)
+			continue
+		}
+		var blocks []*pem.Block
+		if ext == ".p12" || ext == ".pfx" {
+			if blocks, err = decodePKCS12(*contentBytes, pkcs12Password.Get()); err != nil {
+				logrus.Errorf("Failed to parse PKCS#12 bundle [%v]. Error: %v", filePath, err)
+				continue
+			}
+		} else {
+			blocks = decodePEMBlocks(*contentBytes)
+		}
+		certs, keys := splitPEMBlocks(blocks)
+		if len(certs) == 0 || len(keys) == 0 {
+			// chain or key only file, not a bundle
+			continue
+		}
+		cert, err := newCertFromBlocks(name, certs, keys)
+		if err != nil {
+			logrus.Errorf("Failed to read cert bundle [%v]. Error: %v", filePath, err)
+			continue
+		}
+		logrus.Debugf("Read cert %v from bundle [%v]", name, filePath)
+		return cert
+	}
+	return nil
+}
+
+// decodePKCS12 returns the key and the certs of the PKCS#12 bundle as
+// PEM blocks, the key is PKCS#8 encoded
+func decodePKCS12(data []byte, password string) ([]*pem.Block, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []*pem.Block{
+		{Type: "PRIVATE KEY", Bytes: keyDER},
+		{Type: "CERTIFICATE", Bytes: cert.Raw},
+	}
+	for _, caCert := range caCerts {
+		blocks = append(blocks, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	}
+	return blocks, nil
+}
+
+func decodePEMBlocks(data []byte) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func splitPEMBlocks(blocks []*pem.Block) ([]*pem.Block, []*pem.Block) {
+	var certs, keys []*pem.Block
+	for _, block := range blocks {
+		switch {
+		case block.Type == "CERTIFICATE":
+			certs = append(certs, block)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keys = append(keys, block)
+		}
+	}
+	return certs, keys
+}
+
+// newCertFromBlocks picks the key matching one of the certs, and
+// orders the certs as the chain of the leaf cert of the key
+func newCertFromBlocks(name string, certBlocks []*pem.Block, keyBlocks []*pem.Block) (*config.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, block := range certBlocks {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	for _, keyBlock := range keyBlocks {
+		if x509.IsEncryptedPEMBlock(keyBlock) {
+			return nil, fmt.Errorf("encrypted private keys are not supported")
+		}
+		key, err := parsePrivateKey(keyBlock)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := orderCertChain(certs, key)
+		if err != nil {
+			continue
+		}
+		var certPEM bytes.Buffer
+		for _, cert := range chain {
+			pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+		return &config.Certificate{
+			Name: name,
+			Cert: certPEM.String(),
+			Key:  string(pem.EncodeToMemory(&pem.Block{Type: keyBlock.Type, Bytes: keyBlock.Bytes})),
+		}, nil
+	}
+	return nil, fmt.Errorf("no certificate matches the private key")
+}
+
+func parsePrivateKey(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+}
+
+func keyMatchesCert(key interface{}, cert *x509.Certificate) bool {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		return ok && pub.N.Cmp(k.N) == 0 && pub.E == k.E
+	case *ecdsa.PrivateKey:
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		return ok && pub.X.Cmp(k.X) == 0 && pub.Y.Cmp(k.Y) == 0
+	}
+	return false
+}
+
+/*
+orderCertChain returns the leaf cert of the key followed by its
+intermediates, each cert followed by its issuer. Certs not in
+the chain of the leaf are dropped
+*/
+func orderCertChain(certs []*x509.Certificate, key interface{}) ([]*x509.Certificate, error) {
+	used := make([]bool, len(certs))
+	var chain []*x509.Certificate
+	for i, cert := range certs {
+		if keyMatchesCert(key, cert) {
+			chain = append(chain, cert)
+			used[i] = true
+			break
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate matches the private key")
+	}
+	for {
+		current := chain[len(chain)-1]
+		if bytes.Equal(current.RawIssuer, current.RawSubject) {
+			break
+		}
+		next := -1
+		for i, cert := range certs {
+			if !used[i] && isIssuer(cert, current) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		chain = append(chain, certs[next])
+		used[next] = true
+	}
+	for i, cert := range certs {
+		if !used[i] {
+			logrus.Warnf("Dropping certificate [%v] not in the chain of [%v]", cert.Subject.CommonName, chain[0].Subject.CommonName)
+		}
+	}
+	return chain, nil
+}
+
+func isIssuer(issuer *x509.Certificate, cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	if len(cert.AuthorityKeyId) > 0 && len(issuer.SubjectKeyId) > 0 {
+		return bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId)
+	}
+	return true
+}
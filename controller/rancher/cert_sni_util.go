@@ -0,0 +1,135 @@
+package rancher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	certSNILabelPrefix   = "io.rancher.lb_service.cert_hostnames."
+	portCertsLabelPrefix = "io.rancher.lb_service.port_certs."
+)
+
+var sniFilterRegexp = regexp.MustCompile(`^!?(\*\.)?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+/*
+getCertSNIOverrides reads the hostnames certs are served for from the lb
+service labels, overriding the hostnames the certs are issued for. The
+label suffix is the cert name, hostnames prefixed with ! are excluded:
+
+io.rancher.lb_service.cert_hostnames.wildcard-cert=*.example.com,!admin.example.com
+*/
+func getCertSNIOverrides(labels map[string]string) (map[string][]string, error) {
+	overrides := map[string][]string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, certSNILabelPrefix) {
+			continue
+		}
+		certName := strings.TrimPrefix(k, certSNILabelPrefix)
+		if certName == "" {
+			continue
+		}
+		var hostnames []string
+		for _, hostname := range strings.Split(v, ",") {
+			hostname = strings.ToLower(strings.TrimSpace(hostname))
+			if hostname == "" {
+				continue
+			}
+			if !sniFilterRegexp.MatchString(hostname) {
+				return nil, fmt.Errorf("Invalid value for label %s=%s: invalid hostname %s", k, v, hostname)
+			}
+			hostnames = append(hostnames, hostname)
+		}
+		if len(hostnames) == 0 {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: no hostnames set", k, v)
+		}
+		overrides[certName] = hostnames
+	}
+	return overrides, nil
+}
+
+func setCertSNIOverrides(certs []*config.Certificate, overrides map[string][]string) {
+	found := map[string]bool{}
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		if hostnames, ok := overrides[cert.Name]; ok {
+			cert.Hostnames = hostnames
+			found[cert.Name] = true
+		}
+	}
+	for certName := range overrides {
+		if !found[certName] {
+			logrus.Warnf("Hostnames are set for cert %s, but the lb has no such cert", certName)
+		}
+	}
+}
+
+/*
+getPortCerts reads the certs the frontends present from the lb service
+labels, the label suffix is the source port of the frontend and the
+first cert is served to the clients not sending SNI:
+
+io.rancher.lb_service.port_certs.8443=internal-ca
+*/
+func getPortCerts(labels map[string]string) (map[int][]string, error) {
+	portCerts := map[int][]string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, portCertsLabelPrefix) {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimPrefix(k, portCertsLabelPrefix))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid label %s, the suffix should be the source port", k)
+		}
+		var names []string
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: no certs set", k, v)
+		}
+		portCerts[port] = names
+	}
+	return portCerts, nil
+}
+
+// getFrontendCerts returns the certs selected for the frontend of the rule,
+// nil when the frontend presents all certs
+func getFrontendCerts(portCerts map[int][]string, rule metadata.PortRule, certs []*config.Certificate) []string {
+	names, ok := portCerts[rule.SourcePort]
+	if !ok {
+		return nil
+	}
+	if rule.Protocol != config.HTTPSProto && rule.Protocol != config.TLSProto {
+		logrus.Warnf("Ignoring certs selected for port %v, protocol %s doesn't terminate ssl", rule.SourcePort, rule.Protocol)
+		return nil
+	}
+	known := map[string]bool{}
+	for _, cert := range certs {
+		if cert != nil {
+			known[cert.Name] = true
+		}
+	}
+	var selected []string
+	for _, name := range names {
+		if !known[name] {
+			logrus.Warnf("Cert %s selected for port %v is not found", name, rule.SourcePort)
+			continue
+		}
+		selected = append(selected, name)
+	}
+	if len(selected) == 0 {
+		logrus.Warnf("None of the certs selected for port %v is found, the port presents all the certs", rule.SourcePort)
+	}
+	return selected
+}
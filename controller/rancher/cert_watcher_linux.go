@@ -0,0 +1,86 @@
+// +build linux
+
+package rancher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// certWatchMask covers files written in place, and files and
+// symlinks swapped in, as done for mounted secrets
+const certWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+type inotifyWatcher struct {
+	fd     int
+	dirs   []string
+	events chan struct{}
+}
+
+// newCertDirWatcher watches the cert dirs and their sub dirs with inotify,
+// the returned channel receives a value when anything changes in the dirs
+func newCertDirWatcher(dirs []string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:     fd,
+		dirs:   dirs,
+		events: make(chan struct{}, 1),
+	}
+	if err := w.watchDirs(); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go w.run()
+	return w.events, nil
+}
+
+// watchDirs adds watches for the dirs, adding a watch for
+// an already watched dir only updates its existing watch
+func (w *inotifyWatcher) watchDirs() error {
+	for _, dir := range w.dirs {
+		err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+			if err != nil || !f.IsDir() {
+				return nil
+			}
+			_, err = syscall.InotifyAddWatch(w.fd, path, certWatchMask)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*16)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Stopped watching cert dirs %v, falling back to polling: %v", w.dirs, err)
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+		// cert sub dirs created since the last event need their own watches
+		if err := w.watchDirs(); err != nil {
+			logrus.Warnf("Failed to watch cert dirs %v: %v", w.dirs, err)
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// +build linux
+
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertDirWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("Failed to create cert dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	events, err := newCertDirWatcher([]string{dir})
+	if err != nil {
+		t.Fatalf("Failed to watch cert dir %v", err)
+	}
+	certDir := filepath.Join(dir, "a.com")
+	if err := os.Mkdir(certDir, 0755); err != nil {
+		t.Fatalf("Failed to create cert sub dir %v", err)
+	}
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event for the created sub dir")
+	}
+
+	// the new sub dir is watched too
+	if err := ioutil.WriteFile(filepath.Join(certDir, "fullchain.pem"), []byte("cert"), 0644); err != nil {
+		t.Fatalf("Failed to write cert %v", err)
+	}
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event for the cert written in the sub dir")
+	}
+}
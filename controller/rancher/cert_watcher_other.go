@@ -0,0 +1,9 @@
+// +build !linux
+
+package rancher
+
+import "fmt"
+
+func newCertDirWatcher(dirs []string) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("watching cert dirs is only supported on linux")
+}
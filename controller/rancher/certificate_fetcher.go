@@ -7,6 +7,8 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,8 @@ import (
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/utils/cattle"
 )
 
 const (
@@ -21,6 +25,10 @@ const (
 	DefaultKeyName  = "privkey.pem"
 )
 
+const certWatchDelay = 500 * time.Millisecond
+
+var certsWatch = flags.Bool("CERTS_WATCH", true, "Watch cert dirs for changes in addition to polling them")
+
 type CertificateFetcher interface {
 	FetchCertificates(lbMeta *LBMetadata, isDefaultCert bool) ([]*config.Certificate, error)
 	UpdateEndpoints(lbSvc *metadata.Service, eps []client.PublicEndpoint) error
@@ -28,15 +36,21 @@ type CertificateFetcher interface {
 }
 
 type RCertificateFetcher struct {
-	Client *client.RancherClient
+	Client *cattle.Client
+	// ReadOnly is set when the client keys are agent scoped, the certs
+	// are then read from the cert dirs only, and the endpoints are not updated
+	ReadOnly bool
 
+	// CertDir and DefaultCertDir are colon separated lists of dirs,
+	// on cert name conflicts the dirs listed first take precedence
 	CertDir        string
 	DefaultCertDir string
 
 	CertsCache  map[string]*config.Certificate //cert name (sub dir name) -> cert
 	DefaultCert *config.Certificate
 
-	tempCertsMap        map[string]*config.Certificate //cert name (sub dir name) -> cert
+	tempCertsMap        map[string]*config.Certificate            //cert name (sub dir name) -> cert
+	dirCerts            map[string]map[string]*config.Certificate //dir -> certs last read from the dir
 	updateCheckInterval int
 	forceUpdateInterval float64
 
@@ -47,6 +61,15 @@ type RCertificateFetcher struct {
 
 	initPollDone bool
 	initPollMu   *sync.RWMutex
+
+	readOnlyWarned sync.Once
+}
+
+// logReadOnly logs the features disabled in read-only mode
+func logReadOnly() {
+	logrus.Warnf("Running with read-only Rancher API keys (CATTLE_READ_ONLY), the following features are disabled: " +
+		"fetching the lb certificates from Rancher, use the cert_dir and default_cert_dir labels instead; " +
+		"updating the public endpoints of the lb services")
 }
 
 func (fetcher *RCertificateFetcher) checkIfInitPollDone() bool {
@@ -95,6 +118,12 @@ func (fetcher *RCertificateFetcher) FetchCertificates(lbMeta *LBMetadata, isDefa
 				time.Sleep(time.Duration(2) * time.Second)
 			}
 		}
+	} else if fetcher.ReadOnly {
+		if len(lbMeta.CertificateIDs) > 0 || lbMeta.DefaultCertificateID != "" {
+			fetcher.readOnlyWarned.Do(func() {
+				logrus.Warnf("Skipping the certificates of the lb, they can't be fetched from Rancher in read-only mode")
+			})
+		}
 	} else {
 		if !isDefaultCert {
 			for _, certID := range lbMeta.CertificateIDs {
@@ -125,13 +154,14 @@ func (fetcher *RCertificateFetcher) FetchRancherCertificate(certID string) (*con
 	if certID == "" {
 		return nil, nil
 	}
-	opts := client.NewListOpts()
-	opts.Filters["id"] = certID
-	opts.Filters["removed_null"] = "1"
-
-	cert, err := fetcher.Client.Certificate.ById(certID)
+	var cert *client.Certificate
+	err := fetcher.Client.Do("get certificate "+certID, func(rancherClient *client.RancherClient) error {
+		var err error
+		cert, err = rancherClient.Certificate.ById(certID)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Coudln't get certificate by id [%s]. Error: %#v", certID, err)
+		return nil, fmt.Errorf("Coudln't get certificate by id [%s]. Error: %v", certID, err)
 	}
 	if cert == nil {
 		return nil, fmt.Errorf("Failed to fetch certificate by id [%s]", certID)
@@ -145,12 +175,21 @@ func (fetcher *RCertificateFetcher) FetchRancherCertificate(certID string) (*con
 }
 
 func (fetcher *RCertificateFetcher) UpdateEndpoints(lbSvc *metadata.Service, eps []client.PublicEndpoint) error {
+	if fetcher.ReadOnly {
+		logrus.Debugf("Skipping the public endpoints update of lb [%s] in read-only mode", lbSvc.Name)
+		return nil
+	}
 	opts := client.NewListOpts()
 	opts.Filters["uuid"] = lbSvc.UUID
 	opts.Filters["removed_null"] = "1"
-	lbs, err := fetcher.Client.LoadBalancerService.List(opts)
+	var lbs *client.LoadBalancerServiceCollection
+	err := fetcher.Client.Do("list lb service "+lbSvc.UUID, func(rancherClient *client.RancherClient) error {
+		var err error
+		lbs, err = rancherClient.LoadBalancerService.List(opts)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Coudln't get LB service by uuid [%s]. Error: %#v", lbSvc.UUID, err)
+		return fmt.Errorf("Coudln't get LB service by uuid [%s]. Error: %v", lbSvc.UUID, err)
 	}
 	if len(lbs.Data) == 0 {
 		logrus.Infof("Failed to find lb by uuid %s", lbSvc.UUID)
@@ -161,8 +200,12 @@ func (fetcher *RCertificateFetcher) UpdateEndpoints(lbSvc *metadata.Service, eps
 	toUpdate := make(map[string]interface{})
 	toUpdate["publicEndpoints"] = eps
 	logrus.Infof("Updating Rancher LB [%s] in stack [%s] with the new public endpoints [%v] ", lbSvc.Name, lbSvc.StackName, eps)
-	if _, err := fetcher.Client.LoadBalancerService.Update(&lb, toUpdate); err != nil {
-		return fmt.Errorf("Failed to update Rancher LB [%s] in stack [%s]. Error: %#v", lbSvc.Name, lbSvc.StackName, err)
+	err = fetcher.Client.Do("update lb service "+lbSvc.UUID, func(rancherClient *client.RancherClient) error {
+		_, err := rancherClient.LoadBalancerService.Update(&lb, toUpdate)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update Rancher LB [%s] in stack [%s]. Error: %v", lbSvc.Name, lbSvc.StackName, err)
 	}
 	return nil
 }
@@ -171,8 +214,9 @@ func (fetcher *RCertificateFetcher) ReadAllCertificatesFromDir(certDir string) [
 	certs := []*config.Certificate{}
 
 	fetcher.mu.RLock()
-	for _, value := range fetcher.CertsCache {
-		certs = append(certs, value)
+	// ordered by their dir, the map order would change between syncs
+	for _, path := range sortedCertPaths(fetcher.CertsCache) {
+		certs = append(certs, fetcher.CertsCache[path])
 	}
 	fetcher.mu.RUnlock()
 
@@ -193,6 +237,7 @@ func (fetcher *RCertificateFetcher) LookForCertUpdates(doOnUpdate func(string))
 
 	if fetcher.CertDir != "" || fetcher.DefaultCertDir != "" {
 		lastUpdated := time.Now()
+		events := fetcher.watchCertDirs()
 		for {
 			logrus.Debugf("Start --- LookForCertUpdates polling cert dir %v and default cert dir %v", fetcher.CertDir, fetcher.DefaultCertDir)
 			forceUpdate := false
@@ -204,52 +249,43 @@ func (fetcher *RCertificateFetcher) LookForCertUpdates(doOnUpdate func(string))
 				forceUpdate = true
 			}
 
-			//read the certs from the dir into tempMap
+			//read the certs from the dirs into tempMap
 			if fetcher.CertDir != "" {
-				fetcher.tempCertsMap = make(map[string]*config.Certificate)
-				err := filepath.Walk(fetcher.CertDir, fetcher.readCertificate)
-				if err != nil {
-					logrus.Errorf("LookForCertUpdates: Error %v reading certs from cert dir  %v", err, fetcher.CertDir)
-				} else {
-					//compare with existing cache
-					if forceUpdate || !reflect.DeepEqual(fetcher.CertsCache, fetcher.tempCertsMap) {
-						if !forceUpdate {
-							logrus.Infof("LookForCertUpdates: Found an update in cert dir %v, updating the cache", fetcher.CertDir)
-						} else {
-							logrus.Infof("LookForCertUpdates: Force Update triggered, updating the cache from cert dir %v", fetcher.CertDir)
-						}
-						//there is some change, refresh certs
-						fetcher.mu.Lock()
-						fetcher.CertsCache = make(map[string]*config.Certificate)
-						for path, newCert := range fetcher.tempCertsMap {
-							fetcher.CertsCache[path] = newCert
-							logrus.Debugf("LookForCertUpdates: Cert is reloaded in cache : %v", newCert.Name)
-						}
-						certsUpdatedFlag = true
-						fetcher.mu.Unlock()
+				fetcher.tempCertsMap = mergeCertDirs(fetcher.pollCertDirs(splitCertDirs(fetcher.CertDir)))
+				//compare with existing cache
+				if forceUpdate || !reflect.DeepEqual(fetcher.CertsCache, fetcher.tempCertsMap) {
+					if !forceUpdate {
+						logrus.Infof("LookForCertUpdates: Found an update in cert dir %v, updating the cache", fetcher.CertDir)
+					} else {
+						logrus.Infof("LookForCertUpdates: Force Update triggered, updating the cache from cert dir %v", fetcher.CertDir)
 					}
+					//there is some change, refresh certs
+					fetcher.mu.Lock()
+					fetcher.CertsCache = make(map[string]*config.Certificate)
+					for path, newCert := range fetcher.tempCertsMap {
+						fetcher.CertsCache[path] = newCert
+						logrus.Debugf("LookForCertUpdates: Cert is reloaded in cache : %v", newCert.Name)
+					}
+					certsUpdatedFlag = true
+					fetcher.mu.Unlock()
 				}
 			}
 
-			//read the cert from the defaultCertDir into tempMap
+			//read the default cert from the first of the default cert dirs having one
 			if fetcher.DefaultCertDir != "" {
-				fetcher.tempCertsMap = make(map[string]*config.Certificate)
-				err := filepath.Walk(fetcher.DefaultCertDir, fetcher.readCertificate)
-				if err != nil {
-					logrus.Errorf("LookForCertUpdates: Error %v reading default cert from dir  %v", err, fetcher.DefaultCertDir)
-				} else {
-					var tempDefCert *config.Certificate
-					for _, cert := range fetcher.tempCertsMap {
-						tempDefCert = cert
-					}
-					//compare with existing default cert
-					if forceUpdate || !reflect.DeepEqual(fetcher.DefaultCert, tempDefCert) {
-						fetcher.mu.Lock()
-						fetcher.DefaultCert = tempDefCert
-						certsUpdatedFlag = true
-						fetcher.mu.Unlock()
+				var tempDefCert *config.Certificate
+				for _, certs := range fetcher.pollCertDirs(splitCertDirs(fetcher.DefaultCertDir)) {
+					if tempDefCert = firstCert(certs); tempDefCert != nil {
+						break
 					}
 				}
+				//compare with existing default cert
+				if forceUpdate || !reflect.DeepEqual(fetcher.DefaultCert, tempDefCert) {
+					fetcher.mu.Lock()
+					fetcher.DefaultCert = tempDefCert
+					certsUpdatedFlag = true
+					fetcher.mu.Unlock()
+				}
 			}
 
 			if certsUpdatedFlag {
@@ -263,9 +299,105 @@ func (fetcher *RCertificateFetcher) LookForCertUpdates(doOnUpdate func(string))
 			}
 
 			logrus.Debug("Done --- LookForCertUpdates poll")
-			time.Sleep(time.Duration(fetcher.updateCheckInterval) * time.Second)
+			fetcher.waitForCertUpdates(events)
+		}
+	}
+}
+
+// watchCertDirs watches the cert dirs for changes, nil is
+// returned when the dirs can't be watched and are only polled
+func (fetcher *RCertificateFetcher) watchCertDirs() <-chan struct{} {
+	if !certsWatch.Get() {
+		return nil
+	}
+	dirs := append(splitCertDirs(fetcher.CertDir), splitCertDirs(fetcher.DefaultCertDir)...)
+	events, err := newCertDirWatcher(dirs)
+	if err != nil {
+		logrus.Warnf("Failed to watch cert dirs %v, falling back to polling: %v", dirs, err)
+		return nil
+	}
+	logrus.Infof("Watching cert dirs %v for changes", dirs)
+	return events
+}
+
+// waitForCertUpdates waits for the next poll, or for a change in the watched dirs
+func (fetcher *RCertificateFetcher) waitForCertUpdates(events <-chan struct{}) {
+	select {
+	case <-events:
+		// let all the files of a rotated cert be written before reading them
+		time.Sleep(certWatchDelay)
+		select {
+		case <-events:
+		default:
+		}
+	case <-time.After(time.Duration(fetcher.updateCheckInterval) * time.Second):
+	}
+}
+
+// splitCertDirs splits colon separated list of cert dirs
+func splitCertDirs(value string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(value, ":") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
 		}
 	}
+	return dirs
+}
+
+// pollCertDirs reads the certs of each of the dirs, in the order of the
+// dirs. A dir failing to be read keeps the certs it had on the last poll
+func (fetcher *RCertificateFetcher) pollCertDirs(dirs []string) []map[string]*config.Certificate {
+	if fetcher.dirCerts == nil {
+		fetcher.dirCerts = make(map[string]map[string]*config.Certificate)
+	}
+	var result []map[string]*config.Certificate
+	for _, dir := range dirs {
+		fetcher.tempCertsMap = make(map[string]*config.Certificate)
+		if err := filepath.Walk(dir, fetcher.readCertificate); err != nil {
+			logrus.Errorf("LookForCertUpdates: Error %v reading certs from dir %v", err, dir)
+		} else {
+			fetcher.dirCerts[dir] = fetcher.tempCertsMap
+		}
+		result = append(result, fetcher.dirCerts[dir])
+	}
+	return result
+}
+
+// mergeCertDirs merges the certs read from the dirs, a cert
+// is skipped when a preceding dir has a cert with the same name
+func mergeCertDirs(dirCerts []map[string]*config.Certificate) map[string]*config.Certificate {
+	merged := make(map[string]*config.Certificate)
+	names := make(map[string]string)
+	for _, certs := range dirCerts {
+		for _, path := range sortedCertPaths(certs) {
+			cert := certs[path]
+			if existing, ok := names[cert.Name]; ok {
+				logrus.Debugf("Skipping cert %v under dir [%v], it is overridden by [%v]", cert.Name, path, existing)
+				continue
+			}
+			names[cert.Name] = path
+			merged[path] = cert
+		}
+	}
+	return merged
+}
+
+func firstCert(certs map[string]*config.Certificate) *config.Certificate {
+	paths := sortedCertPaths(certs)
+	if len(paths) == 0 {
+		return nil
+	}
+	return certs[paths[0]]
+}
+
+func sortedCertPaths(certs map[string]*config.Certificate) []string {
+	var paths []string
+	for path := range certs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
 }
 
 func (fetcher *RCertificateFetcher) readCertificate(path string, f os.FileInfo, err error) error {
@@ -286,7 +418,7 @@ func (fetcher *RCertificateFetcher) readCertificate(path string, f os.FileInfo,
 			if !file.IsDir() {
 				contentBytes, err := fetcher.evaluatueLinkAndReadFile(path, file.Name())
 				if err != nil {
-					logrus.Errorf("Error while reading file [%v]. Error: %v", file.Name(), err)
+					logrus.Errorf("Error while reading file [%v]. Error: %v", filepath.Join(path, file.Name()), err)
 				} else {
 					if file.Name() == fetcher.CertName {
 						isCertFound = true
@@ -300,6 +432,8 @@ func (fetcher *RCertificateFetcher) readCertificate(path string, f os.FileInfo,
 		}
 		if isCertFound && isKeyFound {
 			fetcher.tempCertsMap[path] = &cert
+		} else if bundle := fetcher.readCertBundle(path, files, cert.Name); bundle != nil {
+			fetcher.tempCertsMap[path] = bundle
 		} else if isCertFound || isKeyFound {
 			logrus.Warnf("Skipping incomplete cert found under dir [%v], [isCertFound %v] [isKeyFound %v]", path, isCertFound, isKeyFound)
 		}
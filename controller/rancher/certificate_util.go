@@ -0,0 +1,129 @@
+package rancher
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+func getKeyType(key string) string {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return ""
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return config.RSAKeyType
+	case "EC PRIVATE KEY":
+		return config.ECDSAKeyType
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return ""
+		}
+		switch parsed.(type) {
+		case *rsa.PrivateKey:
+			return config.RSAKeyType
+		case *ecdsa.PrivateKey:
+			return config.ECDSAKeyType
+		}
+	}
+	return ""
+}
+
+func getCertHostnames(cert string) string {
+	block, _ := pem.Decode([]byte(cert))
+	if block == nil {
+		return ""
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	hostnames := map[string]bool{}
+	if parsed.Subject.CommonName != "" {
+		hostnames[strings.ToLower(parsed.Subject.CommonName)] = true
+	}
+	for _, name := range parsed.DNSNames {
+		hostnames[strings.ToLower(name)] = true
+	}
+	var names []string
+	for name := range hostnames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// CopyCertificates returns shallow copies of the certificates, the fetcher
+// owns the certificates it returns and the build annotates its own copies
+func CopyCertificates(certs []*config.Certificate) []*config.Certificate {
+	copies := make([]*config.Certificate, 0, len(certs))
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		c := *cert
+		copies = append(copies, &c)
+	}
+	return copies
+}
+
+// sortCertificates orders the certificates by name, so the configs
+// built from the same certificates are identical
+func sortCertificates(certs []*config.Certificate) []*config.Certificate {
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i] == nil || certs[j] == nil {
+			return certs[j] == nil && certs[i] != nil
+		}
+		return certs[i].Name < certs[j].Name
+	})
+	return certs
+}
+
+/*
+BundleCertificates pairs RSA and ECDSA certificates issued
+for the same set of hostnames, so the provider can serve both
+and let the client pick the one it supports
+*/
+func BundleCertificates(certs []*config.Certificate) {
+	pairs := map[string]map[string]*config.Certificate{}
+	var keys []string
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		cert.KeyType = getKeyType(cert.Key)
+		if cert.KeyType == "" {
+			continue
+		}
+		hostnames := getCertHostnames(cert.Cert)
+		if hostnames == "" {
+			continue
+		}
+		if _, ok := pairs[hostnames]; !ok {
+			pairs[hostnames] = map[string]*config.Certificate{}
+			keys = append(keys, hostnames)
+		}
+		if _, ok := pairs[hostnames][cert.KeyType]; !ok {
+			pairs[hostnames][cert.KeyType] = cert
+		}
+	}
+
+	for _, key := range keys {
+		rsaCert := pairs[key][config.RSAKeyType]
+		ecdsaCert := pairs[key][config.ECDSAKeyType]
+		if rsaCert == nil || ecdsaCert == nil {
+			continue
+		}
+		logrus.Debugf("Bundling certificates [%s] and [%s] for [%s]", rsaCert.Name, ecdsaCert.Name, key)
+		rsaCert.Bundle = rsaCert.Name
+		ecdsaCert.Bundle = rsaCert.Name
+	}
+}
@@ -0,0 +1,213 @@
+package rancher
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func generateTestCert(t *testing.T, name string, hostname string, keyType string) *config.Certificate {
+	var signer crypto.Signer
+	var keyBlock *pem.Block
+	if keyType == config.ECDSAKeyType {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate ecdsa key %v", err)
+		}
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal ecdsa key %v", err)
+		}
+		signer = key
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	} else {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatalf("Failed to generate rsa key %v", err)
+		}
+		signer = key
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate %v", err)
+	}
+
+	return &config.Certificate{
+		Name: name,
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(keyBlock)),
+	}
+}
+
+func TestBundleCertificates(t *testing.T) {
+	rsaCert := generateTestCert(t, "foo-rsa", "foo.com", config.RSAKeyType)
+	ecdsaCert := generateTestCert(t, "foo-ecdsa", "foo.com", config.ECDSAKeyType)
+	otherCert := generateTestCert(t, "bar-ecdsa", "bar.com", config.ECDSAKeyType)
+
+	BundleCertificates([]*config.Certificate{rsaCert, ecdsaCert, otherCert})
+
+	if rsaCert.KeyType != config.RSAKeyType {
+		t.Fatalf("Invalid key type for rsa cert [%s]", rsaCert.KeyType)
+	}
+	if ecdsaCert.KeyType != config.ECDSAKeyType {
+		t.Fatalf("Invalid key type for ecdsa cert [%s]", ecdsaCert.KeyType)
+	}
+	if rsaCert.Bundle != "foo-rsa" || ecdsaCert.Bundle != "foo-rsa" {
+		t.Fatalf("Certs are not bundled: rsa [%s], ecdsa [%s]", rsaCert.Bundle, ecdsaCert.Bundle)
+	}
+	if otherCert.Bundle != "" {
+		t.Fatalf("Cert without a pair shouldn't be bundled [%s]", otherCert.Bundle)
+	}
+}
+
+func TestBundleCertificatesCopies(t *testing.T) {
+	rsaCert := generateTestCert(t, "foo-rsa", "foo.com", config.RSAKeyType)
+	ecdsaCert := generateTestCert(t, "foo-ecdsa", "foo.com", config.ECDSAKeyType)
+
+	certs := CopyCertificates([]*config.Certificate{rsaCert, nil, ecdsaCert})
+	BundleCertificates(certs)
+
+	if len(certs) != 2 || certs[0].Bundle != "foo-rsa" || certs[1].Bundle != "foo-rsa" {
+		t.Fatalf("Copies are not bundled %v", certs)
+	}
+	if rsaCert.KeyType != "" || rsaCert.Bundle != "" || ecdsaCert.Bundle != "" {
+		t.Fatalf("Fetched certs shouldn't be annotated: rsa [%s], ecdsa [%s]", rsaCert.Bundle, ecdsaCert.Bundle)
+	}
+}
+
+func generateTestChain(t *testing.T) (*x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ca key %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create ca certificate %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate leaf key %v", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "foo.com"},
+		DNSNames:     []string{"foo.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("Failed to create leaf certificate %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+	return ca, leaf, leafKey
+}
+
+func TestReadCertBundle(t *testing.T) {
+	ca, leaf, key := generateTestChain(t)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key %v", err)
+	}
+	// chain in the wrong order, with the key embedded
+	var bundle []byte
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})...)
+
+	dir, err := ioutil.TempDir("", "foo.com")
+	if err != nil {
+		t.Fatalf("Failed to create cert dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "bundle.pem"), bundle, 0644); err != nil {
+		t.Fatalf("Failed to write bundle %v", err)
+	}
+
+	fetcher := &RCertificateFetcher{CertName: "fullchain.pem", KeyName: "privkey.pem"}
+	files, _ := ioutil.ReadDir(dir)
+	cert := fetcher.readCertBundle(dir, files, "foo.com")
+	if cert == nil {
+		t.Fatalf("Failed to read cert bundle")
+	}
+	certs, _ := splitPEMBlocks(decodePEMBlocks([]byte(cert.Cert)))
+	if len(certs) != 2 || !bytes.Equal(certs[0].Bytes, leaf.Raw) || !bytes.Equal(certs[1].Bytes, ca.Raw) {
+		t.Fatalf("Invalid chain order %v", cert.Cert)
+	}
+	if getKeyType(cert.Key) != config.ECDSAKeyType {
+		t.Fatalf("Invalid key %v", cert.Key)
+	}
+}
+
+func TestReadPKCS12Bundle(t *testing.T) {
+	ca, leaf, key := generateTestChain(t)
+	bundle, err := pkcs12.Encode(rand.Reader, key, leaf, []*x509.Certificate{ca}, "")
+	if err != nil {
+		t.Fatalf("Failed to encode bundle %v", err)
+	}
+	dir, err := ioutil.TempDir("", "foo.com")
+	if err != nil {
+		t.Fatalf("Failed to create cert dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "bundle.p12"), bundle, 0644); err != nil {
+		t.Fatalf("Failed to write bundle %v", err)
+	}
+
+	fetcher := &RCertificateFetcher{CertName: "fullchain.pem", KeyName: "privkey.pem"}
+	files, _ := ioutil.ReadDir(dir)
+	cert := fetcher.readCertBundle(dir, files, "foo.com")
+	if cert == nil {
+		t.Fatalf("Failed to read cert bundle")
+	}
+	certs, _ := splitPEMBlocks(decodePEMBlocks([]byte(cert.Cert)))
+	if len(certs) != 2 || !bytes.Equal(certs[0].Bytes, leaf.Raw) || !bytes.Equal(certs[1].Bytes, ca.Raw) {
+		t.Fatalf("Invalid chain %v", cert.Cert)
+	}
+	if getKeyType(cert.Key) != config.ECDSAKeyType {
+		t.Fatalf("Invalid key %v", cert.Key)
+	}
+}
+
+func TestOrderCertChainKeyMismatch(t *testing.T) {
+	ca, leaf, _ := generateTestChain(t)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := orderCertChain([]*x509.Certificate{ca, leaf}, otherKey); err == nil {
+		t.Fatalf("Chain without a cert of the key should fail")
+	}
+}
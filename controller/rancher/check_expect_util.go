@@ -0,0 +1,97 @@
+package rancher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const checkExpectLabelPrefix = "io.rancher.lb_service.check_expect."
+
+var checkHeaderRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+/*
+getCheckExpects reads the responses expected by the http checks of the
+backends from the lb service labels, so the endpoints answering 200
+while broken are marked down. The value is the match type and the
+pattern, separated by a colon:
+
+io.rancher.lb_service.check_expect.api=string:"status":"up"
+io.rancher.lb_service.check_expect.web=rstatus:^2
+io.rancher.lb_service.check_expect.auth=header:X-Health=ok
+
+The match types are status, rstatus (regex), string, rstring (regex) of
+the body, and header (haproxy 2.2 or later)
+*/
+func getCheckExpects(labels map[string]string) (map[string]*config.HealthCheckExpect, error) {
+	expects := map[string]*config.HealthCheckExpect{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, checkExpectLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, checkExpectLabelPrefix)
+		if backendName == "" {
+			continue
+		}
+		expect, err := parseCheckExpect(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		expects[backendName] = expect
+	}
+	return expects, nil
+}
+
+func parseCheckExpect(value string) (*config.HealthCheckExpect, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("expected <match>:<pattern>")
+	}
+	expect := &config.HealthCheckExpect{Match: strings.ToLower(strings.TrimSpace(parts[0])), Pattern: parts[1]}
+	switch expect.Match {
+	case "status":
+		if status, err := strconv.Atoi(expect.Pattern); err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid status [%s]", expect.Pattern)
+		}
+	case "rstatus", "rstring":
+		if _, err := regexp.Compile(expect.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid regex [%s]: %v", expect.Pattern, err)
+		}
+	case "string":
+	case "header":
+		header := strings.SplitN(expect.Pattern, "=", 2)
+		if len(header) != 2 || !checkHeaderRegexp.MatchString(header[0]) || header[1] == "" {
+			return nil, fmt.Errorf("expected header:<name>=<value>")
+		}
+		expect.Header, expect.Pattern = header[0], header[1]
+	default:
+		return nil, fmt.Errorf("unsupported match [%s], expected status, rstatus, string, rstring or header", parts[0])
+	}
+	if strings.ContainsAny(expect.Pattern, "\r\n") {
+		return nil, fmt.Errorf("pattern should be a single line")
+	}
+	return expect, nil
+}
+
+// applyCheckExpect sets the expected response of the http checks of
+// the backend, tcp checks are turned into http checks
+func applyCheckExpect(be *config.BackendService, expect *config.HealthCheckExpect) {
+	if expect == nil {
+		return
+	}
+	if be.HealthCheck == nil || (be.HealthCheck.Port == 0 && be.CheckPort == 0) {
+		logrus.Warnf("Skipping check expect of backend [%s], it has no health check", be.UUID)
+		return
+	}
+	// the health check is shared by the backends of the target
+	hc := *be.HealthCheck
+	if hc.RequestLine == "" {
+		hc.RequestLine = defaultCheckRequestLine
+	}
+	hc.Expect = expect
+	be.HealthCheck = &hc
+}
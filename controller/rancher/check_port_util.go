@@ -0,0 +1,131 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	checkPortLabelPrefix = "io.rancher.lb_service.check_port."
+	// healthCheckPortLabel is set on the target services and
+	// containers, their health check port is overridden with it
+	healthCheckPortLabel = "io.rancher.lb_target.health_check_port"
+
+	defaultCheckRequestLine = "GET / HTTP/1.0"
+)
+
+// CheckPort is the port the health checks of a backend hit
+type CheckPort struct {
+	Port int
+	// HTTP checks the port with http requests instead of connections
+	HTTP bool
+}
+
+/*
+getCheckPorts reads the check ports of the backends from the lb service
+labels, so the endpoints are checked on another port than the target
+port of the rule. The port is checked with http requests when suffixed
+with /http:
+
+io.rancher.lb_service.check_port.api=9000/http
+*/
+func getCheckPorts(labels map[string]string) (map[string]*CheckPort, error) {
+	checkPorts := map[string]*CheckPort{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, checkPortLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, checkPortLabelPrefix)
+		if backendName == "" {
+			continue
+		}
+		checkPort, err := parseCheckPort(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		checkPorts[backendName] = checkPort
+	}
+	return checkPorts, nil
+}
+
+func parseCheckPort(value string) (*CheckPort, error) {
+	checkPort := &CheckPort{}
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	if len(parts) == 2 {
+		switch strings.ToLower(parts[1]) {
+		case config.HTTPProto:
+			checkPort.HTTP = true
+		case config.TCPProto:
+		default:
+			return nil, fmt.Errorf("unsupported check protocol [%s], expected tcp or http", parts[1])
+		}
+	}
+	port, err := strconv.Atoi(parts[0])
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port [%s]", parts[0])
+	}
+	checkPort.Port = port
+	return checkPort, nil
+}
+
+// applyCheckPort sets the check port of the backend, the health check of
+// the target is extended with the defaults of rancher health checks when
+// it has none
+func applyCheckPort(be *config.BackendService, checkPort *CheckPort) {
+	if checkPort == nil {
+		return
+	}
+	if be.HealthCheck == nil {
+		be.HealthCheck = defaultHealthCheck()
+	} else {
+		// the health check is shared by the backends of the target
+		hc := *be.HealthCheck
+		be.HealthCheck = &hc
+	}
+	if checkPort.HTTP && be.HealthCheck.RequestLine == "" {
+		be.HealthCheck.RequestLine = defaultCheckRequestLine
+	}
+	be.CheckPort = checkPort.Port
+}
+
+// defaultHealthCheck has the defaults of rancher health checks
+func defaultHealthCheck() *config.HealthCheck {
+	return &config.HealthCheck{
+		ResponseTimeout:    2000,
+		Interval:           2000,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+/*
+applyHealthCheckPortLabel overrides the port of the health check with
+the health_check_port label of the target, so the checks probe a
+dedicated port while the traffic goes to the target port:
+
+io.rancher.lb_target.health_check_port=9000
+
+The label is set by the owners of the targets, an invalid value is
+logged and ignored rather than failing the lb
+*/
+func applyHealthCheckPortLabel(hc *config.HealthCheck, labels map[string]string) *config.HealthCheck {
+	value, ok := labels[healthCheckPortLabel]
+	if !ok {
+		return hc
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 1 || port > 65535 {
+		logrus.Warnf("Ignoring invalid label %s=%s", healthCheckPortLabel, value)
+		return hc
+	}
+	if hc == nil || hc.Interval <= 0 {
+		// the target has no health check of its own
+		hc = defaultHealthCheck()
+	}
+	hc.Port = port
+	return hc
+}
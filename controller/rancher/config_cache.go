@@ -0,0 +1,115 @@
+package rancher
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+// versionFetcher is implemented by the metadata fetchers
+// able to tell the version of the metadata they read
+type versionFetcher interface {
+	GetVersion() (string, error)
+}
+
+func (mf RMetaFetcher) GetVersion() (string, error) {
+	return mf.MetadataClient.GetVersion()
+}
+
+// metadataVersion returns the current metadata version, empty
+// when the fetcher can't tell it and the configs aren't cached
+func (lbc *LoadBalancerController) metadataVersion() string {
+	fetcher, ok := lbc.MetaFetcher.(versionFetcher)
+	if !ok {
+		return ""
+	}
+	version, err := fetcher.GetVersion()
+	if err != nil {
+		logrus.Debugf("Failed to read the metadata version, skipping the config cache: %v", err)
+		return ""
+	}
+	return version
+}
+
+/*
+configCache holds the configs built from a metadata version. The version
+is read before the metadata, so the configs are built from that version
+or a later one, and a later one gets notified and rebuilt.
+
+The configs depend on more than the metadata: the cert updates and the
+faults invalidate the cache, and the syncs retried for failed rules or
+held endpoints don't fill it. The configs built while the cache got
+invalidated aren't cached either, they may miss the update
+*/
+type configCache struct {
+	mu      sync.Mutex
+	version string
+	configs []*config.LoadBalancerConfig
+	// snapshot is the metadata the configs are built from
+	snapshot *MetadataSnapshot
+	// applied is set once the configs of the version applied
+	applied bool
+	// generation is bumped by every invalidation
+	generation int
+}
+
+// get returns the configs built from the version, and whether they applied
+func (c *configCache) get(version string) ([]*config.LoadBalancerConfig, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version == "" || c.version != version {
+		return nil, false, false
+	}
+	return c.configs, c.applied, true
+}
+
+// getSnapshot returns the snapshot of the configs built from the version
+func (c *configCache) getSnapshot(version string) *MetadataSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version == "" || c.version != version {
+		return nil
+	}
+	return c.snapshot
+}
+
+// getGeneration returns the generation the configs are built at
+func (c *configCache) getGeneration() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// set caches the configs unless the cache got invalidated since
+// the generation they were built at
+func (c *configCache) set(version string, generation int, configs []*config.LoadBalancerConfig, snapshot *MetadataSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.version = version
+	c.configs = configs
+	c.snapshot = snapshot
+	c.applied = false
+}
+
+// setApplied records the configs of the version as applied
+func (c *configCache) setApplied(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != "" && c.version == version {
+		c.applied = true
+	}
+}
+
+func (c *configCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version = ""
+	c.configs = nil
+	c.snapshot = nil
+	c.applied = false
+	c.generation++
+}
@@ -0,0 +1,101 @@
+package rancher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	debugCaptureLabelPrefix = "io.rancher.lb_service.debug_capture."
+	maxDebugCaptureDuration = 24 * time.Hour
+)
+
+/*
+getDebugCaptures reads the backends whose requests are captured for
+debugging, and for how long. The backend name is given in the label
+suffix, and the capture starts when the label is first seen:
+
+io.rancher.lb_service.debug_capture.api=10m
+*/
+func getDebugCaptures(labels map[string]string) (map[string]time.Duration, error) {
+	captures := map[string]time.Duration{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, debugCaptureLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, debugCaptureLabelPrefix)
+		if backendName == "" {
+			return nil, fmt.Errorf("Invalid label %s, the suffix should be a backend name", k)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d <= 0 || d > maxDebugCaptureDuration {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, should be a duration up to %v", k, v, maxDebugCaptureDuration)
+		}
+		captures[backendName] = d
+	}
+	return captures, nil
+}
+
+// captureDeadlines tracks when the captures end, a capture
+// set again with another duration starts over
+type captureDeadlines struct {
+	mu        sync.Mutex
+	deadlines map[string]time.Time
+}
+
+/*
+update returns the deadlines of the captures by backend name. Captures
+no longer set are forgotten, and expired ones are left out until
+their label is removed or changed
+*/
+func (c *captureDeadlines) update(captures map[string]time.Duration, now time.Time) map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadlines := map[string]time.Time{}
+	active := map[string]time.Time{}
+	for backendName, d := range captures {
+		key := fmt.Sprintf("%s=%v", backendName, d)
+		deadline, ok := c.deadlines[key]
+		if !ok {
+			deadline = now.Add(d)
+			logrus.Infof("Capturing the requests of backend [%s] until %v", backendName, deadline.Format(time.RFC3339))
+		}
+		deadlines[key] = deadline
+		if now.Before(deadline) {
+			active[backendName] = deadline
+		} else {
+			logrus.Debugf("Capture of backend [%s] expired at %v", backendName, deadline.Format(time.RFC3339))
+		}
+	}
+	c.deadlines = deadlines
+	return active
+}
+
+// active returns true while a capture is running
+func (c *captureDeadlines) active(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, deadline := range c.deadlines {
+		if now.Before(deadline) {
+			return true
+		}
+	}
+	return false
+}
+
+func getDebugCapture(deadlines map[string]time.Time, backendName string, protocol string) *config.DebugCapture {
+	deadline, ok := deadlines[backendName]
+	if !ok {
+		return nil
+	}
+	if !isHTTPProto(protocol) {
+		logrus.Warnf("Skipping debug capture for backend [%s], not supported for protocol %s", backendName, protocol)
+		return nil
+	}
+	return &config.DebugCapture{Until: deadline}
+}
@@ -0,0 +1,95 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+const dnsLabel = "io.rancher.lb_service.dns"
+
+/*
+getResolvers reads dns resolution settings of the external service
+hostnames from the lb service label:
+
+io.rancher.lb_service.dns=nameservers=10.0.0.2:53 10.0.0.3,resolve_prefer=ipv4,hold_valid=10s,server_slots=4
+
+Nameservers are separated by spaces and default to port 53. With
+server_slots set the hostname can resolve to multiple A records,
+each of them is given a server slot.
+*/
+func getResolvers(labels map[string]string) (*config.Resolvers, error) {
+	value, ok := labels[dnsLabel]
+	if !ok {
+		return nil, nil
+	}
+	resolvers := &config.Resolvers{}
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: setting %s should be in key=value format", dnsLabel, value, setting)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if err := setResolversOption(resolvers, key, val); err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", dnsLabel, value, err)
+		}
+	}
+	return resolvers, nil
+}
+
+func setResolversOption(resolvers *config.Resolvers, key string, val string) error {
+	switch key {
+	case "nameservers":
+		for _, ns := range strings.Fields(val) {
+			host, port, err := net.SplitHostPort(ns)
+			if err != nil {
+				host, port = ns, "53"
+			}
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("invalid nameserver %s", ns)
+			}
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("invalid nameserver port %s", ns)
+			}
+			resolvers.Nameservers = append(resolvers.Nameservers, net.JoinHostPort(host, port))
+		}
+	case "resolve_prefer":
+		if val != "ipv4" && val != "ipv6" {
+			return fmt.Errorf("unsupported resolve_prefer %s", val)
+		}
+		resolvers.ResolvePrefer = val
+	case "resolve_retries", "server_slots":
+		i, err := strconv.Atoi(val)
+		if err != nil || i < 1 {
+			return fmt.Errorf("invalid %s %s", key, val)
+		}
+		if key == "resolve_retries" {
+			resolvers.ResolveRetries = i
+		} else {
+			resolvers.ServerSlots = i
+		}
+	case "timeout_retry", "hold_valid", "hold_other":
+		if _, err := time.ParseDuration(val); err != nil {
+			return fmt.Errorf("invalid %s %s", key, val)
+		}
+		switch key {
+		case "timeout_retry":
+			resolvers.TimeoutRetry = val
+		case "hold_valid":
+			resolvers.HoldValid = val
+		default:
+			resolvers.HoldOther = val
+		}
+	default:
+		return fmt.Errorf("unsupported setting %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package rancher
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var endpointsHold = flags.LabelInt("io.rancher.lb_service.endpoints_hold", 0, "Seconds the last known endpoints of a service are kept when the metadata briefly reports it without containers, 0 disables the hold").Range(0, 3600)
+
+// isEndpointsBlip tells whether the service has no containers while it
+// should, as when the metadata briefly loses them. Services scaled
+// down or whose containers are stopped are confirmed gone
+func isEndpointsBlip(svc *metadata.Service) bool {
+	if !strings.EqualFold(svc.Kind, "service") {
+		return false
+	}
+	return len(svc.Containers) == 0 && svc.Scale > 0
+}
+
+type heldEndpoints struct {
+	eps  config.Endpoints
+	seen time.Time
+	// serving is set while the endpoints are held in the config
+	serving bool
+	until   time.Time
+}
+
+// endpointHolds keeps the last known endpoints of the port rules,
+// keyed by the backend and the service of the rule
+type endpointHolds struct {
+	mu   sync.Mutex
+	held map[string]*heldEndpoints
+}
+
+/*
+hold returns the endpoints of the rule, or its last known endpoints marked
+no-check when the service has none because of a metadata blip, until they
+were seen longer than holdFor ago. Endpoints of rules not seen for that
+long are forgotten
+*/
+func (h *endpointHolds) hold(key string, eps config.Endpoints, blip bool, holdFor time.Duration, now time.Time) config.Endpoints {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if holdFor <= 0 {
+		h.held = nil
+		return eps
+	}
+	if h.held == nil {
+		h.held = map[string]*heldEndpoints{}
+	}
+	for k, held := range h.held {
+		if now.Sub(held.seen) >= holdFor {
+			delete(h.held, k)
+		}
+	}
+	if len(eps) > 0 {
+		h.held[key] = &heldEndpoints{eps: copyEndpoints(eps), seen: now}
+		return eps
+	}
+	held, ok := h.held[key]
+	if !blip || !ok {
+		delete(h.held, key)
+		return eps
+	}
+	held.serving = true
+	held.until = held.seen.Add(holdFor)
+	logrus.Warnf("Holding %v endpoints of [%s] until %v, the service has no containers", len(held.eps), key, held.until.Format(time.RFC3339))
+	eps = copyEndpoints(held.eps)
+	for _, ep := range eps {
+		// the held endpoints are assumed up, as last seen
+		ep.NoCheck = true
+	}
+	return eps
+}
+
+// copyEndpoints copies the endpoints, the provider sets their config
+func copyEndpoints(eps config.Endpoints) config.Endpoints {
+	copied := make(config.Endpoints, 0, len(eps))
+	for _, ep := range eps {
+		c := *ep
+		copied = append(copied, &c)
+	}
+	return copied
+}
+
+// serving tells whether held endpoints are in the config, the config
+// is synced again until they are confirmed or expired. Expired ones are
+// forgotten, the next sync leaves them out
+func (h *endpointHolds) serving(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	serving := false
+	for k, held := range h.held {
+		if !held.serving {
+			continue
+		}
+		serving = true
+		if !now.Before(held.until) {
+			delete(h.held, k)
+		}
+	}
+	return serving
+}
@@ -0,0 +1,113 @@
+package rancher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// SelectorExpansion tells how a selector rule of the lb expanded,
+// for debugging the selector based configs
+type SelectorExpansion struct {
+	Selector   string `json:"selector"`
+	SourcePort int    `json:"source_port"`
+	// Matched are the services or containers matching the selector
+	Matched []string `json:"matched"`
+	// Rules are the rules synthesized from the matching targets
+	Rules []ExpandedRule `json:"rules"`
+	// Skipped are the matching targets and the synthesized
+	// rules left out of the config
+	Skipped []SkippedExpansion `json:"skipped"`
+}
+
+// ExpandedRule is a rule synthesized from a selector rule
+type ExpandedRule struct {
+	// Rule is the index of the rule in the expanded rules,
+	// as the validation report refers to it
+	Rule int `json:"rule"`
+	metadata.PortRule
+}
+
+// SkippedExpansion is a target or a rule left out of the expansion
+type SkippedExpansion struct {
+	Target string `json:"target"`
+	// Rule is the index of the skipped synthesized rule,
+	// -1 for the matching targets no rule was synthesized for
+	Rule   int    `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// ExpansionReport is the expansion of the selector
+// rules of the last sync
+type ExpansionReport struct {
+	LBName     string               `json:"lb_name"`
+	Time       time.Time            `json:"time"`
+	Expansions []*SelectorExpansion `json:"expansions"`
+}
+
+type expansionHolder struct {
+	mu     sync.RWMutex
+	report *ExpansionReport
+}
+
+func (h *expansionHolder) set(report *ExpansionReport) {
+	h.mu.Lock()
+	h.report = report
+	h.mu.Unlock()
+}
+
+func (h *expansionHolder) get() *ExpansionReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.report
+}
+
+// GetRuleExpansions returns how the selector rules expanded on the
+// last sync, nil when the rules weren't expanded yet
+func (lbc *LoadBalancerController) GetRuleExpansions() interface{} {
+	if report := lbc.ruleExpansions.get(); report != nil {
+		return report
+	}
+	return nil
+}
+
+func newSelectorExpansion(lbRule metadata.PortRule) *SelectorExpansion {
+	return &SelectorExpansion{
+		Selector:   lbRule.Selector,
+		SourcePort: lbRule.SourcePort,
+		Matched:    []string{},
+		Rules:      []ExpandedRule{},
+		Skipped:    []SkippedExpansion{},
+	}
+}
+
+func (e *SelectorExpansion) addRule(index int, rule metadata.PortRule) {
+	e.Rules = append(e.Rules, ExpandedRule{Rule: index, PortRule: rule})
+}
+
+func (e *SelectorExpansion) skip(target string, rule int, format string, args ...interface{}) {
+	e.Skipped = append(e.Skipped, SkippedExpansion{Target: target, Rule: rule, Reason: fmt.Sprintf(format, args...)})
+}
+
+// skipInvalidRules adds the synthesized rules the validation
+// left out of the config to the skipped ones
+func skipInvalidRules(expansions []*SelectorExpansion, report *ValidationReport) {
+	if report == nil {
+		return
+	}
+	for _, e := range expansions {
+		for _, rule := range e.Rules {
+			for _, issue := range report.Issues {
+				if issue.Rule == rule.Rule && issue.Severity == SeverityError {
+					target := rule.Service
+					if target == "" {
+						target = rule.ContainerUUID
+					}
+					e.skip(target, rule.Rule, "%s: %s", issue.Field, issue.Message)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	faultLabelPrefix = "io.rancher.lb_service.fault."
+	maxFaultDelay    = time.Minute
+	maxFaultDuration = 24 * time.Hour
+)
+
+// abortStatuses are the statuses haproxy can deny requests with
+var abortStatuses = map[int]bool{
+	200: true, 400: true, 403: true, 405: true, 408: true, 429: true,
+	500: true, 502: true, 503: true, 504: true,
+}
+
+/*
+getFaults reads the faults injected in the requests of the backends,
+the backend name is given in the label suffix. The value delays a
+percent of the requests by a duration, and aborts a percent of them
+with a status:
+
+io.rancher.lb_service.fault.api=delay=200ms:10,abort=503:5
+*/
+func getFaults(labels map[string]string) (map[string]*config.Fault, error) {
+	faults := map[string]*config.Fault{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, faultLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, faultLabelPrefix)
+		if backendName == "" {
+			return nil, fmt.Errorf("Invalid label %s, the suffix should be a backend name", k)
+		}
+		fault, err := parseFault(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+		}
+		faults[backendName] = fault
+	}
+	return faults, nil
+}
+
+func parseFault(value string) (*config.Fault, error) {
+	fault := &config.Fault{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s should be delay=<duration>:<percent> or abort=<status>:<percent>", item)
+		}
+		arg := strings.SplitN(kv[1], ":", 2)
+		if len(arg) != 2 {
+			return nil, fmt.Errorf("%s is missing the percent of the requests", item)
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(arg[1], "%"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid percent %s", arg[1])
+		}
+		switch kv[0] {
+		case "delay":
+			d, err := time.ParseDuration(arg[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay %s", arg[0])
+			}
+			fault.DelayMs = int(d / time.Millisecond)
+			fault.DelayPercent = percent
+		case "abort":
+			status, err := strconv.Atoi(arg[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid status %s", arg[0])
+			}
+			fault.AbortStatus = status
+			fault.AbortPercent = percent
+		default:
+			return nil, fmt.Errorf("unknown fault %s", kv[0])
+		}
+	}
+	return fault, validateFault(fault)
+}
+
+func validateFault(fault *config.Fault) error {
+	if fault.DelayPercent < 0 || fault.DelayPercent > 100 || fault.AbortPercent < 0 || fault.AbortPercent > 100 {
+		return fmt.Errorf("percents should be from 0 to 100")
+	}
+	if fault.DelayPercent > 0 && (fault.DelayMs <= 0 || time.Duration(fault.DelayMs)*time.Millisecond > maxFaultDelay) {
+		return fmt.Errorf("delay should be from 1ms to %v", maxFaultDelay)
+	}
+	if fault.AbortPercent > 0 && !abortStatuses[fault.AbortStatus] {
+		return fmt.Errorf("abort status %v is not supported", fault.AbortStatus)
+	}
+	if fault.DelayPercent == 0 && fault.AbortPercent == 0 {
+		return fmt.Errorf("no delay or abort is set")
+	}
+	return nil
+}
+
+// faultOverrides are the faults set through the admin api, taking
+// precedence over the labels until they are removed or expire
+type faultOverrides struct {
+	mu     sync.Mutex
+	faults map[string]*config.Fault
+}
+
+func (f *faultOverrides) set(backendName string, fault *config.Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.faults == nil {
+		f.faults = map[string]*config.Fault{}
+	}
+	if fault == nil {
+		delete(f.faults, backendName)
+		return
+	}
+	f.faults[backendName] = fault
+}
+
+// get returns the faults running at the time by backend name
+func (f *faultOverrides) get(now time.Time) map[string]*config.Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	faults := map[string]*config.Fault{}
+	for backendName, fault := range f.faults {
+		if !now.Before(fault.Until) {
+			logrus.Infof("Injected fault of backend [%s] expired at %v", backendName, fault.Until.Format(time.RFC3339))
+			delete(f.faults, backendName)
+			continue
+		}
+		faults[backendName] = fault
+	}
+	return faults
+}
+
+// merge returns the faults of the labels, overridden by the admin api ones
+func (f *faultOverrides) merge(labelFaults map[string]*config.Fault, now time.Time) map[string]*config.Fault {
+	faults := f.get(now)
+	for backendName, fault := range labelFaults {
+		if _, ok := faults[backendName]; !ok {
+			faults[backendName] = fault
+		}
+	}
+	return faults
+}
+
+// GetFaults returns the running faults set through the admin api
+func (lbc *LoadBalancerController) GetFaults() map[string]*config.Fault {
+	return lbc.faults.get(time.Now())
+}
+
+// SetFault overrides the fault of the backend for the duration and
+// reapplies the config, again once the fault expires. A nil fault
+// removes the override
+func (lbc *LoadBalancerController) SetFault(backendName string, fault *config.Fault, duration time.Duration) error {
+	if backendName == "" {
+		return fmt.Errorf("backend name is required")
+	}
+	if fault == nil {
+		logrus.Infof("Removing the injected fault of backend [%s]", backendName)
+		lbc.faults.set(backendName, nil)
+		lbc.ScheduleApplyConfig("")
+		return nil
+	}
+	if duration <= 0 || duration > maxFaultDuration {
+		return fmt.Errorf("duration should be up to %v", maxFaultDuration)
+	}
+	if err := validateFault(fault); err != nil {
+		return err
+	}
+	override := *fault
+	override.Until = time.Now().Add(duration)
+	logrus.Infof("Injecting fault %+v in the requests of backend [%s] until %v", *fault, backendName, override.Until.Format(time.RFC3339))
+	lbc.faults.set(backendName, &override)
+	lbc.ScheduleApplyConfig("")
+	time.AfterFunc(duration, func() {
+		lbc.ScheduleApplyConfig("")
+	})
+	return nil
+}
+
+func getFault(faults map[string]*config.Fault, backendName string, protocol string) *config.Fault {
+	fault, ok := faults[backendName]
+	if !ok {
+		return nil
+	}
+	if !isHTTPProto(protocol) {
+		logrus.Warnf("Skipping fault injection for backend [%s], not supported for protocol %s", backendName, protocol)
+		return nil
+	}
+	return fault
+}
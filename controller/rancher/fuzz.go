@@ -0,0 +1,178 @@
+//go:build gofuzz
+// +build gofuzz
+
+package rancher
+
+import (
+	"encoding/json"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/provider"
+	utils "github.com/rancher/lb-controller/utils"
+)
+
+/*
+Fuzz is the go-fuzz entry point for the lb metadata parsing.
+The input is an lb_config document as reported by rancher-metadata:
+
+go-fuzz-build github.com/rancher/lb-controller/controller/rancher
+go-fuzz -bin=rancher-fuzz.zip -workdir=controller/rancher/fuzz
+*/
+func Fuzz(data []byte) int {
+	var lbConfig metadata.LBConfig
+	if err := json.Unmarshal(data, &lbConfig); err != nil {
+		return 0
+	}
+	lbMeta, err := GetLBMetadata(lbConfig)
+	if err != nil {
+		return 0
+	}
+
+	lbc := &LoadBalancerController{
+		MetaFetcher: fuzzMetaFetcher{},
+		CertFetcher: fuzzCertFetcher{},
+		LBProvider:  fuzzProvider{},
+	}
+	if err := lbc.processSelector(lbMeta); err != nil {
+		return 0
+	}
+	for _, rule := range lbMeta.PortRules {
+		GetSelectorConstraints(rule.Selector)
+	}
+	if _, err := lbc.BuildConfigFromMetadata("fuzz", "", "", "prefer-local", lbMeta); err != nil {
+		return 0
+	}
+	return 1
+}
+
+var fuzzContainers = []metadata.Container{
+	{
+		UUID:      "c1",
+		PrimaryIp: "10.42.0.1",
+		State:     "running",
+		HostUUID:  "h1",
+	},
+	{
+		UUID:      "c2",
+		PrimaryIp: "10.42.0.2",
+		State:     "starting",
+	},
+}
+
+type fuzzMetaFetcher struct {
+}
+
+func (mf fuzzMetaFetcher) GetSelfService() (metadata.Service, error) {
+	return metadata.Service{}, nil
+}
+
+func (mf fuzzMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	return metadata.Host{UUID: "h1"}, nil
+}
+
+func (mf fuzzMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	return &metadata.Host{UUID: hostUUID}, nil
+}
+
+func (mf fuzzMetaFetcher) GetSelfHostUUID() (string, error) {
+	return "h1", nil
+}
+
+func (mf fuzzMetaFetcher) OnChange(intervalSeconds int, do func(string)) {
+}
+
+func (mf fuzzMetaFetcher) GetServices() ([]metadata.Service, error) {
+	return []metadata.Service{
+		{
+			Name:       "web",
+			StackName:  "default",
+			Kind:       "service",
+			Labels:     map[string]string{"app": "web", "tier": "frontend"},
+			Containers: fuzzContainers,
+			LBConfig: metadata.LBConfig{
+				PortRules: []metadata.PortRule{
+					{Hostname: "*.foo.com", Path: "/api", TargetPort: 8080},
+				},
+			},
+		},
+	}, nil
+}
+
+func (mf fuzzMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	switch svcName {
+	case "alias":
+		return &metadata.Service{
+			Kind:  "dnsService",
+			Links: map[string]string{"default/web": "", "broken": ""},
+		}, nil
+	case "ext":
+		return &metadata.Service{
+			Kind:        "externalService",
+			ExternalIps: []string{"172.16.0.1"},
+			Hostname:    "example.com",
+		}, nil
+	}
+	return &metadata.Service{
+		Kind:       "service",
+		Containers: fuzzContainers,
+	}, nil
+}
+
+func (mf fuzzMetaFetcher) GetContainer(envUUID string, containerUUID string) (*metadata.Container, error) {
+	for _, c := range fuzzContainers {
+		if c.UUID == containerUUID {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+type fuzzCertFetcher struct {
+}
+
+func (cf fuzzCertFetcher) FetchCertificates(lbMeta *LBMetadata, isDefaultCert bool) ([]*config.Certificate, error) {
+	return nil, nil
+}
+
+func (cf fuzzCertFetcher) UpdateEndpoints(lbSvc *metadata.Service, eps []client.PublicEndpoint) error {
+	return nil
+}
+
+func (cf fuzzCertFetcher) LookForCertUpdates(do func(string)) {
+}
+
+type fuzzProvider struct {
+}
+
+func (p fuzzProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+func (p fuzzProvider) GetName() string {
+	return "fuzz"
+}
+
+func (p fuzzProvider) GetPublicEndpoints(configName string) []provider.PublicEndpoint {
+	return nil
+}
+
+func (p fuzzProvider) CleanupConfig(configName string) error {
+	return nil
+}
+
+func (p fuzzProvider) Run(syncEndpointsQueue *utils.TaskQueue) {
+}
+
+func (p fuzzProvider) Stop() error {
+	return nil
+}
+
+func (p fuzzProvider) IsHealthy() bool {
+	return true
+}
+
+func (p fuzzProvider) ProcessCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	stripHeadersLabel   = "io.rancher.lb_service.strip_headers"
+	trustedSourcesLabel = "io.rancher.lb_service.trusted_sources"
+	// hopByHopHeaders stands for the hop-by-hop headers in the
+	// strip_headers label, Connection, Upgrade and TE are left out
+	// as haproxy handles them and websockets and grpc rely on them
+	hopByHopHeaders = "hop-by-hop"
+)
+
+var (
+	headerNameRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+	hopByHop         = []string{"Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Trailer"}
+)
+
+// the request hardening is on by default, every option can be turned off
+var (
+	percentDecode       = flags.LabelBool("io.rancher.lb_service.percent_decode", true, "Decode the percent encoded unreserved characters of the request paths")
+	mergeSlashes        = flags.LabelBool("io.rancher.lb_service.merge_slashes", true, "Merge the consecutive slashes of the request paths")
+	rejectPathTraversal = flags.LabelBool("io.rancher.lb_service.reject_path_traversal", true, "Reject the request paths with .. segments")
+	rejectSmuggling     = flags.LabelBool("io.rancher.lb_service.reject_smuggling", true, "Reject the requests with ambiguous Content-Length and Transfer-Encoding headers")
+	maxHeaderBytes      = flags.LabelInt("io.rancher.lb_service.max_header_bytes", 8192, "Reject the requests with larger headers, 0 disables the check").Range(0, 1048576)
+)
+
+// getRequestHardening reads the hardening options of the http
+// frontends, nil is returned when they are all turned off
+func getRequestHardening(labels map[string]string) (*config.RequestHardening, error) {
+	hardening := &config.RequestHardening{}
+	var err error
+	if hardening.PercentDecode, err = percentDecode.Get(labels); err != nil {
+		return nil, err
+	}
+	if hardening.MergeSlashes, err = mergeSlashes.Get(labels); err != nil {
+		return nil, err
+	}
+	if hardening.RejectPathTraversal, err = rejectPathTraversal.Get(labels); err != nil {
+		return nil, err
+	}
+	if hardening.RejectSmuggling, err = rejectSmuggling.Get(labels); err != nil {
+		return nil, err
+	}
+	if hardening.MaxHeaderBytes, err = maxHeaderBytes.Get(labels); err != nil {
+		return nil, err
+	}
+	if *hardening == (config.RequestHardening{}) {
+		return nil, nil
+	}
+	return hardening, nil
+}
+
+/*
+getHeaderStripping reads the inbound headers removed from the requests
+of the untrusted clients, to keep them from spoofing the headers the
+backends rely on. The headers are removed from every request unless
+trusted source CIDRs are set:
+
+io.rancher.lb_service.strip_headers=hop-by-hop,X-Forwarded-For,X-Auth-User
+io.rancher.lb_service.trusted_sources=10.42.0.0/16,192.168.1.10
+*/
+func getHeaderStripping(labels map[string]string) (*config.HeaderStripping, error) {
+	val := strings.TrimSpace(labels[stripHeadersLabel])
+	if val == "" {
+		return nil, nil
+	}
+	stripping := &config.HeaderStripping{}
+	seen := map[string]bool{}
+	for _, header := range strings.Split(val, ",") {
+		header = strings.TrimSpace(header)
+		headers := []string{header}
+		if strings.EqualFold(header, hopByHopHeaders) {
+			headers = hopByHop
+		} else if !headerNameRegexp.MatchString(header) {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %q is not a valid header name", stripHeadersLabel, val, header)
+		}
+		for _, h := range headers {
+			if !seen[strings.ToLower(h)] {
+				seen[strings.ToLower(h)] = true
+				stripping.Headers = append(stripping.Headers, h)
+			}
+		}
+	}
+	sources := strings.TrimSpace(labels[trustedSourcesLabel])
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %s is not a valid CIDR", trustedSourcesLabel, sources, source)
+		}
+		stripping.TrustedSources = append(stripping.TrustedSources, source)
+	}
+	return stripping, nil
+}
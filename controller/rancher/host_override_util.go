@@ -0,0 +1,125 @@
+package rancher
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	hostOverrideLabelPrefix = "io.rancher.lb_service.host_override."
+	// pseudo host labels the override selectors can match on
+	hostUUIDLabel     = "io.rancher.host.uuid"
+	hostHostnameLabel = "io.rancher.host.hostname"
+)
+
+// hostOverride holds the lb settings for the hosts matching the selector
+type hostOverride struct {
+	Name        string
+	Selector    string
+	BindAddress string
+	MaxConn     int
+	Config      string
+}
+
+/*
+getHostOverrides reads per host overrides from the lb service labels.
+The overrides are grouped by name, the selector is matched against
+the labels of the host the lb runs on:
+
+io.rancher.lb_service.host_override.large.selector=size=large
+io.rancher.lb_service.host_override.large.maxconn=8000
+io.rancher.lb_service.host_override.edge.selector=io.rancher.host.hostname=edge1
+io.rancher.lb_service.host_override.edge.bind_address=203.0.113.10
+io.rancher.lb_service.host_override.edge.config=<custom config>
+
+All the matching overrides are applied in the name order.
+*/
+func getHostOverrides(labels map[string]string) ([]*hostOverride, error) {
+	overrides := map[string]*hostOverride{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, hostOverrideLabelPrefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(k, hostOverrideLabelPrefix)
+		i := strings.LastIndex(suffix, ".")
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid label %s, expected %s<name>.<setting>", k, hostOverrideLabelPrefix)
+		}
+		name, setting := suffix[:i], suffix[i+1:]
+		override, ok := overrides[name]
+		if !ok {
+			override = &hostOverride{Name: name}
+			overrides[name] = override
+		}
+		v = strings.TrimSpace(v)
+		switch setting {
+		case "selector":
+			override.Selector = v
+		case "bind_address":
+			override.BindAddress = v
+		case "maxconn":
+			maxConn, err := strconv.Atoi(v)
+			if err != nil || maxConn < 1 {
+				return nil, fmt.Errorf("Invalid label value for label %s=%s", k, v)
+			}
+			override.MaxConn = maxConn
+		case "config":
+			override.Config = v
+		default:
+			return nil, fmt.Errorf("Invalid label %s, unsupported setting %s", k, setting)
+		}
+	}
+
+	var names []string
+	for name, override := range overrides {
+		if override.Selector == "" {
+			return nil, fmt.Errorf("Host override %s has no selector", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []*hostOverride
+	for _, name := range names {
+		result = append(result, overrides[name])
+	}
+	return result, nil
+}
+
+func isHostMatch(selector string, host metadata.Host) bool {
+	labels := map[string]string{
+		hostUUIDLabel:     host.UUID,
+		hostHostnameLabel: host.Hostname,
+	}
+	for k, v := range host.Labels {
+		labels[k] = v
+	}
+	return IsSelectorMatch(selector, labels)
+}
+
+// applyHostOverrides updates the lb metadata with the overrides matching the host.
+// Custom config goes after the lb service config, so its settings take precedence
+func applyHostOverrides(lbMeta *LBMetadata, overrides []*hostOverride, host metadata.Host) {
+	for _, override := range overrides {
+		if !isHostMatch(override.Selector, host) {
+			continue
+		}
+		logrus.Debugf("Applying host override %s on host [%s]", override.Name, host.Hostname)
+		if override.BindAddress != "" {
+			if lbMeta.BindAddresses == nil {
+				lbMeta.BindAddresses = map[int]string{}
+			}
+			lbMeta.BindAddresses[0] = override.BindAddress
+		}
+		if override.MaxConn > 0 {
+			lbMeta.Config = fmt.Sprintf("%s\nglobal\n    maxconn %v\ndefaults\n    maxconn %v\n", lbMeta.Config, override.MaxConn, override.MaxConn)
+		}
+		if override.Config != "" {
+			lbMeta.Config = fmt.Sprintf("%s\n%s\n", lbMeta.Config, override.Config)
+		}
+	}
+}
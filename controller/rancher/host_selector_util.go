@@ -0,0 +1,65 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const hostSelectorLabelPrefix = "io.rancher.lb_service.host_selector."
+
+/*
+getHostSelectors reads the host label selectors of the source ports. The
+rules of the port only take effect on the lb instances running on hosts
+matching the selector, so a single lb service can expose different ports
+on different hosts:
+
+io.rancher.lb_service.host_selector.443=role=edge
+io.rancher.lb_service.host_selector.8443=role!=edge
+
+The selectors have the syntax of the port rule selectors.
+*/
+func getHostSelectors(labels map[string]string) (map[int]string, error) {
+	selectors := map[int]string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, hostSelectorLabelPrefix) {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimPrefix(k, hostSelectorLabelPrefix))
+		if err != nil || port < 1 {
+			return nil, fmt.Errorf("Invalid label %s, the suffix should be a source port", k)
+		}
+		v = strings.TrimSpace(v)
+		if len(GetSelectorConstraints(v)) == 0 {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, should be a host label selector", k, v)
+		}
+		selectors[port] = v
+	}
+	return selectors, nil
+}
+
+// processHostSelectors drops the rules of the source ports
+// whose host selector doesn't match the lb host
+func (lbc *LoadBalancerController) processHostSelectors(lbMeta *LBMetadata) error {
+	if len(lbMeta.HostSelectors) == 0 {
+		return nil
+	}
+	selfHost, err := lbc.MetaFetcher.GetSelfHost()
+	if err != nil {
+		return fmt.Errorf("Failed to look up the lb host for the host selectors: %v", err)
+	}
+	var rules []metadata.PortRule
+	for _, rule := range lbMeta.PortRules {
+		selector, ok := lbMeta.HostSelectors[rule.SourcePort]
+		if ok && !IsSelectorMatch(selector, selfHost.Labels) {
+			logrus.Debugf("Skipping port rule for source port %v, the lb host doesn't match %s", rule.SourcePort, selector)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	lbMeta.PortRules = rules
+	return nil
+}
@@ -0,0 +1,141 @@
+package rancher
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/utils/cattle"
+)
+
+// Config holds the settings and the dependencies the controller is
+// initialized with, NewConfigFromEnv reads them from the env vars
+type Config struct {
+	CattleURL   string
+	MetadataURL string
+	// ReadCredentials reads the credentials of the Rancher API, it is
+	// called again when the API rejects them
+	ReadCredentials func() (*cattle.Credentials, error)
+	// ReadOnly skips the Rancher API writes and the cert fetching
+	ReadOnly bool
+
+	CertsPollInterval        int
+	CertsForceUpdateInterval float64
+	CertFileName             string
+	KeyFileName              string
+
+	// StartupPolicy is what to do when the metadata is unreachable
+	// after StartupTimeout, exiting with StartupExitCode or serving
+	// the last config
+	StartupPolicy   string
+	StartupTimeout  time.Duration
+	StartupExitCode int
+
+	NewCattleClient   func(url string, readCredentials func() (*cattle.Credentials, error)) (*cattle.Client, error)
+	NewMetadataClient func(url string) metadata.Client
+	Sleep             func(d time.Duration)
+	Exit              func(code int)
+}
+
+// NewConfigFromEnv reads the init settings from the env vars, the
+// clients are created with the go-rancher and metadata clients
+func NewConfigFromEnv(metadataURL string) (*Config, error) {
+	cfg := &Config{
+		CattleURL:                flags.CattleURL.Get(),
+		MetadataURL:              metadataURL,
+		ReadCredentials:          cattle.ReadCredentials,
+		ReadOnly:                 flags.CattleReadOnly.Get(),
+		CertsPollInterval:        certsPollInterval.Get(),
+		CertsForceUpdateInterval: certsForceUpdateInterval.Get(),
+		CertFileName:             certFileName.Get(),
+		KeyFileName:              keyFileName.Get(),
+		StartupPolicy:            metadataStartupPolicy.Get(),
+		StartupTimeout:           metadataStartupTimeout.Get(),
+		StartupExitCode:          metadataStartupExitCode.Get(),
+		NewCattleClient:          cattle.NewClientWithCredentials,
+		NewMetadataClient:        metadata.NewClient,
+		Sleep:                    time.Sleep,
+		Exit:                     os.Exit,
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *Config) validate() error {
+	if cfg.CattleURL == "" {
+		return fmt.Errorf("CATTLE_URL is not set, fail to init Rancher LB provider")
+	}
+	return validateStartupPolicy(cfg.StartupPolicy)
+}
+
+/*
+InitWithConfig initializes the controller with the clients of the config.
+When the metadata is unreachable, the init either exits or completes in
+Run once the metadata answers, as set by the startup policy
+*/
+func (lbc *LoadBalancerController) InitWithConfig(cfg *Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	client, err := cfg.NewCattleClient(cfg.CattleURL, cfg.ReadCredentials)
+	if err != nil {
+		return fmt.Errorf("Failed to create Rancher client %v", err)
+	}
+	lbc.initConfig = cfg
+	lbc.cattleClient = client
+
+	metadataClient := cfg.NewMetadataClient(cfg.MetadataURL)
+	lbc.MetaFetcher = &recordingMetaFetcher{
+		MetadataFetcher: RMetaFetcher{
+			MetadataClient: metadataClient,
+		},
+		recorder: &lbc.snapshots,
+	}
+	if err := waitForMetadata(metadataClient, cfg.StartupTimeout, cfg.Sleep); err != nil {
+		if err := onMetadataUnreachable(cfg, err); err != nil {
+			return err
+		}
+		// the init completes in Run once the metadata is reachable
+		lbc.metadataClient = metadataClient
+		return nil
+	}
+	return lbc.initCertFetcher()
+}
+
+// initCertFetcher sets up the cert fetcher from the labels of the lb service
+func (lbc *LoadBalancerController) initCertFetcher() error {
+	lbSvc, err := lbc.MetaFetcher.GetSelfService()
+	if err != nil {
+		return fmt.Errorf("Error reading self service metadata: %v", err)
+	}
+
+	cfg := lbc.initConfig
+	certFetcher := &RCertificateFetcher{
+		Client:              lbc.cattleClient,
+		ReadOnly:            cfg.ReadOnly,
+		mu:                  &sync.RWMutex{},
+		updateCheckInterval: cfg.CertsPollInterval,
+		forceUpdateInterval: cfg.CertsForceUpdateInterval,
+		CertDir:             certDirLabel.Get(filterLabels(lbSvc.Labels)),
+		DefaultCertDir:      defaultCertDirLabel.Get(filterLabels(lbSvc.Labels)),
+		CertName:            cfg.CertFileName,
+		KeyName:             cfg.KeyFileName,
+		initPollMu:          &sync.RWMutex{},
+	}
+	lbc.certFetcherMu.Lock()
+	lbc.CertFetcher = certFetcher
+	lbc.certFetcherMu.Unlock()
+	if certFetcher.ReadOnly {
+		logReadOnly()
+	}
+	return nil
+}
+
+// getCertFetcher returns the cert fetcher, nil until the init completes
+func (lbc *LoadBalancerController) getCertFetcher() CertificateFetcher {
+	lbc.certFetcherMu.RLock()
+	defer lbc.certFetcherMu.RUnlock()
+	return lbc.CertFetcher
+}
@@ -0,0 +1,96 @@
+package rancher
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	initStateLabel       = "io.rancher.lb_service.init_state"
+	initStateLabelPrefix = "io.rancher.lb_service.init_state."
+	// initStateDefault keys the state applied to all the backends
+	initStateDefault = ""
+)
+
+/*
+getInitStates reads the state the endpoints added to the backends start
+in from the lb service labels, so strict environments don't send traffic
+to endpoints before their first successful check. The state applies to
+all the backends, or to the backend whose name is given in the label
+suffix:
+
+io.rancher.lb_service.init_state=down
+io.rancher.lb_service.init_state.api=down,slowstart=30s
+io.rancher.lb_service.init_state.web=up
+
+The endpoints start up by default, down requires haproxy 3.1 or later
+*/
+func getInitStates(labels map[string]string) (map[string]*config.InitState, error) {
+	initStates := map[string]*config.InitState{}
+	for k, v := range labels {
+		backendName := initStateDefault
+		if strings.HasPrefix(k, initStateLabelPrefix) {
+			backendName = strings.TrimPrefix(k, initStateLabelPrefix)
+			if backendName == "" {
+				continue
+			}
+		} else if k != initStateLabel {
+			continue
+		}
+		initState, err := parseInitState(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		initStates[backendName] = initState
+	}
+	return initStates, nil
+}
+
+func parseInitState(value string) (*config.InitState, error) {
+	initState := &config.InitState{}
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		switch {
+		case setting == "":
+		case setting == "up":
+			initState.Down = false
+		case setting == "down":
+			initState.Down = true
+		case strings.HasPrefix(setting, "slowstart="):
+			val := strings.TrimPrefix(setting, "slowstart=")
+			slowStart, err := time.ParseDuration(val)
+			if err != nil || slowStart < time.Millisecond {
+				return nil, fmt.Errorf("invalid slowstart %s", val)
+			}
+			initState.SlowStartMs = int(slowStart / time.Millisecond)
+		default:
+			return nil, fmt.Errorf("unsupported setting %s, expected up, down or slowstart=<duration>", setting)
+		}
+	}
+	return initState, nil
+}
+
+// getInitState prefers the backend state over the one set for all backends
+func getInitState(initStates map[string]*config.InitState, backendName string) *config.InitState {
+	if initState, ok := initStates[backendName]; ok && backendName != initStateDefault {
+		return initState
+	}
+	return initStates[initStateDefault]
+}
+
+// applyInitState sets the init state of the backend, the state
+// only applies to the endpoints of checked backends
+func applyInitState(be *config.BackendService, initState *config.InitState) {
+	if initState == nil || (!initState.Down && initState.SlowStartMs == 0) {
+		return
+	}
+	if be.HealthCheck == nil || (be.HealthCheck.Port == 0 && be.CheckPort == 0) {
+		logrus.Warnf("Skipping init state of backend [%s], it has no health check", be.UUID)
+		return
+	}
+	be.InitState = initState
+}
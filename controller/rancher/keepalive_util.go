@@ -0,0 +1,100 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	keepAliveLabel       = "io.rancher.lb_service.keepalive"
+	keepAliveLabelPrefix = "io.rancher.lb_service.keepalive."
+	// keepAliveDefault keys the settings applied to all the backends
+	keepAliveDefault = ""
+)
+
+var supportedHTTPReuseModes = map[string]bool{
+	"never":      true,
+	"safe":       true,
+	"aggressive": true,
+	"always":     true,
+}
+
+/*
+getKeepAlives reads backend connection reuse settings from the lb service
+labels. The settings apply to all http backends, or to the backend whose
+name is given in the label suffix:
+
+io.rancher.lb_service.keepalive=http_reuse=safe
+io.rancher.lb_service.keepalive.api=http_reuse=aggressive,pool_purge_delay=10s,pool_max_conn=200
+*/
+func getKeepAlives(labels map[string]string) (map[string]*config.KeepAlive, error) {
+	keepAlives := map[string]*config.KeepAlive{}
+	for k, v := range labels {
+		backendName := keepAliveDefault
+		if strings.HasPrefix(k, keepAliveLabelPrefix) {
+			backendName = strings.TrimPrefix(k, keepAliveLabelPrefix)
+			if backendName == "" {
+				continue
+			}
+		} else if k != keepAliveLabel {
+			continue
+		}
+		keepAlive, err := parseKeepAlive(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		keepAlives[backendName] = keepAlive
+	}
+	return keepAlives, nil
+}
+
+func parseKeepAlive(value string) (*config.KeepAlive, error) {
+	keepAlive := &config.KeepAlive{}
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("setting %s should be in key=value format", setting)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "http_reuse":
+			if !supportedHTTPReuseModes[val] {
+				return nil, fmt.Errorf("unsupported http_reuse mode %s", val)
+			}
+			keepAlive.HTTPReuse = val
+		case "pool_purge_delay":
+			if _, err := time.ParseDuration(val); err != nil {
+				return nil, fmt.Errorf("invalid pool_purge_delay %s", val)
+			}
+			keepAlive.PoolPurgeDelay = val
+		case "pool_max_conn":
+			maxConn, err := strconv.Atoi(val)
+			if err != nil || maxConn < -1 {
+				return nil, fmt.Errorf("invalid pool_max_conn %s", val)
+			}
+			keepAlive.PoolMaxConn = maxConn
+		default:
+			return nil, fmt.Errorf("unsupported setting %s", key)
+		}
+	}
+	return keepAlive, nil
+}
+
+// getKeepAlive prefers the backend settings over the ones set for all backends
+func getKeepAlive(keepAlives map[string]*config.KeepAlive, backendName string, protocol string) *config.KeepAlive {
+	if !isHTTPProto(protocol) {
+		return nil
+	}
+	if keepAlive, ok := keepAlives[backendName]; ok && backendName != keepAliveDefault {
+		return keepAlive
+	}
+	return keepAlives[keepAliveDefault]
+}
@@ -0,0 +1,308 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	debugHeadersLabel      = "io.rancher.lb_service.debug_headers"
+	bindAddressLabel       = "io.rancher.lb_service.bind_address"
+	bindAddressLabelPrefix = "io.rancher.lb_service.bind_address."
+	bindNetworkLabel       = "io.rancher.lb_service.bind_network"
+	h2cLabel               = "io.rancher.lb_service.h2c"
+	h2cLabelPrefix         = "io.rancher.lb_service.h2c."
+	h2BackendLabel         = "io.rancher.lb_service.h2_backend"
+	detectTLSLabel         = "io.rancher.lb_service.detect_tls"
+	localWeightLabel       = "io.rancher.lb_service.local_weight"
+	remoteWeightLabel      = "io.rancher.lb_service.remote_weight"
+
+	lbLabelPrefix = "io.rancher.lb_service."
+
+	// preferLocalWeighted target sends most of the traffic to the local
+	// endpoints, keeping the remote ones as low weight backups
+	preferLocalWeighted = "prefer-local-weighted"
+	maxEndpointWeight   = 256
+)
+
+var allowedLabels = flags.String("LB_ALLOWED_LABELS", "", "Comma separated list of the io.rancher.lb_service labels honored, shell patterns like io.rancher.lb_service.h2c* are supported. All are honored when not set")
+
+var (
+	localWeight  = flags.LabelInt(localWeightLabel, 100, "Weight of the local endpoints with prefer-local-weighted target").Range(1, maxEndpointWeight)
+	remoteWeight = flags.LabelInt(remoteWeightLabel, 1, "Weight of the remote endpoints with prefer-local-weighted target").Range(1, maxEndpointWeight)
+)
+
+// LocalWeights are the endpoint weights of the prefer-local-weighted target
+type LocalWeights struct {
+	Local  int
+	Remote int
+}
+
+func defaultLocalWeights() *LocalWeights {
+	return &LocalWeights{Local: localWeight.Default.(int), Remote: remoteWeight.Default.(int)}
+}
+
+// filterLabels drops the lb service labels not in LB_ALLOWED_LABELS,
+// the labels outside of the io.rancher.lb_service namespace are kept
+func filterLabels(labels map[string]string) map[string]string {
+	if allowedLabels.Get() == "" {
+		return labels
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(allowedLabels.Get(), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return filterLabelsByPatterns(labels, patterns)
+}
+
+func filterLabelsByPatterns(labels map[string]string, patterns []string) map[string]string {
+	filtered := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if !strings.HasPrefix(key, lbLabelPrefix) || matchesAnyPattern(patterns, key) {
+			filtered[key] = value
+			continue
+		}
+		logrus.Debugf("Ignoring label %s, it is not allowed by LB_ALLOWED_LABELS", key)
+	}
+	return filtered
+}
+
+/*
+getDebugHeaders reads debug headers setting from the lb service labels.
+The label value is either "true", or a comma separated list of trusted
+source CIDRs:
+
+io.rancher.lb_service.debug_headers=10.42.0.0/16,192.168.1.10
+*/
+func getDebugHeaders(labels map[string]string) (*config.DebugHeaders, error) {
+	val := strings.TrimSpace(labels[debugHeadersLabel])
+	if val == "" || strings.EqualFold(val, "false") {
+		return nil, nil
+	}
+	debug := &config.DebugHeaders{}
+	if strings.EqualFold(val, "true") {
+		return debug, nil
+	}
+	for _, source := range strings.Split(val, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %s is not a valid CIDR", debugHeadersLabel, val, source)
+		}
+		debug.Sources = append(debug.Sources, source)
+	}
+	return debug, nil
+}
+
+/*
+getBindAddresses reads the addresses the frontends bind to. The address is
+either an ip or a network interface name, and is set for all the frontends
+or for the frontend on the source port given in the label suffix:
+
+io.rancher.lb_service.bind_address=eth1
+io.rancher.lb_service.bind_address.443=203.0.113.10
+
+The address set for all the frontends is stored under the 0 port.
+*/
+func getBindAddresses(labels map[string]string) (map[int]string, error) {
+	addresses := map[int]string{}
+	for k, v := range labels {
+		port := 0
+		if strings.HasPrefix(k, bindAddressLabelPrefix) {
+			var err error
+			port, err = strconv.Atoi(strings.TrimPrefix(k, bindAddressLabelPrefix))
+			if err != nil || port < 1 {
+				return nil, fmt.Errorf("Invalid label %s, the suffix should be a source port", k)
+			}
+		} else if k != bindAddressLabel {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if v == "" || strings.ContainsAny(v, " /:") && net.ParseIP(v) == nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, should be an ip or an interface name", k, v)
+		}
+		addresses[port] = v
+	}
+	return addresses, nil
+}
+
+func getBindAddress(addresses map[int]string, port int) string {
+	if address, ok := addresses[port]; ok {
+		return address
+	}
+	return addresses[0]
+}
+
+/*
+getH2CPorts reads the http frontends accepting HTTP/2 cleartext, set for
+all the http frontends or for the frontend on the source port given in
+the label suffix:
+
+io.rancher.lb_service.h2c=true
+io.rancher.lb_service.h2c.8080=false
+
+The value set for all the frontends is stored under the 0 port. The
+frontend detects the HTTP/2 preface of the h2c clients and keeps serving
+the HTTP/1.1 ones on the same port. The backends talk HTTP/2 to their servers only when their
+targets opt in with the h2_backend label.
+*/
+func getH2CPorts(labels map[string]string) (map[int]bool, error) {
+	ports := map[int]bool{}
+	for k, v := range labels {
+		port := 0
+		if strings.HasPrefix(k, h2cLabelPrefix) {
+			var err error
+			port, err = strconv.Atoi(strings.TrimPrefix(k, h2cLabelPrefix))
+			if err != nil || port < 1 {
+				return nil, fmt.Errorf("Invalid label %s, the suffix should be a source port", k)
+			}
+		} else if k != h2cLabel {
+			continue
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+		}
+		ports[port] = enabled
+	}
+	return ports, nil
+}
+
+func getH2C(ports map[int]bool, rule metadata.PortRule) bool {
+	enabled, ok := ports[rule.SourcePort]
+	if !ok {
+		enabled = ports[0]
+	}
+	if enabled && rule.Protocol != config.HTTPProto {
+		if ok {
+			logrus.Warnf("Ignoring h2c for port %v, h2c is supported on http ports only", rule.SourcePort)
+		}
+		return false
+	}
+	return enabled
+}
+
+/*
+getH2Backend tells whether the backend talks HTTP/2 cleartext to its
+servers, set on the services targeted by the lb serving h2c or gRPC:
+
+io.rancher.lb_service.h2_backend=true
+*/
+func getH2Backend(backendName string, protocol string, targetLabels map[string]string) bool {
+	value, ok := targetLabels[h2BackendLabel]
+	if !ok {
+		return false
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		logrus.Warnf("Ignoring h2 of backend [%s], invalid label value for label %s=%s", backendName, h2BackendLabel, value)
+		return false
+	}
+	if enabled && protocol != config.HTTPProto && protocol != config.HTTPSProto {
+		logrus.Warnf("Ignoring h2 of backend [%s], h2 is supported on http backends only", backendName)
+		return false
+	}
+	return enabled
+}
+
+/*
+getDetectTLSPorts reads the source ports of the http and https frontends
+serving both TLS and plaintext clients:
+
+io.rancher.lb_service.detect_tls=8080,8443
+*/
+func getDetectTLSPorts(labels map[string]string) (map[int]bool, error) {
+	ports := map[int]bool{}
+	val := strings.TrimSpace(labels[detectTLSLabel])
+	if val == "" {
+		return ports, nil
+	}
+	for _, p := range strings.Split(val, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %s is not a valid port", detectTLSLabel, val, p)
+		}
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+func getDetectTLS(ports map[int]bool, rule metadata.PortRule, certs []*config.Certificate) bool {
+	if !ports[rule.SourcePort] {
+		return false
+	}
+	if !isHTTPProto(rule.Protocol) {
+		logrus.Warnf("Ignoring tls detection for port %v, supported on http and https ports only", rule.SourcePort)
+		return false
+	}
+	if len(certs) == 0 {
+		logrus.Warnf("Ignoring tls detection for port %v, no certs are set", rule.SourcePort)
+		return false
+	}
+	return true
+}
+
+/*
+getBindNetwork reads the CIDR of the network the backend container ips
+are picked from, for the containers attached to multiple networks:
+
+io.rancher.lb_service.bind_network=10.10.0.0/16
+*/
+func getBindNetwork(labels map[string]string) (*net.IPNet, error) {
+	val := strings.TrimSpace(labels[bindNetworkLabel])
+	if val == "" {
+		return nil, nil
+	}
+	_, network, err := net.ParseCIDR(val)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", bindNetworkLabel, val, err)
+	}
+	return network, nil
+}
+
+/*
+getLocalWeights reads the endpoint weights used with
+io.rancher.lb_service.target=prefer-local-weighted:
+
+io.rancher.lb_service.local_weight=100
+io.rancher.lb_service.remote_weight=1
+*/
+func getLocalWeights(labels map[string]string) (*LocalWeights, error) {
+	weights := &LocalWeights{}
+	var err error
+	if weights.Local, err = localWeight.Get(labels); err != nil {
+		return nil, err
+	}
+	if weights.Remote, err = remoteWeight.Get(labels); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+// getIPsLabel reads the comma separated list of ips of the label
+func getIPsLabel(labels map[string]string, label string) ([]string, error) {
+	val := strings.TrimSpace(labels[label])
+	if val == "" {
+		return nil, nil
+	}
+	var ips []string
+	for _, ip := range strings.Split(val, ",") {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, %q is not an ip", label, val, ip)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
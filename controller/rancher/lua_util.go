@@ -0,0 +1,104 @@
+package rancher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	luaFrontendLabelPrefix = "io.rancher.lb_service.lua_frontend."
+	luaBackendLabelPrefix  = "io.rancher.lb_service.lua_backend."
+)
+
+var (
+	// the scripts are files of the scripts dir of the provider
+	luaScriptName = regexp.MustCompile(`^[A-Za-z0-9_.-]+\.lua$`)
+	luaActionName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+)
+
+/*
+getFrontendLuaHooks reads the lua actions run on the requests of the
+frontend on the source port given in the label suffix, as script:action
+pairs run in order, the action being registered by the script:
+
+io.rancher.lb_service.lua_frontend.80=request_id.lua:add_request_id,auth.lua:check_token
+*/
+func getFrontendLuaHooks(labels map[string]string) (map[int][]*config.LuaHook, error) {
+	hooks := map[int][]*config.LuaHook{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, luaFrontendLabelPrefix) {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimPrefix(k, luaFrontendLabelPrefix))
+		if err != nil || port < 1 {
+			return nil, fmt.Errorf("Invalid label %s, the suffix should be a source port", k)
+		}
+		if hooks[port], err = parseLuaHooks(v); err != nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+		}
+	}
+	return hooks, nil
+}
+
+// getPortLuaHooks returns the lua actions of the frontend of the rule,
+// sni frontends accept the connections before the actions would run
+func getPortLuaHooks(hooks map[int][]*config.LuaHook, rule metadata.PortRule) []*config.LuaHook {
+	if len(hooks[rule.SourcePort]) > 0 && strings.EqualFold(rule.Protocol, config.SNIProto) {
+		logrus.Warnf("Ignoring the lua actions of port %v, not supported on sni ports", rule.SourcePort)
+		return nil
+	}
+	return hooks[rule.SourcePort]
+}
+
+/*
+getBackendLuaHooks reads the lua actions run on the requests of the
+backend whose name is given in the label suffix:
+
+io.rancher.lb_service.lua_backend.api=rewrite.lua:rewrite_path
+*/
+func getBackendLuaHooks(labels map[string]string) (map[string][]*config.LuaHook, error) {
+	hooks := map[string][]*config.LuaHook{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, luaBackendLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, luaBackendLabelPrefix)
+		if backendName == "" {
+			continue
+		}
+		var err error
+		if hooks[backendName], err = parseLuaHooks(v); err != nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+		}
+	}
+	return hooks, nil
+}
+
+func parseLuaHooks(value string) ([]*config.LuaHook, error) {
+	var hooks []*config.LuaHook
+	for _, hook := range strings.Split(value, ",") {
+		hook = strings.TrimSpace(hook)
+		if hook == "" {
+			continue
+		}
+		parts := strings.SplitN(hook, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("hook %s should be in script:action format", hook)
+		}
+		script, action := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !luaScriptName.MatchString(script) {
+			return nil, fmt.Errorf("invalid script %s, should be the name of a .lua file of the scripts dir", script)
+		}
+		if !luaActionName.MatchString(action) {
+			return nil, fmt.Errorf("invalid action %s", action)
+		}
+		hooks = append(hooks, &config.LuaHook{Script: script, Action: action})
+	}
+	return hooks, nil
+}
@@ -0,0 +1,350 @@
+package rancher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/provider"
+)
+
+/*
+MetadataSnapshot holds the metadata and the certificates a config was
+built from, so the routing of an lb can be reproduced offline from a
+single file with ReplayMetadataSnapshot. The lookups are recorded with
+their answers, null for the ones not found, and the failed ones with
+their error. The keys of the certificates are left out, and so are
+the overrides of the admin api, as the faults
+*/
+type MetadataSnapshot struct {
+	Time            time.Time         `json:"time"`
+	MetadataVersion string            `json:"metadata_version"`
+	SelfService     *metadata.Service `json:"self_service"`
+	SelfHostUUID    string            `json:"self_host_uuid"`
+	SelfHost        *metadata.Host    `json:"self_host"`
+	// Services are the services the selectors are expanded over
+	Services []metadata.Service `json:"services"`
+	// ServiceLookups are keyed by env/stack/service, Hosts by
+	// uuid and Containers by env/uuid
+	ServiceLookups map[string]*metadata.Service   `json:"service_lookups"`
+	Hosts          map[string]*metadata.Host      `json:"hosts"`
+	Containers     map[string]*metadata.Container `json:"containers"`
+	// Errors are the failed lookups by call and key
+	Errors       map[string]string     `json:"errors"`
+	DefaultCerts []*config.Certificate `json:"default_certs"`
+	Certs        []*config.Certificate `json:"certs"`
+}
+
+func newMetadataSnapshot() *MetadataSnapshot {
+	return &MetadataSnapshot{
+		ServiceLookups: map[string]*metadata.Service{},
+		Hosts:          map[string]*metadata.Host{},
+		Containers:     map[string]*metadata.Container{},
+		Errors:         map[string]string{},
+	}
+}
+
+func serviceLookupKey(envUUID, stackName, svcName string) string {
+	return fmt.Sprintf("%s/%s/%s", envUUID, stackName, svcName)
+}
+
+func containerLookupKey(envUUID, containerUUID string) string {
+	return fmt.Sprintf("%s/%s", envUUID, containerUUID)
+}
+
+// setCerts records the fetched certificates without their keys
+func (s *MetadataSnapshot) setCerts(defaultCerts, certs []*config.Certificate) {
+	s.DefaultCerts = stripCertKeys(defaultCerts)
+	s.Certs = stripCertKeys(certs)
+}
+
+func stripCertKeys(certs []*config.Certificate) []*config.Certificate {
+	stripped := []*config.Certificate{}
+	for _, cert := range certs {
+		c := *cert
+		c.Key = ""
+		stripped = append(stripped, &c)
+	}
+	return stripped
+}
+
+/*
+snapshotRecorder records the metadata read into the snapshots of the
+builds in progress. The fetcher is shared, so the reads of concurrent
+builds or of the other users of the fetcher may be recorded too, the
+snapshots then hold more lookups than their build needs
+*/
+type snapshotRecorder struct {
+	mu        sync.Mutex
+	recording map[*MetadataSnapshot]bool
+	// applied is the snapshot of the configs last applied
+	applied *MetadataSnapshot
+}
+
+// begin starts recording a snapshot, until end is called
+func (r *snapshotRecorder) begin(version string) *MetadataSnapshot {
+	snapshot := newMetadataSnapshot()
+	snapshot.Time = time.Now()
+	snapshot.MetadataVersion = version
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recording == nil {
+		r.recording = map[*MetadataSnapshot]bool{}
+	}
+	r.recording[snapshot] = true
+	return snapshot
+}
+
+func (r *snapshotRecorder) end(snapshot *MetadataSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.recording, snapshot)
+}
+
+func (r *snapshotRecorder) record(f func(snapshot *MetadataSnapshot)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for snapshot := range r.recording {
+		f(snapshot)
+	}
+}
+
+func (r *snapshotRecorder) recordError(call string, key string, err error) {
+	r.record(func(s *MetadataSnapshot) {
+		s.Errors[call+":"+key] = err.Error()
+	})
+}
+
+func (r *snapshotRecorder) setApplied(snapshot *MetadataSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied = snapshot
+}
+
+func (r *snapshotRecorder) getApplied() *MetadataSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.applied
+}
+
+// recordingMetaFetcher records the answers of the fetcher into the
+// snapshots being recorded
+type recordingMetaFetcher struct {
+	MetadataFetcher
+	recorder *snapshotRecorder
+}
+
+// GetVersion forwards the version of the fetcher, the configs
+// aren't cached when it can't tell it
+func (f *recordingMetaFetcher) GetVersion() (string, error) {
+	fetcher, ok := f.MetadataFetcher.(versionFetcher)
+	if !ok {
+		return "", fmt.Errorf("Metadata fetcher doesn't tell the version")
+	}
+	return fetcher.GetVersion()
+}
+
+func (f *recordingMetaFetcher) GetSelfService() (metadata.Service, error) {
+	svc, err := f.MetadataFetcher.GetSelfService()
+	if err != nil {
+		f.recorder.recordError("self_service", "", err)
+		return svc, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.SelfService = &svc
+	})
+	return svc, nil
+}
+
+func (f *recordingMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	key := serviceLookupKey(envUUID, stackName, svcName)
+	svc, err := f.MetadataFetcher.GetService(envUUID, svcName, stackName)
+	if err != nil {
+		f.recorder.recordError("service", key, err)
+		return svc, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.ServiceLookups[key] = svc
+	})
+	return svc, nil
+}
+
+func (f *recordingMetaFetcher) GetServices() ([]metadata.Service, error) {
+	svcs, err := f.MetadataFetcher.GetServices()
+	if err != nil {
+		f.recorder.recordError("services", "", err)
+		return svcs, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.Services = svcs
+	})
+	return svcs, nil
+}
+
+func (f *recordingMetaFetcher) GetSelfHostUUID() (string, error) {
+	hostUUID, err := f.MetadataFetcher.GetSelfHostUUID()
+	if err != nil {
+		f.recorder.recordError("self_host_uuid", "", err)
+		return hostUUID, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.SelfHostUUID = hostUUID
+	})
+	return hostUUID, nil
+}
+
+func (f *recordingMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	host, err := f.MetadataFetcher.GetSelfHost()
+	if err != nil {
+		f.recorder.recordError("self_host", "", err)
+		return host, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.SelfHost = &host
+	})
+	return host, nil
+}
+
+func (f *recordingMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	host, err := f.MetadataFetcher.GetHost(hostUUID)
+	if err != nil {
+		f.recorder.recordError("host", hostUUID, err)
+		return host, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.Hosts[hostUUID] = host
+	})
+	return host, nil
+}
+
+func (f *recordingMetaFetcher) GetContainer(envUUID string, containerUUID string) (*metadata.Container, error) {
+	key := containerLookupKey(envUUID, containerUUID)
+	container, err := f.MetadataFetcher.GetContainer(envUUID, containerUUID)
+	if err != nil {
+		f.recorder.recordError("container", key, err)
+		return container, err
+	}
+	f.recorder.record(func(s *MetadataSnapshot) {
+		s.Containers[key] = container
+	})
+	return container, nil
+}
+
+// snapshotMetaFetcher answers the lookups recorded in the snapshot
+type snapshotMetaFetcher struct {
+	snapshot *MetadataSnapshot
+}
+
+func (f snapshotMetaFetcher) err(call string, key string) error {
+	if msg, ok := f.snapshot.Errors[call+":"+key]; ok {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+func (f snapshotMetaFetcher) GetSelfService() (metadata.Service, error) {
+	if err := f.err("self_service", ""); err != nil {
+		return metadata.Service{}, err
+	}
+	if f.snapshot.SelfService == nil {
+		return metadata.Service{}, fmt.Errorf("Self service is missing from the snapshot")
+	}
+	return *f.snapshot.SelfService, nil
+}
+
+func (f snapshotMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	key := serviceLookupKey(envUUID, stackName, svcName)
+	if err := f.err("service", key); err != nil {
+		return nil, err
+	}
+	return f.snapshot.ServiceLookups[key], nil
+}
+
+func (f snapshotMetaFetcher) OnChange(intervalSeconds int, do func(string)) {
+}
+
+func (f snapshotMetaFetcher) GetServices() ([]metadata.Service, error) {
+	if err := f.err("services", ""); err != nil {
+		return nil, err
+	}
+	return f.snapshot.Services, nil
+}
+
+func (f snapshotMetaFetcher) GetSelfHostUUID() (string, error) {
+	if err := f.err("self_host_uuid", ""); err != nil {
+		return "", err
+	}
+	return f.snapshot.SelfHostUUID, nil
+}
+
+func (f snapshotMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	if err := f.err("self_host", ""); err != nil {
+		return metadata.Host{}, err
+	}
+	if f.snapshot.SelfHost == nil {
+		return metadata.Host{}, fmt.Errorf("Self host is missing from the snapshot")
+	}
+	return *f.snapshot.SelfHost, nil
+}
+
+func (f snapshotMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	if err := f.err("host", hostUUID); err != nil {
+		return nil, err
+	}
+	return f.snapshot.Hosts[hostUUID], nil
+}
+
+func (f snapshotMetaFetcher) GetContainer(envUUID string, containerUUID string) (*metadata.Container, error) {
+	key := containerLookupKey(envUUID, containerUUID)
+	if err := f.err("container", key); err != nil {
+		return nil, err
+	}
+	return f.snapshot.Containers[key], nil
+}
+
+// snapshotCertFetcher answers the certificates recorded in the snapshot
+type snapshotCertFetcher struct {
+	snapshot *MetadataSnapshot
+}
+
+func (f snapshotCertFetcher) FetchCertificates(lbMeta *LBMetadata, isDefaultCert bool) ([]*config.Certificate, error) {
+	if isDefaultCert {
+		return f.snapshot.DefaultCerts, nil
+	}
+	return f.snapshot.Certs, nil
+}
+
+func (f snapshotCertFetcher) UpdateEndpoints(lbSvc *metadata.Service, eps []client.PublicEndpoint) error {
+	return nil
+}
+
+func (f snapshotCertFetcher) LookForCertUpdates(do func(string)) {
+}
+
+// ReplayMetadataSnapshot builds the lb configs from the snapshot, as the
+// controller built them from the metadata the snapshot was recorded from.
+// The custom configs are processed by the provider
+func ReplayMetadataSnapshot(snapshot *MetadataSnapshot, lbp provider.LBProvider) ([]*config.LoadBalancerConfig, error) {
+	lbc := &LoadBalancerController{
+		MetaFetcher: snapshotMetaFetcher{snapshot: snapshot},
+		CertFetcher: snapshotCertFetcher{snapshot: snapshot},
+		LBProvider:  lbp,
+	}
+	state := &SyncState{}
+	if err := lbc.runStages(state, lbc.configStages()); err != nil {
+		return nil, err
+	}
+	return state.Configs, nil
+}
+
+// GetMetadataSnapshot returns the snapshot of the metadata
+// the configs last applied were built from
+func (lbc *LoadBalancerController) GetMetadataSnapshot() interface{} {
+	if snapshot := lbc.snapshots.getApplied(); snapshot != nil {
+		return snapshot
+	}
+	return nil
+}
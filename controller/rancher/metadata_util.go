@@ -2,7 +2,11 @@ package rancher
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/lb-controller/config"
 )
@@ -13,6 +17,82 @@ type LBMetadata struct {
 	DefaultCertificateID string                  `json:"default_certificate_id"`
 	Config               string                  `json:"config"`
 	StickinessPolicy     config.StickinessPolicy `json:"stickiness_policy"`
+	// label driven settings
+	Redirects     map[string]*config.Redirect  `json:"-"`
+	ACMEChallenge *ACMEChallenge               `json:"-"`
+	DebugHeaders  *config.DebugHeaders         `json:"-"`
+	BindAddresses map[int]string               `json:"-"`
+	H2CPorts      map[int]bool                 `json:"-"`
+	DetectTLS     map[int]bool                 `json:"-"`
+	BindNetwork   *net.IPNet                   `json:"-"`
+	LocalWeights  *LocalWeights                `json:"-"`
+	TopologyKeys  []string                     `json:"-"`
+	KeepAlives    map[string]*config.KeepAlive `json:"-"`
+	Transparent   map[string]bool              `json:"-"`
+	DebugCaptures map[string]time.Duration     `json:"-"`
+	Faults        map[string]*config.Fault     `json:"-"`
+	Resolvers     *config.Resolvers            `json:"-"`
+	Hardening     *config.RequestHardening     `json:"-"`
+	StripHeaders  *config.HeaderStripping      `json:"-"`
+	Tuning        *config.Tuning               `json:"-"`
+	TargetScope   *TargetScope                 `json:"-"`
+	CheckPorts    map[string]*CheckPort        `json:"-"`
+	// CheckExpects are the responses expected
+	// by the http checks of the backends
+	CheckExpects map[string]*config.HealthCheckExpect `json:"-"`
+	// InitStates are the states the endpoints of the backends start in
+	InitStates map[string]*config.InitState `json:"-"`
+	// AgentChecks are the agent checks of the backends
+	AgentChecks map[string]*config.AgentCheck `json:"-"`
+	// BackupServices are the backup services by backend name
+	BackupServices map[string]string `json:"-"`
+	// RemoteTargets are the services of other
+	// environments targeted by backend name
+	RemoteTargets map[string]*RemoteTarget `json:"-"`
+	// MetricsTags are the tags of the stats and
+	// the metrics of the backends by backend name
+	MetricsTags map[string]string `json:"-"`
+	// EndpointsHold is how long the last known endpoints of
+	// the services are kept through metadata blips
+	EndpointsHold time.Duration `json:"-"`
+	// InferTargetPort fills in the target port missing
+	// in the rule from the ports of the target
+	InferTargetPort bool `json:"-"`
+	// BackendIdentity is what the backends without
+	// backend name are named after, rule or service
+	BackendIdentity string `json:"-"`
+	// HostSelectors are the host label selectors of the source
+	// ports whose rules only apply on the matching lb hosts
+	HostSelectors map[int]string `json:"-"`
+	// CertSNIOverrides are the hostnames by cert name
+	CertSNIOverrides map[string][]string `json:"-"`
+	// PortCerts are the names of the certs by source port
+	PortCerts map[int][]string `json:"-"`
+	// FrontendLuaHooks and BackendLuaHooks are the lua actions
+	// run by the frontends by source port and by the backends
+	FrontendLuaHooks map[int][]*config.LuaHook    `json:"-"`
+	BackendLuaHooks  map[string][]*config.LuaHook `json:"-"`
+	// SPOEngines are the spoe engines filtering the http frontends
+	SPOEngines []*SPOEngine `json:"-"`
+	// instances of the lb service
+	Peers []*config.Peer `json:"-"`
+	// VRRP floats the virtual ips over the instances, nil when off
+	VRRP *config.VRRP `json:"-"`
+	// ServiceIPs are announced over bgp
+	ServiceIPs []string `json:"-"`
+	// Expansions tell how the selector rules expanded
+	Expansions []*SelectorExpansion `json:"-"`
+	// RuleErrors are the rules left out of the config
+	// as their targets failed to be looked up
+	RuleErrors []*RuleError `json:"-"`
+
+	// certificates fetched by the validation
+	fetchedCerts *fetchedCerts
+}
+
+type fetchedCerts struct {
+	defaultCerts []*config.Certificate
+	certs        []*config.Certificate
 }
 
 func GetLBMetadata(data interface{}) (*LBMetadata, error) {
@@ -42,3 +122,28 @@ func convert(o1 interface{}, o2 interface{}) error {
 	}
 	return nil
 }
+
+// RuleError is a port rule skipped while building the config
+type RuleError struct {
+	SourcePort int
+	Target     string
+	Err        error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("port rule for source port %v and target %s failed: %v", e.SourcePort, e.Target, e.Err)
+}
+
+func (lbMeta *LBMetadata) addRuleError(rule metadata.PortRule, err error) {
+	target := rule.Service
+	if target == "" {
+		target = rule.ContainerUUID
+	}
+	ruleErr := &RuleError{
+		SourcePort: rule.SourcePort,
+		Target:     target,
+		Err:        err,
+	}
+	logrus.Errorf("Skipping %v", ruleErr)
+	lbMeta.RuleErrors = append(lbMeta.RuleErrors, ruleErr)
+}
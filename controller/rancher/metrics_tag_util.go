@@ -0,0 +1,61 @@
+package rancher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// metricsTagLabel tags the backends of the service it's set on
+	metricsTagLabel       = "io.rancher.lb_service.metrics_tag"
+	metricsTagLabelPrefix = "io.rancher.lb_service.metrics_tag."
+)
+
+var metricsTagRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+/*
+getMetricsTags reads the tags the stats and the metrics of the backends
+are labeled with, so they can be sliced by team or product. The backend
+name is given in the label suffix, the services targeted by the lb can
+tag their backends with the label without suffix:
+
+io.rancher.lb_service.metrics_tag.api=payments
+*/
+func getMetricsTags(labels map[string]string) (map[string]string, error) {
+	tags := map[string]string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, metricsTagLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, metricsTagLabelPrefix)
+		if backendName == "" {
+			return nil, fmt.Errorf("Invalid label %s, the suffix should be a backend name", k)
+		}
+		tag := strings.TrimSpace(v)
+		if !metricsTagRegexp.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, should be alphanumeric with _.- up to 63 characters", k, v)
+		}
+		tags[backendName] = tag
+	}
+	return tags, nil
+}
+
+// getMetricsTag prefers the tag the lb sets for the backend
+// over the one of the targeted service
+func getMetricsTag(tags map[string]string, backendName string, serviceLabels map[string]string) string {
+	if tag, ok := tags[backendName]; ok {
+		return tag
+	}
+	tag := strings.TrimSpace(serviceLabels[metricsTagLabel])
+	if tag == "" {
+		return ""
+	}
+	if !metricsTagRegexp.MatchString(tag) {
+		logrus.Warnf("Skipping metrics tag [%s] of backend [%s], should be alphanumeric with _.- up to 63 characters", tag, backendName)
+		return ""
+	}
+	return tag
+}
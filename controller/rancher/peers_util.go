@@ -0,0 +1,36 @@
+package rancher
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+// getPeers lists the running instances of the lb service, so stick-tables
+// are replicated between them. The peers are named after the containers,
+// as the container name is the host name haproxy identifies itself with.
+// Nothing is returned for a single instance, local peer is enough then
+func getPeers(containers []metadata.Container) []*config.Peer {
+	var peers []*config.Peer
+	for _, c := range containers {
+		if !strings.EqualFold(c.State, "running") && !strings.EqualFold(c.State, "starting") {
+			continue
+		}
+		if c.Name == "" || c.PrimaryIp == "" {
+			continue
+		}
+		peers = append(peers, &config.Peer{
+			Name: c.Name,
+			IP:   c.PrimaryIp,
+		})
+	}
+	if len(peers) < 2 {
+		return nil
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
@@ -0,0 +1,183 @@
+package rancher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+// Stages of the sync pipeline, in the order they run
+const (
+	StageCollect   = "collect"
+	StageSelectors = "selectors"
+	StageValidate  = "validate"
+	StageBuild     = "build"
+	StageMutate    = "mutate"
+	StageApply     = "apply"
+)
+
+// SyncState is passed through the stages of the sync pipeline,
+// each stage fills in the fields the next ones work on
+type SyncState struct {
+	// MetadataVersion is the version the metadata is collected at,
+	// empty when the metadata fetcher can't tell it
+	MetadataVersion        string
+	LBService              metadata.Service
+	LBMeta                 *LBMetadata
+	SelfHostUUID           string
+	LocalServicePreference string
+	Report                 *ValidationReport
+	Configs                []*config.LoadBalancerConfig
+	// Snapshot is the metadata the configs are built from,
+	// nil when the fetcher doesn't record it
+	Snapshot *MetadataSnapshot
+}
+
+// StageFunc runs a stage of the sync pipeline
+type StageFunc func(lbc *LoadBalancerController, state *SyncState) error
+
+// Stage is a named step of the sync pipeline
+type Stage struct {
+	Name string
+	Run  StageFunc
+}
+
+// Middleware wraps the stages of the sync pipeline, it can change the
+// state before or after calling next, or stop the sync by returning an error
+type Middleware func(stage string, next StageFunc) StageFunc
+
+// Mutator changes the lb config after it is built, before it is applied
+type Mutator func(lbConfig *config.LoadBalancerConfig) error
+
+type namedMutator struct {
+	name    string
+	mutator Mutator
+}
+
+var (
+	pipelineMu  sync.RWMutex
+	middlewares []Middleware
+	mutators    []namedMutator
+)
+
+// RegisterMiddleware adds the middleware to the sync pipeline, the
+// middleware registered first is the outermost one
+func RegisterMiddleware(m Middleware) {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	middlewares = append(middlewares, m)
+}
+
+// RegisterMutator adds the mutator run by the mutate stage,
+// mutators run in the order they are registered
+func RegisterMutator(name string, m Mutator) error {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	for _, existing := range mutators {
+		if existing.name == name {
+			return fmt.Errorf("mutator %s is already registered", name)
+		}
+	}
+	mutators = append(mutators, namedMutator{name: name, mutator: m})
+	return nil
+}
+
+// configStages are the stages producing the lb configs
+func (lbc *LoadBalancerController) configStages() []Stage {
+	return []Stage{
+		{Name: StageCollect, Run: collectStage},
+		{Name: StageSelectors, Run: selectorsStage},
+		{Name: StageValidate, Run: validateStage},
+		{Name: StageBuild, Run: buildStage},
+		{Name: StageMutate, Run: mutateStage},
+	}
+}
+
+func (lbc *LoadBalancerController) runStages(state *SyncState, stages []Stage) error {
+	pipelineMu.RLock()
+	wrappers := append([]Middleware{}, middlewares...)
+	pipelineMu.RUnlock()
+	for _, stage := range stages {
+		run := stage.Run
+		for i := len(wrappers) - 1; i >= 0; i-- {
+			run = wrappers[i](stage.Name, run)
+		}
+		if err := run(lbc, state); err != nil {
+			return fmt.Errorf("%s stage failed: %v", stage.Name, err)
+		}
+	}
+	return nil
+}
+
+func collectStage(lbc *LoadBalancerController, state *SyncState) error {
+	lbSvc, err := lbc.MetaFetcher.GetSelfService()
+	if err != nil {
+		return err
+	}
+	state.LBService = lbSvc
+	state.LBMeta, err = lbc.collectLBMetadata(lbSvc)
+	if err != nil {
+		return err
+	}
+	state.SelfHostUUID, state.LocalServicePreference, err = lbc.getLocalServicePreference(lbSvc)
+	return err
+}
+
+func selectorsStage(lbc *LoadBalancerController, state *SyncState) error {
+	if err := lbc.processSelector(state.LBMeta); err != nil {
+		return err
+	}
+	return lbc.processHostSelectors(state.LBMeta)
+}
+
+func validateStage(lbc *LoadBalancerController, state *SyncState) error {
+	state.Report = lbc.ValidateLBMetadata(state.LBService.Name, state.LBService.EnvironmentUUID, state.LBMeta)
+	state.Report.log()
+	lbc.validationReport.set(state.Report)
+	skipInvalidRules(state.LBMeta.Expansions, state.Report)
+	lbc.ruleExpansions.set(&ExpansionReport{
+		LBName:     state.LBService.Name,
+		Time:       time.Now(),
+		Expansions: state.LBMeta.Expansions,
+	})
+	return nil
+}
+
+func buildStage(lbc *LoadBalancerController, state *SyncState) error {
+	cfgs, err := lbc.BuildConfigFromMetadata(state.LBService.Name, state.LBService.EnvironmentUUID, state.SelfHostUUID, state.LocalServicePreference, state.LBMeta)
+	if err != nil {
+		return err
+	}
+	state.Configs = cfgs
+	return nil
+}
+
+func mutateStage(lbc *LoadBalancerController, state *SyncState) error {
+	pipelineMu.RLock()
+	registered := append([]namedMutator{}, mutators...)
+	pipelineMu.RUnlock()
+	for _, m := range registered {
+		for _, cfg := range state.Configs {
+			if err := m.mutator(cfg); err != nil {
+				return fmt.Errorf("mutator %s failed: %v", m.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyConfigs applies all the configs, and fails when any of them fails
+func applyConfigs(lbc *LoadBalancerController, state *SyncState) error {
+	var lastErr error
+	for _, cfg := range state.Configs {
+		if err := lbc.LBProvider.ApplyConfig(cfg); err != nil {
+			logrus.Errorf("Failed to apply lb config on provider: %v", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
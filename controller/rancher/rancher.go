@@ -4,21 +4,24 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
-	"os"
+	"net"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
 	"github.com/rancher/lb-controller/controller"
 	"github.com/rancher/lb-controller/provider"
 	utils "github.com/rancher/lb-controller/utils"
+	"github.com/rancher/lb-controller/utils/cattle"
 )
 
 func init() {
@@ -30,96 +33,24 @@ func init() {
 	controller.RegisterController(lbc.GetName(), lbc)
 }
 
-func (lbc *LoadBalancerController) Init(metadataURL string) {
-	cattleURL := os.Getenv("CATTLE_URL")
-	if len(cattleURL) == 0 {
-		logrus.Fatalf("CATTLE_URL is not set, fail to init Rancher LB provider")
-	}
-
-	cattleAccessKey := os.Getenv("CATTLE_ACCESS_KEY")
-	if len(cattleAccessKey) == 0 {
-		logrus.Fatalf("CATTLE_ACCESS_KEY is not set, fail to init of Rancher LB provider")
-	}
-
-	cattleSecretKey := os.Getenv("CATTLE_SECRET_KEY")
-	if len(cattleSecretKey) == 0 {
-		logrus.Fatalf("CATTLE_SECRET_KEY is not set, fail to init of Rancher LB provider")
-	}
-
-	pollIntervalStr := os.Getenv("CERTS_POLL_INTERVAL")
-	if len(pollIntervalStr) == 0 {
-		logrus.Debugf("CERTS_POLL_INTERVAL is not set, will use default 30 seconds")
-		pollIntervalStr = "30"
-	}
-
-	forceUpdateIntStr := os.Getenv("CERTS_FORCE_UPDATE_INTERVAL")
-	if len(forceUpdateIntStr) == 0 {
-		logrus.Debugf("CERTS_FORCE_UPDATE_INTERVAL is not set, will use default 300 seconds")
-		forceUpdateIntStr = "300"
-	}
-
-	certFName := os.Getenv("CERT_FILE_NAME")
-	if len(certFName) == 0 {
-		logrus.Debugf("CERT_FILE_NAME is not set, will use default '%v'", DefaultCertName)
-		certFName = DefaultCertName
-	}
-
-	keyFName := os.Getenv("KEY_FILE_NAME")
-	if len(keyFName) == 0 {
-		logrus.Debugf("KEY_FILE_NAME is not set, will use default '%v'", DefaultKeyName)
-		keyFName = DefaultKeyName
-	}
-
-	opts := &client.ClientOpts{
-		Url:       cattleURL,
-		AccessKey: cattleAccessKey,
-		SecretKey: cattleSecretKey,
-	}
-
-	client, err := client.NewRancherClient(opts)
-	if err != nil {
-		logrus.Fatalf("Failed to create Rancher client %v", err)
-	}
-
-	pollInterval, err := strconv.Atoi(pollIntervalStr)
-	if err != nil {
-		logrus.Fatalf("Failed to convert CERTS_POLL_INTERVAL %v", err)
-	}
-	forceUpdateInt, err := strconv.ParseFloat(forceUpdateIntStr, 64)
-	if err != nil {
-		logrus.Fatalf("Failed to convert CERTS_FORCE_UPDATE_INTERVAL %v", err)
-	}
-
-	metadataClient, err := metadata.NewClientAndWait(metadataURL)
-	if err != nil {
-		logrus.Fatalf("Error initiating metadata client: %v", err)
-	}
+var (
+	certsPollInterval        = flags.Int("CERTS_POLL_INTERVAL", 30, "Interval in seconds to check certificates for updates")
+	certsForceUpdateInterval = flags.Float("CERTS_FORCE_UPDATE_INTERVAL", 300, "Interval in seconds to force certificates update")
+	certFileName             = flags.String("CERT_FILE_NAME", DefaultCertName, "Certificate file name in the cert dir")
+	keyFileName              = flags.String("KEY_FILE_NAME", DefaultKeyName, "Key file name in the cert dir")
 
-	lbc.MetaFetcher = RMetaFetcher{
-		MetadataClient: metadataClient,
-	}
+	certDirLabel        = flags.LabelString("io.rancher.lb_service.cert_dir", "", "Colon separated list of dirs to read the certificates from, the first dirs take precedence")
+	defaultCertDirLabel = flags.LabelString("io.rancher.lb_service.default_cert_dir", "", "Colon separated list of dirs to read the default certificate from, the first dir having one is used")
+)
 
-	lbSvc, err := lbc.MetaFetcher.GetSelfService()
+func (lbc *LoadBalancerController) Init(metadataURL string) {
+	cfg, err := NewConfigFromEnv(metadataURL)
 	if err != nil {
-		logrus.Fatalf("Error reading self service metadata: %v", err)
+		logrus.Fatalf("%v", err)
 	}
-
-	certDir := lbSvc.Labels["io.rancher.lb_service.cert_dir"]
-	defaultCertDir := lbSvc.Labels["io.rancher.lb_service.default_cert_dir"]
-
-	certFetcher := &RCertificateFetcher{
-		Client:              client,
-		mu:                  &sync.RWMutex{},
-		updateCheckInterval: pollInterval,
-		forceUpdateInterval: forceUpdateInt,
-		CertDir:             certDir,
-		DefaultCertDir:      defaultCertDir,
-		CertName:            certFName,
-		KeyName:             keyFName,
-		initPollMu:          &sync.RWMutex{},
+	if err := lbc.InitWithConfig(cfg); err != nil {
+		logrus.Fatalf("%v", err)
 	}
-	lbc.CertFetcher = certFetcher
-
 }
 
 type LoadBalancerController struct {
@@ -131,7 +62,35 @@ type LoadBalancerController struct {
 	incrementalBackoff         int64
 	incrementalBackoffInterval int64
 	CertFetcher                CertificateFetcher
-	MetaFetcher                MetadataFetcher
+	// certFetcherMu guards CertFetcher, set by Run when the
+	// metadata was unreachable at startup
+	certFetcherMu    sync.RWMutex
+	MetaFetcher      MetadataFetcher
+	validationReport reportHolder
+	ruleExpansions   expansionHolder
+	serviceIndex     serviceIndexCache
+	selectorMatchers selectorMatchers
+	// ruleErrors are the rules left out of the last built config
+	ruleErrors []*RuleError
+	captures   captureDeadlines
+	faults     faultOverrides
+	holds      endpointHolds
+	readiness  readiness
+	// requestLoggings are the request loggings set through the admin api
+	requestLoggings requestLoggings
+	// lastSync is the outcome of the last sync, for the state dumps
+	lastSync syncRecorder
+	// configCache skips the rebuilds of an unchanged metadata version
+	configCache configCache
+	// snapshots records the metadata the configs are built from
+	snapshots snapshotRecorder
+	// initConfig is the config the controller was initialized with
+	initConfig *Config
+	// cattleClient is the client of the cert fetcher
+	cattleClient *cattle.Client
+	// metadataClient is set when the metadata was unreachable
+	// at startup, Run waits for it before syncing
+	metadataClient metadata.Client
 }
 
 type MetadataFetcher interface {
@@ -140,6 +99,8 @@ type MetadataFetcher interface {
 	OnChange(intervalSeconds int, do func(string))
 	GetServices() ([]metadata.Service, error)
 	GetSelfHostUUID() (string, error)
+	GetSelfHost() (metadata.Host, error)
+	GetHost(hostUUID string) (*metadata.Host, error)
 	GetContainer(envUUID string, containerUUID string) (*metadata.Container, error)
 }
 
@@ -154,10 +115,19 @@ func (lbc *LoadBalancerController) GetName() string {
 func (lbc *LoadBalancerController) Run(provider provider.LBProvider) {
 	logrus.Infof("starting %s controller", lbc.GetName())
 	lbc.LBProvider = provider
+	go lbc.LBProvider.Run(nil)
 
-	go lbc.syncQueue.Run(time.Second, lbc.stopCh)
+	if lbc.metadataClient != nil {
+		// the provider serves the last config meanwhile
+		waitForMetadata(lbc.metadataClient, 0, lbc.initConfig.Sleep)
+		logrus.Infof("Metadata is reachable, syncing the lb config")
+		if err := lbc.initCertFetcher(); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+	lbc.readiness.start(time.Now())
 
-	go lbc.LBProvider.Run(nil)
+	go lbc.syncQueue.Run(time.Second, lbc.stopCh)
 
 	go lbc.CertFetcher.LookForCertUpdates(lbc.ScheduleApplyConfig)
 
@@ -169,11 +139,31 @@ func (mf RMetaFetcher) OnChange(intervalSeconds int, do func(string)) {
 	mf.MetadataClient.OnChange(intervalSeconds, do)
 }
 
-func (lbc *LoadBalancerController) ScheduleApplyConfig(string) {
+// ScheduleApplyConfig queues a sync, the metadata changes pass their
+// version while the other updates pass none and invalidate the cache
+func (lbc *LoadBalancerController) ScheduleApplyConfig(version string) {
 	logrus.Debug("Scheduling apply config")
+	if version == "" {
+		lbc.configCache.invalidate()
+	}
+	lbc.syncQueue.Enqueue(lbc.GetName())
+}
+
+// Resync syncs the config from fresh metadata, after manual
+// interventions or missed change notifications: the caches are
+// dropped and the backoff of the retries is reset
+func (lbc *LoadBalancerController) Resync() {
+	logrus.Infof("Resyncing the lb config")
+	atomic.StoreInt64(&lbc.incrementalBackoff, 0)
+	lbc.serviceIndex.invalidate()
+	lbc.configCache.invalidate()
 	lbc.syncQueue.Enqueue(lbc.GetName())
 }
 
+func (lbc *LoadBalancerController) GetQueueDepth() int {
+	return lbc.syncQueue.Len()
+}
+
 func (lbc *LoadBalancerController) Stop() error {
 	if !lbc.shutdown {
 		logrus.Infof("Shutting down %s controller", lbc.GetName())
@@ -205,35 +195,45 @@ func (lbc *LoadBalancerController) BuildConfigFromMetadata(lbName, envUUID, self
 	certs := []*config.Certificate{}
 	var defaultCert *config.Certificate
 
-	defCerts, err := lbc.CertFetcher.FetchCertificates(lbMeta, true)
+	defCerts, alternateCerts, err := lbc.fetchCertificates(lbMeta)
 	if err != nil {
 		return nil, err
 	}
-	if len(defCerts) > 0 {
+	if defCerts = CopyCertificates(defCerts); len(defCerts) > 0 {
 		defaultCert = defCerts[0]
-		if defaultCert != nil {
-			certs = append(certs, defaultCert)
-		}
+		certs = append(certs, defaultCert)
 	}
 
-	alternateCerts, err := lbc.CertFetcher.FetchCertificates(lbMeta, false)
-	if err != nil {
-		return nil, err
-	}
-	certs = append(certs, alternateCerts...)
+	certs = append(certs, sortCertificates(CopyCertificates(alternateCerts))...)
+	BundleCertificates(certs)
+	setCertSNIOverrides(certs, lbMeta.CertSNIOverrides)
 
 	logrus.Debugf("Found %v certs", len(certs))
 
+	topology := &topologyFilter{
+		keys:        lbMeta.TopologyKeys,
+		metaFetcher: lbc.MetaFetcher,
+	}
+
+	captureDeadlines := lbc.captures.update(lbMeta.DebugCaptures, time.Now())
+	loggings := lbc.requestLoggings.get(time.Now())
+	faults := lbc.faults.merge(lbMeta.Faults, time.Now())
+
 	allBe := make(map[string]*config.BackendService)
 	allEps := make(map[string]map[string]string)
 	reg, err := regexp.Compile("[^A-Za-z0-9]+")
 	if err != nil {
 		return nil, err
 	}
+	names := newBackendNames(lbMeta.BackendIdentity)
 	for _, rule := range lbMeta.PortRules {
 		if rule.SourcePort < 1 {
 			continue
 		}
+		derivedName := names.derive(rule)
+		if derivedName != "" {
+			rule.BackendName = derivedName
+		}
 		var frontend *config.FrontendService
 		name := strconv.Itoa(rule.SourcePort)
 		if val, ok := frontendsMap[name]; ok {
@@ -245,51 +245,136 @@ func (lbc *LoadBalancerController) BuildConfigFromMetadata(lbName, envUUID, self
 				Port:            rule.SourcePort,
 				Protocol:        rule.Protocol,
 				BackendServices: backends,
+				BindAddress:     getBindAddress(lbMeta.BindAddresses, rule.SourcePort),
+				Certs:           getFrontendCerts(lbMeta.PortCerts, rule, certs),
+				H2C:             getH2C(lbMeta.H2CPorts, rule),
+				DetectTLS:       getDetectTLS(lbMeta.DetectTLS, rule, certs),
+				LuaHooks:        getPortLuaHooks(lbMeta.FrontendLuaHooks, rule),
+				SPOEngines:      getFrontendSPOEngines(lbMeta.SPOEngines, rule),
 			}
 		}
 
 		var eps config.Endpoints
 		var hc *config.HealthCheck
-		if rule.Service != "" {
-			// service comes in a format of stackName/serviceName,
-			// replace "/"" with "_"
-			svcName := strings.SplitN(rule.Service, "/", 2)
-			service, err := lbc.MetaFetcher.GetService(envUUID, svcName[1], svcName[0])
+		backendEnv := envUUID
+		// targetLabels are the labels of the target, read for its metrics tag and h2
+		var targetLabels map[string]string
+		redirect := lbMeta.Redirects[rule.BackendName]
+		if redirect != nil && !isHTTPProto(rule.Protocol) {
+			logrus.Warnf("Skipping redirect for backend [%s], not supported for protocol %s", rule.BackendName, rule.Protocol)
+			redirect = nil
+		}
+		if redirect != nil {
+			// redirect rules answer from the lb itself, no endpoints are needed
+			logrus.Debugf("Backend [%s] redirects to %s", rule.BackendName, redirect.Location)
+		} else if remote := lbMeta.RemoteTargets[rule.BackendName]; remote != nil {
+			if err := lbMeta.TargetScope.allowsRemote(remote); err != nil {
+				logrus.Warnf("Skipping port rule for source port %v and remote service %s: %v", rule.SourcePort, remote, err)
+				continue
+			}
+			service, err := lbc.MetaFetcher.GetService(remote.EnvironmentUUID, remote.ServiceName, remote.StackName)
+			if err != nil {
+				lbMeta.addRuleError(rule, err)
+				continue
+			}
+			if service == nil || !IsActiveService(service) {
+				continue
+			}
+			if rule.TargetPort, err = getTargetPort(rule.TargetPort, service.Ports, lbMeta.InferTargetPort); err != nil {
+				logrus.Warnf("Skipping port rule for source port %v and remote service %s: %v", rule.SourcePort, remote, err)
+				continue
+			}
+			if eps, err = lbc.getRemoteEndpoints(service, rule.TargetPort); err != nil {
+				lbMeta.addRuleError(rule, err)
+				continue
+			}
+			if hc, err = getServiceHealthCheck(service); err != nil {
+				lbMeta.addRuleError(rule, err)
+				continue
+			}
+			backendEnv = remote.EnvironmentUUID
+			targetLabels = service.Labels
+		} else if rule.Service != "" {
+			// service comes in a format of stackName/serviceName[/sidekickName]
+			stackName, svcName, sidekick, err := splitRuleService(rule.Service)
 			if err != nil {
-				return nil, err
+				logrus.Warnf("Skipping port rule: %v", err)
+				continue
+			}
+			if err := lbMeta.TargetScope.Allows(envUUID, stackName); err != nil {
+				logrus.Warnf("Skipping port rule for source port %v and service %s: %v", rule.SourcePort, rule.Service, err)
+				continue
+			}
+			service, err := lbc.getRuleService(envUUID, stackName, svcName, sidekick)
+			if err != nil {
+				lbMeta.addRuleError(rule, err)
+				continue
 			}
 			if service == nil || !IsActiveService(service) {
 				continue
 			}
-			eps, err = lbc.getServiceEndpoints(service, rule.TargetPort, selfHostUUID, localServicePreference)
+			if rule.TargetPort, err = getTargetPort(rule.TargetPort, service.Ports, lbMeta.InferTargetPort); err != nil {
+				logrus.Warnf("Skipping port rule for source port %v and service %s: %v", rule.SourcePort, rule.Service, err)
+				continue
+			}
+			eps, err = lbc.getServiceEndpoints(service, rule.TargetPort, selfHostUUID, localServicePreference, lbMeta.BindNetwork, lbMeta.LocalWeights)
 			if err != nil {
-				return nil, err
+				lbMeta.addRuleError(rule, err)
+				continue
+			}
+			holdKey := fmt.Sprintf("%v/%s%s/%s", rule.SourcePort, rule.Hostname, rule.Path, rule.Service)
+			eps = lbc.holds.hold(holdKey, eps, isEndpointsBlip(service), lbMeta.EndpointsHold, time.Now())
+			if len(lbMeta.TopologyKeys) > 0 {
+				if eps, err = topology.filter(eps); err != nil {
+					lbMeta.addRuleError(rule, err)
+					continue
+				}
 			}
 
 			hc, err = getServiceHealthCheck(service)
 			if err != nil {
-				return nil, err
+				lbMeta.addRuleError(rule, err)
+				continue
 			}
+			targetLabels = service.Labels
 		} else {
 			container, err := lbc.MetaFetcher.GetContainer(envUUID, rule.ContainerUUID)
 			if err != nil {
-				return nil, err
+				lbMeta.addRuleError(rule, err)
+				continue
+			}
+			if container == nil {
+				continue
+			}
+			if err := lbMeta.TargetScope.Allows(envUUID, container.StackName); err != nil {
+				logrus.Warnf("Skipping port rule for source port %v and container %s: %v", rule.SourcePort, rule.ContainerUUID, err)
+				continue
+			}
+			if rule.TargetPort, err = getTargetPort(rule.TargetPort, container.Ports, lbMeta.InferTargetPort); err != nil {
+				logrus.Warnf("Skipping port rule for source port %v and container %s: %v", rule.SourcePort, rule.ContainerUUID, err)
+				continue
 			}
-			ep, _ := getContainerEndpoint(container, rule.TargetPort, selfHostUUID, localServicePreference)
+			ep, _ := getContainerEndpoint(container, rule.TargetPort, selfHostUUID, localServicePreference, lbMeta.BindNetwork)
 			if ep == nil {
 				continue
 			}
 			eps = append(eps, ep)
 			hc, err = getContainerHealthcheck(container)
 			if err != nil {
-				return nil, err
+				lbMeta.addRuleError(rule, err)
+				continue
 			}
+			targetLabels = container.Labels
+		}
+
+		if redirect == nil {
+			eps = append(eps, lbc.getBackupEndpoints(envUUID, lbMeta.BackupServices[rule.BackendName], rule.TargetPort, eps, lbMeta.TargetScope, lbMeta.BindNetwork)...)
 		}
 
 		comparator := config.EqRuleComparator
 		path := rule.Path
 		hostname := rule.Hostname
-		if !(strings.EqualFold(rule.Protocol, config.HTTPSProto) || strings.EqualFold(rule.Protocol, config.HTTPProto) || strings.EqualFold(rule.Protocol, config.SNIProto)) {
+		if !(isHTTPProto(rule.Protocol) || strings.EqualFold(rule.Protocol, config.SNIProto)) {
 			path = ""
 			hostname = ""
 		}
@@ -314,11 +399,15 @@ func (lbc *LoadBalancerController) BuildConfigFromMetadata(lbName, envUUID, self
 					backend.Endpoints = append(backend.Endpoints, ep)
 				}
 			}
+			// the merged endpoints keep the order of a single service
+			sort.Sort(backend.Endpoints)
 		} else {
 			UUID := rule.BackendName
 			if UUID == "" {
 				//replace all non alphanumeric with _
 				UUID = reg.ReplaceAllString(pathUUID, "_")
+			} else if derivedName != "" {
+				UUID = names.unique(UUID)
 			}
 			backend := &config.BackendService{
 				UUID:           UUID,
@@ -330,6 +419,22 @@ func (lbc *LoadBalancerController) BuildConfigFromMetadata(lbName, envUUID, self
 				Endpoints:      eps,
 				HealthCheck:    hc,
 				Priority:       rule.Priority,
+				Redirect:       redirect,
+				KeepAlive:      getKeepAlive(lbMeta.KeepAlives, rule.BackendName, rule.Protocol),
+				Transparent:    getTransparent(lbMeta.Transparent, rule.BackendName),
+				DebugCapture:   getDebugCapture(captureDeadlines, rule.BackendName, rule.Protocol),
+				RequestLogging: getRequestLogging(loggings, rule.BackendName, rule.Protocol),
+				Fault:          getFault(faults, rule.BackendName, rule.Protocol),
+				AgentCheck:     getAgentCheck(lbMeta.AgentChecks, rule.BackendName),
+				LuaHooks:       lbMeta.BackendLuaHooks[rule.BackendName],
+				Environment:    backendEnv,
+				MetricsTag:     getMetricsTag(lbMeta.MetricsTags, rule.BackendName, targetLabels),
+				H2:             getH2Backend(rule.BackendName, rule.Protocol, targetLabels),
+			}
+			if redirect == nil {
+				applyCheckPort(backend, lbMeta.CheckPorts[rule.BackendName])
+				applyCheckExpect(backend, lbMeta.CheckExpects[rule.BackendName])
+				applyInitState(backend, getInitState(lbMeta.InitStates, rule.BackendName))
 			}
 			allBe[pathUUID] = backend
 			frontend.BackendServices = append(frontend.BackendServices, backend)
@@ -345,20 +450,39 @@ func (lbc *LoadBalancerController) BuildConfigFromMetadata(lbName, envUUID, self
 
 	var frontends config.FrontendServices
 	for _, v := range frontendsMap {
-		// sort backends
-		sort.Sort(v.BackendServices)
+		// sort backends, the rules of a same kind keep their order
+		sort.Stable(v.BackendServices)
 		frontends = append(frontends, v)
 	}
 
 	//sort frontends
 	sort.Sort(frontends)
 
+	if lbMeta.ACMEChallenge != nil {
+		acmeBackend, err := lbc.getACMEChallengeBackend(envUUID, lbMeta.ACMEChallenge, lbMeta.BindNetwork)
+		if err != nil {
+			return nil, err
+		}
+		if acmeBackend != nil {
+			addACMEChallengeBackend(frontends, acmeBackend)
+		}
+	}
+
 	lbConfig := &config.LoadBalancerConfig{
 		Name:             lbName,
 		FrontendServices: frontends,
 		Certs:            certs,
 		DefaultCert:      defaultCert,
 		StickinessPolicy: &lbMeta.StickinessPolicy,
+		DebugHeaders:     lbMeta.DebugHeaders,
+		Peers:            lbMeta.Peers,
+		Resolvers:        lbMeta.Resolvers,
+		Hardening:        lbMeta.Hardening,
+		StripHeaders:     lbMeta.StripHeaders,
+		Tuning:           lbMeta.Tuning,
+		SPOEngines:       getUsedSPOEngines(lbMeta.SPOEngines, frontends),
+		VRRP:             lbMeta.VRRP,
+		ServiceIPs:       lbMeta.ServiceIPs,
 	}
 
 	if err = lbc.LBProvider.ProcessCustomConfig(lbConfig, lbMeta.Config); err != nil {
@@ -370,10 +494,91 @@ func (lbc *LoadBalancerController) BuildConfigFromMetadata(lbName, envUUID, self
 	return lbConfigs, nil
 }
 
+// fetchCertificates returns default and alternate certificates,
+// reusing the ones fetched by the validation
+func (lbc *LoadBalancerController) fetchCertificates(lbMeta *LBMetadata) ([]*config.Certificate, []*config.Certificate, error) {
+	if lbMeta.fetchedCerts != nil {
+		return lbMeta.fetchedCerts.defaultCerts, lbMeta.fetchedCerts.certs, nil
+	}
+	defCerts, err := lbc.CertFetcher.FetchCertificates(lbMeta, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	alternateCerts, err := lbc.CertFetcher.FetchCertificates(lbMeta, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	lbMeta.fetchedCerts = &fetchedCerts{defaultCerts: defCerts, certs: alternateCerts}
+	return defCerts, alternateCerts, nil
+}
+
+// splitServiceName splits the name in stackName/serviceName format
+func splitServiceName(name string) (string, string, error) {
+	splitted := strings.SplitN(name, "/", 2)
+	if len(splitted) != 2 || splitted[0] == "" || splitted[1] == "" {
+		return "", "", fmt.Errorf("Invalid service name [%s], expected stackName/serviceName", name)
+	}
+	return splitted[0], splitted[1], nil
+}
+
+// splitRuleService splits the service of a port rule, in either
+// stackName/serviceName or stackName/serviceName/sidekickName format
+func splitRuleService(name string) (string, string, string, error) {
+	svc, sidekick := name, ""
+	if parts := strings.Split(name, "/"); len(parts) == 3 && parts[2] != "" {
+		svc, sidekick = parts[0]+"/"+parts[1], parts[2]
+	}
+	stackName, svcName, err := splitServiceName(svc)
+	if err != nil || strings.Contains(svcName, "/") {
+		return "", "", "", fmt.Errorf("Invalid service name [%s], expected stackName/serviceName or stackName/serviceName/sidekickName", name)
+	}
+	return stackName, svcName, sidekick, nil
+}
+
+// getRuleService looks up the service targeted by a port rule, the
+// sidekicks are listed in the metadata as services of their own
+// referencing their primary service. Nil is returned when the
+// service has no such sidekick
+func (lbc *LoadBalancerController) getRuleService(envUUID, stackName, svcName, sidekick string) (*metadata.Service, error) {
+	if sidekick == "" {
+		return lbc.MetaFetcher.GetService(envUUID, svcName, stackName)
+	}
+	service, err := lbc.MetaFetcher.GetService(envUUID, sidekick, stackName)
+	if err != nil || service == nil {
+		return service, err
+	}
+	if !strings.EqualFold(service.PrimaryServiceName, svcName) {
+		logrus.Debugf("Service [%s/%s] has no sidekick [%s]", stackName, svcName, sidekick)
+		return nil, nil
+	}
+	return service, nil
+}
+
+func isHTTPProto(proto string) bool {
+	return strings.EqualFold(proto, config.HTTPSProto) || strings.EqualFold(proto, config.HTTPProto)
+}
+
 func (mf RMetaFetcher) GetSelfService() (metadata.Service, error) {
 	return mf.MetadataClient.GetSelfService()
 }
 
+func (mf RMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	return mf.MetadataClient.GetSelfHost()
+}
+
+func (mf RMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	hosts, err := mf.MetadataClient.GetHosts()
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		if strings.EqualFold(host.UUID, hostUUID) {
+			return &host, nil
+		}
+	}
+	return nil, nil
+}
+
 func (mf RMetaFetcher) GetSelfHostUUID() (string, error) {
 	host, err := mf.MetadataClient.GetSelfHost()
 	if err != nil {
@@ -383,68 +588,264 @@ func (mf RMetaFetcher) GetSelfHostUUID() (string, error) {
 }
 
 func (lbc *LoadBalancerController) GetLBConfigs() ([]*config.LoadBalancerConfig, error) {
-	lbSvc, err := lbc.MetaFetcher.GetSelfService()
+	state, _, err := lbc.buildState()
 	if err != nil {
 		return nil, err
 	}
+	return state.Configs, nil
+}
 
-	lbMeta, err := lbc.CollectLBMetadata(lbSvc)
-	if err != nil {
-		return nil, err
+// buildState returns the state with the configs of the metadata version,
+// built unless cached, and whether they already applied
+func (lbc *LoadBalancerController) buildState() (*SyncState, bool, error) {
+	generation := lbc.configCache.getGeneration()
+	state := &SyncState{MetadataVersion: lbc.metadataVersion()}
+	if cfgs, applied, ok := lbc.configCache.get(state.MetadataVersion); ok {
+		logrus.Debugf("Using the configs built from metadata version %s", state.MetadataVersion)
+		lbc.ruleErrors = nil
+		state.Configs = cfgs
+		state.Snapshot = lbc.configCache.getSnapshot(state.MetadataVersion)
+		return state, applied, nil
 	}
+	if err := lbc.buildSnapshotted(state); err != nil {
+		return nil, false, err
+	}
+	// the rest of the rules is applied, the failed ones are retried with backoff
+	lbc.ruleErrors = state.LBMeta.RuleErrors
+	// the active captures expire on a later sync of the same version
+	if len(lbc.ruleErrors) == 0 && !lbc.captures.active(time.Now()) {
+		lbc.configCache.set(state.MetadataVersion, generation, state.Configs, state.Snapshot)
+	}
+	return state, false, nil
+}
 
-	selfHostUUID := ""
-	localServicePreference := "any"
-
-	if val, ok := lbSvc.Labels["io.rancher.lb_service.target"]; ok {
-		selfHostUUID, err = lbc.MetaFetcher.GetSelfHostUUID()
-		if err != nil {
-			return nil, err
-		}
-		localServicePreference = val
-		if val != "any" && val != "only-local" && val != "prefer-local" {
-			return nil, fmt.Errorf("Invalid label value for label io.rancher.lb_service.target=%s", val)
-		}
+// buildSnapshotted runs the config stages, recording the metadata and
+// the certificates they read into the state snapshot when the fetcher
+// records them
+func (lbc *LoadBalancerController) buildSnapshotted(state *SyncState) error {
+	if _, ok := lbc.MetaFetcher.(*recordingMetaFetcher); !ok {
+		return lbc.runStages(state, lbc.configStages())
 	}
+	snapshot := lbc.snapshots.begin(state.MetadataVersion)
+	err := lbc.runStages(state, lbc.configStages())
+	lbc.snapshots.end(snapshot)
+	if err != nil {
+		return err
+	}
+	if fetched := state.LBMeta.fetchedCerts; fetched != nil {
+		snapshot.setCerts(fetched.defaultCerts, fetched.certs)
+	}
+	state.Snapshot = snapshot
+	return nil
+}
 
-	return lbc.BuildConfigFromMetadata(lbSvc.Name, lbSvc.EnvironmentUUID, selfHostUUID, localServicePreference, lbMeta)
+// getLocalServicePreference reads the target label of the lb service
+func (lbc *LoadBalancerController) getLocalServicePreference(lbSvc metadata.Service) (string, string, error) {
+	val, ok := filterLabels(lbSvc.Labels)["io.rancher.lb_service.target"]
+	if !ok {
+		return "", "any", nil
+	}
+	if val != "any" && val != "only-local" && val != "prefer-local" && val != preferLocalWeighted {
+		return "", "", fmt.Errorf("Invalid label value for label io.rancher.lb_service.target=%s", val)
+	}
+	selfHostUUID, err := lbc.MetaFetcher.GetSelfHostUUID()
+	if err != nil {
+		return "", "", err
+	}
+	return selfHostUUID, val, nil
 }
 
+// CollectLBMetadata reads the lb config and labels of the
+// lb service, and expands selector based port rules
 func (lbc *LoadBalancerController) CollectLBMetadata(lbSvc metadata.Service) (*LBMetadata, error) {
+	lbMeta, err := lbc.collectLBMetadata(lbSvc)
+	if err != nil {
+		return nil, err
+	}
+	if err = lbc.processSelector(lbMeta); err != nil {
+		return nil, err
+	}
+	if err = lbc.processHostSelectors(lbMeta); err != nil {
+		return nil, err
+	}
+	return lbMeta, nil
+}
+
+func (lbc *LoadBalancerController) collectLBMetadata(lbSvc metadata.Service) (*LBMetadata, error) {
 	lbConfig := lbSvc.LBConfig
+	lbSvc.Labels = filterLabels(lbSvc.Labels)
 
 	lbMeta, err := GetLBMetadata(lbConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = lbc.processSelector(lbMeta); err != nil {
+	if lbMeta.Redirects, err = getRedirects(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+
+	if lbMeta.ACMEChallenge, err = getACMEChallenge(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+
+	if lbMeta.DebugHeaders, err = getDebugHeaders(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.BindAddresses, err = getBindAddresses(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.H2CPorts, err = getH2CPorts(lbSvc.Labels); err != nil {
 		return nil, err
 	}
+	if lbMeta.DetectTLS, err = getDetectTLSPorts(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.BindNetwork, err = getBindNetwork(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.LocalWeights, err = getLocalWeights(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.TopologyKeys, err = getTopologyKeys(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.KeepAlives, err = getKeepAlives(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.Transparent, err = getTransparentBackends(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.DebugCaptures, err = getDebugCaptures(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.Faults, err = getFaults(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.Resolvers, err = getResolvers(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.Hardening, err = getRequestHardening(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.StripHeaders, err = getHeaderStripping(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.Tuning, err = getTuning(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.TargetScope, err = GetTargetScope(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.CheckPorts, err = getCheckPorts(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.CheckExpects, err = getCheckExpects(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.InitStates, err = getInitStates(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.AgentChecks, err = getAgentChecks(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.BackupServices, err = getBackupServices(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.RemoteTargets, err = getRemoteTargets(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.MetricsTags, err = getMetricsTags(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	hold, err := endpointsHold.Get(lbSvc.Labels)
+	if err != nil {
+		return nil, err
+	}
+	lbMeta.EndpointsHold = time.Duration(hold) * time.Second
+	if lbMeta.InferTargetPort, err = inferTargetPort.Get(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.BackendIdentity, err = getBackendIdentity(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.HostSelectors, err = getHostSelectors(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.CertSNIOverrides, err = getCertSNIOverrides(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.PortCerts, err = getPortCerts(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.FrontendLuaHooks, err = getFrontendLuaHooks(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.BackendLuaHooks, err = getBackendLuaHooks(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	if lbMeta.SPOEngines, err = getSPOEngines(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	lbMeta.Peers = getPeers(lbSvc.Containers)
+	if lbMeta.VRRP, err = lbc.getVRRP(lbSvc); err != nil {
+		return nil, err
+	}
+	if lbMeta.ServiceIPs, err = getServiceIPs(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+
+	overrides, err := getHostOverrides(lbSvc.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		host, err := lbc.MetaFetcher.GetSelfHost()
+		if err != nil {
+			return nil, err
+		}
+		applyHostOverrides(lbMeta, overrides, host)
+	}
 	return lbMeta, nil
 }
 
 func (lbc *LoadBalancerController) processSelector(lbMeta *LBMetadata) error {
 	//collect selector based services
 	var rules []metadata.PortRule
-	svcs, err := lbc.MetaFetcher.GetServices()
+	index, err := lbc.getServiceIndex()
 	if err != nil {
 		return err
 	}
 
+	expansions := []*SelectorExpansion{}
 	for _, lbRule := range lbMeta.PortRules {
 		if lbRule.Selector == "" {
 			rules = append(rules, lbRule)
 			continue
 		}
+		expansion := newSelectorExpansion(lbRule)
+		expansions = append(expansions, expansion)
+		if isContainerSelector(lbRule.Selector) {
+			for _, rule := range getContainerSelectorRules(lbRule, index) {
+				expansion.Matched = append(expansion.Matched, rule.ContainerUUID)
+				expansion.addRule(len(rules), rule)
+				rules = append(rules, rule)
+			}
+			continue
+		}
 
+		svcs, err := lbc.matchServices(index, lbRule.Selector)
+		if err != nil {
+			logrus.Warnf("Skipping selector rule for source port %v: %v", lbRule.SourcePort, err)
+			expansion.skip(lbRule.Selector, -1, "Selector matcher failed: %v", err)
+			continue
+		}
 		for _, svc := range svcs {
-			if !IsSelectorMatch(lbRule.Selector, svc.Labels) {
-				continue
-			}
+			svcName := fmt.Sprintf("%s/%s", svc.StackName, svc.Name)
+			expansion.Matched = append(expansion.Matched, svcName)
 			lbConfig := svc.LBConfig
 			if len(lbConfig.PortRules) == 0 {
 				if lbRule.TargetPort == 0 {
+					expansion.skip(svcName, -1, "Service has no port rules and the selector rule has no target port")
 					continue
 				}
 			}
@@ -454,7 +855,6 @@ func (lbc *LoadBalancerController) processSelector(lbMeta *LBMetadata) error {
 				return err
 			}
 
-			svcName := fmt.Sprintf("%s/%s", svc.StackName, svc.Name)
 			if len(meta.PortRules) > 0 {
 				for _, rule := range meta.PortRules {
 					port := metadata.PortRule{
@@ -466,6 +866,7 @@ func (lbc *LoadBalancerController) processSelector(lbMeta *LBMetadata) error {
 						TargetPort:  rule.TargetPort,
 						BackendName: rule.BackendName,
 					}
+					expansion.addRule(len(rules), port)
 					rules = append(rules, port)
 				}
 			} else {
@@ -480,12 +881,14 @@ func (lbc *LoadBalancerController) processSelector(lbMeta *LBMetadata) error {
 					TargetPort:  lbRule.TargetPort,
 					BackendName: lbRule.BackendName,
 				}
+				expansion.addRule(len(rules), port)
 				rules = append(rules, port)
 			}
 
 		}
 	}
 
+	lbMeta.Expansions = expansions
 	lbMeta.PortRules = rules
 	return nil
 }
@@ -494,14 +897,22 @@ func getServiceHealthCheck(svc *metadata.Service) (*config.HealthCheck, error) {
 	if &svc.HealthCheck == nil {
 		return nil, nil
 	}
-	return getConfigServiceHealthCheck(svc.HealthCheck)
+	hc, err := getConfigServiceHealthCheck(svc.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	return applyHealthCheckPortLabel(hc, svc.Labels), nil
 }
 
 func getContainerHealthcheck(c *metadata.Container) (*config.HealthCheck, error) {
 	if &c.HealthCheck == nil {
 		return nil, nil
 	}
-	return getConfigServiceHealthCheck(c.HealthCheck)
+	hc, err := getConfigServiceHealthCheck(c.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	return applyHealthCheckPortLabel(hc, c.Labels), nil
 }
 
 func (mf RMetaFetcher) GetServices() ([]metadata.Service, error) {
@@ -556,18 +967,18 @@ func (mf RMetaFetcher) GetContainer(envUUID string, containerUUID string) (*meta
 	return &container, nil
 }
 
-func (lbc *LoadBalancerController) getServiceEndpoints(svc *metadata.Service, targetPort int, selfHostUUID, localServicePreference string) (config.Endpoints, error) {
+func (lbc *LoadBalancerController) getServiceEndpoints(svc *metadata.Service, targetPort int, selfHostUUID, localServicePreference string, network *net.IPNet, weights *LocalWeights) (config.Endpoints, error) {
 	var eps config.Endpoints
 	var err error
 	if strings.EqualFold(svc.Kind, "externalService") {
 		eps = lbc.getExternalServiceEndpoints(svc, targetPort)
 	} else if strings.EqualFold(svc.Kind, "dnsService") {
-		eps, err = lbc.getAliasServiceEndpoints(svc, targetPort, selfHostUUID, localServicePreference)
+		eps, err = lbc.getAliasServiceEndpoints(svc, targetPort, selfHostUUID, localServicePreference, network, weights)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		eps = lbc.getRegularServiceEndpoints(svc, targetPort, selfHostUUID, localServicePreference)
+		eps = lbc.getRegularServiceEndpoints(svc, targetPort, selfHostUUID, localServicePreference, network, weights)
 	}
 
 	// sort endpoints
@@ -575,18 +986,22 @@ func (lbc *LoadBalancerController) getServiceEndpoints(svc *metadata.Service, ta
 	return eps, nil
 }
 
-func (lbc *LoadBalancerController) getAliasServiceEndpoints(svc *metadata.Service, targetPort int, selfHostUUID, localServicePreference string) (config.Endpoints, error) {
+func (lbc *LoadBalancerController) getAliasServiceEndpoints(svc *metadata.Service, targetPort int, selfHostUUID, localServicePreference string, network *net.IPNet, weights *LocalWeights) (config.Endpoints, error) {
 	var eps config.Endpoints
 	for link := range svc.Links {
-		svcName := strings.SplitN(link, "/", 2)
-		service, err := lbc.MetaFetcher.GetService(svc.EnvironmentUUID, svcName[1], svcName[0])
+		stackName, svcName, err := splitServiceName(link)
+		if err != nil {
+			logrus.Warnf("Skipping alias link: %v", err)
+			continue
+		}
+		service, err := lbc.MetaFetcher.GetService(svc.EnvironmentUUID, svcName, stackName)
 		if err != nil {
 			return nil, err
 		}
 		if service == nil {
 			continue
 		}
-		newEps, err := lbc.getServiceEndpoints(service, targetPort, selfHostUUID, localServicePreference)
+		newEps, err := lbc.getServiceEndpoints(service, targetPort, selfHostUUID, localServicePreference, network, weights)
 		if err != nil {
 			return nil, err
 		}
@@ -618,11 +1033,11 @@ func (lbc *LoadBalancerController) getExternalServiceEndpoints(svc *metadata.Ser
 	return eps
 }
 
-func (lbc *LoadBalancerController) getRegularServiceEndpoints(svc *metadata.Service, targetPort int, selfHostUUID, localServicePreference string) config.Endpoints {
+func (lbc *LoadBalancerController) getRegularServiceEndpoints(svc *metadata.Service, targetPort int, selfHostUUID, localServicePreference string, network *net.IPNet, weights *LocalWeights) config.Endpoints {
 	var eps config.Endpoints
 	var contingencyEps config.Endpoints
 	for _, c := range svc.Containers {
-		ep, isContigency := getContainerEndpoint(&c, targetPort, selfHostUUID, localServicePreference)
+		ep, isContigency := getContainerEndpoint(&c, targetPort, selfHostUUID, localServicePreference, network)
 		if ep == nil {
 			continue
 		}
@@ -636,15 +1051,30 @@ func (lbc *LoadBalancerController) getRegularServiceEndpoints(svc *metadata.Serv
 	if localServicePreference == "prefer-local" && len(eps) == 0 {
 		return contingencyEps
 	}
+	if localServicePreference == preferLocalWeighted {
+		// remote endpoints stay as low weight backups
+		if weights == nil {
+			weights = defaultLocalWeights()
+		}
+		for _, ep := range eps {
+			ep.Weight = weights.Local
+		}
+		for _, ep := range contingencyEps {
+			ep.Weight = weights.Remote
+		}
+		return append(eps, contingencyEps...)
+	}
 	return eps
 }
 
-func getContainerEndpoint(c *metadata.Container, targetPort int, selfHostUUID string, localServicePreference string) (*config.Endpoint, bool) {
+func getContainerEndpoint(c *metadata.Container, targetPort int, selfHostUUID string, localServicePreference string, network *net.IPNet) (*config.Endpoint, bool) {
 	if strings.EqualFold(c.State, "running") || strings.EqualFold(c.State, "starting") {
+		ip := getContainerIP(c, network)
 		ep := &config.Endpoint{
-			Name: hashIP(c.PrimaryIp),
-			IP:   c.PrimaryIp,
-			Port: targetPort,
+			Name:     hashIP(ip),
+			IP:       ip,
+			Port:     targetPort,
+			HostUUID: c.HostUUID,
 		}
 		if localServicePreference != "any" && !strings.EqualFold(c.HostUUID, selfHostUUID) {
 			return ep, true
@@ -654,6 +1084,21 @@ func getContainerEndpoint(c *metadata.Container, targetPort int, selfHostUUID st
 	return nil, false
 }
 
+// getContainerIP picks the container ip on the network, falling
+// back to the primary ip when the container is not attached to it
+func getContainerIP(c *metadata.Container, network *net.IPNet) string {
+	if network == nil {
+		return c.PrimaryIp
+	}
+	for _, ip := range append([]string{c.PrimaryIp}, c.Ips...) {
+		if parsed := net.ParseIP(ip); parsed != nil && network.Contains(parsed) {
+			return ip
+		}
+	}
+	logrus.Debugf("Container [%s] has no ip on network %v, using primary ip", c.Name, network)
+	return c.PrimaryIp
+}
+
 func (lbc *LoadBalancerController) IsHealthy() bool {
 	return true
 }
@@ -676,32 +1121,52 @@ func (lbc *LoadBalancerController) sync(key string) {
 	}
 	logrus.Debugf("Syncing up LB")
 	requeue := false
-	cfgs, err := lbc.GetLBConfigs()
-	if err == nil {
-		for _, cfg := range cfgs {
-			if err := lbc.LBProvider.ApplyConfig(cfg); err != nil {
-				logrus.Errorf("Failed to apply lb config on provider: %v", err)
-				requeue = true
+	state, applied, err := lbc.buildState()
+	if err == nil && applied {
+		logrus.Debugf("Metadata version is unchanged since the last apply, skipping the sync")
+	} else if err == nil && lbc.readiness.holdFirstApply(len(lbc.ruleErrors), bindGateTimeout.Get(), time.Now()) {
+		requeue = true
+	} else if err == nil {
+		if err = lbc.runStages(state, []Stage{{Name: StageApply, Run: applyConfigs}}); err != nil {
+			requeue = true
+		} else {
+			if state.Snapshot != nil {
+				lbc.snapshots.setApplied(state.Snapshot)
+			}
+			if len(lbc.ruleErrors) == 0 {
+				lbc.readiness.synced()
 			}
 		}
+		if len(lbc.ruleErrors) > 0 {
+			logrus.Warnf("Applied lb config without %v failed rule(s), retrying", len(lbc.ruleErrors))
+			requeue = true
+		}
+		if lbc.holds.serving(time.Now()) {
+			logrus.Warnf("Applied lb config with held endpoints, retrying")
+			requeue = true
+		}
 	} else {
 		logrus.Errorf("Failed to get lb config: %v", err)
 		requeue = true
 	}
 
+	lbc.lastSync.set(time.Now(), state, err, lbc.ruleErrors, requeue)
 	if requeue {
+		// the retries rebuild the configs
+		lbc.configCache.invalidate()
 		go lbc.requeue(key)
 	} else {
 		//clear up the backoff
-		lbc.incrementalBackoff = 0
+		atomic.StoreInt64(&lbc.incrementalBackoff, 0)
+		lbc.configCache.setApplied(state.MetadataVersion)
 	}
 }
 
 func (lbc *LoadBalancerController) requeue(key string) {
 	// requeue only when after incremental backoff time
-	lbc.incrementalBackoff = lbc.incrementalBackoff + lbc.incrementalBackoffInterval
-	time.Sleep(time.Duration(lbc.incrementalBackoff) * time.Second)
-	lbc.syncQueue.Requeue(key, fmt.Errorf("retrying sync as one of the configs failed to apply on a backend"))
+	backoff := atomic.AddInt64(&lbc.incrementalBackoff, lbc.incrementalBackoffInterval)
+	time.Sleep(time.Duration(backoff) * time.Second)
+	lbc.syncQueue.Requeue(key, fmt.Errorf("retrying sync as one of the configs or rules failed to apply on a backend"))
 }
 
 func hashIP(ip string) string {
@@ -7,6 +7,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/rancher/lb-controller/config"
 )
 
 var testlbc *LoadBalancerController
@@ -147,3 +149,31 @@ func TestCheckDefaultCertRemoval(t *testing.T) {
 		t.Fatalf("Failed to read the default certificate from the directory")
 	}
 }
+
+func TestMergeCertDirs(t *testing.T) {
+	dirs := splitCertDirs("testcerts/certs: :testcerts/defaultCert:")
+	if len(dirs) != 2 || dirs[0] != "testcerts/certs" || dirs[1] != "testcerts/defaultCert" {
+		t.Fatalf("Invalid cert dirs %v", dirs)
+	}
+	merged := mergeCertDirs([]map[string]*config.Certificate{
+		{"/vol1/a.com": {Name: "a.com", Cert: "vol1"}},
+		{"/vol2/a.com": {Name: "a.com", Cert: "vol2"}, "/vol2/b.com": {Name: "b.com", Cert: "vol2"}},
+	})
+	if len(merged) != 2 || merged["/vol1/a.com"] == nil || merged["/vol2/b.com"] == nil {
+		t.Fatalf("Cert of the first dir should take precedence %v", merged)
+	}
+}
+
+func TestPollCertDirs(t *testing.T) {
+	fetcher := &RCertificateFetcher{
+		CertName: "fullchain.pem",
+		KeyName:  "privkey.pem",
+	}
+	certs := fetcher.pollCertDirs([]string{"testcerts/defaultCert", "testcerts/certs"})
+	if len(certs) != 2 || len(certs[1]) != 2 {
+		t.Fatalf("Invalid certs read from dirs %v", certs)
+	}
+	if cert := firstCert(certs[0]); cert == nil || cert.Name != "default.com" {
+		t.Fatalf("Invalid default cert %v", cert)
+	}
+}
@@ -1,12 +1,19 @@
 package rancher
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/internal/metadatatest"
+	"github.com/rancher/lb-controller/provider"
 	utils "github.com/rancher/lb-controller/utils"
+	"github.com/rancher/lb-controller/utils/cattle"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var lbc *LoadBalancerController
@@ -202,6 +209,45 @@ func TestLocalService(t *testing.T) {
 
 }
 
+func TestPreferLocalWeightedService(t *testing.T) {
+	portRules := []metadata.PortRule{}
+	port := metadata.PortRule{
+		Protocol:   "tcp",
+		Service:    "default/local",
+		TargetPort: 44,
+		SourcePort: 45,
+	}
+	portRules = append(portRules, port)
+	weights, err := getLocalWeights(map[string]string{remoteWeightLabel: "5"})
+	if err != nil {
+		t.Fatalf("Failed to parse weights %v", err)
+	}
+	meta := &LBMetadata{
+		PortRules:    portRules,
+		LocalWeights: weights,
+	}
+
+	configs, _ := lbc.BuildConfigFromMetadata("test", "", "1", preferLocalWeighted, meta)
+
+	eps := configs[0].FrontendServices[0].BackendServices[0].Endpoints
+	if len(eps) != 2 {
+		t.Fatalf("Invalid endpoints length %v", len(eps))
+	}
+	for _, ep := range eps {
+		expected := 5
+		if ep.IP == "10.1.1.13" {
+			expected = 100
+		}
+		if ep.Weight != expected {
+			t.Fatalf("Invalid weight %v of endpoint %v", ep.Weight, ep.IP)
+		}
+	}
+
+	if _, err := getLocalWeights(map[string]string{localWeightLabel: "300"}); err == nil {
+		t.Fatal("Invalid weight is not reported")
+	}
+}
+
 func TestStoppedAndRunningInstance(t *testing.T) {
 	portRules := []metadata.PortRule{}
 	port := metadata.PortRule{
@@ -550,10 +596,14 @@ func (mf tMetaFetcher) GetContainer(envUUID string, containerName string) (*meta
 
 func (mf tMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
 	var svc *metadata.Service
+	if strings.EqualFold(svcName, "broken") {
+		return nil, fmt.Errorf("metadata lookup failed")
+	}
 	if strings.EqualFold(svcName, "foo") {
 		svc = &metadata.Service{
 			Kind:       "service",
 			Containers: getContainers(svcName),
+			Ports:      []string{"8080:80/tcp"},
 		}
 	} else if strings.EqualFold(svcName, "bar") {
 		svc = &metadata.Service{
@@ -631,6 +681,7 @@ func getContainers(svcName string) []metadata.Container {
 	} else if strings.EqualFold(svcName, "baz") {
 		c1 := metadata.Container{
 			PrimaryIp: "10.1.1.3",
+			Ips:       []string{"10.1.1.3", "10.10.0.3"},
 			State:     "running",
 		}
 		c2 := metadata.Container{
@@ -715,6 +766,26 @@ func (mf tMetaFetcher) GetSelfService() (metadata.Service, error) {
 	return svc, nil
 }
 
+func (mf tMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	return metadata.Host{
+		UUID:     "host1",
+		Hostname: "edge1",
+		Labels:   map[string]string{"size": "large", "zone": "a", "region": "r1"},
+	}, nil
+}
+
+func (mf tMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	zones := map[string]string{"host1": "a", "1": "b", "2": "a", "3": "c"}
+	zone, ok := zones[hostUUID]
+	if !ok {
+		return nil, nil
+	}
+	return &metadata.Host{
+		UUID:   hostUUID,
+		Labels: map[string]string{"zone": zone, "region": "r1"},
+	}, nil
+}
+
 func (mf tMetaFetcher) GetSelfHostUUID() (string, error) {
 	return "", nil
 }
@@ -752,8 +823,8 @@ func (p *tProvider) GetName() string {
 	return ""
 }
 
-func (p *tProvider) GetPublicEndpoints(configName string) []string {
-	return []string{}
+func (p *tProvider) GetPublicEndpoints(configName string) []provider.PublicEndpoint {
+	return []provider.PublicEndpoint{}
 }
 
 func (p *tProvider) CleanupConfig(configName string) error {
@@ -894,3 +965,2227 @@ func TestSelectorMatchNoTargetPort(t *testing.T) {
 		t.Fatalf("Port is incorrect %v", be.Port)
 	}
 }
+
+func TestRedirectRule(t *testing.T) {
+	portRules := []metadata.PortRule{}
+	port := metadata.PortRule{
+		SourcePort:  80,
+		Protocol:    "http",
+		Hostname:    "old-domain.com",
+		BackendName: "olddomain",
+	}
+	portRules = append(portRules, port)
+	redirects, err := getRedirects(map[string]string{
+		"io.rancher.lb_service.redirect.olddomain": "301 https://new-domain.com/",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse redirects %v", err)
+	}
+	meta := &LBMetadata{
+		PortRules: portRules,
+		Redirects: redirects,
+	}
+
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+
+	be := configs[0].FrontendServices[0].BackendServices[0]
+	if be.Redirect == nil {
+		t.Fatal("Redirect is not set on the backend")
+	}
+	if be.Redirect.Code != 301 {
+		t.Fatalf("Invalid redirect code %v", be.Redirect.Code)
+	}
+	if be.Redirect.Location != "https://new-domain.com" || !be.Redirect.Prefix {
+		t.Fatalf("Invalid redirect location %v, prefix %v", be.Redirect.Location, be.Redirect.Prefix)
+	}
+	if len(be.Endpoints) != 0 {
+		t.Fatalf("Redirect backend shouldn't have endpoints %v", len(be.Endpoints))
+	}
+}
+
+func TestInvalidRedirect(t *testing.T) {
+	if _, err := getRedirects(map[string]string{"io.rancher.lb_service.redirect.foo": "200 https://foo.com"}); err == nil {
+		t.Fatal("Expected an error for unsupported redirect code")
+	}
+	if _, err := getRedirects(map[string]string{"io.rancher.lb_service.redirect.foo": "301 foo.com"}); err == nil {
+		t.Fatal("Expected an error for relative redirect target")
+	}
+}
+
+func TestACMEChallengeBackend(t *testing.T) {
+	portRules := []metadata.PortRule{}
+	port := metadata.PortRule{
+		SourcePort: 80,
+		Protocol:   "http",
+		Hostname:   "baz.com",
+		Service:    "default/baz",
+		TargetPort: 44,
+	}
+	portRules = append(portRules, port)
+	port = metadata.PortRule{
+		SourcePort: 90,
+		Protocol:   "tcp",
+		Service:    "default/baz",
+		TargetPort: 44,
+	}
+	portRules = append(portRules, port)
+	challenge, err := getACMEChallenge(map[string]string{
+		"io.rancher.lb_service.acme_challenge_service": "default/foo",
+		"io.rancher.lb_service.acme_challenge_port":    "8089",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse acme challenge labels %v", err)
+	}
+	meta := &LBMetadata{
+		PortRules:     portRules,
+		ACMEChallenge: challenge,
+	}
+
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+
+	for _, fe := range configs[0].FrontendServices {
+		be := fe.BackendServices[0]
+		if fe.Protocol == "tcp" {
+			if be.UUID == "acme_challenge" {
+				t.Fatal("Challenge backend shouldn't be added to tcp frontend")
+			}
+			continue
+		}
+		if len(fe.BackendServices) != 2 {
+			t.Fatalf("Invalid backend length %v", len(fe.BackendServices))
+		}
+		if be.UUID != "acme_challenge" {
+			t.Fatalf("Challenge backend should go first, got %v", be.UUID)
+		}
+		if be.Path != "/.well-known/acme-challenge/" || be.Port != 8089 {
+			t.Fatalf("Invalid challenge backend path %v port %v", be.Path, be.Port)
+		}
+		if len(be.Endpoints) != 1 || be.Endpoints[0].IP != "10.1.1.1" {
+			t.Fatalf("Invalid challenge backend endpoints %v", be.Endpoints)
+		}
+	}
+}
+
+func TestMalformedServiceName(t *testing.T) {
+	portRules := []metadata.PortRule{}
+	port := metadata.PortRule{
+		SourcePort: 45,
+		Protocol:   "http",
+		Service:    "foo",
+		TargetPort: 44,
+	}
+	portRules = append(portRules, port)
+	port = metadata.PortRule{
+		SourcePort: 45,
+		Protocol:   "http",
+		Hostname:   "baz.com",
+		Service:    "default/baz",
+		TargetPort: 44,
+	}
+	portRules = append(portRules, port)
+	meta := &LBMetadata{
+		PortRules: portRules,
+	}
+
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+
+	bes := configs[0].FrontendServices[0].BackendServices
+	if len(bes) != 1 {
+		t.Fatalf("Invalid backend length %v", len(bes))
+	}
+	if bes[0].Host != "baz.com" {
+		t.Fatalf("Invalid backend host %v", bes[0].Host)
+	}
+}
+
+func TestBindAddressAndNetwork(t *testing.T) {
+	labels := map[string]string{
+		bindAddressLabel:              "eth1",
+		bindAddressLabelPrefix + "46": "10.0.0.5",
+		bindNetworkLabel:              "10.10.0.0/16",
+	}
+	addresses, err := getBindAddresses(labels)
+	if err != nil {
+		t.Fatalf("Failed to parse bind addresses %v", err)
+	}
+	network, err := getBindNetwork(labels)
+	if err != nil {
+		t.Fatalf("Failed to parse bind network %v", err)
+	}
+	portRules := []metadata.PortRule{
+		{
+			SourcePort: 45,
+			Protocol:   "http",
+			Service:    "default/baz",
+			TargetPort: 44,
+		},
+		{
+			SourcePort: 46,
+			Protocol:   "tcp",
+			Service:    "default/baz",
+			TargetPort: 44,
+		},
+	}
+	meta := &LBMetadata{
+		PortRules:     portRules,
+		BindAddresses: addresses,
+		BindNetwork:   network,
+	}
+
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	fes := configs[0].FrontendServices
+	if len(fes) != 2 {
+		t.Fatalf("Invalid frontend length %v", len(fes))
+	}
+	for _, fe := range fes {
+		expected := "eth1"
+		if fe.Port == 46 {
+			expected = "10.0.0.5"
+		}
+		if fe.BindAddress != expected {
+			t.Fatalf("Invalid bind address of frontend %v: %v", fe.Port, fe.BindAddress)
+		}
+	}
+	eps := fes[0].BackendServices[0].Endpoints
+	if len(eps) != 2 {
+		t.Fatalf("Invalid endpoints length %v", len(eps))
+	}
+	// the second container is not attached to the network
+	ips := map[string]bool{eps[0].IP: true, eps[1].IP: true}
+	if !ips["10.10.0.3"] || !ips["10.1.1.4"] {
+		t.Fatalf("Invalid endpoint ips %v, %v", eps[0].IP, eps[1].IP)
+	}
+
+	if _, err := getBindAddresses(map[string]string{bindAddressLabelPrefix + "foo": "eth1"}); err == nil {
+		t.Fatal("Invalid bind address label is not reported")
+	}
+	if _, err := getBindNetwork(map[string]string{bindNetworkLabel: "10.10.0.0"}); err == nil {
+		t.Fatal("Invalid bind network is not reported")
+	}
+}
+
+func TestHostOverrides(t *testing.T) {
+	labels := map[string]string{
+		hostOverrideLabelPrefix + "large.selector":    "size=large",
+		hostOverrideLabelPrefix + "large.maxconn":     "8000",
+		hostOverrideLabelPrefix + "small.selector":    "size=small",
+		hostOverrideLabelPrefix + "small.maxconn":     "1000",
+		hostOverrideLabelPrefix + "edge.selector":     hostHostnameLabel + "=edge1",
+		hostOverrideLabelPrefix + "edge.bind_address": "203.0.113.10",
+		hostOverrideLabelPrefix + "edge.config":       "global\n    nbproc 2",
+	}
+	svc := metadata.Service{
+		Kind:   "loadBalancerService",
+		Labels: labels,
+		LBConfig: metadata.LBConfig{
+			Config: "global\n    maxpipes 512",
+		},
+	}
+	lbMeta, err := lbc.CollectLBMetadata(svc)
+	if err != nil {
+		t.Fatalf("Failed to collect lb metadata %v", err)
+	}
+	if lbMeta.BindAddresses[0] != "203.0.113.10" {
+		t.Fatalf("Invalid bind address %v", lbMeta.BindAddresses[0])
+	}
+	expected := "global\n    maxpipes 512\nglobal\n    nbproc 2\n\nglobal\n    maxconn 8000\ndefaults\n    maxconn 8000\n"
+	if lbMeta.Config != expected {
+		t.Fatalf("Invalid custom config %q", lbMeta.Config)
+	}
+
+	labels = map[string]string{hostOverrideLabelPrefix + "large.maxconn": "8000"}
+	if _, err := getHostOverrides(labels); err == nil {
+		t.Fatal("Host override without selector is not reported")
+	}
+	labels = map[string]string{hostOverrideLabelPrefix + "large": "8000"}
+	if _, err := getHostOverrides(labels); err == nil {
+		t.Fatal("Host override without setting is not reported")
+	}
+}
+
+func TestTopologyKeys(t *testing.T) {
+	portRules := []metadata.PortRule{
+		{
+			Protocol:   "tcp",
+			Service:    "default/local",
+			TargetPort: 44,
+			SourcePort: 45,
+		},
+	}
+	for _, tc := range []struct {
+		keys     string
+		expected []string
+	}{
+		// lb host is host1 in zone a, endpoints are on host 1 (zone b) and 2 (zone a)
+		{"zone,*", []string{"10.1.1.14"}},
+		{"io.rancher.host.uuid,rack,region", []string{"10.1.1.13", "10.1.1.14"}},
+		{"io.rancher.host.uuid,rack", nil},
+		{"rack,*", []string{"10.1.1.13", "10.1.1.14"}},
+	} {
+		keys, err := getTopologyKeys(map[string]string{topologyKeysLabel: tc.keys})
+		if err != nil {
+			t.Fatalf("Failed to parse topology keys %v", err)
+		}
+		meta := &LBMetadata{
+			PortRules:    portRules,
+			TopologyKeys: keys,
+		}
+		configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+		if err != nil {
+			t.Fatalf("Failed to build the config from metadata %v", err)
+		}
+		eps := configs[0].FrontendServices[0].BackendServices[0].Endpoints
+		if len(eps) != len(tc.expected) {
+			t.Fatalf("Invalid endpoints length %v for topology keys %s", len(eps), tc.keys)
+		}
+		ips := map[string]bool{}
+		for _, ep := range eps {
+			ips[ep.IP] = true
+		}
+		for _, ip := range tc.expected {
+			if !ips[ip] {
+				t.Fatalf("Missing endpoint %s for topology keys %s", ip, tc.keys)
+			}
+		}
+	}
+
+	if _, err := getTopologyKeys(map[string]string{topologyKeysLabel: "*,zone"}); err == nil {
+		t.Fatal("Topology key after * is not reported")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	keepAlives, err := getKeepAlives(map[string]string{
+		keepAliveLabel:               "http_reuse=safe",
+		keepAliveLabelPrefix + "api": "http_reuse=aggressive,pool_purge_delay=10s,pool_max_conn=200",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse keepalive labels %v", err)
+	}
+	portRules := []metadata.PortRule{
+		{
+			SourcePort:  45,
+			Protocol:    "http",
+			Hostname:    "api.com",
+			Service:     "default/foo",
+			TargetPort:  44,
+			BackendName: "api",
+		},
+		{
+			SourcePort: 45,
+			Protocol:   "http",
+			Hostname:   "web.com",
+			Service:    "default/foo",
+			TargetPort: 44,
+		},
+		{
+			SourcePort: 46,
+			Protocol:   "tcp",
+			Service:    "default/foo",
+			TargetPort: 44,
+		},
+	}
+	meta := &LBMetadata{
+		PortRules:  portRules,
+		KeepAlives: keepAlives,
+	}
+
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	for _, fe := range configs[0].FrontendServices {
+		for _, be := range fe.BackendServices {
+			switch {
+			case be.UUID == "api":
+				if be.KeepAlive == nil || be.KeepAlive.HTTPReuse != "aggressive" || be.KeepAlive.PoolPurgeDelay != "10s" || be.KeepAlive.PoolMaxConn != 200 {
+					t.Fatalf("Invalid keepalive of backend api %v", be.KeepAlive)
+				}
+			case be.Protocol == "tcp":
+				if be.KeepAlive != nil {
+					t.Fatalf("Keepalive is set for tcp backend %v", be.KeepAlive)
+				}
+			default:
+				if be.KeepAlive == nil || be.KeepAlive.HTTPReuse != "safe" {
+					t.Fatalf("Invalid keepalive of backend %s %v", be.UUID, be.KeepAlive)
+				}
+			}
+		}
+	}
+
+	for _, value := range []string{"http_reuse=sometimes", "pool_purge_delay=10", "max_idle=5"} {
+		if _, err := getKeepAlives(map[string]string{keepAliveLabel: value}); err == nil {
+			t.Fatalf("Invalid keepalive %s is not reported", value)
+		}
+	}
+}
+
+func TestPeers(t *testing.T) {
+	lbSvc := metadata.Service{
+		Name: "lb",
+		Containers: []metadata.Container{
+			{Name: "lb-2", PrimaryIp: "10.42.0.2", State: "running"},
+			{Name: "lb-1", PrimaryIp: "10.42.0.1", State: "running"},
+			{Name: "lb-3", PrimaryIp: "10.42.0.3", State: "stopped"},
+		},
+	}
+	lbMeta, err := lbc.CollectLBMetadata(lbSvc)
+	if err != nil {
+		t.Fatalf("Failed to collect lb metadata %v", err)
+	}
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", lbMeta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	peers := configs[0].Peers
+	if len(peers) != 2 {
+		t.Fatalf("Invalid peers length %v", len(peers))
+	}
+	if peers[0].Name != "lb-1" || peers[0].IP != "10.42.0.1" || peers[1].Name != "lb-2" {
+		t.Fatalf("Invalid peers %v %v", peers[0], peers[1])
+	}
+
+	// single instance doesn't need remote peers
+	if peers := getPeers(lbSvc.Containers[:1]); peers != nil {
+		t.Fatalf("Invalid peers for single instance %v", peers)
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	resolvers, err := getResolvers(map[string]string{
+		dnsLabel: "nameservers=10.0.0.2:5353 10.0.0.3,resolve_prefer=ipv4,hold_valid=10s,resolve_retries=3,server_slots=4",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse dns label %v", err)
+	}
+	if len(resolvers.Nameservers) != 2 || resolvers.Nameservers[0] != "10.0.0.2:5353" || resolvers.Nameservers[1] != "10.0.0.3:53" {
+		t.Fatalf("Invalid nameservers %v", resolvers.Nameservers)
+	}
+	if resolvers.ResolvePrefer != "ipv4" || resolvers.HoldValid != "10s" || resolvers.ResolveRetries != 3 || resolvers.ServerSlots != 4 {
+		t.Fatalf("Invalid resolvers %v", resolvers)
+	}
+
+	for _, value := range []string{"nameservers=dns.local", "resolve_prefer=ipv5", "server_slots=0", "hold_valid=10", "retries=3"} {
+		if _, err := getResolvers(map[string]string{dnsLabel: value}); err == nil {
+			t.Fatalf("Invalid dns setting %s is not reported", value)
+		}
+	}
+}
+
+func TestMissingTargetPort(t *testing.T) {
+	portRules := []metadata.PortRule{
+		{
+			SourcePort: 45,
+			Protocol:   "http",
+			Service:    "default/foo",
+		},
+		{
+			SourcePort: 46,
+			Protocol:   "http",
+			Service:    "default/bar",
+		},
+	}
+	meta := &LBMetadata{
+		PortRules: portRules,
+	}
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	if len(configs[0].FrontendServices) != 0 {
+		t.Fatalf("Rules without target port should be skipped %v", len(configs[0].FrontendServices))
+	}
+
+	// foo exposes a single port to infer the target port from, bar doesn't expose any
+	meta.InferTargetPort = true
+	configs, err = lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	fes := configs[0].FrontendServices
+	if len(fes) != 1 || fes[0].Port != 45 {
+		t.Fatalf("Invalid frontends %v", fes)
+	}
+	be := fes[0].BackendServices[0]
+	if be.Port != 80 {
+		t.Fatalf("Invalid backend port %v", be.Port)
+	}
+	for _, ep := range be.Endpoints {
+		if ep.Port != 80 {
+			t.Fatalf("Invalid endpoint port %v", ep.Port)
+		}
+	}
+
+	if _, err := getTargetPort(0, []string{"10.0.0.1:8080:80/tcp", "8443:443/tcp"}, true); err == nil {
+		t.Fatalf("Target port shouldn't be inferred from multiple ports")
+	}
+}
+
+func TestValidateLBMetadata(t *testing.T) {
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Hostname: "*.foo.com", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 70000, Protocol: "http", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 81, Protocol: "udp", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 82, Protocol: "http", Hostname: "foo bar.com", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 83, Protocol: "http", Service: "default/missing", TargetPort: 80},
+			{SourcePort: 84, Protocol: "tcp", Hostname: "foo.com", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 85, Protocol: "http", Service: "default/foo"},
+			{SourcePort: 86, Protocol: "http", ContainerUUID: "missing", TargetPort: 80},
+		},
+	}
+	report := lbc.ValidateLBMetadata("test", "", meta)
+	if report.Valid {
+		t.Fatalf("Report should be invalid")
+	}
+	expected := map[int]string{
+		1: "source_port",
+		2: "protocol",
+		3: "hostname",
+		4: "service",
+		6: "target_port",
+		7: "container_uuid",
+	}
+	for _, issue := range report.Issues {
+		if issue.Severity != SeverityError {
+			continue
+		}
+		if expected[issue.Rule] != issue.Field {
+			t.Fatalf("Unexpected issue %v", issue)
+		}
+		delete(expected, issue.Rule)
+	}
+	if len(expected) != 0 {
+		t.Fatalf("Missing issues for rules %v", expected)
+	}
+	warned := false
+	for _, issue := range report.Issues {
+		if issue.Rule == 5 && issue.Severity == SeverityWarning && issue.Field == "hostname" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Fatalf("Ignored tcp hostname should be warned about %v", report.Issues)
+	}
+	if len(meta.PortRules) != 2 || meta.PortRules[0].SourcePort != 80 || meta.PortRules[1].SourcePort != 84 {
+		t.Fatalf("Invalid rules should be dropped %v", meta.PortRules)
+	}
+}
+
+func TestFailedServiceLookup(t *testing.T) {
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 45, Protocol: "http", Service: "default/broken", TargetPort: 44},
+			{SourcePort: 46, Protocol: "http", Service: "default/foo", TargetPort: 44},
+		},
+	}
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed lookup shouldn't fail the whole config %v", err)
+	}
+	fes := configs[0].FrontendServices
+	if len(fes) != 1 || fes[0].Port != 46 {
+		t.Fatalf("Invalid frontends %v", fes)
+	}
+	if len(meta.RuleErrors) != 1 || meta.RuleErrors[0].SourcePort != 45 || meta.RuleErrors[0].Target != "default/broken" {
+		t.Fatalf("Invalid rule errors %v", meta.RuleErrors)
+	}
+}
+
+func TestPipelineMiddlewareAndMutator(t *testing.T) {
+	defer func() {
+		middlewares = nil
+		mutators = nil
+	}()
+	var calls []string
+	RegisterMiddleware(func(stage string, next StageFunc) StageFunc {
+		return func(lbc *LoadBalancerController, state *SyncState) error {
+			calls = append(calls, "outer "+stage)
+			return next(lbc, state)
+		}
+	})
+	RegisterMiddleware(func(stage string, next StageFunc) StageFunc {
+		return func(lbc *LoadBalancerController, state *SyncState) error {
+			calls = append(calls, "inner "+stage)
+			return next(lbc, state)
+		}
+	})
+	if err := RegisterMutator("header", func(lbConfig *config.LoadBalancerConfig) error {
+		lbConfig.Config = "http-request set-header X-Company rancher"
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to register mutator %v", err)
+	}
+	if err := RegisterMutator("header", nil); err == nil {
+		t.Fatalf("Duplicate mutator should fail to register")
+	}
+
+	state := &SyncState{
+		LBMeta: &LBMetadata{
+			PortRules: []metadata.PortRule{
+				{SourcePort: 45, Protocol: "http", Service: "default/foo", TargetPort: 44},
+			},
+		},
+		LocalServicePreference: "any",
+	}
+	stages := []Stage{
+		{Name: StageBuild, Run: buildStage},
+		{Name: StageMutate, Run: mutateStage},
+	}
+	if err := lbc.runStages(state, stages); err != nil {
+		t.Fatalf("Failed to run stages %v", err)
+	}
+	expected := []string{"outer build", "inner build", "outer mutate", "inner mutate"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("Invalid middleware order %v", calls)
+	}
+	if len(state.Configs) != 1 || state.Configs[0].Config != "http-request set-header X-Company rancher" {
+		t.Fatalf("Mutator is not applied %v", state.Configs)
+	}
+}
+
+func TestCertSNIOverrides(t *testing.T) {
+	overrides, err := getCertSNIOverrides(map[string]string{
+		certSNILabelPrefix + "wildcard": "*.Example.com, !admin.example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to read cert hostnames %v", err)
+	}
+	cached := []*config.Certificate{{Name: "wildcard"}, {Name: "admin", Hostnames: []string{"admin.example.com"}}}
+	certs := CopyCertificates(cached)
+	setCertSNIOverrides(certs, overrides)
+	if !reflect.DeepEqual(certs[0].Hostnames, []string{"*.example.com", "!admin.example.com"}) {
+		t.Fatalf("Invalid cert hostnames %v", certs[0].Hostnames)
+	}
+	if !reflect.DeepEqual(certs[1].Hostnames, []string{"admin.example.com"}) {
+		t.Fatalf("Hostnames of the cert without overrides should be kept %v", certs[1].Hostnames)
+	}
+	if cached[0].Hostnames != nil {
+		t.Fatalf("Overrides should not be set on the cached certs %v", cached[0].Hostnames)
+	}
+	if _, err := getCertSNIOverrides(map[string]string{certSNILabelPrefix + "wildcard": "foo..com"}); err == nil {
+		t.Fatalf("Invalid hostname should fail")
+	}
+}
+
+func TestPortCerts(t *testing.T) {
+	portCerts, err := getPortCerts(map[string]string{
+		portCertsLabelPrefix + "8443": "internal-ca, missing",
+		portCertsLabelPrefix + "80":   "public",
+	})
+	if err != nil {
+		t.Fatalf("Failed to read port certs %v", err)
+	}
+	certs := []*config.Certificate{{Name: "internal-ca"}, {Name: "public"}}
+	selected := getFrontendCerts(portCerts, metadata.PortRule{SourcePort: 8443, Protocol: config.HTTPSProto}, certs)
+	if !reflect.DeepEqual(selected, []string{"internal-ca"}) {
+		t.Fatalf("Invalid certs of port 8443 %v", selected)
+	}
+	if selected := getFrontendCerts(portCerts, metadata.PortRule{SourcePort: 80, Protocol: config.HTTPProto}, certs); selected != nil {
+		t.Fatalf("Certs should be ignored for http port %v", selected)
+	}
+	if selected := getFrontendCerts(portCerts, metadata.PortRule{SourcePort: 443, Protocol: config.HTTPSProto}, certs); selected != nil {
+		t.Fatalf("Port without certs should present all certs %v", selected)
+	}
+	if _, err := getPortCerts(map[string]string{portCertsLabelPrefix + "https": "public"}); err == nil {
+		t.Fatalf("Invalid port should fail")
+	}
+}
+
+func TestH2CPorts(t *testing.T) {
+	ports, err := getH2CPorts(map[string]string{
+		h2cLabel:              "true",
+		h2cLabelPrefix + "81": "false",
+	})
+	if err != nil {
+		t.Fatalf("Failed to read h2c ports %v", err)
+	}
+	if !getH2C(ports, metadata.PortRule{SourcePort: 80, Protocol: config.HTTPProto}) {
+		t.Fatalf("H2c should be enabled on all http ports")
+	}
+	if getH2C(ports, metadata.PortRule{SourcePort: 81, Protocol: config.HTTPProto}) {
+		t.Fatalf("H2c should be disabled on port 81")
+	}
+	if getH2C(ports, metadata.PortRule{SourcePort: 443, Protocol: config.HTTPSProto}) {
+		t.Fatalf("H2c should be enabled on http ports only")
+	}
+	if _, err := getH2CPorts(map[string]string{h2cLabel: "yes please"}); err == nil {
+		t.Fatalf("Invalid value should fail")
+	}
+}
+
+func TestH2Backend(t *testing.T) {
+	if !getH2Backend("grpc", config.HTTPProto, map[string]string{h2BackendLabel: "true"}) {
+		t.Fatalf("H2 should be enabled on the target opting in")
+	}
+	if getH2Backend("web", config.HTTPProto, map[string]string{}) || getH2Backend("web", config.HTTPProto, map[string]string{h2BackendLabel: "yes"}) {
+		t.Fatalf("H2 should be disabled without a valid label")
+	}
+	if getH2Backend("db", config.TCPProto, map[string]string{h2BackendLabel: "true"}) {
+		t.Fatalf("H2 should be enabled on http backends only")
+	}
+}
+
+func TestDetectTLSPorts(t *testing.T) {
+	ports, err := getDetectTLSPorts(map[string]string{detectTLSLabel: "8080, 9090"})
+	if err != nil {
+		t.Fatalf("Failed to read tls detection ports %v", err)
+	}
+	certs := []*config.Certificate{{Name: "default"}}
+	if !getDetectTLS(ports, metadata.PortRule{SourcePort: 8080, Protocol: config.HTTPProto}, certs) {
+		t.Fatalf("Tls detection should be enabled on port 8080")
+	}
+	if getDetectTLS(ports, metadata.PortRule{SourcePort: 9090, Protocol: config.TCPProto}, certs) {
+		t.Fatalf("Tls detection should be enabled on http ports only")
+	}
+	if getDetectTLS(ports, metadata.PortRule{SourcePort: 8080, Protocol: config.HTTPProto}, nil) {
+		t.Fatalf("Tls detection should be disabled without certs")
+	}
+	if _, err := getDetectTLSPorts(map[string]string{detectTLSLabel: "8080,http"}); err == nil {
+		t.Fatalf("Invalid port should fail")
+	}
+}
+
+func TestTransparentBackends(t *testing.T) {
+	transparent, err := getTransparentBackends(map[string]string{
+		transparentLabel:                 "true",
+		transparentLabelPrefix + "stats": "false",
+	})
+	if err != nil {
+		t.Fatalf("Failed to read transparent backends %v", err)
+	}
+	if !getTransparent(transparent, "db") {
+		t.Fatalf("Transparent should be enabled for all backends")
+	}
+	if getTransparent(transparent, "stats") {
+		t.Fatalf("Transparent should be disabled for the stats backend")
+	}
+	if _, err := getTransparentBackends(map[string]string{transparentLabel: "sure"}); err == nil {
+		t.Fatalf("Invalid value should fail")
+	}
+}
+
+func TestDebugCaptures(t *testing.T) {
+	captures, err := getDebugCaptures(map[string]string{debugCaptureLabelPrefix + "api": "10m"})
+	if err != nil {
+		t.Fatalf("Failed to read debug captures %v", err)
+	}
+	var c captureDeadlines
+	now := time.Now()
+	deadlines := c.update(captures, now)
+	if !deadlines["api"].Equal(now.Add(10 * time.Minute)) {
+		t.Fatalf("Invalid capture deadline %v", deadlines)
+	}
+	// the capture keeps its deadline over the syncs, and expires
+	deadlines = c.update(captures, now.Add(time.Minute))
+	if !deadlines["api"].Equal(now.Add(10 * time.Minute)) {
+		t.Fatalf("Capture deadline should not move %v", deadlines)
+	}
+	if deadlines = c.update(captures, now.Add(11*time.Minute)); len(deadlines) != 0 {
+		t.Fatalf("Capture should be expired %v", deadlines)
+	}
+	if getDebugCapture(deadlines, "api", config.HTTPProto) != nil {
+		t.Fatalf("Expired capture should not be set")
+	}
+	if _, err := getDebugCaptures(map[string]string{debugCaptureLabelPrefix + "api": "forever"}); err == nil {
+		t.Fatalf("Invalid duration should fail")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	faults, err := getFaults(map[string]string{faultLabelPrefix + "api": "delay=200ms:10,abort=503:5"})
+	if err != nil {
+		t.Fatalf("Failed to read faults %v", err)
+	}
+	expected := &config.Fault{DelayMs: 200, DelayPercent: 10, AbortStatus: 503, AbortPercent: 5}
+	if !reflect.DeepEqual(faults["api"], expected) {
+		t.Fatalf("Invalid fault %+v", faults["api"])
+	}
+	for _, value := range []string{"delay=200ms", "abort=503:150", "abort=302:5", "delay=2h:10", "slow=1s:5", ""} {
+		if _, err := getFaults(map[string]string{faultLabelPrefix + "api": value}); err == nil {
+			t.Fatalf("Invalid fault %s should fail", value)
+		}
+	}
+
+	// the admin api faults override the labels until removed
+	lbc := &LoadBalancerController{syncQueue: utils.NewTaskQueue(func(string) {})}
+	override := &config.Fault{AbortStatus: 500, AbortPercent: 100}
+	if err := lbc.SetFault("api", override, time.Minute); err != nil {
+		t.Fatalf("Failed to set fault %v", err)
+	}
+	if err := lbc.SetFault("api", &config.Fault{AbortStatus: 500}, time.Minute); err == nil {
+		t.Fatalf("Fault without delay or abort should fail")
+	}
+	if err := lbc.SetFault("api", override, 0); err == nil {
+		t.Fatalf("Fault without duration should fail")
+	}
+	now := time.Now()
+	if fault := lbc.faults.merge(faults, now)["api"]; fault == nil || fault.AbortStatus != 500 || fault.Until.Before(now) {
+		t.Fatalf("Admin api fault should override the label")
+	}
+	if !reflect.DeepEqual(lbc.faults.merge(faults, now.Add(2*time.Minute))["api"], expected) {
+		t.Fatalf("Label fault should be used once the override expires")
+	}
+	lbc.SetFault("api", override, time.Minute)
+	lbc.SetFault("api", nil, 0)
+	if !reflect.DeepEqual(lbc.faults.merge(faults, now)["api"], expected) || len(lbc.GetFaults()) != 0 {
+		t.Fatalf("Label fault should be used once the override is removed")
+	}
+	if getFault(faults, "api", config.TCPProto) != nil {
+		t.Fatalf("Faults should only be injected in http backends")
+	}
+}
+
+func TestRequestHardening(t *testing.T) {
+	hardening, err := getRequestHardening(map[string]string{})
+	if err != nil {
+		t.Fatalf("Failed to read request hardening %v", err)
+	}
+	expected := &config.RequestHardening{PercentDecode: true, MergeSlashes: true, RejectPathTraversal: true, RejectSmuggling: true, MaxHeaderBytes: 8192}
+	if !reflect.DeepEqual(hardening, expected) {
+		t.Fatalf("Request hardening should be on by default %+v", hardening)
+	}
+	hardening, _ = getRequestHardening(map[string]string{"io.rancher.lb_service.merge_slashes": "false", "io.rancher.lb_service.max_header_bytes": "0"})
+	if hardening.MergeSlashes || hardening.MaxHeaderBytes != 0 || !hardening.RejectSmuggling {
+		t.Fatalf("Options should be turned off one by one %+v", hardening)
+	}
+	hardening, _ = getRequestHardening(map[string]string{
+		"io.rancher.lb_service.percent_decode":        "false",
+		"io.rancher.lb_service.merge_slashes":         "false",
+		"io.rancher.lb_service.reject_path_traversal": "false",
+		"io.rancher.lb_service.reject_smuggling":      "false",
+		"io.rancher.lb_service.max_header_bytes":      "0",
+	})
+	if hardening != nil {
+		t.Fatalf("Request hardening should be off %+v", hardening)
+	}
+	if _, err := getRequestHardening(map[string]string{"io.rancher.lb_service.reject_smuggling": "maybe"}); err == nil {
+		t.Fatalf("Invalid label value should fail")
+	}
+}
+
+func TestHeaderStripping(t *testing.T) {
+	stripping, err := getHeaderStripping(map[string]string{
+		stripHeadersLabel:   "hop-by-hop, X-Forwarded-For,X-Auth-User,keep-alive",
+		trustedSourcesLabel: "10.42.0.0/16,192.168.1.10",
+	})
+	if err != nil {
+		t.Fatalf("Failed to read header stripping %v", err)
+	}
+	expected := &config.HeaderStripping{
+		Headers:        []string{"Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Trailer", "X-Forwarded-For", "X-Auth-User"},
+		TrustedSources: []string{"10.42.0.0/16", "192.168.1.10"},
+	}
+	if !reflect.DeepEqual(stripping, expected) {
+		t.Fatalf("Invalid header stripping %+v", stripping)
+	}
+	if stripping, _ := getHeaderStripping(map[string]string{trustedSourcesLabel: "10.42.0.0/16"}); stripping != nil {
+		t.Fatalf("Headers should not be stripped without the strip_headers label")
+	}
+	if _, err := getHeaderStripping(map[string]string{stripHeadersLabel: "X-Auth-User if TRUE"}); err == nil {
+		t.Fatalf("Invalid header name should fail")
+	}
+	if _, err := getHeaderStripping(map[string]string{stripHeadersLabel: "X-Auth-User", trustedSourcesLabel: "internal"}); err == nil {
+		t.Fatalf("Invalid trusted source should fail")
+	}
+}
+
+func TestTuningLabels(t *testing.T) {
+	if tuning, err := getTuning(map[string]string{}); err != nil || tuning != nil {
+		t.Fatalf("Tuning should be left to the provider %+v %v", tuning, err)
+	}
+	tuning, err := getTuning(map[string]string{"io.rancher.lb_service.maxconn": "20000", "io.rancher.lb_service.threads": "4"})
+	if err != nil || *tuning != (config.Tuning{MaxConn: 20000, Threads: 4}) {
+		t.Fatalf("Invalid tuning %+v %v", tuning, err)
+	}
+	if _, err := getTuning(map[string]string{"io.rancher.lb_service.threads": "100"}); err == nil {
+		t.Fatalf("Too many threads should fail")
+	}
+}
+
+func TestReadOnlyCertFetcher(t *testing.T) {
+	// no client is set, any Rancher API call would panic
+	fetcher := &RCertificateFetcher{ReadOnly: true}
+	lbMeta := &LBMetadata{CertificateIDs: []string{"1c1"}, DefaultCertificateID: "1c2"}
+	for _, isDefault := range []bool{true, false} {
+		certs, err := fetcher.FetchCertificates(lbMeta, isDefault)
+		if err != nil || len(certs) != 0 {
+			t.Fatalf("No certs should be fetched in read-only mode, got %v %v", certs, err)
+		}
+	}
+	if err := fetcher.UpdateEndpoints(&metadata.Service{Name: "lb"}, []client.PublicEndpoint{{Port: 80}}); err != nil {
+		t.Fatalf("Endpoints update should be skipped in read-only mode, got %v", err)
+	}
+}
+
+func TestTargetScope(t *testing.T) {
+	if scope, err := GetTargetScope(map[string]string{}); err != nil || scope != nil {
+		t.Fatalf("No scope should be set without labels %v %v", scope, err)
+	}
+	if _, err := GetTargetScope(map[string]string{allowedStacksLabel: "team-[a"}); err == nil {
+		t.Fatalf("Invalid pattern should fail")
+	}
+	scope, err := GetTargetScope(map[string]string{
+		allowedStacksLabel:      "Team-A-*, shared",
+		deniedStacksLabel:       "team-a-secrets",
+		deniedEnvironmentsLabel: "1a5",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	allowed := map[string]bool{
+		"team-a-web":     true,
+		"TEAM-A-API":     true,
+		"shared":         true,
+		"team-a-secrets": false,
+		"team-b-web":     false,
+	}
+	for stack, expected := range allowed {
+		if err := scope.Allows("1a6", stack); (err == nil) != expected {
+			t.Fatalf("Stack %s should be allowed: %v, got %v", stack, expected, err)
+		}
+	}
+	if err := scope.Allows("1a5", "shared"); err == nil {
+		t.Fatalf("Denied environment should not be allowed")
+	}
+
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Service: "shared/foo", TargetPort: 80},
+			{SourcePort: 81, Protocol: "http", Service: "default/foo", TargetPort: 80},
+		},
+		TargetScope: scope,
+	}
+	report := lbc.ValidateLBMetadata("test", "", meta)
+	if report.Valid || len(report.Issues) != 1 || report.Issues[0].Rule != 1 || report.Issues[0].Field != "service" {
+		t.Fatalf("Out of scope rule should be rejected %v", report.Issues)
+	}
+	if len(meta.PortRules) != 1 || meta.PortRules[0].SourcePort != 80 {
+		t.Fatalf("Out of scope rule should be dropped %v", meta.PortRules)
+	}
+
+	// the build skips the out of scope rules of unvalidated metadata
+	meta.PortRules = append(meta.PortRules, metadata.PortRule{SourcePort: 81, Protocol: "http", Service: "default/foo", TargetPort: 80})
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, fe := range configs[0].FrontendServices {
+		if fe.Port == 81 && len(fe.BackendServices) > 0 {
+			t.Fatalf("Out of scope rule should not be built")
+		}
+	}
+}
+
+func TestFilterLabels(t *testing.T) {
+	labels := map[string]string{
+		"io.rancher.lb_service.h2c":           "true",
+		"io.rancher.lb_service.h2c.8080":      "true",
+		"io.rancher.lb_service.cert_dir":      "/etc/ssl",
+		"io.rancher.scheduler.global":         "true",
+		"io.rancher.lb_service.debug_headers": "true",
+	}
+	filtered := filterLabelsByPatterns(labels, []string{"io.rancher.lb_service.h2c*"})
+	expected := map[string]string{
+		"io.rancher.lb_service.h2c":      "true",
+		"io.rancher.lb_service.h2c.8080": "true",
+		"io.rancher.scheduler.global":    "true",
+	}
+	if !reflect.DeepEqual(filtered, expected) {
+		t.Fatalf("Invalid filtered labels %v", filtered)
+	}
+	if filtered := filterLabels(labels); !reflect.DeepEqual(filtered, labels) {
+		t.Fatalf("All labels should be kept when LB_ALLOWED_LABELS is not set %v", filtered)
+	}
+}
+
+type containerSelectorMetaFetcher struct {
+	tMetaFetcher
+}
+
+func (mf containerSelectorMetaFetcher) GetServices() ([]metadata.Service, error) {
+	return []metadata.Service{
+		{
+			Name:      "app",
+			StackName: "web",
+			Containers: []metadata.Container{
+				{UUID: "c2", Labels: map[string]string{"role": "frontend"}},
+				{UUID: "c1", Labels: map[string]string{"role": "frontend"}},
+				{UUID: "c3", Labels: map[string]string{"role": "worker"}},
+			},
+			Labels: map[string]string{"role": "frontend"},
+		},
+	}, nil
+}
+
+func TestContainerSelector(t *testing.T) {
+	c := &LoadBalancerController{MetaFetcher: containerSelectorMetaFetcher{}}
+	lbMeta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Selector: "container:role=frontend", TargetPort: 8080, BackendName: "frontend"},
+			{SourcePort: 81, Protocol: "http", Selector: "role=frontend", TargetPort: 8080},
+		},
+	}
+	if err := c.processSelector(lbMeta); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var containers []string
+	for _, rule := range lbMeta.PortRules {
+		if rule.SourcePort != 80 {
+			continue
+		}
+		if rule.Selector != "" || rule.Service != "" || rule.BackendName != "frontend" || rule.TargetPort != 8080 {
+			t.Fatalf("Invalid container rule %+v", rule)
+		}
+		containers = append(containers, rule.ContainerUUID)
+	}
+	if !reflect.DeepEqual(containers, []string{"c1", "c2"}) {
+		t.Fatalf("Invalid selected containers %v", containers)
+	}
+	if len(lbMeta.PortRules) != 3 || lbMeta.PortRules[2].Service != "web/app" {
+		t.Fatalf("Service selector should still match the service labels %+v", lbMeta.PortRules)
+	}
+}
+
+type sidekickMetaFetcher struct {
+	tMetaFetcher
+}
+
+func (mf sidekickMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	if strings.EqualFold(svcName, "nginx") {
+		return &metadata.Service{
+			Kind:               "service",
+			Name:               "nginx",
+			StackName:          "default",
+			PrimaryServiceName: "app",
+			Containers:         []metadata.Container{{PrimaryIp: "10.1.1.20", State: "running"}},
+		}, nil
+	}
+	return mf.tMetaFetcher.GetService(envUUID, svcName, stackName)
+}
+
+func TestSidekickRule(t *testing.T) {
+	if _, _, _, err := splitRuleService("default/app/nginx/extra"); err == nil {
+		t.Fatalf("Too many name parts should fail")
+	}
+	stack, svc, sidekick, err := splitRuleService("default/app/nginx")
+	if err != nil || stack != "default" || svc != "app" || sidekick != "nginx" {
+		t.Fatalf("Invalid split %v %v %v %v", stack, svc, sidekick, err)
+	}
+
+	c := &LoadBalancerController{MetaFetcher: sidekickMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{}}
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Service: "default/app/nginx", TargetPort: 8080},
+			{SourcePort: 81, Protocol: "http", Service: "default/other/nginx", TargetPort: 8080},
+		},
+	}
+	report := c.ValidateLBMetadata("test", "", meta)
+	if len(report.Issues) != 1 || report.Issues[0].Rule != 1 {
+		t.Fatalf("Sidekick of another service should not be found %v", report.Issues)
+	}
+	configs, err := c.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	fe := configs[0].FrontendServices[0]
+	if len(fe.BackendServices) != 1 || len(fe.BackendServices[0].Endpoints) != 1 || fe.BackendServices[0].Endpoints[0].IP != "10.1.1.20" {
+		t.Fatalf("Sidekick containers should be the endpoints %+v", fe.BackendServices)
+	}
+}
+
+func TestCheckPorts(t *testing.T) {
+	checkPorts, err := getCheckPorts(map[string]string{
+		"io.rancher.lb_service.check_port.api": "9000/http",
+		"io.rancher.lb_service.check_port.db":  "9001",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if *checkPorts["api"] != (CheckPort{Port: 9000, HTTP: true}) || *checkPorts["db"] != (CheckPort{Port: 9001}) {
+		t.Fatalf("Invalid check ports %+v", checkPorts)
+	}
+	for _, v := range []string{"0", "9000/udp", "http"} {
+		if _, err := getCheckPorts(map[string]string{"io.rancher.lb_service.check_port.api": v}); err == nil {
+			t.Fatalf("Invalid check port %s should fail", v)
+		}
+	}
+
+	shared := &config.HealthCheck{Port: 8080, Interval: 5000}
+	be := &config.BackendService{HealthCheck: shared}
+	applyCheckPort(be, checkPorts["api"])
+	if be.CheckPort != 9000 || be.HealthCheck.RequestLine != defaultCheckRequestLine || be.HealthCheck.Interval != 5000 {
+		t.Fatalf("Invalid backend check %+v %+v", be, be.HealthCheck)
+	}
+	if shared.RequestLine != "" {
+		t.Fatalf("Health check of the target should not be modified")
+	}
+	be = &config.BackendService{}
+	applyCheckPort(be, checkPorts["db"])
+	if be.CheckPort != 9001 || be.HealthCheck == nil || be.HealthCheck.RequestLine != "" {
+		t.Fatalf("Default health check should be added %+v", be.HealthCheck)
+	}
+}
+
+func TestHealthCheckPortLabel(t *testing.T) {
+	svc := &metadata.Service{
+		HealthCheck: metadata.HealthCheck{Port: 8080, Interval: 5000, ResponseTimeout: 2000, HealthyThreshold: 2, UnhealthyThreshold: 3, RequestLine: "GET /healthz HTTP/1.0"},
+		Labels:      map[string]string{healthCheckPortLabel: "9000"},
+	}
+	hc, err := getServiceHealthCheck(svc)
+	if err != nil || hc.Port != 9000 || hc.Interval != 5000 || hc.RequestLine != "GET /healthz HTTP/1.0" {
+		t.Fatalf("Health check port should be overridden %+v %v", hc, err)
+	}
+
+	c := &metadata.Container{Labels: map[string]string{healthCheckPortLabel: "9000"}}
+	if hc, err := getContainerHealthcheck(c); err != nil || hc.Port != 9000 || hc.Interval != 2000 {
+		t.Fatalf("Default health check should be added %+v %v", hc, err)
+	}
+	c.Labels[healthCheckPortLabel] = "admin"
+	if hc, err := getContainerHealthcheck(c); err != nil || hc.Port != 0 {
+		t.Fatalf("Invalid health check port should be ignored %+v %v", hc, err)
+	}
+}
+
+func TestCheckExpects(t *testing.T) {
+	expects, err := getCheckExpects(map[string]string{
+		"io.rancher.lb_service.check_expect.api":  `string:"status":"up"`,
+		"io.rancher.lb_service.check_expect.web":  "rstatus:^2",
+		"io.rancher.lb_service.check_expect.auth": "header:X-Health=ok",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if *expects["api"] != (config.HealthCheckExpect{Match: "string", Pattern: `"status":"up"`}) ||
+		*expects["web"] != (config.HealthCheckExpect{Match: "rstatus", Pattern: "^2"}) ||
+		*expects["auth"] != (config.HealthCheckExpect{Match: "header", Header: "X-Health", Pattern: "ok"}) {
+		t.Fatalf("Invalid check expects %+v", expects)
+	}
+	for _, v := range []string{"ok", "status:600", "rstring:(", "header:X Health=ok", "header:X-Health", "body:ok"} {
+		if _, err := getCheckExpects(map[string]string{"io.rancher.lb_service.check_expect.api": v}); err == nil {
+			t.Fatalf("Invalid check expect %s should fail", v)
+		}
+	}
+
+	shared := &config.HealthCheck{Port: 8080, Interval: 5000}
+	be := &config.BackendService{HealthCheck: shared}
+	applyCheckExpect(be, expects["api"])
+	if be.HealthCheck.Expect != expects["api"] || be.HealthCheck.RequestLine != defaultCheckRequestLine {
+		t.Fatalf("Invalid backend check %+v", be.HealthCheck)
+	}
+	if shared.Expect != nil || shared.RequestLine != "" {
+		t.Fatalf("Health check of the target should not be modified")
+	}
+	be = &config.BackendService{}
+	applyCheckExpect(be, expects["api"])
+	if be.HealthCheck != nil {
+		t.Fatalf("Backend without health check should be left unchecked %+v", be.HealthCheck)
+	}
+}
+
+func TestInitStates(t *testing.T) {
+	initStates, err := getInitStates(map[string]string{
+		"io.rancher.lb_service.init_state":     "down",
+		"io.rancher.lb_service.init_state.api": "down,slowstart=1m30s",
+		"io.rancher.lb_service.init_state.web": "up",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if *getInitState(initStates, "api") != (config.InitState{Down: true, SlowStartMs: 90000}) ||
+		*getInitState(initStates, "web") != (config.InitState{}) ||
+		*getInitState(initStates, "db") != (config.InitState{Down: true}) {
+		t.Fatalf("Invalid init states %+v", initStates)
+	}
+	for _, v := range []string{"drain", "slowstart=30", "slowstart=-1s"} {
+		if _, err := getInitStates(map[string]string{"io.rancher.lb_service.init_state.api": v}); err == nil {
+			t.Fatalf("Invalid init state %s should fail", v)
+		}
+	}
+
+	be := &config.BackendService{HealthCheck: &config.HealthCheck{Port: 8080, Interval: 2000}}
+	applyInitState(be, initStates["api"])
+	if be.InitState != initStates["api"] {
+		t.Fatalf("Init state should be set %+v", be.InitState)
+	}
+	be = &config.BackendService{}
+	applyInitState(be, initStates["api"])
+	if be.InitState != nil {
+		t.Fatalf("Backend without health check should start up %+v", be.InitState)
+	}
+}
+
+func TestAgentChecks(t *testing.T) {
+	agentChecks, err := getAgentChecks(map[string]string{
+		"io.rancher.lb_service.agent_check":     "port=9999",
+		"io.rancher.lb_service.agent_check.api": "port=9998, inter=5s",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if *getAgentCheck(agentChecks, "api") != (config.AgentCheck{Port: 9998, InterMs: 5000}) ||
+		*getAgentCheck(agentChecks, "web") != (config.AgentCheck{Port: 9999}) {
+		t.Fatalf("Invalid agent checks %+v", agentChecks)
+	}
+	for _, v := range []string{"inter=5s", "port=0", "port=9999,inter=5", "port=9999,send=up"} {
+		if _, err := getAgentChecks(map[string]string{"io.rancher.lb_service.agent_check.api": v}); err == nil {
+			t.Fatalf("Invalid agent check %s should fail", v)
+		}
+	}
+}
+
+type backupMetaFetcher struct {
+	tMetaFetcher
+}
+
+func (mf backupMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	switch svcName {
+	case "app":
+		return &metadata.Service{Kind: "service", Name: "app", StackName: "default", State: "active",
+			Containers: []metadata.Container{{PrimaryIp: "10.1.1.10", State: "running"}}}, nil
+	case "standby":
+		return &metadata.Service{Kind: "service", Name: "standby", StackName: "default", State: "active",
+			Containers: []metadata.Container{{PrimaryIp: "10.1.1.30", State: "running"}, {PrimaryIp: "10.1.1.10", State: "running"}}}, nil
+	}
+	return nil, nil
+}
+
+func TestBackupService(t *testing.T) {
+	if _, err := getBackupServices(map[string]string{"io.rancher.lb_service.backup_service.api": "standby"}); err == nil {
+		t.Fatalf("Backup service without stack should fail")
+	}
+	backups, err := getBackupServices(map[string]string{
+		"io.rancher.lb_service.backup_service.api": "default/standby",
+		"io.rancher.lb_service.backup_service.web": "default/missing",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	c := &LoadBalancerController{MetaFetcher: backupMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{}}
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Service: "default/app", TargetPort: 8080, BackendName: "api", Path: "/api"},
+			{SourcePort: 80, Protocol: "http", Service: "default/app", TargetPort: 8080, BackendName: "web", Path: "/web"},
+		},
+		BackupServices: backups,
+	}
+	configs, err := c.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, be := range configs[0].FrontendServices[0].BackendServices {
+		switch be.UUID {
+		case "api":
+			if len(be.Endpoints) != 2 || be.Endpoints[0].Backup || be.Endpoints[1].IP != "10.1.1.30" || !be.Endpoints[1].Backup {
+				t.Fatalf("Standby endpoints should be backups %+v", be.Endpoints)
+			}
+		case "web":
+			if len(be.Endpoints) != 1 || be.Endpoints[0].Backup {
+				t.Fatalf("Missing backup service should be ignored %+v", be.Endpoints)
+			}
+		}
+	}
+}
+
+func TestEndpointHolds(t *testing.T) {
+	h := &endpointHolds{}
+	now := time.Now()
+	eps := config.Endpoints{{Name: "ep1", IP: "10.1.1.1", Port: 8080}}
+	if held := h.hold("80/default/app", eps, false, time.Minute, now); len(held) != 1 || held[0].NoCheck {
+		t.Fatalf("Endpoints should be returned as they are %+v", held)
+	}
+	eps[0].Config = "check"
+	held := h.hold("80/default/app", nil, true, time.Minute, now.Add(30*time.Second))
+	if len(held) != 1 || !held[0].NoCheck || held[0].Config != "" || held[0].IP != "10.1.1.1" {
+		t.Fatalf("Last known endpoints should be held without check %+v", held)
+	}
+	if !h.serving(now.Add(30 * time.Second)) {
+		t.Fatalf("Held endpoints should be serving")
+	}
+	if held := h.hold("80/default/app", nil, true, time.Minute, now.Add(time.Minute)); len(held) != 0 {
+		t.Fatalf("Endpoints should not be held longer than the hold %+v", held)
+	}
+	if h.serving(now.Add(time.Minute)) {
+		t.Fatalf("Expired endpoints should not be serving")
+	}
+
+	// confirmed gone
+	h.hold("80/default/app", eps, false, time.Minute, now)
+	if held := h.hold("80/default/app", nil, false, time.Minute, now.Add(time.Second)); len(held) != 0 {
+		t.Fatalf("Endpoints confirmed gone should not be held %+v", held)
+	}
+
+	if !isEndpointsBlip(&metadata.Service{Kind: "service", Scale: 2}) ||
+		isEndpointsBlip(&metadata.Service{Kind: "service", Scale: 0}) ||
+		isEndpointsBlip(&metadata.Service{Kind: "service", Scale: 2, Containers: []metadata.Container{{State: "stopped"}}}) ||
+		isEndpointsBlip(&metadata.Service{Kind: "externalService", Scale: 1}) {
+		t.Fatalf("Unexpected blip detection")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	r := &readiness{}
+	now := time.Now()
+	r.start(now)
+	if r.holdFirstApply(1, 0, now) {
+		t.Fatalf("First config should not be held back without timeout")
+	}
+	if !r.holdFirstApply(1, time.Minute, now.Add(30*time.Second)) {
+		t.Fatalf("First config missing rules should be held back")
+	}
+	if r.holdFirstApply(1, time.Minute, now.Add(time.Minute)) {
+		t.Fatalf("First config should be applied after the timeout")
+	}
+	if r.holdFirstApply(0, time.Minute, now) {
+		t.Fatalf("Full config should not be held back")
+	}
+	if r.isReady() {
+		t.Fatalf("Should not be ready before the initial sync")
+	}
+	r.synced()
+	if !r.isReady() || r.holdFirstApply(1, time.Minute, now) {
+		t.Fatalf("Should be ready after the initial sync, and apply the configs missing rules")
+	}
+}
+
+type versionClient struct {
+	metadata.Client
+	failures int
+}
+
+func (c *versionClient) GetVersion() (string, error) {
+	if c.failures > 0 {
+		c.failures--
+		return "", fmt.Errorf("connection refused")
+	}
+	return "1", nil
+}
+
+func TestWaitForMetadata(t *testing.T) {
+	var sleeps []time.Duration
+	sleep := func(d time.Duration) { sleeps = append(sleeps, d) }
+	if err := waitForMetadata(&versionClient{failures: 7}, 0, sleep); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(sleeps) != 7 || sleeps[1] != 2*time.Second || sleeps[6] != maxMetadataBackoff {
+		t.Fatalf("Unexpected backoffs %v", sleeps)
+	}
+	if err := waitForMetadata(&versionClient{failures: 10}, time.Nanosecond, sleep); err == nil {
+		t.Fatalf("Expected the wait to time out")
+	}
+}
+
+type selfServiceClient struct {
+	versionClient
+}
+
+func (c *selfServiceClient) GetSelfService() (metadata.Service, error) {
+	return metadata.Service{Name: "lb", Labels: map[string]string{"io.rancher.lb_service.cert_dir": "/certs"}}, nil
+}
+
+func newTestInitConfig(metadataClient metadata.Client) *Config {
+	return &Config{
+		CattleURL: "http://cattle",
+		ReadCredentials: func() (*cattle.Credentials, error) {
+			return &cattle.Credentials{AccessKey: "key", SecretKey: "secret"}, nil
+		},
+		CertFileName:    "fullchain.pem",
+		KeyFileName:     "privkey.pem",
+		StartupPolicy:   startupPolicyExit,
+		StartupTimeout:  time.Minute,
+		StartupExitCode: 3,
+		NewCattleClient: func(url string, readCredentials func() (*cattle.Credentials, error)) (*cattle.Client, error) {
+			if _, err := readCredentials(); err != nil {
+				return nil, err
+			}
+			return cattle.NewClient(nil), nil
+		},
+		NewMetadataClient: func(url string) metadata.Client { return metadataClient },
+		Sleep:             func(time.Duration) {},
+		Exit:              func(int) {},
+	}
+}
+
+func TestInitWithConfig(t *testing.T) {
+	c := &LoadBalancerController{}
+	if err := c.InitWithConfig(newTestInitConfig(&selfServiceClient{})); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	fetcher, ok := c.CertFetcher.(*RCertificateFetcher)
+	if !ok || fetcher.CertDir != "/certs" || fetcher.CertName != "fullchain.pem" || fetcher.Client == nil {
+		t.Fatalf("Cert fetcher should be set up from the config and the labels %+v", c.CertFetcher)
+	}
+
+	cfg := newTestInitConfig(&selfServiceClient{versionClient{failures: 100}})
+	cfg.StartupTimeout = time.Nanosecond
+	exitCode := 0
+	cfg.Exit = func(code int) { exitCode = code }
+	if err := (&LoadBalancerController{}).InitWithConfig(cfg); err == nil || exitCode != 3 {
+		t.Fatalf("Expected to exit with code 3, got %v %v", exitCode, err)
+	}
+
+	cfg = newTestInitConfig(&selfServiceClient{versionClient{failures: 100}})
+	cfg.StartupPolicy = startupPolicyLastConfig
+	cfg.StartupTimeout = time.Nanosecond
+	c = &LoadBalancerController{}
+	if err := c.InitWithConfig(cfg); err != nil || c.CertFetcher != nil || c.metadataClient == nil {
+		t.Fatalf("Init should complete in Run with the last-config policy %v", err)
+	}
+
+	cfg = newTestInitConfig(&selfServiceClient{})
+	cfg.ReadCredentials = func() (*cattle.Credentials, error) { return nil, fmt.Errorf("no credentials") }
+	if err := (&LoadBalancerController{}).InitWithConfig(cfg); err == nil {
+		t.Fatalf("Expected the missing credentials to fail the init")
+	}
+	cfg.CattleURL = ""
+	if err := (&LoadBalancerController{}).InitWithConfig(cfg); err == nil {
+		t.Fatalf("Expected the missing CATTLE_URL to fail the init")
+	}
+}
+
+// applyProvider reports the applied configs on a channel
+type applyProvider struct {
+	tProvider
+	applied chan *config.LoadBalancerConfig
+}
+
+func (p *applyProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	p.applied <- lbConfig
+	return nil
+}
+
+func waitForEndpoints(t *testing.T, p *applyProvider, count int) {
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case lbConfig := <-p.applied:
+			if len(lbConfig.FrontendServices) == 1 && len(lbConfig.FrontendServices[0].BackendServices[0].Endpoints) == count {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Config with %v endpoints was not applied", count)
+		}
+	}
+}
+
+func TestMetadataServerSync(t *testing.T) {
+	srv := metadatatest.NewServer(&metadatatest.State{
+		SelfService: metadata.Service{
+			Name:      "lb",
+			StackName: "default",
+			Kind:      "loadBalancerService",
+			LBConfig: metadata.LBConfig{
+				PortRules: []metadata.PortRule{
+					{SourcePort: 80, Protocol: "http", Service: "default/web", TargetPort: 8080},
+				},
+			},
+		},
+		SelfHost: metadata.Host{UUID: "host"},
+		Services: []metadata.Service{
+			{
+				Name:       "web",
+				StackName:  "default",
+				Kind:       "service",
+				State:      "active",
+				Containers: []metadata.Container{{PrimaryIp: "10.42.0.10", State: "running"}},
+			},
+		},
+	})
+	defer srv.Close()
+
+	c, _ := NewLoadBalancerController()
+	c.MetaFetcher = RMetaFetcher{MetadataClient: metadata.NewClient(srv.URL)}
+	c.CertFetcher = tCertFetcher{}
+	p := &applyProvider{applied: make(chan *config.LoadBalancerConfig, 10)}
+	go c.Run(p)
+	defer c.Stop()
+
+	waitForEndpoints(t, p, 1)
+	srv.Update(func(state *metadatatest.State) {
+		web := &state.Services[0]
+		web.Containers = append(web.Containers, metadata.Container{PrimaryIp: "10.42.0.11", State: "running"})
+	})
+	waitForEndpoints(t, p, 2)
+}
+
+func TestBackendIdentity(t *testing.T) {
+	if _, err := getBackendIdentity(map[string]string{backendIdentityLabel: "host"}); err == nil {
+		t.Fatalf("Invalid backend identity should fail")
+	}
+	identity, err := getBackendIdentity(map[string]string{backendIdentityLabel: "service"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	build := func(path string) []*config.BackendService {
+		meta := &LBMetadata{
+			PortRules: []metadata.PortRule{
+				{SourcePort: 80, Protocol: "http", Service: "default/foo", TargetPort: 80, Hostname: "foo.com", Path: path},
+				{SourcePort: 80, Protocol: "http", Service: "default/foo", TargetPort: 80, Hostname: "bar.com"},
+				{SourcePort: 80, Protocol: "http", Service: "default/bar", TargetPort: 80, BackendName: "bar"},
+			},
+			BackendIdentity: identity,
+		}
+		configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		return configs[0].FrontendServices[0].BackendServices
+	}
+	uuids := map[string]string{}
+	for _, be := range build("/api") {
+		uuids[be.Host+be.Path] = be.UUID
+	}
+	expected := map[string]string{"foo.com/api": "80_default_foo", "bar.com": "80_default_foo_2", "": "bar"}
+	if !reflect.DeepEqual(uuids, expected) {
+		t.Fatalf("Invalid backend uuids %v", uuids)
+	}
+	for _, be := range build("/v2/api") {
+		if be.Host == "foo.com" && be.UUID != "80_default_foo" {
+			t.Fatalf("Backend uuid should be kept across path edits, got %s", be.UUID)
+		}
+	}
+}
+
+func TestHostSelectors(t *testing.T) {
+	if _, err := getHostSelectors(map[string]string{"io.rancher.lb_service.host_selector.edge": "zone=a"}); err == nil {
+		t.Fatalf("Host selector without source port should fail")
+	}
+	if _, err := getHostSelectors(map[string]string{"io.rancher.lb_service.host_selector.443": " "}); err == nil {
+		t.Fatalf("Empty host selector should fail")
+	}
+	selectors, err := getHostSelectors(map[string]string{
+		"io.rancher.lb_service.host_selector.443":  "zone=a",
+		"io.rancher.lb_service.host_selector.8443": "zone!=a",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 443, Protocol: "http", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 8443, Protocol: "http", Service: "default/foo", TargetPort: 80},
+		},
+		HostSelectors: selectors,
+	}
+	// the lb host is in zone a
+	if err := lbc.processHostSelectors(meta); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ports := []int{}
+	for _, rule := range meta.PortRules {
+		ports = append(ports, rule.SourcePort)
+	}
+	if !reflect.DeepEqual(ports, []int{80, 443}) {
+		t.Fatalf("Invalid rules left for the lb host %v", ports)
+	}
+}
+
+func TestConfigCache(t *testing.T) {
+	srv := metadatatest.NewServer(&metadatatest.State{
+		SelfService: metadata.Service{
+			Name:      "lb",
+			StackName: "default",
+			Kind:      "loadBalancerService",
+			LBConfig: metadata.LBConfig{
+				PortRules: []metadata.PortRule{
+					{SourcePort: 80, Protocol: "http", Service: "default/web", TargetPort: 8080},
+				},
+			},
+		},
+		SelfHost: metadata.Host{UUID: "host"},
+		Services: []metadata.Service{
+			{
+				Name:       "web",
+				StackName:  "default",
+				Kind:       "service",
+				State:      "active",
+				Containers: []metadata.Container{{PrimaryIp: "10.42.0.10", State: "running"}},
+			},
+		},
+	})
+	defer srv.Close()
+
+	c, _ := NewLoadBalancerController()
+	c.MetaFetcher = RMetaFetcher{MetadataClient: metadata.NewClient(srv.URL)}
+	c.CertFetcher = tCertFetcher{}
+	p := &applyProvider{applied: make(chan *config.LoadBalancerConfig, 10)}
+	c.LBProvider = p
+
+	c.sync("")
+	c.sync("")
+	c.sync("")
+	if len(p.applied) != 1 {
+		t.Fatalf("The config of an unchanged metadata version should apply once, applied %v times", len(p.applied))
+	}
+	first := <-p.applied
+	if cfgs, err := c.GetLBConfigs(); err != nil || len(cfgs) != 1 || cfgs[0] != first {
+		t.Fatalf("The cached config should be returned %v", err)
+	}
+
+	srv.Update(func(state *metadatatest.State) {
+		web := &state.Services[0]
+		web.Containers = append(web.Containers, metadata.Container{PrimaryIp: "10.42.0.11", State: "running"})
+	})
+	c.sync("")
+	c.sync("")
+	if len(p.applied) != 1 {
+		t.Fatalf("The config of a new metadata version should apply once, applied %v times", len(p.applied))
+	}
+	if lbConfig := <-p.applied; len(lbConfig.FrontendServices[0].BackendServices[0].Endpoints) != 2 {
+		t.Fatalf("The config should be rebuilt from the new metadata version")
+	}
+
+	// the updates outside of the metadata invalidate the cache
+	c.ScheduleApplyConfig("")
+	c.sync("")
+	if len(p.applied) != 1 {
+		t.Fatalf("The config should apply again once invalidated, applied %v times", len(p.applied))
+	}
+}
+
+func TestLuaHooks(t *testing.T) {
+	labels := map[string]string{
+		luaFrontendLabelPrefix + "45": "request_id.lua:add_request_id, auth.lua:check_token",
+		luaFrontendLabelPrefix + "46": "sni.lua:inspect",
+		luaBackendLabelPrefix + "api": "rewrite.lua:rewrite_path",
+	}
+	frontendHooks, err := getFrontendLuaHooks(labels)
+	if err != nil {
+		t.Fatalf("Failed to parse the frontend lua labels %v", err)
+	}
+	backendHooks, err := getBackendLuaHooks(labels)
+	if err != nil {
+		t.Fatalf("Failed to parse the backend lua labels %v", err)
+	}
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{
+				SourcePort:  45,
+				Protocol:    "http",
+				Hostname:    "api.com",
+				Service:     "default/foo",
+				TargetPort:  44,
+				BackendName: "api",
+			},
+			{
+				SourcePort: 45,
+				Protocol:   "http",
+				Hostname:   "web.com",
+				Service:    "default/foo",
+				TargetPort: 44,
+			},
+			{
+				SourcePort: 46,
+				Protocol:   "sni",
+				Service:    "default/foo",
+				TargetPort: 44,
+			},
+		},
+		FrontendLuaHooks: frontendHooks,
+		BackendLuaHooks:  backendHooks,
+	}
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	for _, fe := range configs[0].FrontendServices {
+		if fe.Port == 46 {
+			if len(fe.LuaHooks) != 0 {
+				t.Fatalf("Lua actions should be ignored on sni ports, got %v", fe.LuaHooks)
+			}
+			continue
+		}
+		expected := []*config.LuaHook{{Script: "request_id.lua", Action: "add_request_id"}, {Script: "auth.lua", Action: "check_token"}}
+		if !reflect.DeepEqual(fe.LuaHooks, expected) {
+			t.Fatalf("Invalid lua actions of frontend %s %v", fe.Name, fe.LuaHooks)
+		}
+		for _, be := range fe.BackendServices {
+			if be.UUID == "api" && (len(be.LuaHooks) != 1 || be.LuaHooks[0].Action != "rewrite_path") {
+				t.Fatalf("Invalid lua actions of backend api %v", be.LuaHooks)
+			} else if be.UUID != "api" && len(be.LuaHooks) != 0 {
+				t.Fatalf("Backend %s should have no lua actions %v", be.UUID, be.LuaHooks)
+			}
+		}
+	}
+
+	for _, value := range []string{"auth.lua", "../auth.lua:check", "auth.sh:check", "auth.lua:check token"} {
+		if _, err := getBackendLuaHooks(map[string]string{luaBackendLabelPrefix + "api": value}); err == nil {
+			t.Fatalf("Invalid lua action %s is not reported", value)
+		}
+	}
+	if _, err := getFrontendLuaHooks(map[string]string{luaFrontendLabelPrefix + "http": "auth.lua:check"}); err == nil {
+		t.Fatalf("Invalid source port should be reported")
+	}
+}
+
+func TestSPOEngines(t *testing.T) {
+	engines, err := getSPOEngines(map[string]string{
+		spoeLabelPrefix + "auth.agents":                "10.42.0.5:12345, 10.42.0.6:12345",
+		spoeLabelPrefix + "auth.timeout":               "200ms",
+		spoeLabelPrefix + "auth.message.check-request": "on-frontend-http-request:ip=src path=path",
+		spoeLabelPrefix + "waf.agents":                 "waf:9000",
+		spoeLabelPrefix + "waf.ports":                  "45,46",
+		spoeLabelPrefix + "waf.message.scan":           "on-backend-http-request:body=req.body",
+		spoeLabelPrefix + "waf.message.log":            "on-http-response",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse the spoe labels %v", err)
+	}
+	if len(engines) != 2 || engines[0].Engine.Name != "auth" || engines[0].Engine.TimeoutMs != 200 ||
+		len(engines[0].Engine.Agents) != 2 || engines[0].Engine.Agents[1] != "10.42.0.6:12345" {
+		t.Fatalf("Invalid spoe engines %+v", engines)
+	}
+	expected := []*config.SPOMessage{
+		{Name: "log", Event: "on-http-response"},
+		{Name: "scan", Event: "on-backend-http-request", Args: []string{"body=req.body"}},
+	}
+	if !reflect.DeepEqual(engines[1].Engine.Messages, expected) {
+		t.Fatalf("Invalid spoe messages %v", engines[1].Engine.Messages)
+	}
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 45, Protocol: "http", Service: "default/foo", TargetPort: 44},
+			{SourcePort: 46, Protocol: "tcp", Service: "default/foo", TargetPort: 44},
+			{SourcePort: 47, Protocol: "http", Service: "default/foo", TargetPort: 44},
+		},
+		SPOEngines: engines[1:],
+	}
+	configs, err := lbc.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Failed to build the config from metadata %v", err)
+	}
+	for _, fe := range configs[0].FrontendServices {
+		if fe.Port == 45 && !reflect.DeepEqual(fe.SPOEngines, []string{"waf"}) {
+			t.Fatalf("The waf engine should filter port 45, got %v", fe.SPOEngines)
+		} else if fe.Port != 45 && len(fe.SPOEngines) != 0 {
+			t.Fatalf("Port %v should not be filtered, got %v", fe.Port, fe.SPOEngines)
+		}
+	}
+	if len(configs[0].SPOEngines) != 1 || configs[0].SPOEngines[0].Name != "waf" {
+		t.Fatalf("The used engines should be in the config, got %v", configs[0].SPOEngines)
+	}
+
+	for _, labels := range []map[string]string{
+		{spoeLabelPrefix + "auth.message.check": "on-frontend-http-request"},
+		{spoeLabelPrefix + "auth.agents": "10.42.0.5:12345"},
+		{spoeLabelPrefix + "auth.agents": "10.42.0.5", spoeLabelPrefix + "auth.message.check": "on-frontend-http-request"},
+		{spoeLabelPrefix + "auth.agents": "10.42.0.5:1", spoeLabelPrefix + "auth.message.check": "on-request"},
+		{spoeLabelPrefix + "auth.agents": "10.42.0.5:1", spoeLabelPrefix + "auth.message.check": "on-http-response:src"},
+		{spoeLabelPrefix + "auth.agents": "10.42.0.5:1", spoeLabelPrefix + "auth.retries": "3"},
+	} {
+		if _, err := getSPOEngines(labels); err == nil {
+			t.Fatalf("Invalid spoe labels %v are not reported", labels)
+		}
+	}
+}
+
+type remoteMetaFetcher struct {
+	tMetaFetcher
+}
+
+func (mf remoteMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	if envUUID != "1a5" || svcName != "api" {
+		return mf.tMetaFetcher.GetService(envUUID, svcName, stackName)
+	}
+	return &metadata.Service{Kind: "service", Name: "api", StackName: "shared", State: "active",
+		HealthCheck: metadata.HealthCheck{Port: 8080, Interval: 2000, HealthyThreshold: 2, UnhealthyThreshold: 3, ResponseTimeout: 2000},
+		Containers: []metadata.Container{
+			{PrimaryIp: "10.2.1.1", State: "running"},
+			{PrimaryIp: "10.2.1.2", State: "stopping"},
+			{PrimaryIp: "10.2.1.3", State: "stopped"},
+		}}, nil
+}
+
+func TestRemoteTargets(t *testing.T) {
+	if _, err := getRemoteTargets(map[string]string{"io.rancher.lb_service.remote_target.api": "shared/api"}); err == nil {
+		t.Fatalf("Remote target without environment should fail")
+	}
+	targets, err := getRemoteTargets(map[string]string{"io.rancher.lb_service.remote_target.api": "1a5/shared/api"})
+	if err != nil || targets["api"] == nil || targets["api"].String() != "1a5/shared/api" {
+		t.Fatalf("Unexpected remote targets %v %v", targets, err)
+	}
+
+	c := &LoadBalancerController{MetaFetcher: remoteMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{}}
+	rules := []metadata.PortRule{
+		{SourcePort: 80, Protocol: "http", TargetPort: 8080, BackendName: "api", Path: "/api"},
+		{SourcePort: 80, Protocol: "http", Service: "default/foo", TargetPort: 80, BackendName: "web"},
+	}
+	// the other environments have to be allowed explicitly
+	meta := &LBMetadata{PortRules: rules, RemoteTargets: targets}
+	configs, err := c.BuildConfigFromMetadata("test", "1a1", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if bes := configs[0].FrontendServices[0].BackendServices; len(bes) != 1 || bes[0].UUID != "web" {
+		t.Fatalf("Remote target should be skipped without allowlist %+v", bes)
+	}
+
+	meta = &LBMetadata{PortRules: rules, RemoteTargets: targets,
+		TargetScope: &TargetScope{AllowedEnvironments: []string{"1a1", "1a5"}}}
+	configs, err = c.BuildConfigFromMetadata("test", "1a1", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var api *config.BackendService
+	for _, be := range configs[0].FrontendServices[0].BackendServices {
+		if be.UUID == "api" {
+			api = be
+		}
+	}
+	if api == nil || api.Environment != "1a5" || api.HealthCheck == nil || api.HealthCheck.Port != 8080 {
+		t.Fatalf("Remote backend should be built with its health check %+v", api)
+	}
+	drained := map[string]bool{}
+	for _, ep := range api.Endpoints {
+		drained[ep.IP] = ep.Drain
+	}
+	if len(api.Endpoints) != 2 || drained["10.2.1.1"] || !drained["10.2.1.2"] {
+		t.Fatalf("Stopping remote containers should be drained %v", drained)
+	}
+}
+
+func TestRuleExpansions(t *testing.T) {
+	c := &LoadBalancerController{MetaFetcher: tMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{}}
+	if c.GetRuleExpansions() != nil {
+		t.Fatalf("Nothing should be reported before the rules are expanded")
+	}
+	state := &SyncState{
+		LBService: metadata.Service{Name: "lb"},
+		LBMeta: &LBMetadata{
+			PortRules: []metadata.PortRule{
+				{SourcePort: 80, Protocol: "http", Service: "default/foo", TargetPort: 80},
+				{SourcePort: 45, Protocol: "http", Selector: "foo=bar"},
+				{SourcePort: 46, Protocol: "http", Selector: "a=b"},
+				{SourcePort: 47, Protocol: "http", Selector: "a=b", TargetPort: 70000},
+			},
+		},
+	}
+	stages := []Stage{
+		{Name: StageSelectors, Run: selectorsStage},
+		{Name: StageValidate, Run: validateStage},
+	}
+	if err := c.runStages(state, stages); err != nil {
+		t.Fatalf("Failed to run stages %v", err)
+	}
+	report, ok := c.GetRuleExpansions().(*ExpansionReport)
+	if !ok || report.LBName != "lb" || len(report.Expansions) != 3 {
+		t.Fatalf("Selector rules should be reported %+v", report)
+	}
+	baz := report.Expansions[0]
+	if len(baz.Matched) != 1 || baz.Matched[0] != "default/baz" || len(baz.Rules) != 1 ||
+		baz.Rules[0].Rule != 1 || baz.Rules[0].Hostname != "baz.com" || len(baz.Skipped) != 0 {
+		t.Fatalf("Unexpected expansion %+v", baz)
+	}
+	noPort := report.Expansions[1]
+	if len(noPort.Matched) != 1 || len(noPort.Rules) != 0 || len(noPort.Skipped) != 1 ||
+		noPort.Skipped[0].Target != "b/a" || noPort.Skipped[0].Rule != -1 {
+		t.Fatalf("Service without target port should be skipped %+v", noPort)
+	}
+	invalid := report.Expansions[2]
+	if len(invalid.Rules) != 1 || len(invalid.Skipped) != 1 || invalid.Skipped[0].Rule != invalid.Rules[0].Rule ||
+		!strings.Contains(invalid.Skipped[0].Reason, "target_port") {
+		t.Fatalf("Invalid synthesized rule should be skipped %+v", invalid)
+	}
+}
+
+func TestServiceIndex(t *testing.T) {
+	fetches := 0
+	fetch := func() ([]metadata.Service, error) {
+		fetches++
+		return []metadata.Service{
+			{Name: "web", StackName: "b", Labels: map[string]string{"Tier": "front", "team": "a"}},
+			{Name: "api", StackName: "b", Labels: map[string]string{"tier": "back", "team": "a"}},
+			{Name: "web", StackName: "a", Labels: map[string]string{"tier": "front"}},
+			{Name: "db", StackName: "a"},
+		}, nil
+	}
+	c := &serviceIndexCache{}
+	index, err := c.get("1", fetch)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if again, _ := c.get("1", fetch); again != index || fetches != 1 {
+		t.Fatalf("The index of an unchanged version should be reused, fetched %v times", fetches)
+	}
+	if c.get("2", fetch); fetches != 2 {
+		t.Fatalf("The services should be loaded again for a new version")
+	}
+	c.get("", fetch)
+	c.get("", fetch)
+	if fetches != 4 {
+		t.Fatalf("The services should be loaded on every sync without version, fetched %v times", fetches)
+	}
+
+	names := func(svcs []metadata.Service) []string {
+		var names []string
+		for _, svc := range svcs {
+			names = append(names, svc.StackName+"/"+svc.Name)
+		}
+		return names
+	}
+	if matched := names(index.match("tier=front")); !reflect.DeepEqual(matched, []string{"a/web", "b/web"}) {
+		t.Fatalf("Unexpected matches %v", matched)
+	}
+	if matched := names(index.match("team=a,tier=back")); !reflect.DeepEqual(matched, []string{"b/api"}) {
+		t.Fatalf("Unexpected matches %v", matched)
+	}
+	if matched := index.match("missing=x"); len(matched) != 0 {
+		t.Fatalf("Unexpected matches %v", names(matched))
+	}
+}
+
+func TestLabelIndexCandidates(t *testing.T) {
+	index := newServiceIndex("", []metadata.Service{
+		{Name: "web", StackName: "a", Labels: map[string]string{"tier": "front", "team": "a"},
+			Containers: []metadata.Container{{UUID: "c1", Labels: map[string]string{"role": "web"}}}},
+		{Name: "api", StackName: "a", Labels: map[string]string{"Tier": "back", "team": "a"},
+			Containers: []metadata.Container{{UUID: "c2", Labels: map[string]string{"role": "api"}}, {UUID: "c3"}}},
+		{Name: "db", StackName: "a", Labels: map[string]string{"tier": "data"}},
+	})
+	if candidates, ok := index.serviceLabels.candidates("team=a,tier=back"); !ok || !reflect.DeepEqual(candidates, []int{0}) {
+		t.Fatalf("The least used label should be looked up, got %v", candidates)
+	}
+	if candidates, ok := index.serviceLabels.candidates("TEAM=A"); !ok || !reflect.DeepEqual(candidates, []int{0, 2}) {
+		t.Fatalf("Labels should be looked up case insensitively, got %v", candidates)
+	}
+	if containers := index.matchContainers("role=API"); len(containers) != 1 || containers[0].UUID != "c2" {
+		t.Fatalf("Unexpected containers %+v", containers)
+	}
+}
+
+func TestSelectorMatcher(t *testing.T) {
+	c := &LoadBalancerController{MetaFetcher: tMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{}}
+	byName := SelectorMatcherFunc(func(selector string, svcs []metadata.Service) ([]metadata.Service, error) {
+		if selector == "broken" {
+			return nil, fmt.Errorf("ownership records unavailable")
+		}
+		var matched []metadata.Service
+		for _, svc := range svcs {
+			if svc.Name == selector {
+				matched = append(matched, svc)
+			}
+		}
+		return matched, nil
+	})
+	if err := c.RegisterSelectorMatcher("container:", byName); err == nil {
+		t.Fatalf("Container selector prefix should be reserved")
+	}
+	if err := c.RegisterSelectorMatcher("name", byName); err == nil {
+		t.Fatalf("Prefix without colon should fail")
+	}
+	if err := c.RegisterSelectorMatcher("name:", byName); err != nil {
+		t.Fatalf("Failed to register matcher %v", err)
+	}
+	if err := c.RegisterSelectorMatcher("name:", byName); err == nil {
+		t.Fatalf("Duplicate matcher should fail to register")
+	}
+
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 45, Protocol: "http", Selector: "name:a", TargetPort: 46},
+			{SourcePort: 46, Protocol: "http", Selector: "name:broken", TargetPort: 46},
+		},
+	}
+	if err := c.processSelector(meta); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(meta.PortRules) != 1 || meta.PortRules[0].Service != "b/a" || meta.PortRules[0].SourcePort != 45 {
+		t.Fatalf("Matched services should be expanded %+v", meta.PortRules)
+	}
+	if skipped := meta.Expansions[1].Skipped; len(skipped) != 1 || !strings.Contains(skipped[0].Reason, "ownership") {
+		t.Fatalf("Failed matcher should be reported %+v", skipped)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	c := &LoadBalancerController{syncQueue: utils.NewTaskQueue(func(string) {})}
+	if err := c.SetRequestLogging("api", 48*time.Hour, 10); err == nil {
+		t.Fatalf("Logging longer than a day should fail")
+	}
+	if err := c.SetRequestLogging("api", time.Minute, -1); err == nil {
+		t.Fatalf("Negative sample rate should fail")
+	}
+	if err := c.SetRequestLogging("api", time.Minute, 0); err != nil {
+		t.Fatalf("Failed to set request logging %v", err)
+	}
+	loggings := c.GetRequestLogging()
+	if loggings["api"] == nil || loggings["api"].SampleRate != 1 {
+		t.Fatalf("All the requests should be logged without sample rate %+v", loggings)
+	}
+	if getRequestLogging(loggings, "api", config.TCPProto) != nil || getRequestLogging(loggings, "api", config.HTTPProto) == nil {
+		t.Fatalf("Requests should only be logged for http backends")
+	}
+	if len(c.requestLoggings.get(time.Now().Add(2*time.Minute))) != 0 || len(c.GetRequestLogging()) != 0 {
+		t.Fatalf("Expired request logging should be dropped")
+	}
+	c.SetRequestLogging("api", time.Minute, 5)
+	c.SetRequestLogging("api", 0, 0)
+	if len(c.GetRequestLogging()) != 0 {
+		t.Fatalf("Request logging should be turned off")
+	}
+}
+
+func TestMetricsTags(t *testing.T) {
+	if _, err := getMetricsTags(map[string]string{"io.rancher.lb_service.metrics_tag.web": "team a"}); err == nil {
+		t.Fatalf("Metrics tag with a space should fail")
+	}
+	tags, err := getMetricsTags(map[string]string{"io.rancher.lb_service.metrics_tag.web": "payments"})
+	if err != nil || tags["web"] != "payments" {
+		t.Fatalf("Unexpected metrics tags %v %v", tags, err)
+	}
+	serviceLabels := map[string]string{"io.rancher.lb_service.metrics_tag": "checkout"}
+	if tag := getMetricsTag(tags, "web", serviceLabels); tag != "payments" {
+		t.Fatalf("The tag of the lb should win over the one of the service, got %s", tag)
+	}
+	if tag := getMetricsTag(tags, "api", serviceLabels); tag != "checkout" {
+		t.Fatalf("The backend should be tagged by its service, got %s", tag)
+	}
+	if tag := getMetricsTag(tags, "api", map[string]string{"io.rancher.lb_service.metrics_tag": "a/b"}); tag != "" {
+		t.Fatalf("Invalid tag of the service should be skipped, got %s", tag)
+	}
+
+	c := &LoadBalancerController{MetaFetcher: tMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{}}
+	meta := &LBMetadata{
+		PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Service: "default/foo", TargetPort: 80, BackendName: "web"},
+		},
+		MetricsTags: tags,
+	}
+	configs, err := c.BuildConfigFromMetadata("test", "", "", "any", meta)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if be := configs[0].FrontendServices[0].BackendServices[0]; be.MetricsTag != "payments" {
+		t.Fatalf("Backend should be tagged %+v", be)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	c := &LoadBalancerController{MetaFetcher: tMetaFetcher{}, CertFetcher: tCertFetcher{}, LBProvider: &tProvider{},
+		syncQueue: utils.NewTaskQueue(func(string) {}), incrementalBackoff: 10}
+	state := &SyncState{Configs: []*config.LoadBalancerConfig{{
+		Name:        "lb",
+		DefaultCert: &config.Certificate{Name: "default", Key: "secret"},
+		Certs:       []*config.Certificate{{Name: "a.com", Key: "secret"}},
+	}}}
+	ruleErrors := []*RuleError{{SourcePort: 80, Target: "default/foo", Err: fmt.Errorf("no target port")}}
+	c.lastSync.set(time.Now(), state, nil, ruleErrors, true)
+	c.faults.set("web", &config.Fault{DelayPercent: 10, DelayMs: 1000, Until: time.Now().Add(time.Minute)})
+
+	dump, ok := c.DumpState().(*StateDump)
+	if !ok || dump.LastSync == nil || !dump.LastSync.Requeued || dump.BackoffSeconds != 10 {
+		t.Fatalf("Unexpected state dump %+v", dump)
+	}
+	if len(dump.LastSync.RuleErrors) != 1 || !strings.Contains(dump.LastSync.RuleErrors[0], "no target port") {
+		t.Fatalf("Rule errors should be dumped %v", dump.LastSync.RuleErrors)
+	}
+	if cfg := dump.LastSync.Configs[0]; cfg.Name != "lb" || cfg.DefaultCert != nil || cfg.Certs != nil {
+		t.Fatalf("Certificates should be stripped from the dumped configs %+v", cfg)
+	}
+	if state.Configs[0].DefaultCert == nil || len(state.Configs[0].Certs) != 1 {
+		t.Fatalf("Built configs shouldn't be changed by the dump")
+	}
+	if dump.Faults["web"] == nil {
+		t.Fatalf("Faults should be dumped %v", dump.Faults)
+	}
+	if _, err := json.Marshal(dump); err != nil {
+		t.Fatalf("State dump should be json encodable: %v", err)
+	}
+
+	cert := generateTestCert(t, "a.com", "a.com", config.RSAKeyType)
+	if summary := summarizeCertificate("a.com", cert); summary.NotAfter.IsZero() {
+		t.Fatalf("Certificate summary should have its expiry %+v", summary)
+	}
+}
+
+func TestResync(t *testing.T) {
+	c := &LoadBalancerController{MetaFetcher: tMetaFetcher{}, syncQueue: utils.NewTaskQueue(func(string) {}), incrementalBackoff: 15}
+	c.configCache.set("1", 0, []*config.LoadBalancerConfig{{Name: "lb"}}, nil)
+	if _, err := c.serviceIndex.get("1", func() ([]metadata.Service, error) { return nil, nil }); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	c.Resync()
+	if c.incrementalBackoff != 0 {
+		t.Fatalf("Resync should reset the backoff, got %v", c.incrementalBackoff)
+	}
+	if _, _, ok := c.configCache.get("1"); ok {
+		t.Fatalf("Resync should drop the cached configs")
+	}
+	if c.serviceIndex.index != nil {
+		t.Fatalf("Resync should drop the service index")
+	}
+	if c.GetQueueDepth() != 1 {
+		t.Fatalf("Resync should queue a sync, got %v", c.GetQueueDepth())
+	}
+}
+
+type snapshotTestFetcher struct {
+	tMetaFetcher
+}
+
+func (mf snapshotTestFetcher) GetSelfService() (metadata.Service, error) {
+	return metadata.Service{
+		Name:            "lb",
+		EnvironmentUUID: "env",
+		LBConfig: metadata.LBConfig{PortRules: []metadata.PortRule{
+			{SourcePort: 80, Protocol: "http", Hostname: "foo.com", Service: "default/foo", TargetPort: 80},
+			{SourcePort: 80, Protocol: "http", Hostname: "alias.com", Service: "default/alias", TargetPort: 81},
+		}},
+	}, nil
+}
+
+type snapshotTestCertFetcher struct {
+	tCertFetcher
+}
+
+func (cf snapshotTestCertFetcher) FetchCertificates(lbMeta *LBMetadata, isDefaultCert bool) ([]*config.Certificate, error) {
+	if isDefaultCert {
+		return []*config.Certificate{{Name: "default", Cert: "cert", Key: "secret"}}, nil
+	}
+	return nil, nil
+}
+
+func TestMetadataSnapshotReplay(t *testing.T) {
+	c := &LoadBalancerController{CertFetcher: snapshotTestCertFetcher{}, LBProvider: &tProvider{},
+		syncQueue: utils.NewTaskQueue(func(string) {})}
+	c.MetaFetcher = &recordingMetaFetcher{MetadataFetcher: snapshotTestFetcher{}, recorder: &c.snapshots}
+	if c.GetMetadataSnapshot() != nil {
+		t.Fatalf("No snapshot should be recorded before the first apply")
+	}
+	c.sync("")
+	snapshot, ok := c.GetMetadataSnapshot().(*MetadataSnapshot)
+	if !ok {
+		t.Fatalf("Snapshot should be recorded on apply")
+	}
+	if snapshot.SelfService == nil || snapshot.ServiceLookups[serviceLookupKey("env", "default", "foo")] == nil {
+		t.Fatalf("Snapshot should hold the lookups of the build %+v", snapshot)
+	}
+	if len(snapshot.DefaultCerts) != 1 || snapshot.DefaultCerts[0].Key != "" {
+		t.Fatalf("Snapshot should hold the certs without their keys %+v", snapshot.DefaultCerts)
+	}
+	applied := c.lastSync.get().Configs
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("Snapshot should be json encodable: %v", err)
+	}
+	replayed := &MetadataSnapshot{}
+	if err := json.Unmarshal(b, replayed); err != nil {
+		t.Fatalf("Failed to decode snapshot: %v", err)
+	}
+	cfgs, err := ReplayMetadataSnapshot(replayed, &tProvider{})
+	if err != nil {
+		t.Fatalf("Failed to replay snapshot: %v", err)
+	}
+	if len(cfgs) != 1 || cfgs[0].DefaultCert == nil || cfgs[0].DefaultCert.Key != "" {
+		t.Fatalf("Unexpected replayed configs %+v", cfgs)
+	}
+	cfgs[0].DefaultCert = nil
+	cfgs[0].Certs = nil
+	if !reflect.DeepEqual(cfgs, applied) {
+		t.Fatalf("Replayed configs should be the applied ones\n%+v\n%+v", cfgs, applied)
+	}
+
+	replayed.Errors["service:"+serviceLookupKey("env", "default", "foo")] = "metadata lookup failed"
+	if cfgs, err = ReplayMetadataSnapshot(replayed, &tProvider{}); err != nil {
+		t.Fatalf("Failed to replay snapshot: %v", err)
+	}
+	if backends := cfgs[0].FrontendServices[0].BackendServices; len(backends) != 1 {
+		t.Fatalf("Failed lookup should be replayed %+v", backends)
+	}
+}
+
+type vrrpMetaFetcher struct {
+	tMetaFetcher
+}
+
+func (mf vrrpMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	return metadata.Host{
+		UUID:    "host1",
+		Name:    "edge1",
+		AgentIP: "10.0.0.1",
+		Labels:  map[string]string{vrrpPriorityLabel: "150"},
+	}, nil
+}
+
+func (mf vrrpMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	priorities := map[string]string{"host2": "", "host3": "invalid"}
+	priority, ok := priorities[hostUUID]
+	if !ok {
+		return nil, nil
+	}
+	return &metadata.Host{
+		UUID:    hostUUID,
+		Name:    hostUUID,
+		AgentIP: "10.0.0." + strings.TrimPrefix(hostUUID, "host"),
+		Labels:  map[string]string{vrrpPriorityLabel: priority},
+	}, nil
+}
+
+func TestGetVRRP(t *testing.T) {
+	lbc := &LoadBalancerController{MetaFetcher: vrrpMetaFetcher{}}
+	lbSvc := metadata.Service{
+		Labels: map[string]string{
+			vrrpVirtualIPsLabel:                    "10.0.0.100, 10.0.0.101",
+			"io.rancher.lb_service.vrrp_router_id": "60",
+		},
+		Containers: []metadata.Container{
+			{HostUUID: "host1", State: "running"},
+			{HostUUID: "host3", State: "running"},
+			{HostUUID: "host2", State: "starting"},
+			{HostUUID: "host2", State: "running"},
+			{HostUUID: "host4", State: "running"},
+			{HostUUID: "host5", State: "stopped"},
+		},
+	}
+	vrrp, err := lbc.getVRRP(lbSvc)
+	if err != nil {
+		t.Fatalf("Failed to get the vrrp: %v", err)
+	}
+	expected := &config.VRRP{
+		RouterID:   60,
+		VirtualIPs: []string{"10.0.0.100", "10.0.0.101"},
+		SelfIP:     "10.0.0.1",
+		Priority:   150,
+		Peers:      []*config.VRRPPeer{{IP: "10.0.0.2", Priority: 100}, {IP: "10.0.0.3", Priority: 100}},
+	}
+	if !reflect.DeepEqual(vrrp, expected) {
+		t.Fatalf("Expected vrrp %+v, got %+v", expected, vrrp)
+	}
+
+	delete(lbSvc.Labels, vrrpVirtualIPsLabel)
+	if vrrp, err = lbc.getVRRP(lbSvc); err != nil || vrrp != nil {
+		t.Fatalf("Expected no vrrp without virtual ips, got %+v %v", vrrp, err)
+	}
+	lbSvc.Labels[vrrpVirtualIPsLabel] = "10.0.0.100,vip"
+	if _, err = lbc.getVRRP(lbSvc); err == nil {
+		t.Fatalf("Expected an error for an invalid virtual ip")
+	}
+}
+
+func TestGetServiceIPs(t *testing.T) {
+	ips, err := getServiceIPs(map[string]string{serviceIPsLabel: "203.0.113.10, 2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ips, []string{"203.0.113.10", "2001:db8::1"}) {
+		t.Fatalf("Unexpected service ips %v", ips)
+	}
+	if _, err := getServiceIPs(map[string]string{serviceIPsLabel: "lb.example.com"}); err == nil {
+		t.Fatalf("Expected an error for a hostname")
+	}
+}
@@ -0,0 +1,52 @@
+package rancher
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var bindGateTimeout = flags.Duration("BIND_GATE_TIMEOUT", 0, "Longest time the first config is held back while rules of the lb fail, so the public ports are only bound once all the backends are configured, 0 applies the first config as is")
+
+// readiness turns ready after the first full sync, when a config
+// with the certificates and all the rules of the lb is applied
+type readiness struct {
+	ready   int32
+	started time.Time
+}
+
+func (r *readiness) start(now time.Time) {
+	r.started = now
+}
+
+func (r *readiness) isReady() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+func (r *readiness) synced() {
+	if atomic.CompareAndSwapInt32(&r.ready, 0, 1) {
+		logrus.Infof("Initial sync is complete, lb is ready")
+	}
+}
+
+// holdFirstApply tells whether the config missing failed rules is held
+// back, the lb binding its public ports with the first applied config
+func (r *readiness) holdFirstApply(failedRules int, timeout time.Duration, now time.Time) bool {
+	if r.isReady() || failedRules == 0 || timeout <= 0 {
+		return false
+	}
+	if now.Sub(r.started) >= timeout {
+		logrus.Warnf("Applying the first config without %v failed rule(s), they failed for %v", failedRules, timeout)
+		return false
+	}
+	logrus.Warnf("Holding back the first config until the %v failed rule(s) are configured", failedRules)
+	return true
+}
+
+// IsReady tells whether the initial sync is complete, the
+// lb answers with its backends and certificates configured
+func (lbc *LoadBalancerController) IsReady() bool {
+	return lbc.readiness.isReady()
+}
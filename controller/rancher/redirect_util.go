@@ -0,0 +1,83 @@
+package rancher
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	redirectLabelPrefix = "io.rancher.lb_service.redirect."
+	defaultRedirectCode = 302
+)
+
+var supportedRedirectCodes = map[int]bool{
+	301: true,
+	302: true,
+	303: true,
+	307: true,
+	308: true,
+}
+
+/*
+getRedirects reads redirect targets from the lb service labels.
+The label suffix is the backend name of the port rule to redirect:
+
+io.rancher.lb_service.redirect.olddomain=301 https://new-domain.com
+*/
+func getRedirects(labels map[string]string) (map[string]*config.Redirect, error) {
+	redirects := map[string]*config.Redirect{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, redirectLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, redirectLabelPrefix)
+		if backendName == "" {
+			continue
+		}
+		redirect, err := parseRedirect(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for label %s=%s: %v", k, v, err)
+		}
+		redirects[backendName] = redirect
+	}
+	return redirects, nil
+}
+
+func parseRedirect(value string) (*config.Redirect, error) {
+	fields := strings.Fields(value)
+	code := defaultRedirectCode
+	var target string
+	for _, field := range fields {
+		if c, err := strconv.Atoi(field); err == nil {
+			if !supportedRedirectCodes[c] {
+				return nil, fmt.Errorf("unsupported redirect code %v", c)
+			}
+			code = c
+			continue
+		}
+		target = field
+	}
+	if target == "" {
+		return nil, fmt.Errorf("redirect target is missing")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("redirect target should be an absolute url")
+	}
+	redirect := &config.Redirect{
+		Code:     code,
+		Location: target,
+		Prefix:   u.Path == "" || u.Path == "/",
+	}
+	if redirect.Prefix {
+		redirect.Location = strings.TrimSuffix(target, "/")
+	}
+	return redirect, nil
+}
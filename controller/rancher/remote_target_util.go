@@ -0,0 +1,95 @@
+package rancher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+const remoteTargetLabelPrefix = "io.rancher.lb_service.remote_target."
+
+// RemoteTarget is a service of another environment
+// targeted by the rules of a backend
+type RemoteTarget struct {
+	EnvironmentUUID string
+	StackName       string
+	ServiceName     string
+}
+
+func (t *RemoteTarget) String() string {
+	return fmt.Sprintf("%s/%s/%s", t.EnvironmentUUID, t.StackName, t.ServiceName)
+}
+
+/*
+getRemoteTargets reads the services of other environments targeted by the
+rules of the backends from the lb service labels, by backend name. The
+rules of the backend target the remote service instead of their own
+service or container, so the link can be set up along with the rule in
+the ui:
+
+io.rancher.lb_service.remote_target.api=1a5/shared/api
+
+The environment has to be allowed explicitly by the
+io.rancher.lb_service.allowed_environments label
+*/
+func getRemoteTargets(labels map[string]string) (map[string]*RemoteTarget, error) {
+	targets := map[string]*RemoteTarget{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, remoteTargetLabelPrefix) {
+			continue
+		}
+		backendName := strings.TrimPrefix(k, remoteTargetLabelPrefix)
+		if backendName == "" {
+			continue
+		}
+		parts := strings.Split(strings.TrimSpace(v), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("Invalid value for label %s=%s, expected environmentUUID/stackName/serviceName", k, v)
+		}
+		targets[backendName] = &RemoteTarget{
+			EnvironmentUUID: parts[0],
+			StackName:       parts[1],
+			ServiceName:     parts[2],
+		}
+	}
+	return targets, nil
+}
+
+// allowsRemote returns an error unless the environment of the remote
+// target is on the allowlist of the scope, an empty allowlist
+// doesn't open the lb to the other environments
+func (s *TargetScope) allowsRemote(target *RemoteTarget) error {
+	if s == nil || len(s.AllowedEnvironments) == 0 {
+		return fmt.Errorf("environment [%s] is not in the %s label", target.EnvironmentUUID, allowedEnvironmentsLabel)
+	}
+	return s.Allows(target.EnvironmentUUID, target.StackName)
+}
+
+/*
+getRemoteEndpoints returns the endpoints of the remote service on the
+target port. The endpoints are not local to any lb host, the containers
+being stopped are kept as drained endpoints so their sessions complete
+*/
+func (lbc *LoadBalancerController) getRemoteEndpoints(svc *metadata.Service, targetPort int) (config.Endpoints, error) {
+	eps, err := lbc.getServiceEndpoints(svc, targetPort, "", "any", nil, nil)
+	if err != nil || strings.EqualFold(svc.Kind, "externalService") || strings.EqualFold(svc.Kind, "dnsService") {
+		return eps, err
+	}
+	for _, c := range svc.Containers {
+		if !strings.EqualFold(c.State, "stopping") || c.PrimaryIp == "" {
+			continue
+		}
+		eps = append(eps, &config.Endpoint{
+			Name:     hashIP(c.PrimaryIp),
+			IP:       c.PrimaryIp,
+			Port:     targetPort,
+			HostUUID: c.HostUUID,
+			Drain:    true,
+		})
+	}
+	sort.Sort(eps)
+	return eps, nil
+}
@@ -0,0 +1,100 @@
+package rancher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	maxRequestLoggingDuration   = 24 * time.Hour
+	maxRequestLoggingSampleRate = 1000000
+)
+
+// requestLoggings are the request loggings turned on through the
+// admin api, they are dropped once expired
+type requestLoggings struct {
+	mu       sync.Mutex
+	loggings map[string]*config.RequestLogging
+}
+
+func (r *requestLoggings) set(backendName string, logging *config.RequestLogging) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loggings == nil {
+		r.loggings = map[string]*config.RequestLogging{}
+	}
+	if logging == nil {
+		delete(r.loggings, backendName)
+		return
+	}
+	r.loggings[backendName] = logging
+}
+
+// get returns the loggings running at the time by backend name
+func (r *requestLoggings) get(now time.Time) map[string]*config.RequestLogging {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loggings := map[string]*config.RequestLogging{}
+	for backendName, logging := range r.loggings {
+		if !now.Before(logging.Until) {
+			logrus.Debugf("Request logging of backend [%s] expired at %v", backendName, logging.Until.Format(time.RFC3339))
+			delete(r.loggings, backendName)
+			continue
+		}
+		loggings[backendName] = logging
+	}
+	return loggings
+}
+
+// GetRequestLogging returns the running request loggings
+func (lbc *LoadBalancerController) GetRequestLogging() map[string]*config.RequestLogging {
+	return lbc.requestLoggings.get(time.Now())
+}
+
+// SetRequestLogging logs the requests of the backend for the duration and
+// reapplies the config, again once the logging expires. A zero duration
+// turns the logging off
+func (lbc *LoadBalancerController) SetRequestLogging(backendName string, duration time.Duration, sampleRate int) error {
+	if backendName == "" {
+		return fmt.Errorf("backend name is required")
+	}
+	if duration < 0 || duration > maxRequestLoggingDuration {
+		return fmt.Errorf("duration should be up to %v", maxRequestLoggingDuration)
+	}
+	if sampleRate < 0 || sampleRate > maxRequestLoggingSampleRate {
+		return fmt.Errorf("sample rate should be from 1 to %v", maxRequestLoggingSampleRate)
+	}
+	if duration == 0 {
+		logrus.Infof("Turning off the request logging of backend [%s]", backendName)
+		lbc.requestLoggings.set(backendName, nil)
+		lbc.ScheduleApplyConfig("")
+		return nil
+	}
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+	logging := &config.RequestLogging{Until: time.Now().Add(duration), SampleRate: sampleRate}
+	logrus.Infof("Logging 1 in %v of the requests of backend [%s] until %v", sampleRate, backendName, logging.Until.Format(time.RFC3339))
+	lbc.requestLoggings.set(backendName, logging)
+	lbc.ScheduleApplyConfig("")
+	time.AfterFunc(duration, func() {
+		lbc.ScheduleApplyConfig("")
+	})
+	return nil
+}
+
+func getRequestLogging(loggings map[string]*config.RequestLogging, backendName string, protocol string) *config.RequestLogging {
+	logging, ok := loggings[backendName]
+	if !ok {
+		return nil
+	}
+	if !isHTTPProto(protocol) {
+		logrus.Warnf("Skipping request logging for backend [%s], not supported for protocol %s", backendName, protocol)
+		return nil
+	}
+	return logging
+}
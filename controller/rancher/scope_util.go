@@ -0,0 +1,103 @@
+package rancher
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	allowedStacksLabel       = "io.rancher.lb_service.allowed_stacks"
+	deniedStacksLabel        = "io.rancher.lb_service.denied_stacks"
+	allowedEnvironmentsLabel = "io.rancher.lb_service.allowed_environments"
+	deniedEnvironmentsLabel  = "io.rancher.lb_service.denied_environments"
+)
+
+/*
+TargetScope restricts the stacks and environments the rules and the
+selectors of the lb may target. The labels are comma separated lists
+of stack names and environment uuids, matched case insensitively with
+shell patterns:
+
+io.rancher.lb_service.allowed_stacks=team-a-*,shared
+io.rancher.lb_service.denied_stacks=team-a-secrets
+
+A target is allowed when it matches one of the allowed patterns, or
+when none is set, and none of the denied patterns
+*/
+type TargetScope struct {
+	AllowedStacks       []string
+	DeniedStacks        []string
+	AllowedEnvironments []string
+	DeniedEnvironments  []string
+}
+
+// GetTargetScope reads the scope from the lb service labels,
+// nil is returned when the lb may target any stack
+func GetTargetScope(labels map[string]string) (*TargetScope, error) {
+	scope := &TargetScope{}
+	var err error
+	if scope.AllowedStacks, err = getScopePatterns(labels, allowedStacksLabel); err != nil {
+		return nil, err
+	}
+	if scope.DeniedStacks, err = getScopePatterns(labels, deniedStacksLabel); err != nil {
+		return nil, err
+	}
+	if scope.AllowedEnvironments, err = getScopePatterns(labels, allowedEnvironmentsLabel); err != nil {
+		return nil, err
+	}
+	if scope.DeniedEnvironments, err = getScopePatterns(labels, deniedEnvironmentsLabel); err != nil {
+		return nil, err
+	}
+	if len(scope.AllowedStacks)+len(scope.DeniedStacks)+len(scope.AllowedEnvironments)+len(scope.DeniedEnvironments) == 0 {
+		return nil, nil
+	}
+	return scope, nil
+}
+
+func getScopePatterns(labels map[string]string, label string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(labels[label], ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern [%s] in label %s: %v", pattern, label, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Allows returns an error when the stack or environment
+// of the target is out of the scope, a nil scope allows all
+func (s *TargetScope) Allows(envUUID string, stackName string) error {
+	if s == nil {
+		return nil
+	}
+	if !scopeAllows(s.AllowedEnvironments, s.DeniedEnvironments, envUUID) {
+		return fmt.Errorf("environment [%s] is out of the lb target scope", envUUID)
+	}
+	if !scopeAllows(s.AllowedStacks, s.DeniedStacks, stackName) {
+		return fmt.Errorf("stack [%s] is out of the lb target scope", stackName)
+	}
+	return nil
+}
+
+func scopeAllows(allowed, denied []string, name string) bool {
+	name = strings.ToLower(name)
+	if matchesAnyPattern(denied, name) {
+		return false
+	}
+	return len(allowed) == 0 || matchesAnyPattern(allowed, name)
+}
+
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
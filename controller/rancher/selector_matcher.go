@@ -0,0 +1,83 @@
+package rancher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+/*
+SelectorMatcher matches the services targeted by the selector rules with
+the prefix it is registered for, for the targeting logic the label
+selectors can't express. The matching services are expanded like the
+ones of a label selector:
+
+	owner:team-a
+*/
+type SelectorMatcher interface {
+	// Match returns the services matching the selector, stripped of
+	// its prefix, out of all the services in their expansion order
+	Match(selector string, svcs []metadata.Service) ([]metadata.Service, error)
+}
+
+// SelectorMatcherFunc adapts a function to a SelectorMatcher
+type SelectorMatcherFunc func(selector string, svcs []metadata.Service) ([]metadata.Service, error)
+
+func (f SelectorMatcherFunc) Match(selector string, svcs []metadata.Service) ([]metadata.Service, error) {
+	return f(selector, svcs)
+}
+
+type selectorMatchers struct {
+	mu       sync.RWMutex
+	matchers map[string]SelectorMatcher
+}
+
+// RegisterSelectorMatcher matches the selectors starting with the prefix
+// with the matcher, the prefix ends with a colon
+func (lbc *LoadBalancerController) RegisterSelectorMatcher(prefix string, m SelectorMatcher) error {
+	if len(prefix) < 2 || !strings.HasSuffix(prefix, ":") {
+		return fmt.Errorf("Invalid selector prefix [%s], expected name:", prefix)
+	}
+	if prefix == containerSelectorPrefix {
+		return fmt.Errorf("selector prefix %s is reserved", prefix)
+	}
+	lbc.selectorMatchers.mu.Lock()
+	defer lbc.selectorMatchers.mu.Unlock()
+	if lbc.selectorMatchers.matchers == nil {
+		lbc.selectorMatchers.matchers = map[string]SelectorMatcher{}
+	}
+	if _, ok := lbc.selectorMatchers.matchers[prefix]; ok {
+		return fmt.Errorf("selector matcher %s is already registered", prefix)
+	}
+	lbc.selectorMatchers.matchers[prefix] = m
+	return nil
+}
+
+// get returns the matcher of the selector prefix and the selector
+// without it, nil when no matcher is registered for the prefix
+func (s *selectorMatchers) get(selector string) (SelectorMatcher, string) {
+	i := strings.Index(selector, ":")
+	if i <= 0 {
+		return nil, selector
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.matchers[selector[:i+1]]
+	if !ok {
+		return nil, selector
+	}
+	return m, selector[i+1:]
+}
+
+// matchServices returns the services matching the selector, with the
+// matcher registered for its prefix or as a label selector
+func (lbc *LoadBalancerController) matchServices(index *serviceIndex, selector string) ([]metadata.Service, error) {
+	m, stripped := lbc.selectorMatchers.get(selector)
+	if m == nil {
+		return index.match(selector), nil
+	}
+	// the matcher gets its own copy, it can't change the index
+	return m.Match(stripped, append([]metadata.Service{}, index.services...))
+}
@@ -2,7 +2,10 @@ package rancher
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
 //supported protocols
@@ -209,3 +212,41 @@ func GetSelectorConstraint(selector string) SelectorConstraint {
 	}
 	return nil
 }
+
+// containerSelectorPrefix marks the selectors matching the labels
+// of the containers instead of the labels of the services
+const containerSelectorPrefix = "container:"
+
+func isContainerSelector(selector string) bool {
+	return strings.HasPrefix(selector, containerSelectorPrefix)
+}
+
+/*
+getContainerSelectorRules expands a container selector rule into a rule
+for each of the service containers matching the selector, the rules
+share the source port, hostname and path so the containers are the
+endpoints of a single backend:
+
+container:io.rancher.stack_service.name=web/app,role=frontend
+*/
+func getContainerSelectorRules(lbRule metadata.PortRule, index *serviceIndex) []metadata.PortRule {
+	selector := strings.TrimPrefix(lbRule.Selector, containerSelectorPrefix)
+	var uuids []string
+	seen := map[string]bool{}
+	for _, c := range index.matchContainers(selector) {
+		if c.UUID == "" || seen[c.UUID] || !IsSelectorMatch(selector, c.Labels) {
+			continue
+		}
+		seen[c.UUID] = true
+		uuids = append(uuids, c.UUID)
+	}
+	sort.Strings(uuids)
+	var rules []metadata.PortRule
+	for _, uuid := range uuids {
+		rule := lbRule
+		rule.Selector = ""
+		rule.ContainerUUID = uuid
+		rules = append(rules, rule)
+	}
+	return rules
+}
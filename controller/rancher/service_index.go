@@ -0,0 +1,199 @@
+package rancher
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+/*
+serviceIndex holds the services of a metadata version, in the stable
+order the selectors expand in, and their containers, indexed by label.
+The syncs of an unchanged version reuse it instead of loading all the
+services again, and the selectors are only evaluated against the
+services or containers carrying the labels of their constraints
+*/
+type serviceIndex struct {
+	version    string
+	services   []metadata.Service
+	containers []metadata.Container
+	// serviceLabels and containerLabels index the
+	// services and the containers by position
+	serviceLabels   *labelIndex
+	containerLabels *labelIndex
+}
+
+// labelIndex is a label index of a list of services or containers,
+// by lowercased key and by lowercased key=value
+type labelIndex struct {
+	byKey   map[string][]int
+	byLabel map[string][]int
+}
+
+type serviceIndexCache struct {
+	mu    sync.Mutex
+	index *serviceIndex
+}
+
+// get returns the index of the version, the services are loaded again
+// when the version changed or the fetcher can't tell it
+func (c *serviceIndexCache) get(version string, fetch func() ([]metadata.Service, error)) (*serviceIndex, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != "" && c.index != nil && c.index.version == version {
+		return c.index, nil
+	}
+	svcs, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	index := newServiceIndex(version, svcs)
+	c.index = index
+	return index, nil
+}
+
+// invalidate drops the index, the services are loaded again
+func (c *serviceIndexCache) invalidate() {
+	c.mu.Lock()
+	c.index = nil
+	c.mu.Unlock()
+}
+
+func newServiceIndex(version string, svcs []metadata.Service) *serviceIndex {
+	// the services matching a selector are expanded in a stable order,
+	// whatever the order of the metadata
+	svcs = append([]metadata.Service{}, svcs...)
+	sort.SliceStable(svcs, func(i, j int) bool {
+		if svcs[i].StackName != svcs[j].StackName {
+			return svcs[i].StackName < svcs[j].StackName
+		}
+		return svcs[i].Name < svcs[j].Name
+	})
+	var containers []metadata.Container
+	for _, svc := range svcs {
+		containers = append(containers, svc.Containers...)
+	}
+	return &serviceIndex{
+		version:         version,
+		services:        svcs,
+		containers:      containers,
+		serviceLabels:   newLabelIndex(len(svcs), func(i int) map[string]string { return svcs[i].Labels }),
+		containerLabels: newLabelIndex(len(containers), func(i int) map[string]string { return containers[i].Labels }),
+	}
+}
+
+func newLabelIndex(n int, labels func(i int) map[string]string) *labelIndex {
+	index := &labelIndex{
+		byKey:   map[string][]int{},
+		byLabel: map[string][]int{},
+	}
+	for i := 0; i < n; i++ {
+		for k, v := range labels(i) {
+			key := strings.ToLower(k)
+			index.byKey[key] = appendIndex(index.byKey[key], i)
+			label := key + "=" + strings.ToLower(v)
+			index.byLabel[label] = appendIndex(index.byLabel[label], i)
+		}
+	}
+	return index
+}
+
+// appendIndex appends the position unless it's the last one, the
+// positions are appended in order so they are only appended once
+func appendIndex(indexes []int, i int) []int {
+	if len(indexes) > 0 && indexes[len(indexes)-1] == i {
+		return indexes
+	}
+	return append(indexes, i)
+}
+
+/*
+candidates returns the positions that may match the selector, in order,
+false when the selector has no constraint to look up. Every constraint
+requires its label key, so the positions are the ones of the least used
+label of the selector: the key=value of the equality constraints, the
+values of the in constraints, or the key of the others
+*/
+func (index *labelIndex) candidates(selector string) ([]int, bool) {
+	var candidates []int
+	found := false
+	for _, c := range GetSelectorConstraints(selector) {
+		var indexes []int
+		switch c := c.(type) {
+		case *SelectorConstraintEq:
+			indexes = index.byLabel[strings.ToLower(c.Key+"="+c.Value)]
+		case *SelectorConstraintIn:
+			var values []int
+			for _, v := range c.Value {
+				values = append(values, index.byLabel[strings.ToLower(c.Key+"="+v)]...)
+			}
+			sort.Ints(values)
+			for _, i := range values {
+				indexes = appendIndex(indexes, i)
+			}
+		case *SelectorConstraintNEq:
+			indexes = index.byKey[strings.ToLower(c.Key)]
+		case *SelectorConstraintNotIn:
+			indexes = index.byKey[strings.ToLower(c.Key)]
+		case *SelectorConstraintNoop:
+			indexes = index.byKey[strings.ToLower(c.Key)]
+		default:
+			continue
+		}
+		if !found || len(indexes) < len(candidates) {
+			candidates = indexes
+			found = true
+		}
+	}
+	return candidates, found
+}
+
+// match returns the services matching the selector, in the order of the index
+func (index *serviceIndex) match(selector string) []metadata.Service {
+	var svcs []metadata.Service
+	candidates, ok := index.serviceLabels.candidates(selector)
+	if !ok {
+		for _, svc := range index.services {
+			if IsSelectorMatch(selector, svc.Labels) {
+				svcs = append(svcs, svc)
+			}
+		}
+		return svcs
+	}
+	for _, i := range candidates {
+		if IsSelectorMatch(selector, index.services[i].Labels) {
+			svcs = append(svcs, index.services[i])
+		}
+	}
+	return svcs
+}
+
+// matchContainers returns the containers that may match the selector,
+// the selector is still to be evaluated against their labels
+func (index *serviceIndex) matchContainers(selector string) []metadata.Container {
+	candidates, ok := index.containerLabels.candidates(selector)
+	if !ok {
+		return index.containers
+	}
+	containers := make([]metadata.Container, 0, len(candidates))
+	for _, i := range candidates {
+		containers = append(containers, index.containers[i])
+	}
+	return containers
+}
+
+// getServiceIndex returns the index of the services of
+// the current metadata version
+func (lbc *LoadBalancerController) getServiceIndex() (*serviceIndex, error) {
+	index, err := lbc.serviceIndex.get(lbc.metadataVersion(), lbc.MetaFetcher.GetServices)
+	if err != nil {
+		return nil, err
+	}
+	// the services of a cached index aren't fetched again
+	lbc.snapshots.record(func(s *MetadataSnapshot) {
+		s.Services = index.services
+	})
+	return index, nil
+}
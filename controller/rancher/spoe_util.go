@@ -0,0 +1,192 @@
+package rancher
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+const spoeLabelPrefix = "io.rancher.lb_service.spoe."
+
+var (
+	spoeName    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	spoeArgName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	spoeEvents  = map[string]bool{
+		"on-client-session":        true,
+		"on-server-session":        true,
+		"on-frontend-tcp-request":  true,
+		"on-backend-tcp-request":   true,
+		"on-tcp-response":          true,
+		"on-frontend-http-request": true,
+		"on-backend-http-request":  true,
+		"on-http-response":         true,
+	}
+)
+
+// SPOEngine is an spoe engine of the lb service, filtering the http
+// frontends on the Ports, or all of them when there is no port
+type SPOEngine struct {
+	Engine *config.SPOEngine
+	Ports  map[int]bool
+}
+
+/*
+getSPOEngines reads the spoe engines from the lb service labels, grouped
+by engine name. The agents are required, and the engine sends at least
+one message, as <event>:<args> with the args in name=sample format:
+
+io.rancher.lb_service.spoe.auth.agents=10.42.0.5:12345,10.42.0.6:12345
+io.rancher.lb_service.spoe.auth.ports=80,443
+io.rancher.lb_service.spoe.auth.timeout=500ms
+io.rancher.lb_service.spoe.auth.message.check-request=on-frontend-http-request:ip=src path=path auth=req.hdr(authorization)
+
+The engines are returned in the name order.
+*/
+func getSPOEngines(labels map[string]string) ([]*SPOEngine, error) {
+	engines := map[string]*SPOEngine{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, spoeLabelPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, spoeLabelPrefix), ".", 2)
+		if len(parts) != 2 || !spoeName.MatchString(parts[0]) {
+			return nil, fmt.Errorf("Invalid label %s, expected %s<engine>.<setting>", k, spoeLabelPrefix)
+		}
+		name, setting := parts[0], parts[1]
+		engine, ok := engines[name]
+		if !ok {
+			engine = &SPOEngine{Engine: &config.SPOEngine{Name: name}, Ports: map[int]bool{}}
+			engines[name] = engine
+		}
+		v = strings.TrimSpace(v)
+		switch {
+		case setting == "agents":
+			for _, agent := range strings.Split(v, ",") {
+				agent = strings.TrimSpace(agent)
+				if err := validateSPOEAgent(agent); err != nil {
+					return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+				}
+				engine.Engine.Agents = append(engine.Engine.Agents, agent)
+			}
+		case setting == "ports":
+			for _, p := range strings.Split(v, ",") {
+				port, err := strconv.Atoi(strings.TrimSpace(p))
+				if err != nil || port < 1 || port > 65535 {
+					return nil, fmt.Errorf("Invalid label value for label %s=%s: %s is not a valid port", k, v, p)
+				}
+				engine.Ports[port] = true
+			}
+		case setting == "timeout":
+			timeout, err := time.ParseDuration(v)
+			if err != nil || timeout < time.Millisecond {
+				return nil, fmt.Errorf("Invalid label value for label %s=%s, should be a duration as 500ms", k, v)
+			}
+			engine.Engine.TimeoutMs = int(timeout / time.Millisecond)
+		case strings.HasPrefix(setting, "message."):
+			message, err := parseSPOMessage(strings.TrimPrefix(setting, "message."), v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+			}
+			engine.Engine.Messages = append(engine.Engine.Messages, message)
+		default:
+			return nil, fmt.Errorf("Invalid label %s, unsupported setting %s", k, setting)
+		}
+	}
+
+	var names []string
+	for name, engine := range engines {
+		if len(engine.Engine.Agents) == 0 {
+			return nil, fmt.Errorf("Spoe engine %s has no agents", name)
+		}
+		if len(engine.Engine.Messages) == 0 {
+			return nil, fmt.Errorf("Spoe engine %s has no messages", name)
+		}
+		sort.Slice(engine.Engine.Messages, func(i, j int) bool {
+			return engine.Engine.Messages[i].Name < engine.Engine.Messages[j].Name
+		})
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []*SPOEngine
+	for _, name := range names {
+		result = append(result, engines[name])
+	}
+	return result, nil
+}
+
+func validateSPOEAgent(agent string) error {
+	host, port, err := net.SplitHostPort(agent)
+	if err != nil || host == "" {
+		return fmt.Errorf("agent %s should be in host:port format", agent)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("agent %s has an invalid port", agent)
+	}
+	return nil
+}
+
+func parseSPOMessage(name string, value string) (*config.SPOMessage, error) {
+	if !spoeName.MatchString(name) {
+		return nil, fmt.Errorf("invalid message name %s", name)
+	}
+	parts := strings.SplitN(value, ":", 2)
+	event := strings.TrimSpace(parts[0])
+	if !spoeEvents[event] {
+		return nil, fmt.Errorf("unsupported event %s", event)
+	}
+	message := &config.SPOMessage{Name: name, Event: event}
+	if len(parts) == 1 {
+		return message, nil
+	}
+	for _, arg := range strings.Fields(parts[1]) {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || !spoeArgName.MatchString(kv[0]) || kv[1] == "" {
+			return nil, fmt.Errorf("arg %s should be in name=sample format", arg)
+		}
+		message.Args = append(message.Args, arg)
+	}
+	return message, nil
+}
+
+// getFrontendSPOEngines returns the names of the engines filtering the frontend of the rule
+func getFrontendSPOEngines(engines []*SPOEngine, rule metadata.PortRule) []string {
+	var names []string
+	for _, engine := range engines {
+		if len(engine.Ports) > 0 && !engine.Ports[rule.SourcePort] {
+			continue
+		}
+		if !isHTTPProto(rule.Protocol) {
+			if len(engine.Ports) > 0 {
+				logrus.Warnf("Ignoring spoe engine %s for port %v, supported on http ports only", engine.Engine.Name, rule.SourcePort)
+			}
+			continue
+		}
+		names = append(names, engine.Engine.Name)
+	}
+	return names
+}
+
+// getUsedSPOEngines returns the engines filtering any of the frontends
+func getUsedSPOEngines(engines []*SPOEngine, frontends config.FrontendServices) []*config.SPOEngine {
+	used := map[string]bool{}
+	for _, fe := range frontends {
+		for _, name := range fe.SPOEngines {
+			used[name] = true
+		}
+	}
+	var result []*config.SPOEngine
+	for _, engine := range engines {
+		if used[engine.Engine.Name] {
+			result = append(result, engine.Engine)
+		}
+	}
+	return result
+}
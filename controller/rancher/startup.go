@@ -0,0 +1,68 @@
+package rancher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	// startupPolicyExit exits when the metadata is unreachable at startup
+	startupPolicyExit = "exit"
+	// startupPolicyLastConfig serves the last config the provider persisted
+	// until the metadata is reachable
+	startupPolicyLastConfig = "last-config"
+
+	maxMetadataBackoff = 30 * time.Second
+)
+
+var (
+	metadataStartupPolicy   = flags.String("METADATA_STARTUP_POLICY", startupPolicyExit, "What to do when the metadata is unreachable at startup, exit or last-config to serve the last applied config until it is reachable")
+	metadataStartupTimeout  = flags.Duration("METADATA_STARTUP_TIMEOUT", 0, "How long the metadata is waited for at startup, 0 waits until it is reachable")
+	metadataStartupExitCode = flags.Int("METADATA_STARTUP_EXIT_CODE", 1, "Exit code when the metadata is unreachable at startup with the exit policy").Range(1, 255)
+)
+
+func validateStartupPolicy(policy string) error {
+	switch policy {
+	case startupPolicyExit, startupPolicyLastConfig:
+		return nil
+	default:
+		return fmt.Errorf("Invalid METADATA_STARTUP_POLICY %s, expected %s or %s", policy, startupPolicyExit, startupPolicyLastConfig)
+	}
+}
+
+// waitForMetadata polls the metadata version with backoff until it
+// answers, or until the timeout when set
+func waitForMetadata(client metadata.Client, timeout time.Duration, sleep func(time.Duration)) error {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for {
+		_, err := client.GetVersion()
+		if err == nil {
+			return nil
+		}
+		if timeout > 0 && !time.Now().Add(backoff).Before(deadline) {
+			return fmt.Errorf("metadata is unreachable after %v: %v", timeout, err)
+		}
+		logrus.Debugf("Waiting for the metadata: %v", err)
+		sleep(backoff)
+		if backoff *= 2; backoff > maxMetadataBackoff {
+			backoff = maxMetadataBackoff
+		}
+	}
+}
+
+// onMetadataUnreachable applies the startup policy, nil is returned when
+// the last config is served meanwhile
+func onMetadataUnreachable(cfg *Config, err error) error {
+	if cfg.StartupPolicy == startupPolicyLastConfig {
+		logrus.Warnf("Serving the last applied config until the metadata is reachable, %v", err)
+		return nil
+	}
+	logrus.Errorf("Error initiating metadata client: %v", err)
+	cfg.Exit(cfg.StartupExitCode)
+	return err
+}
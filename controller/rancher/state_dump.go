@@ -0,0 +1,187 @@
+package rancher
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+// StateDump is the internal state of the controller, dumped
+// for the offline debugging of a stuck or misbehaving lb
+type StateDump struct {
+	Time  time.Time `json:"time"`
+	Ready bool      `json:"ready"`
+	// LastSync is the outcome of the last sync, nil before the first one
+	LastSync *SyncRecord `json:"last_sync"`
+	// CachedVersion is the metadata version of the cached configs
+	CachedVersion  string `json:"cached_version"`
+	CachedApplied  bool   `json:"cached_applied"`
+	QueueDepth     int    `json:"queue_depth"`
+	BackoffSeconds int64  `json:"backoff_seconds"`
+	// HeldEndpoints are the endpoints kept through
+	// metadata blips, by backend and service
+	HeldEndpoints map[string]HeldEndpointsDump      `json:"held_endpoints"`
+	Captures      map[string]time.Time              `json:"captures"`
+	Faults        map[string]*config.Fault          `json:"faults"`
+	Loggings      map[string]*config.RequestLogging `json:"request_loggings"`
+	Certificates  []CertificateSummary              `json:"certificates"`
+	Expansions    *ExpansionReport                  `json:"expansions"`
+	Validation    *ValidationReport                 `json:"validation"`
+}
+
+// SyncRecord is the outcome of a sync, the configs it built
+// are stripped of the certificates and their keys
+type SyncRecord struct {
+	Time       time.Time                    `json:"time"`
+	Error      string                       `json:"error,omitempty"`
+	Requeued   bool                         `json:"requeued"`
+	RuleErrors []string                     `json:"rule_errors"`
+	Configs    []*config.LoadBalancerConfig `json:"configs"`
+}
+
+// HeldEndpointsDump describes the endpoints held for a rule
+type HeldEndpointsDump struct {
+	Endpoints int       `json:"endpoints"`
+	Seen      time.Time `json:"seen"`
+	Serving   bool      `json:"serving"`
+	Until     time.Time `json:"until"`
+}
+
+// CertificateSummary describes a cached certificate, without its key
+type CertificateSummary struct {
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	KeyType   string    `json:"key_type"`
+	Hostnames []string  `json:"hostnames"`
+	NotAfter  time.Time `json:"not_after"`
+	Default   bool      `json:"default"`
+}
+
+type syncRecorder struct {
+	mu     sync.Mutex
+	record *SyncRecord
+}
+
+// set records the outcome of the sync, the certificates of
+// the configs are left out so the dumps can be shared
+func (r *syncRecorder) set(now time.Time, state *SyncState, err error, ruleErrors []*RuleError, requeued bool) {
+	record := &SyncRecord{Time: now, Requeued: requeued}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	for _, ruleErr := range ruleErrors {
+		record.RuleErrors = append(record.RuleErrors, ruleErr.Error())
+	}
+	if state != nil {
+		for _, cfg := range state.Configs {
+			stripped := *cfg
+			stripped.DefaultCert = nil
+			stripped.Certs = nil
+			record.Configs = append(record.Configs, &stripped)
+		}
+	}
+	r.mu.Lock()
+	r.record = record
+	r.mu.Unlock()
+}
+
+func (r *syncRecorder) get() *SyncRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.record
+}
+
+func (h *endpointHolds) dump() map[string]HeldEndpointsDump {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	held := map[string]HeldEndpointsDump{}
+	for key, eps := range h.held {
+		held[key] = HeldEndpointsDump{
+			Endpoints: len(eps.eps),
+			Seen:      eps.seen,
+			Serving:   eps.serving,
+			Until:     eps.until,
+		}
+	}
+	return held
+}
+
+func (c *captureDeadlines) dump() map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadlines := map[string]time.Time{}
+	for key, deadline := range c.deadlines {
+		deadlines[key] = deadline
+	}
+	return deadlines
+}
+
+func (c *configCache) dump() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version, c.applied
+}
+
+// summarizeCertificates lists the certificates cached by the
+// fetcher, nil for the fetchers not caching them
+func summarizeCertificates(fetcher CertificateFetcher) []CertificateSummary {
+	rFetcher, ok := fetcher.(*RCertificateFetcher)
+	if !ok || rFetcher.mu == nil {
+		return nil
+	}
+	rFetcher.mu.RLock()
+	defer rFetcher.mu.RUnlock()
+	var certs []CertificateSummary
+	if rFetcher.DefaultCert != nil {
+		summary := summarizeCertificate("", rFetcher.DefaultCert)
+		summary.Default = true
+		certs = append(certs, summary)
+	}
+	for _, path := range sortedCertPaths(rFetcher.CertsCache) {
+		certs = append(certs, summarizeCertificate(path, rFetcher.CertsCache[path]))
+	}
+	return certs
+}
+
+func summarizeCertificate(path string, cert *config.Certificate) CertificateSummary {
+	summary := CertificateSummary{
+		Path:      path,
+		Name:      cert.Name,
+		KeyType:   cert.KeyType,
+		Hostnames: cert.Hostnames,
+	}
+	if block, _ := pem.Decode([]byte(cert.Cert)); block != nil {
+		if parsed, err := x509.ParseCertificate(block.Bytes); err == nil {
+			summary.NotAfter = parsed.NotAfter
+		}
+	}
+	return summary
+}
+
+// DumpState returns the internal state of the controller: the outcome
+// and the configs of the last sync, the queue and the backoff, the held
+// endpoints, the overrides of the admin api and the cached certificates
+func (lbc *LoadBalancerController) DumpState() interface{} {
+	dump := &StateDump{
+		Time:           time.Now(),
+		Ready:          lbc.readiness.isReady(),
+		LastSync:       lbc.lastSync.get(),
+		BackoffSeconds: atomic.LoadInt64(&lbc.incrementalBackoff),
+		HeldEndpoints:  lbc.holds.dump(),
+		Captures:       lbc.captures.dump(),
+		Faults:         lbc.faults.get(time.Now()),
+		Loggings:       lbc.requestLoggings.get(time.Now()),
+		Certificates:   summarizeCertificates(lbc.getCertFetcher()),
+		Expansions:     lbc.ruleExpansions.get(),
+		Validation:     lbc.validationReport.get(),
+	}
+	dump.CachedVersion, dump.CachedApplied = lbc.configCache.dump()
+	if lbc.syncQueue != nil {
+		dump.QueueDepth = lbc.syncQueue.Len()
+	}
+	return dump
+}
@@ -0,0 +1,51 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const inferTargetPortLabel = "io.rancher.lb_service.infer_target_port"
+
+var inferTargetPort = flags.LabelBool(inferTargetPortLabel, false, "Infer missing target ports from the ports the targets expose")
+
+// getTargetPort returns the target port of the rule, when it is not set
+// and inference is enabled the port is taken from the ports the service
+// or container exposes, as long as there is a single one
+func getTargetPort(targetPort int, ports []string, infer bool) (int, error) {
+	if targetPort > 0 {
+		return targetPort, nil
+	}
+	if !infer {
+		return 0, fmt.Errorf("target port is not set")
+	}
+	private := getPrivatePorts(ports)
+	if len(private) == 0 {
+		return 0, fmt.Errorf("target port is not set and no ports are exposed to infer it from")
+	}
+	if len(private) > 1 {
+		return 0, fmt.Errorf("target port is not set and can't be inferred from multiple exposed ports %v", private)
+	}
+	return private[0], nil
+}
+
+// getPrivatePorts returns distinct private ports of the port
+// specs in [ip:][public:]private[/protocol] format
+func getPrivatePorts(ports []string) []int {
+	var private []int
+	seen := map[int]bool{}
+	for _, spec := range ports {
+		spec = strings.SplitN(spec, "/", 2)[0]
+		splitted := strings.Split(spec, ":")
+		port, err := strconv.Atoi(splitted[len(splitted)-1])
+		if err != nil || port < 1 || seen[port] {
+			continue
+		}
+		seen[port] = true
+		private = append(private, port)
+	}
+	return private
+}
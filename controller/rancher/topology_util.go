@@ -0,0 +1,122 @@
+package rancher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	topologyKeysLabel = "io.rancher.lb_service.topology_keys"
+	// topologyAnyKey matches endpoints on any host
+	topologyAnyKey = "*"
+)
+
+/*
+getTopologyKeys reads the ordered list of host label keys used to pick
+the endpoints closest to the lb host:
+
+io.rancher.lb_service.topology_keys=io.rancher.host.uuid,zone,region,*
+
+The endpoints on the hosts sharing the value of the first key with the lb
+host are used; when there are none, the next key is tried. io.rancher.host.uuid
+matches the lb host itself, and * matches any host. When no key matches,
+the backend is left without endpoints, so * should end the list for the
+traffic to fall back to the rest of the endpoints.
+*/
+func getTopologyKeys(labels map[string]string) ([]string, error) {
+	val := strings.TrimSpace(labels[topologyKeysLabel])
+	if val == "" {
+		return nil, nil
+	}
+	var keys []string
+	for _, key := range strings.Split(val, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, empty topology key", topologyKeysLabel, val)
+		}
+		if len(keys) > 0 && keys[len(keys)-1] == topologyAnyKey {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s, %s should be the last topology key", topologyKeysLabel, val, topologyAnyKey)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// topologyFilter picks the endpoints of the first topology tier
+// having any; hosts are looked up once per config build
+type topologyFilter struct {
+	keys        []string
+	metaFetcher MetadataFetcher
+	selfHost    *metadata.Host
+	hosts       map[string]*metadata.Host
+}
+
+func (f *topologyFilter) filter(eps config.Endpoints) (config.Endpoints, error) {
+	if f.selfHost == nil {
+		selfHost, err := f.metaFetcher.GetSelfHost()
+		if err != nil {
+			return nil, err
+		}
+		f.selfHost = &selfHost
+		f.hosts = map[string]*metadata.Host{}
+	}
+	for _, key := range f.keys {
+		if key == topologyAnyKey {
+			return eps, nil
+		}
+		var tier config.Endpoints
+		for _, ep := range eps {
+			match, err := f.isTopologyMatch(key, ep)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				tier = append(tier, ep)
+			}
+		}
+		if len(tier) > 0 {
+			return tier, nil
+		}
+	}
+	logrus.Debugf("No endpoints match topology keys %v", f.keys)
+	return nil, nil
+}
+
+func (f *topologyFilter) isTopologyMatch(key string, ep *config.Endpoint) (bool, error) {
+	// external endpoints are not bound to any host
+	if ep.HostUUID == "" {
+		return false, nil
+	}
+	if key == hostUUIDLabel {
+		return strings.EqualFold(ep.HostUUID, f.selfHost.UUID), nil
+	}
+	value, ok := f.selfHost.Labels[key]
+	if !ok {
+		return false, nil
+	}
+	host, err := f.getHost(ep.HostUUID)
+	if err != nil {
+		return false, err
+	}
+	if host == nil {
+		return false, nil
+	}
+	epValue, ok := host.Labels[key]
+	return ok && epValue == value, nil
+}
+
+func (f *topologyFilter) getHost(hostUUID string) (*metadata.Host, error) {
+	if host, ok := f.hosts[hostUUID]; ok {
+		return host, nil
+	}
+	host, err := f.metaFetcher.GetHost(hostUUID)
+	if err != nil {
+		return nil, err
+	}
+	f.hosts[hostUUID] = host
+	return host, nil
+}
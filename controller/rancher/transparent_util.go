@@ -0,0 +1,54 @@
+package rancher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	transparentLabel       = "io.rancher.lb_service.transparent"
+	transparentLabelPrefix = "io.rancher.lb_service.transparent."
+	// transparentDefault keys the setting applied to all the backends
+	transparentDefault = ""
+)
+
+/*
+getTransparentBackends reads the backends the lb connects to from the
+client ip (tproxy), set for all the backends or for the backend whose
+name is given in the label suffix:
+
+io.rancher.lb_service.transparent=true
+io.rancher.lb_service.transparent.metrics=false
+
+The endpoints should route the replies to the client ips back through
+the lb host, and the lb container needs the NET_ADMIN capability.
+*/
+func getTransparentBackends(labels map[string]string) (map[string]bool, error) {
+	transparent := map[string]bool{}
+	for k, v := range labels {
+		backendName := transparentDefault
+		if strings.HasPrefix(k, transparentLabelPrefix) {
+			backendName = strings.TrimPrefix(k, transparentLabelPrefix)
+			if backendName == "" {
+				continue
+			}
+		} else if k != transparentLabel {
+			continue
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", k, v, err)
+		}
+		transparent[backendName] = enabled
+	}
+	return transparent, nil
+}
+
+// getTransparent prefers the backend setting over the one set for all backends
+func getTransparent(transparent map[string]bool, backendName string) bool {
+	if enabled, ok := transparent[backendName]; ok && backendName != transparentDefault {
+		return enabled
+	}
+	return transparent[transparentDefault]
+}
@@ -0,0 +1,33 @@
+package rancher
+
+import (
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+// the tuning labels override the settings the provider
+// sizes from the limits of its container, 0 keeps them
+var (
+	maxConnLabel = flags.LabelInt("io.rancher.lb_service.maxconn", 0, "Max number of connections of the lb, sized from the memory limit when not set").Range(0, 1000000)
+	bufSizeLabel = flags.LabelInt("io.rancher.lb_service.bufsize", 0, "Buffer size of the lb connections in bytes, sized from the memory limit when not set").Range(0, 1048576)
+	threadsLabel = flags.LabelInt("io.rancher.lb_service.threads", 0, "Number of lb threads, sized from the cpu limit when enabled and not set").Range(0, 64)
+)
+
+// getTuning reads the tuning overrides, nil is returned when none is set
+func getTuning(labels map[string]string) (*config.Tuning, error) {
+	tuning := &config.Tuning{}
+	var err error
+	if tuning.MaxConn, err = maxConnLabel.Get(labels); err != nil {
+		return nil, err
+	}
+	if tuning.BufSize, err = bufSizeLabel.Get(labels); err != nil {
+		return nil, err
+	}
+	if tuning.Threads, err = threadsLabel.Get(labels); err != nil {
+		return nil, err
+	}
+	if *tuning == (config.Tuning{}) {
+		return nil, nil
+	}
+	return tuning, nil
+}
@@ -0,0 +1,243 @@
+package rancher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+
+	// noRule marks the issues not related to a single rule
+	noRule = -1
+)
+
+var (
+	supportedRuleProtos = map[string]bool{
+		config.HTTPProto:  true,
+		config.HTTPSProto: true,
+		config.TLSProto:   true,
+		config.TCPProto:   true,
+		config.SNIProto:   true,
+	}
+	hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*\.?$`)
+)
+
+// ValidationIssue is a problem found in the lb metadata. Rules with
+// error issues are left out of the config, warnings are only reported
+type ValidationIssue struct {
+	// Rule is the index of the port rule, -1 for lb wide issues
+	Rule       int    `json:"rule"`
+	SourcePort int    `json:"source_port,omitempty"`
+	Field      string `json:"field"`
+	Severity   string `json:"severity"`
+	Message    string `json:"message"`
+}
+
+// ValidationReport is the result of the last validation pass
+type ValidationReport struct {
+	LBName string            `json:"lb_name"`
+	Time   time.Time         `json:"time"`
+	Valid  bool              `json:"valid"`
+	Issues []ValidationIssue `json:"issues"`
+}
+
+type reportHolder struct {
+	mu     sync.RWMutex
+	report *ValidationReport
+}
+
+func (h *reportHolder) set(report *ValidationReport) {
+	h.mu.Lock()
+	h.report = report
+	h.mu.Unlock()
+}
+
+func (h *reportHolder) get() *ValidationReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.report
+}
+
+// GetValidationReport returns the report of the last validation pass,
+// nil when the metadata wasn't validated yet
+func (lbc *LoadBalancerController) GetValidationReport() interface{} {
+	if report := lbc.validationReport.get(); report != nil {
+		return report
+	}
+	return nil
+}
+
+func (r *ValidationReport) add(rule int, sourcePort int, field string, severity string, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, ValidationIssue{
+		Rule:       rule,
+		SourcePort: sourcePort,
+		Field:      field,
+		Severity:   severity,
+		Message:    fmt.Sprintf(format, args...),
+	})
+	if severity == SeverityError {
+		r.Valid = false
+	}
+}
+
+func (r *ValidationReport) ruleFailed(rule int) bool {
+	for _, issue := range r.Issues {
+		if issue.Rule == rule && issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ValidationReport) log() {
+	for _, issue := range r.Issues {
+		entry := logrus.WithFields(logrus.Fields{
+			"lb":          r.LBName,
+			"rule":        issue.Rule,
+			"source_port": issue.SourcePort,
+			"field":       issue.Field,
+		})
+		if issue.Severity == SeverityError {
+			entry.Error(issue.Message)
+		} else {
+			entry.Warn(issue.Message)
+		}
+	}
+}
+
+// ValidateLBMetadata checks all the port rules and certificates of the lb
+// at once, and drops the invalid rules from the metadata so the config
+// is built from the valid ones
+func (lbc *LoadBalancerController) ValidateLBMetadata(lbName string, envUUID string, lbMeta *LBMetadata) *ValidationReport {
+	report := &ValidationReport{
+		LBName: lbName,
+		Time:   time.Now().UTC(),
+		Valid:  true,
+		Issues: []ValidationIssue{},
+	}
+	hasCerts := lbc.validateCertificates(report, lbMeta)
+	for i, rule := range lbMeta.PortRules {
+		lbc.validateRule(report, i, rule, envUUID, lbMeta, hasCerts)
+	}
+
+	var valid []metadata.PortRule
+	for i, rule := range lbMeta.PortRules {
+		if !report.ruleFailed(i) {
+			valid = append(valid, rule)
+		}
+	}
+	lbMeta.PortRules = valid
+	return report
+}
+
+func (lbc *LoadBalancerController) validateCertificates(report *ValidationReport, lbMeta *LBMetadata) bool {
+	defCerts, err := lbc.CertFetcher.FetchCertificates(lbMeta, true)
+	if err != nil {
+		report.add(noRule, 0, "default_certificate_id", SeverityError, "Failed to fetch default certificate: %v", err)
+		return false
+	}
+	certs, err := lbc.CertFetcher.FetchCertificates(lbMeta, false)
+	if err != nil {
+		report.add(noRule, 0, "certificate_ids", SeverityError, "Failed to fetch certificates: %v", err)
+		return false
+	}
+	// the config is built from the fetched certificates
+	lbMeta.fetchedCerts = &fetchedCerts{defaultCerts: defCerts, certs: certs}
+	return len(defCerts)+len(certs) > 0
+}
+
+func (lbc *LoadBalancerController) validateRule(report *ValidationReport, i int, rule metadata.PortRule, envUUID string, lbMeta *LBMetadata, hasCerts bool) {
+	if rule.SourcePort < 1 || rule.SourcePort > 65535 {
+		report.add(i, rule.SourcePort, "source_port", SeverityError, "Source port %v is out of 1-65535 range", rule.SourcePort)
+	}
+	protocol := strings.ToLower(rule.Protocol)
+	if !supportedRuleProtos[protocol] {
+		report.add(i, rule.SourcePort, "protocol", SeverityError, "Unsupported protocol [%s]", rule.Protocol)
+	}
+	if rule.Hostname != "" {
+		if !isHTTPProto(protocol) && protocol != config.SNIProto {
+			report.add(i, rule.SourcePort, "hostname", SeverityWarning, "Hostname is ignored for protocol %s", rule.Protocol)
+		} else if !isValidRuleHostname(rule.Hostname) {
+			report.add(i, rule.SourcePort, "hostname", SeverityError, "Invalid hostname [%s]", rule.Hostname)
+		}
+	}
+	if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+		report.add(i, rule.SourcePort, "path", SeverityWarning, "Path [%s] doesn't start with /", rule.Path)
+	}
+	if (protocol == config.HTTPSProto || protocol == config.TLSProto) && !hasCerts {
+		report.add(i, rule.SourcePort, "protocol", SeverityWarning, "No certificates found for %s rule", rule.Protocol)
+	}
+	if lbMeta.Redirects[rule.BackendName] != nil {
+		// redirects are answered by the lb, there is no target to check
+		return
+	}
+	if rule.TargetPort < 0 || rule.TargetPort > 65535 {
+		report.add(i, rule.SourcePort, "target_port", SeverityError, "Target port %v is out of 1-65535 range", rule.TargetPort)
+	} else if rule.TargetPort == 0 && !lbMeta.InferTargetPort {
+		report.add(i, rule.SourcePort, "target_port", SeverityError, "Target port is not set")
+	}
+	switch remote := lbMeta.RemoteTargets[rule.BackendName]; {
+	case remote != nil:
+		if err := lbMeta.TargetScope.allowsRemote(remote); err != nil {
+			report.add(i, rule.SourcePort, "backend_name", SeverityError, "Remote service [%s] can't be targeted: %v", remote, err)
+			return
+		}
+		service, err := lbc.MetaFetcher.GetService(remote.EnvironmentUUID, remote.ServiceName, remote.StackName)
+		if err != nil {
+			report.add(i, rule.SourcePort, "backend_name", SeverityWarning, "Failed to look up remote service [%s]: %v", remote, err)
+		} else if service == nil {
+			report.add(i, rule.SourcePort, "backend_name", SeverityError, "Remote service [%s] is not found", remote)
+		} else if !IsActiveService(service) {
+			report.add(i, rule.SourcePort, "backend_name", SeverityWarning, "Remote service [%s] is not active", remote)
+		}
+	case rule.Service != "":
+		stackName, svcName, sidekick, err := splitRuleService(rule.Service)
+		if err != nil {
+			report.add(i, rule.SourcePort, "service", SeverityError, "%v", err)
+			return
+		}
+		if err := lbMeta.TargetScope.Allows(envUUID, stackName); err != nil {
+			report.add(i, rule.SourcePort, "service", SeverityError, "Service [%s] can't be targeted: %v", rule.Service, err)
+			return
+		}
+		service, err := lbc.getRuleService(envUUID, stackName, svcName, sidekick)
+		if err != nil {
+			// lookup failures are retried by the build, the rule is kept
+			report.add(i, rule.SourcePort, "service", SeverityWarning, "Failed to look up service [%s]: %v", rule.Service, err)
+		} else if service == nil {
+			report.add(i, rule.SourcePort, "service", SeverityError, "Service [%s] is not found", rule.Service)
+		} else if !IsActiveService(service) {
+			report.add(i, rule.SourcePort, "service", SeverityWarning, "Service [%s] is not active", rule.Service)
+		}
+	case rule.ContainerUUID != "":
+		container, err := lbc.MetaFetcher.GetContainer(envUUID, rule.ContainerUUID)
+		if err != nil {
+			report.add(i, rule.SourcePort, "container_uuid", SeverityWarning, "Failed to look up container [%s]: %v", rule.ContainerUUID, err)
+		} else if container == nil {
+			report.add(i, rule.SourcePort, "container_uuid", SeverityError, "Container [%s] is not found", rule.ContainerUUID)
+		} else if err := lbMeta.TargetScope.Allows(envUUID, container.StackName); err != nil {
+			report.add(i, rule.SourcePort, "container_uuid", SeverityError, "Container [%s] can't be targeted: %v", rule.ContainerUUID, err)
+		}
+	default:
+		report.add(i, rule.SourcePort, "service", SeverityError, "Rule has no target service or container")
+	}
+}
+
+// isValidRuleHostname allows a wildcard at the beginning or the end of the hostname
+func isValidRuleHostname(hostname string) bool {
+	if strings.HasPrefix(hostname, "*") {
+		hostname = strings.TrimPrefix(hostname[1:], ".")
+	} else if strings.HasSuffix(hostname, "*") {
+		hostname = strings.TrimSuffix(hostname[:len(hostname)-1], ".")
+	}
+	return hostname == "" || hostnameRegexp.MatchString(hostname)
+}
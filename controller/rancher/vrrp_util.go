@@ -0,0 +1,87 @@
+package rancher
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	vrrpVirtualIPsLabel = "io.rancher.lb_service.vrrp_virtual_ips"
+	// vrrpPriorityLabel is set on the hosts
+	vrrpPriorityLabel   = "io.rancher.lb_service.vrrp_priority"
+	defaultVRRPPriority = 100
+)
+
+var vrrpRouterID = flags.LabelInt("io.rancher.lb_service.vrrp_router_id", 51, "Virtual router id of the vrrp the virtual ips float over, unique among the lbs of the network").Range(1, 255)
+
+/*
+getVRRP reads the virtual ips the instances of the lb float between:
+
+io.rancher.lb_service.vrrp_virtual_ips=10.0.0.100,10.0.0.101
+
+The instances reach each other at the agent ips of their hosts. The
+priority of an instance is the io.rancher.lb_service.vrrp_priority
+label of its host, 1 to 254, so the virtual ips prefer the hosts
+with the highest one. Nil is returned when the label isn't set
+*/
+func (lbc *LoadBalancerController) getVRRP(lbSvc metadata.Service) (*config.VRRP, error) {
+	virtualIPs, err := getIPsLabel(lbSvc.Labels, vrrpVirtualIPsLabel)
+	if err != nil || len(virtualIPs) == 0 {
+		return nil, err
+	}
+	vrrp := &config.VRRP{VirtualIPs: virtualIPs}
+	if vrrp.RouterID, err = vrrpRouterID.Get(lbSvc.Labels); err != nil {
+		return nil, err
+	}
+	selfHost, err := lbc.MetaFetcher.GetSelfHost()
+	if err != nil {
+		return nil, err
+	}
+	vrrp.SelfIP = selfHost.AgentIP
+	vrrp.Priority = getVRRPPriority(&selfHost)
+
+	hosts := map[string]bool{selfHost.UUID: true}
+	for _, c := range lbSvc.Containers {
+		if !strings.EqualFold(c.State, "running") && !strings.EqualFold(c.State, "starting") {
+			continue
+		}
+		if c.HostUUID == "" || hosts[c.HostUUID] {
+			continue
+		}
+		hosts[c.HostUUID] = true
+		host, err := lbc.MetaFetcher.GetHost(c.HostUUID)
+		if err != nil {
+			return nil, err
+		}
+		if host == nil || host.AgentIP == "" {
+			continue
+		}
+		vrrp.Peers = append(vrrp.Peers, &config.VRRPPeer{
+			IP:       host.AgentIP,
+			Priority: getVRRPPriority(host),
+		})
+	}
+	sort.Slice(vrrp.Peers, func(i, j int) bool {
+		return vrrp.Peers[i].IP < vrrp.Peers[j].IP
+	})
+	return vrrp, nil
+}
+
+func getVRRPPriority(host *metadata.Host) int {
+	val := strings.TrimSpace(host.Labels[vrrpPriorityLabel])
+	if val == "" {
+		return defaultVRRPPriority
+	}
+	priority, err := strconv.Atoi(val)
+	if err != nil || priority < 1 || priority > 254 {
+		logrus.Warnf("Invalid label value for label %s=%s of host %s, using priority %v", vrrpPriorityLabel, val, host.Name, defaultVRRPPriority)
+		return defaultVRRPPriority
+	}
+	return priority
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/rancher/lb-controller/controller"
 	"github.com/rancher/lb-controller/controller/rancher"
 	"github.com/rancher/lb-controller/provider"
+	"github.com/rancher/lb-controller/publicip"
 	utils "github.com/rancher/lb-controller/utils"
 	"reflect"
 	"sort"
@@ -55,8 +56,13 @@ type glbController struct {
 	metaFetcher                MetadataFetcher
 	rancherController          *rancher.LoadBalancerController
 	endpointsCache             *cache.Cache
+	publicIPResolver           publicip.Resolver
 }
 
+// publicIPsLabel maps agent ips of the glb hosts to their public ips,
+// in 10.0.0.1=52.1.1.1,10.0.0.2=52.1.1.2 format
+const publicIPsLabel = "io.rancher.lb_service.public_ips"
+
 type MetadataFetcher interface {
 	GetSelfService() (metadata.Service, error)
 	GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error)
@@ -76,12 +82,18 @@ func newGLBController() (*glbController, error) {
 
 	c := cache.New(1*time.Hour, 1*time.Minute)
 
+	resolver, err := publicip.NewResolverFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	glb := &glbController{
 		stopCh:                     make(chan struct{}),
 		incrementalBackoff:         0,
 		incrementalBackoffInterval: 5,
 		rancherController:          lbc,
 		endpointsCache:             c,
+		publicIPResolver:           resolver,
 	}
 	glb.syncQueue = utils.NewTaskQueue(glb.sync)
 
@@ -130,6 +142,20 @@ func (lbc *glbController) GetGLBConfigs(glbSvc metadata.Service) ([]*config.Load
 		return nil, err
 	}
 
+	scope, err := rancher.GetTargetScope(glbSvc.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := lbc.getPublicIPResolver(glbSvc)
+	if err != nil {
+		return nil, err
+	}
+	selfHostUUID, err := lbc.rancherController.MetaFetcher.GetSelfHostUUID()
+	if err != nil {
+		return nil, err
+	}
+
 	var lbSvcs []metadata.Service
 	svcs, err := lbc.metaFetcher.GetServices()
 	if err != nil {
@@ -150,6 +176,10 @@ func (lbc *glbController) GetGLBConfigs(glbSvc metadata.Service) ([]*config.Load
 			if !rancher.IsSelectorMatch(glbRule.Selector, lbSvc.Labels) {
 				continue
 			}
+			if err := scope.Allows(lbSvc.EnvironmentUUID, lbSvc.StackName); err != nil {
+				logrus.Errorf("Skipping lb [%s/%s] selected by the rule for source port %v: %v", lbSvc.StackName, lbSvc.Name, glbRule.SourcePort, err)
+				continue
+			}
 
 			if !rancher.IsActiveService(&lbSvc) {
 				// cleanup public endpoints
@@ -186,7 +216,7 @@ func (lbc *glbController) GetGLBConfigs(glbSvc metadata.Service) ([]*config.Load
 			configs = append(configs, cs...)
 
 			//update endpoints
-			eps, err := getEndpoints(&glbSvc, sourcePort)
+			eps, err := getEndpoints(&glbSvc, sourcePort, proto, selfHostUUID, resolver)
 			if err != nil {
 				return nil, err
 			}
@@ -227,11 +257,43 @@ func (lbc *glbController) updateEndpoints(lbSvc *metadata.Service, eps []client.
 	return nil
 }
 
-func getEndpoints(glbSvc *metadata.Service, lbPort int) ([]client.PublicEndpoint, error) {
+// getPublicIPResolver prefers the static map from the glb labels
+// over the resolvers configured for the controller
+func (lbc *glbController) getPublicIPResolver(glbSvc metadata.Service) (publicip.Resolver, error) {
+	var resolvers publicip.Chain
+	if value, ok := glbSvc.Labels[publicIPsLabel]; ok {
+		static, err := publicip.ParseStaticMap(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label value for label %s=%s: %v", publicIPsLabel, value, err)
+		}
+		resolvers = append(resolvers, static)
+	}
+	if lbc.publicIPResolver != nil {
+		resolvers = append(resolvers, lbc.publicIPResolver)
+	}
+	return resolvers, nil
+}
+
+// getEndpoints returns the public endpoints of the glb containers publishing
+// the port, over the transport protocol of the lb protocol
+func getEndpoints(glbSvc *metadata.Service, lbPort int, lbProto string, selfHostUUID string, resolver publicip.Resolver) ([]client.PublicEndpoint, error) {
 	var publicEndpoints []client.PublicEndpoint
+	transport := provider.TransportProtocol(lbProto)
 	for _, c := range glbSvc.Containers {
 		for _, port := range c.Ports {
+			// ip:public port:private port[/protocol]
+			proto := provider.ProtocolTCP
+			if i := strings.LastIndex(port, "/"); i >= 0 {
+				port, proto = port[:i], strings.ToLower(port[i+1:])
+			}
 			splitted := strings.Split(port, ":")
+			if len(splitted) < 2 {
+				logrus.Warnf("Skipping port [%s] in unexpected format", port)
+				continue
+			}
+			if proto != transport {
+				continue
+			}
 			port, err := strconv.Atoi(splitted[1])
 			if err != nil {
 				return nil, err
@@ -240,8 +302,17 @@ func getEndpoints(glbSvc *metadata.Service, lbPort int) ([]client.PublicEndpoint
 				logrus.Infof("ports are diff, %v and %v", port, lbPort)
 				continue
 			}
+			ip := splitted[0]
+			if resolver != nil {
+				publicIP, err := resolver.Resolve(ip, c.HostUUID != "" && c.HostUUID == selfHostUUID)
+				if err != nil {
+					logrus.Warnf("Failed to resolve public ip of host [%s]: %v", ip, err)
+				} else if publicIP != "" {
+					ip = publicIP
+				}
+			}
 			pE := client.PublicEndpoint{
-				IpAddress: splitted[0],
+				IpAddress: ip,
 				Port:      int64(port),
 			}
 			publicEndpoints = append(publicEndpoints, pE)
@@ -278,6 +349,9 @@ func (lbc *glbController) mergeConfigs(glbSvc metadata.Service, configs []*confi
 			if existing == nil {
 				existing = be
 			} else {
+				if existing.Environment != be.Environment {
+					logrus.Warnf("Backend [%s] of port %v merges the rules of environments [%s] and [%s]", existing.UUID, fe.Port, existing.Environment, be.Environment)
+				}
 				existing.Endpoints = append(existing.Endpoints, be.Endpoints...)
 			}
 			bes[pathUUID] = existing
@@ -291,6 +365,7 @@ func (lbc *glbController) mergeConfigs(glbSvc metadata.Service, configs []*confi
 
 	// 3. sort frontends and backends
 	var frontends config.FrontendServices
+	prefixEnvironments(frontendsMap)
 	for _, v := range frontendsMap {
 		// sort endpoints
 		for _, b := range v.BackendServices {
@@ -315,18 +390,17 @@ func (lbc *glbController) mergeConfigs(glbSvc metadata.Service, configs []*confi
 	if err != nil {
 		return nil, err
 	}
-	if len(defCerts) > 0 {
+	if defCerts = rancher.CopyCertificates(defCerts); len(defCerts) > 0 {
 		defaultCert = defCerts[0]
-		if defaultCert != nil {
-			certs = append(certs, defaultCert)
-		}
+		certs = append(certs, defaultCert)
 	}
 
 	alternateCerts, err := lbc.rancherController.CertFetcher.FetchCertificates(glbMeta, false)
 	if err != nil {
 		return nil, err
 	}
-	certs = append(certs, alternateCerts...)
+	certs = append(certs, rancher.CopyCertificates(alternateCerts)...)
+	rancher.BundleCertificates(certs)
 
 	lbConfig := &config.LoadBalancerConfig{
 		Name:             glbSvc.Name,
@@ -334,6 +408,9 @@ func (lbc *glbController) mergeConfigs(glbSvc metadata.Service, configs []*confi
 		Certs:            certs,
 		DefaultCert:      defaultCert,
 		StickinessPolicy: &glbMeta.StickinessPolicy,
+		Hardening:        glbMeta.Hardening,
+		StripHeaders:     glbMeta.StripHeaders,
+		Tuning:           glbMeta.Tuning,
 	}
 
 	merged = append(merged, lbConfig)
@@ -341,6 +418,33 @@ func (lbc *glbController) mergeConfigs(glbSvc metadata.Service, configs []*confi
 	return merged, nil
 }
 
+/*
+prefixEnvironments names the backends after their environment when the
+glb serves several environments, so the backends of the environments,
+their stick-tables and their stats don't mix, as 1a5::api. The frontends
+are shared by the environments
+*/
+func prefixEnvironments(frontends map[string]*config.FrontendService) {
+	environments := map[string]bool{}
+	for _, fe := range frontends {
+		for _, be := range fe.BackendServices {
+			if be.Environment != "" {
+				environments[be.Environment] = true
+			}
+		}
+	}
+	if len(environments) < 2 {
+		return
+	}
+	for _, fe := range frontends {
+		for _, be := range fe.BackendServices {
+			if be.Environment != "" && !strings.Contains(be.UUID, config.EnvironmentSeparator) {
+				be.UUID = config.EnvironmentName(be.Environment, be.UUID)
+			}
+		}
+	}
+}
+
 func (lbc *glbController) Run(provider provider.LBProvider) {
 	logrus.Infof("starting %s controller", lbc.GetName())
 	lbc.lbProvider = provider
@@ -354,6 +458,10 @@ func (lbc *glbController) Run(provider provider.LBProvider) {
 	<-lbc.stopCh
 }
 
+func (lbc *glbController) GetQueueDepth() int {
+	return lbc.syncQueue.Len()
+}
+
 func (lbc *glbController) Stop() error {
 	if !lbc.shutdown {
 		logrus.Infof("Shutting down %s controller", lbc.GetName())
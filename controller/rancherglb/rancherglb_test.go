@@ -11,6 +11,7 @@ import (
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/lb-controller/config"
 	"github.com/rancher/lb-controller/controller/rancher"
+	"github.com/rancher/lb-controller/provider"
 	utils "github.com/rancher/lb-controller/utils"
 )
 
@@ -194,6 +195,14 @@ func TestInactiveLB(t *testing.T) {
 	}
 }
 
+func (mf tMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	return metadata.Host{}, nil
+}
+
+func (mf tMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	return nil, nil
+}
+
 func (mf tMetaFetcher) GetSelfHostUUID() (string, error) {
 	return "", nil
 }
@@ -531,8 +540,8 @@ func (p *tProvider) GetName() string {
 	return ""
 }
 
-func (p *tProvider) GetPublicEndpoints(configName string) []string {
-	return []string{}
+func (p *tProvider) GetPublicEndpoints(configName string) []provider.PublicEndpoint {
+	return []provider.PublicEndpoint{}
 }
 
 func (p *tProvider) CleanupConfig(configName string) error {
@@ -553,3 +562,63 @@ func (p *tProvider) IsHealthy() bool {
 func (p *tProvider) ProcessCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error {
 	return nil
 }
+
+func TestGetEndpointsPublicIP(t *testing.T) {
+	glbSvc := &metadata.Service{
+		Labels: map[string]string{publicIPsLabel: "10.0.0.1=52.1.1.1"},
+		Containers: []metadata.Container{
+			{HostUUID: "host1", Ports: []string{"10.0.0.1:80:80/tcp"}},
+			{HostUUID: "host2", Ports: []string{"10.0.0.2:80:80/tcp", "10.0.0.2:80:80/udp"}},
+		},
+	}
+	resolver, err := glb.getPublicIPResolver(*glbSvc)
+	if err != nil {
+		t.Fatalf("Failed to get resolver: %v", err)
+	}
+	eps, err := getEndpoints(glbSvc, 80, "http", "host2", resolver)
+	if err != nil {
+		t.Fatalf("Failed to get endpoints: %v", err)
+	}
+	if len(eps) != 2 {
+		t.Fatalf("Incorrect number of endpoints, expected 2, actual: %v", len(eps))
+	}
+	if eps[0].IpAddress != "52.1.1.1" || eps[1].IpAddress != "10.0.0.2" {
+		t.Fatalf("Invalid endpoint ips %v, %v", eps[0].IpAddress, eps[1].IpAddress)
+	}
+	eps, err = getEndpoints(glbSvc, 80, "udp", "host2", resolver)
+	if err != nil || len(eps) != 1 || eps[0].IpAddress != "10.0.0.2" || eps[0].Port != 80 {
+		t.Fatalf("Only the udp port should be published for the udp rule %v %v", eps, err)
+	}
+}
+
+func TestPrefixEnvironments(t *testing.T) {
+	frontends := map[string]*config.FrontendService{
+		"80": {
+			Name: "80",
+			Port: 80,
+			BackendServices: []*config.BackendService{
+				{UUID: "api", Host: "a.com", Environment: "1a5"},
+				{UUID: "api", Host: "b.com", Environment: "1a7"},
+			},
+		},
+	}
+	prefixEnvironments(frontends)
+	bes := frontends["80"].BackendServices
+	if bes[0].UUID != "1a5::api" || bes[1].UUID != "1a7::api" {
+		t.Fatalf("The backends of the environments should be prefixed, got %s %s", bes[0].UUID, bes[1].UUID)
+	}
+	prefixEnvironments(frontends)
+	if bes[0].UUID != "1a5::api" {
+		t.Fatalf("The backends should be prefixed once, got %s", bes[0].UUID)
+	}
+
+	// the backends of a single environment keep their names
+	frontends["80"].BackendServices = []*config.BackendService{
+		{UUID: "api", Host: "a.com", Environment: "1a5"},
+		{UUID: "web", Host: "b.com", Environment: "1a5"},
+	}
+	prefixEnvironments(frontends)
+	if frontends["80"].BackendServices[0].UUID != "api" {
+		t.Fatalf("The backends of a single environment should not be prefixed, got %s", frontends["80"].BackendServices[0].UUID)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/controller"
+)
+
+var (
+	pprofEnabled         = flags.Bool("DEBUG_PPROF", false, "Serve the pprof endpoints under /debug/pprof/ on the healthcheck port, as admin routes")
+	runtimeStatsInterval = flags.Duration("RUNTIME_STATS_INTERVAL", 0, "Interval the runtime stats are logged at, 0 disables them")
+	stateDumpDir         = flags.String("STATE_DUMP_DIR", "/tmp", "Dir the state dumps are written to on SIGUSR1 or from the admin api")
+)
+
+func registerPprof() {
+	if !pprofEnabled.Get() {
+		return
+	}
+	logrus.Warn("Serving pprof endpoints on the healthcheck port")
+	router.HandleFunc("/debug/pprof/cmdline", adminOnly(pprof.Cmdline)).Methods("GET")
+	router.HandleFunc("/debug/pprof/profile", adminOnly(pprof.Profile)).Methods("GET")
+	router.HandleFunc("/debug/pprof/symbol", adminOnly(pprof.Symbol)).Methods("GET", "POST")
+	router.HandleFunc("/debug/pprof/trace", adminOnly(pprof.Trace)).Methods("GET")
+	// the index serves the named profiles, as heap or goroutine
+	router.PathPrefix("/debug/pprof/").HandlerFunc(adminOnly(pprof.Index)).Methods("GET")
+}
+
+// logRuntimeStats logs the goroutines, heap, gc and sync queue
+// stats every interval, so memory growth can be followed in the logs
+func logRuntimeStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		logrus.WithFields(runtimeStats()).Info("Runtime stats")
+	}
+}
+
+func runtimeStats() logrus.Fields {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fields := logrus.Fields{
+		"goroutines":     runtime.NumGoroutine(),
+		"heap_alloc":     m.HeapAlloc,
+		"heap_inuse":     m.HeapInuse,
+		"heap_objects":   m.HeapObjects,
+		"sys":            m.Sys,
+		"num_gc":         m.NumGC,
+		"gc_pause_total": time.Duration(m.PauseTotalNs).String(),
+	}
+	if m.NumGC > 0 {
+		fields["gc_pause_last"] = time.Duration(m.PauseNs[(m.NumGC+255)%256]).String()
+	}
+	if reporter, ok := lbc.(controller.QueueReporter); ok {
+		fields["sync_queue_depth"] = reporter.GetQueueDepth()
+	}
+	return fields
+}
+
+// stateDump is the internal state of the controller, along with
+// the runtime stats, for the offline debugging of a stuck controller
+func stateDump() map[string]interface{} {
+	dump := map[string]interface{}{
+		"time":       time.Now(),
+		"controller": lbc.GetName(),
+		"provider":   lbp.GetName(),
+		"runtime":    runtimeStats(),
+	}
+	if dumper, ok := lbc.(controller.StateDumper); ok {
+		dump["state"] = dumper.DumpState()
+	}
+	return dump
+}
+
+// writeStateDump writes the state dump to a new file of the
+// dump dir, the path of the file is returned
+func writeStateDump() (string, error) {
+	b, err := json.MarshalIndent(stateDump(), "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Failed to encode state dump: %v", err)
+	}
+	path := filepath.Join(stateDumpDir.Get(), fmt.Sprintf("lb-controller-state-%s.json", time.Now().Format("20060102T150405.000")))
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return "", fmt.Errorf("Failed to write state dump: %v", err)
+	}
+	return path, nil
+}
+
+// handleStateDumpSignal writes a state dump on every SIGUSR1
+func handleStateDumpSignal() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGUSR1)
+	for range signalChan {
+		path, err := writeStateDump()
+		if err != nil {
+			logrus.Errorf("%v", err)
+			continue
+		}
+		logrus.Infof("Received SIGUSR1, state dumped to %s", path)
+	}
+}
+
+// dumpState serves the state dump, POST writes it to the dump dir
+// and answers with the path of the file
+func dumpState(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		path, err := writeStateDump()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logrus.Infof("State dumped to %s", path)
+		w.Write([]byte(path))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stateDump()); err != nil {
+		logrus.Errorf("Failed to write state dump: %v", err)
+	}
+}
+
+// metadataSnapshot serves the metadata the configs last applied were
+// built from, the configs are rebuilt from it by the replay command. The
+// snapshot holds the labels of the environment, so the token is required
+func metadataSnapshot(w http.ResponseWriter, req *http.Request) {
+	snapshotter, ok := lbc.(controller.MetadataSnapshotter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't record metadata snapshots", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	snapshot := snapshotter.GetMetadataSnapshot()
+	if snapshot == nil {
+		http.Error(w, "No config is applied yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		logrus.Errorf("Failed to write metadata snapshot: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package dnssync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+type cloudflareProvider struct {
+	zone   string
+	zoneID string
+	token  string
+	api    string
+	client *http.Client
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+func newCloudflareProviderFromEnv(zone string) (*cloudflareProvider, error) {
+	token := cloudflareToken.Get()
+	if token == "" {
+		return nil, fmt.Errorf("CF_API_TOKEN is not set")
+	}
+	return &cloudflareProvider{
+		zone:   zone,
+		token:  token,
+		api:    cloudflareAPI,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (p *cloudflareProvider) GetName() string {
+	return "cloudflare"
+}
+
+func (p *cloudflareProvider) Records() ([]Record, error) {
+	records, err := p.listRecords(url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	grouped := map[string]*Record{}
+	result := []Record{}
+	for _, r := range records {
+		if r.Type != ARecord && r.Type != TXTRecord {
+			continue
+		}
+		key := r.Type + " " + normalizeName(r.Name)
+		if existing, ok := grouped[key]; ok {
+			existing.Targets = append(existing.Targets, r.Content)
+			continue
+		}
+		grouped[key] = &Record{
+			Name:    normalizeName(r.Name),
+			Type:    r.Type,
+			TTL:     r.TTL,
+			Targets: []string{r.Content},
+		}
+	}
+	for _, key := range sortedKeys(grouped) {
+		result = append(result, *grouped[key])
+	}
+	return result, nil
+}
+
+// ApplyChanges replaces all values of the upserted records, as cloudflare
+// keeps a separate record for every value of the record set
+func (p *cloudflareProvider) ApplyChanges(changes *Changes) error {
+	for _, r := range changes.Delete {
+		if err := p.deleteRecords(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range changes.Upsert {
+		if err := p.deleteRecords(r); err != nil {
+			return err
+		}
+		for _, target := range r.Targets {
+			record := cloudflareRecord{
+				Type:    r.Type,
+				Name:    r.Name,
+				Content: target,
+				TTL:     r.TTL,
+			}
+			zoneID, err := p.getZoneID()
+			if err != nil {
+				return err
+			}
+			if _, err := p.do("POST", fmt.Sprintf("/zones/%s/dns_records", zoneID), record, nil); err != nil {
+				return fmt.Errorf("Failed to create %s record %s: %v", r.Type, r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) deleteRecords(r Record) error {
+	zoneID, err := p.getZoneID()
+	if err != nil {
+		return err
+	}
+	records, err := p.listRecords(url.Values{"type": {r.Type}, "name": {r.Name}})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, err := p.do("DELETE", fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, record.ID), nil, nil); err != nil {
+			return fmt.Errorf("Failed to delete %s record %s: %v", r.Type, r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) listRecords(query url.Values) ([]cloudflareRecord, error) {
+	zoneID, err := p.getZoneID()
+	if err != nil {
+		return nil, err
+	}
+	records := []cloudflareRecord{}
+	query.Set("per_page", "100")
+	for page := 1; ; page++ {
+		query.Set("page", fmt.Sprintf("%v", page))
+		result := []cloudflareRecord{}
+		resp, err := p.do("GET", fmt.Sprintf("/zones/%s/dns_records?%s", zoneID, query.Encode()), nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, result...)
+		if resp.ResultInfo.Page >= resp.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+func (p *cloudflareProvider) getZoneID() (string, error) {
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+	zones := []struct {
+		ID string `json:"id"`
+	}{}
+	if _, err := p.do("GET", "/zones?"+url.Values{"name": {p.zone}}.Encode(), nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("Zone %s is not found", p.zone)
+	}
+	p.zoneID = zones[0].ID
+	return p.zoneID, nil
+}
+
+func (p *cloudflareProvider) do(method string, path string, body interface{}, result interface{}) (*cloudflareResponse, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, p.api+path, &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	cfResp := &cloudflareResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cfResp); err != nil {
+		return nil, fmt.Errorf("Failed to parse cloudflare response, status %s: %v", resp.Status, err)
+	}
+	if !cfResp.Success {
+		if len(cfResp.Errors) > 0 {
+			return nil, fmt.Errorf("cloudflare error %v: %s", cfResp.Errors[0].Code, cfResp.Errors[0].Message)
+		}
+		return nil, fmt.Errorf("cloudflare request failed with status %s", resp.Status)
+	}
+	if result != nil {
+		if err := json.Unmarshal(cfResp.Result, result); err != nil {
+			return nil, err
+		}
+	}
+	return cfResp, nil
+}
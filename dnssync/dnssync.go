@@ -0,0 +1,327 @@
+/*
+Package dnssync registers the hostnames of the lb rules in an external
+DNS provider, pointing them at the public endpoints of the lb.
+
+Every record managed by the syncer is paired with a TXT record holding
+the owner id, so records created by other tools are never modified and
+the records of the hosts gone from the rules get removed, even across
+controller restarts.
+*/
+package dnssync
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+// supported record types
+const (
+	ARecord   = "A"
+	TXTRecord = "TXT"
+)
+
+var (
+	syncProvider = flags.String("DNS_SYNC_PROVIDER", "", "DNS provider the hostnames of the lb rules are registered in, route53, cloudflare or rfc2136")
+	syncZone     = flags.String("DNS_SYNC_ZONE", "", "DNS zone the hostnames are registered in, the hostnames outside of it are skipped")
+	syncOwnerID  = flags.String("DNS_SYNC_OWNER_ID", "rancher-lb", "Owner id of the records managed by the lb, the records of other owners are never modified")
+	syncTTL      = flags.Int("DNS_SYNC_TTL", 300, "TTL in seconds of the records").Range(1, 604800)
+	syncTargets  = flags.String("DNS_SYNC_TARGETS", "", "Comma separated list of the addresses the records point at, instead of the public endpoints of the lb")
+
+	cloudflareToken     = flags.Secret("CF_API_TOKEN", "Api token of the cloudflare DNS provider")
+	rfc2136Server       = flags.String("RFC2136_SERVER", "", "Address of the name server the rfc2136 DNS provider updates, the port defaults to 53")
+	rfc2136TSIGKey      = flags.Secret("RFC2136_TSIG_KEY", "TSIG key of the rfc2136 updates, as [hmac:]name:secret")
+	rfc2136TSIGKeyFile  = flags.String("RFC2136_TSIG_KEYFILE", "", "File of the TSIG key of the rfc2136 updates")
+	route53HostedZoneID = flags.String("ROUTE53_HOSTED_ZONE_ID", "", "Id of the route53 hosted zone of the DNS_SYNC_ZONE")
+)
+
+// Record is a DNS record set; the name is fully qualified,
+// lowercased and has no trailing dot
+type Record struct {
+	Name    string
+	Type    string
+	TTL     int
+	Targets []string
+}
+
+// Changes are applied by the provider in a single batch when possible
+type Changes struct {
+	Upsert []Record
+	Delete []Record
+}
+
+// Provider manages records of a single DNS zone
+type Provider interface {
+	GetName() string
+	Records() ([]Record, error)
+	ApplyChanges(changes *Changes) error
+}
+
+// EndpointsGetter returns public endpoints of the lb config
+type EndpointsGetter interface {
+	GetPublicEndpoints(configName string) []provider.PublicEndpoint
+}
+
+// Syncer keeps the zone records in sync with the hostnames of the applied
+// lb configs. It is invoked as an apply hook of the lb provider
+type Syncer struct {
+	Provider  Provider
+	Endpoints EndpointsGetter
+	Zone      string
+	OwnerID   string
+	TTL       int
+	// Targets override public endpoints reported by the lb provider
+	Targets []string
+
+	mu     sync.Mutex
+	hosts  map[string][]string
+	synced map[string][]string
+}
+
+// NewSyncerFromEnv configures the syncer from DNS_SYNC_* env vars.
+// Nil is returned when DNS_SYNC_PROVIDER is not set
+func NewSyncerFromEnv(endpoints EndpointsGetter) (*Syncer, error) {
+	providerName := syncProvider.Get()
+	if providerName == "" {
+		return nil, nil
+	}
+	zone := normalizeName(syncZone.Get())
+	if zone == "" {
+		return nil, fmt.Errorf("DNS_SYNC_ZONE is not set")
+	}
+	s := &Syncer{
+		Endpoints: endpoints,
+		Zone:      zone,
+		OwnerID:   syncOwnerID.Get(),
+		TTL:       syncTTL.Get(),
+	}
+	for _, target := range strings.Split(syncTargets.Get(), ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			s.Targets = append(s.Targets, target)
+		}
+	}
+
+	var err error
+	switch providerName {
+	case "route53":
+		s.Provider, err = newRoute53ProviderFromEnv(zone)
+	case "cloudflare":
+		s.Provider, err = newCloudflareProviderFromEnv(zone)
+	case "rfc2136":
+		s.Provider, err = newRFC2136ProviderFromEnv(zone)
+	default:
+		err = fmt.Errorf("Unsupported DNS_SYNC_PROVIDER %s, supported providers are route53, cloudflare and rfc2136", providerName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PreApply is a no-op, records are synced once the config is applied
+func (s *Syncer) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply syncs the hostnames of the applied config
+func (s *Syncer) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	targets := s.Targets
+	if len(targets) == 0 && s.Endpoints != nil {
+		targets = provider.PublicEndpointIPs(s.Endpoints.GetPublicEndpoints(lbConfig.Name))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = map[string][]string{}
+	}
+	hosts := s.getHostnames(lbConfig)
+	if len(targets) == 0 {
+		logrus.Infof("No public endpoints found for lb [%s], skipping dns sync", lbConfig.Name)
+		return nil
+	}
+	for _, host := range hosts {
+		s.hosts[host] = mergeTargets(s.hosts[host], lbConfig.Name, targets)
+	}
+	s.forgetConfig(lbConfig.Name, hosts)
+	return s.sync()
+}
+
+// PostCleanup removes the records of the config hostnames
+func (s *Syncer) PostCleanup(configName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetConfig(configName, nil)
+	return s.sync()
+}
+
+func (s *Syncer) sync() error {
+	desired := s.desiredRecords()
+	if s.synced != nil && reflect.DeepEqual(desired, s.synced) {
+		return nil
+	}
+	current, err := s.Provider.Records()
+	if err != nil {
+		return fmt.Errorf("Failed to list %s records: %v", s.Provider.GetName(), err)
+	}
+	changes := s.plan(desired, current)
+	if len(changes.Upsert) > 0 || len(changes.Delete) > 0 {
+		logrus.Infof("Syncing %s records of zone %s: %v upserts, %v deletes", s.Provider.GetName(), s.Zone, len(changes.Upsert), len(changes.Delete))
+		if err := s.Provider.ApplyChanges(changes); err != nil {
+			return fmt.Errorf("Failed to apply %s changes: %v", s.Provider.GetName(), err)
+		}
+	}
+	s.synced = desired
+	return nil
+}
+
+func (s *Syncer) plan(desired map[string][]string, current []Record) *Changes {
+	changes := &Changes{}
+	ownerValue := s.ownerValue()
+	owned := map[string]bool{}
+	existing := map[string]Record{}
+	txts := map[string]Record{}
+	for _, r := range current {
+		switch r.Type {
+		case ARecord:
+			existing[r.Name] = r
+		case TXTRecord:
+			for _, t := range r.Targets {
+				if t == ownerValue {
+					owned[r.Name] = true
+					txts[r.Name] = r
+				}
+			}
+		}
+	}
+
+	for _, host := range sortedKeys(desired) {
+		targets := desired[host]
+		r, exists := existing[host]
+		if exists && !owned[host] {
+			logrus.Warnf("Record %s is not owned by %s, skipping dns sync", host, s.OwnerID)
+			continue
+		}
+		if exists && r.TTL == s.TTL && reflect.DeepEqual(sortedCopy(r.Targets), targets) {
+			continue
+		}
+		changes.Upsert = append(changes.Upsert,
+			Record{Name: host, Type: ARecord, TTL: s.TTL, Targets: targets},
+			Record{Name: host, Type: TXTRecord, TTL: s.TTL, Targets: []string{ownerValue}})
+	}
+
+	for _, host := range sortedKeys(owned) {
+		if _, ok := desired[host]; ok {
+			continue
+		}
+		if r, ok := existing[host]; ok {
+			changes.Delete = append(changes.Delete, r)
+		}
+		changes.Delete = append(changes.Delete, txts[host])
+	}
+	return changes
+}
+
+func (s *Syncer) ownerValue() string {
+	return fmt.Sprintf("heritage=rancher-lb,owner=%s", s.OwnerID)
+}
+
+// getHostnames returns the rule hostnames belonging to the zone;
+// hostnames with wildcards other than the leading label are skipped
+func (s *Syncer) getHostnames(lbConfig *config.LoadBalancerConfig) []string {
+	hosts := map[string]bool{}
+	for _, fe := range lbConfig.FrontendServices {
+		for _, be := range fe.BackendServices {
+			host := normalizeName(be.Host)
+			if host == "" {
+				continue
+			}
+			if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				logrus.Debugf("Skipping dns sync for wildcard host %s", be.Host)
+				continue
+			}
+			if host != s.Zone && !strings.HasSuffix(host, "."+s.Zone) {
+				logrus.Debugf("Host %s doesn't belong to zone %s, skipping dns sync", be.Host, s.Zone)
+				continue
+			}
+			hosts[host] = true
+		}
+	}
+	return sortedKeys(hosts)
+}
+
+// hosts are tracked as host -> "config=target" pairs, so the same hostname
+// can be served by multiple configs
+func mergeTargets(entries []string, configName string, targets []string) []string {
+	merged := []string{}
+	for _, e := range entries {
+		if !strings.HasPrefix(e, configName+"=") {
+			merged = append(merged, e)
+		}
+	}
+	for _, t := range targets {
+		merged = append(merged, fmt.Sprintf("%s=%s", configName, t))
+	}
+	return merged
+}
+
+// forgetConfig drops the config targets from all hosts but the kept ones
+func (s *Syncer) forgetConfig(configName string, keep []string) {
+	kept := map[string]bool{}
+	for _, host := range keep {
+		kept[host] = true
+	}
+	for host, entries := range s.hosts {
+		if kept[host] {
+			continue
+		}
+		entries = mergeTargets(entries, configName, nil)
+		if len(entries) == 0 {
+			delete(s.hosts, host)
+			continue
+		}
+		s.hosts[host] = entries
+	}
+}
+
+func (s *Syncer) desiredRecords() map[string][]string {
+	desired := map[string][]string{}
+	for host, entries := range s.hosts {
+		targets := map[string]bool{}
+		for _, e := range entries {
+			targets[e[strings.Index(e, "=")+1:]] = true
+		}
+		desired[host] = sortedKeys(targets)
+	}
+	return desired
+}
+
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.Replace(name, "\\052", "*", -1)
+	return strings.TrimSuffix(name, ".")
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
@@ -0,0 +1,156 @@
+package dnssync
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+type tProvider struct {
+	records []Record
+	applied []*Changes
+}
+
+func (p *tProvider) GetName() string {
+	return "test"
+}
+
+func (p *tProvider) Records() ([]Record, error) {
+	return p.records, nil
+}
+
+func (p *tProvider) ApplyChanges(changes *Changes) error {
+	p.applied = append(p.applied, changes)
+	return nil
+}
+
+func newTestSyncer(records []Record) (*Syncer, *tProvider) {
+	p := &tProvider{records: records}
+	return &Syncer{
+		Provider: p,
+		Zone:     "example.com",
+		OwnerID:  "test",
+		TTL:      300,
+		Targets:  []string{"10.0.0.2", "10.0.0.1"},
+	}, p
+}
+
+func newTestConfig(name string, hosts ...string) *config.LoadBalancerConfig {
+	bes := []*config.BackendService{}
+	for _, host := range hosts {
+		bes = append(bes, &config.BackendService{Host: host})
+	}
+	return &config.LoadBalancerConfig{
+		Name: name,
+		FrontendServices: []*config.FrontendService{
+			{
+				Port:            80,
+				Protocol:        config.HTTPProto,
+				BackendServices: bes,
+			},
+		},
+	}
+}
+
+func TestSyncCreate(t *testing.T) {
+	s, p := newTestSyncer([]Record{
+		{Name: "foreign.example.com", Type: ARecord, TTL: 300, Targets: []string{"10.1.1.1"}},
+	})
+	lbConfig := newTestConfig("lb", "Foo.example.com", "foreign.example.com", "bar.other.com", "baz.*", "")
+	if err := s.PostApply(lbConfig, nil); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if len(p.applied) != 1 {
+		t.Fatalf("Invalid number of applied changes %v", len(p.applied))
+	}
+	changes := p.applied[0]
+	if len(changes.Delete) != 0 {
+		t.Fatalf("Invalid number of deletes %v", len(changes.Delete))
+	}
+	expected := []Record{
+		{Name: "foo.example.com", Type: ARecord, TTL: 300, Targets: []string{"10.0.0.1", "10.0.0.2"}},
+		{Name: "foo.example.com", Type: TXTRecord, TTL: 300, Targets: []string{"heritage=rancher-lb,owner=test"}},
+	}
+	if !reflect.DeepEqual(changes.Upsert, expected) {
+		t.Fatalf("Invalid upserts %v", changes.Upsert)
+	}
+
+	// nothing changed, provider is not called again
+	if err := s.PostApply(lbConfig, nil); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if len(p.applied) != 1 {
+		t.Fatalf("Invalid number of applied changes %v", len(p.applied))
+	}
+}
+
+func TestSyncDelete(t *testing.T) {
+	owner := []string{"heritage=rancher-lb,owner=test"}
+	s, p := newTestSyncer([]Record{
+		{Name: "foo.example.com", Type: ARecord, TTL: 300, Targets: []string{"10.0.0.2", "10.0.0.1"}},
+		{Name: "foo.example.com", Type: TXTRecord, TTL: 300, Targets: owner},
+		{Name: "old.example.com", Type: ARecord, TTL: 300, Targets: []string{"10.0.0.1"}},
+		{Name: "old.example.com", Type: TXTRecord, TTL: 300, Targets: owner},
+		{Name: "other.example.com", Type: TXTRecord, TTL: 300, Targets: []string{"heritage=rancher-lb,owner=other"}},
+	})
+	if err := s.PostApply(newTestConfig("lb", "foo.example.com"), nil); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if len(p.applied) != 1 {
+		t.Fatalf("Invalid number of applied changes %v", len(p.applied))
+	}
+	changes := p.applied[0]
+	if len(changes.Upsert) != 0 {
+		t.Fatalf("Invalid upserts %v", changes.Upsert)
+	}
+	if len(changes.Delete) != 2 || changes.Delete[0].Name != "old.example.com" || changes.Delete[1].Name != "old.example.com" {
+		t.Fatalf("Invalid deletes %v", changes.Delete)
+	}
+}
+
+func TestSyncCleanup(t *testing.T) {
+	s, p := newTestSyncer(nil)
+	if err := s.PostApply(newTestConfig("lb1", "foo.example.com"), nil); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if err := s.PostApply(newTestConfig("lb2", "foo.example.com"), nil); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if err := s.PostCleanup("lb1"); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	desired := s.desiredRecords()
+	if len(desired) != 1 || len(desired["foo.example.com"]) != 2 {
+		t.Fatalf("Host shared by another config should be kept %v", desired)
+	}
+	if err := s.PostCleanup("lb2"); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if len(s.desiredRecords()) != 0 {
+		t.Fatalf("Invalid desired records %v", s.desiredRecords())
+	}
+	if len(p.applied) != 1 {
+		t.Fatalf("Invalid number of applied changes %v", len(p.applied))
+	}
+}
+
+func TestParseZoneTransfer(t *testing.T) {
+	output := `; <<>> DiG 9.10 <<>> example.com AXFR
+example.com.		3600	IN	SOA	ns.example.com. admin.example.com. 1 3600 600 86400 300
+foo.example.com.	300	IN	A	10.0.0.1
+foo.example.com.	300	IN	A	10.0.0.2
+foo.example.com.	300	IN	TXT	"heritage=rancher-lb,owner=test"
+`
+	records, err := parseZoneTransfer(output)
+	if err != nil {
+		t.Fatalf("Failed to parse zone transfer: %v", err)
+	}
+	expected := []Record{
+		{Name: "foo.example.com", Type: ARecord, TTL: 300, Targets: []string{"10.0.0.1", "10.0.0.2"}},
+		{Name: "foo.example.com", Type: TXTRecord, TTL: 300, Targets: []string{"heritage=rancher-lb,owner=test"}},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Invalid records %v", records)
+	}
+}
@@ -0,0 +1,140 @@
+package dnssync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// rfc2136Provider updates the zone with nsupdate, and reads
+// the zone records with a dig zone transfer
+type rfc2136Provider struct {
+	zone    string
+	server  string
+	port    string
+	tsigKey string
+	keyFile string
+	run     func(name string, stdin string, args ...string) (string, error)
+}
+
+func newRFC2136ProviderFromEnv(zone string) (*rfc2136Provider, error) {
+	server := rfc2136Server.Get()
+	if server == "" {
+		return nil, fmt.Errorf("RFC2136_SERVER is not set")
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	return &rfc2136Provider{
+		zone:    zone,
+		server:  host,
+		port:    port,
+		tsigKey: rfc2136TSIGKey.Get(),
+		keyFile: rfc2136TSIGKeyFile.Get(),
+		run:     runCommand,
+	}, nil
+}
+
+func runCommand(name string, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v -- %v", err, string(output))
+	}
+	return string(output), nil
+}
+
+func (p *rfc2136Provider) GetName() string {
+	return "rfc2136"
+}
+
+func (p *rfc2136Provider) authArgs() []string {
+	if p.keyFile != "" {
+		return []string{"-k", p.keyFile}
+	}
+	if p.tsigKey != "" {
+		return []string{"-y", p.tsigKey}
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) Records() ([]Record, error) {
+	args := append(p.authArgs(), "@"+p.server, "-p", p.port, p.zone+".", "AXFR", "+noall", "+answer")
+	output, err := p.run("dig", "", args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseZoneTransfer(output)
+}
+
+func (p *rfc2136Provider) ApplyChanges(changes *Changes) error {
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "server %s %s\n", p.server, p.port)
+	fmt.Fprintf(&script, "zone %s.\n", p.zone)
+	for _, r := range changes.Delete {
+		fmt.Fprintf(&script, "update delete %s. %s\n", r.Name, r.Type)
+	}
+	for _, r := range changes.Upsert {
+		fmt.Fprintf(&script, "update delete %s. %s\n", r.Name, r.Type)
+		for _, target := range r.Targets {
+			if r.Type == TXTRecord {
+				target = fmt.Sprintf("%q", target)
+			}
+			fmt.Fprintf(&script, "update add %s. %v %s %s\n", r.Name, r.TTL, r.Type, target)
+		}
+	}
+	script.WriteString("send\n")
+	_, err := p.run("nsupdate", script.String(), p.authArgs()...)
+	return err
+}
+
+// parseZoneTransfer groups A and TXT records of the dig output into record sets
+func parseZoneTransfer(output string) ([]Record, error) {
+	grouped := map[string]*Record{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		recordType := fields[3]
+		if recordType != ARecord && recordType != TXTRecord {
+			continue
+		}
+		ttl, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid zone transfer record %s", line)
+		}
+		name := normalizeName(fields[0])
+		value := strings.Join(fields[4:], " ")
+		if recordType == TXTRecord {
+			value = strings.Trim(value, "\"")
+		}
+		key := recordType + " " + name
+		if r, ok := grouped[key]; ok {
+			r.Targets = append(r.Targets, value)
+			continue
+		}
+		grouped[key] = &Record{
+			Name:    name,
+			Type:    recordType,
+			TTL:     ttl,
+			Targets: []string{value},
+		}
+	}
+	records := []Record{}
+	for _, key := range sortedKeys(grouped) {
+		records = append(records, *grouped[key])
+	}
+	return records, scanner.Err()
+}
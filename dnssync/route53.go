@@ -0,0 +1,211 @@
+package dnssync
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/utils/sigv4"
+)
+
+const (
+	route53API       = "https://route53.amazonaws.com"
+	route53Version   = "2013-04-01"
+	route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+	// route53 is a global service signed for us-east-1
+	route53Region  = "us-east-1"
+	route53Service = "route53"
+)
+
+type route53Provider struct {
+	zone         string
+	hostedZoneID string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	api          string
+	client       *http.Client
+	now          func() time.Time
+}
+
+type route53ResourceRecord struct {
+	Value string `xml:"Value"`
+}
+
+type route53RecordSet struct {
+	Name            string                  `xml:"Name"`
+	Type            string                  `xml:"Type"`
+	TTL             int                     `xml:"TTL,omitempty"`
+	ResourceRecords []route53ResourceRecord `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	XMLNS   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53ListResponse struct {
+	RecordSets     []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated    bool               `xml:"IsTruncated"`
+	NextRecordName string             `xml:"NextRecordName"`
+	NextRecordType string             `xml:"NextRecordType"`
+}
+
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func newRoute53ProviderFromEnv(zone string) (*route53Provider, error) {
+	p := &route53Provider{
+		zone:         zone,
+		hostedZoneID: strings.TrimPrefix(route53HostedZoneID.Get(), "/hostedzone/"),
+		accessKey:    flags.AWSAccessKeyID.Get(),
+		secretKey:    flags.AWSSecretAccessKey.Get(),
+		sessionToken: flags.AWSSessionToken.Get(),
+		api:          route53API,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		now:          time.Now,
+	}
+	if p.hostedZoneID == "" {
+		return nil, fmt.Errorf("ROUTE53_HOSTED_ZONE_ID is not set")
+	}
+	if p.accessKey == "" || p.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY should be set")
+	}
+	return p, nil
+}
+
+func (p *route53Provider) GetName() string {
+	return "route53"
+}
+
+func (p *route53Provider) Records() ([]Record, error) {
+	records := []Record{}
+	query := url.Values{}
+	for {
+		resp := &route53ListResponse{}
+		if err := p.do("GET", p.rrsetPath(), query, nil, resp); err != nil {
+			return nil, err
+		}
+		for _, rs := range resp.RecordSets {
+			if rs.Type != ARecord && rs.Type != TXTRecord {
+				continue
+			}
+			r := Record{
+				Name: normalizeName(rs.Name),
+				Type: rs.Type,
+				TTL:  rs.TTL,
+			}
+			for _, rr := range rs.ResourceRecords {
+				value := rr.Value
+				if rs.Type == TXTRecord {
+					value = strings.Trim(value, "\"")
+				}
+				r.Targets = append(r.Targets, value)
+			}
+			records = append(records, r)
+		}
+		if !resp.IsTruncated {
+			return records, nil
+		}
+		query.Set("name", resp.NextRecordName)
+		query.Set("type", resp.NextRecordType)
+	}
+}
+
+func (p *route53Provider) ApplyChanges(changes *Changes) error {
+	req := &route53ChangeRequest{XMLNS: route53Namespace}
+	for _, r := range changes.Delete {
+		req.Changes = append(req.Changes, route53Change{Action: "DELETE", RecordSet: toRoute53RecordSet(r)})
+	}
+	for _, r := range changes.Upsert {
+		req.Changes = append(req.Changes, route53Change{Action: "UPSERT", RecordSet: toRoute53RecordSet(r)})
+	}
+	if len(req.Changes) == 0 {
+		return nil
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return p.do("POST", p.rrsetPath(), nil, append([]byte(xml.Header), body...), nil)
+}
+
+func (p *route53Provider) rrsetPath() string {
+	return fmt.Sprintf("/%s/hostedzone/%s/rrset", route53Version, p.hostedZoneID)
+}
+
+func toRoute53RecordSet(r Record) route53RecordSet {
+	rs := route53RecordSet{
+		Name: r.Name + ".",
+		Type: r.Type,
+		TTL:  r.TTL,
+	}
+	for _, target := range r.Targets {
+		if r.Type == TXTRecord {
+			target = fmt.Sprintf("%q", target)
+		}
+		rs.ResourceRecords = append(rs.ResourceRecords, route53ResourceRecord{Value: target})
+	}
+	return rs
+}
+
+func (p *route53Provider) signer() *sigv4.Signer {
+	return &sigv4.Signer{
+		AccessKey:    p.accessKey,
+		SecretKey:    p.secretKey,
+		SessionToken: p.sessionToken,
+		Region:       route53Region,
+		Service:      route53Service,
+		Now:          p.now,
+	}
+}
+
+func (p *route53Provider) do(method string, path string, query url.Values, body []byte, result interface{}) error {
+	u := p.api + path
+	if len(query) > 0 {
+		u += "?" + sigv4.CanonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	p.signer().Sign(req, body)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		awsErr := &route53Error{}
+		if err := xml.Unmarshal(data, awsErr); err == nil && awsErr.Code != "" {
+			return fmt.Errorf("route53 error %s: %s", awsErr.Code, awsErr.Message)
+		}
+		return fmt.Errorf("route53 request failed with status %s", resp.Status)
+	}
+	if result != nil {
+		return xml.Unmarshal(data, result)
+	}
+	return nil
+}
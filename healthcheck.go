@@ -1,22 +1,102 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/controller"
+	"github.com/rancher/lb-controller/provider"
+	"net"
 	"net/http"
+	"time"
 )
 
 var (
 	router         = mux.NewRouter()
 	healtcheckPort = ":10241"
+	faultInjection = flags.Bool("FAULT_INJECTION_ENABLED", false, "Serve the admin routes injecting faults in the requests of the backends")
+	adminToken     = flags.Secret("ADMIN_TOKEN", "Bearer token of the admin routes changing the lbs, they are only served to the loopback clients when not set. The debug captures are only served with it")
 )
 
 func startHealthcheck() {
 	router.HandleFunc("/healthz", healtcheck).Methods("GET", "HEAD").Name("Healthcheck")
+	router.HandleFunc("/readyz", readiness).Methods("GET", "HEAD").Name("Readiness")
+	router.HandleFunc("/shadow/promote", adminOnly(promoteShadow)).Methods("POST").Name("PromoteShadow")
+	router.Handle("/metrics", prometheus.Handler()).Methods("GET").Name("Metrics")
+	router.HandleFunc("/validation", validationReport).Methods("GET").Name("ValidationReport")
+	router.HandleFunc("/rules/expansions", ruleExpansions).Methods("GET").Name("RuleExpansions")
+	router.HandleFunc("/flags", dumpFlags).Methods("GET").Name("Flags")
+	router.HandleFunc("/debug/captures", tokenOnly(debugCaptures)).Methods("GET").Name("DebugCaptures")
+	if faultInjection.Get() {
+		router.HandleFunc("/faults", listFaults).Methods("GET").Name("Faults")
+		router.HandleFunc("/faults/{backend}", adminOnly(setFault)).Methods("PUT", "DELETE").Name("Fault")
+	}
+	router.HandleFunc("/logging", listRequestLogging).Methods("GET").Name("RequestLoggings")
+	router.HandleFunc("/logging/{backend}", adminOnly(setRequestLogging)).Methods("PUT", "DELETE").Name("RequestLogging")
+	router.HandleFunc("/configs", publishedConfigs).Methods("GET").Name("Configs")
+	router.HandleFunc("/debug/state", adminOnly(dumpState)).Methods("GET", "POST").Name("StateDump")
+	router.HandleFunc("/debug/metadata-snapshot", tokenOnly(metadataSnapshot)).Methods("GET").Name("MetadataSnapshot")
+	router.HandleFunc("/capabilities", providerCapabilities).Methods("GET").Name("Capabilities")
+	router.HandleFunc("/resync", adminOnly(resync)).Methods("POST").Name("Resync")
+	registerPprof()
 	logrus.Info("Healthcheck handler is listening on ", healtcheckPort)
 	logrus.Fatal(http.ListenAndServe(healtcheckPort, router))
 }
 
+// adminOnly authorizes the requests of the admin routes: the bearer
+// token is required when ADMIN_TOKEN is set, and only the loopback
+// clients are served otherwise
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token := adminToken.Get(); token != "" {
+			if !hasAdminToken(req, token) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(req.RemoteAddr) {
+			http.Error(w, "Admin routes are only served to the loopback clients when ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// tokenOnly authorizes the requests of the admin routes serving the
+// client data, the bearer token is required even from the loopback
+func tokenOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := adminToken.Get()
+		if token == "" {
+			http.Error(w, "Route is only served when ADMIN_TOKEN is set", http.StatusForbidden)
+			return
+		}
+		if !hasAdminToken(req, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func hasAdminToken(req *http.Request, token string) bool {
+	auth := []byte(req.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) == 1
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func healtcheck(w http.ResponseWriter, req *http.Request) {
 	// 1) test controller
 	if !lbc.IsHealthy() {
@@ -29,3 +109,214 @@ func healtcheck(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("OK"))
 	}
 }
+
+// readiness fails until the initial sync of the controller is
+// complete, controllers not reporting it are ready when healthy
+func readiness(w http.ResponseWriter, req *http.Request) {
+	if reporter, ok := lbc.(controller.ReadinessReporter); ok && !reporter.IsReady() {
+		http.Error(w, "LB controller hasn't completed its initial sync", http.StatusServiceUnavailable)
+		return
+	}
+	healtcheck(w, req)
+}
+
+func validationReport(w http.ResponseWriter, req *http.Request) {
+	reporter, ok := lbc.(controller.ValidationReporter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't validate lb rules", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	report := reporter.GetValidationReport()
+	if report == nil {
+		http.Error(w, "Lb rules are not validated yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logrus.Errorf("Failed to write validation report: %v", err)
+	}
+}
+
+// ruleExpansions shows how the selector rules expanded, the matching
+// targets, the synthesized rules and the skipped ones
+func ruleExpansions(w http.ResponseWriter, req *http.Request) {
+	reporter, ok := lbc.(controller.ExpansionReporter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't expand selector rules", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	expansions := reporter.GetRuleExpansions()
+	if expansions == nil {
+		http.Error(w, "Lb rules are not expanded yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(expansions); err != nil {
+		logrus.Errorf("Failed to write rule expansions: %v", err)
+	}
+}
+
+func dumpFlags(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(flags.Dump()); err != nil {
+		logrus.Errorf("Failed to write flags: %v", err)
+	}
+}
+
+func debugCaptures(w http.ResponseWriter, req *http.Request) {
+	captureProvider, ok := lbp.(provider.CaptureProvider)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Provider %s doesn't support debug capture", lbp.GetName()), http.StatusNotImplemented)
+		return
+	}
+	captures, err := captureProvider.GetCaptures()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(captures); err != nil {
+		logrus.Errorf("Failed to write debug captures: %v", err)
+	}
+}
+
+func listFaults(w http.ResponseWriter, req *http.Request) {
+	injector, ok := lbc.(controller.FaultInjector)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't support fault injection", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(injector.GetFaults()); err != nil {
+		logrus.Errorf("Failed to write faults: %v", err)
+	}
+}
+
+// setFault injects a fault in the requests of the backend for a
+// duration, like {"abort_status": 503, "abort_percent": 5, "duration": "10m"},
+// the fault is removed by DELETE or once the duration is over
+func setFault(w http.ResponseWriter, req *http.Request) {
+	injector, ok := lbc.(controller.FaultInjector)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't support fault injection", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	var fault *config.Fault
+	var duration time.Duration
+	if req.Method == "PUT" {
+		var body struct {
+			config.Fault
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid fault: %v", err), http.StatusBadRequest)
+			return
+		}
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid fault duration [%s]", body.Duration), http.StatusBadRequest)
+			return
+		}
+		fault, duration = &body.Fault, d
+	}
+	if err := injector.SetFault(mux.Vars(req)["backend"], fault, duration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func listRequestLogging(w http.ResponseWriter, req *http.Request) {
+	logger, ok := lbc.(controller.RequestLogger)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't support request logging", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(logger.GetRequestLogging()); err != nil {
+		logrus.Errorf("Failed to write request loggings: %v", err)
+	}
+}
+
+// setRequestLogging turns on the logging of the requests of the backend
+// for a duration, like {"duration": "10m", "sample_rate": 100}, the
+// logging is turned off by DELETE or once the duration is over
+func setRequestLogging(w http.ResponseWriter, req *http.Request) {
+	logger, ok := lbc.(controller.RequestLogger)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't support request logging", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	var duration time.Duration
+	var logging struct {
+		Duration   string `json:"duration"`
+		SampleRate int    `json:"sample_rate"`
+	}
+	if req.Method == "PUT" {
+		if err := json.NewDecoder(req.Body).Decode(&logging); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request logging: %v", err), http.StatusBadRequest)
+			return
+		}
+		d, err := time.ParseDuration(logging.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid request logging duration [%s]", logging.Duration), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	if err := logger.SetRequestLogging(mux.Vars(req)["backend"], duration, logging.SampleRate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// resync rebuilds and applies the config from fresh metadata now
+func resync(w http.ResponseWriter, req *http.Request) {
+	resyncer, ok := lbc.(controller.Resyncer)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Controller %s doesn't support resync", lbc.GetName()), http.StatusNotImplemented)
+		return
+	}
+	resyncer.Resync()
+	w.Write([]byte("OK"))
+}
+
+func providerCapabilities(w http.ResponseWriter, req *http.Request) {
+	capabilityProvider, ok := lbp.(provider.CapabilityProvider)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Provider %s doesn't report its capabilities", lbp.GetName()), http.StatusNotImplemented)
+		return
+	}
+	capabilities, err := capabilityProvider.GetCapabilities()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(capabilities); err != nil {
+		logrus.Errorf("Failed to write capabilities: %v", err)
+	}
+}
+
+func promoteShadow(w http.ResponseWriter, req *http.Request) {
+	shadowProvider, ok := lbp.(provider.ShadowProvider)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Provider %s doesn't support shadow apply", lbp.GetName()), http.StatusNotImplemented)
+		return
+	}
+	if _, err := shadowProvider.PromoteShadowConfig(); err != nil {
+		logrus.Errorf("Failed to promote shadow config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func publishedConfigs(w http.ResponseWriter, req *http.Request) {
+	if configPublisher == nil {
+		http.Error(w, "Configs are published by the instances with LB_ROLE builder", http.StatusNotImplemented)
+		return
+	}
+	configPublisher.ServeHTTP(w, req)
+}
@@ -0,0 +1,240 @@
+/*
+Package golden renders provider configs from fixture metadata documents
+and compares them with the golden files stored next to the fixtures.
+
+A fixture is a json document describing the lb service and the services
+and containers it targets, as they are reported by rancher-metadata:
+
+	{
+	  "lb_service": {"name": "lb", "lb_config": {"port_rules": [...]}},
+	  "services": [...],
+	  "containers": [...]
+	}
+
+To add a regression case, drop <name>.json into the fixtures dir and
+run the tests with -update to produce <name>.golden, then review it.
+*/
+package golden
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/controller/rancher"
+	"github.com/rancher/lb-controller/provider"
+)
+
+// Update makes Run overwrite golden files with the rendered configs
+var Update = flag.Bool("update", false, "update golden files")
+
+// RenderFunc renders provider config for the lb config
+type RenderFunc func(lbConfig *config.LoadBalancerConfig) ([]byte, error)
+
+// Fixture describes an lb service and its targets
+type Fixture struct {
+	HostUUID   string               `json:"host_uuid"`
+	LBService  metadata.Service     `json:"lb_service"`
+	Services   []metadata.Service   `json:"services"`
+	Containers []metadata.Container `json:"containers"`
+}
+
+// LoadFixture reads a fixture from the json file
+func LoadFixture(path string) (*Fixture, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{}
+	if err := json.Unmarshal(b, fixture); err != nil {
+		return nil, fmt.Errorf("Failed to parse fixture %s: %v", path, err)
+	}
+	return fixture, nil
+}
+
+// BuildConfigs builds the lb configs of the fixture
+func BuildConfigs(fixture *Fixture, lbp provider.LBProvider) ([]*config.LoadBalancerConfig, error) {
+	lbc, err := rancher.NewLoadBalancerController()
+	if err != nil {
+		return nil, err
+	}
+	lbc.MetaFetcher = fixtureMetaFetcher{fixture}
+	lbc.CertFetcher = fixtureCertFetcher{}
+	lbc.LBProvider = lbp
+	return lbc.GetLBConfigs()
+}
+
+// Render builds lb configs from the fixture and renders them with the provider
+func Render(fixture *Fixture, lbp provider.LBProvider, render RenderFunc) ([]byte, error) {
+	cfgs, err := BuildConfigs(fixture, lbp)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	for _, cfg := range cfgs {
+		b, err := render(cfg)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+	}
+	return out.Bytes(), nil
+}
+
+// Run renders every fixture in dir and compares the result with its golden file
+func Run(t *testing.T, dir string, lbp provider.LBProvider, render RenderFunc) {
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("Failed to list fixtures in %s: %v", dir, err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatalf("No fixtures found in %s", dir)
+	}
+	for _, path := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		goldenPath := filepath.Join(dir, fmt.Sprintf("%s.golden", name))
+
+		fixture, err := LoadFixture(path)
+		if err != nil {
+			t.Errorf("[%s] %v", name, err)
+			continue
+		}
+		actual, err := Render(fixture, lbp, render)
+		if err != nil {
+			t.Errorf("[%s] Failed to render config: %v", name, err)
+			continue
+		}
+		if *Update {
+			if err := ioutil.WriteFile(goldenPath, actual, 0644); err != nil {
+				t.Errorf("[%s] Failed to update golden file: %v", name, err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(goldenPath)
+		if err != nil {
+			t.Errorf("[%s] Failed to read golden file, run with -update to create it: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("[%s] Rendered config doesn't match %s\nexpected:\n%s\nactual:\n%s", name, goldenPath, expected, actual)
+		}
+	}
+}
+
+// RunDeterministic renders every fixture in dir again with its services and
+// containers in reverse order, and checks the renders are byte-identical
+func RunDeterministic(t *testing.T, dir string, lbp provider.LBProvider, render RenderFunc) {
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("No fixtures found in %s: %v", dir, err)
+	}
+	for _, path := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		fixture, err := LoadFixture(path)
+		if err != nil {
+			t.Errorf("[%s] %v", name, err)
+			continue
+		}
+		expected, err := Render(fixture, lbp, render)
+		if err != nil {
+			t.Errorf("[%s] Failed to render config: %v", name, err)
+			continue
+		}
+		actual, err := Render(reversed(fixture), lbp, render)
+		if err != nil {
+			t.Errorf("[%s] Failed to render reversed config: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("[%s] Config changes with the metadata order\nexpected:\n%s\nactual:\n%s", name, expected, actual)
+		}
+	}
+}
+
+// reversed copies the fixture with its services, their containers
+// and the containers in reverse order
+func reversed(fixture *Fixture) *Fixture {
+	copied := *fixture
+	copied.Services = nil
+	for i := len(fixture.Services) - 1; i >= 0; i-- {
+		svc := fixture.Services[i]
+		containers := svc.Containers
+		svc.Containers = nil
+		for j := len(containers) - 1; j >= 0; j-- {
+			svc.Containers = append(svc.Containers, containers[j])
+		}
+		copied.Services = append(copied.Services, svc)
+	}
+	copied.Containers = nil
+	for i := len(fixture.Containers) - 1; i >= 0; i-- {
+		copied.Containers = append(copied.Containers, fixture.Containers[i])
+	}
+	return &copied
+}
+
+type fixtureMetaFetcher struct {
+	fixture *Fixture
+}
+
+func (mf fixtureMetaFetcher) GetSelfService() (metadata.Service, error) {
+	return mf.fixture.LBService, nil
+}
+
+func (mf fixtureMetaFetcher) GetSelfHost() (metadata.Host, error) {
+	return metadata.Host{UUID: mf.fixture.HostUUID}, nil
+}
+
+func (mf fixtureMetaFetcher) GetHost(hostUUID string) (*metadata.Host, error) {
+	return &metadata.Host{UUID: hostUUID}, nil
+}
+
+func (mf fixtureMetaFetcher) GetSelfHostUUID() (string, error) {
+	return mf.fixture.HostUUID, nil
+}
+
+func (mf fixtureMetaFetcher) OnChange(intervalSeconds int, do func(string)) {
+}
+
+func (mf fixtureMetaFetcher) GetServices() ([]metadata.Service, error) {
+	return mf.fixture.Services, nil
+}
+
+func (mf fixtureMetaFetcher) GetService(envUUID string, svcName string, stackName string) (*metadata.Service, error) {
+	for _, svc := range mf.fixture.Services {
+		if strings.EqualFold(svc.Name, svcName) && strings.EqualFold(svc.StackName, stackName) {
+			return &svc, nil
+		}
+	}
+	return nil, nil
+}
+
+func (mf fixtureMetaFetcher) GetContainer(envUUID string, containerUUID string) (*metadata.Container, error) {
+	for _, c := range mf.fixture.Containers {
+		if strings.EqualFold(c.UUID, containerUUID) {
+			return &c, nil
+		}
+	}
+	return &metadata.Container{}, nil
+}
+
+type fixtureCertFetcher struct {
+}
+
+func (cf fixtureCertFetcher) FetchCertificates(lbMeta *rancher.LBMetadata, isDefaultCert bool) ([]*config.Certificate, error) {
+	return nil, nil
+}
+
+func (cf fixtureCertFetcher) UpdateEndpoints(lbSvc *metadata.Service, eps []client.PublicEndpoint) error {
+	return nil
+}
+
+func (cf fixtureCertFetcher) LookForCertUpdates(do func(string)) {
+}
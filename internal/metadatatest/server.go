@@ -0,0 +1,196 @@
+/*
+Package metadatatest serves the Rancher metadata API from an in-memory
+state, so the controller flows can be tested end to end with the metadata
+client, from the OnChange version long-poll to the config applies.
+
+	srv := metadatatest.NewServer(&metadatatest.State{
+		SelfService: lbService,
+		Services:    services,
+	})
+	defer srv.Close()
+	client := metadata.NewClient(srv.URL)
+
+Update changes the state and bumps its version, waking the long-polls.
+*/
+package metadatatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// Version is the metadata API version the server is reached under
+const Version = "2015-12-19"
+
+// maxWait caps the long-polls of the version, in seconds
+const maxWait = 60
+
+// State is the metadata answered by the server
+type State struct {
+	SelfService   metadata.Service
+	SelfContainer metadata.Container
+	SelfHost      metadata.Host
+	SelfStack     metadata.Stack
+	Services      []metadata.Service
+	Containers    []metadata.Container
+	Hosts         []metadata.Host
+	Stacks        []metadata.Stack
+	Networks      []metadata.Network
+}
+
+// Server is a metadata server, URL is the base url of the metadata client
+type Server struct {
+	URL string
+
+	server  *httptest.Server
+	mu      sync.Mutex
+	state   *State
+	version int
+	down    bool
+	// changed is closed and replaced on every version bump
+	changed chan struct{}
+	closed  chan struct{}
+}
+
+func NewServer(state *State) *Server {
+	if state == nil {
+		state = &State{}
+	}
+	s := &Server{
+		state:   state,
+		version: 1,
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serve)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL + "/" + Version
+	return s
+}
+
+// Update changes the state with the func and bumps the version
+func (s *Server) Update(update func(state *State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(s.state)
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Version returns the current version of the state
+func (s *Server) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strconv.Itoa(s.version)
+}
+
+// SetDown makes the server answer 503 to every request, as
+// during a metadata outage, until it is set up again
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *Server) Close() {
+	close(s.closed)
+	s.server.Close()
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+Version)
+	s.mu.Lock()
+	if s.down {
+		s.mu.Unlock()
+		http.Error(w, "metadata is down", http.StatusServiceUnavailable)
+		return
+	}
+	if path == "/version" {
+		version, changed := strconv.Itoa(s.version), s.changed
+		s.mu.Unlock()
+		s.serveVersion(w, r, version, changed)
+		return
+	}
+	body, ok := s.get(path)
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, body)
+}
+
+// serveVersion answers the version, the long-polls waiting for it to
+// differ from their value up to their max wait
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request, version string, changed chan struct{}) {
+	query := r.URL.Query()
+	if query.Get("wait") == "true" && query.Get("value") == version {
+		wait, _ := strconv.Atoi(query.Get("maxWait"))
+		if wait <= 0 || wait > maxWait {
+			wait = maxWait
+		}
+		select {
+		case <-changed:
+		case <-s.closed:
+		case <-time.After(time.Duration(wait) * time.Second):
+		}
+		version = s.Version()
+	}
+	writeJSON(w, version)
+}
+
+// get returns the state under the path, s.mu is held
+func (s *Server) get(path string) (interface{}, bool) {
+	state := s.state
+	switch path {
+	case "/self/service":
+		return state.SelfService, true
+	case "/self/container":
+		return state.SelfContainer, true
+	case "/self/host":
+		return state.SelfHost, true
+	case "/self/stack":
+		return state.SelfStack, true
+	case "/services":
+		return state.Services, true
+	case "/containers":
+		return state.Containers, true
+	case "/hosts":
+		return state.Hosts, true
+	case "/stacks":
+		return state.Stacks, true
+	case "/networks":
+		return state.Networks, true
+	}
+	if name := strings.TrimPrefix(path, "/self/stack/services/"); name != path {
+		for _, svc := range state.Services {
+			if svc.Name == name && svc.StackName == state.SelfService.StackName {
+				return svc, true
+			}
+		}
+		return nil, false
+	}
+	if name := strings.TrimPrefix(path, "/stacks/"); name != path {
+		for _, stack := range state.Stacks {
+			if stack.Name == name {
+				return stack, true
+			}
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
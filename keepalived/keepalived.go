@@ -0,0 +1,179 @@
+/*
+Package keepalived floats virtual ips over the lb instances with
+keepalived. The instances of an lb form a VRRP virtual router over the
+agent ips of their hosts, the healthy instance of the highest priority
+holds the virtual ips.
+
+The instance health is tracked by the check command, the health check
+of the controller by default, so an instance whose controller or
+provider is unhealthy releases the virtual ips to the next one.
+The lb containers need the host network and the NET_ADMIN capability
+for keepalived to assign the virtual ips.
+*/
+package keepalived
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	vrrpInterface = flags.String("KEEPALIVED_INTERFACE", "", "Interface the virtual ips of the lb vrrp are assigned to, keepalived is managed when set")
+	configPath    = flags.String("KEEPALIVED_CONFIG", "/etc/keepalived/keepalived.conf", "Path of the keepalived config")
+	reloadCmd     = flags.String("KEEPALIVED_RELOAD_CMD", "keepalived_reload /etc/keepalived/keepalived.conf", "Command starting keepalived, or reloading it when running")
+	checkCmd      = flags.String("KEEPALIVED_CHECK_CMD", "curl -sf http://127.0.0.1:10241/healthz", "Command tracking the health of the instance, it releases the virtual ips when failing")
+	authPass      = flags.Secret("KEEPALIVED_AUTH_PASS", "Password of the vrrp advertisements, up to 8 characters, not authenticated when empty")
+)
+
+// Manager writes the keepalived config of the vrrp of the applied
+// config and reloads keepalived. It is invoked as an apply hook
+// of the lb provider
+type Manager struct {
+	Interface string
+	Config    string
+	ReloadCmd string
+	CheckCmd  string
+	AuthPass  string
+
+	mu sync.Mutex
+	// rendered is the config keepalived runs
+	rendered string
+}
+
+// NewManagerFromEnv configures the manager from the KEEPALIVED_* env
+// vars, nil is returned when KEEPALIVED_INTERFACE is not set
+func NewManagerFromEnv() (*Manager, error) {
+	iface := vrrpInterface.Get()
+	if iface == "" {
+		return nil, nil
+	}
+	m := &Manager{
+		Interface: iface,
+		Config:    configPath.Get(),
+		ReloadCmd: reloadCmd.Get(),
+		CheckCmd:  checkCmd.Get(),
+		AuthPass:  authPass.Get(),
+	}
+	if len(m.AuthPass) > 8 {
+		return nil, fmt.Errorf("Invalid KEEPALIVED_AUTH_PASS, it is longer than 8 characters")
+	}
+	return m, nil
+}
+
+// PreApply is a no-op, the vrrp is configured once the config is applied
+func (m *Manager) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply configures the vrrp of the applied config, the virtual
+// ips are released when it has none
+func (m *Manager) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	return m.sync(lbConfig.VRRP)
+}
+
+// PostCleanup releases the virtual ips
+func (m *Manager) PostCleanup(configName string) error {
+	return m.sync(nil)
+}
+
+func (m *Manager) sync(vrrp *config.VRRP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rendered, err := m.render(vrrp)
+	if err != nil {
+		return err
+	}
+	if rendered == m.rendered {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(m.Config), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.Config, []byte(rendered), 0600); err != nil {
+		return fmt.Errorf("Failed to write the keepalived config: %v", err)
+	}
+	output, err := exec.Command("sh", "-c", m.ReloadCmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to reload keepalived: %v -- %v", err, string(output))
+	}
+	if vrrp == nil {
+		logrus.Infof("Released the vrrp virtual ips")
+	} else {
+		logrus.Infof("Configured vrrp router %v with virtual ips %v and priority %v", vrrp.RouterID, vrrp.VirtualIPs, vrrp.Priority)
+	}
+	m.rendered = rendered
+	return nil
+}
+
+var configTemplate = template.Must(template.New("keepalived").Parse(`global_defs {
+    enable_script_security
+    script_user root
+}
+{{with .VRRP}}
+vrrp_script check_lb {
+    script "{{$.CheckCmd}}"
+    interval 2
+    fall 2
+    rise 2
+}
+
+vrrp_instance lb_{{.RouterID}} {
+    state BACKUP
+    interface {{$.Interface}}
+    virtual_router_id {{.RouterID}}
+    priority {{.Priority}}
+    advert_int 1
+{{- if .SelfIP}}
+    unicast_src_ip {{.SelfIP}}
+{{- end}}
+    unicast_peer {
+{{- range .Peers}}
+        {{.IP}}
+{{- end}}
+    }
+{{- if $.AuthPass}}
+    authentication {
+        auth_type PASS
+        auth_pass {{$.AuthPass}}
+    }
+{{- end}}
+    virtual_ipaddress {
+{{- range .VirtualIPs}}
+        {{.}} dev {{$.Interface}}
+{{- end}}
+    }
+    track_script {
+        check_lb
+    }
+}
+{{end -}}
+`))
+
+// render renders the keepalived config of the vrrp, without
+// instance when nil
+func (m *Manager) render(vrrp *config.VRRP) (string, error) {
+	var b bytes.Buffer
+	err := configTemplate.Execute(&b, map[string]interface{}{
+		"VRRP":      vrrp,
+		"Interface": m.Interface,
+		"CheckCmd":  m.CheckCmd,
+		"AuthPass":  m.AuthPass,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to render the keepalived config: %v", err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,85 @@
+package keepalived
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+func TestManagerSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reloads := filepath.Join(dir, "reloads")
+	m := &Manager{
+		Interface: "eth0",
+		Config:    filepath.Join(dir, "keepalived", "keepalived.conf"),
+		ReloadCmd: fmt.Sprintf("echo reload >> %s", reloads),
+		CheckCmd:  "curl -sf http://127.0.0.1:10241/healthz",
+		AuthPass:  "secret",
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Name: "lb",
+		VRRP: &config.VRRP{
+			RouterID:   52,
+			VirtualIPs: []string{"10.0.0.100"},
+			SelfIP:     "10.0.0.1",
+			Priority:   150,
+			Peers:      []*config.VRRPPeer{{IP: "10.0.0.2", Priority: 100}, {IP: "10.0.0.3", Priority: 100}},
+		},
+	}
+	if err := m.PostApply(lbConfig, nil); err != nil {
+		t.Fatalf("Failed to sync the vrrp: %v", err)
+	}
+	b, err := ioutil.ReadFile(m.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := string(b)
+	for _, expected := range []string{
+		"vrrp_instance lb_52 {",
+		"interface eth0",
+		"virtual_router_id 52",
+		"priority 150",
+		"unicast_src_ip 10.0.0.1",
+		"unicast_peer {\n        10.0.0.2\n        10.0.0.3\n    }",
+		"auth_pass secret",
+		"10.0.0.100 dev eth0",
+		`script "curl -sf http://127.0.0.1:10241/healthz"`,
+		"track_script {\n        check_lb\n    }",
+	} {
+		if !strings.Contains(conf, expected) {
+			t.Fatalf("Expected %q in the keepalived config:\n%s", expected, conf)
+		}
+	}
+
+	// unchanged vrrp doesn't reload keepalived, nor does a failed apply
+	if err := m.PostApply(lbConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PostApply(&config.LoadBalancerConfig{Name: "lb"}, fmt.Errorf("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(reloads); string(b) != "reload\n" {
+		t.Fatalf("Expected a single reload, got %q", b)
+	}
+
+	// the virtual ips are released with the config
+	if err := m.PostCleanup("lb"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(m.Config)
+	if strings.Contains(string(b), "vrrp_instance") || !strings.Contains(string(b), "global_defs") {
+		t.Fatalf("Expected no vrrp instance after cleanup:\n%s", b)
+	}
+	if b, _ := ioutil.ReadFile(reloads); string(b) != "reload\nreload\n" {
+		t.Fatalf("Expected keepalived to be reloaded on cleanup, got %q", b)
+	}
+}
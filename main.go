@@ -1,11 +1,24 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-incubator/candiedyaml"
+	"github.com/rancher/lb-controller/backup"
+	"github.com/rancher/lb-controller/bgp"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/configsync"
 	"github.com/rancher/lb-controller/controller"
+	"github.com/rancher/lb-controller/controller/rancher"
+	"github.com/rancher/lb-controller/dnssync"
+	"github.com/rancher/lb-controller/keepalived"
+	"github.com/rancher/lb-controller/metrics"
+	"github.com/rancher/lb-controller/migrate"
 	"github.com/rancher/lb-controller/provider"
 	"github.com/urfave/cli"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,6 +31,8 @@ var (
 
 	lbc controller.LBController
 	lbp provider.LBProvider
+	// configPublisher serves the applied configs to the data planes
+	configPublisher *configsync.Publisher
 )
 
 func init() {
@@ -41,6 +56,46 @@ func main() {
 			Name:  "metadata-address",
 			Value: "rancher-metadata",
 			Usage: "Rancher metadata address",
+		}, cli.BoolFlag{
+			Name:  "render-only",
+			Usage: "Render the provider configs to the out dir and exit, without running the proxy",
+		}, cli.StringFlag{
+			Name:  "out",
+			Value: "rendered",
+			Usage: "Dir the configs are rendered to in render-only mode",
+		}, cli.StringFlag{
+			Name:  "renderer",
+			Usage: "Renderer of the configs in render-only mode, the provider or json, defaults to the provider",
+		}, cli.BoolFlag{
+			Name:  "render-watch",
+			Usage: "Keep rendering the configs on every change in render-only mode",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "schema",
+			Usage:  "Print json schema of the lb config model",
+			Action: printSchema,
+		},
+		{
+			Name:      "migrate",
+			Usage:     "Convert a haproxy config into the port rules and the custom config of an lb service",
+			ArgsUsage: "<haproxy.cfg>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "yaml",
+					Usage: "Output format, yaml or json",
+				},
+			},
+			Action: migrateHaproxyConfig,
+		},
+		{
+			Name:      "replay",
+			Usage:     "Build the lb configs from a metadata snapshot of the admin api, with the custom configs processed by the provider",
+			ArgsUsage: "<snapshot.json>",
+			Action:    replayMetadataSnapshot,
 		},
 	}
 
@@ -49,6 +104,17 @@ func main() {
 		lbControllerName = c.String("controller")
 		lbProviderName = c.String("provider")
 		metadataAddress = c.String("metadata-address")
+		if err := flags.Validate(); err != nil {
+			logrus.Fatalf("Invalid settings: %v", err)
+		}
+		role, err := configsync.RoleFromEnv()
+		if err != nil {
+			logrus.Fatalf("Invalid settings: %v", err)
+		}
+		if role == configsync.RoleDataPlane {
+			// the configs are fetched from the builder, not built
+			lbControllerName = configsync.DataPlaneControllerName
+		}
 		lbc = controller.GetController(lbControllerName, fmt.Sprintf("http://%s/2015-12-19", metadataAddress))
 		if lbc == nil {
 			logrus.Fatalf("Unable to find controller by name %s", lbControllerName)
@@ -57,13 +123,133 @@ func main() {
 		if lbp == nil {
 			logrus.Fatalf("Unable to find provider by name %s", lbProviderName)
 		}
+		if c.Bool("render-only") {
+			return renderOnly(c)
+		}
+		hooks := []provider.ApplyHook{}
+		// the guard runs first so the other hooks skip the deferred applies
+		if guard := provider.NewShrinkGuardFromEnv(); guard != nil {
+			hooks = append(hooks, guard)
+		}
+		hook, err := provider.NewExecHookFromEnv()
+		if err != nil {
+			logrus.Fatalf("Failed to configure apply hooks: %v", err)
+		}
+		if hook != nil {
+			hooks = append(hooks, hook)
+		}
+		eventHook, err := provider.NewEventHookFromEnv()
+		if err != nil {
+			logrus.Fatalf("Failed to configure event sinks: %v", err)
+		}
+		if eventHook != nil {
+			hooks = append(hooks, eventHook)
+			if sp, ok := lbp.(provider.EndpointStatusProvider); ok {
+				provider.EnableStats(lbp)
+				go eventHook.WatchEndpoints(sp, make(chan struct{}))
+			}
+		}
+		dnsSyncer, err := dnssync.NewSyncerFromEnv(lbp)
+		if err != nil {
+			logrus.Fatalf("Failed to configure dns sync: %v", err)
+		}
+		if dnsSyncer != nil {
+			hooks = append(hooks, dnsSyncer)
+		}
+		queueMonitor, err := metrics.NewQueueMonitorFromEnv(lbp)
+		if err != nil {
+			logrus.Fatalf("Failed to configure queue metrics: %v", err)
+		}
+		detector, err := metrics.NewAnomalyDetectorFromEnv(lbp)
+		if err != nil {
+			logrus.Fatalf("Failed to configure anomaly detection: %v", err)
+		}
+		if detector != nil {
+			hooks = append(hooks, detector)
+			rancher.RegisterMiddleware(countBuildFailures(detector))
+		}
+		uploader, err := backup.NewUploaderFromEnv(lbp)
+		if err != nil {
+			logrus.Fatalf("Failed to configure config backups: %v", err)
+		}
+		if uploader != nil {
+			hooks = append(hooks, uploader)
+		}
+		keepalivedManager, err := keepalived.NewManagerFromEnv()
+		if err != nil {
+			logrus.Fatalf("Failed to configure keepalived: %v", err)
+		}
+		if keepalivedManager != nil {
+			hooks = append(hooks, keepalivedManager)
+		}
+		speaker, err := bgp.NewSpeakerFromEnv(func() bool {
+			return lbc.IsHealthy() && lbp.IsHealthy()
+		})
+		if err != nil {
+			logrus.Fatalf("Failed to configure bgp: %v", err)
+		}
+		if speaker != nil {
+			hooks = append(hooks, speaker)
+		}
+		connCollector := metrics.NewConnCollectorFromEnv()
+		if connCollector != nil {
+			hooks = append(hooks, connCollector)
+		}
+		if configPublisher, err = configsync.NewPublisherFromEnv(); err != nil {
+			logrus.Fatalf("Failed to configure config publishing: %v", err)
+		}
+		if configPublisher != nil {
+			hooks = append(hooks, configPublisher)
+		}
+		var resync func()
+		if resyncer, ok := lbc.(controller.Resyncer); ok {
+			resync = resyncer.Resync
+		}
+		// the drift is checked on the provider itself, the hooks don't forward it
+		reconciler := provider.NewReconcilerFromEnv(lbp, resync)
+		if reconciler != nil {
+			reconciler.Events = eventHook
+		}
+		lbp = provider.WithHooks(lbp, hooks...)
 		logrus.Infof("LB controller: %s", lbc.GetName())
 		logrus.Infof("LB provider: %s", lbp.GetName())
 
 		go handleSigterm(lbc, lbp)
 
+		go handleStateDumpSignal()
+
+		go handleResyncSignal()
+
 		go startHealthcheck()
 
+		if interval := runtimeStatsInterval.Get(); interval > 0 {
+			go logRuntimeStats(interval)
+		}
+
+		if queueMonitor != nil {
+			go queueMonitor.Run(make(chan struct{}))
+		}
+
+		if uploader != nil {
+			go uploader.Run(make(chan struct{}))
+		}
+
+		if detector != nil {
+			go detector.Run(make(chan struct{}))
+		}
+
+		if reconciler != nil {
+			go reconciler.Run(make(chan struct{}))
+		}
+
+		if speaker != nil {
+			go speaker.Run(make(chan struct{}))
+		}
+
+		if connCollector != nil {
+			go connCollector.Run(make(chan struct{}))
+		}
+
 		lbc.Run(lbp)
 		return nil
 	}
@@ -71,6 +257,131 @@ func main() {
 	app.Run(os.Args)
 }
 
+// renderOnly renders the configs built by the controller to the out dir
+// instead of running the proxy, it exits after the first config unless
+// the configs are watched
+func renderOnly(c *cli.Context) error {
+	rendererName := c.String("renderer")
+	if rendererName == "" {
+		rendererName = lbProviderName
+	}
+	renderer := provider.GetRenderer(rendererName)
+	if renderer == nil {
+		logrus.Fatalf("Unable to find renderer by name %s", rendererName)
+	}
+	watch := c.Bool("render-watch")
+	renderProvider := provider.NewRenderOnlyProvider(lbp, renderer, c.String("out"), !watch)
+	logrus.Infof("Rendering the %s configs to %s", rendererName, c.String("out"))
+	if watch {
+		lbc.Run(renderProvider)
+		return nil
+	}
+	go lbc.Run(renderProvider)
+	<-renderProvider.Done()
+	if err := renderProvider.Err(); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	return nil
+}
+
+// countBuildFailures records the failures of the stages building the
+// configs, the apply failures are recorded by the apply hook
+func countBuildFailures(detector *metrics.AnomalyDetector) rancher.Middleware {
+	return func(stage string, next rancher.StageFunc) rancher.StageFunc {
+		return func(c *rancher.LoadBalancerController, state *rancher.SyncState) error {
+			err := next(c, state)
+			if err != nil && stage != rancher.StageApply {
+				detector.Record(metrics.SignalBuildFailures)
+			}
+			return err
+		}
+	}
+}
+
+// migrateHaproxyConfig prints the lb_config converted from the haproxy
+// config, the parts that couldn't be converted are reported on stderr
+func migrateHaproxyConfig(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Expected the path of the haproxy config", 1)
+	}
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer f.Close()
+	result, err := migrate.ConvertHaproxyConfig(f)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var b []byte
+	switch c.String("format") {
+	case "yaml":
+		b, err = candiedyaml.Marshal(result)
+	case "json":
+		b, err = json.MarshalIndent(result, "", "  ")
+	default:
+		return cli.NewExitError(fmt.Sprintf("Invalid format %s, expected yaml or json", c.String("format")), 1)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(b))
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+	}
+	return nil
+}
+
+func replayMetadataSnapshot(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Expected the path of the metadata snapshot", 1)
+	}
+	b, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	snapshot := &rancher.MetadataSnapshot{}
+	if err := json.Unmarshal(b, snapshot); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Invalid metadata snapshot: %v", err), 1)
+	}
+	lbp := provider.GetProvider(c.GlobalString("provider"))
+	if lbp == nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to find provider by name %s", c.GlobalString("provider")), 1)
+	}
+	cfgs, err := rancher.ReplayMetadataSnapshot(snapshot, lbp)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if b, err = json.MarshalIndent(cfgs, "", "  "); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func printSchema(c *cli.Context) error {
+	b, err := json.MarshalIndent(config.JSONSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// handleResyncSignal resyncs the controller on every SIGHUP
+func handleResyncSignal() {
+	resyncer, ok := lbc.(controller.Resyncer)
+	if !ok {
+		return
+	}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+	for range signalChan {
+		logrus.Infof("Received SIGHUP, resyncing")
+		resyncer.Resync()
+	}
+}
+
 func handleSigterm(lbc controller.LBController, lbp provider.LBProvider) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGTERM)
@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+// Signals tracked by the anomaly detector
+const (
+	SignalReloads       = "reloads"
+	SignalBuildFailures = "build_failures"
+	SignalBackendsDown  = "backends_down"
+
+	defaultAnomalyThreshold = 3.0
+	// anomalyWarmup is the number of windows the baselines
+	// are learnt over before the values are checked
+	anomalyWarmup = 10
+	// anomalyAlpha is the weight of the last window in the baselines
+	anomalyAlpha = 0.1
+	// minDeviation keeps the baselines of steady signals
+	// from flagging a change of one
+	minDeviation = 1.0
+)
+
+var (
+	anomalyWindow    = flags.Duration("ANOMALY_WINDOW", 0, "Window the reloads, build failures and backends down are counted over and checked against their baselines, 0 disables the anomaly detection")
+	anomalyThreshold = flags.Float("ANOMALY_THRESHOLD", defaultAnomalyThreshold, "Deviation of a signal from its baseline flagged as an anomaly, in standard deviations")
+	anomalyWebhook   = flags.String("ANOMALY_WEBHOOK", "", "Url the anomalies are posted to, they are only logged when not set")
+)
+
+// Anomaly is a signal deviating from its baseline, Recovered
+// is set when it comes back within the threshold
+type Anomaly struct {
+	Signal    string    `json:"signal"`
+	Value     float64   `json:"value"`
+	Baseline  float64   `json:"baseline"`
+	Deviation float64   `json:"deviation"`
+	Recovered bool      `json:"recovered"`
+	Time      time.Time `json:"time"`
+}
+
+/*
+AnomalyDetector tracks the reloads, the config build failures and the
+backends down per window against their moving averages, to surface the
+slow-burn problems no single failure reveals. A value deviating from
+its baseline by more than the threshold in standard deviations is
+logged as a warning and posted to the webhook once, the debug logs are
+turned on until all the signals recover
+*/
+type AnomalyDetector struct {
+	Window time.Duration
+	// Threshold is the deviation from the baseline flagged,
+	// in standard deviations
+	Threshold float64
+	// Webhook is posted the json encoded anomalies,
+	// they are only logged when empty
+	Webhook string
+	// Status reports the endpoints down, the backends
+	// down are not tracked when nil
+	Status provider.EndpointStatusProvider
+
+	client *http.Client
+
+	mu        sync.Mutex
+	counts    map[string]float64
+	baselines map[string]*baseline
+	// savedLevel is the log level restored once the signals recover
+	savedLevel *logrus.Level
+}
+
+// baseline is the exponentially weighted mean and variance of a signal
+type baseline struct {
+	mean      float64
+	variance  float64
+	windows   int
+	anomalous bool
+}
+
+// NewAnomalyDetectorFromEnv configures the detector from ANOMALY_WINDOW,
+// ANOMALY_THRESHOLD and ANOMALY_WEBHOOK env vars. Nil is returned when
+// no window is set
+func NewAnomalyDetectorFromEnv(lbp provider.LBProvider) (*AnomalyDetector, error) {
+	window := anomalyWindow.Get()
+	if window == 0 {
+		return nil, nil
+	}
+	if window < 0 {
+		return nil, fmt.Errorf("Invalid ANOMALY_WINDOW %v, should be positive", window)
+	}
+	d := NewAnomalyDetector(window)
+	if d.Threshold = anomalyThreshold.Get(); d.Threshold <= 0 {
+		return nil, fmt.Errorf("Invalid ANOMALY_THRESHOLD %v, should be positive", d.Threshold)
+	}
+	d.Webhook = anomalyWebhook.Get()
+	if status, ok := lbp.(provider.EndpointStatusProvider); ok {
+		d.Status = status
+		provider.EnableStats(lbp)
+	}
+	return d, nil
+}
+
+func NewAnomalyDetector(window time.Duration) *AnomalyDetector {
+	return &AnomalyDetector{
+		Window:    window,
+		Threshold: defaultAnomalyThreshold,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		counts:    map[string]float64{},
+		baselines: map[string]*baseline{},
+	}
+}
+
+func (d *AnomalyDetector) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply counts the applies as reloads, and the failed ones as build failures
+func (d *AnomalyDetector) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		d.Record(SignalBuildFailures)
+	} else {
+		d.Record(SignalReloads)
+	}
+	return nil
+}
+
+// Record counts an occurrence of the signal in the current window
+func (d *AnomalyDetector) Record(signal string) {
+	d.mu.Lock()
+	d.counts[signal]++
+	d.mu.Unlock()
+}
+
+// Run checks the signals every window until stopCh is closed
+func (d *AnomalyDetector) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(d.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			for _, anomaly := range d.check(time.Now()) {
+				if err := d.emit(anomaly); err != nil {
+					logrus.Errorf("%v", err)
+				}
+			}
+		}
+	}
+}
+
+// check closes the window, the signals starting or ending
+// to deviate from their baselines are returned
+func (d *AnomalyDetector) check(now time.Time) []Anomaly {
+	down := -1.0
+	if d.Status != nil {
+		if status, err := d.Status.GetEndpointStatus(); err != nil {
+			logrus.Debugf("Failed to read the endpoint status: %v", err)
+		} else {
+			down = countBackendsDown(status)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	values := map[string]float64{
+		SignalReloads:       d.counts[SignalReloads],
+		SignalBuildFailures: d.counts[SignalBuildFailures],
+	}
+	if down >= 0 {
+		values[SignalBackendsDown] = down
+	}
+	d.counts = map[string]float64{}
+
+	signals := make([]string, 0, len(values))
+	for signal := range values {
+		signals = append(signals, signal)
+	}
+	sort.Strings(signals)
+	var anomalies []Anomaly
+	anomalous := false
+	for _, signal := range signals {
+		b := d.baselines[signal]
+		if b == nil {
+			b = &baseline{}
+			d.baselines[signal] = b
+		}
+		if anomaly, changed := b.observe(signal, values[signal], d.Threshold, now); changed {
+			anomalies = append(anomalies, anomaly)
+		}
+		anomalous = anomalous || b.anomalous
+	}
+	d.elevateLogs(anomalous)
+	return anomalies
+}
+
+/*
+observe checks the value against the baseline, then folds it in. The
+values of an anomaly are not folded in, so a lasting problem doesn't
+become the baseline. The anomaly is returned when the signal starts or
+ends deviating
+*/
+func (b *baseline) observe(signal string, value float64, threshold float64, now time.Time) (Anomaly, bool) {
+	deviation := math.Max(math.Sqrt(b.variance), minDeviation)
+	anomalous := b.windows >= anomalyWarmup && value > b.mean+threshold*deviation
+	anomaly := Anomaly{
+		Signal:    signal,
+		Value:     value,
+		Baseline:  b.mean,
+		Deviation: (value - b.mean) / deviation,
+		Recovered: !anomalous,
+		Time:      now,
+	}
+	changed := anomalous != b.anomalous
+	b.anomalous = anomalous
+	if !anomalous {
+		if b.windows == 0 {
+			b.mean = value
+		} else {
+			diff := value - b.mean
+			b.mean += anomalyAlpha * diff
+			b.variance = (1 - anomalyAlpha) * (b.variance + anomalyAlpha*diff*diff)
+		}
+		b.windows++
+	}
+	return anomaly, changed
+}
+
+// elevateLogs turns on the debug logs while a signal is anomalous,
+// the previous level is restored once they all recovered
+func (d *AnomalyDetector) elevateLogs(anomalous bool) {
+	if anomalous && d.savedLevel == nil {
+		level := logrus.GetLevel()
+		if level >= logrus.DebugLevel {
+			return
+		}
+		d.savedLevel = &level
+		logrus.SetLevel(logrus.DebugLevel)
+	} else if !anomalous && d.savedLevel != nil {
+		logrus.SetLevel(*d.savedLevel)
+		d.savedLevel = nil
+	}
+}
+
+func countBackendsDown(status []provider.EndpointStatus) float64 {
+	up := map[string]bool{}
+	for _, s := range status {
+		if s.Status == provider.EndpointUp {
+			up[s.Backend] = true
+		} else if _, ok := up[s.Backend]; !ok {
+			up[s.Backend] = false
+		}
+	}
+	down := 0.0
+	for _, isUp := range up {
+		if !isUp {
+			down++
+		}
+	}
+	return down
+}
+
+// emit logs the anomaly and posts it to the webhook
+func (d *AnomalyDetector) emit(anomaly Anomaly) error {
+	entry := logrus.WithFields(logrus.Fields{
+		"signal":    anomaly.Signal,
+		"value":     anomaly.Value,
+		"baseline":  fmt.Sprintf("%.2f", anomaly.Baseline),
+		"deviation": fmt.Sprintf("%.1f", anomaly.Deviation),
+	})
+	if anomaly.Recovered {
+		entry.Info("Signal is back to its baseline")
+	} else {
+		entry.Warn("Signal deviates from its baseline")
+	}
+	if d.Webhook == "" {
+		return nil
+	}
+	b, err := json.Marshal(anomaly)
+	if err != nil {
+		return err
+	}
+	client := d.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(d.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Failed to post anomaly: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Failed to post anomaly, status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/provider"
+)
+
+type tStatusProvider struct {
+	status []provider.EndpointStatus
+}
+
+func (p *tStatusProvider) GetEndpointStatus() ([]provider.EndpointStatus, error) {
+	return p.status, nil
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+	status := &tStatusProvider{status: []provider.EndpointStatus{
+		{Backend: "api", Server: "a", Status: provider.EndpointUp},
+		{Backend: "api", Server: "b", Status: provider.EndpointDown},
+		{Backend: "web", Server: "a", Status: provider.EndpointDown},
+	}}
+	d := NewAnomalyDetector(time.Minute)
+	d.Status = status
+	now := time.Now()
+	// a baseline of 2 reloads per window, one backend down
+	for i := 0; i < anomalyWarmup; i++ {
+		d.Record(SignalReloads)
+		d.Record(SignalReloads)
+		if anomalies := d.check(now); len(anomalies) != 0 {
+			t.Fatalf("Nothing should be flagged while learning the baselines %+v", anomalies)
+		}
+	}
+	d.Record(SignalReloads)
+	d.Record(SignalReloads)
+	d.Record(SignalReloads)
+	if anomalies := d.check(now); len(anomalies) != 0 {
+		t.Fatalf("Small deviations should not be flagged %+v", anomalies)
+	}
+
+	for i := 0; i < 20; i++ {
+		d.Record(SignalReloads)
+	}
+	anomalies := d.check(now)
+	if len(anomalies) != 1 || anomalies[0].Signal != SignalReloads || anomalies[0].Recovered || anomalies[0].Value != 20 {
+		t.Fatalf("Reload storm should be flagged %+v", anomalies)
+	}
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("Debug logs should be turned on during the anomaly")
+	}
+	for i := 0; i < 20; i++ {
+		d.Record(SignalReloads)
+	}
+	if anomalies := d.check(now); len(anomalies) != 0 {
+		t.Fatalf("A lasting anomaly should only be flagged once %+v", anomalies)
+	}
+	d.Record(SignalReloads)
+	d.Record(SignalReloads)
+	anomalies = d.check(now)
+	if len(anomalies) != 1 || !anomalies[0].Recovered || logrus.GetLevel() != logrus.InfoLevel {
+		t.Fatalf("Recovery should be reported and the log level restored %+v", anomalies)
+	}
+
+	status.status = append(status.status, []provider.EndpointStatus{
+		{Backend: "db", Server: "a", Status: provider.EndpointDown},
+		{Backend: "cache", Server: "a", Status: provider.EndpointDown},
+		{Backend: "queue", Server: "a", Status: provider.EndpointDrained},
+		{Backend: "auth", Server: "a", Status: provider.EndpointDown},
+	}...)
+	d.Record(SignalReloads)
+	d.Record(SignalReloads)
+	anomalies = d.check(now)
+	if len(anomalies) != 1 || anomalies[0].Signal != SignalBackendsDown || anomalies[0].Value != 5 {
+		t.Fatalf("Backends going down should be flagged %+v", anomalies)
+	}
+}
+
+func TestAnomalyWebhook(t *testing.T) {
+	var received Anomaly
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	d := NewAnomalyDetector(time.Minute)
+	d.Webhook = server.URL
+	if err := d.emit(Anomaly{Signal: SignalBuildFailures, Value: 12, Baseline: 0.5}); err != nil {
+		t.Fatalf("Failed to post anomaly %v", err)
+	}
+	if received.Signal != SignalBuildFailures || received.Value != 12 {
+		t.Fatalf("Anomaly should be posted %+v", received)
+	}
+}
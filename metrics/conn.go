@@ -0,0 +1,350 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	connStatsEnabled  = flags.Bool("EBPF_CONN_STATS", false, "Count the syns, the accepts and the syn drops of the frontends, and their rtt distribution, with eBPF where the kernel supports it")
+	connStatsInterval = flags.Duration("EBPF_CONN_STATS_INTERVAL", 10*time.Second, "Interval the eBPF connection stats are collected at")
+	bpftraceCmd       = flags.String("BPFTRACE_CMD", "bpftrace", "bpftrace binary the eBPF programs are run with")
+)
+
+var (
+	frontendSyns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_frontend_syns_total",
+		Help: "Number of connection requests received by the frontend",
+	}, []string{"frontend"})
+	frontendAccepts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_frontend_accepts_total",
+		Help: "Number of connections accepted by the frontend",
+	}, []string{"frontend"})
+	frontendSynDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_frontend_syn_drops_total",
+		Help: "Number of connection requests dropped as the accept queue of the frontend was full",
+	}, []string{"frontend"})
+	rttDesc = prometheus.NewDesc("lb_frontend_rtt_seconds", "Smoothed rtt of the connections of the frontend, sampled once as they close", []string{"frontend"}, nil)
+	// rttBuckets are the upper bounds of the rtt buckets in us
+	rttBuckets = []int{100, 500, 1000, 5000, 10000, 50000, 100000, 500000, 1000000}
+)
+
+// connStatRegexp matches the maps printed by the program, as
+// @syn[80]: 12 and @rtt[443, 1000]: 5
+var connStatRegexp = regexp.MustCompile(`^@(\w+)\[(\d+)(?:, (\d+))?\]: (\d+)$`)
+
+/*
+ConnCollector reports the connection acceptance of the frontends the
+proxy stats don't tell: the syns received, the connections accepted,
+the syns dropped on a full accept queue, and the rtt distribution of
+the connections. The counts are aggregated in the kernel
+by a bpftrace program watching the ports of the frontends, restarted
+when they change. It is invoked as an apply hook of the lb provider
+*/
+type ConnCollector struct {
+	Cmd      string
+	Interval time.Duration
+
+	mu sync.Mutex
+	// frontends are the frontend names by port
+	frontends map[int]string
+	changed   chan struct{}
+	// rtt are the cumulative bucket counts by frontend,
+	// the last bucket counting the rtts above the bounds
+	rtt    map[string][]uint64
+	rttSum map[string]float64
+}
+
+// NewConnCollectorFromEnv configures the collector from the EBPF_CONN_STATS*
+// env vars, nil is returned when EBPF_CONN_STATS is off
+func NewConnCollectorFromEnv() *ConnCollector {
+	if !connStatsEnabled.Get() {
+		return nil
+	}
+	return &ConnCollector{
+		Cmd:      bpftraceCmd.Get(),
+		Interval: connStatsInterval.Get(),
+	}
+}
+
+// PreApply is a no-op, the ports are watched once the config is applied
+func (c *ConnCollector) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+// PostApply watches the ports of the tcp based frontends of the config
+func (c *ConnCollector) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	frontends := map[int]string{}
+	for _, fe := range lbConfig.FrontendServices {
+		if fe.Protocol != config.UDPProto {
+			frontends[fe.Port] = fe.Name
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if samePorts(c.frontends, frontends) {
+		c.frontends = frontends
+		return nil
+	}
+	c.frontends = frontends
+	if c.changed == nil {
+		c.changed = make(chan struct{}, 1)
+	}
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func samePorts(a, b map[int]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for port := range a {
+		if _, ok := b[port]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *ConnCollector) ports() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ports []int
+	for port := range c.frontends {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func (c *ConnCollector) changes() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed == nil {
+		c.changed = make(chan struct{}, 1)
+	}
+	return c.changed
+}
+
+// Describe and Collect export the rtt histograms
+func (c *ConnCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rttDesc
+}
+
+func (c *ConnCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for frontend, counts := range c.rtt {
+		buckets := map[float64]uint64{}
+		var cumulative uint64
+		for i, bound := range rttBuckets {
+			cumulative += counts[i]
+			buckets[float64(bound)/1e6] = cumulative
+		}
+		total := cumulative + counts[len(rttBuckets)]
+		ch <- prometheus.MustNewConstHistogram(rttDesc, total, c.rttSum[frontend], buckets, frontend)
+	}
+}
+
+// supported tells whether bpftrace runs on the kernel
+func (c *ConnCollector) supported() error {
+	output, err := exec.Command("sh", "-c", c.Cmd+" -e 'BEGIN { exit(); }'").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v -- %v", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Run collects the stats until stopCh is closed, the program is
+// restarted when the ports of the frontends change
+func (c *ConnCollector) Run(stopCh <-chan struct{}) {
+	if err := c.supported(); err != nil {
+		logrus.Warnf("eBPF connection stats are not supported on this host: %v", err)
+		return
+	}
+	prometheus.MustRegister(frontendSyns, frontendAccepts, frontendSynDrops, c)
+	changed := c.changes()
+	for {
+		ports := c.ports()
+		if len(ports) == 0 {
+			select {
+			case <-stopCh:
+				return
+			case <-changed:
+				continue
+			}
+		}
+		cmd := exec.Command(c.Cmd, "-e", connStatsProgram(ports, c.Interval))
+		done := make(chan error, 1)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			logrus.Errorf("Failed to run the eBPF connection stats: %v", err)
+			return
+		}
+		go func() {
+			c.read(stdout)
+			done <- cmd.Wait()
+		}()
+		select {
+		case <-stopCh:
+			cmd.Process.Kill()
+			<-done
+			return
+		case <-changed:
+			cmd.Process.Kill()
+			<-done
+		case err := <-done:
+			logrus.Errorf("eBPF connection stats exited, restarting them: %v", err)
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(c.Interval):
+			}
+		}
+	}
+}
+
+func (c *ConnCollector) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		c.record(strings.TrimSpace(scanner.Text()))
+	}
+}
+
+// record counts a map entry printed by the program, the
+// maps are cleared after they are printed
+func (c *ConnCollector) record(line string) {
+	match := connStatRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	port, _ := strconv.Atoi(match[2])
+	count, _ := strconv.ParseUint(match[4], 10, 64)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frontend, ok := c.frontends[port]
+	if !ok {
+		return
+	}
+	switch match[1] {
+	case "syn":
+		frontendSyns.WithLabelValues(frontend).Add(float64(count))
+	case "accept":
+		frontendAccepts.WithLabelValues(frontend).Add(float64(count))
+	case "drop":
+		frontendSynDrops.WithLabelValues(frontend).Add(float64(count))
+	case "rtt":
+		bound, _ := strconv.Atoi(match[3])
+		if c.rtt == nil {
+			c.rtt = map[string][]uint64{}
+			c.rttSum = map[string]float64{}
+		}
+		counts, ok := c.rtt[frontend]
+		if !ok {
+			counts = make([]uint64, len(rttBuckets)+1)
+			c.rtt[frontend] = counts
+		}
+		i := sort.SearchInts(rttBuckets, bound)
+		counts[i] += count
+		// the sum is estimated from the bucket bounds, the
+		// rtts above them are counted as twice the last one
+		if i == len(rttBuckets) {
+			bound = 2 * rttBuckets[len(rttBuckets)-1]
+		}
+		c.rttSum[frontend] += float64(count) * float64(bound) / 1e6
+	}
+}
+
+/*
+connStatsProgram is the bpftrace program counting the syns and the
+accepts of the listening sockets of the ports, the syns dropped on a
+full accept queue, and the smoothed rtts of the connections by bucket,
+in us. The rtt is sampled once per connection as it moves to the close
+state, not per segment, so the probe stays off the receive path; the
+connections never established have no rtt and are skipped. The maps
+are printed every interval then cleared
+*/
+func connStatsProgram(ports []int, interval time.Duration) string {
+	var filter []string
+	for _, port := range ports {
+		filter = append(filter, fmt.Sprintf("$port == %d", port))
+	}
+	bucket := fmt.Sprintf("%d", rttBuckets[len(rttBuckets)-1]+1)
+	for i := len(rttBuckets) - 1; i >= 0; i-- {
+		bucket = fmt.Sprintf("$rtt <= %d ? %d : (%s)", rttBuckets[i], rttBuckets[i], bucket)
+	}
+	seconds := int(interval / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return fmt.Sprintf(`
+kprobe:tcp_conn_request
+{
+	$sk = (struct sock *)arg2;
+	$port = $sk->__sk_common.skc_num;
+	if (%[1]s) {
+		@syn[$port] = count();
+		if ($sk->sk_ack_backlog > $sk->sk_max_ack_backlog) {
+			@drop[$port] = count();
+		}
+	}
+}
+
+kretprobe:inet_csk_accept
+{
+	$sk = (struct sock *)retval;
+	if ($sk != 0) {
+		$port = $sk->__sk_common.skc_num;
+		if (%[1]s) {
+			@accept[$port] = count();
+		}
+	}
+}
+
+// 7 is TCP_CLOSE
+kprobe:tcp_set_state
+/arg1 == 7/
+{
+	$sk = (struct sock *)arg0;
+	$port = $sk->__sk_common.skc_num;
+	$rtt = ((struct tcp_sock *)arg0)->srtt_us >> 3;
+	if ($rtt > 0 && (%[1]s)) {
+		@rtt[$port, %[2]s] = count();
+	}
+}
+
+interval:s:%[3]d
+{
+	print(@syn);
+	print(@accept);
+	print(@drop);
+	print(@rtt);
+	clear(@syn);
+	clear(@accept);
+	clear(@drop);
+	clear(@rtt);
+}
+`, strings.Join(filter, " || "), bucket, seconds)
+}
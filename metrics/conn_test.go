@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rancher/lb-controller/config"
+)
+
+func TestConnCollectorRecord(t *testing.T) {
+	c := &ConnCollector{Interval: 10 * time.Second}
+	lbConfig := &config.LoadBalancerConfig{
+		Name: "lb",
+		FrontendServices: []*config.FrontendService{
+			{Name: "80", Port: 80, Protocol: config.HTTPProto},
+			{Name: "53", Port: 53, Protocol: config.UDPProto},
+		},
+	}
+	if err := c.PostApply(lbConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.changes():
+	default:
+		t.Fatalf("Expected the new ports to restart the program")
+	}
+	if ports := c.ports(); len(ports) != 1 || ports[0] != 80 {
+		t.Fatalf("Expected the tcp based frontends to be watched, got %v", ports)
+	}
+	// the same ports don't restart it
+	c.PostApply(lbConfig, nil)
+	select {
+	case <-c.changes():
+		t.Fatalf("Unchanged ports shouldn't restart the program")
+	default:
+	}
+
+	before := counterValue(frontendSyns.WithLabelValues("80"))
+	for _, line := range []string{
+		"@syn[80]: 12",
+		"@syn[8080]: 3",
+		"@accept[80]: 10",
+		"@rtt[80, 1000]: 4",
+		"@rtt[80, 1000001]: 1",
+		"Attaching 4 probes...",
+	} {
+		c.record(line)
+	}
+	if after := counterValue(frontendSyns.WithLabelValues("80")); after-before != 12 {
+		t.Fatalf("Expected 12 syns, got %v", after-before)
+	}
+	counts := c.rtt["80"]
+	if counts[2] != 4 || counts[len(rttBuckets)] != 1 {
+		t.Fatalf("Unexpected rtt buckets %v", counts)
+	}
+
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	m := &dto.Metric{}
+	if err := (<-ch).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Histogram.GetSampleCount() != 5 || m.Histogram.Bucket[2].GetCumulativeCount() != 4 {
+		t.Fatalf("Unexpected rtt histogram %v", m.Histogram)
+	}
+}
+
+func TestConnStatsProgram(t *testing.T) {
+	program := connStatsProgram([]int{80, 443}, 10*time.Second)
+	for _, expected := range []string{
+		"if ($port == 80 || $port == 443) {",
+		"kprobe:tcp_set_state\n/arg1 == 7/",
+		"if ($rtt > 0 && ($port == 80 || $port == 443)) {",
+		"@rtt[$port, $rtt <= 100 ? 100 : ($rtt <= 500 ? 500 :",
+		"interval:s:10",
+	} {
+		if !strings.Contains(program, expected) {
+			t.Fatalf("Expected %q in the program:\n%s", expected, program)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Package metrics exposes load balancer metrics collected from the provider.
+
+The queue monitor polls backend queue stats of the provider, exports them
+as prometheus gauges and logs a warning when a backend crosses the queue
+depth or queue time threshold, so saturation is noticed before the
+provider starts to reply with 503s. Optionally the load is passed to the
+scale advisor, which recommends to scale the backends up or down when the
+load stays over or under the thresholds for a sustained period.
+
+The closed connections of the tcp frontends reported by the provider are
+counted by termination state, along with the connect errors and retries.
+Where the kernel supports eBPF, the connection collector counts the syns,
+the accepts and the syn drops of the frontends, and their rtt distribution.
+
+The backends of the lbs shared by several environments are named after
+their environment, as <environment>::<backend>, the metrics label them
+with the environment and the backend name. The backends are also labeled
+with their metrics tag, so the metrics can be sliced by team or product.
+*/
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+var (
+	queueMetricsEnabled = flags.Bool("QUEUE_METRICS", false, "Export the backend queue metrics read from the provider stats")
+	queueInterval       = flags.Duration("QUEUE_METRICS_INTERVAL", 10*time.Second, "Interval the backend queue stats are polled at")
+	queueDepthThreshold = flags.Int("QUEUE_DEPTH_THRESHOLD", 0, "Queue depth a backend is considered saturated at, 0 disables the check").Range(0, 100000000)
+	queueTimeThreshold  = flags.Duration("QUEUE_TIME_THRESHOLD", 0, "Queue time a backend is considered saturated at, 0 disables the check")
+)
+
+// backendLabels are the labels of the backend metrics, the environment
+// is set for the backends of the lbs shared by several environments and
+// the tag for the backends having a metrics tag
+var backendLabels = []string{"environment", "backend", "tag"}
+
+var (
+	queueCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_queue_current",
+		Help: "Number of requests queued by the backend",
+	}, backendLabels)
+	queueMax = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_queue_max",
+		Help: "Max number of requests queued by the backend",
+	}, backendLabels)
+	queueTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_queue_time_ms",
+		Help: "Average queue time of the last backend requests in ms",
+	}, backendLabels)
+	sessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_sessions",
+		Help: "Number of current backend sessions",
+	}, backendLabels)
+	saturated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_backend_saturated",
+		Help: "Set to 1 when the backend crosses the queue saturation threshold",
+	}, backendLabels)
+	registerOnce sync.Once
+)
+
+// QueueMonitor polls backend stats of the provider
+type QueueMonitor struct {
+	Stats    provider.StatsProvider
+	Interval time.Duration
+	// DepthThreshold is the queue depth considered saturated, 0 disables the check
+	DepthThreshold int
+	// TimeThreshold is the queue time considered saturated, 0 disables the check
+	TimeThreshold time.Duration
+	// ScaleAdvisor is fed the collected stats when set
+	ScaleAdvisor *ScaleAdvisor
+
+	saturated map[string]bool
+	// backends are the tags of the backends by name, the
+	// metrics of the removed backends are dropped with them
+	backends map[string]string
+}
+
+// NewQueueMonitorFromEnv configures the monitor from QUEUE_METRICS_INTERVAL,
+// QUEUE_DEPTH_THRESHOLD and QUEUE_TIME_THRESHOLD env vars. Nil is returned
+// when QUEUE_METRICS is off or the provider doesn't report backend stats
+func NewQueueMonitorFromEnv(lbp provider.LBProvider) (*QueueMonitor, error) {
+	stats, ok := lbp.(provider.StatsProvider)
+	if !ok || !queueMetricsEnabled.Get() {
+		return nil, nil
+	}
+	m := &QueueMonitor{
+		Stats:          stats,
+		Interval:       queueInterval.Get(),
+		DepthThreshold: queueDepthThreshold.Get(),
+		TimeThreshold:  queueTimeThreshold.Get(),
+	}
+	if m.Interval <= 0 {
+		return nil, fmt.Errorf("Invalid QUEUE_METRICS_INTERVAL %v, should be positive", m.Interval)
+	}
+	if m.TimeThreshold < 0 {
+		return nil, fmt.Errorf("Invalid QUEUE_TIME_THRESHOLD %v", m.TimeThreshold)
+	}
+	advisor, err := NewScaleAdvisorFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	m.ScaleAdvisor = advisor
+	provider.EnableStats(lbp)
+	return m, nil
+}
+
+// Register registers the queue and tcp metrics with the default prometheus registry
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(queueCurrent, queueMax, queueTime, sessions, saturated)
+		prometheus.MustRegister(tcpConnections, tcpConnectErrors, tcpRetries)
+	})
+}
+
+// Run polls the stats until stopCh is closed
+func (m *QueueMonitor) Run(stopCh <-chan struct{}) {
+	Register()
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		if err := m.collect(); err != nil {
+			logrus.Debugf("Failed to collect backend stats: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *QueueMonitor) collect() error {
+	stats, err := m.Stats.GetBackendStats()
+	if err != nil {
+		return err
+	}
+	backends := map[string]string{}
+	for _, s := range stats {
+		backends[s.Name] = s.Tag
+		env, name := config.SplitEnvironmentName(s.Name)
+		queueCurrent.WithLabelValues(env, name, s.Tag).Set(float64(s.QueueCurrent))
+		queueMax.WithLabelValues(env, name, s.Tag).Set(float64(s.QueueMax))
+		queueTime.WithLabelValues(env, name, s.Tag).Set(float64(s.QueueTime))
+		sessions.WithLabelValues(env, name, s.Tag).Set(float64(s.Sessions))
+		m.check(s)
+	}
+	// drop the metrics of removed backends, and of the previous tag of
+	// the retagged ones
+	for name, tag := range m.backends {
+		newTag, ok := backends[name]
+		if ok && newTag == tag {
+			continue
+		}
+		env, backend := config.SplitEnvironmentName(name)
+		for _, g := range []*prometheus.GaugeVec{queueCurrent, queueMax, queueTime, sessions, saturated} {
+			g.DeleteLabelValues(env, backend, tag)
+		}
+		if !ok {
+			delete(m.saturated, name)
+		}
+	}
+	m.backends = backends
+	if m.ScaleAdvisor != nil {
+		for _, hint := range m.ScaleAdvisor.Observe(stats, time.Now()) {
+			if err := m.ScaleAdvisor.Emit(hint); err != nil {
+				logrus.Errorf("%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// check logs a warning when the backend becomes saturated and
+// an info when it recovers, so the warning is not repeated on every poll
+func (m *QueueMonitor) check(s provider.BackendStats) {
+	depthCrossed := m.DepthThreshold > 0 && s.QueueCurrent >= m.DepthThreshold
+	timeCrossed := m.TimeThreshold > 0 && time.Duration(s.QueueTime)*time.Millisecond >= m.TimeThreshold
+	isSaturated := depthCrossed || timeCrossed
+	if m.saturated == nil {
+		m.saturated = map[string]bool{}
+	}
+	fields := logrus.Fields{
+		"backend":         s.Name,
+		"tag":             s.Tag,
+		"queue_current":   s.QueueCurrent,
+		"queue_max":       s.QueueMax,
+		"queue_time_ms":   s.QueueTime,
+		"sessions":        s.Sessions,
+		"depth_threshold": m.DepthThreshold,
+		"time_threshold":  m.TimeThreshold.String(),
+	}
+	if isSaturated && !m.saturated[s.Name] {
+		logrus.WithFields(fields).Warn("Backend queue crossed saturation threshold")
+	} else if !isSaturated && m.saturated[s.Name] {
+		logrus.WithFields(fields).Info("Backend queue recovered from saturation")
+	}
+	m.saturated[s.Name] = isSaturated
+	env, name := config.SplitEnvironmentName(s.Name)
+	if isSaturated {
+		saturated.WithLabelValues(env, name, s.Tag).Set(1)
+	} else {
+		saturated.WithLabelValues(env, name, s.Tag).Set(0)
+	}
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rancher/lb-controller/provider"
+)
+
+type tStats struct {
+	stats []provider.BackendStats
+}
+
+func (s *tStats) GetBackendStats() ([]provider.BackendStats, error) {
+	return s.stats, nil
+}
+
+func TestQueueSaturation(t *testing.T) {
+	stats := &tStats{}
+	m := &QueueMonitor{
+		Stats:          stats,
+		DepthThreshold: 10,
+		TimeThreshold:  time.Second,
+	}
+	stats.stats = []provider.BackendStats{
+		{Name: "foo", QueueCurrent: 1, QueueTime: 10},
+		{Name: "bar", QueueCurrent: 0, QueueTime: 1500},
+	}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if m.saturated["foo"] || !m.saturated["bar"] {
+		t.Fatalf("Invalid saturated backends %v", m.saturated)
+	}
+
+	stats.stats = []provider.BackendStats{
+		{Name: "foo", QueueCurrent: 10, QueueTime: 10},
+	}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if !m.saturated["foo"] {
+		t.Fatalf("Backend foo should be saturated")
+	}
+	if _, ok := m.saturated["bar"]; ok {
+		t.Fatalf("Removed backend bar should be dropped")
+	}
+
+	stats.stats = []provider.BackendStats{
+		{Name: "foo", QueueCurrent: 2, QueueTime: 10},
+	}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if m.saturated["foo"] {
+		t.Fatalf("Backend foo should recover")
+	}
+}
+
+func TestQueueThresholdsDisabled(t *testing.T) {
+	m := &QueueMonitor{
+		Stats: &tStats{stats: []provider.BackendStats{
+			{Name: "foo", QueueCurrent: 1000, QueueTime: 100000},
+		}},
+	}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if m.saturated["foo"] {
+		t.Fatalf("Backend foo shouldn't be saturated without thresholds")
+	}
+}
+
+func TestQueueEnvironmentLabels(t *testing.T) {
+	stats := &tStats{stats: []provider.BackendStats{{Name: "1a5::api", QueueCurrent: 3}}}
+	m := &QueueMonitor{Stats: stats}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	metric := &dto.Metric{}
+	queueCurrent.WithLabelValues("1a5", "api", "").Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 3 {
+		t.Fatalf("The queue of the backend should be labeled with its environment, got %v", v)
+	}
+	stats.stats = nil
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if deleted := queueCurrent.DeleteLabelValues("1a5", "api", ""); deleted {
+		t.Fatalf("The metrics of the removed backend should be dropped")
+	}
+}
+
+func TestQueueTagLabels(t *testing.T) {
+	stats := &tStats{stats: []provider.BackendStats{{Name: "web", QueueCurrent: 2, Tag: "payments"}}}
+	m := &QueueMonitor{Stats: stats}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	metric := &dto.Metric{}
+	queueCurrent.WithLabelValues("", "web", "payments").Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 2 {
+		t.Fatalf("The queue of the backend should be labeled with its tag, got %v", v)
+	}
+	stats.stats = []provider.BackendStats{{Name: "web", QueueCurrent: 2, Tag: "checkout"}}
+	if err := m.collect(); err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if deleted := queueCurrent.DeleteLabelValues("", "web", "payments"); deleted {
+		t.Fatalf("The metrics of the previous tag should be dropped")
+	}
+	if deleted := queueCurrent.DeleteLabelValues("", "web", "checkout"); !deleted {
+		t.Fatalf("The metrics of the new tag should be set")
+	}
+}
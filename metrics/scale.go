@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+const (
+	ScaleUp   = "up"
+	ScaleDown = "down"
+)
+
+var (
+	scaleUpRate      = flags.Int("SCALE_UP_RATE", 0, "Session rate of a backend from which its scale up is recommended, 0 disables the threshold").Range(0, 100000000)
+	scaleUpQueue     = flags.Int("SCALE_UP_QUEUE", 0, "Queue depth of a backend from which its scale up is recommended, 0 disables the threshold").Range(0, 100000000)
+	scaleDownRate    = flags.Int("SCALE_DOWN_RATE", 0, "Session rate of a backend under which its scale down is recommended, 0 disables the scale down hints").Range(0, 100000000)
+	scaleHintPeriod  = flags.Duration("SCALE_HINT_PERIOD", 5*time.Minute, "How long the load of a backend stays over or under the thresholds before a scale hint")
+	scaleHintWebhook = flags.String("SCALE_HINT_WEBHOOK", "", "Url the scale hints are posted to, they are only logged when not set")
+)
+
+// ScaleHint recommends to scale the services of the backend
+type ScaleHint struct {
+	Backend      string    `json:"backend"`
+	Direction    string    `json:"direction"`
+	Reason       string    `json:"reason"`
+	Rate         int       `json:"rate"`
+	QueueCurrent int       `json:"queue_current"`
+	Since        time.Time `json:"since"`
+}
+
+// ScaleAdvisor emits scale hints when backend load stays over the scale up,
+// or under the scale down thresholds for the whole period. The hint is
+// repeated every period for as long as the load stays there
+type ScaleAdvisor struct {
+	// UpRate and UpQueue are the session rate and queue depth the backend
+	// is scaled up at, 0 disables the threshold
+	UpRate  int
+	UpQueue int
+	// DownRate is the session rate the backend is scaled down under,
+	// 0 disables scale down hints
+	DownRate int
+	Period   time.Duration
+	// Webhook is posted the json encoded hint, hints are only logged when empty
+	Webhook string
+
+	client *http.Client
+	states map[string]*scaleState
+}
+
+type scaleState struct {
+	direction string
+	since     time.Time
+}
+
+// NewScaleAdvisorFromEnv configures the advisor from SCALE_UP_RATE, SCALE_UP_QUEUE,
+// SCALE_DOWN_RATE, SCALE_HINT_PERIOD and SCALE_HINT_WEBHOOK env vars. Nil is
+// returned when no threshold is set
+func NewScaleAdvisorFromEnv() (*ScaleAdvisor, error) {
+	a := &ScaleAdvisor{
+		UpRate:   scaleUpRate.Get(),
+		UpQueue:  scaleUpQueue.Get(),
+		DownRate: scaleDownRate.Get(),
+		Period:   scaleHintPeriod.Get(),
+		Webhook:  scaleHintWebhook.Get(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if a.UpRate == 0 && a.UpQueue == 0 && a.DownRate == 0 {
+		return nil, nil
+	}
+	if a.UpRate > 0 && a.DownRate >= a.UpRate {
+		return nil, fmt.Errorf("SCALE_DOWN_RATE should be lower than SCALE_UP_RATE")
+	}
+	if a.Period <= 0 {
+		return nil, fmt.Errorf("Invalid SCALE_HINT_PERIOD %v, should be positive", a.Period)
+	}
+	return a, nil
+}
+
+// Observe updates the load of the backends and returns the hints due
+func (a *ScaleAdvisor) Observe(stats []provider.BackendStats, now time.Time) []ScaleHint {
+	if a.states == nil {
+		a.states = map[string]*scaleState{}
+	}
+	var hints []ScaleHint
+	seen := map[string]bool{}
+	for _, s := range stats {
+		seen[s.Name] = true
+		direction, reason := a.direction(s)
+		state := a.states[s.Name]
+		if direction == "" {
+			delete(a.states, s.Name)
+			continue
+		}
+		if state == nil || state.direction != direction {
+			a.states[s.Name] = &scaleState{direction: direction, since: now}
+			continue
+		}
+		if now.Sub(state.since) < a.Period {
+			continue
+		}
+		hints = append(hints, ScaleHint{
+			Backend:      s.Name,
+			Direction:    direction,
+			Reason:       reason,
+			Rate:         s.Rate,
+			QueueCurrent: s.QueueCurrent,
+			Since:        state.since,
+		})
+		state.since = now
+	}
+	for name := range a.states {
+		if !seen[name] {
+			delete(a.states, name)
+		}
+	}
+	return hints
+}
+
+func (a *ScaleAdvisor) direction(s provider.BackendStats) (string, string) {
+	if a.UpQueue > 0 && s.QueueCurrent >= a.UpQueue {
+		return ScaleUp, fmt.Sprintf("queue depth %v is over %v", s.QueueCurrent, a.UpQueue)
+	}
+	if a.UpRate > 0 && s.Rate >= a.UpRate {
+		return ScaleUp, fmt.Sprintf("session rate %v is over %v", s.Rate, a.UpRate)
+	}
+	if a.DownRate > 0 && s.Rate < a.DownRate && s.QueueCurrent == 0 {
+		return ScaleDown, fmt.Sprintf("session rate %v is under %v", s.Rate, a.DownRate)
+	}
+	return "", ""
+}
+
+// Emit logs the hint and posts it to the webhook
+func (a *ScaleAdvisor) Emit(hint ScaleHint) error {
+	logrus.WithFields(logrus.Fields{
+		"backend":       hint.Backend,
+		"direction":     hint.Direction,
+		"reason":        hint.Reason,
+		"rate":          hint.Rate,
+		"queue_current": hint.QueueCurrent,
+		"since":         hint.Since.Format(time.RFC3339),
+	}).Info("Backend scale hint")
+	if a.Webhook == "" {
+		return nil
+	}
+	b, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	client := a.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(a.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Failed to post scale hint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Failed to post scale hint, status %s", resp.Status)
+	}
+	return nil
+}
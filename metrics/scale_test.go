@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rancher/lb-controller/provider"
+)
+
+func TestScaleHints(t *testing.T) {
+	a := &ScaleAdvisor{
+		UpRate:   100,
+		UpQueue:  10,
+		DownRate: 5,
+		Period:   time.Minute,
+	}
+	start := time.Now()
+	load := []provider.BackendStats{
+		{Name: "foo", Rate: 150},
+		{Name: "bar", Rate: 1},
+		{Name: "baz", Rate: 50},
+	}
+	if hints := a.Observe(load, start); len(hints) != 0 {
+		t.Fatalf("Hints shouldn't be emitted before the period %v", hints)
+	}
+	if hints := a.Observe(load, start.Add(30*time.Second)); len(hints) != 0 {
+		t.Fatalf("Hints shouldn't be emitted before the period %v", hints)
+	}
+	hints := a.Observe(load, start.Add(time.Minute))
+	if len(hints) != 2 {
+		t.Fatalf("Invalid hints length %v", len(hints))
+	}
+	for _, hint := range hints {
+		if hint.Backend == "foo" && hint.Direction != ScaleUp {
+			t.Fatalf("Invalid hint %v", hint)
+		}
+		if hint.Backend == "bar" && hint.Direction != ScaleDown {
+			t.Fatalf("Invalid hint %v", hint)
+		}
+	}
+	// load changed direction, the period restarts
+	load = []provider.BackendStats{
+		{Name: "foo", Rate: 150},
+		{Name: "bar", Rate: 1, QueueCurrent: 20},
+	}
+	hints = a.Observe(load, start.Add(90*time.Second))
+	if len(hints) != 0 {
+		t.Fatalf("Invalid hints %v", hints)
+	}
+	hints = a.Observe(load, start.Add(2*time.Minute))
+	if len(hints) != 1 || hints[0].Backend != "foo" {
+		t.Fatalf("Invalid hints %v", hints)
+	}
+}
+
+func TestScaleHintWebhook(t *testing.T) {
+	var received ScaleHint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&received); err != nil {
+			t.Errorf("Failed to decode hint: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	a := &ScaleAdvisor{Webhook: server.URL}
+	if err := a.Emit(ScaleHint{Backend: "foo", Direction: ScaleUp, Rate: 150}); err != nil {
+		t.Fatalf("Failed to emit hint: %v", err)
+	}
+	if received.Backend != "foo" || received.Direction != ScaleUp || received.Rate != 150 {
+		t.Fatalf("Invalid received hint %v", received)
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/lb-controller/config"
+)
+
+var (
+	tcpConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_tcp_connections_total",
+		Help: "Number of closed connections of the tcp frontends by termination state",
+	}, []string{"frontend", "environment", "backend", "tag", "termination_state"})
+	tcpConnectErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_tcp_connect_errors_total",
+		Help: "Number of tcp connections which failed to connect to the backend",
+	}, backendLabels)
+	tcpRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_tcp_retries_total",
+		Help: "Number of connection retries to the backend servers of the tcp frontends",
+	}, backendLabels)
+)
+
+// TCPConnection is a closed connection of a tcp frontend
+type TCPConnection struct {
+	Frontend string
+	Backend  string
+	// Tag is the metrics tag of the backend
+	Tag string
+	// TerminationState is the haproxy session state at disconnection,
+	// "--" for a normal close
+	TerminationState string
+	// Retries is the haproxy retries count, prefixed
+	// with + when the connection was redispatched
+	Retries string
+}
+
+// ObserveTCPConnection counts the connection in the tcp metrics
+func ObserveTCPConnection(c TCPConnection) {
+	Register()
+	env, backend := config.SplitEnvironmentName(c.Backend)
+	tcpConnections.WithLabelValues(c.Frontend, env, backend, c.Tag, c.TerminationState).Inc()
+	if IsConnectError(c.TerminationState) {
+		tcpConnectErrors.WithLabelValues(env, backend, c.Tag).Inc()
+	}
+	if retries, err := strconv.Atoi(strings.TrimPrefix(c.Retries, "+")); err == nil && retries > 0 {
+		tcpRetries.WithLabelValues(env, backend, c.Tag).Add(float64(retries))
+	}
+}
+
+// IsConnectError tells if the termination state is a connection
+// aborted by the server, or timed out, while connecting to it
+func IsConnectError(state string) bool {
+	return len(state) == 2 && (state[0] == 'S' || state[0] == 's') && state[1] == 'C'
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestObserveTCPConnection(t *testing.T) {
+	ObserveTCPConnection(TCPConnection{Frontend: "3306", Backend: "db", TerminationState: "--", Retries: "0"})
+	ObserveTCPConnection(TCPConnection{Frontend: "3306", Backend: "db", TerminationState: "SC", Retries: "+3"})
+	ObserveTCPConnection(TCPConnection{Frontend: "3306", Backend: "db", TerminationState: "sC", Retries: "1"})
+
+	if v := counterValue(tcpConnections.WithLabelValues("3306", "", "db", "", "--")); v != 1 {
+		t.Fatalf("Invalid connections count %v", v)
+	}
+	if v := counterValue(tcpConnectErrors.WithLabelValues("", "db", "")); v != 2 {
+		t.Fatalf("Invalid connect errors count %v", v)
+	}
+	if v := counterValue(tcpRetries.WithLabelValues("", "db", "")); v != 4 {
+		t.Fatalf("Invalid retries count %v", v)
+	}
+
+	// the backends of shared lbs are labeled with their environment
+	ObserveTCPConnection(TCPConnection{Frontend: "3306", Backend: "1a5::db", TerminationState: "SC", Retries: "0"})
+	if v := counterValue(tcpConnectErrors.WithLabelValues("1a5", "db", "")); v != 1 {
+		t.Fatalf("Invalid connect errors count of the environment %v", v)
+	}
+	// and the tagged backends with their tag
+	ObserveTCPConnection(TCPConnection{Frontend: "3306", Backend: "db", Tag: "billing", TerminationState: "SC", Retries: "0"})
+	if v := counterValue(tcpConnectErrors.WithLabelValues("", "db", "billing")); v != 1 {
+		t.Fatalf("Invalid connect errors count of the tag %v", v)
+	}
+	if IsConnectError("CD") || IsConnectError("") {
+		t.Fatalf("Client disconnections are not connect errors")
+	}
+}
@@ -0,0 +1,533 @@
+/*
+Package migrate converts hand-written haproxy configs into the port rules
+and the custom config of a Rancher lb service, to move the lbs managed by
+hand over to the controller.
+
+The frontends and the listen sections become the port rules: their bind
+ports, their mode and ssl setting, the host and path acls of their
+use_backend rules, in order, and their default backend. The servers of
+the backends are mapped to the services they resolve to in the Rancher
+dns, as <service>.<stack>[.rancher.internal]. Everything else is kept as
+the custom config of the sections it comes from, the settings managed by
+the controller left out. What can't be converted is reported as warnings.
+*/
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortRule is a port rule of the lb service, in the
+// format of the lb_config of rancher-compose
+type PortRule struct {
+	SourcePort  int    `yaml:"source_port" json:"source_port"`
+	Protocol    string `yaml:"protocol" json:"protocol"`
+	Hostname    string `yaml:"hostname,omitempty" json:"hostname,omitempty"`
+	Path        string `yaml:"path,omitempty" json:"path,omitempty"`
+	Service     string `yaml:"service" json:"service"`
+	TargetPort  int    `yaml:"target_port" json:"target_port"`
+	Priority    int    `yaml:"priority,omitempty" json:"priority,omitempty"`
+	BackendName string `yaml:"backend_name,omitempty" json:"backend_name,omitempty"`
+}
+
+// LBConfig is the lb_config of the lb service
+type LBConfig struct {
+	PortRules []PortRule `yaml:"port_rules" json:"port_rules"`
+	Config    string     `yaml:"config,omitempty" json:"config,omitempty"`
+}
+
+// Result is the converted config, with the warnings about the
+// parts of the haproxy config that couldn't be converted
+type Result struct {
+	LBConfig LBConfig `yaml:"lb_config" json:"lb_config"`
+	Warnings []string `yaml:"-" json:"warnings,omitempty"`
+}
+
+// managedGlobals are the global settings the controller
+// sets itself, they are left out of the custom config
+var managedGlobals = map[string]bool{
+	"chroot":        true,
+	"daemon":        true,
+	"group":         true,
+	"master-worker": true,
+	"pidfile":       true,
+	"stats":         true,
+	"user":          true,
+}
+
+// proxySections are the sections proxying the traffic,
+// the others are kept in the custom config as is
+var proxySections = map[string]bool{
+	"defaults": true,
+	"frontend": true,
+	"backend":  true,
+	"listen":   true,
+}
+
+type section struct {
+	kind  string
+	name  string
+	lines []string
+}
+
+type bind struct {
+	port int
+	ssl  bool
+}
+
+// acl is a host or path condition
+type acl struct {
+	hostname string
+	path     string
+}
+
+type server struct {
+	name    string
+	service string
+	port    int
+}
+
+type converter struct {
+	result      *Result
+	defaultMode string
+	acls        map[string]acl
+	backends    map[string][]server
+	// leftovers are the custom config lines by section header
+	leftovers map[string][]string
+	headers   []string
+}
+
+// ConvertHaproxyConfig converts the haproxy config read from r
+func ConvertHaproxyConfig(r io.Reader) (*Result, error) {
+	sections, err := parseSections(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &converter{
+		result:      &Result{},
+		defaultMode: "tcp",
+		backends:    map[string][]server{},
+		leftovers:   map[string][]string{},
+	}
+	// the backends are read first, the frontends reference them
+	for _, s := range sections {
+		switch s.kind {
+		case "defaults":
+			c.convertDefaults(s)
+		case "backend", "listen":
+			c.convertBackend(s)
+		}
+	}
+	for _, s := range sections {
+		switch s.kind {
+		case "global":
+			c.convertGlobal(s)
+		case "frontend", "listen":
+			c.convertFrontend(s)
+		case "defaults", "backend":
+		default:
+			c.addLeftovers(strings.TrimSpace(s.kind+" "+s.name), s.lines)
+		}
+	}
+	c.result.LBConfig.Config = c.customConfig()
+	if c.result.LBConfig.PortRules == nil {
+		c.result.LBConfig.PortRules = []PortRule{}
+	}
+	return c.result, nil
+}
+
+// parseSections splits the config in sections, dropping the comments
+func parseSections(r io.Reader) ([]*section, error) {
+	var sections []*section
+	var current *section
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if isSection(fields[0]) {
+			current = &section{kind: fields[0]}
+			if len(fields) > 1 {
+				current.name = fields[1]
+			}
+			sections = append(sections, current)
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("Setting [%s] is outside of any section", strings.TrimSpace(line))
+		}
+		current.lines = append(current.lines, strings.Join(fields, " "))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read haproxy config: %v", err)
+	}
+	return sections, nil
+}
+
+func isSection(keyword string) bool {
+	switch keyword {
+	case "global", "defaults", "frontend", "backend", "listen",
+		"peers", "resolvers", "userlist", "mailers", "cache", "program", "ring", "http-errors":
+		return true
+	}
+	return false
+}
+
+func (c *converter) warnf(format string, args ...interface{}) {
+	c.result.Warnings = append(c.result.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (c *converter) addLeftovers(header string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	if _, ok := c.leftovers[header]; !ok {
+		c.headers = append(c.headers, header)
+	}
+	c.leftovers[header] = append(c.leftovers[header], lines...)
+}
+
+func (c *converter) convertGlobal(s *section) {
+	var lines []string
+	for _, line := range s.lines {
+		keyword := strings.Fields(line)[0]
+		if managedGlobals[keyword] {
+			c.warnf("Skipping global setting [%s], it is managed by the controller", line)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	c.addLeftovers("global", lines)
+}
+
+func (c *converter) convertDefaults(s *section) {
+	var lines []string
+	for _, line := range s.lines {
+		fields := strings.Fields(line)
+		if fields[0] == "mode" && len(fields) > 1 {
+			c.defaultMode = fields[1]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	c.addLeftovers("defaults", lines)
+}
+
+// convertBackend reads the servers of the backend, the other
+// settings are kept in the custom config of the backend
+func (c *converter) convertBackend(s *section) {
+	var lines []string
+	servers := []server{}
+	for _, line := range s.lines {
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "server":
+			if len(fields) < 3 {
+				c.warnf("Skipping server [%s] of backend %s, its address is missing", line, s.name)
+				continue
+			}
+			servers = append(servers, c.convertServer(s.name, fields[1], fields[2]))
+		case "mode":
+		case "bind", "acl", "use_backend", "default_backend":
+			// the frontend part of the listen sections
+		default:
+			lines = append(lines, line)
+		}
+	}
+	c.backends[s.name] = servers
+	c.addLeftovers("backend "+s.name, lines)
+}
+
+// convertServer maps the server to the service its address resolves to
+// in the Rancher dns, the addresses of the others are kept as is
+func (c *converter) convertServer(backend string, name string, address string) server {
+	host, port := address, 0
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	if port == 0 {
+		c.warnf("Server %s of backend %s has no port, set the target port of its rules", name, backend)
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimSuffix(host, "."), ".rancher.internal"), ".")
+	if net.ParseIP(host) != nil || len(parts) != 2 {
+		c.warnf("Server %s of backend %s at %s isn't a Rancher service, set the service of its rules as stack/service", name, backend, host)
+		return server{name: name, service: host, port: port}
+	}
+	return server{name: name, service: parts[1] + "/" + parts[0], port: port}
+}
+
+/*
+convertFrontend turns the frontend into the port rules of its bind ports.
+The use_backend rules keep their order as priorities, the host and path
+acls they use become the hostnames and the paths of the rules
+*/
+func (c *converter) convertFrontend(s *section) {
+	mode := c.defaultMode
+	var binds []bind
+	c.acls = map[string]acl{}
+	type useBackend struct {
+		backend string
+		acls    []acl
+	}
+	var uses []useBackend
+	defaultBackend := ""
+	var lines []string
+	for _, line := range s.lines {
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "mode":
+			if len(fields) > 1 {
+				mode = fields[1]
+			}
+		case "bind":
+			binds = append(binds, c.convertBind(s.name, fields)...)
+		case "acl":
+			c.convertACL(s.name, line, fields)
+		case "use_backend":
+			if len(fields) < 2 {
+				continue
+			}
+			acls, ok := c.convertCondition(fields[2:])
+			if !ok {
+				c.warnf("Skipping [%s] of frontend %s, only host and path acls can be converted", line, s.name)
+				continue
+			}
+			uses = append(uses, useBackend{backend: fields[1], acls: acls})
+		case "default_backend":
+			if len(fields) > 1 {
+				defaultBackend = fields[1]
+			}
+		case "server":
+			// the backend part of the listen sections
+		default:
+			if s.kind == "frontend" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	if s.kind == "listen" {
+		defaultBackend = s.name
+	}
+	if len(binds) == 0 {
+		c.warnf("Frontend %s has no bind port, skipping it", s.name)
+		return
+	}
+	for _, b := range binds {
+		if b.ssl {
+			c.warnf("Frontend %s terminates ssl on port %v, add its certificates to the lb", s.name, b.port)
+		}
+		protocol := getProtocol(mode, b.ssl)
+		priority := 1
+		for _, use := range uses {
+			for _, a := range use.acls {
+				c.addRules(b.port, protocol, a, use.backend, priority)
+				priority++
+			}
+		}
+		if defaultBackend != "" {
+			c.addRules(b.port, protocol, acl{}, defaultBackend, priority)
+		}
+		c.addLeftovers(fmt.Sprintf("frontend %v", b.port), lines)
+	}
+}
+
+func getProtocol(mode string, ssl bool) string {
+	if mode == "http" {
+		if ssl {
+			return "https"
+		}
+		return "http"
+	}
+	if ssl {
+		return "tls"
+	}
+	return "tcp"
+}
+
+func (c *converter) convertBind(frontend string, fields []string) []bind {
+	if len(fields) < 2 {
+		return nil
+	}
+	ssl := false
+	for _, option := range fields[2:] {
+		if option == "ssl" {
+			ssl = true
+		}
+	}
+	var binds []bind
+	for _, address := range strings.Split(fields[1], ",") {
+		i := strings.LastIndex(address, ":")
+		port, err := strconv.Atoi(address[i+1:])
+		if i < 0 || err != nil || port < 1 || port > 65535 {
+			c.warnf("Skipping bind %s of frontend %s, only single ports can be converted", address, frontend)
+			continue
+		}
+		binds = append(binds, bind{port: port, ssl: ssl})
+	}
+	return binds
+}
+
+// convertACL reads the host and path acls of a single value
+func (c *converter) convertACL(frontend string, line string, fields []string) {
+	if len(fields) < 3 {
+		return
+	}
+	name, criterion := fields[1], fields[2]
+	match := ""
+	var values []string
+	for i := 3; i < len(fields); i++ {
+		switch {
+		case fields[i] == "-m" && i+1 < len(fields):
+			match = fields[i+1]
+			i++
+		case strings.HasPrefix(fields[i], "-"):
+		default:
+			values = append(values, fields[i])
+		}
+	}
+	if len(values) != 1 {
+		c.warnf("Skipping acl [%s] of frontend %s, only acls of a single value can be converted", line, frontend)
+		return
+	}
+	value := values[0]
+	switch criterion {
+	case "hdr(host)", "req.hdr(host)", "req.ssl_sni", "ssl_fc_sni":
+		switch match {
+		case "", "str":
+			c.acls[name] = acl{hostname: value}
+			return
+		case "beg":
+			c.acls[name] = acl{hostname: value + "*"}
+			return
+		case "end":
+			c.acls[name] = acl{hostname: "*" + value}
+			return
+		}
+	case "hdr_beg(host)":
+		c.acls[name] = acl{hostname: value + "*"}
+		return
+	case "hdr_end(host)", "hdr_dom(host)":
+		c.acls[name] = acl{hostname: "*" + value}
+		return
+	case "path_beg", "path":
+		if match == "" || match == "beg" || criterion == "path" && match == "str" {
+			c.acls[name] = acl{path: value}
+			return
+		}
+	}
+	c.warnf("Skipping acl [%s] of frontend %s, only host and path acls can be converted", line, frontend)
+}
+
+/*
+convertCondition returns the host and path of the rules matching the
+condition: a rule for each alternative of an or, each combining the
+host and the path acls of its and. Negations, inline acls and acls
+other than host and path can't be converted
+*/
+func (c *converter) convertCondition(fields []string) ([]acl, bool) {
+	if len(fields) == 0 {
+		return []acl{{}}, true
+	}
+	if fields[0] != "if" {
+		return nil, false
+	}
+	var acls []acl
+	current := acl{}
+	for _, field := range fields[1:] {
+		if field == "||" || field == "or" {
+			acls = append(acls, current)
+			current = acl{}
+			continue
+		}
+		a, ok := c.acls[field]
+		if !ok {
+			return nil, false
+		}
+		if a.hostname != "" {
+			if current.hostname != "" {
+				return nil, false
+			}
+			current.hostname = a.hostname
+		}
+		if a.path != "" {
+			if current.path != "" {
+				return nil, false
+			}
+			current.path = a.path
+		}
+	}
+	return append(acls, current), true
+}
+
+// addRules adds the rules of the servers of the backend, a rule by service
+func (c *converter) addRules(port int, protocol string, a acl, backend string, priority int) {
+	servers, ok := c.backends[backend]
+	if !ok {
+		c.warnf("Backend %s used by the frontend of port %v is missing", backend, port)
+		return
+	}
+	seen := map[string]bool{}
+	for _, s := range servers {
+		key := fmt.Sprintf("%s:%v", s.service, s.port)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		c.result.LBConfig.PortRules = append(c.result.LBConfig.PortRules, PortRule{
+			SourcePort:  port,
+			Protocol:    protocol,
+			Hostname:    a.hostname,
+			Path:        a.path,
+			Service:     s.service,
+			TargetPort:  s.port,
+			Priority:    priority,
+			BackendName: backend,
+		})
+	}
+}
+
+// customConfig renders the leftovers as the custom config of the
+// lb, the sections known to the controller first
+func (c *converter) customConfig() string {
+	headers := append([]string{}, c.headers...)
+	rank := func(header string) int {
+		kind := strings.Fields(header)[0]
+		switch {
+		case kind == "global":
+			return 0
+		case kind == "defaults":
+			return 1
+		case proxySections[kind]:
+			return 2
+		}
+		return 3
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return rank(headers[i]) < rank(headers[j])
+	})
+	var b bytes.Buffer
+	for _, header := range headers {
+		b.WriteString(header + "\n")
+		for _, line := range c.leftovers[header] {
+			b.WriteString("    " + line + "\n")
+		}
+		b.WriteString("\n")
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
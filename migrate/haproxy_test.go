@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const haproxyConfig = `
+global
+    daemon
+    maxconn 4096
+    pidfile /var/run/haproxy.pid
+
+defaults
+    mode http
+    timeout connect 5s # connect timeout
+
+frontend www
+    bind *:80
+    bind *:443 ssl crt /etc/ssl/site.pem
+    option forwardfor
+    acl api_host hdr(host) -i api.example.com
+    acl api_path path_beg /v1
+    acl wild hdr_end(host) -i .example.com
+    acl not_converted src 10.0.0.0/8
+    use_backend api if api_host api_path
+    use_backend api if wild || api_host
+    use_backend internal if not_converted
+    default_backend web
+
+backend web
+    balance leastconn
+    server web1 web.front.rancher.internal:8080 check
+    server web2 web.front:8080 check
+
+backend api
+    server api1 10.42.0.10:9000
+
+listen db
+    bind :3306
+    mode tcp
+    timeout server 1h
+    server db1 mysql.data:3306
+`
+
+func TestConvertHaproxyConfig(t *testing.T) {
+	result, err := ConvertHaproxyConfig(strings.NewReader(haproxyConfig))
+	if err != nil {
+		t.Fatalf("Failed to convert haproxy config: %v", err)
+	}
+	expected := []PortRule{
+		{SourcePort: 80, Protocol: "http", Hostname: "api.example.com", Path: "/v1", Service: "10.42.0.10", TargetPort: 9000, Priority: 1, BackendName: "api"},
+		{SourcePort: 80, Protocol: "http", Hostname: "*.example.com", Service: "10.42.0.10", TargetPort: 9000, Priority: 2, BackendName: "api"},
+		{SourcePort: 80, Protocol: "http", Hostname: "api.example.com", Service: "10.42.0.10", TargetPort: 9000, Priority: 3, BackendName: "api"},
+		{SourcePort: 80, Protocol: "http", Service: "front/web", TargetPort: 8080, Priority: 4, BackendName: "web"},
+		{SourcePort: 443, Protocol: "https", Hostname: "api.example.com", Path: "/v1", Service: "10.42.0.10", TargetPort: 9000, Priority: 1, BackendName: "api"},
+		{SourcePort: 443, Protocol: "https", Hostname: "*.example.com", Service: "10.42.0.10", TargetPort: 9000, Priority: 2, BackendName: "api"},
+		{SourcePort: 443, Protocol: "https", Hostname: "api.example.com", Service: "10.42.0.10", TargetPort: 9000, Priority: 3, BackendName: "api"},
+		{SourcePort: 443, Protocol: "https", Service: "front/web", TargetPort: 8080, Priority: 4, BackendName: "web"},
+		{SourcePort: 3306, Protocol: "tcp", Service: "data/mysql", TargetPort: 3306, Priority: 1, BackendName: "db"},
+	}
+	if !reflect.DeepEqual(result.LBConfig.PortRules, expected) {
+		t.Fatalf("Unexpected port rules\n%+v\nexpected\n%+v", result.LBConfig.PortRules, expected)
+	}
+
+	expectedConfig := `global
+    maxconn 4096
+
+defaults
+    timeout connect 5s
+
+backend web
+    balance leastconn
+
+backend db
+    timeout server 1h
+
+frontend 80
+    option forwardfor
+
+frontend 443
+    option forwardfor
+`
+	if result.LBConfig.Config != expectedConfig {
+		t.Fatalf("Unexpected custom config\n%s", result.LBConfig.Config)
+	}
+
+	warnings := strings.Join(result.Warnings, "\n")
+	for _, expected := range []string{
+		"Skipping global setting [daemon]",
+		"Server api1 of backend api at 10.42.0.10 isn't a Rancher service",
+		"Skipping acl [acl not_converted src 10.0.0.0/8]",
+		"Skipping [use_backend internal if not_converted]",
+		"add its certificates to the lb",
+	} {
+		if !strings.Contains(warnings, expected) {
+			t.Fatalf("Missing warning %s in\n%s", expected, warnings)
+		}
+	}
+}
+
+func TestConvertHaproxyConfigErrors(t *testing.T) {
+	if _, err := ConvertHaproxyConfig(strings.NewReader("maxconn 10\nglobal\n")); err == nil {
+		t.Fatalf("Settings outside of a section should fail")
+	}
+	result, err := ConvertHaproxyConfig(strings.NewReader("frontend f\n    bind :8000-8010\n    default_backend missing\n"))
+	if err != nil {
+		t.Fatalf("Failed to convert haproxy config: %v", err)
+	}
+	if len(result.LBConfig.PortRules) != 0 || len(result.Warnings) != 2 {
+		t.Fatalf("Port ranges should be skipped %+v", result)
+	}
+}
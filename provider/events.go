@@ -0,0 +1,510 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	// EventApplied is sent when a config apply succeeds
+	EventApplied = "config.applied"
+	// EventApplyFailed is sent when a config apply fails
+	EventApplyFailed = "config.apply_failed"
+	// EventRemoved is sent when a config is removed
+	EventRemoved = "config.removed"
+	// EventEndpointAdded is sent for the endpoints
+	// added to a backend by an applied config
+	EventEndpointAdded = "endpoint.added"
+	// EventEndpointRemoved is sent for the endpoints
+	// removed from a backend by an applied config
+	EventEndpointRemoved = "endpoint.removed"
+	// EventBackendAdded and EventBackendRemoved are sent for
+	// the backends added and removed by an applied config
+	EventBackendAdded   = "backend.added"
+	EventBackendRemoved = "backend.removed"
+	// EventCertRotated is sent for the certs changed by an applied config
+	EventCertRotated = "cert.rotated"
+	// EventEndpointUp, EventEndpointDown and EventEndpointDrained are
+	// sent when the provider reports a change of the endpoint health
+	EventEndpointUp      = "endpoint.up"
+	EventEndpointDown    = "endpoint.down"
+	EventEndpointDrained = "endpoint.drained"
+	// EventConfigDrift is sent when the live config
+	// was found modified out-of-band
+	EventConfigDrift = "config.drift"
+)
+
+// Event is a lifecycle notification of the lb configs
+type Event struct {
+	Event      string      `json:"event"`
+	ConfigName string      `json:"config_name"`
+	Time       time.Time   `json:"time"`
+	Error      string      `json:"error,omitempty"`
+	Diff       *ConfigDiff `json:"diff,omitempty"`
+	// Backend and Endpoint are the uuid of the backend and
+	// the ip:port of the endpoint of the endpoint events
+	Backend  string `json:"backend,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// Cert is the name of the cert of the cert events
+	Cert string `json:"cert,omitempty"`
+}
+
+// ConfigDiff summarizes the changes of a config since its last successful
+// apply, frontends are named after their name, backends after their uuid
+type ConfigDiff struct {
+	FrontendsAdded   []string `json:"frontends_added,omitempty"`
+	FrontendsRemoved []string `json:"frontends_removed,omitempty"`
+	FrontendsChanged []string `json:"frontends_changed,omitempty"`
+	BackendsAdded    []string `json:"backends_added,omitempty"`
+	BackendsRemoved  []string `json:"backends_removed,omitempty"`
+	BackendsChanged  []string `json:"backends_changed,omitempty"`
+	CertsAdded       []string `json:"certs_added,omitempty"`
+	CertsRemoved     []string `json:"certs_removed,omitempty"`
+	CertsChanged     []string `json:"certs_changed,omitempty"`
+	// SettingsChanged is set when the lb wide settings changed
+	SettingsChanged bool `json:"settings_changed,omitempty"`
+}
+
+// EventSink delivers the events to an external system
+type EventSink interface {
+	Name() string
+	Send(event *Event) error
+}
+
+// EventSinkFactory creates the sink from its settings,
+// nil is returned when the sink is not configured
+type EventSinkFactory func() (EventSink, error)
+
+var (
+	eventsPollInterval = flags.Duration("EVENTS_ENDPOINT_POLL_INTERVAL", 10*time.Second, "Interval of the endpoint health polls sending the endpoint up, down and drained events, 0 disables them")
+	eventsQueueSize    = flags.Int("EVENTS_QUEUE_SIZE", 1000, "Number of the events queued for a sink, the events sent while its queue is full are dropped").Range(1, 1000000)
+
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_events_dropped_total",
+		Help: "Number of the lb events dropped because the queue of their sink was full",
+	}, []string{"sink"})
+	eventsRegisterOnce sync.Once
+
+	eventSinksMu sync.Mutex
+	eventSinks   = map[string]EventSinkFactory{}
+)
+
+// RegisterEventSink registers the factory of the sink, the sinks
+// configured are notified by the hook of NewEventHookFromEnv
+func RegisterEventSink(name string, factory EventSinkFactory) error {
+	eventSinksMu.Lock()
+	defer eventSinksMu.Unlock()
+	if _, exists := eventSinks[name]; exists {
+		return fmt.Errorf("event sink %s is already registered", name)
+	}
+	eventSinks[name] = factory
+	return nil
+}
+
+// EventHook sends the events of the config applies and removals to the
+// sinks. The backend, endpoint and cert events are sent for the applied
+// configs only. Every sink is delivered its events in order from a queue
+// of its own, so a slow sink holds neither the applies nor the others
+type EventHook struct {
+	Sinks []EventSink
+	// PollInterval is the interval of the endpoint health polls
+	// of WatchEndpoints, 0 disables the endpoint health events
+	PollInterval time.Duration
+	// QueueSize is the number of the events queued for a sink,
+	// the events sent while the queue is full are dropped
+	QueueSize int
+
+	queuesOnce sync.Once
+	queues     []*sinkQueue
+
+	mu sync.Mutex
+	// applied are the fingerprints of the last applied configs by name,
+	// kept instead of the configs so the cert keys are not held
+	applied map[string]*configFingerprint
+	// status is the last reported health of the endpoints,
+	// keyed by their backend and server name
+	status map[string]string
+}
+
+// NewEventHookFromEnv creates the hook of the registered sinks which are
+// configured, nil is returned when none is
+func NewEventHookFromEnv() (*EventHook, error) {
+	eventSinksMu.Lock()
+	names := []string{}
+	for name := range eventSinks {
+		names = append(names, name)
+	}
+	eventSinksMu.Unlock()
+	sort.Strings(names)
+
+	sinks := []EventSink{}
+	for _, name := range names {
+		sink, err := eventSinks[name]()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure %s event sink: %v", name, err)
+		}
+		if sink != nil {
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	hook := NewEventHook(sinks...)
+	hook.PollInterval = eventsPollInterval.Get()
+	hook.QueueSize = eventsQueueSize.Get()
+	return hook, nil
+}
+
+func NewEventHook(sinks ...EventSink) *EventHook {
+	eventsRegisterOnce.Do(func() {
+		prometheus.MustRegister(eventsDropped)
+	})
+	return &EventHook{
+		Sinks:     sinks,
+		QueueSize: eventsQueueSize.Get(),
+		applied:   map[string]*configFingerprint{},
+		status:    map[string]string{},
+	}
+}
+
+func (h *EventHook) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+func (h *EventHook) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	fingerprint := newConfigFingerprint(lbConfig)
+	h.mu.Lock()
+	previous := h.applied[lbConfig.Name]
+	if applyErr == nil {
+		h.applied[lbConfig.Name] = fingerprint
+	}
+	h.mu.Unlock()
+
+	now := time.Now().UTC()
+	event := &Event{
+		Event:      EventApplied,
+		ConfigName: lbConfig.Name,
+		Time:       now,
+		Diff:       fingerprint.diff(previous),
+	}
+	if applyErr != nil {
+		event.Event = EventApplyFailed
+		event.Error = applyErr.Error()
+		h.send(event)
+		return nil
+	}
+	events := []*Event{event}
+	for _, uuid := range event.Diff.BackendsAdded {
+		events = append(events, &Event{Event: EventBackendAdded, ConfigName: lbConfig.Name, Time: now, Backend: uuid})
+	}
+	for _, uuid := range event.Diff.BackendsRemoved {
+		events = append(events, &Event{Event: EventBackendRemoved, ConfigName: lbConfig.Name, Time: now, Backend: uuid})
+	}
+	for _, name := range event.Diff.CertsChanged {
+		events = append(events, &Event{Event: EventCertRotated, ConfigName: lbConfig.Name, Time: now, Cert: name})
+	}
+	added, removed := fingerprint.diffEndpoints(previous)
+	for _, ep := range added {
+		events = append(events, newEndpointEvent(EventEndpointAdded, lbConfig.Name, now, ep))
+	}
+	for _, ep := range removed {
+		events = append(events, newEndpointEvent(EventEndpointRemoved, lbConfig.Name, now, ep))
+	}
+	h.send(events...)
+	return nil
+}
+
+func (h *EventHook) PostCleanup(configName string) error {
+	h.mu.Lock()
+	delete(h.applied, configName)
+	h.mu.Unlock()
+	h.send(&Event{
+		Event:      EventRemoved,
+		ConfigName: configName,
+		Time:       time.Now().UTC(),
+	})
+	return nil
+}
+
+// WatchEndpoints polls the endpoint health reported by the provider until
+// stopCh is closed, sending the endpoint up, down and drained events on
+// its changes
+func (h *EventHook) WatchEndpoints(sp EndpointStatusProvider, stopCh <-chan struct{}) {
+	if h.PollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := h.pollEndpoints(sp); err != nil {
+				logrus.Debugf("Failed to poll the endpoint status: %v", err)
+			}
+		}
+	}
+}
+
+// pollEndpoints sends the events of the endpoints whose health changed
+// since the last poll. Endpoints are assumed up when first reported,
+// their endpoint.added event being sent on the apply
+func (h *EventHook) pollEndpoints(sp EndpointStatusProvider) error {
+	status, err := sp.GetEndpointStatus()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	events := []*Event{}
+	h.mu.Lock()
+	current := map[string]string{}
+	for _, s := range status {
+		key := s.Backend + "/" + s.Server
+		current[key] = s.Status
+		previous, ok := h.status[key]
+		if !ok {
+			previous = EndpointUp
+		}
+		if previous == s.Status {
+			continue
+		}
+		event := &Event{
+			Time:     now,
+			Backend:  s.Backend,
+			Endpoint: s.Server,
+		}
+		switch s.Status {
+		case EndpointUp:
+			event.Event = EventEndpointUp
+		case EndpointDown:
+			event.Event = EventEndpointDown
+		case EndpointDrained:
+			event.Event = EventEndpointDrained
+		default:
+			continue
+		}
+		for name, fingerprint := range h.applied {
+			if address, ok := fingerprint.servers[key]; ok {
+				event.ConfigName = name
+				event.Endpoint = address
+				break
+			}
+		}
+		events = append(events, event)
+	}
+	h.status = current
+	h.mu.Unlock()
+	h.send(events...)
+	return nil
+}
+
+// sinkQueue delivers the queued events to the sink from its goroutine
+type sinkQueue struct {
+	sink   EventSink
+	events chan *Event
+	// pending counts the events queued and not delivered yet
+	pending sync.WaitGroup
+}
+
+func (q *sinkQueue) run() {
+	for event := range q.events {
+		if err := q.sink.Send(event); err != nil {
+			logrus.Errorf("Failed to send %s event to %s sink: %v", event.Event, q.sink.Name(), err)
+		}
+		q.pending.Done()
+	}
+}
+
+// send queues the events of all the sinks, the events of a sink
+// whose queue is full are dropped
+func (h *EventHook) send(events ...*Event) {
+	h.queuesOnce.Do(func() {
+		size := h.QueueSize
+		if size <= 0 {
+			size = 1
+		}
+		for _, sink := range h.Sinks {
+			q := &sinkQueue{sink: sink, events: make(chan *Event, size)}
+			go q.run()
+			h.queues = append(h.queues, q)
+		}
+	})
+	for _, q := range h.queues {
+		for _, event := range events {
+			q.pending.Add(1)
+			select {
+			case q.events <- event:
+			default:
+				q.pending.Done()
+				eventsDropped.WithLabelValues(q.sink.Name()).Inc()
+				logrus.Warnf("Dropping %s event of %s sink, its queue is full", event.Event, q.sink.Name())
+			}
+		}
+	}
+}
+
+// Flush waits until the events queued so far are delivered
+func (h *EventHook) Flush() {
+	for _, q := range h.queues {
+		q.pending.Wait()
+	}
+}
+
+func newEndpointEvent(name string, configName string, now time.Time, key endpointKey) *Event {
+	return &Event{
+		Event:      name,
+		ConfigName: configName,
+		Time:       now,
+		Backend:    key.backend,
+		Endpoint:   key.address,
+	}
+}
+
+// endpointKey is an endpoint of a backend
+type endpointKey struct {
+	backend string
+	address string
+}
+
+// configFingerprint holds the hashes of the parts of a config
+type configFingerprint struct {
+	frontends map[string]string
+	backends  map[string]string
+	certs     map[string]string
+	settings  string
+	endpoints map[endpointKey]bool
+	// servers are the addresses of the endpoints keyed
+	// by their backend and server name
+	servers map[string]string
+}
+
+func newConfigFingerprint(lbConfig *config.LoadBalancerConfig) *configFingerprint {
+	f := &configFingerprint{
+		frontends: map[string]string{},
+		backends:  map[string]string{},
+		certs:     map[string]string{},
+		endpoints: map[endpointKey]bool{},
+		servers:   map[string]string{},
+	}
+	for _, fe := range lbConfig.FrontendServices {
+		// backends are compared on their own
+		copied := *fe
+		copied.BackendServices = nil
+		uuids := []string{}
+		for _, be := range fe.BackendServices {
+			uuids = append(uuids, be.UUID)
+			f.backends[be.UUID] = hashJSON(be)
+			for _, ep := range be.Endpoints {
+				address := fmt.Sprintf("%s:%v", ep.IP, ep.Port)
+				f.endpoints[endpointKey{be.UUID, address}] = true
+				f.servers[be.UUID+"/"+ep.Name] = address
+			}
+		}
+		f.frontends[fe.Name] = hashJSON(struct {
+			Frontend config.FrontendService
+			Backends []string
+		}{copied, uuids})
+	}
+	certs := lbConfig.Certs
+	if lbConfig.DefaultCert != nil {
+		certs = append([]*config.Certificate{lbConfig.DefaultCert}, certs...)
+	}
+	for _, cert := range certs {
+		f.certs[cert.Name] = hashJSON(cert)
+	}
+	f.settings = hashJSON([]interface{}{
+		lbConfig.Config,
+		lbConfig.StickinessPolicy,
+		lbConfig.DebugHeaders,
+		lbConfig.Peers,
+		lbConfig.Resolvers,
+		lbConfig.Hardening,
+		lbConfig.StripHeaders,
+		lbConfig.Tuning,
+	})
+	return f
+}
+
+// diff returns the changes since the previous fingerprint, everything
+// is reported as added when there is no previous fingerprint
+func (f *configFingerprint) diff(previous *configFingerprint) *ConfigDiff {
+	if previous == nil {
+		previous = &configFingerprint{settings: f.settings}
+	}
+	d := &ConfigDiff{SettingsChanged: f.settings != previous.settings}
+	d.FrontendsAdded, d.FrontendsRemoved, d.FrontendsChanged = diffHashes(previous.frontends, f.frontends)
+	d.BackendsAdded, d.BackendsRemoved, d.BackendsChanged = diffHashes(previous.backends, f.backends)
+	d.CertsAdded, d.CertsRemoved, d.CertsChanged = diffHashes(previous.certs, f.certs)
+	return d
+}
+
+// diffEndpoints returns the endpoints added and removed since the
+// previous fingerprint, sorted by backend and address
+func (f *configFingerprint) diffEndpoints(previous *configFingerprint) (added, removed []endpointKey) {
+	if previous == nil {
+		previous = &configFingerprint{}
+	}
+	for key := range f.endpoints {
+		if !previous.endpoints[key] {
+			added = append(added, key)
+		}
+	}
+	for key := range previous.endpoints {
+		if !f.endpoints[key] {
+			removed = append(removed, key)
+		}
+	}
+	sortEndpointKeys(added)
+	sortEndpointKeys(removed)
+	return added, removed
+}
+
+func sortEndpointKeys(keys []endpointKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].backend != keys[j].backend {
+			return keys[i].backend < keys[j].backend
+		}
+		return keys[i].address < keys[j].address
+	})
+}
+
+func diffHashes(previous, current map[string]string) (added, removed, changed []string) {
+	for name, hash := range current {
+		previousHash, ok := previous[name]
+		if !ok {
+			added = append(added, name)
+		} else if previousHash != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func hashJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,44 @@
+//go:build gofuzz
+// +build gofuzz
+
+package haproxy
+
+import (
+	"github.com/rancher/lb-controller/config"
+)
+
+/*
+Fuzz is the go-fuzz entry point for the custom config parsing:
+
+go-fuzz-build github.com/rancher/lb-controller/provider/haproxy
+go-fuzz -bin=haproxy-fuzz.zip -workdir=provider/haproxy/fuzz
+*/
+func Fuzz(data []byte) int {
+	ep := &config.Endpoint{
+		Name:    "s1",
+		IP:      "foo.com",
+		Port:    80,
+		IsCname: true,
+	}
+	backend := &config.BackendService{
+		UUID:        "foo",
+		Port:        80,
+		Protocol:    config.HTTPProto,
+		Endpoints:   config.Endpoints{ep},
+		HealthCheck: &config.HealthCheck{Port: 80, RequestLine: "GET /"},
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.HTTPProto,
+		BackendServices: config.BackendServices{backend},
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: config.FrontendServices{frontend},
+		StickinessPolicy: &config.StickinessPolicy{Mode: "insert"},
+	}
+	if err := BuildCustomConfig(lbConfig, string(data)); err != nil {
+		return 0
+	}
+	return 1
+}
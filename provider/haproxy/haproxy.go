@@ -1,20 +1,35 @@
 package haproxy
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/lb-controller/config"
 	"github.com/rancher/lb-controller/provider"
+	"github.com/rancher/lb-controller/provider/ipvs"
 	utils "github.com/rancher/lb-controller/utils"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
+const (
+	defaultListenerPort = 42
+	defaultNameserver   = "dnsmasq 169.254.169.250:53"
+	// crtListFile lists the certs with hostnames overrides
+	crtListFile = "crt-list"
+	// requestLogAddress is the local syslog the request logs
+	// of the backends are sent to, as traffic logs
+	requestLogAddress = "127.0.0.1:8514"
+)
+
 func init() {
 	haproxyCfg := &haproxyConfig{
 		ReloadCmd: "haproxy_reload /etc/haproxy/haproxy.cfg reload",
@@ -22,11 +37,56 @@ func init() {
 		Config:    "/etc/haproxy/haproxy_new.cfg",
 		Template:  "/etc/haproxy/haproxy_template.cfg",
 		CertDir:   "/etc/haproxy/certs",
+		TProxyCmd: "haproxy_tproxy",
+		LuaDir:    luaScriptsDir.Get(),
+		// the host maps are updated through the admin socket while
+		// the config is unchanged, the reload is forced otherwise
+		LiveConfig:       "/etc/haproxy/haproxy.cfg",
+		ForceReloadCmd:   "haproxy_reload /etc/haproxy/haproxy.cfg reload force",
+		MapsDir:          mapsDir,
+		SPOEDir:          spoeDir,
+		AdminSocket:      adminSocket,
+		HostMapThreshold: hostMapThreshold.Get(),
+		// the configs modified out-of-band are reapplied
+		DriftCheckInterval: driftCheckInterval.Get(),
+		Capabilities:       newCapabilityDetector(),
+	}
+	if tcpLogEnabled.Get() {
+		haproxyCfg.TCPLogAddress = tcpLogAddress()
+	}
+	haproxyCfg.CaptureBodyBytes = captureBodyBytes.Get()
+	haproxyCfg.Tuner = newTunerFromEnv()
+	setPeers(haproxyCfg)
+	shadow, err := newShadowConfig()
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if haproxyCfg.TicketKeys, err = newTicketKeysFromEnv(); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	remote, err := newRemoteConfig()
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if remote != nil {
+		if shadow != nil {
+			logrus.Fatalf("SHADOW_APPLY is not supported with an external haproxy")
+		}
+		remote.apply(haproxyCfg)
+	}
+	fastPath, err := ipvs.NewFastPathFromEnv()
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if fastPath != nil && remote != nil {
+		logrus.Fatalf("IPVS_FAST_PATH is not supported with an external haproxy")
 	}
 	lbp := Provider{
-		cfg:    haproxyCfg,
-		stopCh: make(chan struct{}),
-		init:   true,
+		cfg:      haproxyCfg,
+		stopCh:   make(chan struct{}),
+		init:     true,
+		shadow:   shadow,
+		fastPath: fastPath,
 	}
 	provider.RegisterProvider(lbp.GetName(), &lbp)
 }
@@ -35,6 +95,23 @@ type Provider struct {
 	cfg    *haproxyConfig
 	stopCh chan struct{}
 	init   bool
+	shadow *shadowConfig
+	// tproxy is set once the TProxyCmd succeeded
+	tproxy bool
+	// capture receives the captured requests, it's started
+	// with the first config capturing requests
+	captureMu sync.Mutex
+	capture   *captureReceiver
+	// tcpLog receives the connection logs of the tcp frontends
+	tcpLogMu sync.Mutex
+	tcpLog   *tcpLogReceiver
+	// tags are the metrics tags of the backends of the applied config
+	tags metricsTags
+	// applied is the checksum of the applied config the drift is checked against
+	applied appliedConfig
+	// fastPath serves the plain tcp and the udp frontends
+	// with IPVS, nil when they are all left to haproxy
+	fastPath *ipvs.FastPath
 }
 
 type haproxyConfig struct {
@@ -44,18 +121,123 @@ type haproxyConfig struct {
 	Config    string
 	Template  string
 	CertDir   string
+	// StatsSocket is the haproxy runtime api socket the stats are
+	// read from, empty until a consumer of the stats enables them
+	StatsSocket string
+	// PeerName is the name of the local peer stick-tables are synced
+	// with on reload, empty disables the peers section
+	PeerName  string
+	PeersPort int
+	// TProxyCmd sets up the marking and the routing of the packets
+	// transparent backends need, it runs once before the first
+	// config with transparent backends is applied
+	TProxyCmd string
+	// TCPLogAddress is the udp address the tcp frontends log
+	// their connections to, empty disables the connection logs
+	TCPLogAddress string
+	// CaptureBodyBytes is the size the captured request bodies are
+	// truncated to, 0 leaves the bodies out of the captures
+	CaptureBodyBytes int
+	// Tuner sizes the settings from the cgroup limits, nil disables it
+	Tuner *tuner
+	// LiveConfig is the config haproxy runs, the written config
+	// replaces it on reload
+	LiveConfig     string
+	ForceReloadCmd string
+	// MapsDir holds the host maps of the frontends having at least
+	// HostMapThreshold exact hostname rules, empty disables them
+	MapsDir          string
+	HostMapThreshold int
+	// AdminSocket is the runtime api socket the host maps are updated
+	// through, it is only added to the configs using host maps
+	AdminSocket string
+	// LuaDir holds the lua scripts the frontends and the backends run
+	LuaDir string
+	// SPOEDir holds the configs of the spoe engines
+	SPOEDir string
+	// DriftCheckInterval is the interval the written and the live
+	// configs are checked for drift at, 0 disables the checks
+	DriftCheckInterval time.Duration
+	// Capabilities detects the version of haproxy the configs are
+	// rendered for, nil renders them for any version
+	Capabilities *capabilityDetector
+	// Remote is the external haproxy the configs are applied
+	// to, nil for the colocated one
+	Remote *remoteConfig
+	// TicketKeys are the TLS session ticket keys shared by the
+	// instances, nil leaves them to haproxy
+	TicketKeys *ticketKeys
 }
 
 func (cfg *haproxyConfig) write(lbConfig *config.LoadBalancerConfig) (err error) {
-	var w io.Writer
-	w, err = os.Create(cfg.Config)
+	_, err = cfg.writeConfig(lbConfig)
+	return err
+}
+
+// writeConfig writes the config of the main instance, its host maps
+// and its ticket keys, the changes of the host maps are returned
+func (cfg *haproxyConfig) writeConfig(lbConfig *config.LoadBalancerConfig) (*hostMapsUpdate, error) {
+	files, update, err := cfg.renderFiles(cfg.Config, lbConfig, 0, fmt.Sprintf("%s/%s", cfg.CertDir, "current"))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// the ticket keys are only written for the main instance,
+	// writing them marks the reload haproxy needs to load them
+	if err := cfg.TicketKeys.write(lbConfig.Name, files.ticketKeys, time.Now()); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// render writes the config to the file, shifting all the frontend
+// ports by portOffset. The ticket keys are referenced, not written
+func (cfg *haproxyConfig) render(path string, lbConfig *config.LoadBalancerConfig, portOffset int, certsDir string) (err error) {
+	_, _, err = cfg.renderFiles(path, lbConfig, portOffset, certsDir)
+	return err
+}
+
+// renderFiles writes the config along with its host maps and spoe
+// configs, the files it uses and the changes of the maps are returned
+func (cfg *haproxyConfig) renderFiles(path string, lbConfig *config.LoadBalancerConfig, portOffset int, certsDir string) (*renderedFiles, *hostMapsUpdate, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	files, err := cfg.renderConfig(f, lbConfig, portOffset, certsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeSPOEConfigs(cfg.spoeConfigsDir(portOffset), files.spoeConfigs); err != nil {
+		return nil, nil, fmt.Errorf("Failed to write the spoe configs: %v", err)
+	}
+	previous, err := writeHostMaps(cfg.hostMapsDir(portOffset), files.hostMaps)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to write the host maps: %v", err)
 	}
+	return files, &hostMapsUpdate{previous: previous, maps: files.hostMaps}, nil
+}
+
+func (cfg *haproxyConfig) renderTo(w io.Writer, lbConfig *config.LoadBalancerConfig, portOffset int, certsDir string) (err error) {
+	_, err = cfg.renderConfig(w, lbConfig, portOffset, certsDir)
+	return err
+}
+
+// renderedFiles are the files the rendered config uses
+type renderedFiles struct {
+	hostMaps map[string]*hostMap
+	// spoeConfigs are the contents of the spoe configs by file
+	spoeConfigs map[string]string
+	// ticketKeys are the ticket key files by frontend
+	ticketKeys map[string]string
+}
+
+// renderConfig renders the config, the files it uses are returned
+func (cfg *haproxyConfig) renderConfig(w io.Writer, lbConfig *config.LoadBalancerConfig, portOffset int, certsDir string) (files *renderedFiles, err error) {
 	var t *template.Template
 	t, err = template.ParseFiles(cfg.Template)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	conf := make(map[string]interface{})
 	m := make(map[string]string)
@@ -80,40 +262,315 @@ func (cfg *haproxyConfig) write(lbConfig *config.LoadBalancerConfig) (err error)
 			m[be.UUID] = be.UUID
 			backends = append(backends, be)
 		}
+		if portOffset > 0 || fe.BindAddress != "" {
+			copied := *fe
+			copied.Port = fe.Port + portOffset
+			if fe.BindAddress != "" {
+				if copied.BindAddress, err = resolveBindAddress(fe.BindAddress); err != nil {
+					return nil, fmt.Errorf("Failed to resolve bind address of frontend %s: %v", fe.Name, err)
+				}
+			}
+			fe = &copied
+		}
 		frontends = append(frontends, fe)
 	}
-	conf["frontends"] = frontends
+	conf["certsDir"] = certsDir
+	conf["defaultPort"] = defaultListenerPort + portOffset
 	conf["backends"] = backends
-	conf["globalConfig"] = lbConfig.Config
+	globalConfig := lbConfig.Config
+	conf["globalConfig"] = globalConfig
 	conf["strictSni"] = lbConfig.DefaultCert == nil
+	if hasSNIOverrides(lbConfig) {
+		conf["crtList"] = crtListFile
+	}
+	frontendCrtLists := map[string]string{}
+	for _, fe := range lbConfig.FrontendServices {
+		if len(fe.Certs) > 0 {
+			frontendCrtLists[fe.Name] = getFrontendCrtListFile(fe)
+		}
+	}
+	conf["frontendCrtLists"] = frontendCrtLists
+	frontends, detectors, internalBinds := splitTLSDetection(frontends, frontendCrtLists)
+	conf["frontends"] = frontends
+	conf["tlsDetectors"] = detectors
+	conf["internalBinds"] = internalBinds
+	ticketKeys := cfg.TicketKeys.files(frontends)
+	conf["ticketKeyFiles"] = ticketKeys
+	// the exact hostname rules of the large frontends are routed with maps
+	maps := getHostMaps(frontends, cfg.HostMapThreshold, cfg.hostMapsDir(portOffset))
+	hostMapFiles := map[string]string{}
+	hostMapRules := map[string]string{}
+	for name, m := range maps {
+		hostMapFiles[name] = m.File
+		for i, rule := range m.Rules {
+			state := "mapped"
+			if i == 0 {
+				state = "first"
+			}
+			hostMapRules[fmt.Sprintf("%s %d", name, rule)] = state
+		}
+	}
+	conf["hostMapFiles"] = hostMapFiles
+	conf["hostMapRules"] = hostMapRules
+	caps := cfg.capabilities()
+	var globalSettings []string
+	if socket := cfg.statsSocketSetting(portOffset); socket != "" {
+		globalSettings = append(globalSettings, socket)
+	}
+	// the certs are updated through the admin socket too, and
+	// the stats of an external haproxy are read through it
+	if len(maps) > 0 || (caps != nil && caps.RuntimeCerts) || cfg.Remote != nil {
+		if socket := cfg.adminSocketSetting(portOffset); socket != "" {
+			globalSettings = append(globalSettings, socket)
+		}
+	}
+	luaLoads, err := cfg.getLuaLoads(frontends, backends)
+	if err != nil {
+		return nil, err
+	}
+	globalSettings = append(globalSettings, luaLoads...)
+	conf["globalConfig"] = addGlobalSettings(globalConfig, globalSettings)
+	// the spoe engines send their messages to the backends of their agents
+	spoeEngines, spoeFiles, spoeConfigs := getSPOEConfigs(lbConfig.SPOEngines, frontends, cfg.spoeConfigsDir(portOffset))
+	if caps != nil && !caps.SPOE && len(spoeEngines) > 0 {
+		logrus.Warnf("haproxy %s doesn't run spoe filters, ignoring the spoe engines of lb [%s]", caps.Version, lbConfig.Name)
+		spoeEngines, spoeFiles, spoeConfigs = nil, map[string]string{}, nil
+	}
+	conf["spoeEngines"] = spoeEngines
+	conf["spoeFiles"] = spoeFiles
+	files = &renderedFiles{hostMaps: maps, spoeConfigs: spoeConfigs, ticketKeys: ticketKeys}
+	// frontends of the backends capturing requests log them to the receiver
+	captureFrontends := map[string]bool{}
+	for _, fe := range frontends {
+		for _, be := range fe.BackendServices {
+			if be.DebugCapture != nil && (fe.Protocol == config.HTTPProto || fe.Protocol == config.HTTPSProto) {
+				captureFrontends[fe.Name] = true
+			}
+		}
+	}
+	conf["captureFrontends"] = captureFrontends
+	if len(captureFrontends) > 0 {
+		conf["captureLog"] = captureAddress()
+		conf["captureLogFormat"] = captureLogFormat
+		conf["captureBodyBytes"] = cfg.CaptureBodyBytes
+	}
+	// frontends of the backends logging requests only log the
+	// requests the backends pick, the capture frontends log captures
+	requestLogFrontends := map[string]bool{}
+	for _, fe := range frontends {
+		for _, be := range fe.BackendServices {
+			if be.RequestLogging != nil && (fe.Protocol == config.HTTPProto || fe.Protocol == config.HTTPSProto) && !captureFrontends[fe.Name] {
+				requestLogFrontends[fe.Name] = true
+			}
+		}
+	}
+	conf["requestLogFrontends"] = requestLogFrontends
+	conf["requestLog"] = requestLogAddress
+	// tcp frontends log their connections to the receiver
+	if cfg.TCPLogAddress != "" {
+		conf["tcpLog"] = cfg.TCPLogAddress
+		conf["tcpLogFormat"] = tcpLogFormat
+	}
+	// the h2c frontends are in htx mode, which detects the HTTP/2
+	// preface so the h2c and the HTTP/1.1 clients share the port, and
+	// the backends opting in talk HTTP/2 to the servers. haproxy 1.9
+	// needs the htx mode on both the frontends and all their backends
+	h2c := caps == nil || caps.H2C
+	htxFrontends := map[string]bool{}
+	h2Backends := map[string]bool{}
+	for _, fe := range frontends {
+		if fe.H2C && fe.Protocol == config.HTTPProto {
+			if h2c {
+				htxFrontends[fe.Name] = true
+			} else {
+				logrus.Warnf("haproxy %s doesn't serve HTTP/2 cleartext, ignoring the h2c of frontend %s", caps.Version, fe.Name)
+			}
+		}
+		for _, be := range fe.BackendServices {
+			if !be.H2 {
+				continue
+			}
+			if !h2c {
+				logrus.Warnf("haproxy %s doesn't talk HTTP/2 to the servers, ignoring the h2 of backend %s", caps.Version, be.UUID)
+				continue
+			}
+			h2Backends[be.UUID] = true
+			htxFrontends[fe.Name] = true
+		}
+	}
+	htxBackends := map[string]bool{}
+	for _, fe := range frontends {
+		if htxFrontends[fe.Name] {
+			for _, be := range fe.BackendServices {
+				htxBackends[be.UUID] = true
+			}
+		}
+	}
+	conf["htxOption"] = caps == nil || caps.HTXOption
+	conf["htxFrontends"] = htxFrontends
+	conf["htxBackends"] = htxBackends
+	conf["h2Backends"] = h2Backends
+	// the http backends not setting it reuse the server connections
+	reuseBackends := map[string]bool{}
+	if caps != nil && caps.HTTPReuse {
+		for _, be := range backends {
+			if (be.Protocol == config.HTTPProto || be.Protocol == config.HTTPSProto) && (be.KeepAlive == nil || be.KeepAlive.HTTPReuse == "") {
+				reuseBackends[be.UUID] = true
+			}
+		}
+	}
+	conf["reuseBackends"] = reuseBackends
+	// the idle server connection pools are only tuned by haproxy 2.0+
+	serverPools := caps == nil || caps.ServerPools
+	if !serverPools {
+		for _, be := range backends {
+			if be.KeepAlive != nil && (be.KeepAlive.PoolPurgeDelay != "" || be.KeepAlive.PoolMaxConn > 0) {
+				logrus.Warnf("haproxy %s doesn't tune the server connection pools, ignoring the pool settings of backend %s", caps.Version, be.UUID)
+			}
+		}
+	}
+	conf["serverPools"] = serverPools
 	if lbConfig.DefaultCert != nil {
-		defCertName := strings.Replace(lbConfig.DefaultCert.Name, " ", "\\ ", -1)
+		// bundled certs are referenced by the bundle name,
+		// haproxy picks up .rsa and .ecdsa files by itself
+		defCertName := lbConfig.DefaultCert.Name
+		if lbConfig.DefaultCert.Bundle != "" {
+			defCertName = lbConfig.DefaultCert.Bundle
+		}
+		defCertName = strings.Replace(defCertName, " ", "\\ ", -1)
 		conf["defaultCertFile"] = fmt.Sprintf("%s.pem", defCertName)
 	}
-	err = t.Execute(w, conf)
-	return err
+	conf["nameservers"] = []string{defaultNameserver}
+	if lbConfig.Resolvers != nil {
+		conf["resolvers"] = lbConfig.Resolvers
+		if len(lbConfig.Resolvers.Nameservers) > 0 {
+			nameservers := []string{}
+			for i, ns := range lbConfig.Resolvers.Nameservers {
+				nameservers = append(nameservers, fmt.Sprintf("dns%d %s", i+1, ns))
+			}
+			conf["nameservers"] = nameservers
+		}
+		if lbConfig.Resolvers.ServerSlots > 1 {
+			conf["serverSlots"] = lbConfig.Resolvers.ServerSlots
+		}
+	}
+	conf["hardening"] = lbConfig.Hardening
+	conf["stripHeaders"] = lbConfig.StripHeaders
+	if lbConfig.StripHeaders != nil {
+		conf["stripTrustedSources"] = strings.Join(lbConfig.StripHeaders.TrustedSources, " ")
+	}
+	if lbConfig.DebugHeaders != nil {
+		conf["debugHeaders"] = true
+		conf["debugSources"] = strings.Join(lbConfig.DebugHeaders.Sources, " ")
+		ruleNames := make(map[string]string)
+		for _, be := range backends {
+			ruleNames[be.UUID] = getRuleName(be)
+		}
+		conf["ruleNames"] = ruleNames
+	}
+	if cfg.PeerName == "" {
+		return files, t.Execute(w, conf)
+	}
+	conf["peersName"] = peersSection
+	conf["peers"] = cfg.getPeers(lbConfig.Peers, portOffset)
+	var b bytes.Buffer
+	if err = t.Execute(&b, conf); err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(w, addStickTablePeers(b.String()))
+	return files, err
 }
 
-func (lbp *Provider) applyHaproxyConfig(lbConfig *config.LoadBalancerConfig) error {
-	// copy certificates
-	if _, err := os.Stat(lbp.cfg.CertDir); os.IsNotExist(err) {
-		if err = os.Mkdir(lbp.cfg.CertDir, 0644); err != nil {
-			return err
+// addGlobalSettings adds the settings at the top of the global section
+func addGlobalSettings(globalConfig string, settings []string) string {
+	if len(settings) == 0 || !strings.HasPrefix(globalConfig, "global\n") {
+		return globalConfig
+	}
+	var b bytes.Buffer
+	b.WriteString("global\n")
+	for _, setting := range settings {
+		b.WriteString("    " + setting + "\n")
+	}
+	b.WriteString(strings.TrimPrefix(globalConfig, "global\n"))
+	return b.String()
+}
+
+// tlsDetector is the tcp frontend of a frontend detecting tls, passing
+// the connections on to its internal tls and plaintext frontends
+type tlsDetector struct {
+	Name        string
+	BindAddress string
+	Port        int
+	AcceptProxy bool
+	TLSSocket   string
+	PlainSocket string
+}
+
+/*
+splitTLSDetection replaces the frontends detecting tls by internal tls and
+plaintext frontends, bound to abstract sockets named after the port, which
+already has the offset of the shadow instance, and returns the tcp frontends dispatching
+the connections to them along with the internal binds by frontend name
+*/
+func splitTLSDetection(frontends []*config.FrontendService, crtLists map[string]string) ([]*config.FrontendService, []*tlsDetector, map[string]string) {
+	var split []*config.FrontendService
+	detectors := []*tlsDetector{}
+	internalBinds := map[string]string{}
+	for _, fe := range frontends {
+		if !fe.DetectTLS || (fe.Protocol != config.HTTPProto && fe.Protocol != config.HTTPSProto) {
+			split = append(split, fe)
+			continue
+		}
+		d := &tlsDetector{
+			Name:        fe.Name,
+			BindAddress: fe.BindAddress,
+			Port:        fe.Port,
+			AcceptProxy: fe.AcceptProxy,
+			TLSSocket:   fmt.Sprintf("abns@lb_%d_tls", fe.Port),
+			PlainSocket: fmt.Sprintf("abns@lb_%d_plain", fe.Port),
 		}
+		tlsFe, plainFe := *fe, *fe
+		tlsFe.Name, tlsFe.Protocol = fe.Name+"_tls", config.HTTPSProto
+		plainFe.Name, plainFe.Protocol = fe.Name+"_plain", config.HTTPProto
+		if crtList, ok := crtLists[fe.Name]; ok {
+			crtLists[tlsFe.Name] = crtList
+		}
+		internalBinds[tlsFe.Name] = d.TLSSocket
+		internalBinds[plainFe.Name] = d.PlainSocket
+		split = append(split, &tlsFe, &plainFe)
+		detectors = append(detectors, d)
 	}
-	currentCerts := fmt.Sprintf("%s/%s", lbp.cfg.CertDir, "current")
-	if _, err := os.Stat(currentCerts); os.IsNotExist(err) {
-		if err = os.Mkdir(currentCerts, 0644); err != nil {
-			return err
+	return split, detectors, internalBinds
+}
+
+func getRuleName(be *config.BackendService) string {
+	host := be.Host
+	if host != "" {
+		if be.RuleComparator == config.BegRuleComparator {
+			host = fmt.Sprintf("%s*", host)
+		} else if be.RuleComparator == config.EndRuleComparator {
+			host = fmt.Sprintf("*%s", host)
 		}
 	}
+	name := fmt.Sprintf("%s%s", host, be.Path)
+	if name == "" {
+		return "*"
+	}
+	return name
+}
 
-	newCerts := fmt.Sprintf("%s/%s", lbp.cfg.CertDir, "new")
-	if _, err := os.Stat(newCerts); os.IsNotExist(err) {
-		if err = os.Mkdir(newCerts, 0644); err != nil {
+func ensureDir(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = os.Mkdir(dir, 0644); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// writeCertificates writes the certs to certDir, servedDir is
+// the dir haproxy reads them from once they are applied
+func writeCertificates(certDir string, servedDir string, lbConfig *config.LoadBalancerConfig) error {
 	certs := []*config.Certificate{}
 	if lbConfig.DefaultCert != nil {
 		certs = append(certs, lbConfig.DefaultCert)
@@ -123,22 +580,187 @@ func (lbp *Provider) applyHaproxyConfig(lbConfig *config.LoadBalancerConfig) err
 	}
 
 	for _, cert := range certs {
-		certStr := fmt.Sprintf("%s\n%s", cert.Key, cert.Cert)
+		// no blank line between the key and the cert, it would end
+		// the payload of the runtime cert updates
+		certStr := fmt.Sprintf("%s\n%s", strings.TrimRight(cert.Key, "\n"), cert.Cert)
 		b := []byte(certStr)
-		path := fmt.Sprintf("%s/%s.pem", newCerts, cert.Name)
+		path := getCertFilePath(certDir, cert)
 		err := ioutil.WriteFile(path, b, 0644)
 		if err != nil {
 			return err
 		}
 	}
+	if hasSNIOverrides(lbConfig) {
+		crtList := getCrtList(servedDir, certs)
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%s", certDir, crtListFile), []byte(crtList), 0644); err != nil {
+			return err
+		}
+	}
+	for _, fe := range lbConfig.FrontendServices {
+		if len(fe.Certs) == 0 {
+			continue
+		}
+		crtList := getCrtList(servedDir, getFrontendCerts(fe, certs))
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%s", certDir, getFrontendCrtListFile(fe)), []byte(crtList), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFrontendCrtListFile is the name of the crt-list of the certs the
+// frontend presents
+func getFrontendCrtListFile(fe *config.FrontendService) string {
+	return fmt.Sprintf("%s.%s", crtListFile, sanitizeFileName(fe.Name))
+}
+
+// sanitizeFileName replaces the characters of the name unsafe in file names
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// getFrontendCerts returns the certs selected by the frontend, in the
+// order they are selected so the first one is the default of the bind
+func getFrontendCerts(fe *config.FrontendService, certs []*config.Certificate) []*config.Certificate {
+	var selected []*config.Certificate
+	for _, name := range fe.Certs {
+		for _, cert := range certs {
+			if cert.Name == name {
+				selected = append(selected, cert)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func hasSNIOverrides(lbConfig *config.LoadBalancerConfig) bool {
+	for _, cert := range lbConfig.Certs {
+		if len(cert.Hostnames) > 0 {
+			return true
+		}
+	}
+	return lbConfig.DefaultCert != nil && len(lbConfig.DefaultCert.Hostnames) > 0
+}
+
+/*
+getCrtList lists the cert files with the hostnames they are served for,
+certs without hostnames are served for the hostnames they are issued for:
+
+/etc/haproxy/certs/current/wildcard.pem *.example.com !admin.example.com
+/etc/haproxy/certs/current/admin.pem
+*/
+func getCrtList(servedDir string, certs []*config.Certificate) string {
+	var files []string
+	filters := map[string][]string{}
+	for _, cert := range certs {
+		// bundled certs are listed once by the bundle name
+		name := cert.Name
+		if cert.Bundle != "" {
+			name = cert.Bundle
+		}
+		file := fmt.Sprintf("%s/%s.pem", servedDir, name)
+		if _, ok := filters[file]; !ok {
+			files = append(files, file)
+			filters[file] = []string{}
+		}
+		filters[file] = append(filters[file], cert.Hostnames...)
+	}
+	var b bytes.Buffer
+	for _, file := range files {
+		b.WriteString(strings.Replace(file, " ", "\\ ", -1))
+		seen := map[string]bool{}
+		for _, hostname := range filters[file] {
+			if !seen[hostname] {
+				seen[hostname] = true
+				b.WriteString(" " + hostname)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// applyHaproxyConfig writes and reloads the config, the checksum
+// of the written config is recorded once it is running
+func (lbp *Provider) applyHaproxyConfig(lbConfig *config.LoadBalancerConfig) error {
+	lbp.applied.mu.Lock()
+	defer lbp.applied.mu.Unlock()
+	return lbp.applyLocked(lbConfig)
+}
+
+// applyLocked applies the config with the applied config locked
+func (lbp *Provider) applyLocked(lbConfig *config.LoadBalancerConfig) error {
+	lbp.applied.sum = ""
+	lbp.applied.config = nil
+	if err := lbp.reloadHaproxyConfig(lbConfig); err != nil {
+		return err
+	}
+	sum, err := checksumFile(lbp.cfg.Config)
+	if err != nil {
+		logrus.Warnf("Failed to checksum the applied config, its drift is not checked: %v", err)
+		return nil
+	}
+	lbp.applied.config = lbConfig
+	lbp.applied.sum = sum
+	return nil
+}
+
+func (lbp *Provider) reloadHaproxyConfig(lbConfig *config.LoadBalancerConfig) error {
+	// copy certificates
+	if err := ensureDir(lbp.cfg.CertDir); err != nil {
+		return err
+	}
+	currentCerts := fmt.Sprintf("%s/%s", lbp.cfg.CertDir, "current")
+	if err := ensureDir(currentCerts); err != nil {
+		return err
+	}
+
+	newCerts := fmt.Sprintf("%s/%s", lbp.cfg.CertDir, "new")
+	if err := ensureDir(newCerts); err != nil {
+		return err
+	}
+	if err := writeCertificates(newCerts, currentCerts, lbConfig); err != nil {
+		return err
+	}
 	// apply config
-	if err := lbp.cfg.write(lbConfig); err != nil {
+	update, err := lbp.cfg.writeConfig(lbConfig)
+	if err != nil {
 		return err
 	}
+	// the host maps of an unchanged config are updated without reload
+	if update.changed() && !lbp.cfg.configChanged() {
+		if err := lbp.cfg.updateHostMaps(update.previous, update.maps); err != nil {
+			logrus.Warnf("Failed to update the host maps through the admin socket, forcing the reload: %v", err)
+			return lbp.cfg.runReload(lbp.cfg.ForceReloadCmd)
+		}
+	}
+	// and so are its certificates when haproxy supports it
+	if caps := lbp.cfg.capabilities(); caps != nil && caps.RuntimeCerts && !lbp.cfg.configChanged() {
+		if err := lbp.cfg.updateCerts(newCerts, currentCerts); err != nil {
+			logrus.Warnf("Failed to update the certificates through the admin socket, reloading: %v", err)
+		}
+	}
+	// haproxy reads the ticket keys on start only
+	if lbp.cfg.TicketKeys.reloadNeeded() {
+		return lbp.cfg.runReload(lbp.cfg.ForceReloadCmd)
+	}
 
 	return lbp.cfg.reload()
 }
 
+func getCertFilePath(certDir string, cert *config.Certificate) string {
+	if cert.Bundle != "" && cert.KeyType != "" {
+		return fmt.Sprintf("%s/%s.pem.%s", certDir, cert.Bundle, cert.KeyType)
+	}
+	return fmt.Sprintf("%s/%s.pem", certDir, cert.Name)
+}
+
 func (lbp *Provider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
 	//check if the config is being starting
 	for i := 0; i < 5; i++ {
@@ -146,18 +768,119 @@ func (lbp *Provider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
 			time.Sleep(time.Second * time.Duration(1))
 			continue
 		}
-		return lbp.applyHaproxyConfig(lbConfig)
+		// the virtual services are programmed once haproxy applied
+		// the rest, a rejected config leaves IPVS unchanged
+		var services map[string]*ipvs.VirtualService
+		if lbp.fastPath != nil {
+			lbConfig, services = lbp.fastPath.Split(lbConfig)
+		}
+		if err := lbp.setupTProxy(lbConfig); err != nil {
+			return err
+		}
+		lbp.setupCapture(lbConfig)
+		lbp.setupTCPLog(lbConfig)
+		lbp.tags.set(lbConfig)
+		if lbp.shadow != nil {
+			return lbp.shadowApply(lbConfig, services)
+		}
+		if err := lbp.applyHaproxyConfig(lbConfig); err != nil {
+			return err
+		}
+		return lbp.programFastPath(services)
 	}
 	return fmt.Errorf("Failed to wait for %s to exit init stage", lbp.GetName())
 }
 
+func (lbp *Provider) programFastPath(services map[string]*ipvs.VirtualService) error {
+	if lbp.fastPath == nil {
+		return nil
+	}
+	return lbp.fastPath.Program(services)
+}
+
+func (lbp *Provider) setupTProxy(lbConfig *config.LoadBalancerConfig) error {
+	if lbp.tproxy || lbp.cfg.TProxyCmd == "" || !hasTransparentBackends(lbConfig) {
+		return nil
+	}
+	output, err := exec.Command("sh", "-c", lbp.cfg.TProxyCmd).CombinedOutput()
+	if string(output) != "" {
+		logrus.Info(string(output))
+	}
+	if err != nil {
+		return fmt.Errorf("error setting up transparent proxying: %v", err)
+	}
+	lbp.tproxy = true
+	return nil
+}
+
+func hasTransparentBackends(lbConfig *config.LoadBalancerConfig) bool {
+	for _, fe := range lbConfig.FrontendServices {
+		for _, be := range fe.BackendServices {
+			if be.Transparent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (lbp *Provider) GetRenderedConfig() (string, []byte, error) {
+	data, err := ioutil.ReadFile(lbp.cfg.Config)
+	return "haproxy.cfg", data, err
+}
+
+// RenderConfig renders the config to the dir, along with the host maps
+// and the spoe configs it uses. The certificates are referenced from
+// the cert dir, they are not written, and the ticket keys from theirs
+func (lbp *Provider) RenderConfig(lbConfig *config.LoadBalancerConfig, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	cfg := *lbp.cfg
+	cfg.Config = path.Join(dir, "haproxy.cfg")
+	paths := []string{cfg.Config}
+	if cfg.MapsDir != "" {
+		cfg.MapsDir = path.Join(dir, "maps")
+		paths = append(paths, cfg.MapsDir)
+	}
+	if cfg.SPOEDir != "" {
+		cfg.SPOEDir = path.Join(dir, "spoe")
+		paths = append(paths, cfg.SPOEDir)
+	}
+	if err := cfg.render(cfg.Config, lbConfig, 0, path.Join(lbp.cfg.CertDir, "current")); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
 func (lbp *Provider) GetName() string {
 	return "haproxy"
 }
 
-func (lbp *Provider) GetPublicEndpoints(configName string) []string {
-	epStr := []string{}
-	return epStr
+// resolveBindAddress returns the first ipv4 address of the
+// interface, addresses are returned as is
+func resolveBindAddress(address string) (string, error) {
+	if net.ParseIP(address) != nil {
+		return address, nil
+	}
+	iface, err := net.InterfaceByName(address)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("Interface %s has no ipv4 address", address)
+}
+
+func (lbp *Provider) GetPublicEndpoints(configName string) []provider.PublicEndpoint {
+	return []provider.PublicEndpoint{}
 }
 
 func (cfg *haproxyConfig) start() error {
@@ -173,7 +896,11 @@ func (cfg *haproxyConfig) start() error {
 }
 
 func (cfg *haproxyConfig) reload() error {
-	output, err := exec.Command("sh", "-c", cfg.ReloadCmd).CombinedOutput()
+	return cfg.runReload(cfg.ReloadCmd)
+}
+
+func (cfg *haproxyConfig) runReload(cmd string) error {
+	output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
 	msg := fmt.Sprintf("%v -- %v", cfg.Name, string(output))
 	if string(output) != "" {
 		logrus.Info(msg)
@@ -193,6 +920,12 @@ func (lbp *Provider) IsHealthy() bool {
 }
 
 func (lbp *Provider) Run(syncEndpointsQueue *utils.TaskQueue) {
+	if lbp.cfg.DriftCheckInterval > 0 {
+		go lbp.watchDrift(lbp.cfg.DriftCheckInterval)
+	}
+	if lbp.cfg.TicketKeys != nil {
+		go lbp.watchTicketKeys()
+	}
 	lbp.StartHaproxy()
 	lbp.init = false
 	<-lbp.stopCh
@@ -205,9 +938,16 @@ func (lbp *Provider) Stop() error {
 }
 
 func (lbp *Provider) ProcessCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error {
+	if lbp.cfg.Tuner != nil {
+		lbp.cfg.Tuner.setTuning(lbConfig)
+	}
+	lbp.cfg.capabilities().gateTuning(lbConfig)
 	return BuildCustomConfig(lbConfig, customConfig)
 }
 
 func (lbp *Provider) CleanupConfig(name string) error {
+	if lbp.fastPath != nil {
+		return lbp.fastPath.Cleanup()
+	}
 	return nil
 }
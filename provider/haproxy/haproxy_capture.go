@@ -0,0 +1,203 @@
+package haproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+var (
+	capturePort      = flags.Int("DEBUG_CAPTURE_PORT", 10242, "Local udp port haproxy sends the captured requests to").Range(1, 65535)
+	captureSize      = flags.Int("DEBUG_CAPTURE_SIZE", 100, "Number of captured requests kept for the admin api").Range(1, 10000)
+	captureBodyBytes = flags.Int("DEBUG_CAPTURE_BODY_BYTES", 0, "Captured request bodies are truncated to this size, 0 leaves the bodies out of the captures").Range(0, 65536)
+	captureRedacted  = flags.String("DEBUG_CAPTURE_REDACTED_HEADERS", "Authorization,Proxy-Authorization,Cookie,Set-Cookie", "Comma separated list of the headers whose values are redacted from the captures")
+)
+
+const redactedValue = "<redacted>"
+
+/*
+captureLogFormat logs the captured requests as json, the variables
+are set by the backends with debug capture enabled and are empty for
+the other requests of the frontend
+*/
+const captureLogFormat = `"{\"backend\":\"%[var(txn.lb_capture),json(utf8s)]\",\"client\":\"%ci:%cp\",\"method\":\"%HM\",` +
+	`\"uri\":\"%[capture.req.uri,json(utf8s)]\",\"status\":%ST,\"request_headers\":\"%[var(txn.lb_capture_req_hdrs),json(utf8s)]\",` +
+	`\"request_body\":\"%[var(txn.lb_capture_req_body),json(utf8s)]\",\"response_headers\":\"%[var(txn.lb_capture_res_hdrs),json(utf8s)]\"}"`
+
+// captureReceiver reads the captured requests haproxy logs over
+// syslog, and keeps the last ones in a ring buffer
+type captureReceiver struct {
+	mu       sync.Mutex
+	captures []provider.Capture
+	next     int
+	full     bool
+	// deadlines are the end of the captures by backend
+	deadlines map[string]time.Time
+	// redacted are the lowercased names of the headers
+	// whose values are never stored
+	redacted map[string]bool
+	now      func() time.Time
+}
+
+func newCaptureReceiver(size int, redacted string) *captureReceiver {
+	r := &captureReceiver{
+		captures:  make([]provider.Capture, size),
+		deadlines: map[string]time.Time{},
+		redacted:  map[string]bool{},
+		now:       time.Now,
+	}
+	for _, name := range strings.Split(redacted, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			r.redacted[strings.ToLower(name)] = true
+		}
+	}
+	return r
+}
+
+// redact replaces the values of the redacted headers of the
+// header block, one header per line
+func (r *captureReceiver) redact(headers string) string {
+	lines := strings.Split(headers, "\n")
+	for i, line := range lines {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 || !r.redacted[strings.ToLower(strings.TrimSpace(line[:colon]))] {
+			continue
+		}
+		lines[i] = line[:colon+1] + " " + redactedValue
+		if strings.HasSuffix(line, "\r") {
+			lines[i] += "\r"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *captureReceiver) listen(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Debug capture receiver is listening on %s", address)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				logrus.Errorf("Failed to read debug capture: %v", err)
+				continue
+			}
+			r.receive(buf[:n])
+		}
+	}()
+	return nil
+}
+
+// setDeadlines updates the end of the captures from the backends of the config
+func (r *captureReceiver) setDeadlines(lbConfig *config.LoadBalancerConfig) {
+	deadlines := map[string]time.Time{}
+	for _, fe := range lbConfig.FrontendServices {
+		for _, be := range fe.BackendServices {
+			if be.DebugCapture != nil {
+				deadlines[be.UUID] = be.DebugCapture.Until
+			}
+		}
+	}
+	r.mu.Lock()
+	r.deadlines = deadlines
+	r.mu.Unlock()
+}
+
+// receive stores the capture of the syslog message, messages of
+// requests not captured or past the end of their capture are dropped
+func (r *captureReceiver) receive(message []byte) {
+	start := bytes.IndexByte(message, '{')
+	if start < 0 {
+		return
+	}
+	var capture provider.Capture
+	if err := json.Unmarshal(bytes.TrimSpace(message[start:]), &capture); err != nil {
+		logrus.Debugf("Failed to parse debug capture: %v", err)
+		return
+	}
+	if capture.Backend == "" {
+		return
+	}
+	capture.RequestHeaders = r.redact(capture.RequestHeaders)
+	capture.ResponseHeaders = r.redact(capture.ResponseHeaders)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	capture.Time = r.now()
+	if deadline, ok := r.deadlines[capture.Backend]; !ok || capture.Time.After(deadline) {
+		return
+	}
+	r.captures[r.next] = capture
+	r.next = (r.next + 1) % len(r.captures)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *captureReceiver) list() []provider.Capture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	captures := []provider.Capture{}
+	if r.full {
+		captures = append(captures, r.captures[r.next:]...)
+	}
+	return append(captures, r.captures[:r.next]...)
+}
+
+func hasDebugCaptures(lbConfig *config.LoadBalancerConfig) bool {
+	for _, fe := range lbConfig.FrontendServices {
+		for _, be := range fe.BackendServices {
+			if be.DebugCapture != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setupCapture starts the capture receiver with the first
+// config capturing requests, and updates the capture deadlines
+func (lbp *Provider) setupCapture(lbConfig *config.LoadBalancerConfig) {
+	lbp.captureMu.Lock()
+	defer lbp.captureMu.Unlock()
+	if lbp.capture == nil {
+		if !hasDebugCaptures(lbConfig) {
+			return
+		}
+		receiver := newCaptureReceiver(captureSize.Get(), captureRedacted.Get())
+		if err := receiver.listen(captureAddress()); err != nil {
+			logrus.Errorf("Failed to start debug capture receiver: %v", err)
+			return
+		}
+		lbp.capture = receiver
+	}
+	lbp.capture.setDeadlines(lbConfig)
+}
+
+func (lbp *Provider) GetCaptures() ([]provider.Capture, error) {
+	lbp.captureMu.Lock()
+	defer lbp.captureMu.Unlock()
+	if lbp.capture == nil {
+		return []provider.Capture{}, nil
+	}
+	return lbp.capture.list(), nil
+}
+
+func captureAddress() string {
+	return fmt.Sprintf("127.0.0.1:%d", capturePort.Get())
+}
@@ -5,10 +5,13 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/lb-controller/config"
-	//"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config/flags"
 )
 
+var allowedDirectives = flags.String("CUSTOM_CONFIG_ALLOWED_DIRECTIVES", "", "Comma separated list of the directives honored in the custom configs, like timeout,option httplog,balance. All are honored when not set")
+
 func GetDefaultConfig() map[string]map[string]string {
 	defaults := make(map[string]string)
 	global := make(map[string]string)
@@ -90,10 +93,101 @@ func isDirective(directive string) bool {
 	return false
 }
 
+/*
+filterCustomConfig drops the directives of the custom config not in the
+allowed list. A directive is allowed when its first words match one of
+the allowed entries, "option" allowing all the options and "option
+httplog" only that one. The global, defaults, frontend and backend
+sections are always allowed, the other sections are dropped along with
+their directives unless allowed
+*/
+func filterCustomConfig(customConfig string, allowed []string) string {
+	if len(allowed) == 0 {
+		return customConfig
+	}
+	var lines []string
+	skipSection := false
+	for _, line := range strings.Split(customConfig, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			lines = append(lines, line)
+			continue
+		}
+		if isDirective(fields[0]) {
+			skipSection = !isBuiltinSection(fields[0]) && !isAllowedDirective(fields, allowed)
+			if skipSection {
+				logrus.Warnf("Skipping custom config section [%s], it is not allowed", strings.TrimSpace(line))
+				continue
+			}
+		} else if skipSection {
+			continue
+		} else if !isAllowedDirective(fields, allowed) {
+			logrus.Warnf("Skipping custom config directive [%s], it is not allowed", strings.TrimSpace(line))
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isBuiltinSection(section string) bool {
+	for _, s := range []string{"global", "defaults", "frontend", "backend"} {
+		if strings.EqualFold(section, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllowedDirective(fields []string, allowed []string) bool {
+	for _, entry := range allowed {
+		entryFields := strings.Fields(entry)
+		if len(entryFields) == 0 || len(entryFields) > len(fields) {
+			continue
+		}
+		match := true
+		for i, field := range entryFields {
+			if !strings.EqualFold(field, fields[i]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// httpCheckExpect renders the http-check expect rule of the expected
+// response, spaces of the patterns are escaped as they are single words
+func httpCheckExpect(expect *config.HealthCheckExpect) string {
+	if expect == nil {
+		return ""
+	}
+	pattern := strings.Replace(expect.Pattern, " ", "\\ ", -1)
+	if expect.Match == "header" {
+		return fmt.Sprintf("http-check expect hdr name %s value %s", expect.Header, pattern)
+	}
+	return fmt.Sprintf("http-check expect %s %s", expect.Match, pattern)
+}
+
+func getAllowedDirectives() []string {
+	var allowed []string
+	for _, entry := range strings.Split(allowedDirectives.Get(), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			allowed = append(allowed, entry)
+		}
+	}
+	return allowed
+}
+
 func BuildCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error {
+	customConfig = filterCustomConfig(customConfig, getAllowedDirectives())
 	customConfigMap := make(map[string][]string)
 	var key string
 	defaultConfig := GetDefaultConfig()
+	applyTuning(defaultConfig, lbConfig.Tuning)
 
 	serverPrefix := "server $IP"
 	for _, conf := range strings.Split(customConfig, "\n") {
@@ -166,8 +260,13 @@ func BuildCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string)
 		processedConfigs[feConfigName] = ""
 		for _, be := range fe.BackendServices {
 			healthcheck := false
-			if be.HealthCheck != nil && be.HealthCheck.Port > 0 {
-				healthcheck = true
+			checkPort := 0
+			if be.HealthCheck != nil {
+				checkPort = be.HealthCheck.Port
+				if be.CheckPort > 0 {
+					checkPort = be.CheckPort
+				}
+				healthcheck = checkPort > 0
 			}
 
 			beConfig := sort.StringSlice{}
@@ -181,6 +280,9 @@ func BuildCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string)
 				be.Config = fmt.Sprintf("%s\n    timeout check %v", be.Config, be.HealthCheck.ResponseTimeout)
 				if be.HealthCheck.RequestLine != "" {
 					be.Config = fmt.Sprintf("%s\n    option httpchk %s", be.Config, be.HealthCheck.RequestLine)
+					if expect := httpCheckExpect(be.HealthCheck.Expect); expect != "" {
+						be.Config = fmt.Sprintf("%s\n    %s", be.Config, expect)
+					}
 				}
 			}
 			//append cookie policy
@@ -210,17 +312,45 @@ func BuildCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string)
 				processedConfigs[epConfigName] = ""
 				//append health check
 
-				if healthcheck {
-					hc := fmt.Sprintf("check port %v inter %v rise %v fall %v", be.HealthCheck.Port, be.HealthCheck.Interval, be.HealthCheck.HealthyThreshold, be.HealthCheck.UnhealthyThreshold)
+				epCheck := healthcheck && !ep.NoCheck
+				if epCheck {
+					hc := fmt.Sprintf("check port %v inter %v rise %v fall %v", checkPort, be.HealthCheck.Interval, be.HealthCheck.HealthyThreshold, be.HealthCheck.UnhealthyThreshold)
+					if be.InitState != nil {
+						if be.InitState.Down {
+							hc = fmt.Sprintf("%s init-state down", hc)
+						}
+						if be.InitState.SlowStartMs > 0 {
+							hc = fmt.Sprintf("%s slowstart %v", hc, be.InitState.SlowStartMs)
+						}
+					}
 					ep.Config = fmt.Sprintf("%s %s", ep.Config, hc)
 				}
+				if ep.Backup {
+					ep.Config = fmt.Sprintf("%s backup", ep.Config)
+				}
+				if ep.Drain {
+					// a zero weight only serves the sticky sessions
+					ep.Weight = 0
+					ep.Config = fmt.Sprintf("%s weight 0", ep.Config)
+				}
+				if be.AgentCheck != nil {
+					agent := fmt.Sprintf("agent-check agent-port %v", be.AgentCheck.Port)
+					if be.AgentCheck.InterMs > 0 {
+						agent = fmt.Sprintf("%s agent-inter %v", agent, be.AgentCheck.InterMs)
+					}
+					ep.Config = fmt.Sprintf("%s %s", ep.Config, agent)
+				}
 				if ep.IsCname {
 					// health check is required for the fqdn resolution
 					resolver := " check resolvers rancher"
-					if healthcheck {
+					if epCheck {
 						resolver = " resolvers rancher"
 					}
 
+					if lbConfig.Resolvers != nil && lbConfig.Resolvers.ResolvePrefer != "" {
+						resolver = fmt.Sprintf("%s resolve-prefer %s", resolver, lbConfig.Resolvers.ResolvePrefer)
+					}
+
 					ep.Config = fmt.Sprintf("%s %s", ep.Config, resolver)
 				}
 
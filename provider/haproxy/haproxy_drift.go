@@ -0,0 +1,117 @@
+package haproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+var driftCheckInterval = flags.Duration("DRIFT_CHECK_INTERVAL", 30*time.Second, "Interval the haproxy configs are checked at for changes made outside the controller, the configs modified or removed are reapplied. 0 disables the checks")
+
+// appliedConfig is the config last applied and the checksum of its
+// file, the written and the live configs are compared to it. It is
+// held for the whole apply so the drift isn't checked against a
+// config being reloaded
+type appliedConfig struct {
+	mu     sync.Mutex
+	config *config.LoadBalancerConfig
+	// sum is empty before the first apply and after a failed one,
+	// the live config is unknown then
+	sum string
+}
+
+func checksumFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkedPaths are the live config haproxy runs, then the written
+// config it is reloaded from
+func (cfg *haproxyConfig) checkedPaths() []string {
+	if cfg.LiveConfig == "" || cfg.LiveConfig == cfg.Config {
+		return []string{cfg.Config}
+	}
+	return []string{cfg.LiveConfig, cfg.Config}
+}
+
+// CheckDrift compares the live and the written configs
+// to the config last applied
+func (lbp *Provider) CheckDrift() (*provider.ConfigDrift, error) {
+	lbp.applied.mu.Lock()
+	defer lbp.applied.mu.Unlock()
+	return lbp.checkDriftLocked()
+}
+
+func (lbp *Provider) checkDriftLocked() (*provider.ConfigDrift, error) {
+	if lbp.applied.sum == "" {
+		return nil, nil
+	}
+	for _, path := range lbp.cfg.checkedPaths() {
+		sum, err := checksumFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if sum != lbp.applied.sum {
+			return &provider.ConfigDrift{
+				ConfigName: lbp.applied.config.Name,
+				Path:       path,
+				Expected:   lbp.applied.sum,
+				Actual:     sum,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// healDrift reapplies the config last applied when its files drifted,
+// the drift is returned. The check and the reapply hold the applied
+// config, so a newer config is never overwritten by the previous one
+func (lbp *Provider) healDrift() (*provider.ConfigDrift, error) {
+	lbp.applied.mu.Lock()
+	defer lbp.applied.mu.Unlock()
+	drift, err := lbp.checkDriftLocked()
+	if err != nil || drift == nil {
+		return nil, err
+	}
+	entry := logrus.WithFields(logrus.Fields{
+		"event":    provider.EventConfigDrift,
+		"config":   drift.ConfigName,
+		"path":     drift.Path,
+		"expected": drift.Expected,
+		"actual":   drift.Actual,
+	})
+	if drift.Actual == "" {
+		entry.Warn("Config was removed outside the controller, reapplying it")
+	} else {
+		entry.Warn("Config was modified outside the controller, reapplying it")
+	}
+	return drift, lbp.applyLocked(lbp.applied.config)
+}
+
+// watchDrift heals the drift of the configs every interval until the provider stops
+func (lbp *Provider) watchDrift(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lbp.stopCh:
+			return
+		case <-ticker.C:
+			if _, err := lbp.healDrift(); err != nil {
+				logrus.Errorf("Failed to heal the config drift: %v", err)
+			}
+		}
+	}
+}
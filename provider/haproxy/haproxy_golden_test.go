@@ -0,0 +1,25 @@
+package haproxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/internal/golden"
+)
+
+func renderConfig(lbConfig *config.LoadBalancerConfig) ([]byte, error) {
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func TestGoldenConfigs(t *testing.T) {
+	golden.Run(t, "test_data/golden", &lbp, renderConfig)
+}
+
+func TestGoldenConfigsDeterministic(t *testing.T) {
+	golden.RunDeterministic(t, "test_data/golden", &lbp, renderConfig)
+}
@@ -0,0 +1,286 @@
+package haproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	mapsDir = "/etc/haproxy/maps"
+	// adminSocket is the runtime api socket the host maps are updated
+	// through, it is only added to the configs routing with maps
+	adminSocket = "/var/run/haproxy_admin.sock"
+)
+
+var hostMapThreshold = flags.Int("HOST_MAP_THRESHOLD", 100, "Number of exact hostname rules of a frontend from which they are routed with a map file instead of acls, 0 disables the host maps").Range(0, 1000000)
+
+/*
+hostMap routes the exact hostname rules of a frontend with a map file of
+the hostnames, with and without the port, to their backends. The map is
+looked up where the first of its rules is, the rules are mapped only when
+no rule in between matches their hostname, so the routing is unchanged:
+
+	use_backend %[req.hdr(host),lower,map_str(/etc/haproxy/maps/80.map)] if { req.hdr(host),lower,map_str(/etc/haproxy/maps/80.map) -m found }
+*/
+type hostMap struct {
+	File string
+	// Rules are the indexes of the mapped backends in the frontend
+	Rules []int
+	// Entries are the backend names by hostname
+	Entries map[string]string
+}
+
+/*
+getHostMaps returns the host maps of the http frontends having at least
+threshold mappable rules, by frontend name. The maps are disabled when
+there is no dir or no threshold
+*/
+func getHostMaps(frontends []*config.FrontendService, threshold int, dir string) map[string]*hostMap {
+	maps := map[string]*hostMap{}
+	if threshold <= 0 || dir == "" {
+		return maps
+	}
+	for _, fe := range frontends {
+		if fe.Protocol != config.HTTPProto && fe.Protocol != config.HTTPSProto {
+			continue
+		}
+		m := &hostMap{
+			File:    path.Join(dir, sanitizeFileName(fe.Name)+".map"),
+			Entries: map[string]string{},
+		}
+		// the rules after the first mapped one that aren't mapped
+		var between []*config.BackendService
+		for i, be := range fe.BackendServices {
+			host := strings.ToLower(be.Host)
+			if !isMappable(be) || m.Entries[host] != "" || matchesAny(between, host) {
+				if len(m.Rules) > 0 && (be.Host != "" || be.Path != "") {
+					between = append(between, be)
+				}
+				continue
+			}
+			m.Rules = append(m.Rules, i)
+			m.Entries[host] = be.UUID
+			m.Entries[fmt.Sprintf("%s:%d", host, fe.Port)] = be.UUID
+		}
+		if len(m.Rules) >= threshold {
+			maps[fe.Name] = m
+		}
+	}
+	return maps
+}
+
+// isMappable tells whether the rule only matches an exact hostname
+func isMappable(be *config.BackendService) bool {
+	return be.Host != "" && be.Path == "" && be.RuleComparator == config.EqRuleComparator &&
+		!strings.ContainsAny(be.Host, "* \t;#")
+}
+
+// matchesAny tells whether any of the rules may match the hostname
+func matchesAny(rules []*config.BackendService, host string) bool {
+	for _, be := range rules {
+		ruleHost := strings.ToLower(be.Host)
+		switch {
+		case ruleHost == "":
+			return true
+		case be.RuleComparator == config.EqRuleComparator && ruleHost == host:
+			return true
+		case be.RuleComparator == config.BegRuleComparator && strings.HasPrefix(host, ruleHost):
+			return true
+		case be.RuleComparator == config.EndRuleComparator && strings.HasSuffix(host, ruleHost):
+			return true
+		}
+	}
+	return false
+}
+
+// hostMapsDir is the dir of the host maps of the instance,
+// empty disables the host maps
+func (cfg *haproxyConfig) hostMapsDir(portOffset int) string {
+	return instanceDir(cfg.MapsDir, portOffset)
+}
+
+// instanceDir is the dir of the files of the instance, the shadow
+// instance has its own so it doesn't change the files of the main one
+func instanceDir(dir string, portOffset int) string {
+	if dir == "" || portOffset == 0 {
+		return dir
+	}
+	return path.Join(dir, "shadow")
+}
+
+// adminSocketSetting is the global setting of the admin socket
+// the host maps are updated through, empty without admin socket
+func (cfg *haproxyConfig) adminSocketSetting(portOffset int) string {
+	if cfg.AdminSocket == "" {
+		return ""
+	}
+	socket := cfg.AdminSocket
+	if socketNetwork(socket) == "tcp" {
+		return fmt.Sprintf("stats socket %s level admin", socket)
+	}
+	if portOffset > 0 {
+		socket += ".shadow"
+	}
+	return fmt.Sprintf("stats socket %s mode 600 level admin", socket)
+}
+
+// hostMapsUpdate is the change of the host maps written with a config
+type hostMapsUpdate struct {
+	// previous are the entries of the replaced map files by file
+	previous map[string]map[string]string
+	maps     map[string]*hostMap
+}
+
+func (u *hostMapsUpdate) changed() bool {
+	if len(u.previous) != len(u.maps) {
+		return true
+	}
+	for _, m := range u.maps {
+		old, ok := u.previous[m.File]
+		if !ok || len(old) != len(m.Entries) {
+			return true
+		}
+		for host, backend := range m.Entries {
+			if old[host] != backend {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configChanged tells whether the written config differs from the
+// running one, the reload loads the host maps along with it
+func (cfg *haproxyConfig) configChanged() bool {
+	if cfg.LiveConfig == "" {
+		return true
+	}
+	written, err := ioutil.ReadFile(cfg.Config)
+	if err != nil {
+		return true
+	}
+	live, err := ioutil.ReadFile(cfg.LiveConfig)
+	return err != nil || !bytes.Equal(written, live)
+}
+
+/*
+writeHostMaps writes the map files to the dir and removes the ones no
+longer used, the entries of the previous files are returned by file
+*/
+func writeHostMaps(dir string, maps map[string]*hostMap) (map[string]map[string]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[string]map[string]string{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".map") {
+			continue
+		}
+		file := path.Join(dir, f.Name())
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		previous[file] = parseHostMap(b)
+	}
+	written := map[string]bool{}
+	for _, m := range maps {
+		if err := ioutil.WriteFile(m.File, renderHostMap(m.Entries), 0644); err != nil {
+			return nil, err
+		}
+		written[m.File] = true
+	}
+	for file := range previous {
+		if !written[file] {
+			if err := os.Remove(file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return previous, nil
+}
+
+func renderHostMap(entries map[string]string) []byte {
+	hosts := make([]string, 0, len(entries))
+	for host := range entries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var b bytes.Buffer
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "%s %s\n", host, entries[host])
+	}
+	return b.Bytes()
+}
+
+func parseHostMap(b []byte) map[string]string {
+	entries := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			entries[fields[0]] = fields[1]
+		}
+	}
+	return entries
+}
+
+/*
+updateHostMaps applies the changes of the host maps to the running
+haproxy through the admin socket. The maps a config starts or stops
+using change the config, they are loaded by its reload
+*/
+func (cfg *haproxyConfig) updateHostMaps(previous map[string]map[string]string, maps map[string]*hostMap) error {
+	var cmds []string
+	for _, m := range maps {
+		old, ok := previous[m.File]
+		if !ok {
+			continue
+		}
+		for host, backend := range m.Entries {
+			if oldBackend, ok := old[host]; !ok {
+				cmds = append(cmds, fmt.Sprintf("add map %s %s %s", m.File, host, backend))
+			} else if oldBackend != backend {
+				cmds = append(cmds, fmt.Sprintf("set map %s %s %s", m.File, host, backend))
+			}
+		}
+		for host := range old {
+			if _, ok := m.Entries[host]; !ok {
+				cmds = append(cmds, fmt.Sprintf("del map %s %s", m.File, host))
+			}
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if cfg.AdminSocket == "" {
+		return fmt.Errorf("no admin socket")
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		output, err := runtimeCommand(cfg.AdminSocket, cmd)
+		if err != nil {
+			return err
+		}
+		if output = strings.TrimSpace(output); output != "" {
+			return fmt.Errorf("%s failed: %s", cmd, output)
+		}
+	}
+	logrus.Infof("Updated the host maps with %v change(s) without reload", len(cmds))
+	return nil
+}
@@ -0,0 +1,191 @@
+//go:build integration
+// +build integration
+
+package haproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/lb-controller/internal/golden"
+)
+
+/*
+The integration tests run haproxy in docker with the configs rendered from
+the fixtures of test_data/integration, and check the routing of the
+requests listed in the fixtures. They run with scripts/integration:
+
+	INTEGRATION_IMAGE=rancher/lb-service-haproxy:dev go test -tags integration ./provider/haproxy/
+
+The containers of the fixture services run on 127.0.0.1, every service is
+served by the test on the target port of its rules, answering its name.
+Haproxy joins the network of INTEGRATION_DOCKER_NETWORK, host by default,
+so it reaches the test
+*/
+
+// integrationFixture is a golden fixture with the requests to check
+type integrationFixture struct {
+	golden.Fixture
+	Requests []integrationRequest `json:"requests"`
+}
+
+type integrationRequest struct {
+	Port int    `json:"port"`
+	Host string `json:"host"`
+	Path string `json:"path"`
+	// Service is the name of the service expected to answer,
+	// none expects Status from haproxy
+	Service string `json:"service"`
+	Status  int    `json:"status"`
+}
+
+func TestIntegrationRouting(t *testing.T) {
+	image := os.Getenv("INTEGRATION_IMAGE")
+	if image == "" {
+		t.Skip("INTEGRATION_IMAGE is not set")
+	}
+	network := os.Getenv("INTEGRATION_DOCKER_NETWORK")
+	if network == "" {
+		network = "host"
+	}
+	fixtures, err := filepath.Glob("test_data/integration/*.json")
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("No fixtures found in test_data/integration: %v", err)
+	}
+	for _, path := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			runIntegrationFixture(t, path, image, network)
+		})
+	}
+}
+
+func runIntegrationFixture(t *testing.T, path string, image string, network string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := &integrationFixture{}
+	if err := json.Unmarshal(b, fixture); err != nil {
+		t.Fatalf("Failed to parse fixture %s: %v", path, err)
+	}
+
+	for _, addr := range serviceAddresses(fixture) {
+		stop, err := serveService(addr.port, addr.service)
+		if err != nil {
+			t.Fatalf("Failed to serve service %s: %v", addr.service, err)
+		}
+		defer stop()
+	}
+
+	cfgs, err := golden.BuildConfigs(&fixture.Fixture, &lbp)
+	if err != nil || len(cfgs) != 1 {
+		t.Fatalf("Failed to build the lb config: %v", err)
+	}
+	var rendered bytes.Buffer
+	if err := lbp.cfg.renderTo(&rendered, cfgs[0], 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Failed to render the haproxy config: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "haproxy-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "haproxy.cfg"), rendered.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// -db keeps haproxy in the foreground, the config sets daemon
+	output, err := exec.Command("docker", "run", "-d", "--network", network,
+		"-v", dir+":/etc/haproxy/integration:ro", "--entrypoint", "haproxy",
+		image, "-db", "-f", "/etc/haproxy/integration/haproxy.cfg").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to start haproxy: %v -- %s", err, output)
+	}
+	container := strings.TrimSpace(string(output))
+	defer func() {
+		if t.Failed() {
+			logs, _ := exec.Command("docker", "logs", container).CombinedOutput()
+			t.Logf("haproxy logs:\n%s\nconfig:\n%s", logs, rendered.String())
+		}
+		exec.Command("docker", "rm", "-f", container).Run()
+	}()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, req := range fixture.Requests {
+		status, body, err := doIntegrationRequest(client, req)
+		if err != nil {
+			t.Errorf("Request %+v failed: %v", req, err)
+			continue
+		}
+		if req.Service != "" && (status != http.StatusOK || body != req.Service) {
+			t.Errorf("Request %+v should be served by %s, got %v %q", req, req.Service, status, body)
+		}
+		if req.Service == "" && status != req.Status {
+			t.Errorf("Request %+v should get status %v, got %v %q", req, req.Status, status, body)
+		}
+	}
+}
+
+// doIntegrationRequest sends the request, retrying while haproxy starts
+func doIntegrationRequest(client *http.Client, req integrationRequest) (int, string, error) {
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", req.Port, req.Path)
+	var err error
+	for i := 0; i < 20; i++ {
+		var httpReq *http.Request
+		if httpReq, err = http.NewRequest("GET", url, nil); err != nil {
+			return 0, "", err
+		}
+		httpReq.Host = req.Host
+		var resp *http.Response
+		if resp, err = client.Do(httpReq); err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return resp.StatusCode, string(body), nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return 0, "", err
+}
+
+type serviceAddress struct {
+	service string
+	port    int
+}
+
+// serviceAddresses are the target ports of the services of the port rules
+func serviceAddresses(fixture *integrationFixture) []serviceAddress {
+	seen := map[serviceAddress]bool{}
+	addrs := []serviceAddress{}
+	for _, rule := range fixture.LBService.LBConfig.PortRules {
+		parts := strings.SplitN(rule.Service, "/", 2)
+		addr := serviceAddress{service: parts[len(parts)-1], port: rule.TargetPort}
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func serveService(port int, name string) (func(), error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	})}
+	go server.Serve(listener)
+	return func() { listener.Close() }, nil
+}
@@ -0,0 +1,46 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var luaScriptsDir = flags.String("LUA_SCRIPTS_DIR", "/etc/haproxy/lua", "Dir of the operator provided lua scripts the frontends and the backends can run")
+
+/*
+getLuaLoads returns the lua-load settings of the scripts the frontends
+and the backends run, in the order they are first used. A missing script
+fails the config, rather than running the frontend or the backend
+without its hook
+*/
+func (cfg *haproxyConfig) getLuaLoads(frontends []*config.FrontendService, backends []*config.BackendService) ([]string, error) {
+	var hooks []*config.LuaHook
+	for _, fe := range frontends {
+		hooks = append(hooks, fe.LuaHooks...)
+	}
+	for _, be := range backends {
+		hooks = append(hooks, be.LuaHooks...)
+	}
+	var loads []string
+	seen := map[string]bool{}
+	for _, hook := range hooks {
+		if seen[hook.Script] {
+			continue
+		}
+		seen[hook.Script] = true
+		if cfg.LuaDir == "" {
+			return nil, fmt.Errorf("No lua scripts dir to load %s from", hook.Script)
+		}
+		file := path.Join(cfg.LuaDir, hook.Script)
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("Lua script %s is missing from %s: %v", hook.Script, cfg.LuaDir, err)
+		}
+		loads = append(loads, "lua-load "+strings.Replace(file, " ", "\\ ", -1))
+	}
+	return loads, nil
+}
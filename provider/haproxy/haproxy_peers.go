@@ -0,0 +1,117 @@
+package haproxy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const peersSection = "rancher"
+
+var peersPort = flags.Int("PEERS_PORT", 0, "Port of the haproxy peers the stick-tables are synced through on reload and between the lb instances, 0 disables the peers").Range(0, 65535)
+
+// setPeers configures the local peer, haproxy process started on reload
+// pulls stick-table entries from the old one through it, so session
+// persistence and rate limit counters survive the reload. Haproxy picks
+// the local peer by the host name. The peers are opt-in: PEERS_PORT
+// enables them, the remote peers use it as well
+func setPeers(cfg *haproxyConfig) {
+	port := peersPort.Get()
+	if port == 0 {
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Warnf("Stick-tables won't be kept on reload, failed to get host name: %v", err)
+		return
+	}
+	cfg.PeerName = hostname
+	cfg.PeersPort = port
+}
+
+type peerAddress struct {
+	Name    string
+	Address string
+}
+
+// getPeers returns the local peer, and the other lb instances when the
+// lb runs on multiple hosts. Local peer listens on the loopback unless
+// it is found among the instances, remote peers connect to its ip then
+func (cfg *haproxyConfig) getPeers(peers []*config.Peer, portOffset int) []peerAddress {
+	port := cfg.PeersPort + portOffset
+	local := false
+	for _, p := range peers {
+		if strings.EqualFold(p.Name, cfg.PeerName) {
+			local = true
+			break
+		}
+	}
+	if !local {
+		if len(peers) > 0 {
+			logrus.Warnf("Local peer %s is not an lb instance, stick-tables won't be replicated", cfg.PeerName)
+		}
+		return []peerAddress{{Name: cfg.PeerName, Address: fmt.Sprintf("127.0.0.1:%d", port)}}
+	}
+	addresses := []peerAddress{}
+	for _, p := range peers {
+		name := p.Name
+		if strings.EqualFold(name, cfg.PeerName) {
+			// local peer name has to match the host name exactly
+			name = cfg.PeerName
+		}
+		addresses = append(addresses, peerAddress{Name: name, Address: fmt.Sprintf("%s:%d", p.IP, port)})
+	}
+	return addresses
+}
+
+// addStickTablePeers makes the stick-tables of the custom config
+// use the peers section, unless they are given their own peers. The
+// peers go before the trailing comment of the line, if any
+func addStickTablePeers(cfg string) string {
+	lines := strings.Split(cfg, "\n")
+	for i, line := range lines {
+		setting, comment := splitComment(line)
+		fields := strings.Fields(setting)
+		if len(fields) == 0 || fields[0] != "stick-table" {
+			continue
+		}
+		hasPeers := false
+		for _, f := range fields {
+			if f == "peers" {
+				hasPeers = true
+				break
+			}
+		}
+		if !hasPeers {
+			lines[i] = fmt.Sprintf("%s peers %s", strings.TrimRight(setting, " \t"), peersSection)
+			if comment != "" {
+				lines[i] += " " + comment
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// splitComment splits the line at the first unquoted and unescaped #
+func splitComment(line string) (string, string) {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i], line[i:]
+		}
+	}
+	return line, ""
+}
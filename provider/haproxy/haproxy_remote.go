@@ -0,0 +1,143 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+// supported remote modes
+const (
+	// RemoteVolume shares the configs with the external haproxy through
+	// a volume, it is reloaded through its master cli
+	RemoteVolume = "volume"
+	// RemoteSSH copies the configs to the external haproxy node over
+	// ssh, it is reloaded by the reload command run there
+	RemoteSSH = "ssh"
+)
+
+var (
+	remoteMode      = flags.String("HAPROXY_REMOTE", "", "Drive an external haproxy instead of the colocated one: volume shares the configs with it through a volume, ssh copies them to its node")
+	remoteDir       = flags.String("HAPROXY_REMOTE_DIR", "/etc/haproxy/lb", "Dir of the configs, the certs and the maps of the external haproxy, at the same path on the controller and on the haproxy node. The haproxy runs haproxy.cfg of the dir")
+	remoteHost      = flags.String("HAPROXY_REMOTE_HOST", "", "ssh destination of the external haproxy node, as user@host, in ssh mode")
+	remoteReloadCmd = flags.String("HAPROXY_REMOTE_RELOAD_CMD", "systemctl reload haproxy", "Command reloading the external haproxy, run on its node in ssh mode")
+	remoteMaster    = flags.String("HAPROXY_REMOTE_MASTER", "", "host:port of the master cli of the external haproxy, it is reloaded through it in volume mode")
+	remoteRuntime   = flags.String("HAPROXY_REMOTE_RUNTIME", "", "host:port the external haproxy serves its admin runtime api on, the stats, the host maps and the certs go through it. The stats and the updates without reload are off when not set")
+)
+
+/*
+remoteConfig drives an haproxy the controller doesn't run, on a node
+of its own. The configs are rendered into the remote dir as for the
+colocated haproxy, then the reload script shares or copies them to the
+node and reloads it. The runtime api is reached over tcp, the haproxy
+binds it from the rendered config. The features setting up the local
+node, as the transparent backends and the connection logs, are off
+*/
+type remoteConfig struct {
+	Mode string
+	Dir  string
+	// Target is the ssh destination in ssh mode, the
+	// master cli address in volume mode
+	Target    string
+	ReloadCmd string
+	// Runtime is the address of the runtime api, empty without
+	Runtime string
+}
+
+func newRemoteConfig() (*remoteConfig, error) {
+	mode := remoteMode.Get()
+	if mode == "" {
+		return nil, nil
+	}
+	remote := &remoteConfig{
+		Mode:      mode,
+		Dir:       remoteDir.Get(),
+		ReloadCmd: remoteReloadCmd.Get(),
+		Runtime:   remoteRuntime.Get(),
+	}
+	switch mode {
+	case RemoteSSH:
+		remote.Target = remoteHost.Get()
+		if remote.Target == "" {
+			return nil, fmt.Errorf("HAPROXY_REMOTE_HOST is required in %s mode", mode)
+		}
+	case RemoteVolume:
+		remote.Target = remoteMaster.Get()
+		if _, _, err := net.SplitHostPort(remote.Target); err != nil {
+			return nil, fmt.Errorf("Invalid HAPROXY_REMOTE_MASTER %q, the master cli address is required in %s mode", remote.Target, mode)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid HAPROXY_REMOTE mode %s, supported modes are %s and %s", mode, RemoteVolume, RemoteSSH)
+	}
+	if !path.IsAbs(remote.Dir) {
+		return nil, fmt.Errorf("Invalid HAPROXY_REMOTE_DIR %s, the dir must be absolute", remote.Dir)
+	}
+	if remote.Runtime != "" {
+		if _, _, err := net.SplitHostPort(remote.Runtime); err != nil {
+			return nil, fmt.Errorf("Invalid HAPROXY_REMOTE_RUNTIME %s: %v", remote.Runtime, err)
+		}
+	}
+	return remote, nil
+}
+
+// reloadCmd is the reload script command, the action is reload or force
+func (r *remoteConfig) reloadCmd(action string) string {
+	return strings.Join([]string{
+		"haproxy_remote_reload",
+		shellQuote(r.Dir),
+		r.Mode,
+		shellQuote(r.Target),
+		shellQuote(r.ReloadCmd),
+		action,
+	}, " ")
+}
+
+// versionCmd prints the version of the external haproxy, empty
+// when it can't be run from the controller
+func (r *remoteConfig) versionCmd() string {
+	if r.Mode != RemoteSSH {
+		return ""
+	}
+	return fmt.Sprintf("ssh %s haproxy -v", shellQuote(r.Target))
+}
+
+// apply points the config at the remote dir and the remote runtime api
+func (r *remoteConfig) apply(cfg *haproxyConfig) {
+	cfg.Config = path.Join(r.Dir, "haproxy_new.cfg")
+	cfg.LiveConfig = path.Join(r.Dir, "haproxy.cfg")
+	cfg.CertDir = path.Join(r.Dir, "certs")
+	cfg.MapsDir = path.Join(r.Dir, "maps")
+	cfg.SPOEDir = path.Join(r.Dir, "spoe")
+	if cfg.TicketKeys != nil {
+		cfg.TicketKeys.Dir = path.Join(r.Dir, "tickets")
+	}
+	cfg.ReloadCmd = r.reloadCmd("reload")
+	cfg.ForceReloadCmd = r.reloadCmd("force")
+	// the external haproxy is already running, the first
+	// config is applied to it as a reload
+	cfg.StartCmd = r.reloadCmd("force")
+	cfg.StatsSocket = r.Runtime
+	cfg.AdminSocket = r.Runtime
+	cfg.TProxyCmd = ""
+	cfg.TCPLogAddress = ""
+	cfg.Remote = r
+	if cfg.Capabilities != nil && cfg.Capabilities.Override == "" {
+		cfg.Capabilities.VersionCmd = r.versionCmd()
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// socketNetwork is the network of the runtime api address, the
+// paths are unix sockets and the host:port addresses tcp
+func socketNetwork(socket string) string {
+	if strings.HasPrefix(socket, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
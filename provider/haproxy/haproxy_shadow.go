@@ -0,0 +1,150 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+	"github.com/rancher/lb-controller/provider/ipvs"
+)
+
+var (
+	shadowApply      = flags.String("SHADOW_APPLY", "", "Shadow apply mode, validate renders and checks every config before it is applied, run also loads it into a secondary haproxy on the shifted ports until it is promoted")
+	shadowPortOffset = flags.Int("SHADOW_PORT_OFFSET", 10000, "Offset of the ports the shadow haproxy instance listens on").Range(1, 65535)
+)
+
+//supported shadow apply modes
+const (
+	// ShadowValidate renders and validates every config before
+	// applying it to the main haproxy instance
+	ShadowValidate = "validate"
+	// ShadowRun in addition loads the config into a secondary haproxy
+	// instance listening on the shifted ports, and holds it there
+	// until it gets promoted
+	ShadowRun = "run"
+)
+
+type shadowConfig struct {
+	Mode       string
+	PortOffset int
+	Config     string
+	CertDir    string
+	CheckCmd   string
+	ReloadCmd  string
+
+	mu      *sync.Mutex
+	pending *config.LoadBalancerConfig
+	// pendingServices are the IPVS virtual services of the
+	// pending config, programmed once it is promoted
+	pendingServices map[string]*ipvs.VirtualService
+}
+
+func newShadowConfig() (*shadowConfig, error) {
+	mode := shadowApply.Get()
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != ShadowValidate && mode != ShadowRun {
+		return nil, fmt.Errorf("Invalid SHADOW_APPLY mode %s, supported modes are %s and %s", mode, ShadowValidate, ShadowRun)
+	}
+	return &shadowConfig{
+		Mode:       mode,
+		PortOffset: shadowPortOffset.Get(),
+		Config:     "/etc/haproxy/haproxy_shadow.cfg",
+		CertDir:    "/etc/haproxy/certs/shadow",
+		CheckCmd:   "haproxy -c -f /etc/haproxy/haproxy_shadow.cfg",
+		ReloadCmd:  "haproxy_shadow /etc/haproxy/haproxy_shadow.cfg",
+		mu:         &sync.Mutex{},
+	}, nil
+}
+
+func runCmd(cmd string) error {
+	output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v -- %v", err, string(output))
+	}
+	return nil
+}
+
+func (lbp *Provider) shadowApply(lbConfig *config.LoadBalancerConfig, services map[string]*ipvs.VirtualService) error {
+	shadow := lbp.shadow
+	shadow.mu.Lock()
+	defer shadow.mu.Unlock()
+
+	if err := ensureDir(shadow.CertDir); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(shadow.CertDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(path.Join(shadow.CertDir, f.Name())); err != nil {
+			return err
+		}
+	}
+	if err := writeCertificates(shadow.CertDir, shadow.CertDir, lbConfig); err != nil {
+		return err
+	}
+	cfg := *lbp.cfg
+	cfg.TicketKeys = lbp.cfg.TicketKeys.forShadow()
+	rendered, _, err := cfg.renderFiles(shadow.Config, lbConfig, shadow.PortOffset, shadow.CertDir)
+	if err != nil {
+		return err
+	}
+	if err := cfg.TicketKeys.write(lbConfig.Name, rendered.ticketKeys, time.Now()); err != nil {
+		return err
+	}
+	if err := runCmd(shadow.CheckCmd); err != nil {
+		return fmt.Errorf("Shadow config for lb [%s] is invalid: %v", lbConfig.Name, err)
+	}
+
+	if shadow.Mode == ShadowValidate {
+		logrus.Debugf("Shadow config for lb [%s] is valid, applying", lbConfig.Name)
+		if err := lbp.applyHaproxyConfig(lbConfig); err != nil {
+			return err
+		}
+		return lbp.programFastPath(services)
+	}
+
+	if err := runCmd(shadow.ReloadCmd); err != nil {
+		return fmt.Errorf("Failed to load shadow config for lb [%s]: %v", lbConfig.Name, err)
+	}
+	shadow.pending = lbConfig
+	shadow.pendingServices = services
+	logrus.Infof("Shadow config for lb [%s] is loaded on ports shifted by %v, waiting for promotion", lbConfig.Name, shadow.PortOffset)
+	return provider.ErrPendingPromotion
+}
+
+// PromoteShadowConfig applies the config loaded into the shadow
+// instance to the main haproxy instance, the config is returned
+// along with the error of its apply
+func (lbp *Provider) PromoteShadowConfig() (*config.LoadBalancerConfig, error) {
+	if lbp.shadow == nil || lbp.shadow.Mode != ShadowRun {
+		return nil, fmt.Errorf("Shadow apply is not running")
+	}
+	lbp.shadow.mu.Lock()
+	defer lbp.shadow.mu.Unlock()
+	pending := lbp.shadow.pending
+	if pending == nil {
+		return nil, fmt.Errorf("No pending shadow config to promote")
+	}
+	logrus.Infof("Promoting shadow config for lb [%s]", pending.Name)
+	if err := lbp.applyHaproxyConfig(pending); err != nil {
+		return pending, err
+	}
+	lbp.shadow.pending = nil
+	if err := lbp.programFastPath(lbp.shadow.pendingServices); err != nil {
+		return pending, err
+	}
+	lbp.shadow.pendingServices = nil
+	return pending, nil
+}
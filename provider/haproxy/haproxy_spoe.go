@@ -0,0 +1,130 @@
+package haproxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+const (
+	spoeDir = "/etc/haproxy/spoe"
+	// spoeTimeoutMs is the processing timeout of the engines not setting it
+	spoeTimeoutMs = 500
+)
+
+// spoeConfigsDir is the dir of the spoe configs of the instance,
+// empty disables the spoe engines
+func (cfg *haproxyConfig) spoeConfigsDir(portOffset int) string {
+	return instanceDir(cfg.SPOEDir, portOffset)
+}
+
+// spoeBackend is the backend of the agents of the engine
+func spoeBackend(engine string) string {
+	return "spoe_" + engine
+}
+
+/*
+getSPOEConfigs renders the spoe configs of the engines filtering the
+frontends, by file. The files are named after their content, so the
+haproxy config changes along with them and gets reloaded:
+
+	[auth]
+	spoe-agent auth-agent
+	    messages check-request
+	    option var-prefix auth
+	    timeout hello 2s
+	    timeout idle 30s
+	    timeout processing 500ms
+	    use-backend spoe_auth
+
+	spoe-message check-request
+	    args ip=src path=path
+	    event on-frontend-http-request
+*/
+func getSPOEConfigs(engines []*config.SPOEngine, frontends []*config.FrontendService, dir string) ([]*config.SPOEngine, map[string]string, map[string]string) {
+	if dir == "" {
+		return nil, nil, nil
+	}
+	used := map[string]bool{}
+	for _, fe := range frontends {
+		for _, name := range fe.SPOEngines {
+			used[name] = true
+		}
+	}
+	var rendered []*config.SPOEngine
+	engineFiles := map[string]string{}
+	configs := map[string]string{}
+	for _, engine := range engines {
+		if !used[engine.Name] || len(engine.Agents) == 0 || len(engine.Messages) == 0 {
+			continue
+		}
+		timeout := engine.TimeoutMs
+		if timeout <= 0 {
+			timeout = spoeTimeoutMs
+		}
+		var b bytes.Buffer
+		var messages []string
+		for _, message := range engine.Messages {
+			messages = append(messages, message.Name)
+		}
+		fmt.Fprintf(&b, "[%s]\nspoe-agent %s-agent\n", engine.Name, engine.Name)
+		fmt.Fprintf(&b, "    messages %s\n", strings.Join(messages, " "))
+		fmt.Fprintf(&b, "    option var-prefix %s\n", engine.Name)
+		fmt.Fprintf(&b, "    timeout hello 2s\n    timeout idle 30s\n    timeout processing %dms\n", timeout)
+		fmt.Fprintf(&b, "    use-backend %s\n", spoeBackend(engine.Name))
+		for _, message := range engine.Messages {
+			fmt.Fprintf(&b, "\nspoe-message %s\n", message.Name)
+			if len(message.Args) > 0 {
+				fmt.Fprintf(&b, "    args %s\n", strings.Join(message.Args, " "))
+			}
+			fmt.Fprintf(&b, "    event %s\n", message.Event)
+		}
+		sum := sha1.Sum(b.Bytes())
+		file := path.Join(dir, fmt.Sprintf("%s-%x.conf", sanitizeFileName(engine.Name), sum[:4]))
+		configs[file] = b.String()
+		engineFiles[engine.Name] = file
+		rendered = append(rendered, engine)
+	}
+	return rendered, engineFiles, configs
+}
+
+// writeSPOEConfigs writes the spoe configs to the dir
+// and removes the ones no longer used
+func writeSPOEConfigs(dir string, configs map[string]string) error {
+	if dir == "" {
+		return nil
+	}
+	if len(configs) == 0 {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for file, content := range configs {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		file := path.Join(dir, f.Name())
+		if _, ok := configs[file]; ok || f.IsDir() || !strings.HasSuffix(f.Name(), ".conf") {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package haproxy
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/provider"
+)
+
+const statsSocket = "/var/run/haproxy_stats.sock"
+
+// metricsTags are the metrics tags of the backends by haproxy backend name
+type metricsTags struct {
+	mu   sync.RWMutex
+	tags map[string]string
+}
+
+// set replaces the tags with the ones of the backends of the config
+func (t *metricsTags) set(lbConfig *config.LoadBalancerConfig) {
+	tags := map[string]string{}
+	for _, fe := range lbConfig.FrontendServices {
+		for _, be := range fe.BackendServices {
+			if be.MetricsTag != "" {
+				tags[be.UUID] = be.MetricsTag
+			}
+		}
+	}
+	t.mu.Lock()
+	t.tags = tags
+	t.mu.Unlock()
+}
+
+func (t *metricsTags) get(backend string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tags[backend]
+}
+
+func (lbc *Provider) GetBackendStats() ([]provider.BackendStats, error) {
+	output, err := lbc.showStat()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseBackendStats(output)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		stats[i].Tag = lbc.tags.get(stats[i].Name)
+	}
+	return stats, nil
+}
+
+func (lbc *Provider) GetEndpointStatus() ([]provider.EndpointStatus, error) {
+	output, err := lbc.showStat()
+	if err != nil {
+		return nil, err
+	}
+	return parseEndpointStatus(output)
+}
+
+// EnableStats adds the stats socket to the configs
+func (lbc *Provider) EnableStats() {
+	if lbc.cfg.StatsSocket == "" {
+		lbc.cfg.StatsSocket = statsSocket
+	}
+}
+
+// statsSocketSetting is the global setting of the stats socket, the
+// shadow instance has its own so it doesn't take over the main one.
+// It's empty when the stats are read through the admin socket
+func (cfg *haproxyConfig) statsSocketSetting(portOffset int) string {
+	if cfg.StatsSocket == "" || cfg.StatsSocket == cfg.AdminSocket {
+		return ""
+	}
+	socket := cfg.StatsSocket
+	if portOffset > 0 {
+		socket += ".shadow"
+	}
+	return fmt.Sprintf("stats socket %s mode 600 level user", socket)
+}
+
+func (lbc *Provider) showStat() (string, error) {
+	if lbc.cfg.StatsSocket == "" {
+		return "", fmt.Errorf("haproxy stats are not enabled")
+	}
+	return runtimeCommand(lbc.cfg.StatsSocket, "show stat")
+}
+
+// runtimeCommand runs the command on the haproxy runtime api socket
+func runtimeCommand(socket string, cmd string) (string, error) {
+	conn, err := net.DialTimeout(socketNetwork(socket), socket, 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("Failed to connect to haproxy socket %s: %v", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, cmd+"\n"); err != nil {
+		return "", err
+	}
+	output, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// statsTable is the "show stat" csv output, with its fields by name
+type statsTable struct {
+	header  map[string]int
+	records [][]string
+}
+
+func parseStats(output string, required ...string) (*statsTable, error) {
+	output = strings.TrimPrefix(strings.TrimSpace(output), "# ")
+	if output == "" {
+		return nil, nil
+	}
+	r := csv.NewReader(strings.NewReader(output))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse haproxy stats: %v", err)
+	}
+	header := map[string]int{}
+	for i, name := range records[0] {
+		header[name] = i
+	}
+	for _, name := range required {
+		if _, ok := header[name]; !ok {
+			return nil, fmt.Errorf("Haproxy stats are missing %s field", name)
+		}
+	}
+	return &statsTable{header: header, records: records[1:]}, nil
+}
+
+func (s *statsTable) field(record []string, name string) string {
+	if i, ok := s.header[name]; ok && i < len(record) {
+		return record[i]
+	}
+	return ""
+}
+
+func (s *statsTable) intField(record []string, name string) int {
+	// empty fields are not applicable to the row
+	v, _ := strconv.Atoi(s.field(record, name))
+	return v
+}
+
+// parseBackendStats reads BACKEND rows of the "show stat" csv output
+func parseBackendStats(output string) ([]provider.BackendStats, error) {
+	table, err := parseStats(output, "pxname", "svname", "qcur", "qmax", "qtime", "scur")
+	if table == nil || err != nil {
+		return nil, err
+	}
+	var stats []provider.BackendStats
+	for _, record := range table.records {
+		if table.field(record, "svname") != "BACKEND" {
+			continue
+		}
+		stats = append(stats, provider.BackendStats{
+			Name:         table.field(record, "pxname"),
+			QueueCurrent: table.intField(record, "qcur"),
+			QueueMax:     table.intField(record, "qmax"),
+			QueueTime:    table.intField(record, "qtime"),
+			Sessions:     table.intField(record, "scur"),
+			Rate:         table.intField(record, "rate"),
+		})
+	}
+	return stats, nil
+}
+
+// parseEndpointStatus reads the server rows of the "show stat" csv output.
+// Servers going down or up are reported at their current status, as
+// "UP 1/3" or "DOWN 1/2"
+func parseEndpointStatus(output string) ([]provider.EndpointStatus, error) {
+	table, err := parseStats(output, "pxname", "svname", "status")
+	if table == nil || err != nil {
+		return nil, err
+	}
+	var status []provider.EndpointStatus
+	for _, record := range table.records {
+		svname := table.field(record, "svname")
+		if svname == "FRONTEND" || svname == "BACKEND" {
+			continue
+		}
+		var state string
+		switch s := table.field(record, "status"); {
+		case strings.HasPrefix(s, "UP"), s == "no check", s == "NOLB":
+			state = provider.EndpointUp
+		case strings.HasPrefix(s, "DOWN"), strings.HasPrefix(s, "MAINT"):
+			state = provider.EndpointDown
+		case s == "DRAIN":
+			state = provider.EndpointDrained
+		default:
+			continue
+		}
+		status = append(status, provider.EndpointStatus{
+			Backend: table.field(record, "pxname"),
+			Server:  svname,
+			Status:  state,
+		})
+	}
+	return status, nil
+}
@@ -0,0 +1,138 @@
+package haproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/metrics"
+)
+
+var (
+	tcpLogEnabled = flags.Bool("TCP_CONNECTION_LOG", false, "Log the connections of the tcp frontends and count them by termination state")
+	tcpLogPort    = flags.Int("TCP_CONNECTION_LOG_PORT", 10243, "Local udp port haproxy sends the tcp connection logs to").Range(1, 65535)
+)
+
+// tcpLogFormat logs the closed connections of the tcp frontends as json
+const tcpLogFormat = `"{\"frontend\":\"%f\",\"backend\":\"%b\",\"server\":\"%s\",\"client\":\"%ci:%cp\",` +
+	`\"termination_state\":\"%ts\",\"retries\":\"%rc\",\"connect_ms\":%Tc,\"duration_ms\":%Tt,\"bytes_read\":%B}"`
+
+type tcpConnectionLog struct {
+	Frontend         string `json:"frontend"`
+	Backend          string `json:"backend"`
+	Server           string `json:"server"`
+	Client           string `json:"client"`
+	TerminationState string `json:"termination_state"`
+	Retries          string `json:"retries"`
+	ConnectMs        int    `json:"connect_ms"`
+	DurationMs       int    `json:"duration_ms"`
+	BytesRead        int64  `json:"bytes_read"`
+}
+
+// tcpLogReceiver reads the connection logs haproxy sends over
+// syslog, logs them and counts them in the tcp metrics
+type tcpLogReceiver struct {
+	// tags labels the metrics of the backends, they are not tagged when nil
+	tags *metricsTags
+}
+
+func (r *tcpLogReceiver) listen(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("TCP connection log receiver is listening on %s", address)
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				logrus.Errorf("Failed to read tcp connection log: %v", err)
+				continue
+			}
+			r.receive(buf[:n])
+		}
+	}()
+	return nil
+}
+
+func (r *tcpLogReceiver) receive(message []byte) *tcpConnectionLog {
+	start := bytes.IndexByte(message, '{')
+	if start < 0 {
+		return nil
+	}
+	c := &tcpConnectionLog{}
+	if err := json.Unmarshal(bytes.TrimSpace(message[start:]), c); err != nil {
+		logrus.Debugf("Failed to parse tcp connection log: %v", err)
+		return nil
+	}
+	var tag string
+	if r.tags != nil {
+		tag = r.tags.get(c.Backend)
+	}
+	metrics.ObserveTCPConnection(metrics.TCPConnection{
+		Frontend:         c.Frontend,
+		Backend:          c.Backend,
+		Tag:              tag,
+		TerminationState: c.TerminationState,
+		Retries:          c.Retries,
+	})
+	entry := logrus.WithFields(logrus.Fields{
+		"frontend":          c.Frontend,
+		"backend":           c.Backend,
+		"server":            c.Server,
+		"client":            c.Client,
+		"termination_state": c.TerminationState,
+		"retries":           c.Retries,
+		"connect_ms":        c.ConnectMs,
+		"duration_ms":       c.DurationMs,
+		"bytes_read":        c.BytesRead,
+	})
+	if metrics.IsConnectError(c.TerminationState) {
+		entry.Warn("TCP connection failed to connect to the backend")
+	} else {
+		entry.Info("TCP connection closed")
+	}
+	return c
+}
+
+func isTCPFrontend(fe *config.FrontendService) bool {
+	return fe.Protocol == config.TCPProto || fe.Protocol == config.TLSProto || fe.Protocol == config.SNIProto
+}
+
+func hasTCPFrontends(lbConfig *config.LoadBalancerConfig) bool {
+	for _, fe := range lbConfig.FrontendServices {
+		if isTCPFrontend(fe) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupTCPLog starts the tcp connection log receiver
+// with the first config having tcp frontends
+func (lbp *Provider) setupTCPLog(lbConfig *config.LoadBalancerConfig) {
+	lbp.tcpLogMu.Lock()
+	defer lbp.tcpLogMu.Unlock()
+	if lbp.tcpLog != nil || lbp.cfg.TCPLogAddress == "" || !hasTCPFrontends(lbConfig) {
+		return
+	}
+	receiver := &tcpLogReceiver{tags: &lbp.tags}
+	if err := receiver.listen(lbp.cfg.TCPLogAddress); err != nil {
+		logrus.Errorf("Failed to start tcp connection log receiver: %v", err)
+		return
+	}
+	lbp.tcpLog = receiver
+}
+
+func tcpLogAddress() string {
+	return fmt.Sprintf("127.0.0.1:%d", tcpLogPort.Get())
+}
@@ -1,24 +1,41 @@
 package haproxy
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/provider"
+	"github.com/rancher/lb-controller/utils/cgroup"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var lbp Provider
 
 func init() {
 	haproxyCfg := &haproxyConfig{
-		ReloadCmd: "haproxy_reload /etc/haproxy/haproxy.cfg reload",
-		StartCmd:  "haproxy_reload /etc/haproxy/haproxy.cfg start",
-		Config:    "test_data/haproxy_new.cfg",
-		Template:  "test_data/haproxy_template.cfg",
-		CertDir:   "/etc/haproxy/certs",
+		ReloadCmd:   "haproxy_reload /etc/haproxy/haproxy.cfg reload",
+		StartCmd:    "haproxy_reload /etc/haproxy/haproxy.cfg start",
+		Config:      "test_data/haproxy_new.cfg",
+		Template:    "test_data/haproxy_template.cfg",
+		CertDir:     "/etc/haproxy/certs",
+		StatsSocket: statsSocket,
 	}
 	lbp = Provider{
 		cfg:    haproxyCfg,
@@ -620,3 +637,2069 @@ func TestHaproxyConfigWriteDefaultCertWithSpace(t *testing.T) {
 		t.Fatalf("Error validating default cert presence in haproxy config")
 	}
 }
+
+func TestHaproxyConfigWriteRedirect(t *testing.T) {
+	backend := &config.BackendService{
+		UUID:     "olddomain",
+		Host:     "old-domain.com",
+		Protocol: config.HTTPProto,
+		Redirect: &config.Redirect{
+			Code:     301,
+			Location: "https://new-domain.com",
+			Prefix:   true,
+		},
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.HTTPProto,
+		BackendServices: []*config.BackendService{backend},
+	}
+
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{frontend},
+	}
+	defer os.RemoveAll(lbp.cfg.Config)
+	if err := lbp.cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(lbp.cfg.Config)
+	if err != nil {
+		t.Fatalf("Error while reading the haproxy config file: %v", err)
+	}
+
+	if !strings.Contains(string(b), "http-request redirect prefix https://new-domain.com code 301") {
+		t.Fatalf("Error validating redirect presence in haproxy config")
+	}
+}
+
+func TestHaproxyConfigWriteDebugHeaders(t *testing.T) {
+	ep := &config.Endpoint{
+		Name: "s1",
+		IP:   "10.1.1.1",
+		Port: 90,
+	}
+	backend := &config.BackendService{
+		UUID:           "foo",
+		Host:           ".foo.com",
+		Path:           "/api",
+		RuleComparator: config.EndRuleComparator,
+		Port:           90,
+		Protocol:       config.HTTPProto,
+		Endpoints:      config.Endpoints{ep},
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.HTTPProto,
+		BackendServices: []*config.BackendService{backend},
+	}
+
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{frontend},
+		DebugHeaders: &config.DebugHeaders{
+			Sources: []string{"10.42.0.0/16", "192.168.1.10"},
+		},
+	}
+	defer os.RemoveAll(lbp.cfg.Config)
+	if err := lbp.cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(lbp.cfg.Config)
+	if err != nil {
+		t.Fatalf("Error while reading the haproxy config file: %v", err)
+	}
+	cfgFile := string(b)
+
+	expected := []string{
+		"acl lb_debug_src src 10.42.0.0/16 192.168.1.10",
+		"http-response set-header X-LB-Backend foo if lb_debug_src",
+		"http-response set-header X-LB-Rule *.foo.com/api if lb_debug_src",
+		"http-response set-header X-LB-Endpoint %si:%sp if lb_debug_src",
+	}
+	for _, line := range expected {
+		if !strings.Contains(cfgFile, line) {
+			t.Fatalf("Haproxy config is missing debug header line [%s]", line)
+		}
+	}
+}
+
+func TestHaproxyConfigRenderShadow(t *testing.T) {
+	ep := &config.Endpoint{
+		Name: "s1",
+		IP:   "10.1.1.1",
+		Port: 90,
+	}
+	backend := &config.BackendService{
+		UUID:      "foo",
+		Port:      90,
+		Protocol:  config.HTTPProto,
+		Endpoints: config.Endpoints{ep},
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.HTTPSProto,
+		BackendServices: []*config.BackendService{backend},
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Config:           "global\n    maxconn 4096\n",
+		FrontendServices: []*config.FrontendService{frontend},
+	}
+
+	shadowCfg := "test_data/haproxy_shadow.cfg"
+	defer os.RemoveAll(shadowCfg)
+	if err := lbp.cfg.render(shadowCfg, lbConfig, 10000, "/etc/haproxy/certs/shadow"); err != nil {
+		t.Fatalf("Error while rendering shadow haproxy config: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(shadowCfg)
+	if err != nil {
+		t.Fatalf("Error while reading the shadow haproxy config file: %v", err)
+	}
+	cfgFile := string(b)
+
+	if !strings.Contains(cfgFile, "bind *:10080 ssl crt /etc/haproxy/certs/shadow") {
+		t.Fatalf("Shadow frontend port or cert dir is not shifted")
+	}
+	if !strings.Contains(cfgFile, "bind *:10042") {
+		t.Fatalf("Shadow default listener port is not shifted")
+	}
+	if !strings.Contains(cfgFile, "stats socket /var/run/haproxy_stats.sock.shadow mode 600 level user\n") || strings.Contains(cfgFile, "haproxy_stats.sock mode") {
+		t.Fatalf("Shadow stats socket is not moved:\n%s", cfgFile)
+	}
+	// the stats socket is only added once a consumer enables the stats
+	cfg := *lbp.cfg
+	cfg.StatsSocket = ""
+	var plain bytes.Buffer
+	if err := cfg.renderTo(&plain, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if strings.Contains(plain.String(), "stats socket") {
+		t.Fatalf("Stats socket shouldn't be added without stats consumer:\n%s", plain.String())
+	}
+	if frontend.Port != 80 {
+		t.Fatalf("Rendering shadow config shouldn't modify the original frontend port %v", frontend.Port)
+	}
+}
+
+func TestHaproxyConfigWriteBindAddress(t *testing.T) {
+	ep := &config.Endpoint{
+		Name: "s1",
+		IP:   "10.1.1.1",
+		Port: 90,
+	}
+	backend := &config.BackendService{
+		UUID:      "foo",
+		Port:      90,
+		Protocol:  config.TCPProto,
+		Endpoints: config.Endpoints{ep},
+	}
+	frontends := []*config.FrontendService{
+		{
+			Name:            "80",
+			Port:            80,
+			Protocol:        config.TCPProto,
+			BindAddress:     "lo",
+			BackendServices: []*config.BackendService{backend},
+		},
+		{
+			Name:            "81",
+			Port:            81,
+			Protocol:        config.TCPProto,
+			BindAddress:     "10.0.0.5",
+			BackendServices: []*config.BackendService{backend},
+		},
+	}
+
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: frontends,
+	}
+	defer os.RemoveAll(lbp.cfg.Config)
+	if err := lbp.cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(lbp.cfg.Config)
+	if err != nil {
+		t.Fatalf("Error while reading the haproxy config file: %v", err)
+	}
+	cfgFile := string(b)
+	for _, line := range []string{"bind 127.0.0.1:80", "bind 10.0.0.5:81"} {
+		if !strings.Contains(cfgFile, line) {
+			t.Fatalf("Missing %q in the config:\n%s", line, cfgFile)
+		}
+	}
+	if frontends[0].BindAddress != "lo" {
+		t.Fatalf("Interface name is overwritten in the lb config: %v", frontends[0].BindAddress)
+	}
+
+	frontends[0].BindAddress = "nosuchiface0"
+	if err := lbp.cfg.write(lbConfig); err == nil {
+		t.Fatal("Unknown interface is not reported")
+	}
+}
+
+func TestHaproxyConfigWriteWeight(t *testing.T) {
+	eps := config.Endpoints{
+		{Name: "local", IP: "10.1.1.1", Port: 90, Weight: 100},
+		{Name: "remote", IP: "10.1.1.2", Port: 90, Weight: 1},
+		{Name: "noweight", IP: "10.1.1.3", Port: 90},
+	}
+	backend := &config.BackendService{
+		UUID:      "foo",
+		Port:      90,
+		Protocol:  config.TCPProto,
+		Endpoints: eps,
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.TCPProto,
+		BackendServices: []*config.BackendService{backend},
+	}
+
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{frontend},
+	}
+	defer os.RemoveAll(lbp.cfg.Config)
+	if err := lbp.cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(lbp.cfg.Config)
+	if err != nil {
+		t.Fatalf("Error while reading the haproxy config file: %v", err)
+	}
+	cfgFile := string(b)
+	for _, line := range []string{
+		"server local 10.1.1.1:90 weight 100",
+		"server remote 10.1.1.2:90 weight 1",
+		"server noweight 10.1.1.3:90 \n",
+	} {
+		if !strings.Contains(cfgFile, line) {
+			t.Fatalf("Missing %q in the config:\n%s", line, cfgFile)
+		}
+	}
+}
+
+func TestHaproxyConfigWriteKeepAlive(t *testing.T) {
+	ep := &config.Endpoint{
+		Name: "s1",
+		IP:   "10.1.1.1",
+		Port: 90,
+	}
+	backend := &config.BackendService{
+		UUID:      "api",
+		Port:      90,
+		Protocol:  config.HTTPProto,
+		Endpoints: config.Endpoints{ep},
+		KeepAlive: &config.KeepAlive{
+			HTTPReuse:      "safe",
+			PoolPurgeDelay: "10s",
+			PoolMaxConn:    200,
+		},
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.HTTPProto,
+		BackendServices: []*config.BackendService{backend},
+	}
+
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{frontend},
+	}
+	defer os.RemoveAll(lbp.cfg.Config)
+	if err := lbp.cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(lbp.cfg.Config)
+	if err != nil {
+		t.Fatalf("Error while reading the haproxy config file: %v", err)
+	}
+	cfgFile := string(b)
+	for _, line := range []string{
+		"option http-keep-alive\nhttp-reuse safe\n",
+		"server s1 10.1.1.1:90 pool-purge-delay 10s pool-max-conn 200",
+	} {
+		if !strings.Contains(cfgFile, line) {
+			t.Fatalf("Missing %q in the config:\n%s", line, cfgFile)
+		}
+	}
+}
+
+func TestParseBackendStats(t *testing.T) {
+	output := `# pxname,svname,qcur,qmax,scur,smax,status,qtime,ctime,rate
+default,FRONTEND,,,0,1,OPEN,,,
+foo_80,s1,2,4,10,12,UP,5,1,20
+foo_80,BACKEND,3,7,11,14,UP,120,2,40
+bar_81,BACKEND,0,0,1,1,UP,,,
+`
+	stats, err := parseBackendStats(output)
+	if err != nil {
+		t.Fatalf("Failed to parse stats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Invalid stats length %v", len(stats))
+	}
+	foo := stats[0]
+	if foo.Name != "foo_80" || foo.QueueCurrent != 3 || foo.QueueMax != 7 || foo.QueueTime != 120 || foo.Sessions != 11 || foo.Rate != 40 {
+		t.Fatalf("Invalid backend stats %v", foo)
+	}
+	if stats[1].Name != "bar_81" || stats[1].QueueTime != 0 {
+		t.Fatalf("Invalid backend stats %v", stats[1])
+	}
+}
+
+func TestParseEndpointStatus(t *testing.T) {
+	output := `# pxname,svname,qcur,qmax,scur,smax,status
+default,FRONTEND,,,0,1,OPEN
+foo,s1,0,0,1,2,UP 1/3
+foo,s2,0,0,0,0,DOWN
+foo,s3,0,0,0,0,DRAIN
+foo,s4,0,0,0,0,MAINT
+foo,s5,0,0,0,0,no check
+foo,BACKEND,0,0,1,2,UP
+`
+	status, err := parseEndpointStatus(output)
+	if err != nil {
+		t.Fatalf("Failed to parse stats: %v", err)
+	}
+	expected := []provider.EndpointStatus{
+		{Backend: "foo", Server: "s1", Status: provider.EndpointUp},
+		{Backend: "foo", Server: "s2", Status: provider.EndpointDown},
+		{Backend: "foo", Server: "s3", Status: provider.EndpointDrained},
+		{Backend: "foo", Server: "s4", Status: provider.EndpointDown},
+		{Backend: "foo", Server: "s5", Status: provider.EndpointUp},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("Invalid endpoint status %+v", status)
+	}
+}
+
+func TestHaproxyConfigWritePeers(t *testing.T) {
+	backend := &config.BackendService{
+		UUID:     "foo",
+		Port:     90,
+		Protocol: config.HTTPProto,
+		Config:   "stick-table type ip size 200k expire 30m\nstick on src",
+		Endpoints: config.Endpoints{
+			{Name: "s1", IP: "10.1.1.1", Port: 90},
+		},
+	}
+	frontend := &config.FrontendService{
+		Name:            "80",
+		Port:            80,
+		Protocol:        config.HTTPProto,
+		BackendServices: []*config.BackendService{backend},
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{frontend},
+	}
+
+	lbp.cfg.PeerName = "lb1"
+	lbp.cfg.PeersPort = 10242
+	defer func() {
+		lbp.cfg.PeerName = ""
+		lbp.cfg.PeersPort = 0
+	}()
+	defer os.RemoveAll(lbp.cfg.Config)
+	if err := lbp.cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	b, err := ioutil.ReadFile(lbp.cfg.Config)
+	if err != nil {
+		t.Fatalf("Error while reading the haproxy config file: %v", err)
+	}
+	cfgFile := string(b)
+	for _, line := range []string{
+		"peers rancher\n peer lb1 127.0.0.1:10242\n",
+		"stick-table type ip size 200k expire 30m peers rancher\nstick on src\n",
+	} {
+		if !strings.Contains(cfgFile, line) {
+			t.Fatalf("Missing %q in the config:\n%s", line, cfgFile)
+		}
+	}
+}
+
+func TestAddStickTablePeers(t *testing.T) {
+	cfg := "backend a\n  stick-table type ip size 1m\nbackend b\n  stick-table type ip size 1m peers other\n" +
+		"backend c\n  stick-table type ip size 1m # per client, see \"#1\"\n  # stick-table type ip size 2m\n"
+	expected := "backend a\n  stick-table type ip size 1m peers rancher\nbackend b\n  stick-table type ip size 1m peers other\n" +
+		"backend c\n  stick-table type ip size 1m peers rancher # per client, see \"#1\"\n  # stick-table type ip size 2m\n"
+	if result := addStickTablePeers(cfg); result != expected {
+		t.Fatalf("Invalid config with peers:\n%s", result)
+	}
+}
+
+func TestHaproxyConfigWriteRemotePeers(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		Peers: []*config.Peer{
+			{Name: "lb-1", IP: "10.42.0.1"},
+			{Name: "lb-2", IP: "10.42.0.2"},
+		},
+	}
+	lbp.cfg.PeerName = "lb-2"
+	lbp.cfg.PeersPort = 10242
+	defer func() {
+		lbp.cfg.PeerName = ""
+		lbp.cfg.PeersPort = 0
+	}()
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	expected := "peers rancher\n peer lb-1 10.42.0.1:10242\n peer lb-2 10.42.0.2:10242\n"
+	if !strings.Contains(b.String(), expected) {
+		t.Fatalf("Missing %q in the config:\n%s", expected, b.String())
+	}
+
+	// not an lb instance, only local peer is kept
+	lbp.cfg.PeerName = "other"
+	b.Reset()
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	expected = "peers rancher\n peer other 127.0.0.1:10242\n\n"
+	if !strings.Contains(b.String(), expected) {
+		t.Fatalf("Missing %q in the config:\n%s", expected, b.String())
+	}
+}
+
+func TestHaproxyConfigWriteResolvers(t *testing.T) {
+	backend := &config.BackendService{
+		UUID:     "foo",
+		Port:     80,
+		Protocol: config.HTTPProto,
+		Endpoints: config.Endpoints{
+			{Name: "foo.com", IP: "foo.com", Port: 80, IsCname: true},
+			{Name: "s1", IP: "10.1.1.1", Port: 80},
+		},
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:            "80",
+				Port:            80,
+				Protocol:        config.HTTPProto,
+				BackendServices: []*config.BackendService{backend},
+			},
+		},
+		Resolvers: &config.Resolvers{
+			Nameservers:   []string{"10.0.0.2:53", "10.0.0.3:53"},
+			ResolvePrefer: "ipv4",
+			HoldValid:     "10s",
+			ServerSlots:   4,
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	cfgFile := b.String()
+	for _, line := range []string{
+		"resolvers rancher\n nameserver dns1 10.0.0.2:53\n nameserver dns2 10.0.0.3:53\n hold valid 10s\n\n",
+		"server-template foo.com 4 foo.com:80 ",
+		" check resolvers rancher resolve-prefer ipv4\n",
+		"server s1 10.1.1.1:80",
+	} {
+		if !strings.Contains(cfgFile, line) {
+			t.Fatalf("Missing %q in the config:\n%s", line, cfgFile)
+		}
+	}
+	if strings.Contains(cfgFile, "dnsmasq") {
+		t.Fatalf("Default nameserver should be replaced:\n%s", cfgFile)
+	}
+}
+
+func TestHaproxyConfigWriteCrtList(t *testing.T) {
+	wildcard := &config.Certificate{Name: "wildcard", Hostnames: []string{"*.example.com", "!admin.example.com"}}
+	admin := &config.Certificate{Name: "admin"}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "443",
+				Port:     443,
+				Protocol: config.HTTPSProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "foo", Port: 80, Protocol: config.HTTPSProto},
+				},
+			},
+		},
+		Certs: []*config.Certificate{wildcard, admin},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "ssl crt-list /etc/haproxy/certs/current/crt-list strict-sni") {
+		t.Fatalf("Crt list is not used: %s", b.String())
+	}
+
+	crtList := getCrtList("/etc/haproxy/certs/current", lbConfig.Certs)
+	expected := "/etc/haproxy/certs/current/wildcard.pem *.example.com !admin.example.com\n/etc/haproxy/certs/current/admin.pem\n"
+	if crtList != expected {
+		t.Fatalf("Invalid crt list %q", crtList)
+	}
+
+	wildcard.Hostnames = nil
+	b.Reset()
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "ssl crt /etc/haproxy/certs/current strict-sni") {
+		t.Fatalf("Cert dir should be used without overrides: %s", b.String())
+	}
+}
+
+func TestHaproxyConfigFrontendCerts(t *testing.T) {
+	internal := &config.Certificate{Name: "internal-ca"}
+	public := &config.Certificate{Name: "public"}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "443",
+				Port:     443,
+				Protocol: config.HTTPSProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "foo", Port: 80, Protocol: config.HTTPSProto},
+				},
+			},
+			{
+				Name:     "8443",
+				Port:     8443,
+				Protocol: config.HTTPSProto,
+				Certs:    []string{"internal-ca"},
+				BackendServices: []*config.BackendService{
+					{UUID: "bar", Port: 80, Protocol: config.HTTPSProto},
+				},
+			},
+		},
+		DefaultCert: public,
+		Certs:       []*config.Certificate{internal},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "*:8443 ssl crt-list /etc/haproxy/certs/current/crt-list.8443\n") {
+		t.Fatalf("Crt list of the frontend is not used: %s", b.String())
+	}
+	if !strings.Contains(b.String(), "*:443 ssl crt /etc/haproxy/certs/current/public.pem ssl crt /etc/haproxy/certs/current\n") {
+		t.Fatalf("Frontend without certs should present all certs: %s", b.String())
+	}
+
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := writeCertificates(dir, "/etc/haproxy/certs/current", lbConfig); err != nil {
+		t.Fatalf("Error writing certs: %v", err)
+	}
+	crtList, err := ioutil.ReadFile(fmt.Sprintf("%s/crt-list.8443", dir))
+	if err != nil {
+		t.Fatalf("Crt list of the frontend is not written: %v", err)
+	}
+	if string(crtList) != "/etc/haproxy/certs/current/internal-ca.pem\n" {
+		t.Fatalf("Invalid crt list %q", crtList)
+	}
+}
+
+func TestHaproxyConfigH2C(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "8080",
+				Port:     8080,
+				Protocol: config.HTTPProto,
+				H2C:      true,
+				BackendServices: []*config.BackendService{
+					{
+						UUID:      "grpc",
+						Port:      50051,
+						Protocol:  config.HTTPProto,
+						Endpoints: []*config.Endpoint{{Name: "s1", IP: "10.1.1.1", Port: 50051}},
+						H2:        true,
+					},
+					{
+						UUID:      "acme_challenge",
+						Path:      "/.well-known/acme-challenge/",
+						Port:      80,
+						Protocol:  config.HTTPProto,
+						Endpoints: []*config.Endpoint{{Name: "s3", IP: "10.1.1.3", Port: 80}},
+					},
+				},
+			},
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{
+						UUID:      "web",
+						Port:      80,
+						Protocol:  config.HTTPProto,
+						Endpoints: []*config.Endpoint{{Name: "s2", IP: "10.1.1.2", Port: 80}},
+					},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	cfg := b.String()
+	// HTTP/1.1 and h2c clients share the port, htx detects the h2 preface
+	if !strings.Contains(cfg, "frontend 8080\nbind *:8080\noption http-use-htx\n") || strings.Contains(cfg, "del-header Upgrade") {
+		t.Fatalf("H2c is not enabled on the frontend: %s", cfg)
+	}
+	if strings.Contains(cfg, "bind *:8080 proto h2") {
+		t.Fatalf("H2c frontend shouldn't be limited to HTTP/2 prior knowledge: %s", cfg)
+	}
+	if !strings.Contains(cfg, "server s1 10.1.1.1:50051 proto h2") {
+		t.Fatalf("Backend opting in should talk h2: %s", cfg)
+	}
+	if strings.Contains(cfg, "server s3 10.1.1.3:80 proto h2") || strings.Contains(cfg, "server s2 10.1.1.2:80 proto h2") {
+		t.Fatalf("Backends not opting in should talk HTTP/1.1: %s", cfg)
+	}
+	// the frontend and both its backends are in htx mode
+	if strings.Contains(cfg, "bind *:80 proto h2") || strings.Count(cfg, "option http-use-htx") != 3 {
+		t.Fatalf("H2c should be enabled on the h2c frontend only: %s", cfg)
+	}
+}
+
+func TestHaproxyConfigDetectTLS(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:      "8080",
+				Port:      8080,
+				Protocol:  config.HTTPProto,
+				DetectTLS: true,
+				BackendServices: []*config.BackendService{
+					{UUID: "foo", Port: 80, Protocol: config.HTTPProto},
+				},
+			},
+		},
+		DefaultCert: &config.Certificate{Name: "default"},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	cfg := b.String()
+	expected := []string{
+		"frontend 8080\nbind *:8080\nmode tcp\n",
+		"use_backend 8080_detected_tls if { req.ssl_hello_type 1 }\ndefault_backend 8080_detected_plain\n",
+		"server tls abns@lb_8080_tls send-proxy-v2\n",
+		"server plain abns@lb_8080_plain send-proxy-v2\n",
+		"frontend 8080_tls\nbind abns@lb_8080_tls accept-proxy ssl crt /etc/haproxy/certs/current/default.pem ssl crt /etc/haproxy/certs/current\n",
+		"frontend 8080_plain\nbind abns@lb_8080_plain accept-proxy\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(cfg, e) {
+			t.Fatalf("Expected %q in the config: %s", e, cfg)
+		}
+	}
+	if strings.Count(cfg, "default_backend foo") != 2 {
+		t.Fatalf("Both internal frontends should route to the backend: %s", cfg)
+	}
+
+	b.Reset()
+	if err := lbp.cfg.renderTo(&b, lbConfig, 100, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "bind abns@lb_8180_tls accept-proxy") {
+		t.Fatalf("Shadow instance should bind its own sockets: %s", b.String())
+	}
+}
+
+func TestHaproxyConfigTransparent(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "3306",
+				Port:     3306,
+				Protocol: config.TCPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "db", Port: 3306, Protocol: config.TCPProto, Transparent: true},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "mode tcp\nsource 0.0.0.0 usesrc clientip\n") {
+		t.Fatalf("Transparent backend should connect from the client ip: %s", b.String())
+	}
+
+	f, err := ioutil.TempFile("", "tproxy")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	p := &Provider{cfg: &haproxyConfig{TProxyCmd: fmt.Sprintf("echo run >> %s", f.Name())}}
+	for i := 0; i < 2; i++ {
+		if err := p.setupTProxy(lbConfig); err != nil {
+			t.Fatalf("Error setting up tproxy: %v", err)
+		}
+	}
+	output, _ := ioutil.ReadFile(f.Name())
+	if string(output) != "run\n" {
+		t.Fatalf("TProxy command should run once, got %q", output)
+	}
+}
+
+func TestHaproxyConfigDebugCapture(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 80, Protocol: config.HTTPProto, DebugCapture: &config.DebugCapture{Until: time.Now().Add(time.Minute)}},
+				},
+			},
+			{
+				Name:     "81",
+				Port:     81,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "web", Port: 80, Protocol: config.HTTPProto},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	cfg := b.String()
+	if !strings.Contains(cfg, "frontend 80\nbind *:80\nlog global\nlog 127.0.0.1:10242 len 65535 local0 debug\nlog-format \"{") {
+		t.Fatalf("Frontend should log the captures: %s", cfg)
+	}
+	if !strings.Contains(cfg, "http-request set-var(txn.lb_capture) str(api)\n") || strings.Contains(cfg, "req.body") {
+		t.Fatalf("Backend should capture the requests without their body: %s", cfg)
+	}
+	if strings.Count(cfg, "log-format") != 1 || strings.Contains(cfg, "str(web)") {
+		t.Fatalf("Requests should be captured for the api backend only: %s", cfg)
+	}
+
+	// the bodies are captured once opted in
+	withBodies := *lbp.cfg
+	withBodies.CaptureBodyBytes = 1024
+	b.Reset()
+	if err := withBodies.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "http-request set-var(txn.lb_capture_req_body) req.body,bytes(0,1024)\n") {
+		t.Fatalf("Backend should capture the request bodies: %s", b.String())
+	}
+}
+
+func TestCaptureReceiver(t *testing.T) {
+	now := time.Now()
+	r := newCaptureReceiver(2, "Authorization, cookie")
+	r.now = func() time.Time { return now }
+	r.setDeadlines(&config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				BackendServices: []*config.BackendService{
+					{UUID: "api", DebugCapture: &config.DebugCapture{Until: now.Add(time.Minute)}},
+					{UUID: "old", DebugCapture: &config.DebugCapture{Until: now.Add(-time.Minute)}},
+				},
+			},
+		},
+	})
+	for _, uri := range []string{"/1", "/2", "/3"} {
+		r.receive([]byte(fmt.Sprintf(`<135>Oct 16 10:00:00 haproxy[1]: {"backend":"api","method":"POST","uri":"%s","status":200,"request_body":"{\"a\":1}"}`, uri)))
+	}
+	r.receive([]byte(`<135>Oct 16 10:00:00 haproxy[1]: {"backend":"","uri":"/other","status":200}`))
+	r.receive([]byte(`<135>Oct 16 10:00:00 haproxy[1]: {"backend":"old","uri":"/old","status":200}`))
+	captures := r.list()
+	if len(captures) != 2 || captures[0].URI != "/2" || captures[1].URI != "/3" {
+		t.Fatalf("Invalid captures %+v", captures)
+	}
+	if captures[0].RequestBody != `{"a":1}` || captures[0].Status != 200 {
+		t.Fatalf("Invalid capture %+v", captures[0])
+	}
+
+	r.receive([]byte(`<135>Oct 16 10:00:00 haproxy[1]: {"backend":"api","uri":"/auth","status":200,` +
+		`"request_headers":"host: api\r\nauthorization: Bearer s3cr3t\r\nCookie: sid=s3cr3t\r\n"}`))
+	captures = r.list()
+	if headers := captures[1].RequestHeaders; headers != "host: api\r\nauthorization: <redacted>\r\nCookie: <redacted>\r\n" {
+		t.Fatalf("Invalid redacted headers %q", headers)
+	}
+}
+
+func TestHaproxyConfigFault(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 80, Protocol: config.HTTPProto, Fault: &config.Fault{DelayMs: 200, DelayPercent: 10, AbortStatus: 503, AbortPercent: 5}},
+					{UUID: "web", Port: 80, Protocol: config.HTTPProto},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "http-request deny deny_status 503 if { rand(100) lt 5 }\n") {
+		t.Fatalf("Backend should abort the requests: %s", out)
+	}
+	if !strings.Contains(out, "tcp-request inspect-delay 200ms\n") ||
+		!strings.Contains(out, "tcp-request content accept if WAIT_END || { var(txn.lb_fault_delay) -m int ge 10 }\n") {
+		t.Fatalf("Backend should delay the requests: %s", out)
+	}
+	if strings.Count(out, "inspect-delay") != 1 {
+		t.Fatalf("Only the api backend should inject faults: %s", out)
+	}
+}
+
+func TestHaproxyConfigHardening(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "web", Port: 80, Protocol: config.HTTPProto},
+				},
+			},
+			{
+				Name:     "3306",
+				Port:     3306,
+				Protocol: config.TCPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "db", Port: 3306, Protocol: config.TCPProto},
+				},
+			},
+		},
+		Hardening: &config.RequestHardening{MergeSlashes: true, RejectPathTraversal: true},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "mode http\nhttp-request set-path %[path,regsub(/+,/,g)] if { path -m sub // }\n"+
+		"http-request deny deny_status 400 if { path,url_dec -m reg (^|/)[.][.](/|$) }\n") {
+		t.Fatalf("Http frontend should be hardened: %s", out)
+	}
+	if strings.Contains(out, "req.hdrs_len") || strings.Contains(out, "transfer-encoding") || strings.Count(out, "set-path") != 1 {
+		t.Fatalf("Only the enabled options should be rendered for the http frontend: %s", out)
+	}
+}
+
+func TestHaproxyConfigStripHeaders(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "web", Port: 80, Protocol: config.HTTPProto},
+				},
+			},
+		},
+		StripHeaders: &config.HeaderStripping{Headers: []string{"X-Forwarded-For", "X-Auth-User"}, TrustedSources: []string{"10.42.0.0/16"}},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "acl lb_trusted_src src 10.42.0.0/16\n"+
+		"http-request del-header X-Forwarded-For if !lb_trusted_src\n"+
+		"http-request del-header X-Auth-User if !lb_trusted_src\n") {
+		t.Fatalf("Headers of the untrusted sources should be stripped: %s", b.String())
+	}
+
+	lbConfig.StripHeaders.TrustedSources = nil
+	b.Reset()
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	if !strings.Contains(b.String(), "http-request del-header X-Auth-User\n") || strings.Contains(b.String(), "lb_trusted_src") {
+		t.Fatalf("Headers should be stripped from every request: %s", b.String())
+	}
+}
+
+func TestHaproxyConfigTCPLog(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "3306",
+				Port:     3306,
+				Protocol: config.TCPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "db", Port: 3306, Protocol: config.TCPProto},
+				},
+			},
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "web", Port: 80, Protocol: config.HTTPProto},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	cfg := *lbp.cfg
+	cfg.TCPLogAddress = "127.0.0.1:10243"
+	var b bytes.Buffer
+	if err := cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "bind *:3306\nlog global\nlog 127.0.0.1:10243 len 8192 local0 info\nlog-format "+tcpLogFormat+"\n") {
+		t.Fatalf("Tcp frontend should log its connections: %s", out)
+	}
+	if strings.Count(out, "log-format") != 1 {
+		t.Fatalf("Only the tcp frontend should log its connections: %s", out)
+	}
+
+	tags := &metricsTags{}
+	tags.set(&config.LoadBalancerConfig{FrontendServices: []*config.FrontendService{{
+		BackendServices: []*config.BackendService{{UUID: "db", MetricsTag: "billing"}, {UUID: "cache"}},
+	}}})
+	if tags.get("db") != "billing" || tags.get("cache") != "" {
+		t.Fatalf("Invalid metrics tags %v", tags.tags)
+	}
+	r := &tcpLogReceiver{tags: tags}
+	c := r.receive([]byte(`<134>Oct 16 10:00:00 haproxy[1]: {"frontend":"3306","backend":"db","server":"db1","client":"10.42.0.5:4000",` +
+		`"termination_state":"SC","retries":"+3","connect_ms":-1,"duration_ms":3001,"bytes_read":0}`))
+	if c == nil || c.Backend != "db" || c.TerminationState != "SC" || c.DurationMs != 3001 {
+		t.Fatalf("Invalid tcp connection log %+v", c)
+	}
+	if r.receive([]byte(`<134>Oct 16 10:00:00 haproxy[1]: Proxy 3306 started.`)) != nil {
+		t.Fatalf("Messages without connection log should be skipped")
+	}
+}
+
+func TestTuning(t *testing.T) {
+	now := time.Now()
+	limits := cgroup.Limits{MemoryBytes: 64 << 20, CPUs: 1.5}
+	reads := 0
+	tn := &tuner{
+		read:        func() (cgroup.Limits, error) { reads++; return limits, nil },
+		interval:    time.Minute,
+		threads:     true,
+		memoryShare: 0.5,
+		now:         func() time.Time { return now },
+	}
+	lbConfig := &config.LoadBalancerConfig{Tuning: &config.Tuning{BufSize: 32768}}
+	tn.setTuning(lbConfig)
+	// 32MiB share for connections of 2 8KiB buffers and 16KiB overhead
+	expected := config.Tuning{MaxConn: 1024, BufSize: 32768, Threads: 2}
+	if *lbConfig.Tuning != expected {
+		t.Fatalf("Invalid tuning %+v", *lbConfig.Tuning)
+	}
+	limits = cgroup.Limits{MemoryBytes: 8 << 30}
+	if tuning := tn.get(); tuning.MaxConn != 1024 || reads != 1 {
+		t.Fatalf("Limits should be read again after the interval only %+v", tuning)
+	}
+	now = now.Add(time.Minute)
+	if tuning := tn.get(); tuning != (config.Tuning{MaxConn: defaultMaxConn, BufSize: defaultBufSize}) {
+		t.Fatalf("Maxconn should not be raised over the default %+v", tuning)
+	}
+
+	if err := BuildCustomConfig(lbConfig, "global\n    maxconn 2000\ndefaults\n    maxconn 2000\n"); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	for _, line := range []string{"maxconn 2000", "tune.bufsize 32768", "nbthread 2"} {
+		if !strings.Contains(lbConfig.Config, line) {
+			t.Fatalf("Global config is missing %s: %s", line, lbConfig.Config)
+		}
+	}
+	if strings.Contains(lbConfig.Config, "maxconn 1024") {
+		t.Fatalf("Custom config should override the tuning: %s", lbConfig.Config)
+	}
+}
+
+func TestFilterCustomConfig(t *testing.T) {
+	custom := "global\n    maxconn 2000\n    lua-load /tmp/evil.lua\n" +
+		"defaults\n    timeout client 30s\n    option httplog\n    option http-use-htx\n" +
+		"listen evil\n    bind :9999\n    server x 10.0.0.1:22\n" +
+		"backend foo\n    balance leastconn\n    server $IP check\n"
+	allowed := []string{"maxconn", "timeout", "option httplog", "balance"}
+	filtered := filterCustomConfig(custom, allowed)
+	for _, line := range []string{"maxconn 2000", "timeout client 30s", "option httplog", "backend foo", "balance leastconn"} {
+		if !strings.Contains(filtered, line) {
+			t.Fatalf("Allowed directive %s should be kept: %s", line, filtered)
+		}
+	}
+	for _, line := range []string{"lua-load", "option http-use-htx", "listen evil", "bind :9999", "server"} {
+		if strings.Contains(filtered, line) {
+			t.Fatalf("Directive %s should be dropped: %s", line, filtered)
+		}
+	}
+	if filterCustomConfig(custom, nil) != custom {
+		t.Fatalf("Custom config should be kept when no directive list is set")
+	}
+}
+
+func TestHaproxyConfigCheckPort(t *testing.T) {
+	hc := &config.HealthCheck{ResponseTimeout: 2000, Interval: 2000, HealthyThreshold: 2, UnhealthyThreshold: 3, Port: 8080, RequestLine: "GET /healthz HTTP/1.0"}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 8080, Protocol: config.HTTPProto, HealthCheck: hc, CheckPort: 9000,
+						Endpoints: []*config.Endpoint{{Name: "ep1", IP: "10.1.1.1", Port: 8080}}},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "10.1.1.1:8080") || !strings.Contains(out, "check port 9000 inter 2000 rise 2 fall 3") {
+		t.Fatalf("Endpoint should be checked on the check port: %s", out)
+	}
+	if !strings.Contains(out, "option httpchk GET /healthz HTTP/1.0") {
+		t.Fatalf("Check request line should be kept: %s", out)
+	}
+}
+
+func TestHaproxyConfigCheckExpect(t *testing.T) {
+	hc := &config.HealthCheck{ResponseTimeout: 2000, Interval: 2000, HealthyThreshold: 2, UnhealthyThreshold: 3, Port: 8080, RequestLine: "GET /healthz HTTP/1.0",
+		Expect: &config.HealthCheckExpect{Match: "string", Pattern: "all good"}}
+	headerHC := *hc
+	headerHC.Expect = &config.HealthCheckExpect{Match: "header", Header: "X-Health", Pattern: "ok"}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 8080, Protocol: config.HTTPProto, HealthCheck: hc, Path: "/api",
+						Endpoints: []*config.Endpoint{{Name: "ep1", IP: "10.1.1.1", Port: 8080}}},
+					{UUID: "auth", Port: 8080, Protocol: config.HTTPProto, HealthCheck: &headerHC, Path: "/auth",
+						Endpoints: []*config.Endpoint{{Name: "ep2", IP: "10.1.1.2", Port: 8080}}},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "http-check expect string all\\ good") {
+		t.Fatalf("Expected body match should be rendered: %s", out)
+	}
+	if !strings.Contains(out, "http-check expect hdr name X-Health value ok") {
+		t.Fatalf("Expected header match should be rendered: %s", out)
+	}
+}
+
+func TestHaproxyConfigInitState(t *testing.T) {
+	hc := &config.HealthCheck{ResponseTimeout: 2000, Interval: 2000, HealthyThreshold: 2, UnhealthyThreshold: 3, Port: 8080}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 8080, Protocol: config.HTTPProto, HealthCheck: hc, Path: "/api",
+						InitState: &config.InitState{Down: true, SlowStartMs: 30000},
+						Endpoints: []*config.Endpoint{{Name: "ep1", IP: "10.1.1.1", Port: 8080}}},
+					{UUID: "web", Port: 8080, Protocol: config.HTTPProto, HealthCheck: hc, Path: "/web",
+						Endpoints: []*config.Endpoint{{Name: "ep2", IP: "10.1.1.2", Port: 8080}}},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "check port 8080 inter 2000 rise 2 fall 3 init-state down slowstart 30000") {
+		t.Fatalf("Init state should be rendered: %s", out)
+	}
+	if strings.Count(out, "init-state") != 1 {
+		t.Fatalf("Init state should only be rendered for the api backend: %s", out)
+	}
+}
+
+func TestHaproxyConfigAgentCheck(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 8080, Protocol: config.HTTPProto, AgentCheck: &config.AgentCheck{Port: 9999, InterMs: 5000},
+						Endpoints: []*config.Endpoint{{Name: "ep1", IP: "10.1.1.1", Port: 8080}}},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "agent-check agent-port 9999 agent-inter 5000") {
+		t.Fatalf("Agent check should be rendered: %s", out)
+	}
+}
+
+func TestHaproxyConfigBackupEndpoints(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 8080, Protocol: config.HTTPProto,
+						Endpoints: []*config.Endpoint{{Name: "ep1", IP: "10.1.1.1", Port: 8080}, {Name: "ep2", IP: "10.1.1.2", Port: 8080, Backup: true}}},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "server ep2 10.1.1.2:8080  backup") || strings.Count(out, "backup") != 1 {
+		t.Fatalf("Backup endpoint should be rendered as backup server: %s", out)
+	}
+}
+
+func TestHaproxyConfigNoCheckEndpoints(t *testing.T) {
+	hc := &config.HealthCheck{ResponseTimeout: 2000, Interval: 2000, HealthyThreshold: 2, UnhealthyThreshold: 3, Port: 8080}
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 8080, Protocol: config.HTTPProto, HealthCheck: hc,
+						Endpoints: []*config.Endpoint{{Name: "ep1", IP: "10.1.1.1", Port: 8080, NoCheck: true}}},
+				},
+			},
+		},
+	}
+	if err := lbp.ProcessCustomConfig(lbConfig, ""); err != nil {
+		t.Fatalf("Error while process custom config: %v", err)
+	}
+	var b bytes.Buffer
+	if err := lbp.cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "server ep1 10.1.1.1:8080") || strings.Contains(out, "check port") {
+		t.Fatalf("No-check endpoint should be rendered without check: %s", out)
+	}
+}
+
+func TestHaproxyConfigHostMaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := *lbp.cfg
+	cfg.Config = dir + "/haproxy_new.cfg"
+	cfg.MapsDir = dir + "/maps"
+	cfg.AdminSocket = dir + "/admin.sock"
+	cfg.HostMapThreshold = 2
+	backend := func(uuid string, host string, path string) *config.BackendService {
+		return &config.BackendService{
+			UUID:           uuid,
+			Host:           host,
+			Path:           path,
+			Port:           80,
+			Protocol:       config.HTTPProto,
+			RuleComparator: config.EqRuleComparator,
+		}
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Name:   "test",
+		Config: "global\n    maxconn 4096\n",
+		FrontendServices: []*config.FrontendService{{
+			Name:     "80",
+			Port:     80,
+			Protocol: config.HTTPProto,
+			BackendServices: []*config.BackendService{
+				backend("a", "A.com", ""),
+				backend("b", "b.com", "/api"),
+				backend("c", "c.com", ""),
+				// shadowed by the b.com path rule, stays an acl
+				backend("b2", "b.com", ""),
+			},
+		}},
+	}
+	update, err := cfg.writeConfig(lbConfig)
+	if err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	if !update.changed() {
+		t.Fatalf("The new host map should be reported")
+	}
+	rendered, _ := ioutil.ReadFile(cfg.Config)
+	mapFile := cfg.MapsDir + "/80.map"
+	for _, expected := range []string{
+		fmt.Sprintf("global\n    stats socket %s mode 600 level user\n    stats socket %s mode 600 level admin\n    maxconn 4096\n", statsSocket, cfg.AdminSocket),
+		fmt.Sprintf("use_backend %%[req.hdr(host),lower,map_str(%s)] if { req.hdr(host),lower,map_str(%s) -m found }\nacl b_host", mapFile, mapFile),
+		"acl b2_host hdr(host) -i b.com\n",
+	} {
+		if !strings.Contains(string(rendered), expected) {
+			t.Fatalf("Missing %q in the config:\n%s", expected, rendered)
+		}
+	}
+	if strings.Contains(string(rendered), "acl a_host") || strings.Contains(string(rendered), "acl c_host") {
+		t.Fatalf("Mapped hosts should not have acls:\n%s", rendered)
+	}
+	entries, _ := ioutil.ReadFile(mapFile)
+	if string(entries) != "a.com a\na.com:80 a\nc.com c\nc.com:80 c\n" {
+		t.Fatalf("Unexpected host map:\n%s", entries)
+	}
+
+	// the changed hosts are sent to the admin socket
+	l, err := net.Listen("unix", cfg.AdminSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmds := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			cmds <- strings.TrimSpace(line)
+			conn.Write([]byte("\n"))
+			conn.Close()
+		}
+	}()
+	lbConfig.FrontendServices[0].BackendServices[2].Host = "e.com"
+	if update, err = cfg.writeConfig(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	if err := cfg.updateHostMaps(update.previous, update.maps); err != nil {
+		t.Fatalf("Error while updating the host maps: %v", err)
+	}
+	close(cmds)
+	var sent []string
+	for cmd := range cmds {
+		sent = append(sent, cmd)
+	}
+	expected := []string{
+		fmt.Sprintf("add map %s e.com c", mapFile),
+		fmt.Sprintf("add map %s e.com:80 c", mapFile),
+		fmt.Sprintf("del map %s c.com", mapFile),
+		fmt.Sprintf("del map %s c.com:80", mapFile),
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("Expected %v to be sent, got %v", expected, sent)
+	}
+
+	// below the threshold the map is removed
+	cfg.HostMapThreshold = 3
+	if _, err := cfg.writeConfig(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	if _, err := os.Stat(mapFile); !os.IsNotExist(err) {
+		t.Fatalf("The unused host map should be removed")
+	}
+	rendered, _ = ioutil.ReadFile(cfg.Config)
+	if !strings.Contains(string(rendered), "acl a_host hdr(host) -i A.com\n") || strings.Contains(string(rendered), "level admin") {
+		t.Fatalf("Hosts should be routed with acls below the threshold:\n%s", rendered)
+	}
+}
+
+func TestHaproxyConfigLuaHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, script := range []string{"auth.lua", "rewrite.lua"} {
+		if err := ioutil.WriteFile(dir+"/"+script, []byte("-- test\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := *lbp.cfg
+	cfg.LuaDir = dir
+	lbConfig := &config.LoadBalancerConfig{
+		Name:   "test",
+		Config: "global\n    maxconn 4096\n",
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				LuaHooks: []*config.LuaHook{{Script: "auth.lua", Action: "check_token"}},
+				BackendServices: []*config.BackendService{{
+					UUID:     "api",
+					Port:     80,
+					Protocol: config.HTTPProto,
+					LuaHooks: []*config.LuaHook{{Script: "rewrite.lua", Action: "rewrite_path"}},
+				}},
+			},
+			{
+				Name:     "3306",
+				Port:     3306,
+				Protocol: config.TCPProto,
+				LuaHooks: []*config.LuaHook{{Script: "auth.lua", Action: "check_source"}},
+				BackendServices: []*config.BackendService{{
+					UUID:     "db",
+					Port:     3306,
+					Protocol: config.TCPProto,
+				}},
+			},
+		},
+	}
+	var b bytes.Buffer
+	if err := cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("global\n    stats socket %s mode 600 level user\n    lua-load %s/auth.lua\n    lua-load %s/rewrite.lua\n    maxconn 4096\n", statsSocket, dir, dir),
+		"http-request lua.check_token\ndefault_backend api\n",
+		"tcp-request content lua.check_source\ndefault_backend db\n",
+		"mode http\nhttp-request lua.rewrite_path\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Fatalf("Missing %q in the config:\n%s", expected, b.String())
+		}
+	}
+
+	// the frontends don't run without their scripts
+	lbConfig.FrontendServices[1].LuaHooks[0].Script = "missing.lua"
+	if err := cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err == nil || !strings.Contains(err.Error(), "missing.lua") {
+		t.Fatalf("The missing script should fail the config, got %v", err)
+	}
+}
+
+func TestHaproxyConfigSPOE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := *lbp.cfg
+	cfg.Config = dir + "/haproxy_new.cfg"
+	cfg.SPOEDir = dir + "/spoe"
+	engine := &config.SPOEngine{
+		Name:   "auth",
+		Agents: []string{"10.42.0.5:12345", "10.42.0.6:12345"},
+		Messages: []*config.SPOMessage{
+			{Name: "check-request", Event: "on-frontend-http-request", Args: []string{"ip=src", "path=path"}},
+		},
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Name: "test",
+		FrontendServices: []*config.FrontendService{{
+			Name:       "80",
+			Port:       80,
+			Protocol:   config.HTTPProto,
+			SPOEngines: []string{"auth"},
+			BackendServices: []*config.BackendService{{
+				UUID:     "foo",
+				Port:     80,
+				Protocol: config.HTTPProto,
+			}},
+		}},
+		SPOEngines: []*config.SPOEngine{engine, {Name: "unused", Agents: []string{"10.42.0.7:1"}, Messages: engine.Messages}},
+	}
+	if err := cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	files, _ := ioutil.ReadDir(cfg.SPOEDir)
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), "auth-") {
+		t.Fatalf("The config of the used engine should be written, got %v", files)
+	}
+	spoeFile := cfg.SPOEDir + "/" + files[0].Name()
+	spoeConfig, _ := ioutil.ReadFile(spoeFile)
+	expectedConfig := "[auth]\nspoe-agent auth-agent\n    messages check-request\n    option var-prefix auth\n" +
+		"    timeout hello 2s\n    timeout idle 30s\n    timeout processing 500ms\n    use-backend spoe_auth\n\n" +
+		"spoe-message check-request\n    args ip=src path=path\n    event on-frontend-http-request\n"
+	if string(spoeConfig) != expectedConfig {
+		t.Fatalf("Unexpected spoe config:\n%s", spoeConfig)
+	}
+	rendered, _ := ioutil.ReadFile(cfg.Config)
+	for _, expected := range []string{
+		fmt.Sprintf("filter spoe engine auth config %s\n", spoeFile),
+		"backend spoe_auth\nmode tcp\nbalance roundrobin\nserver agent0 10.42.0.5:12345 check\nserver agent1 10.42.0.6:12345 check\n",
+	} {
+		if !strings.Contains(string(rendered), expected) {
+			t.Fatalf("Missing %q in the config:\n%s", expected, rendered)
+		}
+	}
+	if strings.Contains(string(rendered), "spoe_unused") {
+		t.Fatalf("Unused engines should not be rendered:\n%s", rendered)
+	}
+
+	// a changed engine is written to a new file, the old one is removed
+	engine.TimeoutMs = 200
+	if err := cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	files, _ = ioutil.ReadDir(cfg.SPOEDir)
+	if len(files) != 1 || cfg.SPOEDir+"/"+files[0].Name() == spoeFile {
+		t.Fatalf("The changed engine should be written to a new file, got %v", files)
+	}
+}
+
+func TestHaproxyConfigRequestLogging(t *testing.T) {
+	cfg := *lbp.cfg
+	until := time.Now().Add(time.Hour)
+	lbConfig := &config.LoadBalancerConfig{
+		Name:   "test",
+		Config: "global\n    maxconn 4096\n",
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{
+					{UUID: "api", Port: 80, Protocol: config.HTTPProto, RequestLogging: &config.RequestLogging{Until: until, SampleRate: 10}},
+					{UUID: "web", Port: 80, Protocol: config.HTTPProto, Path: "/web", RequestLogging: &config.RequestLogging{Until: until, SampleRate: 1}},
+				},
+			},
+			{
+				Name:            "81",
+				Port:            81,
+				Protocol:        config.HTTPProto,
+				BackendServices: []*config.BackendService{{UUID: "other", Port: 80, Protocol: config.HTTPProto}},
+			},
+		},
+	}
+	var b bytes.Buffer
+	if err := cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+		t.Fatalf("Error while rendering haproxy config: %v", err)
+	}
+	out := b.String()
+	for _, expected := range []string{
+		"log 127.0.0.1:8514 len 8192 local0 info\noption httplog\nhttp-request set-log-level silent\n",
+		"http-request set-log-level info if { rand(10) -m int 0 }\n",
+		"http-request set-log-level info\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("Missing %q in config:\n%s", expected, out)
+		}
+	}
+	if strings.Count(out, "option httplog") != 1 {
+		t.Fatalf("Only the frontend of the logged backends should log requests:\n%s", out)
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lbConfig := &config.LoadBalancerConfig{
+		FrontendServices: []*config.FrontendService{{
+			Name:     "80",
+			Port:     80,
+			Protocol: config.HTTPProto,
+			BackendServices: []*config.BackendService{{
+				UUID:      "web",
+				Port:      8080,
+				Protocol:  config.HTTPProto,
+				Endpoints: []*config.Endpoint{{Name: "web1", IP: "10.1.1.1", Port: 8080}},
+			}},
+		}},
+	}
+	paths, err := lbp.RenderConfig(lbConfig, dir)
+	if err != nil {
+		t.Fatalf("Failed to render config: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != filepath.Join(dir, "haproxy.cfg") {
+		t.Fatalf("Unexpected rendered paths %v", paths)
+	}
+	b, err := ioutil.ReadFile(paths[0])
+	if err != nil || !strings.Contains(string(b), "backend web\n") {
+		t.Fatalf("Config should be rendered %s %v", b, err)
+	}
+	if lbp.cfg.Config != "test_data/haproxy_new.cfg" {
+		t.Fatalf("Rendering shouldn't change the provider config %s", lbp.cfg.Config)
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := *lbp.cfg
+	cfg.Config = filepath.Join(dir, "haproxy_new.cfg")
+	cfg.LiveConfig = filepath.Join(dir, "haproxy.cfg")
+	cfg.CertDir = filepath.Join(dir, "certs")
+	cfg.ReloadCmd = fmt.Sprintf("cp %s %s", cfg.Config, cfg.LiveConfig)
+	p := &Provider{cfg: &cfg}
+	if drift, err := p.CheckDrift(); drift != nil || err != nil {
+		t.Fatalf("Drift shouldn't be checked before the first apply %+v %v", drift, err)
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Name: "lb",
+		FrontendServices: []*config.FrontendService{{
+			Name:     "80",
+			Port:     80,
+			Protocol: config.HTTPProto,
+			BackendServices: []*config.BackendService{{
+				UUID:      "web",
+				Port:      8080,
+				Protocol:  config.HTTPProto,
+				Endpoints: []*config.Endpoint{{Name: "web1", IP: "10.1.1.1", Port: 8080}},
+			}},
+		}},
+	}
+	if err := p.applyHaproxyConfig(lbConfig); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	if drift, err := p.CheckDrift(); drift != nil || err != nil {
+		t.Fatalf("Applied config shouldn't drift %+v %v", drift, err)
+	}
+
+	if err := ioutil.WriteFile(cfg.LiveConfig, []byte("global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := p.CheckDrift()
+	if err != nil || drift == nil {
+		t.Fatalf("Modified live config should drift %v", err)
+	}
+	if drift.ConfigName != "lb" || drift.Path != cfg.LiveConfig || drift.Actual == "" || drift.Actual == drift.Expected {
+		t.Fatalf("Invalid drift %+v", drift)
+	}
+	os.Remove(cfg.LiveConfig)
+	if drift, err := p.CheckDrift(); err != nil || drift == nil || drift.Actual != "" {
+		t.Fatalf("Removed live config should drift %+v %v", drift, err)
+	}
+
+	// the reapply restores the live config
+	if err := p.applyHaproxyConfig(lbConfig); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	if drift, err := p.CheckDrift(); drift != nil || err != nil {
+		t.Fatalf("Reapplied config shouldn't drift %+v %v", drift, err)
+	}
+}
+
+func TestHealDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := *lbp.cfg
+	cfg.Config = filepath.Join(dir, "haproxy_new.cfg")
+	cfg.LiveConfig = filepath.Join(dir, "haproxy.cfg")
+	cfg.CertDir = filepath.Join(dir, "certs")
+	cfg.ReloadCmd = fmt.Sprintf("cp %s %s", cfg.Config, cfg.LiveConfig)
+	p := &Provider{cfg: &cfg}
+	if drift, err := p.healDrift(); drift != nil || err != nil {
+		t.Fatalf("Nothing should be healed before the first apply %+v %v", drift, err)
+	}
+	lbConfig := &config.LoadBalancerConfig{
+		Name: "lb",
+		FrontendServices: []*config.FrontendService{{
+			Name:     "80",
+			Port:     80,
+			Protocol: config.HTTPProto,
+			BackendServices: []*config.BackendService{{
+				UUID:      "web",
+				Port:      8080,
+				Protocol:  config.HTTPProto,
+				Endpoints: []*config.Endpoint{{Name: "web1", IP: "10.1.1.1", Port: 8080}},
+			}},
+		}},
+	}
+	if err := p.applyHaproxyConfig(lbConfig); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	expected, err := ioutil.ReadFile(cfg.LiveConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the written config is checked too
+	if err := ioutil.WriteFile(cfg.Config, []byte("global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := p.healDrift()
+	if err != nil || drift == nil || drift.Path != cfg.Config {
+		t.Fatalf("Modified written config should be healed %+v %v", drift, err)
+	}
+	os.Remove(cfg.LiveConfig)
+	drift, err = p.healDrift()
+	if err != nil || drift == nil || drift.Path != cfg.LiveConfig || drift.Actual != "" {
+		t.Fatalf("Removed live config should be healed %+v %v", drift, err)
+	}
+	for _, path := range []string{cfg.Config, cfg.LiveConfig} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(b, expected) {
+			t.Fatalf("Config %s should be reapplied %v", path, err)
+		}
+	}
+	if drift, err := p.healDrift(); drift != nil || err != nil {
+		t.Fatalf("Healed config shouldn't drift %+v %v", drift, err)
+	}
+}
+
+func TestParseHaproxyVersion(t *testing.T) {
+	tests := map[string]string{
+		"HA-Proxy version 1.8.14-52e4d43 2018/09/20\nCopyright 2000-2018 Willy Tarreau": "1.8.14",
+		"HAProxy version 2.2.3-0e58a34 2020/09/08 - https://haproxy.org/":               "2.2.3",
+		"2.1": "2.1.0",
+	}
+	for output, expected := range tests {
+		v, err := parseHaproxyVersion(output)
+		if err != nil || v.String() != expected {
+			t.Fatalf("Expected version %s for %q, got %v %v", expected, output, v, err)
+		}
+	}
+	if _, err := parseHaproxyVersion("haproxy: command not found"); err == nil {
+		t.Fatalf("Invalid version should fail to parse")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	lbConfig := &config.LoadBalancerConfig{
+		Name:   "lb",
+		Config: "global\n    maxconn 4096\n",
+		FrontendServices: []*config.FrontendService{{
+			Name:     "80",
+			Port:     80,
+			Protocol: config.HTTPProto,
+			H2C:      true,
+			BackendServices: []*config.BackendService{{
+				UUID:      "grpc",
+				Port:      8080,
+				Protocol:  config.HTTPProto,
+				Endpoints: []*config.Endpoint{{Name: "grpc1", IP: "10.1.1.1", Port: 8080}},
+				KeepAlive: &config.KeepAlive{PoolMaxConn: 10},
+				H2:        true,
+			}},
+		}},
+	}
+	render := func(version string) string {
+		cfg := *lbp.cfg
+		cfg.AdminSocket = adminSocket
+		if version != "" {
+			cfg.Capabilities = &capabilityDetector{Override: version}
+		}
+		var b bytes.Buffer
+		if err := cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/certs/current"); err != nil {
+			t.Fatalf("Failed to render config: %v", err)
+		}
+		return b.String()
+	}
+
+	// the configs of an unknown version are rendered as before
+	out := render("")
+	if !strings.Contains(out, "option http-use-htx") || !strings.Contains(out, "proto h2") || strings.Contains(out, "http-reuse") {
+		t.Fatalf("Unexpected config for unknown version:\n%s", out)
+	}
+	out = render("1.8.14")
+	if strings.Contains(out, "option http-use-htx") || strings.Contains(out, "proto h2") || !strings.Contains(out, "http-reuse safe") || strings.Contains(out, "pool-max-conn") {
+		t.Fatalf("Unexpected config for 1.8:\n%s", out)
+	}
+	if strings.Contains(out, adminSocket) {
+		t.Fatalf("1.8 shouldn't update the certs through the admin socket:\n%s", out)
+	}
+	out = render("2.0.1")
+	if !strings.Contains(out, "option http-use-htx") || !strings.Contains(out, "proto h2") || !strings.Contains(out, "pool-max-conn 10") {
+		t.Fatalf("Unexpected config for 2.0:\n%s", out)
+	}
+	out = render("2.2.3")
+	if strings.Contains(out, "option http-use-htx") || !strings.Contains(out, "proto h2") || !strings.Contains(out, "stats socket "+adminSocket) {
+		t.Fatalf("Unexpected config for 2.2:\n%s", out)
+	}
+
+	tuned := &config.LoadBalancerConfig{Name: "lb", Tuning: &config.Tuning{Threads: 4, MaxConn: 100}}
+	newCapabilities(haproxyVersion{Major: 1, Minor: 7}).gateTuning(tuned)
+	if tuned.Tuning.Threads != 0 || tuned.Tuning.MaxConn != 100 {
+		t.Fatalf("Threads should be dropped for 1.7 %+v", tuned.Tuning)
+	}
+	var unknown *capabilities
+	tuned.Tuning.Threads = 4
+	if unknown.gateTuning(tuned); tuned.Tuning.Threads != 4 {
+		t.Fatalf("Threads should be kept for unknown version %+v", tuned.Tuning)
+	}
+}
+
+// generateTestPEM returns the pem encoded key and self signed cert of the
+// hostname, as pem.EncodeToMemory ends them with a newline
+func generateTestPEM(t *testing.T, hostname string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestUpdateCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newDir, servedDir := filepath.Join(dir, "new"), filepath.Join(dir, "current")
+	for _, d := range []string{newDir, servedDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldKey, oldCert := generateTestPEM(t, "a.com")
+	newKey, newCert := generateTestPEM(t, "a.com")
+	sameKey, sameCert := generateTestPEM(t, "b.com")
+	writeCerts := func(d string, certs ...*config.Certificate) {
+		if err := writeCertificates(d, d, &config.LoadBalancerConfig{Certs: certs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCerts(servedDir, &config.Certificate{Name: "a.com", Key: oldKey, Cert: oldCert}, &config.Certificate{Name: "b.com", Key: sameKey, Cert: sameCert})
+	writeCerts(newDir, &config.Certificate{Name: "a.com", Key: newKey, Cert: newCert}, &config.Certificate{Name: "b.com", Key: sameKey, Cert: sameCert})
+	written, _ := ioutil.ReadFile(filepath.Join(newDir, "a.com.pem"))
+	if strings.Contains(string(written), "\n\n") {
+		t.Fatalf("Cert file shouldn't have blank lines, got:\n%s", written)
+	}
+
+	cfg := &haproxyConfig{AdminSocket: filepath.Join(dir, "admin.sock")}
+	l, err := net.Listen("unix", cfg.AdminSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmds := make(chan string, 10)
+	payloads := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			line, _ := r.ReadString('\n')
+			line = strings.TrimSpace(line)
+			cmds <- line
+			if strings.HasPrefix(line, "set ssl cert") {
+				// haproxy reads the payload up to the first blank line
+				var payload []string
+				for {
+					l, err := r.ReadString('\n')
+					if l = strings.TrimRight(l, "\n"); l == "" || err != nil {
+						break
+					}
+					payload = append(payload, l)
+				}
+				payloads <- strings.Join(payload, "\n")
+				conn.Write([]byte("Transaction created for certificate a.com.pem!\n"))
+			} else {
+				conn.Write([]byte("Committing a.com.pem.\nSuccess!\n"))
+			}
+			conn.Close()
+		}
+	}()
+	if err := cfg.updateCerts(newDir, servedDir); err != nil {
+		t.Fatalf("Failed to update certs: %v", err)
+	}
+	close(cmds)
+	close(payloads)
+	var received []string
+	for cmd := range cmds {
+		received = append(received, cmd)
+	}
+	served := filepath.Join(servedDir, "a.com.pem")
+	expected := []string{"set ssl cert " + served + " <<", "commit ssl cert " + served}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("Expected runtime commands %v, got %v", expected, received)
+	}
+	if payload := <-payloads; payload != strings.TrimRight(string(written), "\n") {
+		t.Fatalf("Expected the full key and cert in the payload, got:\n%s", payload)
+	}
+	if b, _ := ioutil.ReadFile(served); string(b) != string(written) {
+		t.Fatalf("Updated cert should be copied to the served dir, got %s", b)
+	}
+	// the files written with a blank line after the key are sent whole too
+	if payload := certPayload(newKey + "\n" + newCert); payload != strings.TrimRight(string(written), "\n") {
+		t.Fatalf("Blank lines should be dropped from the payload, got:\n%s", payload)
+	}
+
+	// the added certs are left to the reload
+	cKey, cCert := generateTestPEM(t, "c.com")
+	writeCerts(newDir, &config.Certificate{Name: "c.com", Key: cKey, Cert: cCert}, &config.Certificate{Name: "a.com", Key: oldKey, Cert: oldCert})
+	cfg.AdminSocket = ""
+	if err := cfg.updateCerts(newDir, servedDir); err != nil {
+		t.Fatalf("Added certs should be left to the reload: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(served); string(b) != string(written) {
+		t.Fatalf("Certs shouldn't be updated along with added ones, got %s", b)
+	}
+}
+
+func TestRemoteConfig(t *testing.T) {
+	remote := &remoteConfig{
+		Mode:      RemoteSSH,
+		Dir:       "/etc/haproxy/lb",
+		Target:    "admin@haproxy1",
+		ReloadCmd: "systemctl reload haproxy",
+		Runtime:   "127.0.0.1:0",
+	}
+	l, err := net.Listen("tcp", remote.Runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote.Runtime = l.Addr().String()
+	cfg := *lbp.cfg
+	cfg.Capabilities = &capabilityDetector{VersionCmd: "haproxy -v"}
+	remote.apply(&cfg)
+
+	if cfg.Config != "/etc/haproxy/lb/haproxy_new.cfg" || cfg.LiveConfig != "/etc/haproxy/lb/haproxy.cfg" || cfg.CertDir != "/etc/haproxy/lb/certs" {
+		t.Fatalf("Configs should be written to the remote dir %+v", cfg)
+	}
+	expected := "haproxy_remote_reload '/etc/haproxy/lb' ssh 'admin@haproxy1' 'systemctl reload haproxy' reload"
+	if cfg.ReloadCmd != expected {
+		t.Fatalf("Expected reload command %s, got %s", expected, cfg.ReloadCmd)
+	}
+	if cfg.Capabilities.VersionCmd != "ssh 'admin@haproxy1' haproxy -v" {
+		t.Fatalf("Version should be detected on the remote node, got %s", cfg.Capabilities.VersionCmd)
+	}
+	if cfg.TProxyCmd != "" || cfg.TCPLogAddress != "" {
+		t.Fatalf("Local node features should be off %+v", cfg)
+	}
+
+	// the external haproxy binds the runtime api on tcp
+	lbConfig := &config.LoadBalancerConfig{Name: "lb", Config: "global\n    maxconn 4096\n"}
+	var b bytes.Buffer
+	if err := cfg.renderTo(&b, lbConfig, 0, "/etc/haproxy/lb/certs/current"); err != nil {
+		t.Fatalf("Failed to render config: %v", err)
+	}
+	if !strings.Contains(b.String(), "stats socket "+remote.Runtime+" level admin\n") {
+		t.Fatalf("Expected the tcp runtime api in the config:\n%s", b.String())
+	}
+
+	// and the controller reaches it over tcp
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("received " + line))
+	}()
+	output, err := runtimeCommand(cfg.StatsSocket, "show info")
+	if err != nil {
+		t.Fatalf("Failed to run the runtime command over tcp: %v", err)
+	}
+	if output != "received show info\n" {
+		t.Fatalf("Unexpected runtime output %q", output)
+	}
+	if quoted := shellQuote("it's"); quoted != `'it'\''s'` {
+		t.Fatalf("Unexpected quoting %s", quoted)
+	}
+}
+
+func TestTicketKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := &ticketKeys{
+		Secret:   []byte("0123456789abcdef"),
+		Rotation: time.Hour,
+		Dir:      dir + "/tickets",
+	}
+	cfg := *lbp.cfg
+	cfg.Config = dir + "/haproxy_new.cfg"
+	cfg.TicketKeys = keys
+	lbConfig := &config.LoadBalancerConfig{
+		Name:   "lb",
+		Config: "global\n    maxconn 4096\n",
+		FrontendServices: []*config.FrontendService{
+			{Name: "443", Port: 443, Protocol: config.HTTPSProto},
+			{Name: "8443", Port: 8443, Protocol: config.TLSProto},
+			{Name: "80", Port: 80, Protocol: config.HTTPProto},
+		},
+	}
+	if err := cfg.write(lbConfig); err != nil {
+		t.Fatalf("Error while writing haproxy config: %v", err)
+	}
+	rendered, _ := ioutil.ReadFile(cfg.Config)
+	for _, expected := range []string{
+		"bind *:443 ssl crt /etc/haproxy/certs/current strict-sni tls-ticket-keys " + dir + "/tickets/443.keys\n",
+		"bind *:8443 ssl crt /etc/haproxy/certs/current strict-sni tls-ticket-keys " + dir + "/tickets/8443.keys\n",
+		"bind *:80\n",
+	} {
+		if !strings.Contains(string(rendered), expected) {
+			t.Fatalf("Expected %q in the config:\n%s", expected, rendered)
+		}
+	}
+	if _, err := os.Stat(dir + "/tickets/80.keys"); !os.IsNotExist(err) {
+		t.Fatalf("The plain frontends should have no ticket keys")
+	}
+
+	// the keys of the previous, the current and the next periods
+	period := keys.period(time.Now())
+	written, _ := ioutil.ReadFile(dir + "/tickets/443.keys")
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	if !reflect.DeepEqual(lines, keys.keys("lb", "443", period)) {
+		t.Fatalf("Unexpected keys %v", lines)
+	}
+	if len(lines) != 3 || lines[1] != keys.key("lb", "443", period) || lines[2] != keys.key("lb", "443", period+1) {
+		t.Fatalf("The current key should be the penultimate one %v", lines)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(lines[0]); err != nil || len(decoded) != 48 {
+		t.Fatalf("Keys should be 48 bytes base64 encoded, got %v bytes: %v", len(decoded), err)
+	}
+
+	// the instances sharing the secret derive the same keys
+	other := &ticketKeys{Secret: []byte("0123456789abcdef"), Rotation: time.Hour}
+	if other.key("lb", "443", period) != keys.key("lb", "443", period) {
+		t.Fatalf("Keys should be derived from the secret")
+	}
+	if keys.key("lb", "8443", period) == keys.key("lb", "443", period) ||
+		keys.key("lb2", "443", period) == keys.key("lb", "443", period) {
+		t.Fatalf("Keys should differ by lb and frontend")
+	}
+
+	// haproxy is reloaded once per rotation
+	if !keys.reloadNeeded() || keys.reloadNeeded() {
+		t.Fatalf("The reload should be needed once for the new keys")
+	}
+	now := time.Now()
+	if err := keys.write("lb", keys.files(lbConfig.FrontendServices), now); err != nil {
+		t.Fatal(err)
+	}
+	if keys.reloadNeeded() && keys.period(now) == period {
+		t.Fatalf("The keys of the same period shouldn't need a reload")
+	}
+	if err := keys.write("lb", keys.files(lbConfig.FrontendServices), keys.next(now)); err != nil {
+		t.Fatal(err)
+	}
+	if !keys.reloadNeeded() {
+		t.Fatalf("The keys of the next period should need a reload")
+	}
+	if next := keys.next(now); next.Sub(now) > time.Hour || next.Unix()%3600 != 0 {
+		t.Fatalf("Unexpected next rotation %v", next)
+	}
+
+	// the renders but the main instance's don't write its keys
+	p := &Provider{cfg: &cfg}
+	if _, err := p.RenderConfig(lbConfig, dir+"/render"); err != nil {
+		t.Fatal(err)
+	}
+	shadow := keys.forShadow()
+	if err := shadow.write("lb", shadow.files(lbConfig.FrontendServices), keys.next(keys.next(now))); err != nil {
+		t.Fatal(err)
+	}
+	if keys.reloadNeeded() {
+		t.Fatalf("The renders and the shadow keys shouldn't need a reload of the main instance")
+	}
+	if _, err := os.Stat(dir + "/tickets/shadow/443.keys"); err != nil {
+		t.Fatalf("The shadow keys should be written to their own dir: %v", err)
+	}
+
+	var nilKeys *ticketKeys
+	if nilKeys.files(lbConfig.FrontendServices) != nil || nilKeys.reloadNeeded() || nilKeys.forShadow() != nil {
+		t.Fatalf("Nil ticket keys should be a no-op")
+	}
+}
@@ -0,0 +1,190 @@
+package haproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	ticketKeySecretFile = flags.String("TLS_TICKET_KEY_SECRET_FILE", "", "File of the secret the TLS session ticket keys are derived from, a rancher secret shared by the lb instances so the sessions resume on any of them. haproxy generates its own keys when not set")
+	ticketKeyRotation   = flags.Duration("TLS_TICKET_KEY_ROTATION", 12*time.Hour, "Interval the TLS session ticket keys are rotated at, the tickets are resumed for up to twice the interval")
+)
+
+const ticketKeysDir = "/etc/haproxy/tickets"
+
+/*
+ticketKeys are the TLS session ticket keys of the tls frontends. The
+keys of a rotation period are derived from the shared secret, the lb
+and the frontend names, so all the instances of an lb encrypt the
+tickets with the same keys without talking to each other, and the
+frontends don't resume the sessions of each other. The clocks of the
+instances are assumed in sync.
+
+The key file of a frontend holds the keys of the previous, the current
+and the next periods: haproxy encrypts with the penultimate key and
+decrypts with all of them, so the tickets of the previous period still
+resume, and so do the ones of an instance already in the next period
+*/
+type ticketKeys struct {
+	Secret   []byte
+	Rotation time.Duration
+	Dir      string
+
+	mu sync.Mutex
+	// written and loaded are the periods of the keys
+	// written and the ones haproxy was reloaded with
+	written int64
+	loaded  int64
+}
+
+func newTicketKeysFromEnv() (*ticketKeys, error) {
+	file := ticketKeySecretFile.Get()
+	if file == "" {
+		return nil, nil
+	}
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read TLS_TICKET_KEY_SECRET_FILE: %v", err)
+	}
+	if len(strings.TrimSpace(string(secret))) < 16 {
+		return nil, fmt.Errorf("Invalid TLS_TICKET_KEY_SECRET_FILE %s, the secret should be at least 16 characters", file)
+	}
+	rotation := ticketKeyRotation.Get()
+	if rotation < time.Minute {
+		return nil, fmt.Errorf("Invalid TLS_TICKET_KEY_ROTATION %v, should be at least a minute", rotation)
+	}
+	return &ticketKeys{
+		Secret:   []byte(strings.TrimSpace(string(secret))),
+		Rotation: rotation,
+		Dir:      ticketKeysDir,
+	}, nil
+}
+
+// forShadow returns the keys of the shadow instance, derived as
+// k but written to a dir of their own, so the shadow loads don't
+// mark a reload of the main instance
+func (k *ticketKeys) forShadow() *ticketKeys {
+	if k == nil {
+		return nil
+	}
+	return &ticketKeys{
+		Secret:   k.Secret,
+		Rotation: k.Rotation,
+		Dir:      path.Join(k.Dir, "shadow"),
+	}
+}
+
+func (k *ticketKeys) period(t time.Time) int64 {
+	return t.Unix() / int64(k.Rotation/time.Second)
+}
+
+// next is the start of the next rotation period
+func (k *ticketKeys) next(t time.Time) time.Time {
+	return time.Unix((k.period(t)+1)*int64(k.Rotation/time.Second), 0)
+}
+
+// key derives the 48 bytes key of the frontend for the period
+func (k *ticketKeys) key(lbName, frontend string, period int64) string {
+	derive := func(block int) []byte {
+		mac := hmac.New(sha256.New, k.Secret)
+		fmt.Fprintf(mac, "tls-ticket-key|%s|%s|%d|%d", lbName, frontend, period, block)
+		return mac.Sum(nil)
+	}
+	key := append(derive(0), derive(1)[:16]...)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// keys are the keys of the previous, the current and the next periods
+func (k *ticketKeys) keys(lbName, frontend string, period int64) []string {
+	return []string{
+		k.key(lbName, frontend, period-1),
+		k.key(lbName, frontend, period),
+		k.key(lbName, frontend, period+1),
+	}
+}
+
+func (k *ticketKeys) file(frontend string) string {
+	return path.Join(k.Dir, frontend+".keys")
+}
+
+// files are the key files of the tls frontends by name, nil
+// when the ticket keys aren't managed
+func (k *ticketKeys) files(frontends []*config.FrontendService) map[string]string {
+	if k == nil {
+		return nil
+	}
+	files := map[string]string{}
+	for _, fe := range frontends {
+		if fe.Protocol == config.HTTPSProto || fe.Protocol == config.TLSProto {
+			files[fe.Name] = k.file(fe.Name)
+		}
+	}
+	return files
+}
+
+// write writes the key files of the frontends for the time
+func (k *ticketKeys) write(lbName string, files map[string]string, now time.Time) error {
+	if k == nil || len(files) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(k.Dir, 0700); err != nil {
+		return err
+	}
+	period := k.period(now)
+	for frontend, file := range files {
+		content := strings.Join(k.keys(lbName, frontend, period), "\n") + "\n"
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			return fmt.Errorf("Failed to write the ticket keys of frontend %s: %v", frontend, err)
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.written = period
+	return nil
+}
+
+// reloadNeeded tells whether the keys written are newer than the ones
+// haproxy runs, they are marked loaded as the reload follows
+func (k *ticketKeys) reloadNeeded() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	needed := k.written != k.loaded
+	k.loaded = k.written
+	return needed
+}
+
+// watchTicketKeys reapplies the config at the start of every rotation
+// period until the provider stops, so haproxy loads the new keys
+func (lbp *Provider) watchTicketKeys() {
+	keys := lbp.cfg.TicketKeys
+	for {
+		select {
+		case <-lbp.stopCh:
+			return
+		case <-time.After(keys.next(time.Now()).Sub(time.Now())):
+		}
+		lbp.applied.mu.Lock()
+		if lbp.applied.sum != "" {
+			logrus.Infof("Rotating the TLS session ticket keys")
+			if err := lbp.applyLocked(lbp.applied.config); err != nil {
+				logrus.Errorf("Failed to rotate the TLS session ticket keys: %v", err)
+			}
+		}
+		lbp.applied.mu.Unlock()
+	}
+}
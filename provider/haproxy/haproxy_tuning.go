@@ -0,0 +1,154 @@
+package haproxy
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/utils/cgroup"
+)
+
+const (
+	defaultMaxConn = 4096
+	defaultBufSize = 16384
+	smallBufSize   = 8192
+	// containers with less memory use the small buffers
+	smallMemory = 128 << 20
+	// connOverhead is the memory of a connection besides its two
+	// buffers, mostly the ssl context
+	connOverhead = 16384
+	maxThreads   = 64
+)
+
+var (
+	autoTune         = flags.Bool("AUTO_TUNE", true, "Size haproxy maxconn and buffers from the memory limit of the container")
+	autoTuneThreads  = flags.Bool("AUTO_TUNE_THREADS", false, "Run as many haproxy threads as the cpu limit of the container, requires haproxy 1.8+")
+	autoTuneInterval = flags.Duration("AUTO_TUNE_INTERVAL", time.Minute, "Interval the cgroup limits are read again at")
+	autoTuneMemory   = flags.Float("AUTO_TUNE_MEMORY_SHARE", 0.5, "Share of the memory limit for the haproxy connections, the rest is left to the reloads and the controller")
+)
+
+// tuner sizes the haproxy settings from the cgroup limits, the
+// limits are read again when they are older than the interval
+type tuner struct {
+	read     func() (cgroup.Limits, error)
+	interval time.Duration
+	threads  bool
+	// memoryShare is the share of the memory limit for the connections
+	memoryShare float64
+	now         func() time.Time
+
+	mu     sync.Mutex
+	readAt time.Time
+	tuning config.Tuning
+}
+
+func newTunerFromEnv() *tuner {
+	if !autoTune.Get() {
+		return nil
+	}
+	memoryShare := autoTuneMemory.Get()
+	if memoryShare <= 0 || memoryShare > 1 {
+		logrus.Warnf("Invalid AUTO_TUNE_MEMORY_SHARE %v, should be over 0 and up to 1", memoryShare)
+		memoryShare = autoTuneMemory.Default.(float64)
+	}
+	return &tuner{
+		read:        func() (cgroup.Limits, error) { return cgroup.Read(cgroup.DefaultRoot) },
+		interval:    autoTuneInterval.Get(),
+		threads:     autoTuneThreads.Get(),
+		memoryShare: memoryShare,
+		now:         time.Now,
+	}
+}
+
+// get returns the tuning of the current limits, the last
+// one is kept when the limits fail to be read
+func (t *tuner) get() config.Tuning {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if !t.readAt.IsZero() && now.Sub(t.readAt) < t.interval {
+		return t.tuning
+	}
+	t.readAt = now
+	limits, err := t.read()
+	if err != nil {
+		logrus.Errorf("Failed to read cgroup limits: %v", err)
+		return t.tuning
+	}
+	tuning := t.fromLimits(limits)
+	if tuning != t.tuning {
+		logrus.Infof("Tuning haproxy for memory limit %v and cpu limit %v: %+v", limits.MemoryBytes, limits.CPUs, tuning)
+	}
+	t.tuning = tuning
+	return tuning
+}
+
+// fromLimits sizes maxconn so the buffers of the connections fit in the
+// memory share, it's never raised over the default
+func (t *tuner) fromLimits(limits cgroup.Limits) config.Tuning {
+	tuning := config.Tuning{}
+	if limits.MemoryBytes > 0 {
+		tuning.BufSize = defaultBufSize
+		if limits.MemoryBytes < smallMemory {
+			tuning.BufSize = smallBufSize
+		}
+		connMemory := float64(2*tuning.BufSize + connOverhead)
+		tuning.MaxConn = int(float64(limits.MemoryBytes) * t.memoryShare / connMemory)
+		if tuning.MaxConn > defaultMaxConn {
+			tuning.MaxConn = defaultMaxConn
+		}
+		if tuning.MaxConn < 1 {
+			tuning.MaxConn = 1
+		}
+	}
+	if t.threads && limits.CPUs > 0 {
+		tuning.Threads = int(math.Ceil(limits.CPUs))
+		if tuning.Threads > maxThreads {
+			tuning.Threads = maxThreads
+		}
+	}
+	return tuning
+}
+
+// setTuning fills the settings of the config not set by
+// the labels with the ones from the cgroup limits
+func (t *tuner) setTuning(lbConfig *config.LoadBalancerConfig) {
+	auto := t.get()
+	if auto == (config.Tuning{}) {
+		return
+	}
+	if lbConfig.Tuning == nil {
+		lbConfig.Tuning = &config.Tuning{}
+	}
+	if lbConfig.Tuning.MaxConn == 0 {
+		lbConfig.Tuning.MaxConn = auto.MaxConn
+	}
+	if lbConfig.Tuning.BufSize == 0 {
+		lbConfig.Tuning.BufSize = auto.BufSize
+	}
+	if lbConfig.Tuning.Threads == 0 {
+		lbConfig.Tuning.Threads = auto.Threads
+	}
+}
+
+// applyTuning overrides the default global and defaults settings,
+// the custom config still takes precedence
+func applyTuning(defaultConfig map[string]map[string]string, tuning *config.Tuning) {
+	if tuning == nil {
+		return
+	}
+	if tuning.MaxConn > 0 {
+		defaultConfig["global"]["maxconn"] = strconv.Itoa(tuning.MaxConn)
+		defaultConfig["defaults"]["maxconn"] = strconv.Itoa(tuning.MaxConn)
+	}
+	if tuning.BufSize > 0 {
+		defaultConfig["global"]["tune.bufsize"] = strconv.Itoa(tuning.BufSize)
+	}
+	if tuning.Threads > 1 {
+		defaultConfig["global"]["nbthread"] = strconv.Itoa(tuning.Threads)
+	}
+}
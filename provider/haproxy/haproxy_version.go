@@ -0,0 +1,284 @@
+package haproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+	"github.com/rancher/lb-controller/provider"
+)
+
+var haproxyVersionOverride = flags.String("HAPROXY_VERSION", "", "Version of the haproxy the configs are rendered for, like 2.2. It is detected from the haproxy binary when not set")
+
+// haproxyVersionRegexp matches the version of haproxy -v, as
+// "HA-Proxy version 1.8.14-52e4d43 2018/09/20" or "HAProxy version 2.2.3"
+var haproxyVersionRegexp = regexp.MustCompile(`(?i)^(?:ha-?proxy version )?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Features of the haproxy versions
+const (
+	FeatureThreads      = "threads"
+	FeatureSPOE         = "spoe"
+	FeatureH2C          = "h2c"
+	FeatureHTTPReuse    = "http_reuse"
+	FeatureRuntimeCerts = "runtime_certs"
+	FeatureServerPools  = "server_pools"
+)
+
+type haproxyVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v haproxyVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v haproxyVersion) atLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func parseHaproxyVersion(output string) (haproxyVersion, error) {
+	match := haproxyVersionRegexp.FindStringSubmatch(strings.TrimSpace(output))
+	if match == nil {
+		return haproxyVersion{}, fmt.Errorf("Invalid haproxy version %q", output)
+	}
+	v := haproxyVersion{}
+	v.Major, _ = strconv.Atoi(match[1])
+	v.Minor, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		v.Patch, _ = strconv.Atoi(match[3])
+	}
+	return v, nil
+}
+
+/*
+capabilities are the features of the running haproxy. The directives
+of the features it lacks are left out of the configs, and the features
+the configs don't ask for are turned on when it has them: the http
+backends reuse the server connections, and the certificates changed
+alone are updated through the admin socket without reload. The configs
+are rendered as before when the version is unknown
+*/
+type capabilities struct {
+	Version haproxyVersion
+	// Threads is nbthread, 1.8+
+	Threads bool
+	// SPOE is the spoe filter, 1.7+
+	SPOE bool
+	// H2C is the HTTP/2 to the servers, 1.9+. HTXOption is the
+	// option http-use-htx it takes before htx is the default in 2.1
+	H2C       bool
+	HTXOption bool
+	// HTTPReuse is the connection reuse to the servers, 1.6+
+	HTTPReuse bool
+	// RuntimeCerts is the certificate update through the runtime api, 2.1+
+	RuntimeCerts bool
+	// ServerPools are the pool-purge-delay and the pool-max-conn
+	// settings of the idle server connections, 2.0+
+	ServerPools bool
+}
+
+func newCapabilities(v haproxyVersion) *capabilities {
+	return &capabilities{
+		Version:      v,
+		Threads:      v.atLeast(1, 8),
+		SPOE:         v.atLeast(1, 7),
+		H2C:          v.atLeast(1, 9),
+		HTXOption:    v.atLeast(1, 9) && !v.atLeast(2, 1),
+		HTTPReuse:    v.atLeast(1, 6),
+		RuntimeCerts: v.atLeast(2, 1),
+		ServerPools:  v.atLeast(2, 0),
+	}
+}
+
+func (c *capabilities) features() map[string]bool {
+	return map[string]bool{
+		FeatureThreads:      c.Threads,
+		FeatureSPOE:         c.SPOE,
+		FeatureH2C:          c.H2C,
+		FeatureHTTPReuse:    c.HTTPReuse,
+		FeatureRuntimeCerts: c.RuntimeCerts,
+		FeatureServerPools:  c.ServerPools,
+	}
+}
+
+// capabilityDetector detects the version of haproxy on first use,
+// from the override or the output of the version command
+type capabilityDetector struct {
+	Override   string
+	VersionCmd string
+
+	once sync.Once
+	caps *capabilities
+}
+
+func newCapabilityDetector() *capabilityDetector {
+	return &capabilityDetector{
+		Override:   haproxyVersionOverride.Get(),
+		VersionCmd: "haproxy -v",
+	}
+}
+
+// get returns the capabilities, nil when the version is unknown
+func (d *capabilityDetector) get() *capabilities {
+	if d == nil {
+		return nil
+	}
+	d.once.Do(func() {
+		output := d.Override
+		if output == "" && d.VersionCmd == "" {
+			logrus.Warnf("haproxy version can't be detected, set HAPROXY_VERSION to render the configs for its features")
+			return
+		}
+		if output == "" {
+			b, err := exec.Command("sh", "-c", d.VersionCmd).Output()
+			if err != nil {
+				logrus.Warnf("Failed to detect the haproxy version, rendering the configs for any version: %v", err)
+				return
+			}
+			output = string(b)
+		}
+		v, err := parseHaproxyVersion(output)
+		if err != nil {
+			logrus.Warnf("%v, rendering the configs for any version", err)
+			return
+		}
+		d.caps = newCapabilities(v)
+		logrus.Infof("Rendering the configs for haproxy %s with the features %v", v, d.caps.features())
+	})
+	return d.caps
+}
+
+// capabilities returns the capabilities of the running haproxy, nil when unknown
+func (cfg *haproxyConfig) capabilities() *capabilities {
+	return cfg.Capabilities.get()
+}
+
+// GetCapabilities reports the version of the running haproxy and its features
+func (lbp *Provider) GetCapabilities() (*provider.Capabilities, error) {
+	caps := lbp.cfg.capabilities()
+	if caps == nil {
+		return nil, fmt.Errorf("haproxy version is unknown")
+	}
+	return &provider.Capabilities{
+		Version:  caps.Version.String(),
+		Features: caps.features(),
+	}, nil
+}
+
+// gateTuning drops the tuning of the features the haproxy lacks
+func (c *capabilities) gateTuning(lbConfig *config.LoadBalancerConfig) {
+	if c == nil || lbConfig.Tuning == nil {
+		return
+	}
+	if lbConfig.Tuning.Threads > 1 && !c.Threads {
+		logrus.Warnf("haproxy %s doesn't run threads, ignoring the %v threads of lb [%s]", c.Version, lbConfig.Tuning.Threads, lbConfig.Name)
+		lbConfig.Tuning.Threads = 0
+	}
+}
+
+/*
+updateCerts applies the certificates changed in the new cert dir to the
+running haproxy through the admin socket, and copies them to the served
+dir so they don't reload it. The certificates added or removed, and the
+crt-lists and the bundles changed, are left to the reload
+*/
+func (cfg *haproxyConfig) updateCerts(newDir, servedDir string) error {
+	newFiles, err := readCertFiles(newDir)
+	if err != nil {
+		return err
+	}
+	servedFiles, err := readCertFiles(servedDir)
+	if err != nil {
+		return err
+	}
+	if len(newFiles) != len(servedFiles) {
+		return nil
+	}
+	var changed []string
+	for name, content := range newFiles {
+		served, ok := servedFiles[name]
+		if !ok {
+			return nil
+		}
+		if content == served {
+			continue
+		}
+		if !strings.HasSuffix(name, ".pem") {
+			return nil
+		}
+		changed = append(changed, name)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if cfg.AdminSocket == "" {
+		return fmt.Errorf("no admin socket")
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		servedPath := path.Join(servedDir, name)
+		cmd := fmt.Sprintf("set ssl cert %s <<\n%s\n", servedPath, certPayload(newFiles[name]))
+		output, err := runtimeCommand(cfg.AdminSocket, cmd)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(output, "Transaction created") && !strings.Contains(output, "Transaction updated") {
+			return fmt.Errorf("set ssl cert %s failed: %s", servedPath, strings.TrimSpace(output))
+		}
+		if output, err = runtimeCommand(cfg.AdminSocket, "commit ssl cert "+servedPath); err != nil {
+			return err
+		}
+		if !strings.Contains(output, "Success") {
+			return fmt.Errorf("commit ssl cert %s failed: %s", servedPath, strings.TrimSpace(output))
+		}
+		if err := ioutil.WriteFile(servedPath, []byte(newFiles[name]), 0644); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Updated %v certificate(s) without reload", len(changed))
+	return nil
+}
+
+// certPayload returns the pem of the runtime cert updates without the
+// empty lines, haproxy ends the payload at the first one
+func certPayload(pem string) string {
+	var lines []string
+	for _, line := range strings.Split(pem, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readCertFiles returns the content of the files of the dir by name
+func readCertFiles(dir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	contents := map[string]string{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		contents[f.Name()] = string(b)
+	}
+	return contents, nil
+}
@@ -0,0 +1,202 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	// PreApplyStage is passed to the hooks invoked before ApplyConfig
+	PreApplyStage = "pre_apply"
+	// PostApplyStage is passed to the hooks invoked after ApplyConfig
+	PostApplyStage = "post_apply"
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+var (
+	preApplyHook     = flags.String("PRE_APPLY_HOOK", "", "Command run before a config is applied, the apply is aborted when it fails")
+	postApplyHook    = flags.String("POST_APPLY_HOOK", "", "Command run after a config is applied, its failure is only logged")
+	applyHookTimeout = flags.Duration("APPLY_HOOK_TIMEOUT", defaultHookTimeout, "Timeout of the apply hook commands")
+)
+
+// ApplyHook is invoked before and after the provider applies the config.
+// An error returned by PreApply aborts the apply; PostApply receives
+// the result of the apply and its error is only logged. The configs
+// pending promotion are passed to PostApply once they are promoted
+type ApplyHook interface {
+	PreApply(lbConfig *config.LoadBalancerConfig) error
+	PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error
+}
+
+// CleanupHook is optionally implemented by apply hooks
+// interested in the removal of a config
+type CleanupHook interface {
+	PostCleanup(configName string) error
+}
+
+type hookedProvider struct {
+	LBProvider
+	hooks []ApplyHook
+}
+
+// WithHooks wraps the provider so the hooks are invoked around ApplyConfig.
+// The providers holding configs pending promotion are wrapped without
+// hooks too, so their pending applies don't fail
+func WithHooks(lbp LBProvider, hooks ...ApplyHook) LBProvider {
+	if _, ok := lbp.(ShadowProvider); len(hooks) == 0 && !ok {
+		return lbp
+	}
+	return &hookedProvider{
+		LBProvider: lbp,
+		hooks:      hooks,
+	}
+}
+
+func (p *hookedProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	for _, hook := range p.hooks {
+		if err := hook.PreApply(lbConfig); err != nil {
+			return fmt.Errorf("Pre apply hook failed for lb [%s]: %v", lbConfig.Name, err)
+		}
+	}
+	applyErr := p.LBProvider.ApplyConfig(lbConfig)
+	if applyErr == ErrPendingPromotion {
+		// the main instance is unchanged, the config isn't applied yet
+		logrus.Debugf("Config for lb [%s] is pending promotion, post apply hooks are deferred", lbConfig.Name)
+		return nil
+	}
+	p.postApply(lbConfig, applyErr)
+	return applyErr
+}
+
+func (p *hookedProvider) postApply(lbConfig *config.LoadBalancerConfig, applyErr error) {
+	for _, hook := range p.hooks {
+		if err := hook.PostApply(lbConfig, applyErr); err != nil {
+			logrus.Errorf("Post apply hook failed for lb [%s]: %v", lbConfig.Name, err)
+		}
+	}
+}
+
+func (p *hookedProvider) CleanupConfig(configName string) error {
+	if err := p.LBProvider.CleanupConfig(configName); err != nil {
+		return err
+	}
+	for _, hook := range p.hooks {
+		if cleanupHook, ok := hook.(CleanupHook); ok {
+			if err := cleanupHook.PostCleanup(configName); err != nil {
+				logrus.Errorf("Post cleanup hook failed for lb [%s]: %v", configName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PromoteShadowConfig promotes the pending config, and runs
+// the post apply hooks deferred until then
+func (p *hookedProvider) PromoteShadowConfig() (*config.LoadBalancerConfig, error) {
+	shadowProvider, ok := p.LBProvider.(ShadowProvider)
+	if !ok {
+		return nil, fmt.Errorf("Provider %s doesn't support shadow apply", p.GetName())
+	}
+	lbConfig, err := shadowProvider.PromoteShadowConfig()
+	if lbConfig != nil {
+		p.postApply(lbConfig, err)
+	}
+	return lbConfig, err
+}
+
+func (p *hookedProvider) EnableStats() {
+	EnableStats(p.LBProvider)
+}
+
+func (p *hookedProvider) GetCaptures() ([]Capture, error) {
+	captureProvider, ok := p.LBProvider.(CaptureProvider)
+	if !ok {
+		return nil, fmt.Errorf("Provider %s doesn't support debug capture", p.GetName())
+	}
+	return captureProvider.GetCaptures()
+}
+
+func (p *hookedProvider) GetCapabilities() (*Capabilities, error) {
+	capabilityProvider, ok := p.LBProvider.(CapabilityProvider)
+	if !ok {
+		return nil, fmt.Errorf("Provider %s doesn't report its capabilities", p.GetName())
+	}
+	return capabilityProvider.GetCapabilities()
+}
+
+// ExecHook runs commands before and after the config apply.
+// The serialized config is passed on the command stdin, and
+// LB_HOOK_STAGE, LB_CONFIG_NAME and LB_APPLY_ERROR are set
+// in the command environment
+type ExecHook struct {
+	PreApplyCmd  string
+	PostApplyCmd string
+	Timeout      time.Duration
+}
+
+// NewExecHookFromEnv configures the exec hook from PRE_APPLY_HOOK,
+// POST_APPLY_HOOK and APPLY_HOOK_TIMEOUT env vars. Nil is returned
+// when no hook command is set
+func NewExecHookFromEnv() (*ExecHook, error) {
+	hook := &ExecHook{
+		PreApplyCmd:  preApplyHook.Get(),
+		PostApplyCmd: postApplyHook.Get(),
+		Timeout:      applyHookTimeout.Get(),
+	}
+	if hook.PreApplyCmd == "" && hook.PostApplyCmd == "" {
+		return nil, nil
+	}
+	if hook.Timeout <= 0 {
+		return nil, fmt.Errorf("Invalid APPLY_HOOK_TIMEOUT %v, should be positive", hook.Timeout)
+	}
+	return hook, nil
+}
+
+func (h *ExecHook) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return h.run(h.PreApplyCmd, PreApplyStage, lbConfig, nil)
+}
+
+func (h *ExecHook) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	return h.run(h.PostApplyCmd, PostApplyStage, lbConfig, applyErr)
+}
+
+func (h *ExecHook) run(command string, stage string, lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if command == "" {
+		return nil
+	}
+	data, err := json.Marshal(lbConfig)
+	if err != nil {
+		return err
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("LB_HOOK_STAGE=%s", stage),
+		fmt.Sprintf("LB_CONFIG_NAME=%s", lbConfig.Name))
+	if applyErr != nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("LB_APPLY_ERROR=%v", applyErr))
+	}
+	logrus.Debugf("Running %s hook for lb [%s]", stage, lbConfig.Name)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v -- %v", err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,577 @@
+package provider
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/lb-controller/config"
+	utils "github.com/rancher/lb-controller/utils"
+)
+
+type tProvider struct {
+	applied []string
+	err     error
+}
+
+func (p *tProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	p.applied = append(p.applied, lbConfig.Name)
+	return p.err
+}
+
+func (p *tProvider) GetName() string {
+	return "test"
+}
+
+func (p *tProvider) GetPublicEndpoints(configName string) []PublicEndpoint {
+	return nil
+}
+
+func (p *tProvider) CleanupConfig(configName string) error {
+	return nil
+}
+
+func (p *tProvider) Run(syncEndpointsQueue *utils.TaskQueue) {
+}
+
+func (p *tProvider) Stop() error {
+	return nil
+}
+
+func (p *tProvider) IsHealthy() bool {
+	return true
+}
+
+func (p *tProvider) ProcessCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error {
+	return nil
+}
+
+func TestExecHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pre := filepath.Join(dir, "pre.json")
+	post := filepath.Join(dir, "post")
+
+	lbp := &tProvider{err: fmt.Errorf("apply failed")}
+	hooked := WithHooks(lbp, &ExecHook{
+		PreApplyCmd:  fmt.Sprintf("cat > %s", pre),
+		PostApplyCmd: fmt.Sprintf("echo \"$LB_HOOK_STAGE $LB_CONFIG_NAME $LB_APPLY_ERROR\" > %s", post),
+	})
+	if err := hooked.ApplyConfig(&config.LoadBalancerConfig{Name: "lb"}); err == nil {
+		t.Fatal("Apply error is not returned")
+	}
+	if len(lbp.applied) != 1 {
+		t.Fatalf("Invalid number of applies %v", len(lbp.applied))
+	}
+
+	b, err := ioutil.ReadFile(pre)
+	if err != nil {
+		t.Fatalf("Pre apply hook wasn't invoked: %v", err)
+	}
+	lbConfig := &config.LoadBalancerConfig{}
+	if err := json.Unmarshal(b, lbConfig); err != nil {
+		t.Fatalf("Failed to parse serialized config: %v", err)
+	}
+	if lbConfig.Name != "lb" || lbConfig.Version != config.SchemaVersion {
+		t.Fatalf("Invalid serialized config %s", string(b))
+	}
+
+	b, err = ioutil.ReadFile(post)
+	if err != nil {
+		t.Fatalf("Post apply hook wasn't invoked: %v", err)
+	}
+	if string(b) != "post_apply lb apply failed\n" {
+		t.Fatalf("Invalid post apply hook environment %s", string(b))
+	}
+}
+
+func TestExecHookAbortsApply(t *testing.T) {
+	lbp := &tProvider{}
+	hooked := WithHooks(lbp, &ExecHook{PreApplyCmd: "exit 1"})
+	if err := hooked.ApplyConfig(&config.LoadBalancerConfig{Name: "lb"}); err == nil {
+		t.Fatal("Pre apply hook failure is not returned")
+	}
+	if len(lbp.applied) != 0 {
+		t.Fatal("Config is applied after pre apply hook failure")
+	}
+}
+
+// tShadowProvider holds the applied configs pending promotion
+type tShadowProvider struct {
+	tProvider
+	pending *config.LoadBalancerConfig
+}
+
+func (p *tShadowProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	p.pending = lbConfig
+	return ErrPendingPromotion
+}
+
+func (p *tShadowProvider) PromoteShadowConfig() (*config.LoadBalancerConfig, error) {
+	if p.pending == nil {
+		return nil, fmt.Errorf("No pending config")
+	}
+	p.applied = append(p.applied, p.pending.Name)
+	promoted := p.pending
+	p.pending = nil
+	return promoted, nil
+}
+
+type tPostApplyHook struct {
+	applied []string
+}
+
+func (h *tPostApplyHook) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	return nil
+}
+
+func (h *tPostApplyHook) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	h.applied = append(h.applied, lbConfig.Name)
+	return nil
+}
+
+func TestPendingPromotion(t *testing.T) {
+	lbp := &tShadowProvider{}
+	hook := &tPostApplyHook{}
+	hooked := WithHooks(lbp, hook)
+	if err := hooked.ApplyConfig(&config.LoadBalancerConfig{Name: "lb"}); err != nil {
+		t.Fatalf("Pending config shouldn't fail the apply: %v", err)
+	}
+	if len(hook.applied) != 0 {
+		t.Fatalf("Post apply hooks should wait for the promotion, got %v", hook.applied)
+	}
+	promoted, err := hooked.(ShadowProvider).PromoteShadowConfig()
+	if err != nil || promoted.Name != "lb" {
+		t.Fatalf("Failed to promote the pending config %v: %v", promoted, err)
+	}
+	if !reflect.DeepEqual(hook.applied, []string{"lb"}) {
+		t.Fatalf("Post apply hooks should run on promotion, got %v", hook.applied)
+	}
+	if _, err := hooked.(ShadowProvider).PromoteShadowConfig(); err == nil || len(hook.applied) != 1 {
+		t.Fatalf("Nothing should be promoted twice")
+	}
+
+	// the pending applies don't fail without hooks either
+	if err := WithHooks(&tShadowProvider{}).ApplyConfig(&config.LoadBalancerConfig{Name: "lb"}); err != nil {
+		t.Fatalf("Pending config shouldn't fail the apply without hooks: %v", err)
+	}
+}
+
+func TestWebhookHook(t *testing.T) {
+	var events []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Invalid webhook body %s", body)
+		}
+		timestamp := r.Header.Get(WebhookTimestampHeader)
+		if signed, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(signed, 0)) > time.Minute {
+			t.Errorf("Invalid webhook timestamp %s", timestamp)
+		}
+		if r.Header.Get(WebhookSignatureHeader) != "sha256="+signWebhook("secret", timestamp, body) {
+			t.Errorf("Invalid webhook signature %s", r.Header.Get(WebhookSignatureHeader))
+		}
+		if r.Header.Get(WebhookSignatureHeader) == "sha256="+signWebhook("secret", "0", body) {
+			t.Errorf("Signature should cover the timestamp")
+		}
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	hook := NewEventHook(NewWebhookSink(server.URL, "secret", time.Second))
+	lbConfig := &config.LoadBalancerConfig{
+		Name: "lb",
+		FrontendServices: []*config.FrontendService{
+			{Name: "80", Port: 80, BackendServices: []*config.BackendService{{UUID: "foo", Port: 8080}}},
+		},
+	}
+	if err := hook.PostApply(lbConfig, nil); err != nil {
+		t.Fatalf("Failed to send webhook %v", err)
+	}
+	lbConfig.FrontendServices[0].BackendServices[0].Port = 8081
+	lbConfig.FrontendServices = append(lbConfig.FrontendServices, &config.FrontendService{Name: "443", Port: 443})
+	if err := hook.PostApply(lbConfig, fmt.Errorf("reload failed")); err != nil {
+		t.Fatalf("Failed to send webhook %v", err)
+	}
+	if err := hook.PostCleanup("lb"); err != nil {
+		t.Fatalf("Failed to send webhook %v", err)
+	}
+	hook.Flush()
+
+	if len(events) != 4 {
+		t.Fatalf("Invalid number of webhooks %v", len(events))
+	}
+	if events[0].Event != EventApplied || !reflect.DeepEqual(events[0].Diff.FrontendsAdded, []string{"80"}) {
+		t.Fatalf("Invalid applied webhook %+v", events[0])
+	}
+	if events[1].Event != EventBackendAdded || events[1].Backend != "foo" {
+		t.Fatalf("Invalid backend added webhook %+v", events[1])
+	}
+	diff := events[2].Diff
+	if events[2].Event != EventApplyFailed || events[2].Error != "reload failed" ||
+		!reflect.DeepEqual(diff.FrontendsAdded, []string{"443"}) || !reflect.DeepEqual(diff.BackendsChanged, []string{"foo"}) || len(diff.FrontendsChanged) != 0 {
+		t.Fatalf("Invalid apply failed webhook %+v %+v", events[2], diff)
+	}
+	if events[3].Event != EventRemoved || events[3].ConfigName != "lb" {
+		t.Fatalf("Invalid removed webhook %+v", events[3])
+	}
+}
+
+type tEventSink struct {
+	events []*Event
+}
+
+func (s *tEventSink) Name() string {
+	return "test"
+}
+
+func (s *tEventSink) Send(event *Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestEventHookEndpoints(t *testing.T) {
+	sink := &tEventSink{}
+	hook := NewEventHook(sink)
+	hook.PostApply(shrinkTestConfig("10.0.0.1", "10.0.0.2"), nil)
+	hook.Flush()
+	sink.events = nil
+	hook.PostApply(shrinkTestConfig("10.0.0.2"), fmt.Errorf("reload failed"))
+	hook.Flush()
+	if len(sink.events) != 1 || sink.events[0].Event != EventApplyFailed {
+		t.Fatalf("Failed apply should not send endpoint events %+v", sink.events)
+	}
+
+	sink.events = nil
+	hook.PostApply(shrinkTestConfig("10.0.0.2", "10.0.0.3"), nil)
+	hook.Flush()
+	if len(sink.events) != 3 || sink.events[0].Event != EventApplied {
+		t.Fatalf("Invalid events %+v", sink.events)
+	}
+	added, removed := sink.events[1], sink.events[2]
+	if added.Event != EventEndpointAdded || added.Backend != "api" || added.Endpoint != "10.0.0.3:80" {
+		t.Fatalf("Invalid endpoint added event %+v", added)
+	}
+	if removed.Event != EventEndpointRemoved || removed.Backend != "api" || removed.Endpoint != "10.0.0.1:80" {
+		t.Fatalf("Invalid endpoint removed event %+v", removed)
+	}
+}
+
+type tEndpointStatus struct {
+	status []EndpointStatus
+}
+
+func (s *tEndpointStatus) GetEndpointStatus() ([]EndpointStatus, error) {
+	return s.status, nil
+}
+
+func TestEventHookEndpointStatus(t *testing.T) {
+	sink := &tEventSink{}
+	hook := NewEventHook(sink)
+	lbConfig := shrinkTestConfig("10.0.0.1", "10.0.0.2")
+	lbConfig.FrontendServices[0].BackendServices[0].Endpoints[0].Name = "s1"
+	lbConfig.Certs = []*config.Certificate{{Name: "foo", Cert: "a"}}
+	hook.PostApply(lbConfig, nil)
+	hook.Flush()
+	if len(sink.events) != 4 || sink.events[1].Event != EventBackendAdded || sink.events[1].Backend != "api" {
+		t.Fatalf("Invalid events of the first apply %+v", sink.events)
+	}
+	sink.events = nil
+	lbConfig.Certs[0].Cert = "b"
+	hook.PostApply(lbConfig, nil)
+	hook.Flush()
+	if len(sink.events) != 2 || sink.events[1].Event != EventCertRotated || sink.events[1].Cert != "foo" {
+		t.Fatalf("Invalid cert rotated events %+v", sink.events)
+	}
+
+	sink.events = nil
+	status := &tEndpointStatus{status: []EndpointStatus{
+		{Backend: "api", Server: "s1", Status: EndpointUp},
+		{Backend: "api", Server: "s2", Status: EndpointUp},
+	}}
+	hook.pollEndpoints(status)
+	hook.Flush()
+	if len(sink.events) != 0 {
+		t.Fatalf("Endpoints up should not send events %+v", sink.events)
+	}
+	status.status[0].Status = EndpointDown
+	status.status[1].Status = EndpointDrained
+	hook.pollEndpoints(status)
+	hook.Flush()
+	if len(sink.events) != 2 {
+		t.Fatalf("Invalid endpoint status events %+v", sink.events)
+	}
+	down, drained := sink.events[0], sink.events[1]
+	if down.Event != EventEndpointDown || down.ConfigName != "lb" || down.Endpoint != "10.0.0.1:80" {
+		t.Fatalf("Invalid endpoint down event %+v", down)
+	}
+	if drained.Event != EventEndpointDrained || drained.Endpoint != "s2" {
+		t.Fatalf("Invalid endpoint drained event %+v", drained)
+	}
+	sink.events = nil
+	status.status[0].Status = EndpointUp
+	hook.pollEndpoints(status)
+	hook.Flush()
+	if len(sink.events) != 1 || sink.events[0].Event != EventEndpointUp {
+		t.Fatalf("Invalid endpoint up events %+v", sink.events)
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	published := make(chan string, 2)
+	pong := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {}\r\nPING\r\n")
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "CONNECT ") && !strings.Contains(line, `"user":"lb"`) {
+				t.Errorf("Invalid connect %s", line)
+			}
+			if strings.HasPrefix(line, "PUB ") {
+				body, _ := reader.ReadString('\n')
+				published <- line + body
+			}
+			if line == "PONG\r\n" {
+				close(pong)
+			}
+		}
+	}()
+
+	sink, err := NewNATSSink("nats://lb:pass@"+listener.Addr().String(), "lb.events", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server never answers, the events are published without waiting
+	for _, name := range []string{EventEndpointDown, EventEndpointUp} {
+		if err := sink.Send(&Event{Event: name, ConfigName: "lb"}); err != nil {
+			t.Fatalf("Failed to publish event %v", err)
+		}
+	}
+	msg := <-published
+	if !strings.HasPrefix(msg, "PUB lb.events.endpoint.down ") || !strings.Contains(msg, `"config_name":"lb"`) {
+		t.Fatalf("Invalid published event %q", msg)
+	}
+	if msg := <-published; !strings.HasPrefix(msg, "PUB lb.events.endpoint.up ") {
+		t.Fatalf("Invalid published event %q", msg)
+	}
+	select {
+	case <-pong:
+	case <-time.After(time.Second):
+		t.Fatal("Server ping should be answered")
+	}
+
+	if _, err := NewNATSSink("http://localhost:4222", "lb.events", time.Second); err == nil {
+		t.Fatal("Non nats url should be rejected")
+	}
+}
+
+func shrinkTestConfig(endpoints ...string) *config.LoadBalancerConfig {
+	be := &config.BackendService{UUID: "api"}
+	for _, ip := range endpoints {
+		be.Endpoints = append(be.Endpoints, &config.Endpoint{IP: ip, Port: 80})
+	}
+	return &config.LoadBalancerConfig{
+		Name:             "lb",
+		FrontendServices: []*config.FrontendService{{Name: "80", BackendServices: []*config.BackendService{be}}},
+	}
+}
+
+func TestShrinkGuard(t *testing.T) {
+	lbp := &tProvider{}
+	guard := NewShrinkGuard(50, time.Minute)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+	hooked := WithHooks(lbp, guard)
+
+	if err := hooked.ApplyConfig(shrinkTestConfig("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")); err != nil {
+		t.Fatalf("First config should be applied: %v", err)
+	}
+	if err := hooked.ApplyConfig(shrinkTestConfig("10.0.0.1", "10.0.0.2")); err != nil {
+		t.Fatalf("Config removing half of the endpoints should be applied: %v", err)
+	}
+	if err := hooked.ApplyConfig(shrinkTestConfig()); err == nil {
+		t.Fatal("Config removing all the endpoints should be deferred")
+	}
+	now = now.Add(30 * time.Second)
+	if err := hooked.ApplyConfig(shrinkTestConfig()); err == nil || len(lbp.applied) != 2 {
+		t.Fatalf("Config should be deferred for the confirm interval, applied %v", lbp.applied)
+	}
+	now = now.Add(30 * time.Second)
+	if err := hooked.ApplyConfig(shrinkTestConfig()); err != nil || len(lbp.applied) != 3 {
+		t.Fatalf("Config shrinking for the confirm interval should be applied: %v", err)
+	}
+
+	// the deferral ends when the endpoints come back
+	hooked.ApplyConfig(shrinkTestConfig("10.0.0.1", "10.0.0.2"))
+	hooked.ApplyConfig(&config.LoadBalancerConfig{Name: "lb"})
+	now = now.Add(30 * time.Second)
+	hooked.ApplyConfig(shrinkTestConfig("10.0.0.1", "10.0.0.2"))
+	now = now.Add(30 * time.Second)
+	if err := hooked.ApplyConfig(&config.LoadBalancerConfig{Name: "lb"}); err == nil {
+		t.Fatal("Config removing the backends should be deferred again")
+	}
+}
+
+// tLegacyProvider returns the public endpoints as bare ips
+type tLegacyProvider struct {
+	tProvider
+}
+
+func (p *tLegacyProvider) GetPublicEndpoints(configName string) []string {
+	return []string{"10.0.0.1", "10.0.0.2"}
+}
+
+func TestPublicEndpoints(t *testing.T) {
+	lbp := WithHooks(FromLegacy(&tLegacyProvider{}), &ExecHook{})
+	eps := lbp.GetPublicEndpoints("lb")
+	if !reflect.DeepEqual(eps, []PublicEndpoint{{IPAddress: "10.0.0.1"}, {IPAddress: "10.0.0.2"}}) {
+		t.Fatalf("Invalid public endpoints of the legacy provider %v", eps)
+	}
+	ips := PublicEndpointIPs([]PublicEndpoint{
+		{IPAddress: "10.0.0.1", Port: 80, Protocol: ProtocolTCP},
+		{IPAddress: "10.0.0.1", Port: 53, Protocol: ProtocolUDP},
+		{IPAddress: "10.0.0.2", Port: 80, Protocol: ProtocolTCP},
+	})
+	if !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("Invalid public endpoint ips %v", ips)
+	}
+	if TransportProtocol("UDP") != ProtocolUDP || TransportProtocol("https") != ProtocolTCP {
+		t.Fatalf("Invalid transport protocols")
+	}
+}
+
+func TestRenderOnlyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if GetRenderer("json") == nil || GetRenderer("missing") != nil {
+		t.Fatalf("Only the registered renderers should be found")
+	}
+	p := NewRenderOnlyProvider(&tProvider{}, GetRenderer("json"), dir, true)
+	lbConfig := &config.LoadBalancerConfig{
+		Name:        "lb",
+		DefaultCert: &config.Certificate{Name: "default", Cert: "cert", Key: "secret"},
+	}
+	if err := p.ApplyConfig(lbConfig); err != nil {
+		t.Fatalf("Failed to render config: %v", err)
+	}
+	select {
+	case <-p.Done():
+	default:
+		t.Fatalf("Render once should be done after the first config")
+	}
+	if p.Err() != nil {
+		t.Fatalf("Unexpected render error %v", p.Err())
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "lb.json"))
+	if err != nil {
+		t.Fatalf("Config should be rendered: %v", err)
+	}
+	if strings.Contains(string(b), "secret") || !strings.Contains(string(b), `"cert": "cert"`) {
+		t.Fatalf("Rendered config should be stripped of the keys only: %s", b)
+	}
+	if lbConfig.DefaultCert.Key != "secret" {
+		t.Fatalf("Applied config shouldn't be changed by the renderer")
+	}
+	// the config is rendered again, the first one is reported
+	if err := p.ApplyConfig(lbConfig); err != nil {
+		t.Fatalf("Failed to render config: %v", err)
+	}
+}
+
+type tDriftDetector struct {
+	drift *ConfigDrift
+}
+
+func (d *tDriftDetector) CheckDrift() (*ConfigDrift, error) {
+	return d.drift, nil
+}
+
+func TestReconciler(t *testing.T) {
+	sink := &tEventSink{}
+	detector := &tDriftDetector{}
+	resyncs := 0
+	r := &Reconciler{
+		Detector: detector,
+		Resync:   func() { resyncs++ },
+		Events:   NewEventHook(sink),
+	}
+	drift := r.reconcile()
+	r.Events.Flush()
+	if drift != nil || resyncs != 1 || len(sink.events) != 0 {
+		t.Fatalf("Unchanged config should only be resynced, drift %+v, resyncs %v, events %+v", drift, resyncs, sink.events)
+	}
+
+	detector.drift = &ConfigDrift{ConfigName: "lb", Path: "/etc/haproxy/haproxy.cfg", Expected: "a", Actual: "b"}
+	drift = r.reconcile()
+	r.Events.Flush()
+	if drift != detector.drift || resyncs != 2 {
+		t.Fatalf("Drifted config should be resynced, drift %+v, resyncs %v", drift, resyncs)
+	}
+	if len(sink.events) != 1 || sink.events[0].Event != EventConfigDrift || sink.events[0].ConfigName != "lb" {
+		t.Fatalf("Invalid drift events %+v", sink.events)
+	}
+}
+
+type tBlockedSink struct {
+	release chan struct{}
+	sent    int
+}
+
+func (s *tBlockedSink) Name() string {
+	return "blocked"
+}
+
+func (s *tBlockedSink) Send(event *Event) error {
+	<-s.release
+	s.sent++
+	return nil
+}
+
+func TestEventHookQueue(t *testing.T) {
+	blocked := &tBlockedSink{release: make(chan struct{})}
+	hook := NewEventHook(blocked)
+	hook.QueueSize = 2
+
+	// the blocked sink takes one event and queues two,
+	// the others are dropped without holding the sender
+	for i := 0; i < 5; i++ {
+		hook.send(&Event{Event: EventApplied, ConfigName: "lb"})
+	}
+	close(blocked.release)
+	hook.Flush()
+	if blocked.sent < 2 || blocked.sent > 3 {
+		t.Fatalf("Invalid number of events sent to the blocked sink %v", blocked.sent)
+	}
+}
@@ -0,0 +1,399 @@
+/*
+Package ipvs serves the plain tcp and the udp rules of the lb with the
+kernel IPVS, so their traffic skips the userspace proxy. The http rules,
+and the tcp ones needing the proxy, are left to it.
+
+The virtual services are added at the address of the host, nat to the
+endpoints. The replies of the endpoints have to go back through the lb
+host, the setup command masquerades the traffic of the virtual services
+for that. The lb containers need the host network and the NET_ADMIN
+capability to program IPVS. The table outlives the restarts of the
+containers, so the virtual services of the host are read before the
+first change.
+*/
+package ipvs
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	fastPathEnabled = flags.Bool("IPVS_FAST_PATH", false, "Serve the plain tcp and the udp rules with IPVS instead of the proxy")
+	fastPathAddress = flags.String("IPVS_ADDRESS", "", "Address the IPVS virtual services are added at, the first ipv4 of the host interfaces when not set")
+	scheduler       = flags.String("IPVS_SCHEDULER", "wrr", "IPVS scheduler of the virtual services, as wrr, rr, lc or sh")
+	restoreCmd      = flags.String("IPVS_RESTORE_CMD", "ipvsadm-restore", "Command the changes of the virtual services are piped to, in ipvsadm rules format")
+	saveCmd         = flags.String("IPVS_SAVE_CMD", "ipvsadm-save -n", "Command printing the virtual services of the host in ipvsadm rules format, read before the first change")
+	setupCmd        = flags.String("IPVS_SETUP_CMD", "ipvs_setup", "Command setting up the masquerading of the IPVS traffic, run before the first virtual service is added")
+)
+
+// VirtualService is an IPVS service, its address is ip:port
+type VirtualService struct {
+	Protocol    string
+	Address     string
+	Scheduler   string
+	RealServers []RealServer
+}
+
+// RealServer is an endpoint of the virtual service, weight 0
+// takes no new connections
+type RealServer struct {
+	Address string
+	Weight  int
+}
+
+func (vs *VirtualService) key() string {
+	return vs.Protocol + " " + vs.Address
+}
+
+// FastPath moves the frontends IPVS can serve out of the configs
+// the proxy applies, and programs their virtual services once the
+// proxy applied the rest, so a config the proxy rejects leaves
+// IPVS as it was
+type FastPath struct {
+	Address    string
+	Scheduler  string
+	RestoreCmd string
+	SaveCmd    string
+	SetupCmd   string
+
+	mu    sync.Mutex
+	setup bool
+	// loaded is set once the virtual services of the host are read,
+	// the table outlives the restarts of the controller
+	loaded bool
+	// applied are the virtual services programmed by key
+	applied map[string]*VirtualService
+}
+
+// NewFastPathFromEnv configures the fast path from the IPVS_* env
+// vars, nil is returned when IPVS_FAST_PATH is off
+func NewFastPathFromEnv() (*FastPath, error) {
+	if !fastPathEnabled.Get() {
+		return nil, nil
+	}
+	f := &FastPath{
+		Address:    fastPathAddress.Get(),
+		Scheduler:  scheduler.Get(),
+		RestoreCmd: restoreCmd.Get(),
+		SaveCmd:    saveCmd.Get(),
+		SetupCmd:   setupCmd.Get(),
+	}
+	if f.Address == "" {
+		var err error
+		if f.Address, err = hostIPv4(); err != nil {
+			return nil, err
+		}
+	} else if net.ParseIP(f.Address) == nil {
+		return nil, fmt.Errorf("Invalid IPVS_ADDRESS %s", f.Address)
+	}
+	return f, nil
+}
+
+// hostIPv4 returns the first ipv4 of the up interfaces, but the loopback
+func hostIPv4() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ipNet.IP.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No ipv4 found for the IPVS virtual services, set IPVS_ADDRESS")
+}
+
+/*
+isFastPath tells whether IPVS serves the frontend: the udp ones, which
+the proxy doesn't serve, and the tcp ones with a single backend of ip
+endpoints and no setting of the proxy. IPVS doesn't check the endpoints,
+so the tcp backends with a health check are left to the proxy
+*/
+func isFastPath(fe *config.FrontendService) bool {
+	if fe.Protocol != config.TCPProto && fe.Protocol != config.UDPProto {
+		return false
+	}
+	if len(fe.BackendServices) != 1 || fe.AcceptProxy || fe.Config != "" {
+		return false
+	}
+	if fe.BindAddress != "" && net.ParseIP(fe.BindAddress) == nil {
+		return false
+	}
+	be := fe.BackendServices[0]
+	if be.Config != "" || be.SendProxy || be.Transparent || be.Redirect != nil || be.DebugCapture != nil ||
+		be.RequestLogging != nil || be.Fault != nil || be.AgentCheck != nil || len(be.LuaHooks) > 0 {
+		return false
+	}
+	if fe.Protocol == config.TCPProto && be.HealthCheck != nil {
+		return false
+	}
+	for _, ep := range be.Endpoints {
+		if ep.IsCname || net.ParseIP(ep.IP) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Split returns the config left to the proxy, and the
+// virtual services of the fast path frontends by key
+func (f *FastPath) Split(lbConfig *config.LoadBalancerConfig) (*config.LoadBalancerConfig, map[string]*VirtualService) {
+	proxied := *lbConfig
+	proxied.FrontendServices = nil
+	services := map[string]*VirtualService{}
+	for _, fe := range lbConfig.FrontendServices {
+		if !isFastPath(fe) {
+			proxied.FrontendServices = append(proxied.FrontendServices, fe)
+			continue
+		}
+		address := f.Address
+		if fe.BindAddress != "" {
+			address = fe.BindAddress
+		}
+		vs := &VirtualService{
+			Protocol:  fe.Protocol,
+			Address:   net.JoinHostPort(address, strconv.Itoa(fe.Port)),
+			Scheduler: f.Scheduler,
+		}
+		be := fe.BackendServices[0]
+		for _, ep := range be.Endpoints {
+			weight := ep.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			// ipvs has no backup servers, they are kept out of the traffic
+			if ep.Backup || ep.Drain {
+				weight = 0
+			}
+			vs.RealServers = append(vs.RealServers, RealServer{
+				Address: net.JoinHostPort(ep.IP, strconv.Itoa(ep.Port)),
+				Weight:  weight,
+			})
+		}
+		sort.Slice(vs.RealServers, func(i, j int) bool {
+			return vs.RealServers[i].Address < vs.RealServers[j].Address
+		})
+		services[vs.key()] = vs
+	}
+	return &proxied, services
+}
+
+// Program programs the virtual services split from a config,
+// the ones programmed before and no longer split are removed
+func (f *FastPath) Program(services map[string]*VirtualService) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(services) > 0 && !f.setup {
+		if err := runCmd(f.SetupCmd, ""); err != nil {
+			return fmt.Errorf("Failed to set up IPVS: %v", err)
+		}
+		f.setup = true
+	}
+	return f.program(services)
+}
+
+// Cleanup removes the virtual services
+func (f *FastPath) Cleanup() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.program(nil)
+}
+
+func (f *FastPath) program(services map[string]*VirtualService) error {
+	if !f.loaded {
+		if err := f.load(services); err != nil {
+			return err
+		}
+	}
+	rules := plan(f.applied, services)
+	if len(rules) == 0 {
+		return nil
+	}
+	if err := runCmd(f.RestoreCmd, strings.Join(rules, "\n")+"\n"); err != nil {
+		return fmt.Errorf("Failed to program IPVS: %v", err)
+	}
+	logrus.Infof("Programmed %v IPVS virtual service(s) with %v rule(s)", len(services), len(rules))
+	f.applied = services
+	return nil
+}
+
+// load reads the virtual services programmed on the host as applied: the
+// ones at the fast path address, which are removed when no longer split,
+// and the ones of the bind addresses of the desired services
+func (f *FastPath) load(desired map[string]*VirtualService) error {
+	if f.SaveCmd == "" {
+		f.loaded = true
+		return nil
+	}
+	output, err := cmdOutput(f.SaveCmd)
+	if err != nil {
+		return fmt.Errorf("Failed to read the IPVS virtual services: %v", err)
+	}
+	f.applied = map[string]*VirtualService{}
+	for key, vs := range parseRules(output) {
+		host, _, err := net.SplitHostPort(vs.Address)
+		if err != nil {
+			continue
+		}
+		if _, ok := desired[key]; ok || net.ParseIP(host).Equal(net.ParseIP(f.Address)) {
+			f.applied[key] = vs
+		}
+	}
+	logrus.Infof("Found %v IPVS virtual service(s) of the fast path on the host", len(f.applied))
+	f.loaded = true
+	return nil
+}
+
+// parseRules reads the virtual services of ipvsadm-save -n output by key,
+// the fwmark services are skipped
+func parseRules(output string) map[string]*VirtualService {
+	services := map[string]*VirtualService{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[0] != "-A" && fields[0] != "-a") {
+			continue
+		}
+		var protocol string
+		switch fields[1] {
+		case "-t":
+			protocol = config.TCPProto
+		case "-u":
+			protocol = config.UDPProto
+		default:
+			continue
+		}
+		vs := &VirtualService{Protocol: protocol, Address: fields[2]}
+		options := map[string]string{}
+		for i := 3; i+1 < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "-") && !strings.HasPrefix(fields[i+1], "-") {
+				options[fields[i]] = fields[i+1]
+				i++
+			}
+		}
+		if fields[0] == "-A" {
+			vs.Scheduler = options["-s"]
+			if existing, ok := services[vs.key()]; ok {
+				existing.Scheduler = vs.Scheduler
+			} else {
+				services[vs.key()] = vs
+			}
+			continue
+		}
+		if options["-r"] == "" {
+			continue
+		}
+		if _, ok := services[vs.key()]; !ok {
+			services[vs.key()] = vs
+		}
+		weight, err := strconv.Atoi(options["-w"])
+		if err != nil {
+			weight = 1
+		}
+		rs := RealServer{Address: options["-r"], Weight: weight}
+		services[vs.key()].RealServers = append(services[vs.key()].RealServers, rs)
+	}
+	return services
+}
+
+// plan returns the ipvsadm rules changing the applied virtual services
+// into the desired ones, the unchanged real servers are kept so their
+// connections last
+func plan(applied, desired map[string]*VirtualService) []string {
+	var rules []string
+	for _, key := range sortedKeys(applied) {
+		if _, ok := desired[key]; !ok {
+			vs := applied[key]
+			rules = append(rules, fmt.Sprintf("-D %s %s", protocolFlag(vs.Protocol), vs.Address))
+		}
+	}
+	for _, key := range sortedKeys(desired) {
+		vs := desired[key]
+		old, exists := applied[key]
+		servers := map[string]int{}
+		if !exists {
+			rules = append(rules, fmt.Sprintf("-A %s %s -s %s", protocolFlag(vs.Protocol), vs.Address, vs.Scheduler))
+		} else {
+			if old.Scheduler != vs.Scheduler {
+				rules = append(rules, fmt.Sprintf("-E %s %s -s %s", protocolFlag(vs.Protocol), vs.Address, vs.Scheduler))
+			}
+			for _, rs := range old.RealServers {
+				servers[rs.Address] = rs.Weight
+			}
+		}
+		kept := map[string]bool{}
+		for _, rs := range vs.RealServers {
+			kept[rs.Address] = true
+			weight, ok := servers[rs.Address]
+			switch {
+			case !ok:
+				rules = append(rules, fmt.Sprintf("-a %s %s -r %s -m -w %d", protocolFlag(vs.Protocol), vs.Address, rs.Address, rs.Weight))
+			case weight != rs.Weight:
+				rules = append(rules, fmt.Sprintf("-e %s %s -r %s -m -w %d", protocolFlag(vs.Protocol), vs.Address, rs.Address, rs.Weight))
+			}
+		}
+		if !exists {
+			continue
+		}
+		for _, rs := range old.RealServers {
+			if !kept[rs.Address] {
+				rules = append(rules, fmt.Sprintf("-d %s %s -r %s", protocolFlag(vs.Protocol), vs.Address, rs.Address))
+			}
+		}
+	}
+	return rules
+}
+
+func protocolFlag(protocol string) string {
+	if protocol == config.UDPProto {
+		return "-u"
+	}
+	return "-t"
+}
+
+func sortedKeys(services map[string]*VirtualService) []string {
+	keys := []string{}
+	for k := range services {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cmdOutput(cmd string) (string, error) {
+	output, err := exec.Command("sh", "-c", cmd).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("%v -- %v", err, string(exitErr.Stderr))
+	}
+	return string(output), err
+}
+
+func runCmd(cmd string, input string) error {
+	c := exec.Command("sh", "-c", cmd)
+	if input != "" {
+		c.Stdin = strings.NewReader(input)
+	}
+	output, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v -- %v", err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package ipvs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/lb-controller/config"
+)
+
+func newTestConfig(weight int) *config.LoadBalancerConfig {
+	return &config.LoadBalancerConfig{
+		Name: "lb",
+		FrontendServices: []*config.FrontendService{
+			{
+				Name:     "53",
+				Port:     53,
+				Protocol: config.UDPProto,
+				BackendServices: []*config.BackendService{{
+					UUID:      "dns",
+					Endpoints: []*config.Endpoint{{IP: "10.42.0.2", Port: 53}, {IP: "10.42.0.3", Port: 53, Backup: true}},
+				}},
+			},
+			{
+				Name:     "80",
+				Port:     80,
+				Protocol: config.HTTPProto,
+				BackendServices: []*config.BackendService{{
+					UUID:      "web",
+					Endpoints: []*config.Endpoint{{IP: "10.42.0.4", Port: 8080}},
+				}},
+			},
+			{
+				Name:     "5432",
+				Port:     5432,
+				Protocol: config.TCPProto,
+				BackendServices: []*config.BackendService{{
+					UUID:      "db",
+					Endpoints: []*config.Endpoint{{IP: "10.42.0.5", Port: 5432, Weight: weight}},
+				}},
+			},
+			{
+				Name:     "6379",
+				Port:     6379,
+				Protocol: config.TCPProto,
+				BackendServices: []*config.BackendService{{
+					UUID:      "redis",
+					SendProxy: true,
+					Endpoints: []*config.Endpoint{{IP: "10.42.0.6", Port: 6379}},
+				}},
+			},
+			{
+				Name:     "3306",
+				Port:     3306,
+				Protocol: config.TCPProto,
+				BackendServices: []*config.BackendService{{
+					UUID:        "mysql",
+					HealthCheck: &config.HealthCheck{Port: 3306, Interval: 2000},
+					Endpoints:   []*config.Endpoint{{IP: "10.42.0.7", Port: 3306}},
+				}},
+			},
+		},
+	}
+}
+
+func TestFastPathApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rules := filepath.Join(dir, "rules")
+	setup := filepath.Join(dir, "setup")
+	f := &FastPath{
+		Address:    "10.0.0.1",
+		Scheduler:  "wrr",
+		RestoreCmd: fmt.Sprintf("cat > %s", rules),
+		SetupCmd:   fmt.Sprintf("echo setup >> %s", setup),
+	}
+	proxied, services := f.Split(newTestConfig(0))
+	if err := f.Program(services); err != nil {
+		t.Fatalf("Failed to program the fast path: %v", err)
+	}
+	var names []string
+	for _, fe := range proxied.FrontendServices {
+		names = append(names, fe.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"80", "6379", "3306"}) {
+		t.Fatalf("Expected the http, the proxy protocol and the health checked frontends to be left to the proxy, got %v", names)
+	}
+	b, _ := ioutil.ReadFile(rules)
+	expected := "-A -t 10.0.0.1:5432 -s wrr\n" +
+		"-a -t 10.0.0.1:5432 -r 10.42.0.5:5432 -m -w 1\n" +
+		"-A -u 10.0.0.1:53 -s wrr\n" +
+		"-a -u 10.0.0.1:53 -r 10.42.0.2:53 -m -w 1\n" +
+		"-a -u 10.0.0.1:53 -r 10.42.0.3:53 -m -w 0\n"
+	if string(b) != expected {
+		t.Fatalf("Expected rules:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// only the changes are programmed
+	_, services = f.Split(newTestConfig(5))
+	if err := f.Program(services); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(rules)
+	if string(b) != "-e -t 10.0.0.1:5432 -r 10.42.0.5:5432 -m -w 5\n" {
+		t.Fatalf("Expected the weight change only, got:\n%s", b)
+	}
+	if err := f.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(rules)
+	if string(b) != "-D -t 10.0.0.1:5432\n-D -u 10.0.0.1:53\n" {
+		t.Fatalf("Expected the virtual services to be removed, got:\n%s", b)
+	}
+	if b, _ := ioutil.ReadFile(setup); string(b) != "setup\n" {
+		t.Fatalf("Expected a single setup, got %q", b)
+	}
+}
+
+func TestFastPathLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rules := filepath.Join(dir, "rules")
+	table := filepath.Join(dir, "table")
+	// the table left by the controller before its restart, and a
+	// virtual service of another address
+	saved := "-A -t 10.0.0.1:5432 -s wrr\n" +
+		"-a -t 10.0.0.1:5432 -r 10.42.0.5:5432 -m -w 1\n" +
+		"-A -t 10.0.0.1:6379 -s wrr\n" +
+		"-a -t 10.0.0.1:6379 -r 10.42.0.6:6379 -m -w 1\n" +
+		"-A -u 10.0.0.1:53 -s wrr\n" +
+		"-a -u 10.0.0.1:53 -r 10.42.0.2:53 -m -w 1\n" +
+		"-A -t 10.0.0.2:80 -s rr\n" +
+		"-a -t 10.0.0.2:80 -r 10.42.0.9:80 -m -w 1\n"
+	if err := ioutil.WriteFile(table, []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &FastPath{
+		Address:    "10.0.0.1",
+		Scheduler:  "wrr",
+		RestoreCmd: fmt.Sprintf("cat > %s", rules),
+		SaveCmd:    fmt.Sprintf("cat %s", table),
+		SetupCmd:   "true",
+	}
+	_, services := f.Split(newTestConfig(0))
+	if err := f.Program(services); err != nil {
+		t.Fatalf("Failed to program the fast path: %v", err)
+	}
+	b, _ := ioutil.ReadFile(rules)
+	expected := "-D -t 10.0.0.1:6379\n" +
+		"-a -u 10.0.0.1:53 -r 10.42.0.3:53 -m -w 0\n"
+	if string(b) != expected {
+		t.Fatalf("Expected rules:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// the cleanup after a restart removes the services left at the address
+	f = &FastPath{Address: "10.0.0.1", RestoreCmd: fmt.Sprintf("cat > %s", rules), SaveCmd: fmt.Sprintf("cat %s", table)}
+	if err := f.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(rules)
+	if string(b) != "-D -t 10.0.0.1:5432\n-D -t 10.0.0.1:6379\n-D -u 10.0.0.1:53\n" {
+		t.Fatalf("Expected the virtual services of the address to be removed, got:\n%s", b)
+	}
+}
+
+func TestPlanRealServers(t *testing.T) {
+	applied := map[string]*VirtualService{
+		"tcp 10.0.0.1:80": {Protocol: "tcp", Address: "10.0.0.1:80", Scheduler: "rr", RealServers: []RealServer{
+			{Address: "10.42.0.1:80", Weight: 1}, {Address: "10.42.0.2:80", Weight: 1},
+		}},
+	}
+	desired := map[string]*VirtualService{
+		"tcp 10.0.0.1:80": {Protocol: "tcp", Address: "10.0.0.1:80", Scheduler: "lc", RealServers: []RealServer{
+			{Address: "10.42.0.2:80", Weight: 1}, {Address: "10.42.0.3:80", Weight: 1},
+		}},
+	}
+	expected := []string{
+		"-E -t 10.0.0.1:80 -s lc",
+		"-a -t 10.0.0.1:80 -r 10.42.0.3:80 -m -w 1",
+		"-d -t 10.0.0.1:80 -r 10.42.0.1:80",
+	}
+	if rules := plan(applied, desired); !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rules)
+	}
+}
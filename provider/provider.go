@@ -1,9 +1,11 @@
 package provider
 
 import (
+	"errors"
 	"fmt"
 	"github.com/rancher/lb-controller/config"
 	utils "github.com/rancher/lb-controller/utils"
+	"time"
 )
 
 const Localhost = "localhost"
@@ -11,7 +13,7 @@ const Localhost = "localhost"
 type LBProvider interface {
 	ApplyConfig(lbConfig *config.LoadBalancerConfig) error
 	GetName() string
-	GetPublicEndpoints(configName string) []string
+	GetPublicEndpoints(configName string) []PublicEndpoint
 	CleanupConfig(configName string) error
 	Run(syncEndpointsQueue *utils.TaskQueue)
 	Stop() error
@@ -19,6 +21,146 @@ type LBProvider interface {
 	ProcessCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error
 }
 
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// PublicEndpoint is an address the lb is reachable at, the port
+// is 0 and the protocol empty when the provider can't tell them
+type PublicEndpoint struct {
+	IPAddress string `json:"ip_address"`
+	Port      int    `json:"port"`
+	// Protocol is the transport protocol, ProtocolTCP or ProtocolUDP
+	Protocol string `json:"protocol"`
+}
+
+// BackendStats is the load of a backend reported by the provider
+type BackendStats struct {
+	Name         string
+	QueueCurrent int
+	QueueMax     int
+	// QueueTime is the average queue time of the last requests in ms
+	QueueTime int
+	Sessions  int
+	// Rate is the number of sessions per second over the last second
+	Rate int
+	// Tag is the metrics tag of the backend, empty when it has none
+	Tag string
+}
+
+// StatsProvider is implemented by providers able to report backend stats
+type StatsProvider interface {
+	GetBackendStats() ([]BackendStats, error)
+}
+
+// StatsEnabler is implemented by providers exposing their backend and
+// endpoint stats only once a consumer of the stats asks for them
+type StatsEnabler interface {
+	EnableStats()
+}
+
+// EnableStats asks the provider to expose its stats, when it has to be asked
+func EnableStats(lbp LBProvider) {
+	if enabler, ok := lbp.(StatsEnabler); ok {
+		enabler.EnableStats()
+	}
+}
+
+const (
+	EndpointUp      = "up"
+	EndpointDown    = "down"
+	EndpointDrained = "drained"
+)
+
+// EndpointStatus is the health of an endpoint reported by the provider,
+// the endpoint is named after its backend uuid and its server name
+type EndpointStatus struct {
+	Backend string
+	Server  string
+	// Status is one of EndpointUp, EndpointDown or EndpointDrained
+	Status string
+}
+
+// EndpointStatusProvider is implemented by providers able
+// to report the health of the endpoints
+type EndpointStatusProvider interface {
+	GetEndpointStatus() ([]EndpointStatus, error)
+}
+
+// ErrPendingPromotion is returned by ApplyConfig when the config is held
+// in a secondary instance, the main one is unchanged until it's promoted
+var ErrPendingPromotion = errors.New("config is pending promotion")
+
+// ShadowProvider is implemented by providers able to hold a pending
+// config in a secondary instance until it gets promoted
+type ShadowProvider interface {
+	// PromoteShadowConfig applies the pending config to the main
+	// instance, the promoted config is returned
+	PromoteShadowConfig() (*config.LoadBalancerConfig, error)
+}
+
+// Capture is a request captured for debugging
+type Capture struct {
+	Time            time.Time `json:"time"`
+	Backend         string    `json:"backend"`
+	Client          string    `json:"client"`
+	Method          string    `json:"method"`
+	URI             string    `json:"uri"`
+	Status          int       `json:"status"`
+	RequestHeaders  string    `json:"request_headers"`
+	RequestBody     string    `json:"request_body"`
+	ResponseHeaders string    `json:"response_headers"`
+}
+
+// CaptureProvider is implemented by providers able to capture the
+// requests of the backends with debug capture enabled
+type CaptureProvider interface {
+	// GetCaptures returns the last captured requests, oldest first
+	GetCaptures() ([]Capture, error)
+}
+
+// RenderedConfigProvider is implemented by providers rendering the lb
+// configs into a config file of their own
+type RenderedConfigProvider interface {
+	// GetRenderedConfig returns the name and the content of the config
+	// file last rendered
+	GetRenderedConfig() (string, []byte, error)
+}
+
+// Capabilities are the version of the running proxy and
+// whether it supports the features by name
+type Capabilities struct {
+	Version  string          `json:"version"`
+	Features map[string]bool `json:"features"`
+}
+
+// CapabilityProvider is implemented by providers rendering the
+// configs for the version of the proxy they run
+type CapabilityProvider interface {
+	// GetCapabilities returns the capabilities of the running
+	// proxy, an error when its version is unknown
+	GetCapabilities() (*Capabilities, error)
+}
+
+// ConfigDrift is a live config modified out-of-band, its
+// checksum doesn't match the one of the config applied
+type ConfigDrift struct {
+	ConfigName string `json:"config_name"`
+	Path       string `json:"path"`
+	Expected   string `json:"expected"`
+	// Actual is empty when the live config was removed
+	Actual string `json:"actual"`
+}
+
+// DriftDetector is implemented by providers able to tell whether
+// the config the proxy runs still is the one they applied
+type DriftDetector interface {
+	// CheckDrift returns the drift of the live config,
+	// nil when it is unchanged or nothing was applied yet
+	CheckDrift() (*ConfigDrift, error)
+}
+
 var (
 	providers map[string]LBProvider
 )
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"strings"
+
+	"github.com/rancher/lb-controller/config"
+	utils "github.com/rancher/lb-controller/utils"
+)
+
+// LegacyLBProvider is the provider contract returning the
+// public endpoints as bare ips, FromLegacy adapts it
+type LegacyLBProvider interface {
+	ApplyConfig(lbConfig *config.LoadBalancerConfig) error
+	GetName() string
+	GetPublicEndpoints(configName string) []string
+	CleanupConfig(configName string) error
+	Run(syncEndpointsQueue *utils.TaskQueue)
+	Stop() error
+	IsHealthy() bool
+	ProcessCustomConfig(lbConfig *config.LoadBalancerConfig, customConfig string) error
+}
+
+type legacyProvider struct {
+	LegacyLBProvider
+}
+
+// FromLegacy adapts the provider returning bare ips, its public
+// endpoints have no port nor protocol
+func FromLegacy(lbp LegacyLBProvider) LBProvider {
+	return legacyProvider{lbp}
+}
+
+func (p legacyProvider) GetPublicEndpoints(configName string) []PublicEndpoint {
+	eps := []PublicEndpoint{}
+	for _, ip := range p.LegacyLBProvider.GetPublicEndpoints(configName) {
+		eps = append(eps, PublicEndpoint{IPAddress: ip})
+	}
+	return eps
+}
+
+// PublicEndpointIPs returns the distinct ips of the
+// endpoints, for the consumers of bare ips
+func PublicEndpointIPs(eps []PublicEndpoint) []string {
+	ips := []string{}
+	seen := map[string]bool{}
+	for _, ep := range eps {
+		if !seen[ep.IPAddress] {
+			seen[ep.IPAddress] = true
+			ips = append(ips, ep.IPAddress)
+		}
+	}
+	return ips
+}
+
+// TransportProtocol returns the transport protocol of the lb protocol,
+// ProtocolUDP for udp and ProtocolTCP for the rest
+func TransportProtocol(protocol string) string {
+	if strings.ToLower(protocol) == ProtocolUDP {
+		return ProtocolUDP
+	}
+	return ProtocolTCP
+}
@@ -3,7 +3,6 @@ package rancher
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -13,6 +12,7 @@ import (
 	"github.com/rancher/event-subscriber/locks"
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
 	"github.com/rancher/lb-controller/provider"
 	utils "github.com/rancher/lb-controller/utils"
 )
@@ -39,32 +39,28 @@ type LBProvider struct {
 	stopCh             chan struct{}
 }
 
+var lbSeparator = flags.String("RANCHER_LB_SEPARATOR", "rancherlb", "Separator in the names of the created lb services")
+
 func init() {
-	cattleURL := os.Getenv("CATTLE_URL")
+	cattleURL := flags.CattleURL.Get()
 	if len(cattleURL) == 0 {
 		logrus.Info("CATTLE_URL is not set, skipping init of Rancher LB provider")
 		return
 	}
 
-	cattleAccessKey := os.Getenv("CATTLE_ACCESS_KEY")
+	cattleAccessKey := flags.CattleAccessKey.Get()
 	if len(cattleAccessKey) == 0 {
 		logrus.Info("CATTLE_ACCESS_KEY is not set, skipping init of Rancher LB provider")
 		return
 	}
 
-	cattleSecretKey := os.Getenv("CATTLE_SECRET_KEY")
+	cattleSecretKey := flags.CattleSecretKey.Get()
 	if len(cattleSecretKey) == 0 {
 		logrus.Info("CATTLE_SECRET_KEY is not set, skipping init of Rancher LB provider")
 		return
 	}
 
-	separator := "rancherlb"
-	userSet := os.Getenv("RANCHER_LB_SEPARATOR")
-	if len(userSet) != 0 {
-		separator = userSet
-	}
-
-	lbSvcNameSeparator = fmt.Sprintf("-%s-", separator)
+	lbSvcNameSeparator = fmt.Sprintf("-%s-", lbSeparator.Get())
 
 	opts := &client.ClientOpts{
 		Url:       cattleURL,
@@ -220,8 +216,10 @@ func (lbp *LBProvider) GetName() string {
 	return "rancher"
 }
 
-func (lbp *LBProvider) GetPublicEndpoints(configName string) []string {
-	epStr := []string{}
+// GetPublicEndpoints returns the public endpoints cattle assigned to the lb,
+// the ingress lbs only publish tcp ports
+func (lbp *LBProvider) GetPublicEndpoints(configName string) []provider.PublicEndpoint {
+	epStr := []provider.PublicEndpoint{}
 	lb, err := lbp.getLBServiceForConfig(configName)
 	if err != nil {
 		logrus.Errorf("Failed to find LB [%s]: %v", configName, err)
@@ -259,7 +257,11 @@ func (lbp *LBProvider) GetPublicEndpoints(configName string) []string {
 			logrus.Errorf("Faield to convert public endpoints for LB [%s], skipping endpoint update %v", lb.Name, err)
 			return epStr
 		}
-		epStr = append(epStr, ep.IPAddress)
+		epStr = append(epStr, provider.PublicEndpoint{
+			IPAddress: ep.IPAddress,
+			Port:      ep.Port,
+			Protocol:  provider.ProtocolTCP,
+		})
 	}
 
 	return epStr
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	fullResyncInterval = flags.Duration("FULL_RESYNC_INTERVAL", 0, "Interval of the full resyncs rebuilding and reapplying the configs, along with the drift checks of the live config, 0 disables them")
+)
+
+/*
+Reconciler runs a full resync every interval, so a missed change
+notification or a config modified out-of-band doesn't last. The live
+config is checked for drift before each resync, a drift is logged as a
+warning and sent to the event sinks, the resync then reapplies the
+expected config
+*/
+type Reconciler struct {
+	Interval time.Duration
+	// Detector checks the live config, the drift
+	// is not checked when nil
+	Detector DriftDetector
+	// Resync rebuilds and reapplies the configs
+	// from fresh metadata, skipped when nil
+	Resync func()
+	// Events are sent the config drifts, they are only logged when nil
+	Events *EventHook
+}
+
+// NewReconcilerFromEnv configures the reconciler from the FULL_RESYNC_INTERVAL
+// env var, nil is returned when no interval is set
+func NewReconcilerFromEnv(lbp LBProvider, resync func()) *Reconciler {
+	interval := fullResyncInterval.Get()
+	if interval <= 0 {
+		return nil
+	}
+	r := &Reconciler{
+		Interval: interval,
+		Resync:   resync,
+	}
+	if detector, ok := lbp.(DriftDetector); ok {
+		r.Detector = detector
+	}
+	return r
+}
+
+// Run reconciles every interval until stopCh is closed
+func (r *Reconciler) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			r.reconcile()
+		}
+	}
+}
+
+// reconcile checks the live config for drift, then resyncs
+func (r *Reconciler) reconcile() *ConfigDrift {
+	var drift *ConfigDrift
+	if r.Detector != nil {
+		var err error
+		if drift, err = r.Detector.CheckDrift(); err != nil {
+			logrus.Errorf("Failed to check the live config for drift: %v", err)
+		} else if drift != nil {
+			r.alert(drift)
+		}
+	}
+	if r.Resync != nil {
+		logrus.Debugf("Running the periodic full resync")
+		r.Resync()
+	}
+	return drift
+}
+
+func (r *Reconciler) alert(drift *ConfigDrift) {
+	logrus.WithFields(logrus.Fields{
+		"config":   drift.ConfigName,
+		"path":     drift.Path,
+		"expected": drift.Expected,
+		"actual":   drift.Actual,
+	}).Warn("Live config was modified out-of-band, reapplying it")
+	if r.Events == nil {
+		return
+	}
+	event := &Event{
+		Event:      EventConfigDrift,
+		ConfigName: drift.ConfigName,
+		Time:       time.Now(),
+		Error:      fmt.Sprintf("%s was modified out-of-band", drift.Path),
+	}
+	r.Events.send(event)
+}
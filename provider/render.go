@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config"
+	utils "github.com/rancher/lb-controller/utils"
+)
+
+// ConfigRenderer is implemented by providers able to render the
+// lb configs into their config files without running the proxy
+type ConfigRenderer interface {
+	// RenderConfig writes the config files of the lb config
+	// to the dir, the paths of the files are returned
+	RenderConfig(lbConfig *config.LoadBalancerConfig, dir string) ([]string, error)
+}
+
+var (
+	renderers = map[string]ConfigRenderer{
+		"json": jsonRenderer{},
+	}
+)
+
+// RegisterRenderer registers a renderer of the lb configs, the
+// providers implementing ConfigRenderer don't need to be registered
+func RegisterRenderer(name string, renderer ConfigRenderer) error {
+	if _, exists := renderers[name]; exists {
+		return fmt.Errorf("renderer already registered")
+	}
+	renderers[name] = renderer
+	return nil
+}
+
+// GetRenderer returns the renderer registered under the name, or the
+// provider of that name when it renders its configs, nil otherwise
+func GetRenderer(name string) ConfigRenderer {
+	if renderer, ok := renderers[name]; ok {
+		return renderer
+	}
+	if renderer, ok := providers[name].(ConfigRenderer); ok {
+		return renderer
+	}
+	return nil
+}
+
+// jsonRenderer writes the lb configs as json, the private
+// keys of the certificates are left out
+type jsonRenderer struct{}
+
+func (jsonRenderer) RenderConfig(lbConfig *config.LoadBalancerConfig, dir string) ([]string, error) {
+	stripped := *lbConfig
+	stripped.DefaultCert = stripKey(lbConfig.DefaultCert)
+	stripped.Certs = nil
+	for _, cert := range lbConfig.Certs {
+		stripped.Certs = append(stripped.Certs, stripKey(cert))
+	}
+	b, err := json.MarshalIndent(stripped, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, lbConfig.Name+".json")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+func stripKey(cert *config.Certificate) *config.Certificate {
+	if cert == nil {
+		return nil
+	}
+	stripped := *cert
+	stripped.Key = ""
+	return &stripped
+}
+
+/*
+RenderOnlyProvider renders the configs the controller applies into a
+dir instead of running a proxy, so what the lb would do can be reviewed
+or checked in CI. The custom configs are still processed by the provider
+the configs are rendered for
+*/
+type RenderOnlyProvider struct {
+	LBProvider
+	renderer ConfigRenderer
+	dir      string
+
+	once    bool
+	done    chan struct{}
+	errMu   sync.Mutex
+	err     error
+	stopped sync.Once
+}
+
+// NewRenderOnlyProvider renders the configs of the provider with the
+// renderer into the dir. When once is set, Done is closed after the
+// first config is rendered or failed to
+func NewRenderOnlyProvider(lbp LBProvider, renderer ConfigRenderer, dir string, once bool) *RenderOnlyProvider {
+	return &RenderOnlyProvider{
+		LBProvider: lbp,
+		renderer:   renderer,
+		dir:        dir,
+		once:       once,
+		done:       make(chan struct{}),
+	}
+}
+
+func (p *RenderOnlyProvider) ApplyConfig(lbConfig *config.LoadBalancerConfig) error {
+	paths, err := p.renderer.RenderConfig(lbConfig, p.dir)
+	if err != nil {
+		err = fmt.Errorf("Failed to render lb config [%s]: %v", lbConfig.Name, err)
+	} else {
+		logrus.Infof("Rendered lb config [%s] to %v", lbConfig.Name, paths)
+	}
+	if p.once {
+		p.stopped.Do(func() {
+			p.errMu.Lock()
+			p.err = err
+			p.errMu.Unlock()
+			close(p.done)
+		})
+	}
+	return err
+}
+
+// Done is closed once the first config is rendered in once mode
+func (p *RenderOnlyProvider) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the error of the first render in once mode
+func (p *RenderOnlyProvider) Err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+func (p *RenderOnlyProvider) GetPublicEndpoints(configName string) []PublicEndpoint {
+	return []PublicEndpoint{}
+}
+
+func (p *RenderOnlyProvider) CleanupConfig(configName string) error {
+	return nil
+}
+
+// Run doesn't start the proxy, the configs are only rendered
+func (p *RenderOnlyProvider) Run(syncEndpointsQueue *utils.TaskQueue) {
+}
+
+func (p *RenderOnlyProvider) Stop() error {
+	return nil
+}
+
+func (p *RenderOnlyProvider) IsHealthy() bool {
+	return true
+}
@@ -0,0 +1,159 @@
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/lb-controller/config"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	shrinkGuardPercent = flags.Int("SHRINK_GUARD_PERCENT", 0, "Percent of the backends or endpoints a config may remove before its apply is deferred, 0 disables the guard").Range(0, 100)
+	shrinkGuardConfirm = flags.Duration("SHRINK_GUARD_CONFIRM_INTERVAL", 2*time.Minute, "How long a shrinking config is deferred before it is applied")
+
+	shrinkDeferred = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_config_shrink_deferred",
+		Help: "Set to 1 while the apply of a shrinking config is deferred",
+	}, []string{"config"})
+	shrinkRegisterOnce sync.Once
+)
+
+/*
+ShrinkGuard defers the apply of the configs removing more than Percent of
+the backends or endpoints of the last applied config, guarding against
+metadata outages wiping the routing. The config is applied once it keeps
+shrinking for the Confirm interval, the controller retrying the sync
+meanwhile. The deferral is logged as an error and exported as the
+lb_config_shrink_deferred gauge
+*/
+type ShrinkGuard struct {
+	Percent int
+	Confirm time.Duration
+
+	mu sync.Mutex
+	// applied are the backends and endpoints of the last applied configs
+	applied map[string]*configTargets
+	// deferred is when the deferral of the configs started
+	deferred map[string]time.Time
+	now      func() time.Time
+}
+
+// configTargets holds the backend uuids, and the
+// endpoints keyed by their backend and address
+type configTargets struct {
+	backends  map[string]bool
+	endpoints map[string]bool
+}
+
+// NewShrinkGuardFromEnv configures the guard from SHRINK_GUARD_PERCENT and
+// SHRINK_GUARD_CONFIRM_INTERVAL env vars. Nil is returned when disabled
+func NewShrinkGuardFromEnv() *ShrinkGuard {
+	if shrinkGuardPercent.Get() == 0 {
+		return nil
+	}
+	return NewShrinkGuard(shrinkGuardPercent.Get(), shrinkGuardConfirm.Get())
+}
+
+func NewShrinkGuard(percent int, confirm time.Duration) *ShrinkGuard {
+	shrinkRegisterOnce.Do(func() {
+		prometheus.MustRegister(shrinkDeferred)
+	})
+	return &ShrinkGuard{
+		Percent:  percent,
+		Confirm:  confirm,
+		applied:  map[string]*configTargets{},
+		deferred: map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+func (g *ShrinkGuard) PreApply(lbConfig *config.LoadBalancerConfig) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	previous := g.applied[lbConfig.Name]
+	if previous == nil {
+		return nil
+	}
+	current := newConfigTargets(lbConfig)
+	backends := removedPercent(previous.backends, current.backends)
+	endpoints := removedPercent(previous.endpoints, current.endpoints)
+	if backends <= g.Percent && endpoints <= g.Percent {
+		g.confirm(lbConfig.Name)
+		return nil
+	}
+	now := g.now()
+	since, ok := g.deferred[lbConfig.Name]
+	if !ok {
+		since = now
+		g.deferred[lbConfig.Name] = since
+		shrinkDeferred.WithLabelValues(lbConfig.Name).Set(1)
+		logrus.Errorf("Config of lb [%s] removes %v%% of the backends and %v%% of the endpoints, deferring its apply for %v", lbConfig.Name, backends, endpoints, g.Confirm)
+	}
+	if now.Sub(since) < g.Confirm {
+		return fmt.Errorf("config removes %v%% of the backends and %v%% of the endpoints, apply deferred until %v", backends, endpoints, since.Add(g.Confirm).Format(time.RFC3339))
+	}
+	logrus.Warnf("Config of lb [%s] kept shrinking for %v, applying it", lbConfig.Name, g.Confirm)
+	g.confirm(lbConfig.Name)
+	return nil
+}
+
+func (g *ShrinkGuard) PostApply(lbConfig *config.LoadBalancerConfig, applyErr error) error {
+	if applyErr != nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.applied[lbConfig.Name] = newConfigTargets(lbConfig)
+	return nil
+}
+
+func (g *ShrinkGuard) PostCleanup(configName string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.applied, configName)
+	g.confirm(configName)
+	return nil
+}
+
+// confirm ends the deferral of the config
+func (g *ShrinkGuard) confirm(configName string) {
+	if _, ok := g.deferred[configName]; !ok {
+		return
+	}
+	delete(g.deferred, configName)
+	shrinkDeferred.WithLabelValues(configName).Set(0)
+}
+
+func newConfigTargets(lbConfig *config.LoadBalancerConfig) *configTargets {
+	t := &configTargets{
+		backends:  map[string]bool{},
+		endpoints: map[string]bool{},
+	}
+	for _, fe := range lbConfig.FrontendServices {
+		for _, be := range fe.BackendServices {
+			t.backends[be.UUID] = true
+			for _, ep := range be.Endpoints {
+				t.endpoints[fmt.Sprintf("%s/%s:%v", be.UUID, ep.IP, ep.Port)] = true
+			}
+		}
+	}
+	return t
+}
+
+// removedPercent is the percent of the previous keys missing in current
+func removedPercent(previous, current map[string]bool) int {
+	if len(previous) == 0 {
+		return 0
+	}
+	removed := 0
+	for k := range previous {
+		if !current[k] {
+			removed++
+		}
+	}
+	return removed * 100 / len(previous)
+}
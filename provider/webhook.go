@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+const (
+	// WebhookSignatureHeader holds the hex encoded hmac-sha256 of the
+	// timestamp, a dot and the request body, keyed with the webhook secret
+	WebhookSignatureHeader = "X-LB-Signature"
+	// WebhookTimestampHeader holds the unix time the notification was
+	// signed at. Receivers reject the notifications signed outside of
+	// their tolerance window, 5 minutes is advised, so the captured
+	// notifications can't be replayed
+	WebhookTimestampHeader = "X-LB-Timestamp"
+)
+
+var (
+	webhookURL     = flags.String("APPLY_WEBHOOK_URL", "", "Url notified of the config applies")
+	webhookSecret  = flags.Secret("APPLY_WEBHOOK_SECRET", "Key of the hmac signature of the config apply notifications")
+	webhookTimeout = flags.Duration("APPLY_WEBHOOK_TIMEOUT", 10*time.Second, "Timeout of the config apply notifications")
+)
+
+func init() {
+	RegisterEventSink("webhook", NewWebhookSinkFromEnv)
+}
+
+// WebhookSink posts the events to the url as json,
+// signed with the secret when one is set
+type WebhookSink struct {
+	URL     string
+	Secret  string
+	Timeout time.Duration
+
+	client *http.Client
+}
+
+// NewWebhookSinkFromEnv configures the webhook from APPLY_WEBHOOK_URL,
+// APPLY_WEBHOOK_SECRET and APPLY_WEBHOOK_TIMEOUT env vars. Nil is
+// returned when no url is set
+func NewWebhookSinkFromEnv() (EventSink, error) {
+	if webhookURL.Get() == "" {
+		return nil, nil
+	}
+	return NewWebhookSink(webhookURL.Get(), webhookSecret.Get(), webhookTimeout.Get()), nil
+}
+
+func NewWebhookSink(url string, secret string, timeout time.Duration) *WebhookSink {
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return &WebhookSink{
+		URL:     url,
+		Secret:  secret,
+		Timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signWebhook(s.Secret, timestamp, body))
+	}
+	logrus.Debugf("Sending %s webhook for lb [%s]", event.Event, event.ConfigName)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to send %s webhook: %v", event.Event, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Failed to send %s webhook: %s", event.Event, resp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
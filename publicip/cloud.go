@@ -0,0 +1,81 @@
+package publicip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MetadataResolver reads public ip of the local host from
+// the metadata service of the cloud provider
+type MetadataResolver struct {
+	Name    string
+	URL     string
+	Headers map[string]string
+	client  *http.Client
+}
+
+func newMetadataResolver(name string, url string, headers map[string]string) *MetadataResolver {
+	return &MetadataResolver{
+		Name:    name,
+		URL:     url,
+		Headers: headers,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func newAWSResolver() *MetadataResolver {
+	return newMetadataResolver("aws", "http://169.254.169.254/latest/meta-data/public-ipv4", nil)
+}
+
+func newGCEResolver() *MetadataResolver {
+	return newMetadataResolver("gce",
+		"http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip",
+		map[string]string{"Metadata-Flavor": "Google"})
+}
+
+func newAzureResolver() *MetadataResolver {
+	return newMetadataResolver("azure",
+		"http://169.254.169.254/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress?api-version=2017-08-01&format=text",
+		map[string]string{"Metadata": "true"})
+}
+
+func (r *MetadataResolver) Resolve(hostIP string, local bool) (string, error) {
+	if !local {
+		return "", nil
+	}
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to query %s metadata: %v", r.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// no public ip assigned
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to query %s metadata, status %s", r.Name, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(body))
+	if ip == "" {
+		return "", nil
+	}
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("Invalid public ip %q reported by %s metadata", ip, r.Name)
+	}
+	return ip, nil
+}
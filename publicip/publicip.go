@@ -0,0 +1,158 @@
+/*
+Package publicip resolves public addresses of the hosts, for the setups
+where the hosts are behind NAT and their agent ips are not reachable
+by the clients of the lb.
+
+Cloud metadata and STUN resolvers can only discover the address of the
+host the controller runs on; the addresses of the other hosts are taken
+from the static map.
+*/
+package publicip
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var (
+	resolverNames = flags.String("PUBLIC_IP_RESOLVER", "", "Comma separated list of the resolvers of the public ip of the host tried in order, aws, gce, azure and stun")
+	stunServer    = flags.String("STUN_SERVER", defaultSTUNServer, "Address of the STUN server the stun resolver asks")
+)
+
+const (
+	defaultCacheTTL    = 5 * time.Minute
+	defaultCacheErrTTL = 30 * time.Second
+)
+
+// Resolver returns public ip of the host by its agent ip, or empty
+// string when the public ip is unknown. Local is set for the host
+// the controller runs on
+type Resolver interface {
+	Resolve(hostIP string, local bool) (string, error)
+}
+
+// NewResolverFromEnv configures the resolver from PUBLIC_IP_RESOLVER env
+// var, a comma separated list of aws, gce, azure and stun resolvers tried
+// in order. Nil is returned when no resolver is set
+func NewResolverFromEnv() (Resolver, error) {
+	value := resolverNames.Get()
+	if value == "" {
+		return nil, nil
+	}
+	var resolvers Chain
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		var r Resolver
+		switch name {
+		case "":
+			continue
+		case "aws":
+			r = newAWSResolver()
+		case "gce":
+			r = newGCEResolver()
+		case "azure":
+			r = newAzureResolver()
+		case "stun":
+			r = &STUNResolver{Server: stunServer.Get(), Timeout: 5 * time.Second}
+		default:
+			return nil, fmt.Errorf("Unsupported PUBLIC_IP_RESOLVER %s, supported resolvers are aws, gce, azure and stun", name)
+		}
+		resolvers = append(resolvers, r)
+	}
+	return &cachedResolver{Resolver: resolvers, ttl: defaultCacheTTL, errTTL: defaultCacheErrTTL}, nil
+}
+
+// Chain returns the first public ip found by its resolvers
+type Chain []Resolver
+
+func (c Chain) Resolve(hostIP string, local bool) (string, error) {
+	var lastErr error
+	for _, r := range c {
+		if r == nil {
+			continue
+		}
+		ip, err := r.Resolve(hostIP, local)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ip != "" {
+			return ip, nil
+		}
+	}
+	return "", lastErr
+}
+
+// StaticMap maps agent ips to public ips
+type StaticMap map[string]string
+
+/*
+ParseStaticMap parses comma separated agent to public ip pairs:
+
+10.0.0.1=52.1.1.1,10.0.0.2=52.1.1.2
+*/
+func ParseStaticMap(value string) (StaticMap, error) {
+	m := StaticMap{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("Invalid public ip mapping %s, should be in agent_ip=public_ip format", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+func (m StaticMap) Resolve(hostIP string, local bool) (string, error) {
+	return m[hostIP], nil
+}
+
+// cachedResolver caches resolved ips, as metadata and STUN lookups
+// are done on every endpoints update. The failures are cached for
+// errTTL, so an unreachable server doesn't block every update
+type cachedResolver struct {
+	Resolver
+	ttl    time.Duration
+	errTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedIP
+}
+
+type cachedIP struct {
+	ip      string
+	err     error
+	expires time.Time
+}
+
+func (r *cachedResolver) Resolve(hostIP string, local bool) (string, error) {
+	key := fmt.Sprintf("%s/%v", hostIP, local)
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ip, cached.err
+	}
+	// the lookup is done unlocked, so the hosts
+	// already cached don't wait for it
+	ip, err := r.Resolver.Resolve(hostIP, local)
+	ttl := r.ttl
+	if err != nil {
+		ip, ttl = "", r.errTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = map[string]cachedIP{}
+	}
+	r.cache[key] = cachedIP{ip: ip, err: err, expires: time.Now().Add(ttl)}
+	return ip, err
+}
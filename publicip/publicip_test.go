@@ -0,0 +1,108 @@
+package publicip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseStaticMap(t *testing.T) {
+	m, err := ParseStaticMap("10.0.0.1=52.1.1.1, 10.0.0.2 = 52.1.1.2,")
+	if err != nil {
+		t.Fatalf("Failed to parse static map: %v", err)
+	}
+	if len(m) != 2 || m["10.0.0.1"] != "52.1.1.1" || m["10.0.0.2"] != "52.1.1.2" {
+		t.Fatalf("Invalid static map %v", m)
+	}
+	if _, err := ParseStaticMap("10.0.0.1"); err == nil {
+		t.Fatal("Invalid mapping is not reported")
+	}
+}
+
+type tLocalResolver string
+
+func (r tLocalResolver) Resolve(hostIP string, local bool) (string, error) {
+	if !local {
+		return "", nil
+	}
+	return string(r), nil
+}
+
+func TestChain(t *testing.T) {
+	c := Chain{StaticMap{"10.0.0.1": "52.1.1.1"}, tLocalResolver("52.2.2.2")}
+	for _, tc := range []struct {
+		hostIP   string
+		local    bool
+		expected string
+	}{
+		{"10.0.0.1", false, "52.1.1.1"},
+		{"10.0.0.1", true, "52.1.1.1"},
+		{"10.0.0.2", true, "52.2.2.2"},
+		{"10.0.0.2", false, ""},
+	} {
+		ip, err := c.Resolve(tc.hostIP, tc.local)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %v", tc.hostIP, err)
+		}
+		if ip != tc.expected {
+			t.Fatalf("Invalid public ip of %s (local %v): %s", tc.hostIP, tc.local, ip)
+		}
+	}
+}
+
+// tFailingResolver counts its lookups, which fail
+type tFailingResolver struct {
+	lookups int
+}
+
+func (r *tFailingResolver) Resolve(hostIP string, local bool) (string, error) {
+	r.lookups++
+	return "", fmt.Errorf("metadata server unreachable")
+}
+
+func TestCachedResolverErrors(t *testing.T) {
+	failing := &tFailingResolver{}
+	r := &cachedResolver{Resolver: failing, ttl: time.Minute, errTTL: time.Minute}
+	for i := 0; i < 3; i++ {
+		if _, err := r.Resolve("10.0.0.1", true); err == nil {
+			t.Fatal("Lookup failure is not reported")
+		}
+	}
+	if failing.lookups != 1 {
+		t.Fatalf("Failures should be cached, got %v lookups", failing.lookups)
+	}
+	r.errTTL = 0
+	r.cache = nil
+	r.Resolve("10.0.0.1", true)
+	r.Resolve("10.0.0.1", true)
+	if failing.lookups != 3 {
+		t.Fatalf("Expired failures should be looked up again, got %v lookups", failing.lookups)
+	}
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	txID := []byte("0123456789ab")
+	resp := make([]byte, stunHeaderLength+12)
+	binary.BigEndian.PutUint16(resp[0:2], stunBindingResponse)
+	binary.BigEndian.PutUint16(resp[2:4], 12)
+	binary.BigEndian.PutUint32(resp[4:8], stunMagicCookie)
+	copy(resp[8:20], txID)
+	attr := resp[stunHeaderLength:]
+	binary.BigEndian.PutUint16(attr[0:2], stunXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], 8)
+	attr[5] = 0x01
+	// 52.1.1.1 xor magic cookie
+	copy(attr[8:12], []byte{52 ^ 0x21, 1 ^ 0x12, 1 ^ 0xA4, 1 ^ 0x42})
+
+	ip, err := parseSTUNResponse(resp, txID)
+	if err != nil {
+		t.Fatalf("Failed to parse STUN response: %v", err)
+	}
+	if ip.String() != "52.1.1.1" {
+		t.Fatalf("Invalid mapped address %s", ip)
+	}
+	if _, err := parseSTUNResponse(resp, []byte("ba9876543210")); err == nil {
+		t.Fatal("Transaction id mismatch is not reported")
+	}
+}
@@ -0,0 +1,122 @@
+package publicip
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultSTUNServer = "stun.l.google.com:19302"
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderLength    = 20
+
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+)
+
+// STUNResolver discovers public ip of the local host with
+// a STUN binding request (RFC 5389)
+type STUNResolver struct {
+	Server  string
+	Timeout time.Duration
+}
+
+func (r *STUNResolver) Resolve(hostIP string, local bool) (string, error) {
+	if !local {
+		return "", nil
+	}
+	conn, err := net.Dial("udp", r.Server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+
+	req := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	resp := make([]byte, 1024)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return "", fmt.Errorf("STUN request to %s failed: %v", r.Server, err)
+	}
+	ip, err := parseSTUNResponse(resp[:n], req[8:20])
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+func parseSTUNResponse(resp []byte, txID []byte) (net.IP, error) {
+	if len(resp) < stunHeaderLength {
+		return nil, fmt.Errorf("STUN response is too short")
+	}
+	if binary.BigEndian.Uint16(resp[0:2]) != stunBindingResponse {
+		return nil, fmt.Errorf("Unexpected STUN message type %#x", binary.BigEndian.Uint16(resp[0:2]))
+	}
+	if binary.BigEndian.Uint32(resp[4:8]) != stunMagicCookie || string(resp[8:20]) != string(txID) {
+		return nil, fmt.Errorf("STUN response doesn't match the request")
+	}
+	length := int(binary.BigEndian.Uint16(resp[2:4]))
+	if len(resp) < stunHeaderLength+length {
+		return nil, fmt.Errorf("STUN response is truncated")
+	}
+	var mapped net.IP
+	attrs := resp[stunHeaderLength : stunHeaderLength+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunXorMappedAddress:
+			if ip := parseSTUNAddress(value, true); ip != nil {
+				return ip, nil
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(value, false)
+		}
+		// attributes are padded to 4 bytes
+		next := 4 + (attrLen+3)/4*4
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, fmt.Errorf("STUN response has no mapped address")
+}
+
+// parseSTUNAddress parses IPv4 (xor) mapped address attribute
+func parseSTUNAddress(value []byte, xor bool) net.IP {
+	// reserved, family, port, address
+	if len(value) != 8 || value[1] != 0x01 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	copy(ip, value[4:8])
+	if xor {
+		cookie := make([]byte, 4)
+		binary.BigEndian.PutUint32(cookie, stunMagicCookie)
+		for i := range ip {
+			ip[i] ^= cookie[i]
+		}
+	}
+	return ip
+}
@@ -0,0 +1,240 @@
+/*
+Package cattle wraps the go-rancher client with timeouts, retries and
+circuit breaking of the Rancher API calls.
+
+Calls failing with a 5xx or a connection error are retried with an
+exponential backoff. Once a number of consecutive calls failed, the
+circuit opens and the calls fail fast until the cooldown is over, the
+next call then probes the API and closes the circuit when it succeeds.
+
+Calls failing with a 401 re-read the credentials, and are made again
+with a new client when the credentials were rotated.
+*/
+package cattle
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+// ErrCircuitOpen is returned by the calls made while the circuit is open
+var ErrCircuitOpen = errors.New("Rancher API circuit is open, skipping the call")
+
+// Client makes the go-rancher client calls through Do
+type Client struct {
+	Retries int
+	Backoff time.Duration
+	// MaxBackoff caps the backoff between the retries
+	MaxBackoff time.Duration
+
+	breaker *breaker
+	sleep   func(time.Duration)
+
+	mu            sync.RWMutex
+	rancherClient *client.RancherClient
+	opts          client.ClientOpts
+	// readCredentials and newClient are called to refresh the credentials
+	readCredentials func() (*Credentials, error)
+	newClient       func(opts *client.ClientOpts) (*client.RancherClient, error)
+}
+
+/*
+NewClientFromEnv creates the client of the api at url with the CATTLE_*
+env vars settings, the credentials are read with ReadCredentials
+*/
+func NewClientFromEnv(url string) (*Client, error) {
+	return NewClientWithCredentials(url, ReadCredentials)
+}
+
+// NewClientWithCredentials creates the client of the api at url with the
+// CATTLE_* env vars settings, the credentials are read with readCredentials
+// and read again when the api rejects them
+func NewClientWithCredentials(url string, readCredentials func() (*Credentials, error)) (*Client, error) {
+	credentials, err := readCredentials()
+	if err != nil {
+		return nil, err
+	}
+	opts := &client.ClientOpts{
+		Url:       url,
+		AccessKey: credentials.AccessKey,
+		SecretKey: credentials.SecretKey,
+		Timeout:   flags.CattleTimeout.Get(),
+	}
+	rancherClient, err := client.NewRancherClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(rancherClient)
+	c.opts = *opts
+	c.readCredentials = readCredentials
+	c.Retries = flags.CattleRetries.Get()
+	c.Backoff = flags.CattleRetryBackoff.Get()
+	c.breaker = newBreaker(flags.CattleBreakerThreshold.Get(), flags.CattleBreakerCooldown.Get())
+	return c, nil
+}
+
+func NewClient(rancherClient *client.RancherClient) *Client {
+	return &Client{
+		Retries:       flags.CattleRetries.Default.(int),
+		Backoff:       flags.CattleRetryBackoff.Default.(time.Duration),
+		MaxBackoff:    30 * time.Second,
+		breaker:       newBreaker(flags.CattleBreakerThreshold.Default.(int), flags.CattleBreakerCooldown.Default.(time.Duration)),
+		sleep:         time.Sleep,
+		rancherClient: rancherClient,
+		newClient:     client.NewRancherClient,
+	}
+}
+
+// RancherClient returns the go-rancher client of the current credentials
+func (c *Client) RancherClient() *client.RancherClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rancherClient
+}
+
+/*
+Do makes the call named after op with the current go-rancher client,
+retrying it on retryable errors. The error of the last attempt is
+returned, prefixed with op
+*/
+func (c *Client) Do(op string, call func(rancherClient *client.RancherClient) error) error {
+	if !c.breaker.allow() {
+		return fmt.Errorf("%s: %v", op, ErrCircuitOpen)
+	}
+	backoff := c.Backoff
+	var err error
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		err = call(c.RancherClient())
+		if IsAuthError(err) && !refreshed {
+			// the call is made again only once with the new credentials
+			refreshed = true
+			if c.refresh() {
+				attempt--
+				continue
+			}
+		}
+		if err == nil || !IsRetryable(err) {
+			break
+		}
+		if attempt >= c.Retries {
+			break
+		}
+		logrus.Warnf("Rancher API call %s failed, retrying in %v: %v", op, backoff, err)
+		c.sleep(backoff)
+		if backoff *= 2; c.MaxBackoff > 0 && backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+	// errors returned by the api for the request itself
+	// don't tell anything about the api health
+	c.breaker.done(err == nil || !IsRetryable(err))
+	if err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	return nil
+}
+
+// refresh re-reads the credentials, and replaces the go-rancher
+// client when they changed. It returns whether the client was replaced
+func (c *Client) refresh() bool {
+	if c.readCredentials == nil {
+		return false
+	}
+	credentials, err := c.readCredentials()
+	if err != nil {
+		logrus.Errorf("Failed to re-read the Rancher API credentials: %v", err)
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if credentials.AccessKey == c.opts.AccessKey && credentials.SecretKey == c.opts.SecretKey {
+		return false
+	}
+	opts := c.opts
+	opts.AccessKey, opts.SecretKey = credentials.AccessKey, credentials.SecretKey
+	rancherClient, err := c.newClient(&opts)
+	if err != nil {
+		logrus.Errorf("Failed to create Rancher client with the rotated credentials: %v", err)
+		return false
+	}
+	logrus.Infof("Rancher API credentials were rotated, using access key %s", opts.AccessKey)
+	c.opts = opts
+	c.rancherClient = rancherClient
+	return true
+}
+
+// IsAuthError tells whether the error is a 401
+func IsAuthError(err error) bool {
+	e, ok := err.(*client.ApiError)
+	return ok && e.StatusCode == 401
+}
+
+// IsRetryable tells whether the error is a 5xx or a connection error
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *client.ApiError:
+		return e.StatusCode >= 500 || e.StatusCode == 429
+	case *url.Error, net.Error:
+		return true
+	}
+	return false
+}
+
+// breaker opens after threshold consecutive failures, and lets
+// a single call through once the cooldown is over
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) done(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		if b.threshold > 0 && b.failures >= b.threshold {
+			logrus.Infof("Rancher API circuit is closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			logrus.Errorf("Rancher API circuit is open after %v failed calls, failing the calls for %v", b.failures, b.cooldown)
+		}
+		b.openedAt = b.now()
+	}
+}
@@ -0,0 +1,160 @@
+package cattle
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher/v2"
+)
+
+func newTestClient(retries, threshold int) (*Client, *[]time.Duration) {
+	var sleeps []time.Duration
+	c := NewClient(nil)
+	c.Retries = retries
+	c.Backoff = time.Second
+	c.MaxBackoff = 3 * time.Second
+	c.breaker = newBreaker(threshold, time.Minute)
+	c.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return c, &sleeps
+}
+
+func TestRetries(t *testing.T) {
+	c, sleeps := newTestClient(3, 0)
+	calls := 0
+	err := c.Do("test", func(*client.RancherClient) error {
+		calls++
+		if calls < 3 {
+			return &client.ApiError{StatusCode: 503}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("Expected 3 calls and no error, got %v calls and %v", calls, err)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[0] != time.Second || (*sleeps)[1] != 2*time.Second {
+		t.Fatalf("Unexpected backoffs %v", *sleeps)
+	}
+
+	// backoff is capped, and the last error is returned
+	calls = 0
+	*sleeps = nil
+	err = c.Do("test", func(*client.RancherClient) error {
+		calls++
+		return &url.Error{Op: "Get", URL: "http://cattle", Err: errors.New("connection refused")}
+	})
+	if err == nil || !strings.Contains(err.Error(), "connection refused") || calls != 4 {
+		t.Fatalf("Expected 4 calls and the connection error, got %v calls and %v", calls, err)
+	}
+	if (*sleeps)[2] != 3*time.Second {
+		t.Fatalf("Unexpected backoffs %v", *sleeps)
+	}
+
+	// client errors are not retried
+	calls = 0
+	err = c.Do("test", func(*client.RancherClient) error {
+		calls++
+		return &client.ApiError{StatusCode: 404}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("Expected a single call and an error, got %v calls and %v", calls, err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	c, _ := newTestClient(0, 2)
+	now := time.Now()
+	c.breaker.now = func() time.Time { return now }
+	fail := func(*client.RancherClient) error { return &client.ApiError{StatusCode: 500} }
+	calls := 0
+	succeed := func(*client.RancherClient) error {
+		calls++
+		return nil
+	}
+
+	c.Do("test", fail)
+	// client errors don't open the circuit
+	c.Do("test", func(*client.RancherClient) error { return &client.ApiError{StatusCode: 422} })
+	if err := c.Do("test", succeed); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	c.Do("test", fail)
+	c.Do("test", fail)
+	if err := c.Do("test", succeed); err == nil || !strings.Contains(err.Error(), ErrCircuitOpen.Error()) || calls != 1 {
+		t.Fatalf("Expected the circuit to be open, got %v", err)
+	}
+
+	// a failed probe opens the circuit again
+	now = now.Add(time.Minute)
+	c.Do("test", fail)
+	if err := c.Do("test", succeed); err == nil {
+		t.Fatalf("Expected the circuit to be open after the failed probe")
+	}
+
+	now = now.Add(time.Minute)
+	if err := c.Do("test", succeed); err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", err)
+	}
+	if err := c.Do("test", succeed); err != nil || calls != 3 {
+		t.Fatalf("Expected the circuit to be closed, got %v", err)
+	}
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	c, _ := newTestClient(0, 0)
+	c.opts = client.ClientOpts{Url: "http://cattle", AccessKey: "old", SecretKey: "old-secret"}
+	credentials := &Credentials{AccessKey: "old", SecretKey: "old-secret"}
+	c.readCredentials = func() (*Credentials, error) { return credentials, nil }
+	rotated := &client.RancherClient{}
+	c.newClient = func(opts *client.ClientOpts) (*client.RancherClient, error) {
+		if opts.AccessKey != "new" || opts.SecretKey != "new-secret" || opts.Url != "http://cattle" {
+			t.Fatalf("Unexpected client opts %v", opts)
+		}
+		return rotated, nil
+	}
+	call := func(rancherClient *client.RancherClient) error {
+		if rancherClient != rotated {
+			return &client.ApiError{StatusCode: 401}
+		}
+		return nil
+	}
+
+	// the credentials didn't change, the call is not made again
+	if err := c.Do("test", call); err == nil {
+		t.Fatalf("Expected the call to fail before the rotation, got %v", err)
+	}
+	credentials = &Credentials{AccessKey: "new", SecretKey: "new-secret"}
+	if err := c.Do("test", call); err != nil {
+		t.Fatalf("Expected the call to succeed with the rotated credentials, got %v", err)
+	}
+	if c.RancherClient() != rotated {
+		t.Fatalf("Expected the client to be replaced")
+	}
+}
+
+func TestReadCredentialsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# rotated by rancher\nCATTLE_ACCESS_KEY=access\n\nexport CATTLE_SECRET_KEY=\"secret\"\nOTHER=value\n")
+	f.Close()
+
+	credentials, err := readCredentialsFile(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if credentials.AccessKey != "access" || credentials.SecretKey != "secret" {
+		t.Fatalf("Unexpected credentials %v", credentials)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("CATTLE_ACCESS_KEY\n"), 0600)
+	if _, err := readCredentialsFile(f.Name()); err == nil {
+		t.Fatalf("Expected an error on invalid lines")
+	}
+}
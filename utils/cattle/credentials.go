@@ -0,0 +1,73 @@
+package cattle
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/rancher/lb-controller/config/flags"
+)
+
+var credentialsFile = flags.String("CATTLE_CREDENTIALS_FILE", "", "File holding the CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY lines, re-read when the Rancher API rejects the credentials")
+
+// Credentials are the keys of the Rancher API
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+/*
+ReadCredentials reads the credentials from the CATTLE_CREDENTIALS_FILE
+when set, the keys it doesn't hold are read from the CATTLE_ACCESS_KEY
+and CATTLE_SECRET_KEY env vars
+*/
+func ReadCredentials() (*Credentials, error) {
+	credentials := &Credentials{}
+	if credentialsFile.Get() != "" {
+		var err error
+		if credentials, err = readCredentialsFile(credentialsFile.Get()); err != nil {
+			return nil, err
+		}
+	}
+	if credentials.AccessKey == "" {
+		credentials.AccessKey = flags.CattleAccessKey.Get()
+	}
+	if credentials.SecretKey == "" {
+		credentials.SecretKey = flags.CattleSecretKey.Get()
+	}
+	if credentials.AccessKey == "" || credentials.SecretKey == "" {
+		return nil, fmt.Errorf("CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY should be set, in the env or in the CATTLE_CREDENTIALS_FILE")
+	}
+	return credentials, nil
+}
+
+// readCredentialsFile parses the KEY=value lines of the file,
+// blank lines and lines starting with # are skipped
+func readCredentialsFile(path string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the credentials file: %v", err)
+	}
+	credentials := &Credentials{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid line %v of the credentials file %s", n, path)
+		}
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		switch strings.TrimSpace(strings.TrimPrefix(parts[0], "export ")) {
+		case flags.CattleAccessKey.Name:
+			credentials.AccessKey = value
+		case flags.CattleSecretKey.Name:
+			credentials.SecretKey = value
+		}
+	}
+	return credentials, scanner.Err()
+}
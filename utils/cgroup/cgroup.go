@@ -0,0 +1,113 @@
+/*
+Package cgroup reads the memory and cpu limits of the container from its
+cgroup, with cgroup v2 unified hierarchy and v1 controllers supported.
+*/
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultRoot is where the cgroup filesystem is mounted in the container
+const DefaultRoot = "/sys/fs/cgroup"
+
+// limits over this are the v1 way of telling there is no limit
+const unlimitedMemory = 1 << 60
+
+// Limits are the resource limits of the container, zero when unlimited
+type Limits struct {
+	MemoryBytes int64
+	// CPUs is the cpu quota in cpus, 1.5 for 150ms every 100ms
+	CPUs float64
+}
+
+// Read reads the limits of the cgroup mounted at root, the v2 files are
+// tried first. Missing files are read as no limit
+func Read(root string) (Limits, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return readV2(root)
+	}
+	return readV1(root)
+}
+
+func readV2(root string) (Limits, error) {
+	limits := Limits{}
+	memory, err := readFile(filepath.Join(root, "memory.max"))
+	if err != nil {
+		return limits, err
+	}
+	if memory != "" && memory != "max" {
+		if limits.MemoryBytes, err = strconv.ParseInt(memory, 10, 64); err != nil {
+			return limits, err
+		}
+	}
+	cpu, err := readFile(filepath.Join(root, "cpu.max"))
+	if err != nil {
+		return limits, err
+	}
+	// cpu.max is "<quota> <period>", with max as quota when unlimited
+	if fields := strings.Fields(cpu); len(fields) == 2 && fields[0] != "max" {
+		limits.CPUs, err = quota(fields[0], fields[1])
+	}
+	return limits, err
+}
+
+func readV1(root string) (Limits, error) {
+	limits := Limits{}
+	memory, err := readFile(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return limits, err
+	}
+	if memory != "" {
+		if limits.MemoryBytes, err = strconv.ParseInt(memory, 10, 64); err != nil {
+			return limits, err
+		}
+		if limits.MemoryBytes >= unlimitedMemory {
+			limits.MemoryBytes = 0
+		}
+	}
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		cpuQuota, err := readFile(filepath.Join(root, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			return limits, err
+		}
+		if cpuQuota == "" {
+			continue
+		}
+		if cpuQuota != "-1" {
+			period, err := readFile(filepath.Join(root, dir, "cpu.cfs_period_us"))
+			if err != nil {
+				return limits, err
+			}
+			limits.CPUs, err = quota(cpuQuota, period)
+			return limits, err
+		}
+		break
+	}
+	return limits, nil
+}
+
+func quota(quota, period string) (float64, error) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil {
+		return 0, err
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, err
+	}
+	return q / p, nil
+}
+
+// readFile returns the trimmed content of the file, empty when it doesn't exist
+func readFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
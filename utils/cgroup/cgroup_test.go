@@ -0,0 +1,61 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s %v", name, err)
+		}
+	}
+	return root
+}
+
+func TestReadV2(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"cgroup.controllers": "cpu memory",
+		"memory.max":         "268435456\n",
+		"cpu.max":            "150000 100000\n",
+	})
+	defer os.RemoveAll(root)
+	limits, err := Read(root)
+	if err != nil || limits.MemoryBytes != 256<<20 || limits.CPUs != 1.5 {
+		t.Fatalf("Invalid limits %+v %v", limits, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "memory.max"), []byte("max\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "cpu.max"), []byte("max 100000\n"), 0644)
+	if limits, err = Read(root); err != nil || limits != (Limits{}) {
+		t.Fatalf("Limits should be unset %+v %v", limits, err)
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"memory/memory.limit_in_bytes":  "9223372036854771712\n",
+		"cpu,cpuacct/cpu.cfs_quota_us":  "200000\n",
+		"cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+	})
+	defer os.RemoveAll(root)
+	limits, err := Read(root)
+	if err != nil || limits.MemoryBytes != 0 || limits.CPUs != 2 {
+		t.Fatalf("Invalid limits %+v %v", limits, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "memory/memory.limit_in_bytes"), []byte("134217728\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "cpu,cpuacct/cpu.cfs_quota_us"), []byte("-1\n"), 0644)
+	if limits, err = Read(root); err != nil || limits.MemoryBytes != 128<<20 || limits.CPUs != 0 {
+		t.Fatalf("Invalid limits %+v %v", limits, err)
+	}
+}
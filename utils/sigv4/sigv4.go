@@ -0,0 +1,108 @@
+/*
+Package sigv4 signs requests to the AWS apis, and the S3 compatible
+object storages, with the AWS signature version 4.
+*/
+package sigv4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Signer holds the credentials and the scope of the signature
+type Signer struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+	Service      string
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+// Sign adds the signature headers to the request, body is the request
+// body. S3 requests get the x-amz-content-sha256 header it requires
+func (s *Signer) Sign(req *http.Request, body []byte) {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := HashHex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, s.Region, s.Service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		HashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// CanonicalQuery encodes the query as the signature expects it
+func CanonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// HashHex returns the hex encoded sha256 of the data
+func HashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -47,6 +47,11 @@ func (t *TaskQueue) Enqueue(obj interface{}) {
 	}
 }
 
+// Len returns the number of items waiting in the queue
+func (t *TaskQueue) Len() int {
+	return t.queue.Len()
+}
+
 func (t *TaskQueue) Requeue(key string, err error) {
 	logrus.Debugf("requeuing %v, err %v", key, err)
 	t.queue.Add(key)